@@ -4,6 +4,9 @@ package api
 // WARNING 2: useless to be removed
 
 import (
+	"syscall"
+	"time"
+
 	"github.com/toorop/tmail/core"
 )
 
@@ -15,8 +18,8 @@ func UserGetByLogin(login string) (user *core.User, err error) {
 }
 
 // UserAdd add a new usere
-func UserAdd(login, passwd, mbQuota string, haveMailbox, authRelay, isCatchall bool) error {
-	return core.UserAdd(login, passwd, mbQuota, haveMailbox, authRelay, isCatchall)
+func UserAdd(login, passwd, mbQuota, mbDriver string, haveMailbox, authRelay, isCatchall bool) error {
+	return core.UserAdd(login, passwd, mbQuota, mbDriver, haveMailbox, authRelay, isCatchall)
 }
 
 // UserDel delete an user (keep his mailboxe)
@@ -46,6 +49,157 @@ func AliasList() (aliases []core.Alias, err error) {
 	return core.AliasList()
 }
 
+// AliasAddVirtual adds a virtual alias (address or @domain catch-all)
+func AliasAddVirtual(address string, destinations []string) (core.Alias, error) {
+	return core.AliasAddVirtual(address, destinations)
+}
+
+// AliasExpand returns final recipients of address
+func AliasExpand(address string) ([]string, error) {
+	return core.AliasExpand(address)
+}
+
+// AddressRewriteAdd adds a rewrite rule (scope sender or recipient)
+func AddressRewriteAdd(scope, pattern, replacement string, priority int) (core.AddressRewrite, error) {
+	return core.AddressRewriteAdd(scope, pattern, replacement, priority)
+}
+
+// AddressRewriteDel removes a rewrite rule
+func AddressRewriteDel(id int64) error {
+	return core.AddressRewriteDel(id)
+}
+
+// AddressRewriteList returns rewrite rules
+func AddressRewriteList() ([]core.AddressRewrite, error) {
+	return core.AddressRewriteList()
+}
+
+// RewriteAddress returns address rewritten by rules of scope
+func RewriteAddress(scope, address string) string {
+	return core.RewriteAddress(scope, address)
+}
+
+// GROUP
+
+// MailGroupAdd adds a group
+func MailGroupAdd(group core.MailGroup) (core.MailGroup, error) {
+	return core.MailGroupAdd(group)
+}
+
+// MailGroupUpdate updates options of a group
+func MailGroupUpdate(address string, options core.MailGroup) (core.MailGroup, error) {
+	return core.MailGroupUpdate(address, options)
+}
+
+// MailGroupGet returns a group
+func MailGroupGet(address string) (core.MailGroup, error) {
+	return core.MailGroupGet(address)
+}
+
+// MailGroupDel removes a group and its members
+func MailGroupDel(address string) error {
+	return core.MailGroupDel(address)
+}
+
+// MailGroupList returns groups
+func MailGroupList() ([]core.MailGroup, error) {
+	return core.MailGroupList()
+}
+
+// MailGroupMembers returns members of a group
+func MailGroupMembers(address string) ([]core.MailGroupMember, error) {
+	return core.MailGroupMembers(address)
+}
+
+// MailGroupMemberAdd adds a member (or an owner) to a group
+func MailGroupMemberAdd(address, member string, isOwner bool) (core.MailGroupMember, error) {
+	return core.MailGroupMemberAdd(address, member, isOwner)
+}
+
+// MailGroupMemberDel removes a member of a group
+func MailGroupMemberDel(address, member string) error {
+	return core.MailGroupMemberDel(address, member)
+}
+
+// SIEVE
+
+// SieveScriptPut adds or replaces a sieve script of a user
+func SieveScriptPut(login, name, content string) (core.SieveScript, error) {
+	return core.SieveScriptPut(login, name, content)
+}
+
+// SieveScriptGet returns a sieve script of a user
+func SieveScriptGet(login, name string) (core.SieveScript, error) {
+	return core.SieveScriptGet(login, name)
+}
+
+// SieveScriptList returns sieve scripts of a user
+func SieveScriptList(login string) ([]core.SieveScript, error) {
+	return core.SieveScriptList(login)
+}
+
+// SieveScriptDel removes a sieve script of a user
+func SieveScriptDel(login, name string) error {
+	return core.SieveScriptDel(login, name)
+}
+
+// SieveScriptActivate activates a sieve script of a user ("" deactivates
+// them)
+func SieveScriptActivate(login, name string) error {
+	return core.SieveScriptActivate(login, name)
+}
+
+// SieveScriptCheck checks a sieve script
+func SieveScriptCheck(content string) error {
+	return core.SieveScriptCheck(content)
+}
+
+// VACATION
+
+// VacationSet sets vacation response of a mailbox
+func VacationSet(v core.Vacation) (core.Vacation, error) {
+	return core.VacationSet(v)
+}
+
+// VacationGet returns vacation response of a mailbox
+func VacationGet(login string) (core.Vacation, error) {
+	return core.VacationGet(login)
+}
+
+// VacationDel removes vacation response of a mailbox
+func VacationDel(login string) error {
+	return core.VacationDel(login)
+}
+
+// VacationList returns vacation responses
+func VacationList() ([]core.Vacation, error) {
+	return core.VacationList()
+}
+
+// JOURNAL
+
+// JournalRuleAdd adds a journal rule
+func JournalRuleAdd(rule core.JournalRule) (core.JournalRule, error) {
+	return core.JournalRuleAdd(rule)
+}
+
+// JournalRuleDel removes a journal rule
+func JournalRuleDel(id int64) error {
+	return core.JournalRuleDel(id)
+}
+
+// JournalRuleList returns journal rules
+func JournalRuleList() ([]core.JournalRule, error) {
+	return core.JournalRuleList()
+}
+
+// CLUSTER
+
+// ClusterStatus returns status of cluster nodes
+func ClusterStatus() ([]core.ClusterNodeStatus, error) {
+	return core.ClusterStatus()
+}
+
 /*
 // MAILBOXES
 
@@ -81,12 +235,45 @@ func RelayIpGetAll() (ips []core.RelayIpOk, err error) {
 	return core.RelayIpGetAll()
 }
 
+// RELAY POLICIES
+
+// RelayPolicySet sets relay policy of listener
+func RelayPolicySet(listener, policy string) (*core.RelayPolicy, error) {
+	return core.RelayPolicySet(listener, policy)
+}
+
+// RelayPolicyDel removes relay policy of listener
+func RelayPolicyDel(listener string) error {
+	return core.RelayPolicyDel(listener)
+}
+
+// RelayPolicyList returns relay policies of listeners
+func RelayPolicyList() ([]core.RelayPolicy, error) {
+	return core.RelayPolicyGetAll()
+}
+
+// RelayLoginAdd records a POP/IMAP login (POP/IMAP-before-SMTP)
+func RelayLoginAdd(ip, login string) error {
+	return core.RelayLoginAdd(ip, login)
+}
+
+// RelayLoginList returns POP/IMAP logins whose IP can relay
+func RelayLoginList() ([]core.RelayLogin, error) {
+	return core.RelayLoginGetAll()
+}
+
 // Queue
 // QueueGetMessages returns all message in queue
 func QueueGetMessages() ([]core.QMessage, error) {
 	return core.QueueListMessages()
 }
 
+// QueueInject puts a message in queue, it will not be delivered before sendAt
+// (zero: now)
+func QueueInject(rawMess []byte, mailFrom string, rcptTo []string, sendAt time.Time) (string, error) {
+	return core.QueueInject(rawMess, mailFrom, rcptTo, sendAt)
+}
+
 // QueueGetMessage return a message by its id
 func QueueGetMessage(id int64) (core.QMessage, error) {
 	return core.QueueGetMessageById(id)
@@ -110,6 +297,74 @@ func QueueBounceMsg(id int64) error {
 	return m.Bounce()
 }
 
+// QueueFreeze freezes outbound delivery of messages matching scope (all,
+// domain, user or host) & value
+func QueueFreeze(scope, value, reason string) (core.QueueFreeze, error) {
+	return core.QueueFreezeAdd(scope, value, reason)
+}
+
+// QueueFreezeList returns freezes
+func QueueFreezeList() ([]core.QueueFreeze, error) {
+	return core.QueueFreezeList()
+}
+
+// QueueUnfreeze removes freeze id and returns the number of requeued
+// messages
+func QueueUnfreeze(id int64) (int, error) {
+	return core.QueueFreezeDel(id)
+}
+
+// QueueThaw requeues frozen messages matching filter, they are delivered
+// even if they match a freeze
+func QueueThaw(filter core.QueueThawFilter) (int, error) {
+	return core.QueueThaw(filter, true)
+}
+
+// QueueHold puts messages of target (message ID or destination domain) on
+// hold and returns the number of held messages
+func QueueHold(target string) (int, error) {
+	return core.QueueHold(target)
+}
+
+// QueueRelease releases messages of target (message ID or destination
+// domain) on hold and returns the number of released messages
+func QueueRelease(target string) (int, error) {
+	return core.QueueRelease(target)
+}
+
+// QueueFlush forces an immediate delivery attempt of messages of target
+// (message ID or destination domain) and returns the number of flushed
+// messages
+func QueueFlush(target string) (int, error) {
+	return core.QueueFlush(target)
+}
+
+// QueueBounce bounces now messages of target (message ID or destination
+// domain) and returns the number of bounced messages
+func QueueBounce(target string) (int, error) {
+	return core.QueueBounce(target)
+}
+
+// QueueRedirect redirects queued message id to rcptTo
+func QueueRedirect(id int64, rcptTo, operator string) (core.RedirectAudit, error) {
+	return core.QueueRedirect(id, rcptTo, operator)
+}
+
+// BouncedList returns bounced messages kept for redirection
+func BouncedList() ([]core.BouncedMessage, error) {
+	return core.BouncedList()
+}
+
+// BouncedRedirect redirects bounced message id to rcptTo
+func BouncedRedirect(id int64, rcptTo, operator string) (core.RedirectAudit, error) {
+	return core.BouncedRedirect(id, rcptTo, operator)
+}
+
+// RedirectAuditList returns redirections
+func RedirectAuditList() ([]core.RedirectAudit, error) {
+	return core.RedirectAuditList()
+}
+
 // ROUTES
 // RoutesGet returns all routes
 func RoutesGet() ([]core.Route, error) {
@@ -117,8 +372,8 @@ func RoutesGet() ([]core.Route, error) {
 }
 
 // RoutesAdd adds en new route
-func RoutesAdd(host, localIp, remoteHost string, remotePort, priority int, user, mailFrom, smtpAuthLogin, smtpAuthPasswd string) error {
-	return core.AddRoute(host, localIp, remoteHost, remotePort, priority, user, mailFrom, smtpAuthLogin, smtpAuthPasswd)
+func RoutesAdd(host, localIp, remoteHost string, remotePort, priority int, user, mailFrom, smtpAuthLogin, smtpAuthPasswd, forwardClient, retrySchedule, proxy, smtpAuthMech string, weight int, mxFallback bool, ipFamily, timeouts string) error {
+	return core.AddRoute(host, localIp, remoteHost, remotePort, priority, user, mailFrom, smtpAuthLogin, smtpAuthPasswd, forwardClient, retrySchedule, proxy, smtpAuthMech, weight, mxFallback, ipFamily, timeouts)
 }
 
 // RoutesDel delete route routeId
@@ -126,6 +381,34 @@ func RoutesDel(routeId int64) error {
 	return core.DelRoute(routeId)
 }
 
+// RoutesHealth returns health of routes
+func RoutesHealth() ([]core.RouteHealth, error) {
+	return core.RouteHealthList()
+}
+
+// RoutesHealthReset resets health of route routeId
+func RoutesHealthReset(routeId int64) error {
+	return core.RouteHealthReset(routeId)
+}
+
+// RoutesTest returns the routing decision of a message from sender to
+// recipient, route is probed (EHLO & STARTTLS) if probe is true
+func RoutesTest(sender, recipient, authUser string, probe bool) (*core.RouteDryRun, error) {
+	return core.RouteDryRunOf(sender, recipient, authUser, probe)
+}
+
+// RoutesPlanDiff validates plan and returns destinations whose routes would
+// change
+func RoutesPlanDiff(plan core.RoutePlan) ([]core.RouteChange, error) {
+	return core.RoutePlanDiff(plan)
+}
+
+// RoutesPlanApply applies plan atomically, it's rolled back if probe is
+// true and a canary probe fails
+func RoutesPlanApply(plan core.RoutePlan, probe bool) ([]core.RouteChange, error) {
+	return core.RoutePlanApply(plan, probe)
+}
+
 // RCPTHOSTS ie locals domains
 
 // RcptHostAdd add a rcpthost
@@ -160,3 +443,376 @@ func DkimDisable(domain string) error {
 func DkimGetConfig(domain string) (dkimConfig *core.DkimConfig, err error) {
 	return core.DkimGetConfig(domain)
 }
+
+// DkimRotate replaces DKIM keys and selector of domain domain
+func DkimRotate(domain string) (dkimConfig *core.DkimConfig, oldSelector string, err error) {
+	return core.DkimRotate(domain)
+}
+
+// DkimSetOptions sets DKIM canonicalization and signed headers for domain
+func DkimSetOptions(domain, canonicalization, headers string) error {
+	return core.DkimSetOptions(domain, canonicalization, headers)
+}
+
+// BATV
+
+// BatvEnable enables BATV on domain
+func BatvEnable(domain string) (*core.BatvDomain, error) {
+	return core.BatvEnable(domain)
+}
+
+// BatvDisable disables BATV on domain
+func BatvDisable(domain string) error {
+	return core.BatvDisable(domain)
+}
+
+// BatvRotate replaces key of domain
+func BatvRotate(domain string) (*core.BatvDomain, error) {
+	return core.BatvRotate(domain)
+}
+
+// BatvList returns domains with BATV enabled
+func BatvList() ([]core.BatvDomain, error) {
+	return core.BatvGetAll()
+}
+
+// MONITOR
+
+// MonitorGetStats returns self monitoring counters
+func MonitorGetStats() core.MonitorStats {
+	return core.MonitorGetStats()
+}
+
+// MetricsHistory returns rollups of delivery & rejection counters between
+// from and to (tier: raw, hourly, daily or "" for auto)
+func MetricsHistory(kind, tier string, from, to time.Time) ([]core.MetricsRollup, error) {
+	return core.MetricsHistory(kind, tier, from, to)
+}
+
+// QUARANTINE
+
+// QuarantineList returns quarantined messages
+func QuarantineList() ([]core.QuarantinedMessage, error) {
+	return core.QuarantineList()
+}
+
+// QuarantineGet returns a quarantined message
+func QuarantineGet(id int64) (core.QuarantinedMessage, error) {
+	return core.QuarantineGet(id)
+}
+
+// QuarantineHeaders returns headers of a quarantined message
+func QuarantineHeaders(id int64) (string, error) {
+	return core.QuarantineHeaders(id)
+}
+
+// QuarantineRelease queues quarantined message for delivery
+func QuarantineRelease(id int64) (queueId string, err error) {
+	return core.QuarantineRelease(id)
+}
+
+// QuarantineDel deletes quarantined message
+func QuarantineDel(id int64) error {
+	return core.QuarantineDel(id)
+}
+
+// SHADOW
+
+// ShadowGetStats returns comparison reports of checks in shadow mode
+func ShadowGetStats() map[string]core.ShadowCheckStats {
+	return core.ShadowGetStats()
+}
+
+// ShadowResetStats resets comparison reports of checks in shadow mode
+func ShadowResetStats() {
+	core.ShadowResetStats()
+}
+
+// DMARC
+
+// DmarcReportsPreview returns pending DMARC aggregate reports
+func DmarcReportsPreview(domain string) (map[string]string, error) {
+	return core.DmarcReportsPreview(domain)
+}
+
+// REPLAY
+
+// ReplayQuarantine replays quarantined messages through current filters
+func ReplayQuarantine(ids []int64) ([]core.ReplayResult, error) {
+	return core.ReplayQuarantine(ids)
+}
+
+// ReplayDir replays messages stored in dir through current filters
+func ReplayDir(dir, disposition string) ([]core.ReplayResult, error) {
+	return core.ReplayDir(dir, disposition)
+}
+
+// RSPAMD
+
+// RspamdLearn submits raw message to rspamd as spam or ham
+func RspamdLearn(raw []byte, spam bool) error {
+	return core.RspamdLearn(raw, spam)
+}
+
+// RspamdLearnQuarantined submits quarantined message to rspamd as spam or
+// ham
+func RspamdLearnQuarantined(id int64, spam bool) error {
+	return core.RspamdLearnQuarantined(id, spam)
+}
+
+// GREYLIST
+
+// GreylistList returns greylisted triplets
+func GreylistList() ([]core.GreylistTriplet, error) {
+	return core.GreylistList()
+}
+
+// GreylistFlush removes expired triplets (all if all is true)
+func GreylistFlush(all bool) error {
+	return core.GreylistFlush(all)
+}
+
+// GreylistWhitelistAdd whitelists network
+func GreylistWhitelistAdd(network string) error {
+	return core.GreylistWhitelistAdd(network)
+}
+
+// GreylistWhitelistDel removes network from whitelist
+func GreylistWhitelistDel(network string) error {
+	return core.GreylistWhitelistDel(network)
+}
+
+// GreylistWhitelistList returns whitelisted networks
+func GreylistWhitelistList() ([]core.GreylistWhitelist, error) {
+	return core.GreylistWhitelistList()
+}
+
+// THROTTLE
+
+// ThrottleGetStats returns connections & sessions counters
+func ThrottleGetStats() core.ThrottleStats {
+	return core.ThrottleGetStats()
+}
+
+// ThrottleCounters returns messages counters of current hour
+func ThrottleCounters() ([]core.ThrottleCounter, error) {
+	return core.ThrottleCounters()
+}
+
+// ThrottleCounterReset resets messages counters of sender
+func ThrottleCounterReset(sender string) error {
+	return core.ThrottleCounterReset(sender)
+}
+
+// ThrottleLimitSet sets throttling limits of user
+func ThrottleLimitSet(login string, msgsPerHour, maxRcpt, maxSessions int) error {
+	return core.ThrottleLimitSet(login, msgsPerHour, maxRcpt, maxSessions)
+}
+
+// ThrottleLimitDel removes throttling limits of user
+func ThrottleLimitDel(login string) error {
+	return core.ThrottleLimitDel(login)
+}
+
+// ThrottleLimitList returns throttling limits of users
+func ThrottleLimitList() ([]core.ThrottleLimit, error) {
+	return core.ThrottleLimitList()
+}
+
+// SENDING QUOTAS
+
+// SendingStatusList returns sending status (quotas, counters of the day,
+// reputation) of authenticated users
+func SendingStatusList() ([]core.SendingStatus, error) {
+	return core.SendingStatusList()
+}
+
+// SendingStatusOf returns sending status of user
+func SendingStatusOf(login string) (core.SendingStatus, error) {
+	return core.SendingStatusOf(login)
+}
+
+// SendingQuotaSet sets sending quotas of user (0: global quota)
+func SendingQuotaSet(login string, msgsPerDay, rcptsPerDay int, bytesPerDay int64) error {
+	return core.SendingQuotaSet(login, msgsPerDay, rcptsPerDay, bytesPerDay)
+}
+
+// SendingReset resets sending counters of user and lifts their suspension
+func SendingReset(login string) error {
+	return core.SendingReset(login)
+}
+
+// HEADER RULES
+
+// HeaderRuleAdd adds a header rule
+func HeaderRuleAdd(rule core.HeaderRule) (core.HeaderRule, error) {
+	return core.HeaderRuleAdd(rule)
+}
+
+// HeaderRuleDel removes a header rule
+func HeaderRuleDel(id int64) error {
+	return core.HeaderRuleDel(id)
+}
+
+// HeaderRuleList returns header rules
+func HeaderRuleList() ([]core.HeaderRule, error) {
+	return core.HeaderRuleList()
+}
+
+// HeaderRulesReload asks tmail daemon to reload header rules (SIGHUP)
+func HeaderRulesReload() error {
+	return core.SignalDaemon(syscall.SIGHUP)
+}
+
+// MESSAGE TRACE
+
+// MessageTrace returns events of message id (queue id or Message-ID)
+func MessageTrace(id string) ([]core.MessageTimeline, error) {
+	return core.MessageTrace(id)
+}
+
+// MessageTraceSearch returns events of messages matching query
+func MessageTraceSearch(query core.MessageTraceQuery) ([]core.MessageTimeline, error) {
+	return core.MessageTraceSearch(query)
+}
+
+// DELIVERY POLICIES
+
+// DeliveryPolicySet adds or updates delivery policy of a destination domain
+func DeliveryPolicySet(domain string, maxConns, maxMsgsPerConn, msgsPerMinute int, backoffMultiplier float64, retrySchedule string) error {
+	return core.DeliveryPolicySet(domain, maxConns, maxMsgsPerConn, msgsPerMinute, backoffMultiplier, retrySchedule)
+}
+
+// DeliveryPolicyDel removes delivery policy of a destination domain
+func DeliveryPolicyDel(domain string) error {
+	return core.DeliveryPolicyDel(domain)
+}
+
+// DeliveryPolicyList returns delivery policies
+func DeliveryPolicyList() ([]core.DeliveryPolicy, error) {
+	return core.DeliveryPolicyList()
+}
+
+// DIGESTS
+
+// DigestSubscribe subscribes a domain to digests
+func DigestSubscribe(domain, frequency string, recipients []string) error {
+	return core.DigestSubscribe(domain, frequency, recipients)
+}
+
+// DigestUnsubscribe unsubscribes a domain from digests
+func DigestUnsubscribe(domain string) error {
+	return core.DigestUnsubscribe(domain)
+}
+
+// DigestSubscriptionList returns subscriptions to digests
+func DigestSubscriptionList() ([]core.DigestSubscription, error) {
+	return core.DigestSubscriptionList()
+}
+
+// DigestPreview returns the digest of a domain for the current period
+func DigestPreview(domain string) ([]byte, error) {
+	return core.DigestPreview(domain)
+}
+
+// CONFIGURATION BUNDLES
+
+// ConfigBundleExport returns current configuration as bundle version
+func ConfigBundleExport(version int64) (core.ConfigBundle, error) {
+	return core.ConfigBundleExport(version)
+}
+
+// ConfigBundleSign signs JSON bundle with PEM RSA private key
+func ConfigBundleSign(payload, privateKeyPem []byte) (core.SignedConfigBundle, error) {
+	return core.ConfigBundleSign(payload, privateKeyPem)
+}
+
+// ConfigBundleApply fetches, verifies and applies bundle from source
+func ConfigBundleApply(source string, force bool) (bool, error) {
+	return core.ConfigBundleApply(source, force)
+}
+
+// ConfigBundleRollback applies again the previous bundle
+func ConfigBundleRollback() (int64, error) {
+	return core.ConfigBundleRollback()
+}
+
+// ConfigBundleHistoryList returns applied bundles
+func ConfigBundleHistoryList() ([]core.ConfigBundleHistory, error) {
+	return core.ConfigBundleHistoryList()
+}
+
+// WEBHOOKS
+
+// WebhookAdd registers a webhook for events (none: all)
+func WebhookAdd(scope, target, url, secret string, events []string) (core.Webhook, error) {
+	return core.WebhookAdd(scope, target, url, secret, events)
+}
+
+// WebhookDel removes a webhook
+func WebhookDel(id int64) error {
+	return core.WebhookDel(id)
+}
+
+// WebhookList returns registered webhooks
+func WebhookList() ([]core.Webhook, error) {
+	return core.WebhookList()
+}
+
+// TLS
+
+// TLSCertificateAdd stores certificate & key (PEM) in DB for SNI
+func TLSCertificateAdd(certPem, keyPem []byte) (core.TLSCertificate, error) {
+	return core.TLSCertificateAdd(certPem, keyPem)
+}
+
+// TLSCertificateDel removes certificate of domain from DB
+func TLSCertificateDel(domain string) error {
+	return core.TLSCertificateDel(domain)
+}
+
+// TLSCertificateList loads and returns certificates presented by smtpd
+// (directory & DB)
+func TLSCertificateList() ([]core.TLSCertInfo, error) {
+	return core.TLSCertsReload()
+}
+
+// TLSReload asks tmail daemon to reload certificates (SIGHUP)
+func TLSReload() error {
+	return core.SignalDaemon(syscall.SIGHUP)
+}
+
+// CONFIG
+
+// ConfigCheck validates config file and checks schema of its DB
+func ConfigCheck() error {
+	return core.ConfigCheck()
+}
+
+// ConfigReload validates config file and asks tmail daemon to reload it
+// (SIGHUP)
+func ConfigReload() error {
+	if err := core.ConfigCheck(); err != nil {
+		return err
+	}
+	return core.SignalDaemon(syscall.SIGHUP)
+}
+
+// Restart validates config file and asks tmail daemon to restart (SIGUSR2):
+// the executable is started with listeners of the daemon, which exits once
+// it serves
+func Restart() error {
+	if err := core.ConfigCheck(); err != nil {
+		return err
+	}
+	return core.SignalDaemon(syscall.SIGUSR2)
+}
+
+// BOUNCES
+
+// BouncesPreview renders notification kind (bounce, delay or over_quota)
+// sent to sender about a message to rcpt which failed with errMsg (raw is
+// the failed message, a sample if nil)
+func BouncesPreview(kind, sender, rcpt, errMsg, lang string, raw []byte) ([]byte, error) {
+	return core.NotificationPreview(kind, sender, rcpt, errMsg, lang, raw)
+}
@@ -1,6 +1,8 @@
 package cli
 
 import (
+	"fmt"
+	"strconv"
 	"strings"
 
 	cgCli "github.com/codegangsta/cli"
@@ -61,7 +63,11 @@ var alias = cgCli.Command{
 					println("there is no alias defined")
 				} else {
 					for _, alias := range aliases {
-						println(alias.Alias)
+						if alias.IsVirtual {
+							println(alias.Alias + " (virtual)")
+						} else {
+							println(alias.Alias)
+						}
 						if alias.Pipe != "" {
 							println("\tPipe: " + alias.Pipe)
 						}
@@ -73,6 +79,94 @@ var alias = cgCli.Command{
 				}
 				cliDieOk()
 			},
+		}, {
+			Name:        "virtual-add",
+			Usage:       "Add a virtual alias (@domain for a catch-all) to one or more addresses",
+			Description: "tmail alias virtual-add ALIAS|@DOMAIN DESTINATION [DESTINATION...]",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) < 2 {
+					cliDieBadArgs(c)
+				}
+				_, err := api.AliasAddVirtual(c.Args()[0], c.Args()[1:])
+				cliHandleErr(err)
+				cliDieOk()
+			},
+		}, {
+			Name:        "expand",
+			Usage:       "Display final recipients of an address (virtual aliases expansion)",
+			Description: "tmail alias expand ADDRESS",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				rcpts, err := api.AliasExpand(c.Args()[0])
+				cliHandleErr(err)
+				for _, rcpt := range rcpts {
+					println(rcpt)
+				}
+				cliDieOk()
+			},
+		}, {
+			Name:        "rewrite-add",
+			Usage:       "Add a rewrite rule of sender or recipient addresses (regexp)",
+			Description: "tmail alias rewrite-add [--priority N] sender|recipient PATTERN REPLACEMENT",
+			Flags: []cgCli.Flag{
+				cgCli.IntFlag{
+					Name:  "priority, p",
+					Value: 0,
+					Usage: "rules are tried by priority (lowest first)",
+				},
+			},
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 3 {
+					cliDieBadArgs(c)
+				}
+				rule, err := api.AddressRewriteAdd(c.Args()[0], c.Args()[1], c.Args()[2], c.Int("priority"))
+				cliHandleErr(err)
+				println(fmt.Sprintf("Rewrite rule %d added", rule.Id))
+				cliDieOk()
+			},
+		}, {
+			Name:        "rewrite-del",
+			Usage:       "Delete a rewrite rule",
+			Description: "tmail alias rewrite-del ID",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				id, err := strconv.ParseInt(c.Args()[0], 10, 64)
+				if err != nil {
+					cliDieBadArgs(c)
+				}
+				cliHandleErr(api.AddressRewriteDel(id))
+				cliDieOk()
+			},
+		}, {
+			Name:        "rewrite-list",
+			Usage:       "List rewrite rules",
+			Description: "tmail alias rewrite-list",
+			Action: func(c *cgCli.Context) {
+				rules, err := api.AddressRewriteList()
+				cliHandleErr(err)
+				if len(rules) == 0 {
+					println("There is no rewrite rule.")
+				}
+				for _, rule := range rules {
+					println(fmt.Sprintf("%d - %s %s -> %s (priority %d)", rule.Id, rule.Scope, rule.Pattern, rule.Replacement, rule.Priority))
+				}
+				cliDieOk()
+			},
+		}, {
+			Name:        "rewrite-test",
+			Usage:       "Display an address rewritten by rules",
+			Description: "tmail alias rewrite-test sender|recipient ADDRESS",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 2 {
+					cliDieBadArgs(c)
+				}
+				println(api.RewriteAddress(strings.ToLower(c.Args()[0]), c.Args()[1]))
+				cliDieOk()
+			},
 		},
 	},
 }
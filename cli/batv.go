@@ -0,0 +1,68 @@
+package cli
+
+import (
+	"fmt"
+	"time"
+
+	cgCli "github.com/codegangsta/cli"
+	"github.com/toorop/tmail/api"
+)
+
+var batv = cgCli.Command{
+	Name:  "batv",
+	Usage: "commands to manage BATV (tagging of senders, rejection of backscatter)",
+	Subcommands: []cgCli.Command{
+		{
+			Name:        "enable",
+			Usage:       "Tag senders of domain DOMAIN and reject bounces to untagged addresses of DOMAIN",
+			Description: "tmail batv enable DOMAIN",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				_, err := api.BatvEnable(c.Args().First())
+				cliHandleErr(err)
+				cliDieOk()
+			},
+		}, {
+			Name:        "disable",
+			Usage:       "Disable BATV on domain DOMAIN",
+			Description: "tmail batv disable DOMAIN",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				cliHandleErr(api.BatvDisable(c.Args().First()))
+				cliDieOk()
+			},
+		}, {
+			Name:        "rotate",
+			Usage:       "Replace now the key of domain DOMAIN (keys are replaced automatically)",
+			Description: "tmail batv rotate DOMAIN",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				b, err := api.BatvRotate(c.Args().First())
+				cliHandleErr(err)
+				fmt.Printf("Senders of %s are now tagged with key %d, tags of key %d are still valid.\n", b.Domain, b.KeyNumber, (b.KeyNumber+9)%10)
+				cliDieOk()
+			},
+		}, {
+			Name:        "list",
+			Usage:       "List domains with BATV enabled",
+			Description: "tmail batv list",
+			Action: func(c *cgCli.Context) {
+				domains, err := api.BatvList()
+				cliHandleErr(err)
+				if len(domains) == 0 {
+					println("BATV is not enabled on any domain.")
+				}
+				for _, b := range domains {
+					fmt.Printf("%s - key %d since %s - enabled %s\n", b.Domain, b.KeyNumber, b.RotatedAt.Format(time.RFC3339), b.EnabledAt.Format(time.RFC3339))
+				}
+				cliDieOk()
+			},
+		},
+	},
+}
@@ -0,0 +1,68 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+
+	cgCli "github.com/codegangsta/cli"
+	"github.com/toorop/tmail/api"
+)
+
+var bounces = cgCli.Command{
+	Name:  "bounces",
+	Usage: "commands to manage notifications (bounces, delay warnings, over quota)",
+	Subcommands: []cgCli.Command{
+		{
+			Name:        "preview",
+			Usage:       "Render a notification template against a sample failed message",
+			Description: "tmail bounces preview [-k bounce|delay|over_quota] [-f SENDER] [-r RECIPIENT] [-e ERROR] [-l LANG] [-m MESSAGE_FILE]",
+			Flags: []cgCli.Flag{
+				cgCli.StringFlag{
+					Name:  "kind, k",
+					Value: "bounce",
+					Usage: "notification: bounce, delay or over_quota",
+				},
+				cgCli.StringFlag{
+					Name:  "from, f",
+					Value: "sender@example.com",
+					Usage: "sender of the failed message (notified address)",
+				},
+				cgCli.StringFlag{
+					Name:  "rcpt, r",
+					Value: "recipient@example.net",
+					Usage: "recipient of the failed message",
+				},
+				cgCli.StringFlag{
+					Name:  "error, e",
+					Value: "550 5.1.1 <recipient@example.net>: Recipient address rejected: User unknown",
+					Usage: "error of the delivery",
+				},
+				cgCli.StringFlag{
+					Name:  "lang, l",
+					Value: "",
+					Usage: "language of the template (default: language of the sender domain)",
+				},
+				cgCli.StringFlag{
+					Name:  "message, m",
+					Value: "",
+					Usage: "file of the failed message (default: a sample message)",
+				},
+			},
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 0 {
+					cliDieBadArgs(c)
+				}
+				var raw []byte
+				if c.String("m") != "" {
+					var err error
+					raw, err = ioutil.ReadFile(c.String("m"))
+					cliHandleErr(err)
+				}
+				notification, err := api.BouncesPreview(c.String("k"), c.String("f"), c.String("r"), c.String("e"), c.String("l"), raw)
+				cliHandleErr(err)
+				os.Stdout.Write(notification)
+				cliDieOk()
+			},
+		},
+	},
+}
@@ -0,0 +1,113 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	cgCli "github.com/codegangsta/cli"
+	"github.com/toorop/tmail/api"
+)
+
+var bundle = cgCli.Command{
+	Name:  "bundle",
+	Usage: "commands to manage signed configuration bundles (routes, delivery policies, throttle limits, greylist whitelist)",
+	Subcommands: []cgCli.Command{
+		{
+			Name:        "export",
+			Usage:       "Export current configuration as a bundle (JSON)",
+			Description: "tmail bundle export VERSION",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				version, err := strconv.ParseInt(c.Args()[0], 10, 64)
+				if err != nil {
+					cliDieBadArgs(c)
+				}
+				b, err := api.ConfigBundleExport(version)
+				cliHandleErr(err)
+				js, err := json.MarshalIndent(b, "", "  ")
+				cliHandleErr(err)
+				fmt.Printf("%s\n", js)
+				os.Exit(0)
+			},
+		},
+		{
+			Name:        "sign",
+			Usage:       "Sign a bundle with a RSA private key (PEM)",
+			Description: "tmail bundle sign PRIVATE_KEY_FILE BUNDLE_FILE",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 2 {
+					cliDieBadArgs(c)
+				}
+				key, err := ioutil.ReadFile(c.Args()[0])
+				cliHandleErr(err)
+				payload, err := ioutil.ReadFile(c.Args()[1])
+				cliHandleErr(err)
+				signed, err := api.ConfigBundleSign(payload, key)
+				cliHandleErr(err)
+				js, err := json.Marshal(signed)
+				cliHandleErr(err)
+				fmt.Printf("%s\n", js)
+				os.Exit(0)
+			},
+		},
+		{
+			Name:        "apply",
+			Usage:       "Verify and apply a signed bundle (HTTPS URL or file)",
+			Description: "tmail bundle apply [-f] URL|FILE",
+			Flags: []cgCli.Flag{
+				cgCli.BoolFlag{
+					Name:  "force, f",
+					Usage: "apply bundle even if it's not newer than the current one",
+				},
+			},
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				applied, err := api.ConfigBundleApply(c.Args()[0], c.Bool("f"))
+				cliHandleErr(err)
+				if !applied {
+					println("Bundle is already applied.")
+					os.Exit(0)
+				}
+				cliDieOk()
+			},
+		},
+		{
+			Name:        "rollback",
+			Usage:       "Apply again the bundle applied before the current one",
+			Description: "tmail bundle rollback",
+			Action: func(c *cgCli.Context) {
+				version, err := api.ConfigBundleRollback()
+				cliHandleErr(err)
+				fmt.Printf("Bundle version %d applied.\r\n", version)
+				os.Exit(0)
+			},
+		},
+		{
+			Name:        "history",
+			Usage:       "List applied bundles",
+			Description: "tmail bundle history",
+			Action: func(c *cgCli.Context) {
+				history, err := api.ConfigBundleHistoryList()
+				cliHandleErr(err)
+				if len(history) == 0 {
+					println("No bundle has been applied.")
+				}
+				for _, h := range history {
+					rolledBack := ""
+					if h.RolledBack {
+						rolledBack = " - rolled back"
+					}
+					fmt.Printf("%d - version %d - sha256 %s - from %s - applied at %v%s\r\n", h.Id, h.Version, h.Sha256, h.Source, h.AppliedAt, rolledBack)
+				}
+				os.Exit(0)
+			},
+		},
+	},
+}
@@ -7,13 +7,37 @@ import (
 // CliCommands is a slice of subcomands
 var CliCommands = []cgCli.Command{
 	alias,
+	group,
+	sieve,
+	vacation,
+	journal,
+	headers,
+	trace,
+	cluster,
 	Queue,
 	Routes,
 	user,
 	Rcpthost,
 	RelayIP,
+	relay,
 	//Mailbox,
 	Dkim,
+	batv,
+	quarantine,
+	dmarc,
+	replay,
+	rspamd,
+	greylist,
+	throttle,
+	sending,
+	policy,
+	digest,
+	bundle,
+	bounces,
+	tlsCerts,
+	config,
+	reload,
+	restart,
 }
 
 var cliCommandHelpTemplate = `NAME:
@@ -0,0 +1,43 @@
+package cli
+
+import (
+	"fmt"
+	"time"
+
+	cgCli "github.com/codegangsta/cli"
+	"github.com/toorop/tmail/api"
+)
+
+var cluster = cgCli.Command{
+	Name:  "cluster",
+	Usage: "commands to manage cluster",
+	Subcommands: []cgCli.Command{
+		{
+			Name:        "status",
+			Usage:       "Show nodes of cluster, their share of the queue and their throughput",
+			Description: "tmail cluster status",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 0 {
+					cliDieBadArgs(c)
+				}
+				nodes, err := api.ClusterStatus()
+				cliHandleErr(err)
+				if len(nodes) == 0 {
+					println("There is no cluster node.")
+				}
+				for _, n := range nodes {
+					state, nsq := "alive", "ok"
+					if !n.Alive {
+						state = "DEAD"
+					}
+					if !n.NsqOk {
+						nsq = "KO"
+					}
+					println(fmt.Sprintf("%s (%s, role %s, version %s) - %s - heartbeat %s ago - nsq %s", n.NodeId, n.Hostname, n.Role, n.Version, state, time.Since(n.HeartbeatAt)/time.Second*time.Second, nsq))
+					println(fmt.Sprintf("\tin delivery: %d (%.1f%% of the queue in delivery) - throughput: %.1f msg/min - since %s: %d delivered, %d deferred, %d bounced", n.InDelivery, n.Share, n.Throughput, n.StartedAt.Format(time.RFC3339), n.Delivered, n.Deferred, n.Bounced))
+				}
+				cliDieOk()
+			},
+		},
+	},
+}
@@ -0,0 +1,56 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	cgCli "github.com/codegangsta/cli"
+	"github.com/toorop/tmail/api"
+	"github.com/toorop/tmail/core"
+)
+
+var config = cgCli.Command{
+	Name:  "config",
+	Usage: "commands to check configuration",
+	Subcommands: []cgCli.Command{
+		{
+			Name:        "check",
+			Usage:       "Validate config file and schema of its DB without starting tmail",
+			Description: "tmail config check",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 0 {
+					cliDieBadArgs(c)
+				}
+				cliHandleErr(api.ConfigCheck())
+				fmt.Printf("%s is valid.\r\n", core.ConfigFile())
+				os.Exit(0)
+			},
+		},
+	},
+}
+
+var restart = cgCli.Command{
+	Name:        "restart",
+	Usage:       "Validate config file and restart running tmail without dropping connections (SIGUSR2), eg: after an upgrade",
+	Description: "tmail restart",
+	Action: func(c *cgCli.Context) {
+		if len(c.Args()) != 0 {
+			cliDieBadArgs(c)
+		}
+		cliHandleErr(api.Restart())
+		cliDieOk()
+	},
+}
+
+var reload = cgCli.Command{
+	Name:        "reload",
+	Usage:       "Validate config file and reload it (and TLS certificates, header rules) in running tmail (SIGHUP)",
+	Description: "tmail reload",
+	Action: func(c *cgCli.Context) {
+		if len(c.Args()) != 0 {
+			cliDieBadArgs(c)
+		}
+		cliHandleErr(api.ConfigReload())
+		cliDieOk()
+	},
+}
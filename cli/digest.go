@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	cgCli "github.com/codegangsta/cli"
+	"github.com/toorop/tmail/api"
+)
+
+var digest = cgCli.Command{
+	Name:  "digest",
+	Usage: "commands to manage digests for domain administrators",
+	Subcommands: []cgCli.Command{
+		{
+			Name:        "subscribe",
+			Usage:       "Subscribe a domain to digests",
+			Description: "tmail digest subscribe DOMAIN -t ADDRESS[;ADDRESS] [-f daily|weekly]",
+			Flags: []cgCli.Flag{
+				cgCli.StringFlag{
+					Name:  "to, t",
+					Value: "",
+					Usage: "recipients of digests separated by ;",
+				},
+				cgCli.StringFlag{
+					Name:  "frequency, f",
+					Value: "weekly",
+					Usage: "daily or weekly",
+				},
+			},
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 || c.String("t") == "" {
+					cliDieBadArgs(c)
+				}
+				cliHandleErr(api.DigestSubscribe(c.Args()[0], c.String("f"), strings.Split(c.String("t"), ";")))
+				cliDieOk()
+			},
+		},
+		{
+			Name:        "unsubscribe",
+			Usage:       "Unsubscribe a domain from digests",
+			Description: "tmail digest unsubscribe DOMAIN",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				cliHandleErr(api.DigestUnsubscribe(c.Args()[0]))
+				cliDieOk()
+			},
+		},
+		{
+			Name:        "list",
+			Usage:       "List domains subscribed to digests",
+			Description: "tmail digest list",
+			Action: func(c *cgCli.Context) {
+				subscriptions, err := api.DigestSubscriptionList()
+				cliHandleErr(err)
+				if len(subscriptions) == 0 {
+					println("There is no domain subscribed to digests.")
+				}
+				for _, s := range subscriptions {
+					fmt.Printf("%s - %s - to: %s - last sent at: %v\r\n", s.Domain, s.Frequency, s.Recipients, s.LastSentAt)
+				}
+				os.Exit(0)
+			},
+		},
+		{
+			Name:        "preview",
+			Usage:       "Preview the digest of a domain for the current period",
+			Description: "tmail digest preview DOMAIN",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				digest, err := api.DigestPreview(c.Args()[0])
+				cliHandleErr(err)
+				fmt.Printf("%s\r\n", digest)
+				os.Exit(0)
+			},
+		},
+	},
+}
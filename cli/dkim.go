@@ -16,13 +16,16 @@ var Dkim = cgCli.Command{
 		{
 			Name:        "enable",
 			Usage:       "Activate DKIM on domain DOMAIN",
-			Description: "To enable DKIM on domain DOMAIN:\n\ttmail dkim enable DOMAIN",
+			Description: "To enable DKIM on domain DOMAIN:\n\ttmail dkim enable DOMAIN [-c CANONICALIZATION] [-H HEADERS]",
+			Flags:       dkimOptionsFlags,
 			Action: func(c *cgCli.Context) {
 				if len(c.Args()) != 1 {
 					cliDieBadArgs(c)
 				}
 				dkc, err := api.DkimEnable(c.Args().First())
 				cliHandleErr(err)
+				err = api.DkimSetOptions(c.Args().First(), c.String("c"), c.String("H"))
+				cliHandleErr(err)
 				println("Done !")
 				fmt.Printf("It remains for you to create this TXT record on %s._domainkey.%s zone:\n\nv=DKIM1;k=rsa;s=email;h=sha256;p=%s\n\n", dkc.Selector, c.Args().First(), dkc.PubKey)
 				println("And... That's all.")
@@ -30,6 +33,35 @@ var Dkim = cgCli.Command{
 				cliDieOk()
 			},
 		}, {
+			Name:        "setoptions",
+			Usage:       "Set canonicalization and signed headers for domain DOMAIN",
+			Description: "tmail dkim setoptions DOMAIN [-c CANONICALIZATION] [-H HEADERS]",
+			Flags:       dkimOptionsFlags,
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				err := api.DkimSetOptions(c.Args().First(), c.String("c"), c.String("H"))
+				cliHandleErr(err)
+				cliDieOk()
+			},
+		}, {
+			Name:        "rotate",
+			Usage:       "Replace keys and selector of domain DOMAIN",
+			Description: "tmail dkim rotate DOMAIN",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				domain := c.Args().First()
+				dkc, oldSelector, err := api.DkimRotate(domain)
+				cliHandleErr(err)
+				println("Done !")
+				fmt.Printf("Create this TXT record on %s._domainkey.%s zone:\n\nv=DKIM1;k=rsa;s=email;h=sha256;p=%s\n\n", dkc.Selector, domain, dkc.PubKey)
+				fmt.Printf("Messages are now signed with selector %s. Once queued messages are delivered, you can remove the TXT record of %s._domainkey.%s zone.\n", dkc.Selector, oldSelector, domain)
+				cliDieOk()
+			},
+		}, {
 			Name:        "disable",
 			Usage:       "Disable DKIM on domain DOMAIN",
 			Description: "TO disable DKIM on domain DOMAIN\n\ttmail dkim disable DOMAIN",
@@ -107,3 +139,17 @@ var Dkim = cgCli.Command{
 		},
 	},
 }
+
+// dkimOptionsFlags are flags used to set DKIM options
+var dkimOptionsFlags = []cgCli.Flag{
+	cgCli.StringFlag{
+		Name:  "canonicalization, c",
+		Value: "",
+		Usage: "header/body canonicalization, simple or relaxed. Default: relaxed/relaxed",
+	},
+	cgCli.StringFlag{
+		Name:  "headers, H",
+		Value: "",
+		Usage: "signed headers separated by ':'. Default: from:subject:date:message-id",
+	},
+}
@@ -0,0 +1,40 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	cgCli "github.com/codegangsta/cli"
+	"github.com/toorop/tmail/api"
+)
+
+var dmarc = cgCli.Command{
+	Name:  "dmarc",
+	Usage: "commands to manage DMARC reports",
+	Subcommands: []cgCli.Command{
+		{
+			Name:        "preview",
+			Usage:       "Preview pending aggregate reports",
+			Description: "tmail dmarc preview [DOMAIN]",
+			Action: func(c *cgCli.Context) {
+				domain := ""
+				if len(c.Args()) > 1 {
+					cliDieBadArgs(c)
+				}
+				if len(c.Args()) == 1 {
+					domain = c.Args()[0]
+				}
+				reports, err := api.DmarcReportsPreview(domain)
+				cliHandleErr(err)
+				if len(reports) == 0 {
+					println("There is no pending report.")
+					os.Exit(0)
+				}
+				for d, report := range reports {
+					fmt.Printf("--- %s\r\n%s\r\n", d, report)
+				}
+				os.Exit(0)
+			},
+		},
+	},
+}
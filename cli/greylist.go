@@ -0,0 +1,95 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	cgCli "github.com/codegangsta/cli"
+	"github.com/toorop/tmail/api"
+)
+
+var greylist = cgCli.Command{
+	Name:  "greylist",
+	Usage: "commands to manage greylisting",
+	Subcommands: []cgCli.Command{
+		{
+			Name:        "list",
+			Usage:       "List greylisted triplets",
+			Description: "tmail greylist list",
+			Action: func(c *cgCli.Context) {
+				triplets, err := api.GreylistList()
+				cliHandleErr(err)
+				if len(triplets) == 0 {
+					println("There is no greylisted triplet.")
+				}
+				for _, t := range triplets {
+					status := "greylisted"
+					if t.Passed {
+						status = "passed"
+					}
+					fmt.Printf("%d - %s - From: %s - To: %s - %s - Attempts: %d - First seen: %v - Last seen: %v\r\n", t.Id, t.Network, t.MailFrom, t.RcptTo, status, t.Attempts, t.FirstSeen, t.LastSeen)
+				}
+				os.Exit(0)
+			},
+		},
+		{
+			Name:        "flush",
+			Usage:       "Remove expired triplets (all triplets with --all)",
+			Description: "tmail greylist flush [--all]",
+			Flags: []cgCli.Flag{
+				cgCli.BoolFlag{
+					Name:  "all",
+					Usage: "remove all triplets",
+				},
+			},
+			Action: func(c *cgCli.Context) {
+				cliHandleErr(api.GreylistFlush(c.Bool("all")))
+				cliDieOk()
+			},
+		},
+		{
+			Name:        "whitelist",
+			Usage:       "Whitelist a network (or an IP)",
+			Description: "tmail greylist whitelist IP|CIDR",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				cliHandleErr(api.GreylistWhitelistAdd(c.Args()[0]))
+				cliDieOk()
+			},
+		},
+		{
+			Name:        "unwhitelist",
+			Usage:       "Remove a network (or an IP) from whitelist",
+			Description: "tmail greylist unwhitelist IP|CIDR",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				cliHandleErr(api.GreylistWhitelistDel(c.Args()[0]))
+				cliDieOk()
+			},
+		},
+		{
+			Name:        "whitelisted",
+			Usage:       "List whitelisted networks",
+			Description: "tmail greylist whitelisted",
+			Action: func(c *cgCli.Context) {
+				whitelist, err := api.GreylistWhitelistList()
+				cliHandleErr(err)
+				if len(whitelist) == 0 {
+					println("There is no whitelisted network.")
+				}
+				for _, wl := range whitelist {
+					line := fmt.Sprintf("%s - added: %v", wl.Network, wl.AddedAt)
+					if wl.Auto {
+						line += fmt.Sprintf(" - auto whitelisted, expires: %v", wl.ExpiresAt)
+					}
+					println(line)
+				}
+				os.Exit(0)
+			},
+		},
+	},
+}
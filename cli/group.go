@@ -0,0 +1,157 @@
+package cli
+
+import (
+	"fmt"
+
+	cgCli "github.com/codegangsta/cli"
+	"github.com/toorop/tmail/api"
+	"github.com/toorop/tmail/core"
+)
+
+// groupFlags are options of groups
+var groupFlags = []cgCli.Flag{
+	cgCli.StringFlag{
+		Name:  "policy, p",
+		Value: core.GroupPolicyAnyone,
+		Usage: "who can post: anyone, members or owners",
+	},
+	cgCli.StringFlag{
+		Name:  "description, d",
+		Usage: "description (in List-Id header)",
+	},
+	cgCli.StringFlag{
+		Name:  "prefix, s",
+		Usage: "subject prefix (eg [team])",
+	},
+	cgCli.BoolFlag{
+		Name:  "reply-to-group, r",
+		Usage: "if set, Reply-To is rewritten to group address",
+	},
+	cgCli.StringFlag{
+		Name:  "unsubscribe, u",
+		Usage: "List-Unsubscribe URL (default: mailto first owner)",
+	},
+}
+
+// groupOptions returns group options of flags
+func groupOptions(c *cgCli.Context) core.MailGroup {
+	return core.MailGroup{
+		Address:       c.Args()[0],
+		Policy:        c.String("policy"),
+		Description:   c.String("description"),
+		SubjectPrefix: c.String("prefix"),
+		ReplyToGroup:  c.Bool("reply-to-group"),
+		Unsubscribe:   c.String("unsubscribe"),
+	}
+}
+
+var group = cgCli.Command{
+	Name:  "group",
+	Usage: "commands to manage groups (distribution addresses)",
+	Subcommands: []cgCli.Command{
+		{
+			Name:        "add",
+			Usage:       "Add a group",
+			Description: "tmail group add [--policy anyone|members|owners] [--description DESC] [--prefix PREFIX] [--reply-to-group] [--unsubscribe URL] GROUP",
+			Flags:       groupFlags,
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				_, err := api.MailGroupAdd(groupOptions(c))
+				cliHandleErr(err)
+				cliDieOk()
+			},
+		}, {
+			Name:        "set",
+			Usage:       "Set options of a group (options not given are reset)",
+			Description: "tmail group set [--policy anyone|members|owners] [--description DESC] [--prefix PREFIX] [--reply-to-group] [--unsubscribe URL] GROUP",
+			Flags:       groupFlags,
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				_, err := api.MailGroupUpdate(c.Args()[0], groupOptions(c))
+				cliHandleErr(err)
+				cliDieOk()
+			},
+		}, {
+			Name:        "del",
+			Usage:       "Delete a group and its members",
+			Description: "tmail group del GROUP",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				cliHandleErr(api.MailGroupDel(c.Args()[0]))
+				cliDieOk()
+			},
+		}, {
+			Name:        "list",
+			Usage:       "List groups",
+			Description: "tmail group list",
+			Action: func(c *cgCli.Context) {
+				groups, err := api.MailGroupList()
+				cliHandleErr(err)
+				if len(groups) == 0 {
+					println("There is no group.")
+				}
+				for _, g := range groups {
+					println(fmt.Sprintf("%s - policy: %s - prefix: %s - reply-to group: %t - %s", g.Address, g.Policy, g.SubjectPrefix, g.ReplyToGroup, g.Description))
+				}
+				cliDieOk()
+			},
+		}, {
+			Name:        "members",
+			Usage:       "List members of a group",
+			Description: "tmail group members GROUP",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				members, err := api.MailGroupMembers(c.Args()[0])
+				cliHandleErr(err)
+				if len(members) == 0 {
+					println("There is no member.")
+				}
+				for _, m := range members {
+					if m.IsOwner {
+						println(m.Address + " (owner)")
+					} else {
+						println(m.Address)
+					}
+				}
+				cliDieOk()
+			},
+		}, {
+			Name:        "member-add",
+			Usage:       "Add a member to a group",
+			Description: "tmail group member-add [--owner] GROUP MEMBER",
+			Flags: []cgCli.Flag{
+				cgCli.BoolFlag{
+					Name:  "owner, o",
+					Usage: "member is an owner of the group",
+				},
+			},
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 2 {
+					cliDieBadArgs(c)
+				}
+				_, err := api.MailGroupMemberAdd(c.Args()[0], c.Args()[1], c.Bool("owner"))
+				cliHandleErr(err)
+				cliDieOk()
+			},
+		}, {
+			Name:        "member-del",
+			Usage:       "Remove a member of a group",
+			Description: "tmail group member-del GROUP MEMBER",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 2 {
+					cliDieBadArgs(c)
+				}
+				cliHandleErr(api.MailGroupMemberDel(c.Args()[0], c.Args()[1]))
+				cliDieOk()
+			},
+		},
+	},
+}
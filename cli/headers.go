@@ -0,0 +1,134 @@
+package cli
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	cgCli "github.com/codegangsta/cli"
+	"github.com/toorop/tmail/api"
+	"github.com/toorop/tmail/core"
+)
+
+var headers = cgCli.Command{
+	Name:  "headers",
+	Usage: "commands to manage header rules (rewriting of messages before queueing)",
+	Subcommands: []cgCli.Command{
+		{
+			Name:        "add",
+			Usage:       "Add a header rule",
+			Description: "tmail headers add ACTION [HEADER] [VALUE] [--match REGEXP] [--listener LISTENER] [--user USER] [--sender DOMAIN] [--rcpt DOMAIN] [--priority N]\n   ACTION: add HEADER VALUE, remove HEADER, replace HEADER VALUE, from-domain DOMAIN or disclaimer TEXT",
+			Flags: []cgCli.Flag{
+				cgCli.StringFlag{
+					Name:  "match, m",
+					Usage: "remove only headers whose value matches this regexp",
+				},
+				cgCli.StringFlag{
+					Name:  "listener, l",
+					Usage: "listener of messages: ip:port, :port or submission (default: all)",
+				},
+				cgCli.StringFlag{
+					Name:  "user, u",
+					Usage: "authenticated user, * for all authenticated users, - for unauthenticated sessions (default: all)",
+				},
+				cgCli.StringFlag{
+					Name:  "sender, s",
+					Usage: "domain of sender (default: all)",
+				},
+				cgCli.StringFlag{
+					Name:  "rcpt, r",
+					Usage: "domain of a recipient (default: all)",
+				},
+				cgCli.IntFlag{
+					Name:  "priority, p",
+					Value: 0,
+					Usage: "rules are applied by priority",
+				},
+			},
+			Action: func(c *cgCli.Context) {
+				args := c.Args()
+				if len(args) < 2 {
+					cliDieBadArgs(c)
+				}
+				rule := core.HeaderRule{
+					Action:       args[0],
+					Priority:     c.Int("priority"),
+					Listener:     c.String("listener"),
+					AuthUser:     c.String("user"),
+					SenderDomain: c.String("sender"),
+					RcptDomain:   c.String("rcpt"),
+					Match:        c.String("match"),
+				}
+				switch strings.ToLower(args[0]) {
+				case core.HeaderActionFromDomain, core.HeaderActionDisclaimer:
+					// disclaimer: \n are new lines
+					rule.Value = strings.Replace(strings.Join(args[1:], " "), `\n`, "\n", -1)
+				default:
+					rule.Header = args[1]
+					if len(args) > 2 {
+						rule.Value = strings.Join(args[2:], " ")
+					}
+				}
+				rule, err := api.HeaderRuleAdd(rule)
+				cliHandleErr(err)
+				println(fmt.Sprintf("Header rule %d added", rule.Id))
+				cliDieOk()
+			},
+		}, {
+			Name:        "del",
+			Usage:       "Delete a header rule",
+			Description: "tmail headers del RULE_ID",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				id, err := strconv.ParseInt(c.Args()[0], 10, 64)
+				cliHandleErr(err)
+				cliHandleErr(api.HeaderRuleDel(id))
+				cliDieOk()
+			},
+		}, {
+			Name:        "list",
+			Usage:       "List header rules in the order they are applied",
+			Description: "tmail headers list",
+			Action: func(c *cgCli.Context) {
+				rules, err := api.HeaderRuleList()
+				cliHandleErr(err)
+				if len(rules) == 0 {
+					println("There is no header rule.")
+				}
+				for _, r := range rules {
+					match := []string{}
+					for _, m := range [][2]string{{"listener", r.Listener}, {"user", r.AuthUser}, {"sender", r.SenderDomain}, {"rcpt", r.RcptDomain}} {
+						if m[1] != "" {
+							match = append(match, m[0]+" "+m[1])
+						}
+					}
+					if len(match) == 0 {
+						match = append(match, "all messages")
+					}
+					action := r.Action
+					if r.Header != "" {
+						action += " " + r.Header
+					}
+					if r.Value != "" {
+						action += " " + strconv.Quote(r.Value)
+					}
+					if r.Match != "" {
+						action += " matching " + r.Match
+					}
+					println(fmt.Sprintf("%d - priority %d - %s - %s", r.Id, r.Priority, strings.Join(match, ", "), action))
+				}
+				cliDieOk()
+			},
+		}, {
+			Name:        "reload",
+			Usage:       "Reload header rules of running tmail (SIGHUP)",
+			Description: "tmail headers reload",
+			Action: func(c *cgCli.Context) {
+				cliHandleErr(api.HeaderRulesReload())
+				cliDieOk()
+			},
+		},
+	},
+}
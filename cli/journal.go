@@ -0,0 +1,87 @@
+package cli
+
+import (
+	"fmt"
+	"strconv"
+
+	cgCli "github.com/codegangsta/cli"
+	"github.com/toorop/tmail/api"
+	"github.com/toorop/tmail/core"
+)
+
+var journal = cgCli.Command{
+	Name:  "journal",
+	Usage: "commands to manage journaling (compliance archiving) rules",
+	Subcommands: []cgCli.Command{
+		{
+			Name:        "add",
+			Usage:       "Add a journal rule",
+			Description: "tmail journal add [--domain DOMAIN] [--direction inbound|outbound|both] [--address ARCHIVE_ADDRESS] [--archive]",
+			Flags: []cgCli.Flag{
+				cgCli.StringFlag{
+					Name:  "domain, d",
+					Usage: "domain of the rule (default: all domains)",
+				},
+				cgCli.StringFlag{
+					Name:  "direction, D",
+					Value: core.JournalBoth,
+					Usage: "inbound, outbound or both",
+				},
+				cgCli.StringFlag{
+					Name:  "address, a",
+					Usage: "archive address receiving journal reports",
+				},
+				cgCli.BoolFlag{
+					Name:  "archive, s",
+					Usage: "copy messages to journal store",
+				},
+			},
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 0 {
+					cliDieBadArgs(c)
+				}
+				rule, err := api.JournalRuleAdd(core.JournalRule{
+					Domain:    c.String("domain"),
+					Direction: c.String("direction"),
+					Address:   c.String("address"),
+					Archive:   c.Bool("archive"),
+				})
+				cliHandleErr(err)
+				println(fmt.Sprintf("Journal rule %d added", rule.Id))
+				cliDieOk()
+			},
+		}, {
+			Name:        "del",
+			Usage:       "Delete a journal rule",
+			Description: "tmail journal del RULE_ID",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				id, err := strconv.ParseInt(c.Args()[0], 10, 64)
+				cliHandleErr(err)
+				cliHandleErr(api.JournalRuleDel(id))
+				cliDieOk()
+			},
+		}, {
+			Name:        "list",
+			Usage:       "List journal rules",
+			Description: "tmail journal list",
+			Action: func(c *cgCli.Context) {
+				rules, err := api.JournalRuleList()
+				cliHandleErr(err)
+				if len(rules) == 0 {
+					println("There is no journal rule.")
+				}
+				for _, r := range rules {
+					domain := r.Domain
+					if domain == "" {
+						domain = "all domains"
+					}
+					println(fmt.Sprintf("%d - %s - %s - address: %s - journal store: %t", r.Id, domain, r.Direction, r.Address, r.Archive))
+				}
+				cliDieOk()
+			},
+		},
+	},
+}
@@ -0,0 +1,92 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	cgCli "github.com/codegangsta/cli"
+	"github.com/toorop/tmail/api"
+)
+
+var policy = cgCli.Command{
+	Name:  "policy",
+	Usage: "commands to manage delivery policies (outbound rate shaping per destination domain)",
+	Subcommands: []cgCli.Command{
+		{
+			Name:        "set",
+			Usage:       "Add or update delivery policy of a destination domain (* for default policy, 0: unlimited)",
+			Description: "tmail policy set DOMAIN [-c MAX_CONNS] [-m MAX_MSGS_PER_CONN] [-r MSGS_PER_MINUTE] [-b BACKOFF_MULTIPLIER] [-s RETRY_SCHEDULE]",
+			Flags: []cgCli.Flag{
+				cgCli.IntFlag{
+					Name:  "conns, c",
+					Value: 0,
+					Usage: "concurrent connections",
+				},
+				cgCli.IntFlag{
+					Name:  "msgs, m",
+					Value: 0,
+					Usage: "messages per connection",
+				},
+				cgCli.IntFlag{
+					Name:  "rate, r",
+					Value: 0,
+					Usage: "messages per minute",
+				},
+				cgCli.StringFlag{
+					Name:  "backoff, b",
+					Value: "0",
+					Usage: "backoff multiplier on 421 & 4xx greeting (0: no backoff)",
+				},
+				cgCli.StringFlag{
+					Name:  "schedule, s",
+					Value: "",
+					Usage: "retry schedule, eg 5m,15m,1h,4h,8h (empty: global schedule)",
+				},
+			},
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				backoff, err := strconv.ParseFloat(c.String("b"), 64)
+				if err != nil {
+					cliDieBadArgs(c)
+				}
+				cliHandleErr(api.DeliveryPolicySet(c.Args()[0], c.Int("c"), c.Int("m"), c.Int("r"), backoff, c.String("s")))
+				cliDieOk()
+			},
+		},
+		{
+			Name:        "del",
+			Usage:       "Remove delivery policy of a destination domain",
+			Description: "tmail policy del DOMAIN",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				cliHandleErr(api.DeliveryPolicyDel(c.Args()[0]))
+				cliDieOk()
+			},
+		},
+		{
+			Name:        "list",
+			Usage:       "List delivery policies",
+			Description: "tmail policy list",
+			Action: func(c *cgCli.Context) {
+				policies, err := api.DeliveryPolicyList()
+				cliHandleErr(err)
+				if len(policies) == 0 {
+					println("There is no delivery policy.")
+				}
+				for _, p := range policies {
+					fmt.Printf("%s - connections: %d - messages per connection: %d - messages per minute: %d - backoff multiplier: %g", p.Domain, p.MaxConns, p.MaxMsgsPerConn, p.MsgsPerMinute, p.BackoffMultiplier)
+					if p.RetrySchedule != "" {
+						fmt.Printf(" - retry schedule: %s", p.RetrySchedule)
+					}
+					fmt.Print("\r\n")
+				}
+				os.Exit(0)
+			},
+		},
+	},
+}
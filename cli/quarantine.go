@@ -0,0 +1,85 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	cgCli "github.com/codegangsta/cli"
+	"github.com/toorop/tmail/api"
+)
+
+var quarantine = cgCli.Command{
+	Name:  "quarantine",
+	Usage: "commands to manage quarantined messages",
+	Subcommands: []cgCli.Command{
+		{
+			Name:        "list",
+			Usage:       "List quarantined messages",
+			Description: "tmail quarantine list",
+			Action: func(c *cgCli.Context) {
+				messages, err := api.QuarantineList()
+				cliHandleErr(err)
+				if len(messages) == 0 {
+					println("There is no message in quarantine.")
+					os.Exit(0)
+				}
+				fmt.Printf("%d messages in quarantine.\r\n", len(messages))
+				for _, m := range messages {
+					expires := "never"
+					if !m.ExpiresAt.IsZero() {
+						expires = m.ExpiresAt.Format("2006-01-02 15:04")
+					}
+					fmt.Printf("%d - From: %s - To: %s - Subject: %s - Message-ID: %s - Reason: %s - Added: %v - Expires: %s\r\n", m.Id, m.MailFrom, m.RcptTo, m.Subject, m.MessageId, m.Reason, m.AddedAt, expires)
+				}
+				os.Exit(0)
+			},
+		},
+		{
+			Name:        "headers",
+			Usage:       "Print headers of a quarantined message",
+			Description: "tmail quarantine headers MESSAGE_ID",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				id, err := strconv.ParseInt(c.Args()[0], 10, 64)
+				cliHandleErr(err)
+				headers, err := api.QuarantineHeaders(id)
+				cliHandleErr(err)
+				print(headers)
+				cliDieOk()
+			},
+		},
+		{
+			Name:        "release",
+			Usage:       "Release a quarantined message (queue it for delivery)",
+			Description: "tmail quarantine release MESSAGE_ID",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				id, err := strconv.ParseInt(c.Args()[0], 10, 64)
+				cliHandleErr(err)
+				queueId, err := api.QuarantineRelease(id)
+				cliHandleErr(err)
+				println("Message queued as " + queueId)
+				cliDieOk()
+			},
+		},
+		{
+			Name:        "del",
+			Usage:       "Delete a quarantined message",
+			Description: "tmail quarantine del MESSAGE_ID",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				id, err := strconv.ParseInt(c.Args()[0], 10, 64)
+				cliHandleErr(err)
+				cliHandleErr(api.QuarantineDel(id))
+				cliDieOk()
+			},
+		},
+	},
+}
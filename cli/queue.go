@@ -3,6 +3,7 @@ package cli
 import (
 	"fmt"
 	"github.com/toorop/tmail/api"
+	"github.com/toorop/tmail/core"
 	cgCli "github.com/codegangsta/cli"
 	"os"
 	"strconv"
@@ -35,12 +36,30 @@ var Queue = cgCli.Command{
 							status = "Scheduled"
 						case 3:
 							status = "Will be bounced"
+						case 4:
+							status = "Frozen"
+						case 5:
+							status = "On hold"
+						case 6:
+							status = "Waiting for scan"
 						}
 
 						msg := fmt.Sprintf("%d - From: %s - To: %s - Status: %s - Added: %v ", m.Id, m.MailFrom, m.RcptTo, status, m.AddedAt)
 						if m.Status != 0 {
 							msg += fmt.Sprintf("- Next delivery process scheduled at: %v", m.NextDeliveryScheduledAt)
 						}
+						if !m.SendAt.IsZero() {
+							msg += fmt.Sprintf(" - Send at: %v", m.SendAt)
+						}
+						if m.DeliveryFailedCount != 0 {
+							msg += fmt.Sprintf(" - Failed attempts: %d", m.DeliveryFailedCount)
+						}
+						if m.Destination != "" {
+							msg += " - Destination: " + m.Destination
+						}
+						if m.LastError != "" {
+							msg += " - Last error: " + m.LastError
+						}
 						println(msg)
 					}
 				}
@@ -63,16 +82,257 @@ var Queue = cgCli.Command{
 		},
 		{
 			Name:        "bounce",
-			Usage:       "Bounce a message in queue",
-			Description: "tmail queue bounce MESSAGE_ID",
+			Usage:       "Bounce now a message or all messages to a destination domain",
+			Description: "tmail queue bounce MESSAGE_ID|DOMAIN",
 			Action: func(c *cgCli.Context) {
 				if len(c.Args()) != 1 {
 					cliDieBadArgs(c)
 				}
+				count, err := api.QueueBounce(c.Args()[0])
+				cliHandleErr(err)
+				fmt.Printf("%d messages bounced\n", count)
+				os.Exit(0)
+			},
+		},
+		{
+			Name:        "redirect",
+			Usage:       "Redirect a queued message (or a bounced one with --bounced) to another recipient",
+			Description: "tmail queue redirect [--bounced] MESSAGE_ID ADDRESS",
+			Flags: []cgCli.Flag{
+				cgCli.BoolFlag{
+					Name:  "bounced, b",
+					Usage: "MESSAGE_ID is the ID of a bounced message (tmail queue bounced)",
+				},
+			},
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 2 {
+					cliDieBadArgs(c)
+				}
 				id, err := strconv.ParseInt(c.Args()[0], 10, 64)
 				cliHandleErr(err)
-				cliHandleErr(api.QueueBounceMsg(id))
-				cliDieOk()
+				operator := os.Getenv("USER")
+				var audit core.RedirectAudit
+				if c.Bool("bounced") {
+					audit, err = api.BouncedRedirect(id, c.Args()[1], operator)
+				} else {
+					audit, err = api.QueueRedirect(id, c.Args()[1], operator)
+				}
+				cliHandleErr(err)
+				fmt.Printf("message redirected to %s, queued as %s\n", audit.NewRcpt, audit.QueueId)
+				os.Exit(0)
+			},
+		},
+		{
+			Name:        "bounced",
+			Usage:       "List bounced messages kept for redirection",
+			Description: "tmail queue bounced",
+			Action: func(c *cgCli.Context) {
+				messages, err := api.BouncedList()
+				cliHandleErr(err)
+				if len(messages) == 0 {
+					println("There is no bounced message.")
+				}
+				for _, m := range messages {
+					line := fmt.Sprintf("%d - From: %s - To: %s - Bounced: %v", m.Id, m.MailFrom, m.RcptTo, m.BouncedAt)
+					if m.Redirected {
+						line += " - redirected"
+					}
+					println(line)
+				}
+				os.Exit(0)
+			},
+		},
+		{
+			Name:        "redirects",
+			Usage:       "List redirections",
+			Description: "tmail queue redirects",
+			Action: func(c *cgCli.Context) {
+				audits, err := api.RedirectAuditList()
+				cliHandleErr(err)
+				if len(audits) == 0 {
+					println("There is no redirection.")
+				}
+				for _, a := range audits {
+					println(fmt.Sprintf("%d - %v - %s %d from %s: %s redirected to %s by %s, queued as %s", a.Id, a.CreatedAt, a.Source, a.SourceId, a.MailFrom, a.OriginalRcpt, a.NewRcpt, a.Operator, a.QueueId))
+				}
+				os.Exit(0)
+			},
+		},
+		{
+			Name:        "hold",
+			Usage:       "Put on hold a message or all messages to a destination domain, they will not be delivered until they are released",
+			Description: "tmail queue hold MESSAGE_ID|DOMAIN",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				count, err := api.QueueHold(c.Args()[0])
+				cliHandleErr(err)
+				fmt.Printf("%d messages on hold\n", count)
+				os.Exit(0)
+			},
+		},
+		{
+			Name:        "release",
+			Usage:       "Release a message or all messages to a destination domain on hold",
+			Description: "tmail queue release MESSAGE_ID|DOMAIN",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				count, err := api.QueueRelease(c.Args()[0])
+				cliHandleErr(err)
+				fmt.Printf("%d messages released\n", count)
+				os.Exit(0)
+			},
+		},
+		{
+			Name:        "flush",
+			Usage:       "Force an immediate delivery attempt of a message or of all messages to a destination domain",
+			Description: "tmail queue flush MESSAGE_ID|DOMAIN",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				count, err := api.QueueFlush(c.Args()[0])
+				cliHandleErr(err)
+				fmt.Printf("%d messages flushed\n", count)
+				os.Exit(0)
+			},
+		},
+		{
+			Name:        "freeze",
+			Usage:       "Freeze outbound delivery (all, or for a sender domain, a user or a destination host)",
+			Description: "tmail queue freeze [-d SENDER_DOMAIN | -u USER | -H DESTINATION_HOST] [-r REASON]",
+			Flags: []cgCli.Flag{
+				cgCli.StringFlag{
+					Name:  "domain, d",
+					Value: "",
+					Usage: "freeze messages from this domain (MAIL FROM or authenticated user)",
+				},
+				cgCli.StringFlag{
+					Name:  "user, u",
+					Value: "",
+					Usage: "freeze messages from this user (MAIL FROM or authenticated user)",
+				},
+				cgCli.StringFlag{
+					Name:  "host, H",
+					Value: "",
+					Usage: "freeze messages to this destination host",
+				},
+				cgCli.StringFlag{
+					Name:  "reason, r",
+					Value: "",
+					Usage: "reason of the freeze",
+				},
+			},
+			Action: func(c *cgCli.Context) {
+				scope, value := core.QueueFreezeAll, ""
+				for _, s := range []string{core.QueueFreezeDomain, core.QueueFreezeUser, core.QueueFreezeHost} {
+					if c.String(s) == "" {
+						continue
+					}
+					if value != "" {
+						cliDieBadArgs(c, "only one of --domain, --user or --host is allowed")
+					}
+					scope, value = s, c.String(s)
+				}
+				freeze, err := api.QueueFreeze(scope, value, c.String("r"))
+				cliHandleErr(err)
+				fmt.Printf("freeze %d added\n", freeze.Id)
+				os.Exit(0)
+			},
+		},
+		{
+			Name:        "freezes",
+			Usage:       "List freezes",
+			Description: "tmail queue freezes",
+			Action: func(c *cgCli.Context) {
+				freezes, err := api.QueueFreezeList()
+				cliHandleErr(err)
+				if len(freezes) == 0 {
+					println("There is no freeze.")
+				}
+				for _, f := range freezes {
+					line := fmt.Sprintf("%d - %s", f.Id, f.Scope)
+					if f.Value != "" {
+						line += " " + f.Value
+					}
+					line += fmt.Sprintf(" - since %v", f.CreatedAt)
+					if f.Reason != "" {
+						line += " - " + f.Reason
+					}
+					println(line)
+				}
+				os.Exit(0)
+			},
+		},
+		{
+			Name:        "unfreeze",
+			Usage:       "Remove a freeze, frozen messages are requeued (they will be frozen again if they match another freeze)",
+			Description: "tmail queue unfreeze FREEZE_ID",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				id, err := strconv.ParseInt(c.Args()[0], 10, 64)
+				cliHandleErr(err)
+				requeued, err := api.QueueUnfreeze(id)
+				cliHandleErr(err)
+				fmt.Printf("freeze %d removed, %d messages requeued\n", id, requeued)
+				os.Exit(0)
+			},
+		},
+		{
+			Name:        "thaw",
+			Usage:       "Requeue frozen messages matching filters, they are delivered even if they match a freeze",
+			Description: "tmail queue thaw [--all] [-i MESSAGE_ID] [-f MAIL_FROM] [-t RCPT_TO] [-u USER] [-H DESTINATION_HOST]",
+			Flags: []cgCli.Flag{
+				cgCli.BoolFlag{
+					Name:  "all",
+					Usage: "thaw all frozen messages",
+				},
+				cgCli.IntFlag{
+					Name:  "id, i",
+					Value: 0,
+					Usage: "message ID",
+				},
+				cgCli.StringFlag{
+					Name:  "from, f",
+					Value: "",
+					Usage: "MAIL FROM",
+				},
+				cgCli.StringFlag{
+					Name:  "to, t",
+					Value: "",
+					Usage: "RCPT TO",
+				},
+				cgCli.StringFlag{
+					Name:  "user, u",
+					Value: "",
+					Usage: "authenticated user",
+				},
+				cgCli.StringFlag{
+					Name:  "host, H",
+					Value: "",
+					Usage: "destination host",
+				},
+			},
+			Action: func(c *cgCli.Context) {
+				filter := core.QueueThawFilter{
+					Id:       int64(c.Int("i")),
+					MailFrom: c.String("f"),
+					RcptTo:   c.String("t"),
+					User:     c.String("u"),
+					Host:     c.String("H"),
+				}
+				if filter == (core.QueueThawFilter{}) && !c.Bool("all") {
+					cliDieBadArgs(c, "you must provide a filter or --all")
+				}
+				thawed, err := api.QueueThaw(filter)
+				cliHandleErr(err)
+				fmt.Printf("%d messages thawed\n", thawed)
+				os.Exit(0)
 			},
 		},
 	},
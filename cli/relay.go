@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"fmt"
+	"time"
+
+	cgCli "github.com/codegangsta/cli"
+	"github.com/toorop/tmail/api"
+)
+
+var relay = cgCli.Command{
+	Name:  "relay",
+	Usage: "commands to manage relay policies of listeners and POP/IMAP-before-SMTP",
+	Subcommands: []cgCli.Command{
+		{
+			Name:        "setpolicy",
+			Usage:       "Set relay policy of listener LISTENER",
+			Description: "tmail relay setpolicy LISTENER POLICY\n   LISTENER: ip:port, :port or submission\n   POLICY: default (authenticated users, trusted networks and POP/IMAP logins), auth (authenticated users only), networks (trusted networks and POP/IMAP logins only) or none (no relaying)",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 2 {
+					cliDieBadArgs(c)
+				}
+				_, err := api.RelayPolicySet(c.Args()[0], c.Args()[1])
+				cliHandleErr(err)
+				cliDieOk()
+			},
+		}, {
+			Name:        "delpolicy",
+			Usage:       "Remove relay policy of listener LISTENER (default policy applies)",
+			Description: "tmail relay delpolicy LISTENER",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				cliHandleErr(api.RelayPolicyDel(c.Args().First()))
+				cliDieOk()
+			},
+		}, {
+			Name:        "policies",
+			Usage:       "List relay policies of listeners",
+			Description: "tmail relay policies",
+			Action: func(c *cgCli.Context) {
+				policies, err := api.RelayPolicyList()
+				cliHandleErr(err)
+				if len(policies) == 0 {
+					println("There is no relay policy, default policy applies to all listeners.")
+				}
+				for _, p := range policies {
+					fmt.Printf("%s %s\n", p.Listener, p.Policy)
+				}
+				cliDieOk()
+			},
+		}, {
+			Name:        "login",
+			Usage:       "Record a POP/IMAP login from IP (run by Dovecot post-login script)",
+			Description: "tmail relay login IP [USER]",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) < 1 || len(c.Args()) > 2 {
+					cliDieBadArgs(c)
+				}
+				cliHandleErr(api.RelayLoginAdd(c.Args()[0], c.Args().Get(1)))
+				cliDieOk()
+			},
+		}, {
+			Name:        "logins",
+			Usage:       "List POP/IMAP logins whose IP can relay",
+			Description: "tmail relay logins",
+			Action: func(c *cgCli.Context) {
+				logins, err := api.RelayLoginList()
+				cliHandleErr(err)
+				if len(logins) == 0 {
+					println("There is no recent POP/IMAP login.")
+				}
+				for _, l := range logins {
+					fmt.Printf("%s %s %s\n", l.Ip, l.Login, l.LoggedAt.Format(time.RFC3339))
+				}
+				cliDieOk()
+			},
+		},
+	},
+}
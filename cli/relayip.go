@@ -13,8 +13,8 @@ var RelayIP = cgCli.Command{
 		// Add an authorized IP
 		{
 			Name:        "add",
-			Usage:       "Add an authorized IP",
-			Description: "tmail relayip add IP",
+			Usage:       "Add an authorized IP or network (CIDR)",
+			Description: "tmail relayip add IP|NETWORK\n   eg: tmail relayip add 192.168.0.0/16",
 			Action: func(c *cgCli.Context) {
 				if len(c.Args()) == 0 {
 					cliDieBadArgs(c)
@@ -44,8 +44,8 @@ var RelayIP = cgCli.Command{
 		// Delete relayip
 		{
 			Name:        "del",
-			Usage:       "Delete an authorized IP",
-			Description: "tmail relayip del IP",
+			Usage:       "Delete an authorized IP or network",
+			Description: "tmail relayip del IP|NETWORK",
 			Action: func(c *cgCli.Context) {
 				if len(c.Args()) == 0 {
 					cliDieBadArgs(c)
@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	cgCli "github.com/codegangsta/cli"
+	"github.com/toorop/tmail/api"
+	"github.com/toorop/tmail/core"
+)
+
+var replay = cgCli.Command{
+	Name:  "replay",
+	Usage: "replay stored messages through current filters and policies",
+	Subcommands: []cgCli.Command{
+		{
+			Name:        "quarantine",
+			Usage:       "Replay quarantined messages (all if no ID is given)",
+			Description: "tmail replay quarantine [MESSAGE_ID...]",
+			Action: func(c *cgCli.Context) {
+				ids := []int64{}
+				for _, arg := range c.Args() {
+					id, err := strconv.ParseInt(arg, 10, 64)
+					cliHandleErr(err)
+					ids = append(ids, id)
+				}
+				results, err := api.ReplayQuarantine(ids)
+				cliHandleErr(err)
+				printReplayResults(results)
+			},
+		},
+		{
+			Name:        "dir",
+			Usage:       "Replay messages stored in a directory (one message per file)",
+			Description: "tmail replay dir [-d DISPOSITION] PATH",
+			Flags: []cgCli.Flag{
+				cgCli.StringFlag{
+					Name:  "disposition, d",
+					Value: "accept",
+					Usage: "original disposition of messages: accept, tag, quarantine, tempfail or reject",
+				},
+			},
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				results, err := api.ReplayDir(c.Args()[0], c.String("disposition"))
+				cliHandleErr(err)
+				printReplayResults(results)
+			},
+		},
+	},
+}
+
+// printReplayResults prints replay report
+func printReplayResults(results []core.ReplayResult) {
+	changed := 0
+	for _, r := range results {
+		if r.Err != "" {
+			fmt.Printf("%s - ERROR: %s\r\n", r.Source, r.Err)
+			continue
+		}
+		status := "unchanged"
+		if r.Changed {
+			status = "CHANGED"
+			changed++
+		}
+		fmt.Printf("%s - From: %s - To: %s - %s -> %s (%s)\r\n", r.Source, r.MailFrom, strings.Join(r.RcptTo, ", "), r.OriginalDisposition, r.Disposition, status)
+		for _, v := range r.Verdicts {
+			shadow := ""
+			if v.Shadow {
+				shadow = " (shadow)"
+			}
+			fmt.Printf("\t%s: %s%s %s\r\n", v.Check, v.Action, shadow, v.Reason)
+		}
+	}
+	fmt.Printf("%d messages replayed, %d verdicts changed.\r\n", len(results), changed)
+	os.Exit(0)
+}
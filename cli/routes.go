@@ -1,13 +1,52 @@
 package cli
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/toorop/tmail/api"
+	"github.com/toorop/tmail/core"
 	cgCli "github.com/codegangsta/cli"
+	"io/ioutil"
 	"os"
 	"strconv"
 )
 
+// routesReadPlan reads JSON plan file of command c
+// {"Add": [{"Host": ..., "RemoteHost": ..., ...}], "Delete": [ROUTE_ID, ...]}
+func routesReadPlan(c *cgCli.Context) (plan core.RoutePlan) {
+	if len(c.Args()) != 1 {
+		cliDieBadArgs(c, "you must provide a plan file")
+	}
+	raw, err := ioutil.ReadFile(c.Args()[0])
+	cliHandleErr(err)
+	cliHandleErr(json.Unmarshal(raw, &plan))
+	return
+}
+
+// routesPrintChanges prints changes of destinations
+func routesPrintChanges(changes []core.RouteChange) {
+	if len(changes) == 0 {
+		println("No destination changes.")
+		return
+	}
+	for _, change := range changes {
+		println(change.Destination)
+		for _, r := range change.Before {
+			println("\t- " + r)
+		}
+		if len(change.Before) == 0 {
+			println("\t- MX records")
+		}
+		for _, r := range change.After {
+			println("\t+ " + r)
+		}
+		if len(change.After) == 0 {
+			println("\t+ MX records")
+		}
+	}
+}
+
 var Routes = cgCli.Command{
 	Name:  "routes",
 	Usage: "commands to manage outgoing SMTP routes",
@@ -70,6 +109,44 @@ var Routes = cgCli.Command{
 							line += ":25"
 						}
 
+						// Forward client
+						if route.ForwardClient.Valid && route.ForwardClient.String != "" {
+							line += " - Forward client: " + route.ForwardClient.String
+						}
+
+						// Retry schedule
+						if route.RetrySchedule.Valid && route.RetrySchedule.String != "" {
+							line += " - Retry schedule: " + route.RetrySchedule.String
+						}
+
+						// SMTP AUTH mechanism
+						if route.SmtpAuthMech.Valid && route.SmtpAuthMech.String != "" {
+							line += " - Auth mechanism: " + route.SmtpAuthMech.String
+						}
+
+						// Proxy
+						if route.Proxy.Valid && route.Proxy.String != "" {
+							line += " - Proxy: " + route.Proxy.String
+						}
+
+						// Weight & MX fallback
+						if route.Weight.Valid && route.Weight.Int64 > 1 {
+							line += fmt.Sprintf(" - Weight: %d", route.Weight.Int64)
+						}
+						if route.MxFallback {
+							line += " - MX fallback"
+						}
+
+						// IP family
+						if route.IpFamily.Valid && route.IpFamily.String != "" {
+							line += " - IP family: " + route.IpFamily.String
+						}
+
+						// Timeouts
+						if route.Timeouts.Valid && route.Timeouts.String != "" {
+							line += " - Timeouts: " + route.Timeouts.String
+						}
+
 						println(line)
 					}
 				}
@@ -79,7 +156,7 @@ var Routes = cgCli.Command{
 		{
 			Name:        "add",
 			Usage:       "Add a route",
-			Description: "tmail routes add -d DESTINATION_HOST -rh REMOTE_HOST [-rp REMOTE_PORT] [-p PRORITY] [-l LOCAL_IP] [-u AUTHENTIFIED_USER] [-f MAIL_FROM] [-rl REMOTE_LOGIN] [-rpwd REMOTE_PASSWD]",
+			Description: "tmail routes add -d DESTINATION_HOST -rh REMOTE_HOST [-rp REMOTE_PORT] [-p PRORITY] [-l LOCAL_IP] [-u AUTHENTIFIED_USER] [-f MAIL_FROM] [-rl REMOTE_LOGIN] [-rpwd REMOTE_PASSWD] [-fc xclient|xforward] [-retry RETRY_SCHEDULE] [-proxy PROXY] [-rmech plain|cram-md5|scram-sha-256|xoauth2] [-w WEIGHT] [-mx] [-ip ipv6-first|ipv4-first|ipv6-only|ipv4-only] [-timeouts TIMEOUTS]",
 			Flags: []cgCli.Flag{
 				cgCli.StringFlag{
 					Name:  "destination, d",
@@ -89,7 +166,7 @@ var Routes = cgCli.Command{
 				cgCli.StringFlag{
 					Name:  "remote host, rh",
 					Value: "",
-					Usage: "remote host, eg where email should be deliver",
+					Usage: "remote host, eg where email should be deliver (lmtp://host:port or lmtp:///path/to/socket for LMTP)",
 				}, cgCli.IntFlag{
 					Name:  "remotePort, rp",
 					Value: 25,
@@ -126,6 +203,45 @@ var Routes = cgCli.Command{
 					Value: "",
 					Usage: "SMTPauth passwd for remote host",
 				},
+				cgCli.StringFlag{
+					Name:  "forwardClient, fc",
+					Value: "",
+					Usage: "Forward original client details to remote host using XCLIENT or XFORWARD (xclient|xforward)",
+				},
+				cgCli.StringFlag{
+					Name:  "retrySchedule, retry",
+					Value: "",
+					Usage: "Retry schedule of messages using this route, eg 5m,15m,1h,4h,8h",
+				},
+				cgCli.StringFlag{
+					Name:  "proxy",
+					Value: "",
+					Usage: "Connect through a SOCKS5 proxy (socks5://[user:password@]host:port) or a relay expecting a PROXY protocol header (proxy://host:port for v1, proxy2://host:port for v2) whose source is the local IP",
+				},
+				cgCli.StringFlag{
+					Name:  "rmech",
+					Value: "",
+					Usage: "SMTP AUTH mechanism: plain, cram-md5, scram-sha-256 or xoauth2 (remote password is the OAuth2 access token), best announced by remote host if empty",
+				},
+				cgCli.IntFlag{
+					Name:  "weight, w",
+					Value: 1,
+					Usage: "Route weight. Routes of the same priority are used in proportion to their weights",
+				},
+				cgCli.BoolFlag{
+					Name:  "mxFallback, mx",
+					Usage: "Deliver following MX records when all routes of the destination are down (circuit breakers open)",
+				},
+				cgCli.StringFlag{
+					Name:  "ipFamily, ip",
+					Value: "",
+					Usage: "IP family preference: ipv6-first, ipv4-first, ipv6-only or ipv4-only (default: TMAIL_DELIVERD_IP_FAMILY)",
+				},
+				cgCli.StringFlag{
+					Name:  "timeouts",
+					Value: "",
+					Usage: "Timeouts overriding TMAIL_DELIVERD_TIMEOUTS, eg: connect=10s,greeting=5m,data-term=10m (connect, greeting, ehlo, starttls, mail, rcpt, data-init, data-block, data-term, command)",
+				},
 			},
 			Action: func(c *cgCli.Context) {
 				// si la destination n'est pas renseignée on wildcard
@@ -134,7 +250,7 @@ var Routes = cgCli.Command{
 					host = "*"
 				}
 				// (host, localIp, remoteHost string, remotePort, priority int64, user, mailFrom, smtpAuthLogin, smtpAuthPasswd string)
-				err := api.RoutesAdd(host, c.String("l"), c.String("rh"), c.Int("rp"), c.Int("p"), c.String("u"), c.String("f"), c.String("rl"), c.String("rpwd"))
+				err := api.RoutesAdd(host, c.String("l"), c.String("rh"), c.Int("rp"), c.Int("p"), c.String("u"), c.String("f"), c.String("rl"), c.String("rpwd"), c.String("fc"), c.String("retry"), c.String("proxy"), c.String("rmech"), c.Int("w"), c.Bool("mx"), c.String("ip"), c.String("timeouts"))
 				cliHandleErr(err)
 			},
 		},
@@ -152,5 +268,150 @@ var Routes = cgCli.Command{
 				cliHandleErr(err)
 			},
 		},
+		{
+			Name:        "plan",
+			Usage:       "Validate a plan (routes to add and to delete) and show destinations which change (dry run)",
+			Description: "tmail routes plan PLAN_FILE",
+			Action: func(c *cgCli.Context) {
+				changes, err := api.RoutesPlanDiff(routesReadPlan(c))
+				cliHandleErr(err)
+				routesPrintChanges(changes)
+				os.Exit(0)
+			},
+		},
+		{
+			Name:        "apply",
+			Usage:       "Apply a plan atomically",
+			Description: "tmail routes apply [--probe] PLAN_FILE",
+			Flags: []cgCli.Flag{
+				cgCli.BoolFlag{
+					Name:  "probe",
+					Usage: "probe new routes of changed destinations, plan is rolled back if a probe fails",
+				},
+			},
+			Action: func(c *cgCli.Context) {
+				changes, err := api.RoutesPlanApply(routesReadPlan(c), c.Bool("probe"))
+				if changes != nil {
+					routesPrintChanges(changes)
+				}
+				cliHandleErr(err)
+				cliDieOk()
+			},
+		},
+		{
+			Name:        "test",
+			Usage:       "Show routing decision for a recipient without sending mail",
+			Description: "tmail routes test [-u AUTHENTIFIED_USER] [--probe] SENDER RECIPIENT",
+			Flags: []cgCli.Flag{
+				cgCli.StringFlag{
+					Name:  "smtpUser, u",
+					Value: "",
+					Usage: "Authentified user",
+				},
+				cgCli.BoolFlag{
+					Name:  "probe",
+					Usage: "connect to remote server and send EHLO (and STARTTLS if announced), no mail is sent",
+				},
+			},
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 2 {
+					cliDieBadArgs(c)
+				}
+				dr, err := api.RoutesTest(c.Args()[0], c.Args()[1], c.String("u"), c.Bool("probe"))
+				cliHandleErr(err)
+				if dr.Local {
+					println(dr.Host + " is a local domain: local delivery, no route is used")
+					cliDieOk()
+				}
+				via := "routes"
+				if dr.FromMX {
+					via = "MX records"
+				}
+				println(fmt.Sprintf("Remote delivery to %s following %s (routes of the same priority are tried in weighted random order)", dr.Host, via))
+				for _, r := range dr.Routes {
+					line := "Route " + r.Description
+					if r.RouteId == 0 {
+						line = "MX " + r.Description
+					}
+					switch {
+					case r.Down:
+						line += " - DOWN (circuit breaker open), skipped"
+					case r.Error != "":
+						line += " - ERROR " + r.Error
+					}
+					println(line)
+					for _, a := range r.Attempts {
+						local := "any local IP"
+						if a.LocalIP != nil {
+							local = a.LocalIP.String()
+						}
+						println("    " + local + " -> " + a.RemoteAddr)
+					}
+				}
+				if dr.Error != "" {
+					cliHandleErr(errors.New(dr.Error))
+				}
+				if p := dr.Probe; p != nil {
+					line := fmt.Sprintf("Probe: route %d - %s -> %s", p.RouteId, p.LocalAddr, p.RemoteAddr)
+					if p.LocalName != "" {
+						line += " - EHLO " + p.LocalName
+					}
+					if p.Hello != "" {
+						line += " - " + p.Hello
+					}
+					if p.StartTLS && p.TLSVersion != "" {
+						line += " - STARTTLS " + p.TLSVersion + " " + p.TLSCipher
+					} else if !p.StartTLS && p.Hello != "" {
+						line += " - no STARTTLS"
+					}
+					println(line)
+					if p.Error != "" {
+						cliHandleErr(errors.New("probe failed - " + p.Error))
+					}
+				}
+				cliDieOk()
+			},
+		},
+		{
+			Name:        "health",
+			Usage:       "Show health of routes (failure rates & circuit breakers)",
+			Description: "tmail routes health",
+			Action: func(c *cgCli.Context) {
+				health, err := api.RoutesHealth()
+				cliHandleErr(err)
+				if len(health) == 0 {
+					println("There is no route health recorded.")
+				}
+				for _, h := range health {
+					state := "up"
+					if h.IsOpen() {
+						state = "down until " + h.OpenUntil.Format("2006-01-02 15:04:05")
+					}
+					line := fmt.Sprintf("%d - %s - %s - Failures: %d/%d (%.1f%%) since %s - Consecutive failures: %d", h.RouteId, h.RemoteHost, state, h.Failures, h.Attempts, h.FailureRate(), h.WindowStart.Format("15:04:05"), h.ConsecutiveFailures)
+					if !h.LastSuccessAt.IsZero() {
+						line += " - Last success: " + h.LastSuccessAt.Format("2006-01-02 15:04:05")
+					}
+					if !h.LastFailureAt.IsZero() {
+						line += " - Last failure: " + h.LastFailureAt.Format("2006-01-02 15:04:05") + " " + h.LastError
+					}
+					println(line)
+				}
+				cliDieOk()
+			},
+		},
+		{
+			Name:        "health-reset",
+			Usage:       "Reset health of a route (closes its circuit breaker)",
+			Description: "tmail routes health-reset ROUTE_ID",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				routeId, err := strconv.ParseInt(c.Args()[0], 10, 64)
+				cliHandleErr(err)
+				cliHandleErr(api.RoutesHealthReset(routeId))
+				cliDieOk()
+			},
+		},
 	},
 }
@@ -0,0 +1,45 @@
+package cli
+
+import (
+	"io/ioutil"
+	"strconv"
+
+	cgCli "github.com/codegangsta/cli"
+	"github.com/toorop/tmail/api"
+)
+
+var rspamd = cgCli.Command{
+	Name:  "rspamd",
+	Usage: "commands to interact with rspamd",
+	Subcommands: []cgCli.Command{
+		{
+			Name:        "learn",
+			Usage:       "Learn messages as spam or ham",
+			Description: "tmail rspamd learn [-q] spam|ham FILE|QUARANTINE_ID...",
+			Flags: []cgCli.Flag{
+				cgCli.BoolFlag{
+					Name:  "quarantine, q",
+					Usage: "arguments are IDs of quarantined messages",
+				},
+			},
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) < 2 || (c.Args()[0] != "spam" && c.Args()[0] != "ham") {
+					cliDieBadArgs(c)
+				}
+				spam := c.Args()[0] == "spam"
+				for _, arg := range c.Args()[1:] {
+					if c.Bool("q") {
+						id, err := strconv.ParseInt(arg, 10, 64)
+						cliHandleErr(err)
+						cliHandleErr(api.RspamdLearnQuarantined(id, spam))
+						continue
+					}
+					raw, err := ioutil.ReadFile(arg)
+					cliHandleErr(err)
+					cliHandleErr(api.RspamdLearn(raw, spam))
+				}
+				cliDieOk()
+			},
+		},
+	},
+}
@@ -0,0 +1,101 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	cgCli "github.com/codegangsta/cli"
+	"github.com/toorop/tmail/api"
+	"github.com/toorop/tmail/core"
+)
+
+var sending = cgCli.Command{
+	Name:  "sending",
+	Usage: "commands to manage sending quotas of authenticated users",
+	Subcommands: []cgCli.Command{
+		{
+			Name:        "status",
+			Usage:       "Show quotas, counters of the day, bounce rate and reputation of users",
+			Description: "tmail sending status [USER]",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) > 1 {
+					cliDieBadArgs(c)
+				}
+				var statuses []core.SendingStatus
+				if len(c.Args()) == 1 {
+					status, err := api.SendingStatusOf(c.Args()[0])
+					cliHandleErr(err)
+					statuses = []core.SendingStatus{status}
+				} else {
+					var err error
+					statuses, err = api.SendingStatusList()
+					cliHandleErr(err)
+				}
+				if len(statuses) == 0 {
+					println("There is no sending user.")
+				}
+				for _, s := range statuses {
+					state := "active"
+					if s.Suspended {
+						state = "SUSPENDED until " + s.SuspendedUntil.Format(time.RFC3339) + " - " + s.SuspendReason
+					}
+					fmt.Printf("%s - %s - reputation %.1f%%\r\n", s.Login, state, s.Reputation)
+					fmt.Printf("\ttoday: %d/%s messages, %d/%s recipients, %d/%s bytes - %d delivered, %d bounced (%.1f%%)\r\n", s.Today.Messages, sendingQuotaString(int64(s.MsgsPerDay)), s.Today.Recipients, sendingQuotaString(int64(s.RcptsPerDay)), s.Today.Bytes, sendingQuotaString(s.BytesPerDay), s.Today.Delivered, s.Today.Bounced, s.BounceRate)
+				}
+				os.Exit(0)
+			},
+		},
+		{
+			Name:        "quota",
+			Usage:       "Set sending quotas of an user (0: global quota)",
+			Description: "tmail sending quota USER [-m MSGS_PER_DAY] [-r RCPTS_PER_DAY] [-b BYTES_PER_DAY]",
+			Flags: []cgCli.Flag{
+				cgCli.IntFlag{
+					Name:  "msgs, m",
+					Value: 0,
+					Usage: "messages per day",
+				},
+				cgCli.IntFlag{
+					Name:  "rcpts, r",
+					Value: 0,
+					Usage: "recipients per day",
+				},
+				cgCli.StringFlag{
+					Name:  "bytes, b",
+					Value: "",
+					Usage: "bytes per day (K, M or G unit), eg: 1G",
+				},
+			},
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				bytes, err := core.ParseSize(c.String("b"))
+				cliHandleErr(err)
+				cliHandleErr(api.SendingQuotaSet(c.Args()[0], c.Int("m"), c.Int("r"), bytes))
+				cliDieOk()
+			},
+		},
+		{
+			Name:        "reset",
+			Usage:       "Reset sending counters of an user and lift their suspension",
+			Description: "tmail sending reset USER",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				cliHandleErr(api.SendingReset(c.Args()[0]))
+				cliDieOk()
+			},
+		},
+	},
+}
+
+// sendingQuotaString returns quota as string ("-" if unlimited)
+func sendingQuotaString(quota int64) string {
+	if quota == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d", quota)
+}
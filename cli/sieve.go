@@ -0,0 +1,113 @@
+package cli
+
+import (
+	"io/ioutil"
+
+	cgCli "github.com/codegangsta/cli"
+	"github.com/toorop/tmail/api"
+)
+
+var sieve = cgCli.Command{
+	Name:  "sieve",
+	Usage: "commands to manage sieve scripts of users",
+	Subcommands: []cgCli.Command{
+		{
+			Name:        "list",
+			Usage:       "List sieve scripts of a user",
+			Description: "tmail sieve list USER",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				scripts, err := api.SieveScriptList(c.Args()[0])
+				cliHandleErr(err)
+				if len(scripts) == 0 {
+					println("There is no script.")
+				}
+				for _, s := range scripts {
+					if s.Active {
+						println(s.Name + " (active)")
+					} else {
+						println(s.Name)
+					}
+				}
+				cliDieOk()
+			},
+		}, {
+			Name:        "put",
+			Usage:       "Add or replace a sieve script of a user",
+			Description: "tmail sieve put [--activate] USER NAME FILE",
+			Flags: []cgCli.Flag{
+				cgCli.BoolFlag{
+					Name:  "activate, a",
+					Usage: "activate script",
+				},
+			},
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 3 {
+					cliDieBadArgs(c)
+				}
+				content, err := ioutil.ReadFile(c.Args()[2])
+				cliHandleErr(err)
+				_, err = api.SieveScriptPut(c.Args()[0], c.Args()[1], string(content))
+				cliHandleErr(err)
+				if c.Bool("activate") {
+					cliHandleErr(api.SieveScriptActivate(c.Args()[0], c.Args()[1]))
+				}
+				cliDieOk()
+			},
+		}, {
+			Name:        "check",
+			Usage:       "Check a sieve script",
+			Description: "tmail sieve check FILE",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				content, err := ioutil.ReadFile(c.Args()[0])
+				cliHandleErr(err)
+				cliHandleErr(api.SieveScriptCheck(string(content)))
+				cliDieOk()
+			},
+		}, {
+			Name:        "get",
+			Usage:       "Print a sieve script of a user",
+			Description: "tmail sieve get USER NAME",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 2 {
+					cliDieBadArgs(c)
+				}
+				script, err := api.SieveScriptGet(c.Args()[0], c.Args()[1])
+				cliHandleErr(err)
+				println(script.Content)
+				cliDieOk()
+			},
+		}, {
+			Name:        "del",
+			Usage:       "Delete a sieve script of a user (script must be inactive)",
+			Description: "tmail sieve del USER NAME",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 2 {
+					cliDieBadArgs(c)
+				}
+				cliHandleErr(api.SieveScriptDel(c.Args()[0], c.Args()[1]))
+				cliDieOk()
+			},
+		}, {
+			Name:        "activate",
+			Usage:       "Activate a sieve script of a user, without NAME scripts are deactivated",
+			Description: "tmail sieve activate USER [NAME]",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 && len(c.Args()) != 2 {
+					cliDieBadArgs(c)
+				}
+				name := ""
+				if len(c.Args()) == 2 {
+					name = c.Args()[1]
+				}
+				cliHandleErr(api.SieveScriptActivate(c.Args()[0], name))
+				cliDieOk()
+			},
+		},
+	},
+}
@@ -0,0 +1,101 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	cgCli "github.com/codegangsta/cli"
+	"github.com/toorop/tmail/api"
+)
+
+var throttle = cgCli.Command{
+	Name:  "throttle",
+	Usage: "commands to manage smtpd throttling",
+	Subcommands: []cgCli.Command{
+		{
+			Name:        "counters",
+			Usage:       "List messages counters of current hour",
+			Description: "tmail throttle counters",
+			Action: func(c *cgCli.Context) {
+				counters, err := api.ThrottleCounters()
+				cliHandleErr(err)
+				if len(counters) == 0 {
+					println("There is no messages counter for this hour.")
+				}
+				for _, counter := range counters {
+					fmt.Printf("%s - %d messages since %v\r\n", counter.Sender, counter.Count, counter.WindowStart)
+				}
+				os.Exit(0)
+			},
+		},
+		{
+			Name:        "reset",
+			Usage:       "Reset messages counters of a sender",
+			Description: "tmail throttle reset SENDER",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				cliHandleErr(api.ThrottleCounterReset(c.Args()[0]))
+				cliDieOk()
+			},
+		},
+		{
+			Name:        "limit",
+			Usage:       "Set throttling limits of an user (0: global limit)",
+			Description: "tmail throttle limit USER [-m MSGS_PER_HOUR] [-r MAX_RCPT] [-s MAX_SESSIONS]",
+			Flags: []cgCli.Flag{
+				cgCli.IntFlag{
+					Name:  "msgs, m",
+					Value: 0,
+					Usage: "messages per hour",
+				},
+				cgCli.IntFlag{
+					Name:  "rcpt, r",
+					Value: 0,
+					Usage: "recipients per message",
+				},
+				cgCli.IntFlag{
+					Name:  "sessions, s",
+					Value: 0,
+					Usage: "simultaneous sessions",
+				},
+			},
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				cliHandleErr(api.ThrottleLimitSet(c.Args()[0], c.Int("m"), c.Int("r"), c.Int("s")))
+				cliDieOk()
+			},
+		},
+		{
+			Name:        "unlimit",
+			Usage:       "Remove throttling limits of an user (global limits apply)",
+			Description: "tmail throttle unlimit USER",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				cliHandleErr(api.ThrottleLimitDel(c.Args()[0]))
+				cliDieOk()
+			},
+		},
+		{
+			Name:        "limits",
+			Usage:       "List throttling limits of users",
+			Description: "tmail throttle limits",
+			Action: func(c *cgCli.Context) {
+				limits, err := api.ThrottleLimitList()
+				cliHandleErr(err)
+				if len(limits) == 0 {
+					println("There is no user with throttling limits.")
+				}
+				for _, l := range limits {
+					fmt.Printf("%s - messages per hour: %d - recipients per message: %d - sessions: %d\r\n", l.Login, l.MsgsPerHour, l.MaxRcpt, l.MaxSessions)
+				}
+				os.Exit(0)
+			},
+		},
+	},
+}
@@ -0,0 +1,73 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	cgCli "github.com/codegangsta/cli"
+	"github.com/toorop/tmail/api"
+)
+
+var tlsCerts = cgCli.Command{
+	Name:  "tls",
+	Usage: "commands to manage TLS certificates presented by smtpd (SNI)",
+	Subcommands: []cgCli.Command{
+		{
+			Name:        "add",
+			Usage:       "Store a certificate and its key (PEM) in DB",
+			Description: "tmail tls add CERT_FILE KEY_FILE",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 2 {
+					cliDieBadArgs(c)
+				}
+				certPem, err := ioutil.ReadFile(c.Args()[0])
+				cliHandleErr(err)
+				keyPem, err := ioutil.ReadFile(c.Args()[1])
+				cliHandleErr(err)
+				stored, err := api.TLSCertificateAdd(certPem, keyPem)
+				cliHandleErr(err)
+				fmt.Printf("Certificate of %s stored (expires %v), run tmail tls reload to use it.\r\n", stored.Domain, stored.NotAfter)
+				os.Exit(0)
+			},
+		},
+		{
+			Name:        "del",
+			Usage:       "Remove certificate of a domain from DB",
+			Description: "tmail tls del DOMAIN",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				cliHandleErr(api.TLSCertificateDel(c.Args()[0]))
+				cliDieOk()
+			},
+		},
+		{
+			Name:        "list",
+			Usage:       "List certificates presented by smtpd (directory and DB)",
+			Description: "tmail tls list",
+			Action: func(c *cgCli.Context) {
+				infos, err := api.TLSCertificateList()
+				cliHandleErr(err)
+				if len(infos) == 0 {
+					println("No SNI certificate, ssl/server.crt is presented.")
+				}
+				for _, info := range infos {
+					fmt.Printf("%s - %s - expires %v\r\n", strings.Join(info.Names, ", "), info.Source, info.NotAfter)
+				}
+				os.Exit(0)
+			},
+		},
+		{
+			Name:        "reload",
+			Usage:       "Reload certificates of running tmail (SIGHUP)",
+			Description: "tmail tls reload",
+			Action: func(c *cgCli.Context) {
+				cliHandleErr(api.TLSReload())
+				cliDieOk()
+			},
+		},
+	},
+}
@@ -0,0 +1,112 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	cgCli "github.com/codegangsta/cli"
+	"github.com/toorop/tmail/api"
+	"github.com/toorop/tmail/core"
+)
+
+var trace = cgCli.Command{
+	Name:        "trace",
+	Usage:       "Show events of a message (queue id or Message-ID) or search messages",
+	Description: "tmail trace [-s SENDER] [-r RECIPIENT] [-m MESSAGE-ID] [--since DATE] [--until DATE] [-l LIMIT] [UUID|MESSAGE-ID]",
+	Flags: []cgCli.Flag{
+		cgCli.StringFlag{
+			Name:  "sender, s",
+			Value: "",
+			Usage: "envelope sender",
+		},
+		cgCli.StringFlag{
+			Name:  "rcpt, r",
+			Value: "",
+			Usage: "envelope recipient",
+		},
+		cgCli.StringFlag{
+			Name:  "message-id, m",
+			Value: "",
+			Usage: "Message-ID",
+		},
+		cgCli.StringFlag{
+			Name:  "since",
+			Value: "",
+			Usage: "events since DATE (RFC 3339) or since a duration, eg: 2h",
+		},
+		cgCli.StringFlag{
+			Name:  "until",
+			Value: "",
+			Usage: "events until DATE (RFC 3339) or until a duration ago",
+		},
+		cgCli.IntFlag{
+			Name:  "limit, l",
+			Value: 0,
+			Usage: "max number of messages (default 50)",
+		},
+	},
+	Action: func(c *cgCli.Context) {
+		if len(c.Args()) > 1 {
+			cliDieBadArgs(c)
+		}
+		var timelines []core.MessageTimeline
+		var err error
+		if len(c.Args()) == 1 {
+			timelines, err = api.MessageTrace(c.Args()[0])
+		} else {
+			query := core.MessageTraceQuery{
+				MessageId: c.String("m"),
+				MailFrom:  c.String("s"),
+				RcptTo:    c.String("r"),
+				Limit:     c.Int("l"),
+			}
+			query.Since, err = traceTime(c.String("since"))
+			cliHandleErr(err)
+			query.Until, err = traceTime(c.String("until"))
+			cliHandleErr(err)
+			timelines, err = api.MessageTraceSearch(query)
+		}
+		cliHandleErr(err)
+		if len(timelines) == 0 {
+			println("There is no traced message.")
+		}
+		for _, t := range timelines {
+			id := t.Uuid
+			if id == "" {
+				id = "not queued (session " + t.SessionId + ")"
+			}
+			fmt.Printf("%s - Message-ID: <%s> - from: %s\r\n", id, t.MessageId, t.MailFrom)
+			for _, e := range t.Events {
+				line := fmt.Sprintf("\t%s %-9s to: %s", e.OccurredAt.Format(time.RFC3339), e.Event, e.RcptTo)
+				if e.RemoteAddr != "" {
+					line += " - " + e.RemoteAddr
+				}
+				if e.Code != 0 {
+					line += fmt.Sprintf(" - %d", e.Code)
+				}
+				if e.Detail != "" {
+					line += " - " + e.Detail
+				}
+				fmt.Println(line)
+			}
+		}
+		os.Exit(0)
+	},
+}
+
+// traceTime returns time of value: a RFC 3339 date or a duration before now
+// (zero time if value is empty)
+func traceTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("bad date %s (RFC 3339 or duration expected)", value)
+	}
+	return t, nil
+}
@@ -13,7 +13,7 @@ var user = cgCli.Command{
 		{
 			Name:        "add",
 			Usage:       "Add an user",
-			Description: "tmail user add USER CLEAR_PASSWD [-m] [-r] [-q BYTES] [--catchall]",
+			Description: "tmail user add USER CLEAR_PASSWD [-m] [-r] [-q BYTES] [-d DRIVER] [--catchall]",
 			Flags: []cgCli.Flag{
 				cgCli.BoolFlag{
 					Name:  "mailbox, m",
@@ -32,13 +32,18 @@ var user = cgCli.Command{
 					Value: "",
 					Usage: "Mailbox quota in bytes (not bits). You can use K,M,G as unit. Eg: 10G mean a quota of 10GB",
 				},
+				cgCli.StringFlag{
+					Name:  "driver, d",
+					Value: "",
+					Usage: "Mailbox driver: dovecot or maildir (built-in). Default: TMAIL_USERS_MAILBOX_DEFAULT_DRIVER",
+				},
 			},
 			Action: func(c *cgCli.Context) {
 				var err error
 				if len(c.Args()) < 2 {
 					cliDieBadArgs(c)
 				}
-				err = api.UserAdd(c.Args()[0], c.Args()[1], c.String("q"), c.Bool("m"), c.Bool("r"), c.Bool("catchall"))
+				err = api.UserAdd(c.Args()[0], c.Args()[1], c.String("q"), c.String("d"), c.Bool("m"), c.Bool("r"), c.Bool("catchall"))
 				cliHandleErr(err)
 				cliDieOk()
 			},
@@ -78,6 +83,9 @@ var user = cgCli.Command{
 					line += " - have mailbox: "
 					if user.HaveMailbox {
 						line += "yes - home: " + user.Home
+						if user.MailboxDriver != "" {
+							line += " - driver: " + user.MailboxDriver
+						}
 					} else {
 						line += "no"
 					}
@@ -0,0 +1,141 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	cgCli "github.com/codegangsta/cli"
+	"github.com/toorop/tmail/api"
+	"github.com/toorop/tmail/core"
+)
+
+// vacationDate parses a date (YYYY-MM-DD or YYYY-MM-DD HH:MM), "" is the
+// zero time
+func vacationDate(date string) (time.Time, error) {
+	if date == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04", date, time.Local)
+	if err != nil {
+		t, err = time.ParseInLocation("2006-01-02", date, time.Local)
+	}
+	return t, err
+}
+
+// vacationFormatDate formats date of vacation
+func vacationFormatDate(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+var vacation = cgCli.Command{
+	Name:  "vacation",
+	Usage: "commands to manage vacation responses of mailboxes",
+	Subcommands: []cgCli.Command{
+		{
+			Name:        "set",
+			Usage:       "Set vacation response of a mailbox",
+			Description: "tmail vacation set [--subject SUBJECT] --body BODY|--body-file FILE [--start DATE] [--end DATE] [--interval DAYS] [--disabled] USER",
+			Flags: []cgCli.Flag{
+				cgCli.StringFlag{
+					Name:  "subject, s",
+					Usage: "subject of response (default: Auto: subject of message)",
+				},
+				cgCli.StringFlag{
+					Name:  "body, b",
+					Usage: "body of response",
+				},
+				cgCli.StringFlag{
+					Name:  "body-file, f",
+					Usage: "file containing body of response",
+				},
+				cgCli.StringFlag{
+					Name:  "start",
+					Usage: "start of vacation (YYYY-MM-DD or \"YYYY-MM-DD HH:MM\")",
+				},
+				cgCli.StringFlag{
+					Name:  "end",
+					Usage: "end of vacation (YYYY-MM-DD or \"YYYY-MM-DD HH:MM\")",
+				},
+				cgCli.IntFlag{
+					Name:  "interval, i",
+					Value: 7,
+					Usage: "days between two responses to the same sender",
+				},
+				cgCli.BoolFlag{
+					Name:  "disabled, d",
+					Usage: "vacation is saved but disabled",
+				},
+			},
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				body := c.String("body")
+				if c.String("body-file") != "" {
+					b, err := ioutil.ReadFile(c.String("body-file"))
+					cliHandleErr(err)
+					body = string(b)
+				}
+				start, err := vacationDate(c.String("start"))
+				cliHandleErr(err)
+				end, err := vacationDate(c.String("end"))
+				cliHandleErr(err)
+				_, err = api.VacationSet(core.Vacation{
+					Login:    c.Args()[0],
+					Enabled:  !c.Bool("disabled"),
+					Subject:  c.String("subject"),
+					Body:     body,
+					StartAt:  start,
+					EndAt:    end,
+					Interval: c.Int("interval"),
+				})
+				cliHandleErr(err)
+				cliDieOk()
+			},
+		}, {
+			Name:        "get",
+			Usage:       "Print vacation response of a mailbox",
+			Description: "tmail vacation get USER",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				v, err := api.VacationGet(c.Args()[0])
+				cliHandleErr(err)
+				println(fmt.Sprintf("Enabled: %t\nActive: %t\nStart: %s\nEnd: %s\nInterval: %d days\nSubject: %s\n\n%s", v.Enabled, v.IsActive(time.Now()), vacationFormatDate(v.StartAt), vacationFormatDate(v.EndAt), v.Interval, v.Subject, v.Body))
+				cliDieOk()
+			},
+		}, {
+			Name:        "del",
+			Usage:       "Delete vacation response of a mailbox",
+			Description: "tmail vacation del USER",
+			Action: func(c *cgCli.Context) {
+				if len(c.Args()) != 1 {
+					cliDieBadArgs(c)
+				}
+				cliHandleErr(api.VacationDel(c.Args()[0]))
+				cliDieOk()
+			},
+		}, {
+			Name:        "list",
+			Usage:       "List vacation responses",
+			Description: "tmail vacation list",
+			Action: func(c *cgCli.Context) {
+				vacations, err := api.VacationList()
+				cliHandleErr(err)
+				if len(vacations) == 0 {
+					println("There is no vacation.")
+				}
+				now := time.Now()
+				for _, v := range vacations {
+					println(fmt.Sprintf("%s - enabled: %t - active: %t - from %s to %s - every %d days", v.Login, v.Enabled, v.IsActive(now), vacationFormatDate(v.StartAt), vacationFormatDate(v.EndAt), v.Interval))
+				}
+				cliDieOk()
+			},
+		},
+	},
+}
@@ -0,0 +1,193 @@
+package core
+
+// ACME (Let's Encrypt)
+// Certificates of acme_hosts (me and hostnames of identities by default) are
+// obtained and renewed automatically (30 days before expiration). Challenges are TLS-ALPN-01, answered by the REST TLS
+// listener (validated on port 443), and HTTP-01, answered by the
+// acme_http_listen listener (validated on port 80).
+// Certificates and account key are cached in DB (AcmeCacheEntry), shared by
+// nodes of a cluster: only the node holding the ACME leader lease orders
+// and renews certificates, others serve them from cache.
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACME leader lease lifetime, it's renewed by acmeRenewInterval
+const (
+	acmeLeaseTTL       = 30 * time.Minute
+	acmeRenewInterval  = 10 * time.Minute
+	acmeLeaderLeaseKey = "acme"
+)
+
+// AcmeCacheEntry is an entry of the ACME cache (certificates, account key)
+type AcmeCacheEntry struct {
+	Id        int64
+	CacheKey  string `sql:"unique"`
+	Data      string `sql:"type:text;" json:"-"`
+	UpdatedAt time.Time
+}
+
+// acmeDBCache is the ACME cache stored in DB
+type acmeDBCache struct{}
+
+// Get implements autocert.Cache
+func (acmeDBCache) Get(ctx context.Context, key string) ([]byte, error) {
+	entry := AcmeCacheEntry{}
+	if err := DB.Where("cache_key = ?", key).First(&entry).Error; err != nil {
+		if err == gorm.RecordNotFound {
+			return nil, autocert.ErrCacheMiss
+		}
+		return nil, err
+	}
+	return []byte(entry.Data), nil
+}
+
+// Put implements autocert.Cache
+func (acmeDBCache) Put(ctx context.Context, key string, data []byte) error {
+	entry := AcmeCacheEntry{}
+	if err := DB.Where("cache_key = ?", key).First(&entry).Error; err != nil && err != gorm.RecordNotFound {
+		return err
+	}
+	entry.CacheKey, entry.Data, entry.UpdatedAt = key, string(data), time.Now()
+	return DB.Save(&entry).Error
+}
+
+// Delete implements autocert.Cache
+func (acmeDBCache) Delete(ctx context.Context, key string) error {
+	return DB.Where("cache_key = ?", key).Delete(AcmeCacheEntry{}).Error
+}
+
+// acmeHostPolicy allows ACME hosts, new certificates are ordered by the
+// node holding the ACME leader lease only
+func acmeHostPolicy(hosts []string) autocert.HostPolicy {
+	whitelist := autocert.HostWhitelist(hosts...)
+	return func(ctx context.Context, host string) error {
+		if err := whitelist(ctx, host); err != nil {
+			return err
+		}
+		if !ClusterLeader(acmeLeaderLeaseKey, acmeLeaseTTL) {
+			return errors.New("certificate of " + host + " is not yet ordered by the ACME leader")
+		}
+		return nil
+	}
+}
+
+var acmeManagerOnce sync.Once
+var acmeManagerInstance *autocert.Manager
+
+// acmeHosts returns hostnames managed by ACME
+func acmeHosts() []string {
+	hosts := Cfg.GetAcmeHosts()
+	if len(hosts) != 0 {
+		return hosts
+	}
+	hosts = []string{strings.ToLower(Cfg.GetMe())}
+	for _, identity := range Cfg.GetIdentities() {
+		p := strings.LastIndex(identity, "=")
+		if p == -1 {
+			continue
+		}
+		hostname := strings.ToLower(strings.TrimSpace(identity[p+1:]))
+		if hostname != "" && !IsStringInSlice(hostname, hosts) {
+			hosts = append(hosts, hostname)
+		}
+	}
+	return hosts
+}
+
+// acmeManager returns ACME manager
+func acmeManager() *autocert.Manager {
+	acmeManagerOnce.Do(func() {
+		acmeManagerInstance = &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       acmeDBCache{},
+			HostPolicy:  acmeHostPolicy(acmeHosts()),
+			RenewBefore: 30 * 24 * time.Hour,
+			Email:       Cfg.GetAcmeEmail(),
+		}
+		if Cfg.GetAcmeDirectoryUrl() != "" {
+			acmeManagerInstance.Client = &acme.Client{DirectoryURL: Cfg.GetAcmeDirectoryUrl()}
+		}
+	})
+	return acmeManagerInstance
+}
+
+// isAcmeChallenge returns true if hello is a TLS-ALPN-01 challenge
+func isAcmeChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+// acmeGetCertificate returns ACME certificate for name (ok is false if name
+// is not managed by ACME)
+func acmeGetCertificate(hello *tls.ClientHelloInfo, name string) (cert *tls.Certificate, ok bool, err error) {
+	if !Cfg.GetAcmeEnabled() || !IsStringInSlice(name, acmeHosts()) {
+		return nil, false, nil
+	}
+	h := *hello
+	h.ServerName = name
+	cert, err = acmeManager().GetCertificate(&h)
+	if err != nil {
+		Log.Error("TLS - ACME - unable to get certificate of " + name + " - " + err.Error())
+	}
+	return cert, true, err
+}
+
+// RestTLSConfig returns TLS config of REST server, certificates are the
+// ACME ones if ACME is enabled (nil otherwise: ssl/web_server.crt)
+func RestTLSConfig() *tls.Config {
+	if !Cfg.GetAcmeEnabled() {
+		return nil
+	}
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if isAcmeChallenge(hello) {
+				return acmeManager().GetCertificate(hello)
+			}
+			name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+			if name == "" {
+				name = strings.ToLower(Cfg.GetMe())
+			}
+			cert, _, err := acmeGetCertificate(hello, name)
+			return cert, err
+		},
+		NextProtos: []string{"http/1.1", acme.ALPNProto},
+	}
+}
+
+// LaunchAcme launches HTTP-01 challenges listener (if enabled) and obtains
+// certificates of ACME hosts
+func LaunchAcme() {
+	if addr := Cfg.GetAcmeHttpListen(); addr != "" {
+		go func() {
+			Log.Info("ACME - HTTP-01 listener " + addr + " launched")
+			if err := http.ListenAndServe(addr, acmeManager().HTTPHandler(nil)); err != nil {
+				Log.Error("ACME - HTTP-01 listener " + addr + " failed - " + err.Error())
+			}
+		}()
+	}
+	// give listeners time to start
+	time.Sleep(2 * time.Second)
+	ready := []string{}
+	for {
+		if ClusterLeader(acmeLeaderLeaseKey, acmeLeaseTTL) {
+			for _, host := range acmeHosts() {
+				if _, _, err := acmeGetCertificate(&tls.ClientHelloInfo{}, host); err == nil && !IsStringInSlice(host, ready) {
+					Log.Info("ACME - certificate of " + host + " ready")
+					ready = append(ready, host)
+				}
+			}
+		}
+		time.Sleep(acmeRenewInterval)
+	}
+}
@@ -0,0 +1,140 @@
+package core
+
+// Address rewriting
+// Rewrite rules replace the envelope sender (before queueing) or recipients
+// (at RCPT TO, before expansion of virtual aliases) matching a regexp. Rules
+// are tried by priority, the first matching one is applied.
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rewrite rules scopes
+const (
+	RewriteSender    = "sender"
+	RewriteRecipient = "recipient"
+)
+
+// rewrite rules are reloaded from DB with this interval
+const rewriteCacheTTL = 1 * time.Minute
+
+// AddressRewrite represents a rewrite rule of addresses
+type AddressRewrite struct {
+	Id          int64
+	Scope       string // sender or recipient
+	Pattern     string // regexp
+	Replacement string // $1... are replaced by submatches
+	Priority    int    // lowest first
+	CreatedAt   time.Time
+}
+
+// rewriteRule is a rewrite rule with its compiled regexp
+type rewriteRule struct {
+	AddressRewrite
+	re *regexp.Regexp
+}
+
+var rewriteCache = struct {
+	sync.Mutex
+	rules    []rewriteRule
+	loadedAt time.Time
+}{}
+
+// AddressRewriteAdd adds a rewrite rule of scope sender or recipient
+func AddressRewriteAdd(scope, pattern, replacement string, priority int) (rule AddressRewrite, err error) {
+	scope = strings.ToLower(strings.TrimSpace(scope))
+	if scope != RewriteSender && scope != RewriteRecipient {
+		return rule, errors.New("scope must be " + RewriteSender + " or " + RewriteRecipient)
+	}
+	if _, err = regexp.Compile(pattern); err != nil {
+		return rule, errors.New("bad pattern " + pattern + " - " + err.Error())
+	}
+	rule = AddressRewrite{
+		Scope:       scope,
+		Pattern:     pattern,
+		Replacement: strings.TrimSpace(replacement),
+		Priority:    priority,
+		CreatedAt:   time.Now(),
+	}
+	if err = DB.Create(&rule).Error; err != nil {
+		return
+	}
+	rewriteCacheReset()
+	return
+}
+
+// AddressRewriteDel removes rewrite rule id
+func AddressRewriteDel(id int64) error {
+	rule := AddressRewrite{}
+	if err := DB.Where("id = ?", id).First(&rule).Error; err != nil {
+		return err
+	}
+	if err := DB.Delete(&rule).Error; err != nil {
+		return err
+	}
+	rewriteCacheReset()
+	return nil
+}
+
+// AddressRewriteList returns rewrite rules by priority
+func AddressRewriteList() (rules []AddressRewrite, err error) {
+	rules = []AddressRewrite{}
+	err = DB.Order("priority, id").Find(&rules).Error
+	return
+}
+
+// rewriteCacheReset forces a reload of rewrite rules
+func rewriteCacheReset() {
+	rewriteCache.Lock()
+	rewriteCache.loadedAt = time.Time{}
+	rewriteCache.Unlock()
+}
+
+// rewriteRules returns rewrite rules (cached)
+func rewriteRules() []rewriteRule {
+	rewriteCache.Lock()
+	defer rewriteCache.Unlock()
+	if time.Since(rewriteCache.loadedAt) > rewriteCacheTTL {
+		list, err := AddressRewriteList()
+		if err != nil {
+			Log.Error("rewrite - unable to get rewrite rules - " + err.Error())
+			return rewriteCache.rules
+		}
+		rules := []rewriteRule{}
+		for _, r := range list {
+			re, err := regexp.Compile(r.Pattern)
+			if err != nil {
+				Log.Error(fmt.Sprintf("rewrite - bad pattern %s of rule %d - %s", r.Pattern, r.Id, err))
+				continue
+			}
+			rules = append(rules, rewriteRule{r, re})
+		}
+		rewriteCache.rules, rewriteCache.loadedAt = rules, time.Now()
+	}
+	return rewriteCache.rules
+}
+
+// RewriteAddress returns address rewritten by the first matching rule of
+// scope (address if none matches)
+func RewriteAddress(scope, address string) string {
+	if address == "" {
+		return address
+	}
+	for _, rule := range rewriteRules() {
+		if rule.Scope != scope || !rule.re.MatchString(address) {
+			continue
+		}
+		rewritten, err := aliasAddress(rule.re.ReplaceAllString(address, rule.Replacement), false)
+		if err != nil {
+			Log.Error(fmt.Sprintf("rewrite - rule %d rewrites %s to a bad address - %s", rule.Id, address, err))
+			return address
+		}
+		return rewritten
+	}
+	return address
+}
@@ -2,6 +2,7 @@ package core
 
 import (
 	"errors"
+	"net/mail"
 	"os/exec"
 	"strings"
 
@@ -9,6 +10,12 @@ import (
 )
 
 // Alias represents a tmail alias
+// A virtual alias (IsVirtual) maps an address, or @domain (catch-all of the
+// domain), to one or more addresses, local or remote. Virtual aliases are
+// expanded at RCPT TO, recursively: a destination which is a virtual alias
+// is expanded too, up to smtpd_virtual_alias_max_depth levels, and an
+// address found in its own expansion is a loop (recipient is rejected). A
+// catch-all applies to addresses which are not valid local recipients.
 type Alias struct {
 	ID         int64
 	Alias      string `sql:"unique"`
@@ -16,6 +23,18 @@ type Alias struct {
 	Pipe       string `sql:"null"`
 	IsDomAlias bool   `sql:"default:false"`
 	IsMiniList bool   `sql:"default:false"`
+	IsVirtual  bool   `sql:"default:false"`
+}
+
+// AliasLoopError is returned if expansion of a virtual alias loops or is
+// too deep
+type AliasLoopError struct {
+	Path []string
+}
+
+// Error implements error
+func (e *AliasLoopError) Error() string {
+	return "alias loop " + strings.Join(e.Path, " -> ")
 }
 
 // AliasGet returns an alias
@@ -33,6 +52,9 @@ func AliasAdd(alias, deliverTo, pipe string, isMiniList bool) error {
 		return errors.New("you must define pipe command OR local mailbox(es), domain where mails for this alias have to be delivered")
 	}
 	alias = strings.ToLower(strings.TrimSpace(alias))
+	if strings.HasPrefix(alias, "@") {
+		return errors.New("a catch-all must be a virtual alias")
+	}
 
 	// domain or adress alias
 	localDom := strings.SplitN(alias, "@", 2)
@@ -221,3 +243,196 @@ func AliasExists(alias string) (bool, error) {
 	}
 	return false, nil
 }
+
+// aliasAddress returns normalized address (or @domain if catchAll is true)
+func aliasAddress(address string, catchAll bool) (string, error) {
+	address = strings.ToLower(strings.TrimSpace(address))
+	if catchAll && strings.HasPrefix(address, "@") {
+		if len(address) == 1 || strings.Count(address, "@") != 1 {
+			return "", errors.New("bad catch-all " + address + ", @domain expected")
+		}
+		return address, nil
+	}
+	a, err := mail.ParseAddress(address)
+	if err != nil || strings.Count(a.Address, "@") != 1 {
+		return "", errors.New("bad address " + address)
+	}
+	return strings.ToLower(a.Address), nil
+}
+
+// AliasAddVirtual creates a virtual alias of address (or @domain) to
+// destinations (local or remote addresses)
+func AliasAddVirtual(address string, destinations []string) (alias Alias, err error) {
+	if alias.Alias, err = aliasAddress(address, true); err != nil {
+		return
+	}
+	domain := alias.Alias[strings.Index(alias.Alias, "@")+1:]
+	rcpthost, err := RcpthostGet(domain)
+	if err != nil {
+		if err == gorm.RecordNotFound {
+			err = errors.New("domain " + domain + " is not handled by tmail")
+		}
+		return
+	}
+	if !rcpthost.IsLocal {
+		return alias, errors.New("domain part of alias must be a local domain handled by tmail")
+	}
+	exists, err := AliasExists(alias.Alias)
+	if err != nil {
+		return
+	}
+	if exists {
+		return alias, errors.New(alias.Alias + " already exists")
+	}
+	if !strings.HasPrefix(alias.Alias, "@") {
+		user, err := UserGetByLogin(alias.Alias)
+		if err != nil && err != gorm.RecordNotFound {
+			return alias, err
+		}
+		if err == nil && user.HaveMailbox {
+			return alias, errors.New(alias.Alias + " is an existing user")
+		}
+		if _, err = MailGroupGet(alias.Alias); err != gorm.RecordNotFound {
+			if err == nil {
+				err = errors.New(alias.Alias + " is an existing group")
+			}
+			return alias, err
+		}
+	}
+	dests := []string{}
+	for _, list := range destinations {
+		for _, d := range strings.Split(list, ";") {
+			if strings.TrimSpace(d) == "" {
+				continue
+			}
+			dest, err := aliasAddress(d, false)
+			if err != nil {
+				return alias, err
+			}
+			if dest == alias.Alias {
+				return alias, errors.New(alias.Alias + " can't be its own destination")
+			}
+			if !IsStringInSlice(dest, dests) {
+				dests = append(dests, dest)
+			}
+		}
+	}
+	if len(dests) == 0 {
+		return alias, errors.New("no destination for " + alias.Alias)
+	}
+	alias.DeliverTo = strings.Join(dests, ";")
+	alias.IsVirtual = true
+	if err = DB.Create(&alias).Error; err != nil {
+		return
+	}
+	// loops are refused
+	if !strings.HasPrefix(alias.Alias, "@") {
+		if _, err = AliasExpand(alias.Alias); err != nil {
+			DB.Delete(&alias)
+		}
+	}
+	return
+}
+
+// aliasLookup returns the virtual alias (nil if none) which applies to
+// local address rcpt and if rcpt is a valid local recipient: mailbox,
+// alias, group, address of a domain alias or catch-all.
+// Aliases of the address and of its domain are fetched with one query.
+func aliasLookup(rcpt string) (virtual *Alias, valid bool, err error) {
+	localDom := strings.Split(rcpt, "@")
+	if len(localDom) != 2 {
+		return nil, false, errors.New("bad address format in aliasLookup. Got " + rcpt)
+	}
+	aliases := []Alias{}
+	if err = DB.Where("alias IN (?)", []string{rcpt, localDom[1], "@" + localDom[1]}).Find(&aliases).Error; err != nil && err != gorm.RecordNotFound {
+		return nil, false, err
+	}
+	var domAlias, catchAll *Alias
+	for i := range aliases {
+		switch aliases[i].Alias {
+		case rcpt:
+			if aliases[i].IsVirtual {
+				return &aliases[i], true, nil
+			}
+			return nil, true, nil
+		case localDom[1]:
+			domAlias = &aliases[i]
+		default:
+			if aliases[i].IsVirtual {
+				catchAll = &aliases[i]
+			}
+		}
+	}
+	// mailbox
+	u, err := UserGetByLogin(rcpt)
+	if err != nil && err != gorm.RecordNotFound {
+		return nil, false, err
+	}
+	if err == nil && u.HaveMailbox {
+		return nil, true, nil
+	}
+	// group
+	if _, err = MailGroupGet(rcpt); err != gorm.RecordNotFound {
+		return nil, err == nil, err
+	}
+	// domain alias
+	if domAlias != nil {
+		valid, err = IsValidLocalRcpt(localDom[0] + "@" + domAlias.DeliverTo)
+		return nil, valid, err
+	}
+	// Catchall
+	if _, err = UserGetCatchallForDomain(localDom[1]); err != gorm.RecordNotFound {
+		return nil, err == nil, err
+	}
+	return catchAll, catchAll != nil, nil
+}
+
+// AliasExpand returns final recipients of address (address itself if it's
+// not a virtual alias)
+func AliasExpand(address string) ([]string, error) {
+	rcpts := []string{}
+	err := aliasExpand(address, nil, nil, &rcpts)
+	return rcpts, err
+}
+
+// aliasExpandVirtual returns final recipients of address, virtual is the
+// virtual alias which applies to address
+func aliasExpandVirtual(address string, virtual *Alias) ([]string, error) {
+	rcpts := []string{}
+	err := aliasExpand(address, virtual, nil, &rcpts)
+	return rcpts, err
+}
+
+// aliasExpand appends final recipients of address to rcpts, path is the
+// chain of aliases which leads to address. If virtual is nil, the virtual
+// alias of address is searched if address is local.
+func aliasExpand(address string, virtual *Alias, path []string, rcpts *[]string) error {
+	key := strings.ToLower(address)
+	if IsStringInSlice(key, path) || len(path) > Cfg.GetSmtpdVirtualAliasMaxDepth() {
+		return &AliasLoopError{append(path, key)}
+	}
+	if virtual == nil {
+		local, err := isLocalDelivery(address)
+		if err != nil {
+			return err
+		}
+		if local {
+			if virtual, _, err = aliasLookup(address); err != nil {
+				return err
+			}
+		}
+	}
+	if virtual == nil {
+		if !IsStringInSlice(address, *rcpts) {
+			*rcpts = append(*rcpts, address)
+		}
+		return nil
+	}
+	next := append(append([]string{}, path...), key)
+	for _, dest := range strings.Split(virtual.DeliverTo, ";") {
+		if err := aliasExpand(dest, nil, next, rcpts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,409 @@
+package core
+
+// ARC (RFC 8617): validation of incoming chains & sealing of relayed
+// messages with the DKIM keys of deliverd_arc_seal_domain
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toorop/tmail/message"
+)
+
+// arcResult is the result of an ARC chain validation (cv)
+type arcResult string
+
+const (
+	arcNone arcResult = "none"
+	arcPass arcResult = "pass"
+	arcFail arcResult = "fail"
+)
+
+// RFC 8617 4.2.1: no more than 50 ARC sets
+const arcMaxInstances = 50
+
+var (
+	rxArcWSP   = regexp.MustCompile(`[ \t]+`)
+	rxArcBTag  = regexp.MustCompile(`([:;][ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+	rxArcFWSCR = regexp.MustCompile(`\r\n[ \t]`)
+)
+
+// arcSet is an ARC set: the three ARC headers of an instance
+type arcSet struct {
+	aar  string // ARC-Authentication-Results raw field
+	ams  string // ARC-Message-Signature raw field
+	as   string // ARC-Seal raw field
+	amsT map[string]string
+	asT  map[string]string
+}
+
+// arcParseTags parses tag-list (RFC 6376 3.2), whitespaces are removed
+// from values
+func arcParseTags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v := strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, kv[1])
+		tags[strings.TrimSpace(kv[0])] = v
+	}
+	return tags
+}
+
+// arcFieldName returns lowercased name of header field
+func arcFieldName(field string) string {
+	return strings.ToLower(strings.TrimSpace(field[:strings.Index(field, ":")]))
+}
+
+// arcFieldValue returns the value of header field
+func arcFieldValue(field string) string {
+	return field[strings.Index(field, ":")+1:]
+}
+
+// arcCanonHeader is the relaxed header canonicalization (RFC 6376 3.4.2)
+func arcCanonHeader(field string) string {
+	value := rxArcFWSCR.ReplaceAllString(arcFieldValue(field), " ")
+	value = strings.Replace(value, "\r\n", "", -1)
+	value = strings.TrimSpace(rxArcWSP.ReplaceAllString(value, " "))
+	return arcFieldName(field) + ":" + value + "\r\n"
+}
+
+// arcCanonBody is the relaxed body canonicalization (RFC 6376 3.4.4)
+func arcCanonBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(rxArcWSP.ReplaceAllString(line, " "), " ")
+	}
+	// remove empty lines at the end
+	for len(lines) != 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return []byte{}
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// arcStripB removes the value of the b= tag of a signature field
+func arcStripB(field string) string {
+	return rxArcBTag.ReplaceAllString(field, "$1")
+}
+
+// arcGetBody returns body of raw message
+func arcGetBody(raw *[]byte) []byte {
+	p := bytes.Index(*raw, []byte{13, 10, 13, 10})
+	if p == -1 {
+		return []byte{}
+	}
+	return (*raw)[p+4:]
+}
+
+// arcBodyHash returns base64 encoded sha256 hash of canonicalized body
+func arcBodyHash(raw *[]byte) string {
+	h := sha256.Sum256(arcCanonBody(arcGetBody(raw)))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// arcSelectHeaders returns fields signed for header names, from the
+// bottom (RFC 6376 5.4.2)
+func arcSelectHeaders(fields []string, names []string) []string {
+	used := make(map[int]bool)
+	selected := []string{}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || strings.Index(fields[i], ":") == -1 || arcFieldName(fields[i]) != name {
+				continue
+			}
+			used[i] = true
+			selected = append(selected, fields[i])
+			break
+		}
+	}
+	return selected
+}
+
+// arcGetSets returns ARC sets of raw message indexed by instance
+func arcGetSets(fields []string) (map[int]*arcSet, error) {
+	sets := make(map[int]*arcSet)
+	for _, field := range fields {
+		if strings.Index(field, ":") == -1 {
+			continue
+		}
+		name := arcFieldName(field)
+		if name != "arc-seal" && name != "arc-message-signature" && name != "arc-authentication-results" {
+			continue
+		}
+		tags := arcParseTags(arcFieldValue(field))
+		istr, ok := tags["i"]
+		if !ok {
+			return nil, errors.New("no instance tag in " + name)
+		}
+		i, err := strconv.Atoi(istr)
+		if err != nil || i < 1 || i > arcMaxInstances {
+			return nil, errors.New("bad instance tag in " + name)
+		}
+		set, ok := sets[i]
+		if !ok {
+			set = &arcSet{}
+			sets[i] = set
+		}
+		switch name {
+		case "arc-seal":
+			if set.as != "" {
+				return nil, fmt.Errorf("duplicate ARC-Seal for i=%d", i)
+			}
+			set.as, set.asT = field, tags
+		case "arc-message-signature":
+			if set.ams != "" {
+				return nil, fmt.Errorf("duplicate ARC-Message-Signature for i=%d", i)
+			}
+			set.ams, set.amsT = field, tags
+		default:
+			if set.aar != "" {
+				return nil, fmt.Errorf("duplicate ARC-Authentication-Results for i=%d", i)
+			}
+			set.aar = field
+		}
+	}
+	// instances must be 1..N and complete
+	for i := 1; i <= len(sets); i++ {
+		set, ok := sets[i]
+		if !ok || set.as == "" || set.ams == "" || set.aar == "" {
+			return nil, fmt.Errorf("incomplete ARC set i=%d", i)
+		}
+	}
+	return sets, nil
+}
+
+// arcSealData returns data signed by the ARC-Seal of instance n
+func arcSealData(sets map[int]*arcSet, n int, seal string) string {
+	data := ""
+	for i := 1; i <= n; i++ {
+		data += arcCanonHeader(sets[i].aar) + arcCanonHeader(sets[i].ams)
+		if i < n {
+			data += arcCanonHeader(sets[i].as)
+		}
+	}
+	return data + strings.TrimSuffix(arcCanonHeader(arcStripB(seal)), "\r\n")
+}
+
+// arcGetPublicKey returns the public key published by domain for selector
+func arcGetPublicKey(selector, domain string) (*rsa.PublicKey, error) {
+	txts, err := net.LookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		return nil, err
+	}
+	tags := arcParseTags(strings.Join(txts, ""))
+	der, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil || len(der) == 0 {
+		return nil, errors.New("no valid key for " + selector + "._domainkey." + domain)
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("key for " + selector + "._domainkey." + domain + " is not a RSA key")
+	}
+	return rsaPub, nil
+}
+
+// arcVerifySig verifies signature (tags) of data
+func arcVerifySig(tags map[string]string, data string) error {
+	if tags["a"] != "rsa-sha256" {
+		return errors.New("unsupported algorithm " + tags["a"])
+	}
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+	pub, err := arcGetPublicKey(tags["s"], tags["d"])
+	if err != nil {
+		return err
+	}
+	h := sha256.Sum256([]byte(data))
+	return rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig)
+}
+
+// arcValidate validates the ARC chain of raw message (RFC 8617 5.2)
+// It returns the chain validation status and the number of ARC sets.
+func arcValidate(raw *[]byte) (arcResult, int) {
+	fields := message.RawGetHeaderFields(raw)
+	sets, err := arcGetSets(fields)
+	if err != nil {
+		return arcFail, 0
+	}
+	n := len(sets)
+	if n == 0 {
+		return arcNone, 0
+	}
+	if sets[n].asT["cv"] == string(arcFail) {
+		return arcFail, n
+	}
+	for i := 1; i <= n; i++ {
+		cv := sets[i].asT["cv"]
+		if (i == 1 && cv != string(arcNone)) || (i > 1 && cv != string(arcPass)) {
+			return arcFail, n
+		}
+	}
+
+	// most recent AMS
+	ams := sets[n].amsT
+	if ams["bh"] != arcBodyHash(raw) {
+		return arcFail, n
+	}
+	data := ""
+	for _, f := range arcSelectHeaders(fields, strings.Split(ams["h"], ":")) {
+		data += arcCanonHeader(f)
+	}
+	data += strings.TrimSuffix(arcCanonHeader(arcStripB(sets[n].ams)), "\r\n")
+	if err = arcVerifySig(ams, data); err != nil {
+		return arcFail, n
+	}
+
+	// seals
+	for i := n; i >= 1; i-- {
+		if err = arcVerifySig(sets[i].asT, arcSealData(sets, i, sets[i].as)); err != nil {
+			return arcFail, n
+		}
+	}
+	return arcPass, n
+}
+
+// arcSign signs data with PEM encoded private key
+func arcSign(privKey, data string) (string, error) {
+	block, _ := pem.Decode([]byte(privKey))
+	if block == nil {
+		return "", errors.New("bad private key")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256([]byte(data))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// arcFoldField folds field as it will be sent
+func arcFoldField(field string) string {
+	f := []byte(field)
+	message.FoldHeader(&f)
+	return string(f)
+}
+
+// arcSeal adds an ARC set to raw message if it was received by our smtpd
+// from a remote client, authResults are the results of the checks recorded
+// by smtpd for this message ("": message is not sealed). Authentication-Results
+// header fields of the message are never trusted.
+// It returns the new instance or 0 if message was not sealed.
+func arcSeal(raw *[]byte, authResults string) (instance int, err error) {
+	domain := Cfg.GetDeliverdArcSealDomain()
+	if domain == "" || authResults == "" {
+		return 0, nil
+	}
+	fields := message.RawGetHeaderFields(raw)
+
+	dkc, err := DkimGetConfig(domain)
+	if err != nil {
+		return 0, err
+	}
+	if dkc == nil {
+		return 0, errors.New("DKIM is not enabled on ARC seal domain " + domain)
+	}
+
+	// chain validation status, as seen by smtpd
+	cv := arcNone
+	sets, err := arcGetSets(fields)
+	if err != nil {
+		cv = arcFail
+		instance = message.RawCountHeaders(raw, "arc-seal:") + 1
+	} else {
+		instance = len(sets) + 1
+		if len(sets) != 0 {
+			cv = arcFail
+			if strings.Contains(authResults, " arc=pass") {
+				cv = arcPass
+			}
+		}
+	}
+	if instance > arcMaxInstances {
+		return 0, nil
+	}
+	now := time.Now().Unix()
+
+	// ARC-Authentication-Results
+	aar := arcFoldField(fmt.Sprintf("ARC-Authentication-Results: i=%d; %s", instance, authResults))
+
+	// ARC-Message-Signature
+	names := []string{}
+	headers := dkimDefaultHeaders
+	if dkc.Headers != "" {
+		headers = dkc.Headers
+	}
+	// ARC headers are never signed by an AMS
+	for _, name := range strings.Split(headers, ":") {
+		if !strings.HasPrefix(name, "arc-") {
+			names = append(names, name)
+		}
+	}
+	signed := arcSelectHeaders(fields, names)
+	signedNames := []string{}
+	data := ""
+	for _, f := range signed {
+		signedNames = append(signedNames, arcFieldName(f))
+		data += arcCanonHeader(f)
+	}
+	ams := arcFoldField(fmt.Sprintf("ARC-Message-Signature: i=%d; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=", instance, domain, dkc.Selector, now, strings.Join(signedNames, ":"), arcBodyHash(raw)))
+	data += strings.TrimSuffix(arcCanonHeader(ams), "\r\n")
+	b, err := arcSign(dkc.PrivKey, data)
+	if err != nil {
+		return 0, err
+	}
+	ams += b
+
+	// ARC-Seal
+	as := arcFoldField(fmt.Sprintf("ARC-Seal: i=%d; a=rsa-sha256; t=%d; cv=%s; d=%s; s=%s; b=", instance, now, cv, domain, dkc.Selector))
+	if cv == arcFail {
+		// a failed chain can't be extended: the seal only covers our
+		// own ARC set (RFC 8617 5.1.2)
+		data = arcCanonHeader(aar) + arcCanonHeader(ams) + strings.TrimSuffix(arcCanonHeader(arcStripB(as)), "\r\n")
+	} else {
+		sets[instance] = &arcSet{aar: aar, ams: ams}
+		data = arcSealData(sets, instance, as)
+	}
+	if b, err = arcSign(dkc.PrivKey, data); err != nil {
+		return 0, err
+	}
+	as += b
+
+	// headers are added on top: ARC-Seal, ARC-Message-Signature,
+	// ARC-Authentication-Results
+	*raw = append([]byte(as+"\r\n"+ams+"\r\n"+aar+"\r\n"), *raw...)
+	return instance, nil
+}
@@ -0,0 +1,345 @@
+package core
+
+// Attachment hashing & threat-intel lookup
+// SHA-256 of each attachment is checked against a local blocklist
+// (smtpd_attachment_hash_blocklist) and a threat-intel service
+// (smtpd_attachment_hash_lookup). Lookup verdicts are cached.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	// max depth of nested multiparts & messages
+	attachmentMaxDepth = 10
+	// number of cached verdicts above which expired ones are purged
+	attachmentHashCachePurgeSize = 10000
+)
+
+// attachment represents an attachment of a message
+type attachment struct {
+	name   string
+	sha256 string
+}
+
+// attachmentHashVerdict is a verdict on an attachment hash
+type attachmentHashVerdict struct {
+	malicious bool
+	threat    string // name of the threat
+	expiresAt time.Time
+}
+
+// cache of lookup verdicts
+var attachmentHashCache = struct {
+	sync.Mutex
+	verdicts map[string]attachmentHashVerdict
+}{
+	verdicts: make(map[string]attachmentHashVerdict),
+}
+
+// local blocklist, read again when the file changes
+var attachmentHashBlocklist = struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	hashes  map[string]string // hash -> threat
+}{}
+
+// attachmentsOf returns attachments of raw message
+func attachmentsOf(rawMessage []byte) ([]attachment, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(rawMessage))
+	if err != nil {
+		return nil, err
+	}
+	attachments := []attachment{}
+	err = attachmentsWalk(textproto.MIMEHeader(msg.Header), msg.Body, 0, &attachments)
+	return attachments, err
+}
+
+// attachmentsWalk appends attachments of MIME part (header, body) to
+// attachments
+func attachmentsWalk(header textproto.MIMEHeader, body io.Reader, depth int, attachments *[]attachment) error {
+	if depth > attachmentMaxDepth {
+		return errors.New("too many nested MIME parts")
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if params["boundary"] == "" {
+			return errors.New("multipart without boundary")
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err = attachmentsWalk(part.Header, part, depth+1, attachments); err != nil {
+				return err
+			}
+		}
+	}
+
+	// attachment: part with a filename
+	name := params["name"]
+	if _, dParams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil && dParams["filename"] != "" {
+		name = dParams["filename"]
+	}
+	if mediaType == "message/rfc822" && name == "" {
+		msg, err := mail.ReadMessage(body)
+		if err != nil {
+			return err
+		}
+		return attachmentsWalk(textproto.MIMEHeader(msg.Header), msg.Body, depth+1, attachments)
+	}
+	if name == "" {
+		return nil
+	}
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	h := sha256.New()
+	if _, err = io.Copy(h, body); err != nil {
+		return err
+	}
+	*attachments = append(*attachments, attachment{name: name, sha256: hex.EncodeToString(h.Sum(nil))})
+	return nil
+}
+
+// attachmentHashBlocklisted returns threat name and true if hash is in local
+// blocklist
+// blocklist file: a hash per line, optionally followed by the threat name
+func attachmentHashBlocklisted(hash string) (threat string, found bool, err error) {
+	path := Cfg.GetSmtpdAttachmentHashBlocklist()
+	if path == "" {
+		return
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	attachmentHashBlocklist.Lock()
+	defer attachmentHashBlocklist.Unlock()
+	if attachmentHashBlocklist.path != path || !fi.ModTime().Equal(attachmentHashBlocklist.modTime) {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", false, err
+		}
+		defer f.Close()
+		hashes := make(map[string]string)
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || line[0] == '#' {
+				continue
+			}
+			fields := strings.Fields(line)
+			threat := "blocklisted"
+			if len(fields) > 1 {
+				threat = strings.Join(fields[1:], " ")
+			}
+			hashes[strings.ToLower(fields[0])] = threat
+		}
+		if err = scanner.Err(); err != nil {
+			return "", false, err
+		}
+		attachmentHashBlocklist.path = path
+		attachmentHashBlocklist.modTime = fi.ModTime()
+		attachmentHashBlocklist.hashes = hashes
+	}
+	threat, found = attachmentHashBlocklist.hashes[hash]
+	return
+}
+
+// attachmentHashLookup queries threat-intel service for hash (cached)
+// service is queried with GET url/hash, 200: malicious (body is the threat
+// name), 404: unknown.
+func attachmentHashLookup(uri, hash string) (v attachmentHashVerdict, err error) {
+	attachmentHashCache.Lock()
+	v, ok := attachmentHashCache.verdicts[hash]
+	attachmentHashCache.Unlock()
+	if ok && time.Now().Before(v.expiresAt) {
+		return v, nil
+	}
+	timeout, _, err := attachmentHashLookupOptions(uri)
+	if err != nil {
+		return
+	}
+	client := &http.Client{
+		Timeout: timeout,
+	}
+	resp, err := client.Get(strings.TrimSuffix(strings.Split(uri, "?")[0], "/") + "/" + hash)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	switch resp.StatusCode {
+	case 200:
+		v.malicious = true
+		v.threat = strings.TrimSpace(string(body))
+		if v.threat == "" {
+			v.threat = "known malicious"
+		}
+	case 404:
+	default:
+		return v, errors.New(resp.Status + " " + string(body))
+	}
+	if ttl := Cfg.GetSmtpdAttachmentHashCacheTtl(); ttl != 0 {
+		v.expiresAt = time.Now().Add(time.Duration(ttl) * time.Second)
+		attachmentHashCachePurge()
+		attachmentHashCache.Lock()
+		attachmentHashCache.verdicts[hash] = v
+		attachmentHashCache.Unlock()
+	}
+	return v, nil
+}
+
+// attachmentHashLookupOptions returns timeout & onfailure options of lookup
+// uri
+func attachmentHashLookupOptions(uri string) (timeout time.Duration, onFailure onfailure, err error) {
+	timeout, onFailure = 10*time.Second, CONTINUE
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return
+	}
+	if t := parsed.Query().Get("timeout"); t != "" {
+		var seconds uint64
+		if seconds, err = strconv.ParseUint(t, 10, 64); err != nil {
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+	switch parsed.Query().Get("onfailure") {
+	case "tempfail":
+		onFailure = TEMPFAIL
+	case "permfail":
+		onFailure = PERMFAIL
+	}
+	return
+}
+
+// attachmentHashCachePurge removes expired verdicts if cache is too large
+func attachmentHashCachePurge() {
+	now := time.Now()
+	attachmentHashCache.Lock()
+	defer attachmentHashCache.Unlock()
+	if len(attachmentHashCache.verdicts) < attachmentHashCachePurgeSize {
+		return
+	}
+	for hash, v := range attachmentHashCache.verdicts {
+		if now.After(v.expiresAt) {
+			delete(attachmentHashCache.verdicts, hash)
+		}
+	}
+}
+
+// checkAttachmentHash checks hashes of attachments against blocklist and
+// threat-intel service
+func checkAttachmentHash(ctx *smtpdCheckContext, rawMessage *[]byte) (v smtpdVerdict) {
+	v.check = "attachment-hash"
+	if !Cfg.GetSmtpdAttachmentHashEnabled() {
+		return
+	}
+	// attachments found before a parse error are checked first
+	attachments, walkErr := attachmentsOf(*rawMessage)
+	defer func() {
+		if walkErr == nil || v.action != smtpdActionAccept {
+			return
+		}
+		// attachments which can't be parsed can't be checked
+		ctx.logError("MAIL - attachment-hash: unable to parse message - " + walkErr.Error())
+		v.reason = "malformed MIME structure - " + walkErr.Error()
+		if QuarantineEnabled() {
+			v.action = smtpdActionQuarantine
+			return
+		}
+		v.action, v.reply = smtpdActionTempfail, "451 4.7.1 unable to check attachments of message, please try again later"
+	}()
+	uri := Cfg.GetSmtpdAttachmentHashLookup()
+	for _, a := range attachments {
+		name := attachmentSafeName(a.name)
+		ctx.log(fmt.Sprintf("MAIL - attachment %s sha256 %s", name, a.sha256))
+		threat, found, err := attachmentHashBlocklisted(a.sha256)
+		if err != nil {
+			ctx.logError("MAIL - attachment-hash: unable to read blocklist - " + err.Error())
+		}
+		if !found && uri != "" {
+			var hv attachmentHashVerdict
+			if hv, err = attachmentHashLookup(uri, a.sha256); err != nil {
+				ctx.logError("MAIL - attachment-hash: lookup failed - " + err.Error())
+				_, onFailure, _ := attachmentHashLookupOptions(uri)
+				if onFailure == TEMPFAIL {
+					v.action, v.reason, v.reply = smtpdActionTempfail, "threat-intel lookup failure", "454 4.3.0 scanner failure"
+					return
+				} else if onFailure == PERMFAIL {
+					v.action, v.reason, v.reply = smtpdActionReject, "threat-intel lookup failure", "554 5.3.0 scanner failure"
+					return
+				}
+				continue
+			}
+			found, threat = hv.malicious, hv.threat
+		}
+		if !found {
+			continue
+		}
+		action, err := parseSmtpdAction(Cfg.GetSmtpdAttachmentHashAction())
+		if err != nil {
+			ctx.logError("MAIL - attachment-hash: bad action in config - " + err.Error())
+			action = smtpdActionReject
+		}
+		v.action = action
+		threat = attachmentSafeName(threat)
+		v.reason = fmt.Sprintf("attachment %s (sha256 %s) is %s", name, a.sha256, threat)
+		v.reply = "554 5.7.1 message contains a malicious attachment"
+		if action == smtpdActionTempfail {
+			v.reply = "451 4.7.1 message contains a suspicious attachment, please try again later"
+		}
+		v.headers = append(v.headers, "X-Tmail-Attachment-Threat: "+mime.QEncoding.Encode("utf-8", name+" ("+threat+")"))
+		return
+	}
+	return
+}
+
+// attachmentSafeName returns name (set by the sender) without control
+// characters: it's logged and added in headers
+func attachmentSafeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+}
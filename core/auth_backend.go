@@ -0,0 +1,213 @@
+package core
+
+// Authentication backends
+// SMTP AUTH credentials are checked by the backends of smtpd_auth_backends,
+// in order: db (tmail users), ldap and pam, or backends registered with
+// RegisterAuthBackend. The next backend is tried if a backend doesn't know
+// the user (or is unavailable), a wrong password ends the chain.
+// Users of external backends are not stored in DB, their attributes are
+// mapped to User (see smtpd_auth_ldap_attributes). Successful
+// authentications are cached for smtpd_auth_cache_ttl seconds.
+
+import (
+	"crypto/sha256"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	// ErrAuthNoSuchUser is returned by backends which don't know the user
+	ErrAuthNoSuchUser = errors.New("no such user")
+	// ErrAuthFailed is returned by backends if password is wrong
+	ErrAuthFailed = errors.New("bad password")
+)
+
+// AuthBackend checks credentials of SMTP AUTH
+type AuthBackend interface {
+	// Authenticate returns user of login if passwd is right,
+	// ErrAuthNoSuchUser or ErrAuthFailed
+	Authenticate(login, passwd string) (*User, error)
+}
+
+var authBackends = struct {
+	sync.RWMutex
+	registered map[string]AuthBackend
+}{registered: map[string]AuthBackend{
+	"db":   dbAuthBackend{},
+	"ldap": ldapAuthBackend{},
+	"pam":  pamAuthBackend{},
+}}
+
+// RegisterAuthBackend registers backend b as name, it's used if name is in
+// smtpd_auth_backends
+func RegisterAuthBackend(name string, b AuthBackend) {
+	authBackends.Lock()
+	authBackends.registered[strings.ToLower(name)] = b
+	authBackends.Unlock()
+}
+
+// authCacheEntry is a cached authentication
+type authCacheEntry struct {
+	hash    [sha256.Size]byte
+	user    User
+	expires time.Time
+}
+
+var authCache = struct {
+	sync.Mutex
+	entries map[string]authCacheEntry
+}{entries: make(map[string]authCacheEntry)}
+
+// authCacheKey returns hash of credentials
+func authCacheKey(login, passwd string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(login + "\x00" + passwd))
+}
+
+// authCacheGet returns cached user of login/passwd
+func authCacheGet(login, passwd string) (*User, bool) {
+	authCache.Lock()
+	defer authCache.Unlock()
+	entry, ok := authCache.entries[login]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(authCache.entries, login)
+		return nil, false
+	}
+	if entry.hash != authCacheKey(login, passwd) {
+		return nil, false
+	}
+	user := entry.user
+	return &user, true
+}
+
+// authCachePut caches authentication of user
+func authCachePut(login, passwd string, user *User) {
+	ttl := Cfg.GetSmtpdAuthCacheTtl()
+	if ttl <= 0 {
+		return
+	}
+	authCache.Lock()
+	defer authCache.Unlock()
+	now := time.Now()
+	for l, entry := range authCache.entries {
+		if now.After(entry.expires) {
+			delete(authCache.entries, l)
+		}
+	}
+	authCache.entries[login] = authCacheEntry{
+		hash:    authCacheKey(login, passwd),
+		user:    *user,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// authenticate checks login/passwd with backends of config
+func authenticate(login, passwd string) (*User, error) {
+	login = strings.ToLower(login)
+	if login == "" || passwd == "" {
+		return nil, ErrAuthFailed
+	}
+	if user, ok := authCacheGet(login, passwd); ok {
+		return user, nil
+	}
+	var lastErr error
+	for _, name := range Cfg.GetSmtpdAuthBackends() {
+		name = strings.ToLower(strings.TrimSpace(name))
+		authBackends.RLock()
+		b, ok := authBackends.registered[name]
+		authBackends.RUnlock()
+		if !ok {
+			lastErr = errors.New("unknown auth backend " + name)
+			continue
+		}
+		user, err := b.Authenticate(login, passwd)
+		switch err {
+		case nil:
+			authCachePut(login, passwd, user)
+			return user, nil
+		case ErrAuthNoSuchUser:
+			continue
+		case ErrAuthFailed:
+			return nil, err
+		}
+		lastErr = errors.New(name + " - " + err.Error())
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, ErrAuthNoSuchUser
+}
+
+// authExternalUser returns user login of an external backend with
+// attributes attrs (see authMapAttributes)
+func authExternalUser(login string, attrs map[string]string) *User {
+	user := &User{
+		Login:     login,
+		Active:    "Y",
+		AuthRelay: Cfg.GetSmtpdAuthExternalRelay(),
+	}
+	for field, value := range attrs {
+		if value == "" {
+			continue
+		}
+		switch field {
+		case "login":
+			user.Login = strings.ToLower(value)
+		case "auth_relay":
+			user.AuthRelay = authAttributeBool(value)
+		case "have_mailbox":
+			user.HaveMailbox = authAttributeBool(value)
+		case "mailbox_quota":
+			user.MailboxQuota = value
+		case "mailbox_driver":
+			user.MailboxDriver = value
+		case "home":
+			user.Home = value
+		}
+	}
+	return user
+}
+
+// authAttributeBool returns boolean value of an attribute
+func authAttributeBool(value string) bool {
+	switch strings.ToLower(value) {
+	case "1", "true", "yes", "y", "on":
+		return true
+	}
+	return false
+}
+
+// authAttributesMap returns tmail field -> backend attribute of entries
+// field:attribute
+func authAttributesMap(entries []string) map[string]string {
+	m := make(map[string]string)
+	for _, entry := range entries {
+		p := strings.Index(entry, ":")
+		if p == -1 {
+			continue
+		}
+		m[strings.ToLower(strings.TrimSpace(entry[:p]))] = strings.TrimSpace(entry[p+1:])
+	}
+	return m
+}
+
+// dbAuthBackend authenticates tmail users
+type dbAuthBackend struct{}
+
+// Authenticate implements AuthBackend
+func (dbAuthBackend) Authenticate(login, passwd string) (*User, error) {
+	user, err := UserGet(login, passwd)
+	if err == gorm.RecordNotFound {
+		return nil, ErrAuthNoSuchUser
+	}
+	if err != nil && err.Error() == "crypto/bcrypt: hashedPassword is not the hash of the given password" {
+		return nil, ErrAuthFailed
+	}
+	return user, err
+}
@@ -0,0 +1,164 @@
+package core
+
+// LDAP authentication backend
+// Bind mode: if smtpd_auth_ldap_bind_dn_template is set (eg
+// uid=%s,ou=people,dc=example,dc=com) user binds with its DN and password.
+// Search+bind mode: tmail binds with smtpd_auth_ldap_bind_dn, searches the
+// entry of user under smtpd_auth_ldap_base_dn with smtpd_auth_ldap_filter
+// (eg (mail=%s)) then binds with its DN and password.
+// Attributes of entry are mapped to User by smtpd_auth_ldap_attributes.
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/ldap.v2"
+)
+
+// LDAP timeout
+const ldapTimeout = 10 * time.Second
+
+// ldapAuthBackend authenticates users of a LDAP directory
+type ldapAuthBackend struct{}
+
+// ldapConnect returns a connection to LDAP server of config
+func ldapConnect() (*ldap.Conn, error) {
+	u, err := url.Parse(Cfg.GetSmtpdAuthLdapUrl())
+	if err != nil {
+		return nil, errors.New("bad LDAP URL - " + err.Error())
+	}
+	host, port := u.Host, ""
+	if h, p, err := net.SplitHostPort(u.Host); err == nil {
+		host, port = h, p
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: Cfg.GetSmtpdAuthLdapTlsSkipVerify(),
+	}
+	var conn *ldap.Conn
+	switch u.Scheme {
+	case "ldap":
+		if port == "" {
+			port = "389"
+		}
+		if conn, err = ldap.Dial("tcp", net.JoinHostPort(host, port)); err != nil {
+			return nil, err
+		}
+		if Cfg.GetSmtpdAuthLdapStartTls() {
+			if err = conn.StartTLS(tlsConfig); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+	case "ldaps":
+		if port == "" {
+			port = "636"
+		}
+		if conn, err = ldap.DialTLS("tcp", net.JoinHostPort(host, port), tlsConfig); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("bad LDAP URL scheme " + u.Scheme + ", ldap or ldaps expected")
+	}
+	conn.SetTimeout(ldapTimeout)
+	return conn, nil
+}
+
+// Authenticate implements AuthBackend
+func (ldapAuthBackend) Authenticate(login, passwd string) (*User, error) {
+	conn, err := ldapConnect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	attrsMap := authAttributesMap(Cfg.GetSmtpdAuthLdapAttributes())
+	ldapAttrs := []string{}
+	for _, attr := range attrsMap {
+		ldapAttrs = append(ldapAttrs, attr)
+	}
+
+	// bind mode
+	if template := Cfg.GetSmtpdAuthLdapBindDnTemplate(); template != "" {
+		dn := fmt.Sprintf(template, ldapEscapeDn(login))
+		if err = conn.Bind(dn, passwd); err != nil {
+			return nil, ldapBindError(err)
+		}
+		attrs := map[string]string{}
+		if len(ldapAttrs) != 0 {
+			req := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, int(ldapTimeout.Seconds()), false, "(objectClass=*)", ldapAttrs, nil)
+			result, err := conn.Search(req)
+			if err != nil {
+				return nil, errors.New("unable to read entry " + dn + " - " + err.Error())
+			}
+			if len(result.Entries) == 1 {
+				attrs = ldapEntryAttributes(result.Entries[0], attrsMap)
+			}
+		}
+		return authExternalUser(login, attrs), nil
+	}
+
+	// search+bind mode
+	if err = conn.Bind(Cfg.GetSmtpdAuthLdapBindDn(), Cfg.GetSmtpdAuthLdapBindPassword()); err != nil {
+		return nil, errors.New("unable to bind as " + Cfg.GetSmtpdAuthLdapBindDn() + " - " + err.Error())
+	}
+	filter := strings.Replace(Cfg.GetSmtpdAuthLdapFilter(), "%s", ldap.EscapeFilter(login), -1)
+	req := ldap.NewSearchRequest(Cfg.GetSmtpdAuthLdapBaseDn(), ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout.Seconds()), false, filter, ldapAttrs, nil)
+	result, err := conn.Search(req)
+	if err != nil {
+		return nil, errors.New("search " + filter + " failed - " + err.Error())
+	}
+	switch len(result.Entries) {
+	case 0:
+		return nil, ErrAuthNoSuchUser
+	case 1:
+	default:
+		return nil, errors.New("search " + filter + " returned several entries")
+	}
+	entry := result.Entries[0]
+	if err = conn.Bind(entry.DN, passwd); err != nil {
+		return nil, ldapBindError(err)
+	}
+	return authExternalUser(login, ldapEntryAttributes(entry, attrsMap)), nil
+}
+
+// ldapBindError returns error of a bind of a user
+func ldapBindError(err error) error {
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return ErrAuthFailed
+	}
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return ErrAuthNoSuchUser
+	}
+	return err
+}
+
+// ldapEntryAttributes returns tmail field -> value of entry
+func ldapEntryAttributes(entry *ldap.Entry, attrsMap map[string]string) map[string]string {
+	attrs := make(map[string]string)
+	for field, attr := range attrsMap {
+		attrs[field] = entry.GetAttributeValue(attr)
+	}
+	return attrs
+}
+
+// ldapEscapeDn escapes value of a DN attribute (RFC 4514)
+func ldapEscapeDn(value string) string {
+	escaped := ""
+	for i, r := range value {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, r),
+			i == 0 && (r == ' ' || r == '#'),
+			i == len(value)-1 && r == ' ':
+			escaped += `\` + string(r)
+		default:
+			escaped += string(r)
+		}
+	}
+	return escaped
+}
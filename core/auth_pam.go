@@ -0,0 +1,48 @@
+//go:build pam
+// +build pam
+
+package core
+
+// PAM authentication backend (tmail must be built with tag pam)
+// Users are authenticated by service smtpd_auth_pam_service, with their
+// login or the local part of their login if smtpd_auth_pam_strip_domain is
+// true.
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/msteinert/pam"
+)
+
+// pamAuthBackend authenticates users with PAM
+type pamAuthBackend struct{}
+
+// Authenticate implements AuthBackend
+func (pamAuthBackend) Authenticate(login, passwd string) (*User, error) {
+	pamUser := login
+	if Cfg.GetSmtpdAuthPamStripDomain() {
+		if p := strings.LastIndex(pamUser, "@"); p != -1 {
+			pamUser = pamUser[:p]
+		}
+	}
+	tx, err := pam.StartFunc(Cfg.GetSmtpdAuthPamService(), pamUser, func(s pam.Style, msg string) (string, error) {
+		switch s {
+		case pam.PromptEchoOff, pam.PromptEchoOn:
+			return passwd, nil
+		case pam.ErrorMsg, pam.TextInfo:
+			return "", nil
+		}
+		return "", errors.New("unsupported PAM message style")
+	})
+	if err != nil {
+		return nil, errors.New("unable to start PAM transaction - " + err.Error())
+	}
+	if err = tx.Authenticate(0); err != nil {
+		return nil, ErrAuthFailed
+	}
+	if err = tx.AcctMgmt(0); err != nil {
+		return nil, ErrAuthFailed
+	}
+	return authExternalUser(login, nil), nil
+}
@@ -0,0 +1,14 @@
+//go:build !pam
+// +build !pam
+
+package core
+
+import "errors"
+
+// pamAuthBackend is not available (tmail is not built with tag pam)
+type pamAuthBackend struct{}
+
+// Authenticate implements AuthBackend
+func (pamAuthBackend) Authenticate(login, passwd string) (*User, error) {
+	return nil, errors.New("PAM support is not available, tmail must be built with tag pam")
+}
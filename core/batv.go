@@ -0,0 +1,248 @@
+package core
+
+// BATV (bounce address tag validation)
+// Senders of domains with BATV enabled are tagged on remote deliveries:
+// prvs=KDDDSSSSSS=local@domain where K is the number of the key of domain,
+// DDD the day of expiry (days since epoch modulo 1000) and SSSSSS the first
+// 3 bytes of HMAC-SHA1 of KDDD and sender. At RCPT valid tags are removed and
+// bounces (null sender) to addresses of these domains which are not validly
+// tagged are rejected: they are backscatter of messages we never sent. Keys
+// are replaced every batv_key_rotation days, tags signed by the previous key
+// are still verified.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// batvMaxLifetime is the max lifetime of tags in days (day of expiry is
+// modulo 1000)
+const batvMaxLifetime = 999
+
+// BatvDomain is a domain whose senders are tagged
+type BatvDomain struct {
+	Id         int64
+	Domain     string
+	KeyNumber  int       // K of tags signed by Secret (0-9)
+	Secret     string    // key (hex)
+	PrevSecret string    // previous key, number KeyNumber-1 ("" if none)
+	RotatedAt  time.Time // Secret is replaced batv_key_rotation days after
+	EnabledAt  time.Time // untagged bounces are accepted during batv_lifetime days after
+}
+
+// batvNewSecret returns a new key
+func batvNewSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// BatvEnable enables BATV on domain
+func BatvEnable(domain string) (b *BatvDomain, err error) {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if b, err = batvGet(domain); err != nil {
+		return nil, err
+	}
+	if b != nil {
+		return nil, errors.New("BATV is already enabled on " + domain)
+	}
+	secret, err := batvNewSecret()
+	if err != nil {
+		return nil, err
+	}
+	b = &BatvDomain{
+		Domain:    domain,
+		Secret:    secret,
+		RotatedAt: time.Now(),
+		EnabledAt: time.Now(),
+	}
+	err = DB.Save(b).Error
+	return b, err
+}
+
+// BatvDisable disables BATV on domain
+func BatvDisable(domain string) error {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	b, err := batvGet(domain)
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		return errors.New("BATV is not enabled on " + domain)
+	}
+	return DB.Delete(b).Error
+}
+
+// BatvGetAll returns domains with BATV enabled
+func BatvGetAll() (domains []BatvDomain, err error) {
+	domains = []BatvDomain{}
+	err = DB.Order("domain").Find(&domains).Error
+	if err == gorm.RecordNotFound {
+		err = nil
+	}
+	return
+}
+
+// BatvRotate replaces key of domain now, tags signed by the previous key
+// are still valid
+func BatvRotate(domain string) (b *BatvDomain, err error) {
+	b, err = batvGet(strings.ToLower(strings.TrimSpace(domain)))
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, errors.New("BATV is not enabled on " + domain)
+	}
+	return b, b.rotate()
+}
+
+// batvGet returns BATV config of domain (nil if BATV is not enabled)
+func batvGet(domain string) (*BatvDomain, error) {
+	b := &BatvDomain{}
+	err := DB.Where("domain = ?", domain).First(b).Error
+	if err == gorm.RecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// rotate replaces key of b, if another process has already replaced it b
+// is updated from DB
+func (b *BatvDomain) rotate() error {
+	secret, err := batvNewSecret()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	number := (b.KeyNumber + 1) % 10
+	r := DB.Model(BatvDomain{}).Where("id = ? AND secret = ?", b.Id, b.Secret).Updates(map[string]interface{}{"key_number": number, "secret": secret, "prev_secret": b.Secret, "rotated_at": now})
+	if r.Error != nil {
+		return r.Error
+	}
+	if r.RowsAffected != 1 {
+		return DB.First(b, b.Id).Error
+	}
+	b.KeyNumber, b.Secret, b.PrevSecret, b.RotatedAt = number, secret, b.Secret, now
+	return nil
+}
+
+// secretOf returns key number k of b (nil if it's no more valid)
+func (b *BatvDomain) secretOf(k int) []byte {
+	secret := ""
+	switch k {
+	case b.KeyNumber:
+		secret = b.Secret
+	case (b.KeyNumber + 9) % 10:
+		secret = b.PrevSecret
+	}
+	key, err := hex.DecodeString(secret)
+	if err != nil || len(key) == 0 {
+		return nil
+	}
+	return key
+}
+
+// batvDay returns day number (modulo 1000) of t
+func batvDay(t time.Time) int {
+	return int(t.Unix()/86400) % 1000
+}
+
+// batvTagValue returns tag value (KDDDSSSSSS) of mailbox for key number k
+// and day of expiry
+func batvTagValue(key []byte, k, day int, mailbox string) string {
+	kddd := fmt.Sprintf("%d%03d", k, day)
+	mac := hmac.New(sha1.New, key)
+	mac.Write([]byte(kddd + mailbox))
+	return kddd + hex.EncodeToString(mac.Sum(nil)[:3])
+}
+
+// batvUntag splits local part tagged by BATV, it returns false if local
+// is not tagged
+func batvUntag(local string) (value, original string, tagged bool) {
+	if len(local) < 16 || !strings.EqualFold(local[:5], "prvs=") || local[15] != '=' {
+		return "", local, false
+	}
+	value = strings.ToLower(local[5:15])
+	if strings.Trim(value[:4], "0123456789") != "" {
+		return "", local, false
+	}
+	return value, local[16:], true
+}
+
+// batvSign returns sender tagged if BATV is enabled on its domain, key of
+// domain is replaced if it's older than batv_key_rotation days
+func batvSign(sender string) (string, error) {
+	p := strings.LastIndex(sender, "@")
+	if p < 1 {
+		return sender, nil
+	}
+	if _, _, tagged := batvUntag(sender[:p]); tagged {
+		return sender, nil
+	}
+	domain := strings.ToLower(sender[p+1:])
+	b, err := batvGet(domain)
+	if err != nil || b == nil {
+		return sender, err
+	}
+	if time.Since(b.RotatedAt) > time.Duration(Cfg.GetBatvKeyRotation())*24*time.Hour {
+		if err = b.rotate(); err != nil {
+			return sender, errors.New("unable to rotate BATV key of " + domain + " - " + err.Error())
+		}
+	}
+	mailbox := sender[:p] + "@" + domain
+	day := batvDay(time.Now().Add(time.Duration(Cfg.GetBatvLifetime()) * 24 * time.Hour))
+	return "prvs=" + batvTagValue(b.secretOf(b.KeyNumber), b.KeyNumber, day, mailbox) + "=" + mailbox, nil
+}
+
+// batvCheckRcpt checks recipient rcpt of a message from sender, it returns
+// recipient without its valid tag and false if message is a bounce which
+// must be rejected (domain of rcpt has BATV enabled and rcpt is not validly
+// tagged)
+func batvCheckRcpt(sender, rcpt string) (string, bool, error) {
+	p := strings.LastIndex(rcpt, "@")
+	if p < 1 {
+		return rcpt, true, nil
+	}
+	domain := rcpt[p+1:]
+	value, original, tagged := batvUntag(rcpt[:p])
+	if !tagged && sender != "" {
+		return rcpt, true, nil
+	}
+	b, err := batvGet(domain)
+	if err != nil || b == nil {
+		return rcpt, true, err
+	}
+	untagged := original + "@" + domain
+	if tagged {
+		k, _ := strconv.Atoi(value[:1])
+		day, _ := strconv.Atoi(value[1:4])
+		key := b.secretOf(k)
+		remaining := (day - batvDay(time.Now()) + 1000) % 1000
+		if key != nil && remaining <= Cfg.GetBatvLifetime() && hmac.Equal([]byte(batvTagValue(key, k, day, untagged)), []byte(value)) {
+			return untagged, true, nil
+		}
+	}
+	// not a bounce or postmaster
+	if sender != "" || strings.EqualFold(original, "postmaster") {
+		return untagged, true, nil
+	}
+	// bounce of a message sent before BATV was enabled
+	if !tagged && time.Since(b.EnabledAt) < time.Duration(Cfg.GetBatvLifetime())*24*time.Hour {
+		return rcpt, true, nil
+	}
+	return rcpt, false, nil
+}
@@ -2,6 +2,7 @@ package core
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -140,3 +141,26 @@ func (c *clamav) ScanStream(r io.Reader) (bool, string, error) {
 	}
 	return false, "", nil
 }
+
+// checkClamav scans message with clamav
+func checkClamav(ctx *smtpdCheckContext, rawMessage *[]byte) (v smtpdVerdict) {
+	v.check = "clamav"
+	if !Cfg.GetSmtpdClamavEnabled() {
+		return
+	}
+	found, virusName, err := NewClamav().ScanStream(bytes.NewReader(*rawMessage))
+	Log.Debug("clamav scan result", found, virusName, err)
+	if err != nil {
+		ctx.logError("MAIL - clamav: " + err.Error())
+		v.action = smtpdActionTempfail
+		v.reason = "scanner failure"
+		v.reply = "454 4.3.0 scanner failure"
+		return
+	}
+	if found {
+		v.action = smtpdActionReject
+		v.reason = "infected by " + virusName
+		v.reply = "554 5.7.1 message infected by " + virusName
+	}
+	return
+}
@@ -0,0 +1,250 @@
+package core
+
+// Cluster mode
+// Nodes share DB and store. A queued message is leased by the deliverd node
+// which claims it (QMessage.Claim), leases are renewed by heartbeats of the
+// node. Each node stores its heartbeat in DB (with the state of its NSQ
+// producer and its deliveries counters), leases of a node without heartbeat
+// for cluster_node_timeout expire: messages are queued again and delivered
+// by living nodes. Final updates of a message in delivery are fenced by its
+// lease (a node whose lease expired doesn't delete or save it).
+// Singleton jobs (DMARC reports, digests, quarantine housekeeping, async
+// scans sweep, ACME orders) run on the node holding their leader lease
+// (ClusterLease), a lease not renewed before its expiry is taken over by
+// another node.
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// dead nodes are removed after this delay
+const clusterDeadNodeLifetime = 24 * time.Hour
+
+// ClusterLease is the leader lease of a singleton job
+type ClusterLease struct {
+	Id        int64
+	Name      string `sql:"unique"`
+	Owner     string // node id
+	ExpiresAt time.Time
+}
+
+// ClusterNode represents a node of cluster (last heartbeat)
+type ClusterNode struct {
+	Id          int64
+	NodeId      string `sql:"unique"`
+	Hostname    string
+	Role        string
+	Version     string
+	StartedAt   time.Time
+	HeartbeatAt time.Time
+	NsqOk       bool    // NSQ producer answered to ping
+	Delivered   int64   // since start
+	Deferred    int64   // since start
+	Bounced     int64   // since start
+	Throughput  float64 // deliveries (success) per minute during last heartbeat interval
+}
+
+// ClusterNodeStatus represents state of a node and its share of the queue
+type ClusterNodeStatus struct {
+	ClusterNode
+	Alive      bool
+	InDelivery int     // messages leased by node
+	Share      float64 // % of messages in delivery leased by node
+}
+
+// deliveries counters of this node
+var clusterStats struct {
+	delivered int64
+	deferred  int64
+	bounced   int64
+}
+
+var clusterNode = struct {
+	sync.Mutex
+	id string
+}{}
+
+// ClusterNodeId returns id of this node (cluster_node_id or hostname), it
+// must not change on restart
+func ClusterNodeId() string {
+	clusterNode.Lock()
+	defer clusterNode.Unlock()
+	if clusterNode.id == "" {
+		if clusterNode.id = Cfg.GetClusterNodeId(); clusterNode.id == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				hostname = Cfg.GetMe()
+			}
+			clusterNode.id = hostname
+		}
+	}
+	return clusterNode.id
+}
+
+// ClusterLeader returns true if this node holds (or takes) the leader lease
+// of job name, the lease is renewed for ttl
+func ClusterLeader(name string, ttl time.Duration) bool {
+	now, owner := time.Now(), ClusterNodeId()
+	r := DB.Model(ClusterLease{}).Where("name = ? AND (owner = ? OR expires_at < ?)", name, owner, now).Updates(map[string]interface{}{"owner": owner, "expires_at": now.Add(ttl)})
+	if r.Error != nil {
+		Log.Error("cluster - unable to renew leader lease " + name + " - " + r.Error.Error())
+		return false
+	}
+	if r.RowsAffected == 1 {
+		return true
+	}
+	err := DB.Where("name = ?", name).First(&ClusterLease{}).Error
+	if err != gorm.RecordNotFound {
+		if err != nil {
+			Log.Error("cluster - unable to get leader lease " + name + " - " + err.Error())
+		}
+		return false
+	}
+	// first lease (name is unique: only one node creates it)
+	return DB.Create(&ClusterLease{Name: name, Owner: owner, ExpiresAt: now.Add(ttl)}).Error == nil
+}
+
+// clusterLeaseTTL returns lifetime of a lease
+func clusterLeaseTTL() time.Duration {
+	return time.Duration(Cfg.GetClusterNodeTimeout()) * time.Second
+}
+
+// clusterDelivery counts delivery attempt of this node (result: success,
+// temp or perm)
+func clusterDelivery(result string) {
+	switch result {
+	case "success":
+		atomic.AddInt64(&clusterStats.delivered, 1)
+	case "temp":
+		atomic.AddInt64(&clusterStats.deferred, 1)
+	case "perm":
+		atomic.AddInt64(&clusterStats.bounced, 1)
+	}
+}
+
+// ClusterInit must be called before deliverd is launched: leases of a
+// previous run of this node (same cluster_node_id) are released
+func ClusterInit() error {
+	if Cfg.GetClusterHeartbeat() < 1 || Cfg.GetClusterNodeTimeout() <= Cfg.GetClusterHeartbeat() {
+		return errors.New("cluster_node_timeout must be greater than cluster_heartbeat")
+	}
+	released, err := clusterReleaseLeases("lease_owner = ?", ClusterNodeId())
+	if err != nil {
+		return err
+	}
+	if released != 0 {
+		Log.Info("cluster - " + strconv.Itoa(released) + " messages leased by a previous run of node " + ClusterNodeId() + " queued again")
+	}
+	return nil
+}
+
+// LaunchClusterHeartbeat sends heartbeats of this node
+func LaunchClusterHeartbeat() {
+	Log.Info("cluster heartbeat launched, node " + ClusterNodeId())
+	node := ClusterNode{NodeId: ClusterNodeId(), Role: Cfg.GetRole(), Version: Version, StartedAt: time.Now()}
+	node.Hostname, _ = os.Hostname()
+	for {
+		if err := clusterHeartbeat(&node, time.Now()); err != nil {
+			Log.Error("cluster - heartbeat failed - " + err.Error())
+		}
+		time.Sleep(time.Duration(Cfg.GetClusterHeartbeat()) * time.Second)
+	}
+}
+
+// clusterHeartbeat saves state of node, renews its leases and releases
+// leases of dead nodes
+func clusterHeartbeat(node *ClusterNode, now time.Time) error {
+	stored := ClusterNode{}
+	err := DB.Where("node_id = ?", node.NodeId).First(&stored).Error
+	if err != nil && err != gorm.RecordNotFound {
+		return err
+	}
+	node.Id = stored.Id
+
+	// throughput since last heartbeat
+	delivered := atomic.LoadInt64(&clusterStats.delivered)
+	if !node.HeartbeatAt.IsZero() {
+		if elapsed := now.Sub(node.HeartbeatAt).Minutes(); elapsed > 0 {
+			node.Throughput = float64(delivered-node.Delivered) / elapsed
+		}
+	}
+	node.Delivered = delivered
+	node.Deferred = atomic.LoadInt64(&clusterStats.deferred)
+	node.Bounced = atomic.LoadInt64(&clusterStats.bounced)
+	node.NsqOk = NsqQueueProducer != nil && NsqQueueProducer.Ping() == nil
+	node.HeartbeatAt = now
+	if err = DB.Save(node).Error; err != nil {
+		return err
+	}
+
+	// renew leases
+	if err = DB.Model(QMessage{}).Where("status = ? AND lease_owner = ?", 0, node.NodeId).Update("lease_expires_at", now.Add(clusterLeaseTTL())).Error; err != nil {
+		return err
+	}
+
+	// leases of dead nodes
+	released, err := clusterReleaseLeases("lease_owner != ? AND lease_expires_at < ?", "", now)
+	if err != nil {
+		return err
+	}
+	if released != 0 {
+		Log.Info("cluster - " + strconv.Itoa(released) + " messages with expired leases queued again")
+	}
+	return DB.Where("heartbeat_at < ?", now.Add(-clusterDeadNodeLifetime)).Delete(ClusterNode{}).Error
+}
+
+// clusterReleaseLeases queues again messages in delivery matching where, it
+// returns the number of released messages
+func clusterReleaseLeases(where string, args ...interface{}) (released int, err error) {
+	messages := []QMessage{}
+	if err = DB.Where("status = ? AND "+where, append([]interface{}{0}, args...)...).Find(&messages).Error; err != nil {
+		return
+	}
+	for i := range messages {
+		// another node may have released (or renewed) it in the meantime
+		r := DB.Model(QMessage{}).Where("id = ? AND status = ? AND "+where, append([]interface{}{messages[i].Id, 0}, args...)...).Updates(map[string]interface{}{"status": 2, "lease_owner": "", "last_update": time.Now()})
+		if r.Error != nil {
+			return released, r.Error
+		}
+		if r.RowsAffected != 1 {
+			continue
+		}
+		messages[i].Status, messages[i].LeaseOwner = 2, ""
+		if err = messages[i].publish(); err != nil {
+			return released, err
+		}
+		released++
+	}
+	return
+}
+
+// ClusterStatus returns status of cluster nodes
+func ClusterStatus() (status []ClusterNodeStatus, err error) {
+	nodes := []ClusterNode{}
+	if err = DB.Order("node_id").Find(&nodes).Error; err != nil {
+		return
+	}
+	status = []ClusterNodeStatus{}
+	total := 0
+	for _, n := range nodes {
+		s := ClusterNodeStatus{ClusterNode: n, Alive: time.Since(n.HeartbeatAt) < clusterLeaseTTL()}
+		if err = DB.Model(QMessage{}).Where("status = ? AND lease_owner = ?", 0, n.NodeId).Count(&s.InDelivery).Error; err != nil {
+			return
+		}
+		total += s.InDelivery
+		status = append(status, s)
+	}
+	for i := range status {
+		if total != 0 {
+			status[i].Share = float64(status[i].InDelivery) * 100 / float64(total)
+		}
+	}
+	return
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path"
 	"reflect"
 	"strconv"
 	"strings"
@@ -19,42 +20,227 @@ type Config struct {
 	sync.Mutex
 	cfg struct {
 		ClusterModeEnabled  bool   `name:"cluster_mode_enabled" default:"false"`
+		ClusterNodeId       string `name:"cluster_node_id" default:"_"`
+		ClusterHeartbeat    int    `name:"cluster_heartbeat" default:"10"`
+		ClusterNodeTimeout  int    `name:"cluster_node_timeout" default:"60"`
 		Me                  string `name:"me" default:""`
 		TempDir             string `name:"tempdir" default:"/tmp"`
 		LogPath             string `name:"logpath" default:"stdout"`
+		LogFormat           string `name:"log_format" default:"text"`
 		DebugEnabled        bool   `name:"debug_enabled" default:"false"`
 		HideServerSignature bool   `name:"hide_server_signature" default:"false"`
+		Identities          string `name:"identities" default:"_"`
+
+		MonitorInterval       int `name:"monitor_interval" default:"60"`
+		MonitorAlertThreshold int `name:"monitor_alert_threshold" default:"10"`
+
+		MetricsListen         string `name:"metrics_listen" default:"_"`
+		MetricsRollupsEnabled bool   `name:"metrics_rollups_enabled" default:"false"`
+
+		WebhookEnabled     bool   `name:"webhook_enabled" default:"false"`
+		WebhookUrls        string `name:"webhook_urls" default:"_"`
+		WebhookSecret      string `name:"webhook_secret" default:"_"`
+		WebhookTimeout     int    `name:"webhook_timeout" default:"10"`
+		WebhookMaxAttempts int    `name:"webhook_max_attempts" default:"8"`
 
 		DbDriver string `name:"db_driver"`
 		DbSource string `name:"db_source"`
 
-		StoreDriver  string `name:"store_driver"`
-		StroreSource string `name:"store_source"`
+		StoreDriver             string `name:"store_driver"`
+		StroreSource            string `name:"store_source"`
+		StoreEncryptionKey      string `name:"store_encryption_key" default:"_"`
+		StoreEncryptionRequired bool   `name:"store_encryption_required" default:"false"`
 
 		//NsqdEnbleLogging        bool   `name:"nsqd_eanble_logging" default:"false"`
 		NSQLookupdTcpAddresses  string `name:"nsq_lookupd_tcp_addresses" default:"_"`
 		NSQLookupdHttpAddresses string `name:"nsq_lookupd_http_addresses" default:"_"`
 
-		LaunchSmtpd              bool   `name:"smtpd_launch" default:"false"`
-		SmtpdDsns                string `name:"smtpd_dsns" default:""`
-		SmtpdServerTimeout       int    `name:"smtpd_server_timeout" default:"300"`
-		SmtpdMaxDataBytes        int    `name:"smtpd_max_databytes" default:"0"`
-		SmtpdMaxHops             int    `name:"smtpd_max_hops" default:"10"`
-		SmtpdMaxRcptTo           int    `name:"smtpd_max_rcpt" default:"0"`
-		SmtpdMaxBadRcptTo        int    `name:"smtpd_max_bad_rcpt" default:"0"`
-		SmtpdMaxVrfy             int    `name:"smtpd_max_vrfy" default:"0"`
-		SmtpdClamavEnabled       bool   `name:"smtpd_scan_clamav_enabled" default:"false"`
-		SmtpdClamavDsns          string `name:"smtpd_scan_clamav_dsns" default:""`
-		SmtpdConcurrencyIncoming int    `name:"smtpd_concurrency_incoming" default:"20"`
+		Role string `name:"role" default:"all"`
+
+		LaunchSmtpd               bool   `name:"smtpd_launch" default:"false"`
+		SmtpdDsns                 string `name:"smtpd_dsns" default:""`
+		SmtpdServerTimeout        int    `name:"smtpd_server_timeout" default:"300"`
+		SmtpdDataTimeout          int    `name:"smtpd_data_timeout" default:"0"`
+		SmtpdTLSHandshakeTimeout  int    `name:"smtpd_tls_handshake_timeout" default:"0"`
+		SmtpdSessionTimeout       int    `name:"smtpd_session_timeout" default:"0"`
+		SmtpdShutdownGrace        int    `name:"smtpd_shutdown_grace" default:"30"`
+		SmtpdMaxDataBytes         int    `name:"smtpd_max_databytes" default:"0"`
+		SmtpdMaxHops              int    `name:"smtpd_max_hops" default:"10"`
+		SmtpdMaxRcptTo            int    `name:"smtpd_max_rcpt" default:"0"`
+		SmtpdMaxBadRcptTo         int    `name:"smtpd_max_bad_rcpt" default:"0"`
+		SmtpdMaxVrfy              int    `name:"smtpd_max_vrfy" default:"0"`
+		SmtpdMaxMail              int    `name:"smtpd_max_mail" default:"0"`
+		SmtpdMaxRcptDomains       int    `name:"smtpd_max_rcpt_domains" default:"0"`
+		SmtpdVirtualAliasMaxDepth int    `name:"smtpd_virtual_alias_max_depth" default:"10"`
+		SmtpdClamavEnabled        bool   `name:"smtpd_scan_clamav_enabled" default:"false"`
+		SmtpdClamavDsns           string `name:"smtpd_scan_clamav_dsns" default:""`
+		SmtpdConcurrencyIncoming  int    `name:"smtpd_concurrency_incoming" default:"20"`
+
+		SmtpdAuthResultsEnabled    bool   `name:"smtpd_authres_enabled" default:"false"`
+		SmtpdDmarcActionReject     string `name:"smtpd_dmarc_action_reject" default:"reject"`
+		SmtpdDmarcActionQuarantine string `name:"smtpd_dmarc_action_quarantine" default:"quarantine"`
+		SmtpdDmarcOverrides        string `name:"smtpd_dmarc_overrides" default:"_"`
+		QuarantineStoreSource      string `name:"quarantine_store_source" default:"_"`
+		QuarantineLifetime         int    `name:"quarantine_lifetime" default:"30"`
+		QuarantineDigestEnabled    bool   `name:"quarantine_digest_enabled" default:"false"`
+		SmtpdShadowChecks          string `name:"smtpd_shadow_checks" default:"_"`
+		SmtpdMilters               string `name:"smtpd_milters" default:"_"`
+		SmtpdContentFilter         string `name:"smtpd_content_filter" default:"_"`
+		SmtpdRspamd                string `name:"smtpd_rspamd" default:"_"`
+		SmtpdRspamdController      string `name:"smtpd_rspamd_controller" default:"_"`
+		SmtpdRspamdPassword        string `name:"smtpd_rspamd_password" default:"_"`
+
+		SmtpdDmarcReportsEnabled bool   `name:"smtpd_dmarc_reports_enabled" default:"false"`
+		SmtpdDmarcReportsFrom    string `name:"smtpd_dmarc_reports_from" default:"_"`
+		SmtpdDmarcReportsOrgName string `name:"smtpd_dmarc_reports_org_name" default:"_"`
+		SmtpdDmarcReportsMaxSize int    `name:"smtpd_dmarc_reports_max_size" default:"10485760"`
+
+		SmtpdGreylistEnabled       bool `name:"smtpd_greylist_enabled" default:"false"`
+		SmtpdGreylistDelay         int  `name:"smtpd_greylist_delay" default:"300"`
+		SmtpdGreylistExpire        int  `name:"smtpd_greylist_expire" default:"14400"`
+		SmtpdGreylistPassedTtl     int  `name:"smtpd_greylist_passed_ttl" default:"36"`
+		SmtpdGreylistAutoWhitelist int  `name:"smtpd_greylist_auto_whitelist" default:"5"`
+
+		SmtpdDisabledVerbs string `name:"smtpd_disabled_verbs" default:"_"`
+		SmtpdHelp          string `name:"smtpd_help" default:"_"`
+
+		SmtpdFutureReleaseMaxInterval int `name:"smtpd_future_release_max_interval" default:"0"`
+
+		SmtpdPassthroughParams string `name:"smtpd_passthrough_params" default:"_"`
+
+		SmtpdScanMode         string `name:"smtpd_scan_mode" default:"_"`
+		SmtpdScanAsyncWorkers int    `name:"smtpd_scan_async_workers" default:"4"`
+
+		SmtpdThrottleConnectionsPerIp int `name:"smtpd_throttle_connections_per_ip" default:"0"`
+		SmtpdThrottleUserSessions     int `name:"smtpd_throttle_user_sessions" default:"0"`
+		SmtpdThrottleMsgsPerHour      int `name:"smtpd_throttle_msgs_per_hour" default:"0"`
+
+		SmtpdSendingMsgsPerDay      int    `name:"smtpd_sending_msgs_per_day" default:"0"`
+		SmtpdSendingRcptsPerDay     int    `name:"smtpd_sending_rcpts_per_day" default:"0"`
+		SmtpdSendingBytesPerDay     string `name:"smtpd_sending_bytes_per_day" default:"_"`
+		SmtpdSendingSuspendDuration int    `name:"smtpd_sending_suspend_duration" default:"1440"`
+		SmtpdSendingMaxBounceRate   int    `name:"smtpd_sending_max_bounce_rate" default:"0"`
+		SmtpdSendingBounceRateMin   int    `name:"smtpd_sending_bounce_rate_min" default:"20"`
+
+		SmtpdMemoryBudget        int `name:"smtpd_memory_budget" default:"0"`
+		SmtpdMemoryHighWatermark int `name:"smtpd_memory_high_watermark" default:"90"`
+
+		SmtpdRequireTLS        string `name:"smtpd_require_tls" default:"_"`
+		SmtpdRequireAuth       string `name:"smtpd_require_auth" default:"_"`
+		SmtpdRequireExceptions string `name:"smtpd_require_exceptions" default:"_"`
+
+		SmtpdAuthBackends           string `name:"smtpd_auth_backends" default:"db"`
+		SmtpdAuthMechanisms         string `name:"smtpd_auth_mechanisms" default:"PLAIN"`
+		SmtpdAuthCacheTtl           int    `name:"smtpd_auth_cache_ttl" default:"0"`
+		SmtpdAuthExternalRelay      bool   `name:"smtpd_auth_external_relay" default:"true"`
+		SmtpdAuthLdapUrl            string `name:"smtpd_auth_ldap_url" default:"ldap://127.0.0.1:389"`
+		SmtpdAuthLdapStartTls       bool   `name:"smtpd_auth_ldap_starttls" default:"false"`
+		SmtpdAuthLdapTlsSkipVerify  bool   `name:"smtpd_auth_ldap_tls_skipverify" default:"false"`
+		SmtpdAuthLdapBindDnTemplate string `name:"smtpd_auth_ldap_bind_dn_template" default:"_"`
+		SmtpdAuthLdapBindDn         string `name:"smtpd_auth_ldap_bind_dn" default:"_"`
+		SmtpdAuthLdapBindPassword   string `name:"smtpd_auth_ldap_bind_password" default:"_"`
+		SmtpdAuthLdapBaseDn         string `name:"smtpd_auth_ldap_base_dn" default:"_"`
+		SmtpdAuthLdapFilter         string `name:"smtpd_auth_ldap_filter" default:"(mail=%s)"`
+		SmtpdAuthLdapAttributes     string `name:"smtpd_auth_ldap_attributes" default:"_"`
+		SmtpdAuthPamService         string `name:"smtpd_auth_pam_service" default:"smtp"`
+		SmtpdAuthPamStripDomain     bool   `name:"smtpd_auth_pam_strip_domain" default:"false"`
+		SmtpdPopBeforeSmtpLifetime  int    `name:"smtpd_pop_before_smtp_lifetime" default:"0"`
+
+		SmtpdTLSCertsDir string `name:"smtpd_tls_certs_dir" default:"_"`
+
+		AcmeEnabled      bool   `name:"acme_enabled" default:"false"`
+		AcmeHosts        string `name:"acme_hosts" default:"_"`
+		AcmeEmail        string `name:"acme_email" default:"_"`
+		AcmeDirectoryUrl string `name:"acme_directory_url" default:"_"`
+		AcmeHttpListen   string `name:"acme_http_listen" default:"_"`
+
+		SmtpdProxyProtocolListeners string `name:"smtpd_proxy_protocol_listeners" default:"_"`
+		SmtpdProxyProtocolTrusted   string `name:"smtpd_proxy_protocol_trusted" default:"_"`
+
+		SmtpdSubmissionListeners    string `name:"smtpd_submission_listeners" default:"_"`
+		SmtpdSubmissionMaxDataBytes int    `name:"smtpd_submission_max_databytes" default:"0"`
+		SmtpdSubmissionMaxRcptTo    int    `name:"smtpd_submission_max_rcpt" default:"0"`
+		SmtpdSubmissionMsgsPerHour  int    `name:"smtpd_submission_msgs_per_hour" default:"0"`
+
+		SmtpdDnsbl              string `name:"smtpd_dnsbl" default:"_"`
+		SmtpdDnsblTagScore      int    `name:"smtpd_dnsbl_tag_score" default:"1"`
+		SmtpdDnsblTempfailScore int    `name:"smtpd_dnsbl_tempfail_score" default:"0"`
+		SmtpdDnsblRejectScore   int    `name:"smtpd_dnsbl_reject_score" default:"5"`
+		SmtpdDnsblCacheTtl      int    `name:"smtpd_dnsbl_cache_ttl" default:"600"`
+
+		SmtpdAttachmentHashEnabled   bool   `name:"smtpd_attachment_hash_enabled" default:"false"`
+		SmtpdAttachmentHashBlocklist string `name:"smtpd_attachment_hash_blocklist" default:"_"`
+		SmtpdAttachmentHashLookup    string `name:"smtpd_attachment_hash_lookup" default:"_"`
+		SmtpdAttachmentHashAction    string `name:"smtpd_attachment_hash_action" default:"reject"`
+		SmtpdAttachmentHashCacheTtl  int    `name:"smtpd_attachment_hash_cache_ttl" default:"3600"`
+
+		SmtpdNewnessEnabled   bool   `name:"smtpd_newness_enabled" default:"false"`
+		SmtpdNewnessThreshold int    `name:"smtpd_newness_threshold" default:"24"`
+		SmtpdNewnessAction    string `name:"smtpd_newness_action" default:"tag"`
+
+		DigestEnabled      bool   `name:"digest_enabled" default:"false"`
+		DigestFrom         string `name:"digest_from" default:"_"`
+		DigestQuotaWarning int    `name:"digest_quota_warning" default:"90"`
+
+		BundleUrl          string `name:"bundle_url" default:"_"`
+		BundlePublicKey    string `name:"bundle_public_key" default:"_"`
+		BundlePollInterval int    `name:"bundle_poll_interval" default:"300"`
+		BundleSecretKey    string `name:"bundle_secret_key" default:"_"`
+
+		RoleAddresses      string `name:"role_addresses" default:"postmaster;abuse"`
+		RoleAddressesRoute string `name:"role_addresses_route" default:"_"`
 
 		LaunchDeliverd              bool   `name:"deliverd_launch" default:"false"`
 		LocalIps                    string `name:"deliverd_local_ips" default:"_"`
 		DeliverdMaxInFlight         int    `name:"deliverd_max_in_flight" default:"5"`
 		DeliverdQueueLifetime       int    `name:"deliverd_queue_lifetime" default:"10080"`
 		DeliverdRemoteTimeout       int    `name:"deliverd_remote_timeout" default:"60"`
+		DeliverdTimeouts            string `name:"deliverd_timeouts" default:"_"`
+		DeliverdShutdownGrace       int    `name:"deliverd_shutdown_grace" default:"60"`
+		DeliverdOAuth2TokenUrl      string `name:"deliverd_oauth2_token_url" default:"_"`
+		DeliverdOAuth2ClientId      string `name:"deliverd_oauth2_client_id" default:"_"`
+		DeliverdOAuth2ClientSecret  string `name:"deliverd_oauth2_client_secret" default:"_"`
 		DeliverdRemoteTLSSkipVerify bool   `name:"deliverd_remote_tls_skipverify" default:"false"`
 		DeliverdRemoteTLSFallback   bool   `name:"deliverd_remote_tls_fallback" default:"false"`
 		DeliverdDkimSign            bool   `name:"deliverd_dkim_sign" default:"false"`
+		DeliverdArcSealDomain       string `name:"deliverd_arc_seal_domain" default:"_"`
+		DeliverdBdatChunkSize       int    `name:"deliverd_bdat_chunk_size" default:"1048576"`
+		DeliverdRemoteBatchMaxRcpt  int    `name:"deliverd_remote_batch_max_rcpt" default:"1"`
+		DeliverdBouncedKeep         int    `name:"deliverd_bounced_keep" default:"0"`
+		DeliverdDnsCacheTtl         int    `name:"deliverd_dns_cache_ttl" default:"300"`
+		DeliverdDnsPrefetchWindow   int    `name:"deliverd_dns_prefetch_window" default:"300"`
+		DeliverdDnsPrefetchWorkers  int    `name:"deliverd_dns_prefetch_workers" default:"10"`
+
+		DeliverdRouteBreakerFailures int `name:"deliverd_route_breaker_failures" default:"5"`
+		DeliverdRouteBreakerCooldown int `name:"deliverd_route_breaker_cooldown" default:"300"`
+
+		DeliverdIpFamily           string `name:"deliverd_ip_family" default:"ipv6-first"`
+		DeliverdHappyEyeballsDelay int    `name:"deliverd_happy_eyeballs_delay" default:"250"`
+
+		DeliverdAutoscaleEnabled         bool `name:"deliverd_autoscale_enabled" default:"false"`
+		DeliverdAutoscaleMin             int  `name:"deliverd_autoscale_min" default:"1"`
+		DeliverdAutoscaleInterval        int  `name:"deliverd_autoscale_interval" default:"10"`
+		DeliverdAutoscaleCooldown        int  `name:"deliverd_autoscale_cooldown" default:"60"`
+		DeliverdAutoscaleMaxDeferralRate int  `name:"deliverd_autoscale_max_deferral_rate" default:"50"`
+
+		DeliverdRetrySchedule         string `name:"deliverd_retry_schedule" default:"_"`
+		DeliverdRetryScheduleBounce   string `name:"deliverd_retry_schedule_bounce" default:"_"`
+		DeliverdRetrySchedulePriority string `name:"deliverd_retry_schedule_priority" default:"_"`
+		DeliverdQueueLifetimeBounce   int    `name:"deliverd_queue_lifetime_bounce" default:"0"`
+		DeliverdQueueLifetimePriority int    `name:"deliverd_queue_lifetime_priority" default:"0"`
+		DeliverdPrioritySenders       string `name:"deliverd_priority_senders" default:"_"`
+
+		// notifications
+		DeliverdDelayWarning       int    `name:"deliverd_delay_warning" default:"4"`
+		DeliverdDelayWarningOptOut string `name:"deliverd_delay_warning_optout" default:"_"`
+		NotificationLanguages      string `name:"notification_languages" default:"_"`
+
+		// message trace
+		MessageTraceRetention int `name:"message_trace_retention" default:"7"`
+
+		// BATV (bounce address tag validation)
+		BatvLifetime    int `name:"batv_lifetime" default:"7"`
+		BatvKeyRotation int `name:"batv_key_rotation" default:"30"`
 
 		// RFC compliance
 		// RFC 5321 2.3.5: the domain name givent MUST be either a primary hostname
@@ -75,11 +261,31 @@ type Config struct {
 		RestServerLogin  string `name:"rest_server_login" default:""`
 		RestServerPasswd string `name:"rest_server_passwd" default:""`
 
-		UsersHomeBase           string `name:"users_home_base" default:"/home"`
-		UserMailboxDefaultQuota string `name:"users_mailbox_default_quota" default:""`
+		// gRPC management server
+		LaunchGrpcServer   bool   `name:"grpc_server_launch" default:"false"`
+		GrpcServerIp       string `name:"grpc_server_ip" default:"127.0.0.1"`
+		GrpcServerPort     int    `name:"grpc_server_port" default:"8081"`
+		GrpcServerCert     string `name:"grpc_server_cert" default:"ssl/grpc_server.crt"`
+		GrpcServerKey      string `name:"grpc_server_key" default:"ssl/grpc_server.key"`
+		GrpcServerClientCa string `name:"grpc_server_client_ca" default:"ssl/grpc_client_ca.crt"`
+		GrpcServerClients  string `name:"grpc_server_clients" default:"_"`
+
+		UsersHomeBase             string `name:"users_home_base" default:"/home"`
+		UserMailboxDefaultQuota   string `name:"users_mailbox_default_quota" default:""`
+		UsersMailboxDefaultDriver string `name:"users_mailbox_default_driver" default:"dovecot"`
 
 		DovecotLda            string `name:"dovecot_lda" default:""`
 		DovecotSupportEnabled bool   `name:"dovecot_support_enabled" default:"false"`
+		DovecotLmtp           string `name:"dovecot_lmtp" default:"_"`
+
+		// sieve
+		SieveMaxScriptSize    int    `name:"sieve_max_script_size" default:"65536"`
+		ManageSieveListen     string `name:"managesieve_listen" default:"_"`
+		ManageSieveRequireTls bool   `name:"managesieve_require_tls" default:"true"`
+
+		// journaling
+		JournalStoreDriver string `name:"journal_store_driver" default:"disk"`
+		JournalStoreSource string `name:"journal_store_source" default:"_"`
 	}
 }
 
@@ -92,6 +298,18 @@ func InitConfig(prefix string) (*Config, error) {
 	return &c, nil
 }
 
+// InitConfigFromMap initialises config from values (keyed by name of
+// parameters, eg "smtpd_dsns"), environment is not read
+func InitConfigFromMap(values map[string]string) (*Config, error) {
+	if err := c.load("", func(name string) string {
+		return values[strings.ToLower(name)]
+	}); err != nil {
+		return nil, err
+	}
+	c.stayUpToDate()
+	return &c, nil
+}
+
 // stayUpToDate keeps config up to date
 // by quering etcd (if enabled) or by reloading env var
 func (c *Config) stayUpToDate() {
@@ -105,6 +323,11 @@ func (c *Config) stayUpToDate() {
 
 //func LoadFromEnv(prefix string, container interface{}) error {
 func (c *Config) loadFromEnv(prefix string) error {
+	return c.load(prefix, os.Getenv)
+}
+
+// load loads config, raw values are returned by lookup
+func (c *Config) load(prefix string, lookup func(name string) string) error {
 	// container should be a struct
 	elem := reflect.ValueOf(&c.cfg).Elem()
 
@@ -131,7 +354,7 @@ func (c *Config) loadFromEnv(prefix string) error {
 		defautVal := field.Tag.Get("default")
 		requiered := defautVal == ""
 
-		rawValue := os.Getenv(envName)
+		rawValue := lookup(envName)
 		// missing
 		if requiered && rawValue == "" {
 			return errors.New("unable to load config from env, " + envName + " variable is missing.")
@@ -180,6 +403,31 @@ func (c *Config) GetClusterModeEnabled() bool {
 	return c.cfg.ClusterModeEnabled
 }
 
+// GetClusterNodeId returns id of this node in cluster ("" for hostname)
+func (c *Config) GetClusterNodeId() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.ClusterNodeId == "_" {
+		return ""
+	}
+	return c.cfg.ClusterNodeId
+}
+
+// GetClusterHeartbeat returns interval (seconds) of cluster heartbeats
+func (c *Config) GetClusterHeartbeat() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.ClusterHeartbeat
+}
+
+// GetClusterNodeTimeout returns delay (seconds) without heartbeat after which
+// a node is dead, it's also the lifetime of leases of queued messages
+func (c *Config) GetClusterNodeTimeout() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.ClusterNodeTimeout
+}
+
 // GetMe return me
 func (c *Config) GetMe() string {
 	c.Lock()
@@ -187,6 +435,16 @@ func (c *Config) GetMe() string {
 	return c.cfg.Me
 }
 
+// GetIdentities returns identities (selector=hostname)
+func (c *Config) GetIdentities() []string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.Identities == "_" {
+		return []string{}
+	}
+	return strings.Split(c.cfg.Identities, ";")
+}
+
 // GetDebugEnabled returns debugEnabled
 func (c *Config) GetDebugEnabled() bool {
 	c.Lock()
@@ -201,6 +459,85 @@ func (c *Config) GetHideServerSignature() bool {
 	return c.cfg.HideServerSignature
 }
 
+// GetMonitorInterval returns interval in seconds between two self monitoring
+// samples. 0 disables self monitoring
+func (c *Config) GetMonitorInterval() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.MonitorInterval
+}
+
+// GetMonitorAlertThreshold returns the number of consecutive growing samples
+// before raising a leak alert
+func (c *Config) GetMonitorAlertThreshold() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.MonitorAlertThreshold
+}
+
+// GetMetricsListen returns address (ip:port) of Prometheus metrics listener,
+// "" if metrics are disabled
+func (c *Config) GetMetricsListen() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.MetricsListen == "_" {
+		return ""
+	}
+	return c.cfg.MetricsListen
+}
+
+// GetMetricsRollupsEnabled returns true if rollups of metrics are stored in
+// DB
+func (c *Config) GetMetricsRollupsEnabled() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.MetricsRollupsEnabled
+}
+
+// GetWebhookEnabled returns true if delivery events are sent to webhooks
+func (c *Config) GetWebhookEnabled() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.WebhookEnabled
+}
+
+// GetWebhookUrls returns URLs receiving all events (in addition to
+// registered webhooks)
+func (c *Config) GetWebhookUrls() []string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.WebhookUrls == "_" {
+		return []string{}
+	}
+	return strings.Split(c.cfg.WebhookUrls, ";")
+}
+
+// GetWebhookSecret returns HMAC secret of requests to webhook_urls ("" for
+// unsigned requests)
+func (c *Config) GetWebhookSecret() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.WebhookSecret == "_" {
+		return ""
+	}
+	return c.cfg.WebhookSecret
+}
+
+// GetWebhookTimeout returns timeout of webhook requests in seconds
+func (c *Config) GetWebhookTimeout() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.WebhookTimeout
+}
+
+// GetWebhookMaxAttempts returns number of attempts of a webhook request
+// before it's dropped
+func (c *Config) GetWebhookMaxAttempts() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.WebhookMaxAttempts
+}
+
 // GetTempDir return temp directory
 func (c *Config) GetTempDir() string {
 	c.Lock()
@@ -215,6 +552,13 @@ func (c *Config) GetLogPath() string {
 	return c.cfg.LogPath
 }
 
+// GetLogFormat returns format of log records (text, json or logfmt)
+func (c *Config) GetLogFormat() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.LogFormat
+}
+
 // GetDbDriver returns database driver
 func (c *Config) GetDbDriver() string {
 	c.Lock()
@@ -231,7 +575,7 @@ func (c *Config) GetDbSource() string {
 
 // GetStoreDriver return source driver
 // disk
-// runabove
+// s3 (S3 or compatible as MinIO)
 func (c *Config) GetStoreDriver() string {
 	c.Lock()
 	defer c.Unlock()
@@ -245,6 +589,39 @@ func (c *Config) GetStoreSource() string {
 	return c.cfg.StroreSource
 }
 
+// GetStoreEncryptionKey returns the key (32 bytes, hex encoded) used to
+// encrypt messages in stores (empty if they are not encrypted)
+func (c *Config) GetStoreEncryptionKey() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.StoreEncryptionKey == "_" {
+		return ""
+	}
+	return c.cfg.StoreEncryptionKey
+}
+
+// GetStoreEncryptionRequired returns true if data not encrypted (stored
+// before encryption was enabled) must be refused by stores
+func (c *Config) GetStoreEncryptionRequired() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.StoreEncryptionRequired
+}
+
+// GetRole returns role of process (all, smtpd or deliverd)
+func (c *Config) GetRole() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.Role
+}
+
+// SetRole sets role of process
+func (c *Config) SetRole(role string) {
+	c.Lock()
+	defer c.Unlock()
+	c.cfg.Role = role
+}
+
 // GetLaunchSmtpd returns true if smtpd have to be launched
 func (c *Config) GetLaunchSmtpd() bool {
 	c.Lock()
@@ -267,6 +644,38 @@ func (c *Config) GetSmtpdServerTimeout() int {
 	return c.cfg.SmtpdServerTimeout
 }
 
+// GetSmtpdDataTimeout returns timeout in seconds between blocks of data
+// sent by clients (DATA & BDAT), 0 for smtpd_server_timeout
+func (c *Config) GetSmtpdDataTimeout() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdDataTimeout
+}
+
+// GetSmtpdTLSHandshakeTimeout returns timeout in seconds of TLS handshakes
+// (STARTTLS & SMTPS), 0 for smtpd_server_timeout
+func (c *Config) GetSmtpdTLSHandshakeTimeout() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdTLSHandshakeTimeout
+}
+
+// GetSmtpdSessionTimeout returns max duration in seconds of sessions (0:
+// unlimited)
+func (c *Config) GetSmtpdSessionTimeout() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdSessionTimeout
+}
+
+// GetSmtpdShutdownGrace returns time in seconds active sessions have to end
+// when tmail stops (or restarts)
+func (c *Config) GetSmtpdShutdownGrace() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdShutdownGrace
+}
+
 // GetSmtpdMaxDataBytes returns max size of accepted email
 func (c *Config) GetSmtpdMaxDataBytes() int {
 	c.Lock()
@@ -302,6 +711,29 @@ func (c *Config) GetSmtpdMaxVrfy() int {
 	return c.cfg.SmtpdMaxVrfy
 }
 
+// GetSmtpdMaxMail returns the maximum number of transactions per session
+func (c *Config) GetSmtpdMaxMail() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdMaxMail
+}
+
+// GetSmtpdMaxRcptDomains returns the maximum number of recipient domains
+// per transaction
+func (c *Config) GetSmtpdMaxRcptDomains() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdMaxRcptDomains
+}
+
+// GetSmtpdVirtualAliasMaxDepth returns the maximum number of levels of
+// virtual aliases expansion
+func (c *Config) GetSmtpdVirtualAliasMaxDepth() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdVirtualAliasMaxDepth
+}
+
 // GetSmtpdClamavEnabled returns if clamav scan is enable
 func (c *Config) GetSmtpdClamavEnabled() bool {
 	c.Lock()
@@ -309,181 +741,1075 @@ func (c *Config) GetSmtpdClamavEnabled() bool {
 	return c.cfg.SmtpdClamavEnabled
 }
 
-// GetSmtpdClamavDsns returns clamav dsns
-func (c *Config) GetSmtpdClamavDsns() string {
+// GetSmtpdAuthResultsEnabled returns if SPF, DKIM & DMARC checks are enabled
+func (c *Config) GetSmtpdAuthResultsEnabled() bool {
 	c.Lock()
 	defer c.Unlock()
-	return c.cfg.SmtpdClamavDsns
+	return c.cfg.SmtpdAuthResultsEnabled
 }
 
-// GetSmtpdConcurrencyIncoming returns ConcurrencyIncoming
-func (c *Config) GetSmtpdConcurrencyIncoming() int {
+// GetSmtpdDmarcActionReject returns action for DMARC reject disposition
+func (c *Config) GetSmtpdDmarcActionReject() string {
 	c.Lock()
 	defer c.Unlock()
-	return c.cfg.SmtpdConcurrencyIncoming
+	return c.cfg.SmtpdDmarcActionReject
 }
 
-// GetLaunchDeliverd returns true if deliverd have to be launched
-func (c *Config) GetLaunchDeliverd() bool {
+// GetSmtpdDmarcActionQuarantine returns action for DMARC quarantine
+// disposition
+func (c *Config) GetSmtpdDmarcActionQuarantine() string {
 	c.Lock()
 	defer c.Unlock()
-	return c.cfg.LaunchDeliverd
+	return c.cfg.SmtpdDmarcActionQuarantine
 }
 
-// RFC
+// GetSmtpdDmarcOverrides returns DMARC actions per destination domain
+// format: domain:action;domain:action
+func (c *Config) GetSmtpdDmarcOverrides() map[string]string {
+	c.Lock()
+	defer c.Unlock()
+	overrides := make(map[string]string)
+	if c.cfg.SmtpdDmarcOverrides == "_" {
+		return overrides
+	}
+	for _, o := range strings.Split(c.cfg.SmtpdDmarcOverrides, ";") {
+		p := strings.SplitN(o, ":", 2)
+		if len(p) != 2 {
+			continue
+		}
+		overrides[strings.ToLower(strings.TrimSpace(p[0]))] = strings.TrimSpace(p[1])
+	}
+	return overrides
+}
 
-// return getRFCHeloNeedsFqnOrAddress
-func (c *Config) getRFCHeloNeedsFqnOrAddress() bool {
+// GetQuarantineStoreSource returns quarantine store source
+func (c *Config) GetQuarantineStoreSource() string {
 	c.Lock()
 	defer c.Unlock()
-	return c.cfg.RFCHeloNeedsFqnOrAddress
+	if c.cfg.QuarantineStoreSource == "_" {
+		return ""
+	}
+	return c.cfg.QuarantineStoreSource
 }
 
-// returns RFCHeloMandatory
-func (c *Config) getRFCHeloMandatory() bool {
+// GetQuarantineLifetime returns the number of days messages are kept in
+// quarantine (0: forever)
+func (c *Config) GetQuarantineLifetime() int {
 	c.Lock()
 	defer c.Unlock()
-	return c.cfg.RFCHeloMandatory
+	return c.cfg.QuarantineLifetime
 }
 
-// nsqd
-// GetNsqdEnableLogging return loging enable/disable for nsqd
-/*func (c *Config) GetNsqdEnableLogging() bool {
+// GetQuarantineDigestEnabled returns true if local recipients receive a
+// daily digest of their quarantined messages
+func (c *Config) GetQuarantineDigestEnabled() bool {
 	c.Lock()
 	defer c.Unlock()
-	return c.cfg.NsqdEnbleLogging
-}*/
+	return c.cfg.QuarantineDigestEnabled
+}
 
-// GetNSQLookupdTcpAddresses returns lookupd tcp adresses
-func (c *Config) GetNSQLookupdTcpAddresses() (addr []string) {
-	if c.cfg.NSQLookupdTcpAddresses == "_" {
-		return
-	}
+// GetSmtpdShadowChecks returns checks running in shadow mode
+func (c *Config) GetSmtpdShadowChecks() []string {
 	c.Lock()
 	defer c.Unlock()
-	p := strings.Split(c.cfg.NSQLookupdTcpAddresses, ";")
-	for _, a := range p {
-		addr = append(addr, a)
+	if c.cfg.SmtpdShadowChecks == "_" {
+		return []string{}
 	}
-	return
+	checks := []string{}
+	for _, check := range strings.Split(c.cfg.SmtpdShadowChecks, ";") {
+		if check = strings.ToLower(strings.TrimSpace(check)); check != "" {
+			checks = append(checks, check)
+		}
+	}
+	return checks
 }
 
-// GetNSQLookupdHttpAddresses returns lookupd HTTP adresses
-func (c *Config) GetNSQLookupdHttpAddresses() (addr []string) {
-	if c.cfg.NSQLookupdHttpAddresses == "_" {
-		return
+// GetSmtpdDmarcReportsEnabled returns if DMARC aggregate reports are enabled
+func (c *Config) GetSmtpdDmarcReportsEnabled() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdDmarcReportsEnabled
+}
+
+// GetSmtpdDmarcReportsFrom returns sender address of DMARC reports
+func (c *Config) GetSmtpdDmarcReportsFrom() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdDmarcReportsFrom == "_" {
+		return ""
 	}
+	return c.cfg.SmtpdDmarcReportsFrom
+}
+
+// GetSmtpdDmarcReportsOrgName returns organization name used in DMARC
+// reports (default: me)
+func (c *Config) GetSmtpdDmarcReportsOrgName() string {
 	c.Lock()
 	defer c.Unlock()
-	p := strings.Split(c.cfg.NSQLookupdHttpAddresses, ";")
-	for _, a := range p {
-		addr = append(addr, a)
+	if c.cfg.SmtpdDmarcReportsOrgName == "_" {
+		return c.cfg.Me
 	}
-	return
+	return c.cfg.SmtpdDmarcReportsOrgName
 }
 
-// microservices
+// GetSmtpdDmarcReportsMaxSize returns max size of DMARC report messages
+func (c *Config) GetSmtpdDmarcReportsMaxSize() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdDmarcReportsMaxSize
+}
 
-// GetMicroservicesUri returns defined URI for a hookId
-func (c *Config) GetMicroservicesUri(hookId string) []string {
+// GetSmtpdMilters returns milters URI
+func (c *Config) GetSmtpdMilters() []string {
 	c.Lock()
 	defer c.Unlock()
-	switch hookId {
-	case "smtpdnewclient":
-		if c.cfg.MsUriSmtpdNewClient != "_" {
-			return strings.Split(c.cfg.MsUriSmtpdNewClient, ";")
-		}
-	case "smtpddata":
-		if c.cfg.MsUriSmtpdData != "_" {
-			return strings.Split(c.cfg.MsUriSmtpdData, ";")
-		}
+	if c.cfg.SmtpdMilters == "_" {
+		return []string{}
 	}
-	return []string{}
+	return strings.Split(c.cfg.SmtpdMilters, ";")
+}
 
+// GetRoleAddresses returns local parts of role addresses
+func (c *Config) GetRoleAddresses() []string {
+	c.Lock()
+	defer c.Unlock()
+	roles := []string{}
+	for _, role := range strings.Split(c.cfg.RoleAddresses, ";") {
+		if role = strings.ToLower(strings.TrimSpace(role)); role != "" && role != "_" {
+			roles = append(roles, role)
+		}
+	}
+	return roles
 }
 
-// REST server
+// GetRoleAddressesRoute returns where messages to role addresses without
+// mailbox are routed (address or webhook URL)
+func (c *Config) GetRoleAddressesRoute() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.RoleAddressesRoute == "_" {
+		return ""
+	}
+	return c.cfg.RoleAddressesRoute
+}
 
-// GetRestServerLaunch return true if REST server must be launched
-func (c *Config) GetRestServerLaunch() bool {
+// GetSmtpdContentFilter returns content filter URI
+func (c *Config) GetSmtpdContentFilter() string {
 	c.Lock()
 	defer c.Unlock()
-	return c.cfg.LaunchRestServer
+	if c.cfg.SmtpdContentFilter == "_" {
+		return ""
+	}
+	return c.cfg.SmtpdContentFilter
 }
 
-// GetRestServerIp return the ip that the REST server should listen on
-func (c *Config) GetRestServerIp() string {
+// GetSmtpdRspamd returns rspamd URI
+func (c *Config) GetSmtpdRspamd() string {
 	c.Lock()
 	defer c.Unlock()
-	return c.cfg.RestServerIp
+	if c.cfg.SmtpdRspamd == "_" {
+		return ""
+	}
+	return c.cfg.SmtpdRspamd
 }
 
-// GetRestServerPort return the port that the REST server should listen on
-func (c *Config) GetRestServerPort() int {
+// GetSmtpdRspamdController returns rspamd controller URL
+func (c *Config) GetSmtpdRspamdController() string {
 	c.Lock()
 	defer c.Unlock()
-	return c.cfg.RestServerPort
+	if c.cfg.SmtpdRspamdController == "_" {
+		return ""
+	}
+	return c.cfg.SmtpdRspamdController
 }
 
-// GetRestServerIsTls return RestServerIsTls
-func (c *Config) GetRestServerIsTls() bool {
+// GetSmtpdRspamdPassword returns rspamd controller password
+func (c *Config) GetSmtpdRspamdPassword() string {
 	c.Lock()
 	defer c.Unlock()
-	return c.cfg.RestServerIsTls
+	if c.cfg.SmtpdRspamdPassword == "_" {
+		return ""
+	}
+	return c.cfg.SmtpdRspamdPassword
 }
 
-// GetRestServerLogin return RestServerLogin
-func (c *Config) GetRestServerLogin() string {
+// GetSmtpdGreylistEnabled returns true if greylisting is enabled
+func (c *Config) GetSmtpdGreylistEnabled() bool {
 	c.Lock()
 	defer c.Unlock()
-	return c.cfg.RestServerLogin
+	return c.cfg.SmtpdGreylistEnabled
 }
 
-// SetRestServerLogin is used to set REST server login
-func (c *Config) SetRestServerLogin(login string) {
+// GetSmtpdGreylistDelay returns the delay (in seconds) before a greylisted
+// triplet can pass
+func (c *Config) GetSmtpdGreylistDelay() int {
 	c.Lock()
 	defer c.Unlock()
-	c.cfg.RestServerLogin = login
+	return c.cfg.SmtpdGreylistDelay
 }
 
-// GetRestServerPasswd return RestServerPasswd
-func (c *Config) GetRestServerPasswd() string {
+// GetSmtpdGreylistExpire returns the delay (in seconds) after which a
+// greylisted triplet which has not passed expires
+func (c *Config) GetSmtpdGreylistExpire() int {
 	c.Lock()
 	defer c.Unlock()
-	return c.cfg.RestServerPasswd
+	return c.cfg.SmtpdGreylistExpire
 }
 
-// SetRestServerPasswd set RestServerPasswd
-func (c *Config) SetRestServerPasswd(passwd string) {
+// GetSmtpdGreylistPassedTtl returns lifetime (in days) of passed triplets
+// and auto whitelisted networks
+func (c *Config) GetSmtpdGreylistPassedTtl() int {
 	c.Lock()
 	defer c.Unlock()
-	c.cfg.RestServerPasswd = passwd
+	return c.cfg.SmtpdGreylistPassedTtl
 }
 
-// deliverd
+// GetSmtpdGreylistAutoWhitelist returns the number of passed triplets
+// after which a network is whitelisted
+func (c *Config) GetSmtpdGreylistAutoWhitelist() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdGreylistAutoWhitelist
+}
 
-// GetDeliverdMaxInFlight returns DeliverdMaxInFlight
-func (c *Config) GetDeliverdMaxInFlight() int {
+// GetSmtpdNewnessEnabled returns true if first-seen tracking is enabled
+func (c *Config) GetSmtpdNewnessEnabled() bool {
 	c.Lock()
 	defer c.Unlock()
-	return c.cfg.DeliverdMaxInFlight
+	return c.cfg.SmtpdNewnessEnabled
 }
 
-// GetLocalIps returns ordered lits of local IP (net.IP) to use when sending mail
-func (c *Config) GetLocalIps() string {
+// GetSmtpdNewnessThreshold returns age (in hours) under which sender
+// domains, DKIM domains and client IPs are new
+func (c *Config) GetSmtpdNewnessThreshold() int {
 	c.Lock()
 	defer c.Unlock()
-	return c.cfg.LocalIps
-	/*
-		// no mix beetween & and |
-		failover := strings.Count(localIps, "&") != 0
-		roundRobin := strings.Count(localIps, "|") != 0
+	return c.cfg.SmtpdNewnessThreshold
+}
 
-		if failover && roundRobin {
-			return nil, errors.New("mixing & and | are not allowed in config TMAIL_DELIVERD_LOCAL_IPS")
-		}
+// GetSmtpdNewnessAction returns action for messages from new sender domains
+func (c *Config) GetSmtpdNewnessAction() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdNewnessAction
+}
 
-		var sIps []string
+// GetDigestEnabled returns if digests for domain administrators are sent
+func (c *Config) GetDigestEnabled() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DigestEnabled
+}
+
+// GetDigestFrom returns sender address of digests
+func (c *Config) GetDigestFrom() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.DigestFrom == "_" {
+		return ""
+	}
+	return c.cfg.DigestFrom
+}
+
+// GetDigestQuotaWarning returns mailbox usage (percent of quota) reported
+// in digests
+func (c *Config) GetDigestQuotaWarning() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DigestQuotaWarning
+}
+
+// GetBundleUrl returns URL of signed configuration bundle ("" if none)
+func (c *Config) GetBundleUrl() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.BundleUrl == "_" {
+		return ""
+	}
+	return c.cfg.BundleUrl
+}
+
+// GetBundlePublicKey returns path of the public key verifying bundles
+func (c *Config) GetBundlePublicKey() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.BundlePublicKey == "_" {
+		return ""
+	}
+	return c.cfg.BundlePublicKey
+}
+
+// GetBundlePollInterval returns interval in seconds between two fetches of
+// bundle
+func (c *Config) GetBundlePollInterval() int {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.BundlePollInterval < 1 {
+		return 300
+	}
+	return c.cfg.BundlePollInterval
+}
+
+// GetBundleSecretKey returns the key (32 bytes, hex encoded) encrypting
+// credentials of routes in bundles ("" if none)
+func (c *Config) GetBundleSecretKey() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.BundleSecretKey == "_" {
+		return ""
+	}
+	return c.cfg.BundleSecretKey
+}
+
+// GetSmtpdFutureReleaseMaxInterval returns max delay (in seconds) of a future
+// release, 0 if future release is disabled
+func (c *Config) GetSmtpdFutureReleaseMaxInterval() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdFutureReleaseMaxInterval
+}
+
+// GetSmtpdPassthroughParams returns MAIL/RCPT parameters forwarded to next
+// hop (PARAM or PARAM:EXTENSION)
+func (c *Config) GetSmtpdPassthroughParams() []string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdPassthroughParams == "_" {
+		return []string{}
+	}
+	return strings.Split(c.cfg.SmtpdPassthroughParams, ";")
+}
+
+// GetSmtpdScanMode returns scan mode per listener (listener=inline|async)
+func (c *Config) GetSmtpdScanMode() []string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdScanMode == "_" {
+		return []string{}
+	}
+	return strings.Split(c.cfg.SmtpdScanMode, ";")
+}
+
+// GetSmtpdScanAsyncWorkers returns number of workers scanning messages
+// accepted without scan
+func (c *Config) GetSmtpdScanAsyncWorkers() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdScanAsyncWorkers
+}
+
+// GetSmtpdHelp returns help files per listener (listener=file)
+func (c *Config) GetSmtpdHelp() []string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdHelp == "_" {
+		return []string{}
+	}
+	return strings.Split(c.cfg.SmtpdHelp, ";")
+}
+
+// GetSmtpdDisabledVerbs returns verbs disabled per listener
+// (listener=VERB,VERB)
+func (c *Config) GetSmtpdDisabledVerbs() []string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdDisabledVerbs == "_" {
+		return []string{}
+	}
+	return strings.Split(c.cfg.SmtpdDisabledVerbs, ";")
+}
+
+// GetSmtpdThrottleConnectionsPerIp returns max simultaneous connections per
+// client IP (0: unlimited)
+func (c *Config) GetSmtpdThrottleConnectionsPerIp() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdThrottleConnectionsPerIp
+}
+
+// GetSmtpdMemoryBudget returns memory budget of smtpd sessions in MB
+// (0: unlimited)
+func (c *Config) GetSmtpdMemoryBudget() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdMemoryBudget
+}
+
+// GetSmtpdMemoryHighWatermark returns percentage of memory budget above which
+// new transactions are refused
+func (c *Config) GetSmtpdMemoryHighWatermark() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdMemoryHighWatermark
+}
+
+// GetSmtpdThrottleUserSessions returns max simultaneous sessions per
+// authenticated user (0: unlimited)
+func (c *Config) GetSmtpdThrottleUserSessions() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdThrottleUserSessions
+}
+
+// GetSmtpdThrottleMsgsPerHour returns max messages per sender and per hour
+// (0: unlimited)
+func (c *Config) GetSmtpdThrottleMsgsPerHour() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdThrottleMsgsPerHour
+}
+
+// GetSmtpdSendingMsgsPerDay returns max messages per authenticated user and
+// per day (0: unlimited)
+func (c *Config) GetSmtpdSendingMsgsPerDay() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdSendingMsgsPerDay
+}
+
+// GetSmtpdSendingRcptsPerDay returns max recipients per authenticated user
+// and per day (0: unlimited)
+func (c *Config) GetSmtpdSendingRcptsPerDay() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdSendingRcptsPerDay
+}
+
+// GetSmtpdSendingBytesPerDay returns max bytes per authenticated user and
+// per day ("": unlimited)
+func (c *Config) GetSmtpdSendingBytesPerDay() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdSendingBytesPerDay == "_" {
+		return ""
+	}
+	return c.cfg.SmtpdSendingBytesPerDay
+}
+
+// GetSmtpdSendingSuspendDuration returns duration in minutes of suspensions
+// of users who go over their quotas
+func (c *Config) GetSmtpdSendingSuspendDuration() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdSendingSuspendDuration
+}
+
+// GetSmtpdSendingMaxBounceRate returns bounce rate (%) above which users are
+// suspended (0: no limit)
+func (c *Config) GetSmtpdSendingMaxBounceRate() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdSendingMaxBounceRate
+}
+
+// GetSmtpdSendingBounceRateMin returns min deliveries of a day before bounce
+// rate of a user is checked
+func (c *Config) GetSmtpdSendingBounceRateMin() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdSendingBounceRateMin
+}
+
+// GetSmtpdRequireTLS returns listeners on which STARTTLS is required
+func (c *Config) GetSmtpdRequireTLS() []string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdRequireTLS == "_" {
+		return []string{}
+	}
+	return strings.Split(c.cfg.SmtpdRequireTLS, ";")
+}
+
+// GetSmtpdRequireAuth returns listeners on which AUTH is required
+func (c *Config) GetSmtpdRequireAuth() []string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdRequireAuth == "_" {
+		return []string{}
+	}
+	return strings.Split(c.cfg.SmtpdRequireAuth, ";")
+}
+
+// GetSmtpdRequireExceptions returns exceptions to STARTTLS & AUTH
+// requirements
+func (c *Config) GetSmtpdRequireExceptions() []string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdRequireExceptions == "_" {
+		return []string{}
+	}
+	return strings.Split(c.cfg.SmtpdRequireExceptions, ";")
+}
+
+// GetSmtpdAuthBackends returns authentication backends, in order
+func (c *Config) GetSmtpdAuthBackends() []string {
+	c.Lock()
+	defer c.Unlock()
+	return strings.Split(c.cfg.SmtpdAuthBackends, ";")
+}
+
+// GetSmtpdAuthMechanisms returns announced SASL mechanisms
+func (c *Config) GetSmtpdAuthMechanisms() []string {
+	c.Lock()
+	defer c.Unlock()
+	return strings.Split(c.cfg.SmtpdAuthMechanisms, ";")
+}
+
+// GetSmtpdAuthCacheTtl returns how long (seconds) successful authentications
+// are cached
+func (c *Config) GetSmtpdAuthCacheTtl() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdAuthCacheTtl
+}
+
+// GetSmtpdAuthExternalRelay returns true if users of external
+// backends are allowed to relay (unless mapped otherwise)
+func (c *Config) GetSmtpdAuthExternalRelay() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdAuthExternalRelay
+}
+
+// GetSmtpdAuthLdapUrl returns URL of LDAP server
+func (c *Config) GetSmtpdAuthLdapUrl() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdAuthLdapUrl
+}
+
+// GetSmtpdAuthLdapStartTls returns true if STARTTLS is used on ldap://
+func (c *Config) GetSmtpdAuthLdapStartTls() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdAuthLdapStartTls
+}
+
+// GetSmtpdAuthLdapTlsSkipVerify returns true if certificate of LDAP
+// server is not verified
+func (c *Config) GetSmtpdAuthLdapTlsSkipVerify() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdAuthLdapTlsSkipVerify
+}
+
+// GetSmtpdAuthLdapBindDnTemplate returns DN template of users
+// (bind mode)
+func (c *Config) GetSmtpdAuthLdapBindDnTemplate() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdAuthLdapBindDnTemplate == "_" {
+		return ""
+	}
+	return c.cfg.SmtpdAuthLdapBindDnTemplate
+}
+
+// GetSmtpdAuthLdapBindDn returns DN tmail binds with (search+bind
+// mode)
+func (c *Config) GetSmtpdAuthLdapBindDn() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdAuthLdapBindDn == "_" {
+		return ""
+	}
+	return c.cfg.SmtpdAuthLdapBindDn
+}
+
+// GetSmtpdAuthLdapBindPassword returns password of bind DN
+func (c *Config) GetSmtpdAuthLdapBindPassword() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdAuthLdapBindPassword == "_" {
+		return ""
+	}
+	return c.cfg.SmtpdAuthLdapBindPassword
+}
+
+// GetSmtpdAuthLdapBaseDn returns base DN of searches
+func (c *Config) GetSmtpdAuthLdapBaseDn() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdAuthLdapBaseDn == "_" {
+		return ""
+	}
+	return c.cfg.SmtpdAuthLdapBaseDn
+}
+
+// GetSmtpdAuthLdapFilter returns filter of user searches
+func (c *Config) GetSmtpdAuthLdapFilter() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdAuthLdapFilter
+}
+
+// GetSmtpdAuthLdapAttributes returns mapping of LDAP attributes to user
+// fields (field:attribute)
+func (c *Config) GetSmtpdAuthLdapAttributes() []string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdAuthLdapAttributes == "_" {
+		return []string{}
+	}
+	return strings.Split(c.cfg.SmtpdAuthLdapAttributes, ";")
+}
+
+// GetSmtpdAuthPamService returns PAM service
+func (c *Config) GetSmtpdAuthPamService() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdAuthPamService
+}
+
+// GetSmtpdAuthPamStripDomain returns true if domain of login is
+// removed for PAM
+func (c *Config) GetSmtpdAuthPamStripDomain() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdAuthPamStripDomain
+}
+
+// GetSmtpdPopBeforeSmtpLifetime returns number of minutes IPs of POP/IMAP
+// logins can relay (0: POP/IMAP-before-SMTP is disabled)
+func (c *Config) GetSmtpdPopBeforeSmtpLifetime() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdPopBeforeSmtpLifetime
+}
+
+// GetSmtpdTLSCertsDir returns directory of SNI certificates (ssl/certs by
+// default)
+func (c *Config) GetSmtpdTLSCertsDir() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdTLSCertsDir == "_" {
+		return path.Join(GetBasePath(), "ssl/certs")
+	}
+	return c.cfg.SmtpdTLSCertsDir
+}
+
+// GetAcmeEnabled returns true if certificates are obtained by ACME
+func (c *Config) GetAcmeEnabled() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.AcmeEnabled
+}
+
+// GetAcmeHosts returns hostnames whose certificates are obtained by ACME
+// (empty for me and hostnames of identities)
+func (c *Config) GetAcmeHosts() []string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.AcmeHosts == "_" {
+		return []string{}
+	}
+	return strings.Split(c.cfg.AcmeHosts, ";")
+}
+
+// GetAcmeEmail returns contact email of ACME account
+func (c *Config) GetAcmeEmail() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.AcmeEmail == "_" {
+		return ""
+	}
+	return c.cfg.AcmeEmail
+}
+
+// GetAcmeDirectoryUrl returns URL of ACME directory (Let's Encrypt by
+// default)
+func (c *Config) GetAcmeDirectoryUrl() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.AcmeDirectoryUrl == "_" {
+		return ""
+	}
+	return c.cfg.AcmeDirectoryUrl
+}
+
+// GetAcmeHttpListen returns address of HTTP-01 challenges listener ("" if
+// disabled)
+func (c *Config) GetAcmeHttpListen() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.AcmeHttpListen == "_" {
+		return ""
+	}
+	return c.cfg.AcmeHttpListen
+}
+
+// GetSmtpdProxyProtocolListeners returns listeners expecting a PROXY header
+func (c *Config) GetSmtpdProxyProtocolListeners() []string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdProxyProtocolListeners == "_" {
+		return []string{}
+	}
+	return strings.Split(c.cfg.SmtpdProxyProtocolListeners, ";")
+}
+
+// GetSmtpdProxyProtocolTrusted returns networks (IP or CIDR) allowed to send
+// PROXY headers (empty: none)
+func (c *Config) GetSmtpdProxyProtocolTrusted() []string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdProxyProtocolTrusted == "_" {
+		return []string{}
+	}
+	return strings.Split(c.cfg.SmtpdProxyProtocolTrusted, ";")
+}
+
+// GetSmtpdSubmissionListeners returns submission listeners
+func (c *Config) GetSmtpdSubmissionListeners() []string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdSubmissionListeners == "_" {
+		return []string{}
+	}
+	return strings.Split(c.cfg.SmtpdSubmissionListeners, ";")
+}
+
+// GetSmtpdSubmissionMaxDataBytes returns max size of messages submitted on
+// submission listeners (0: smtpd_max_databytes)
+func (c *Config) GetSmtpdSubmissionMaxDataBytes() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdSubmissionMaxDataBytes
+}
+
+// GetSmtpdSubmissionMaxRcptTo returns max recipients per message on
+// submission listeners (0: smtpd_max_rcpt)
+func (c *Config) GetSmtpdSubmissionMaxRcptTo() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdSubmissionMaxRcptTo
+}
+
+// GetSmtpdSubmissionMsgsPerHour returns max messages per user and per hour
+// on submission listeners (0: smtpd_throttle_msgs_per_hour)
+func (c *Config) GetSmtpdSubmissionMsgsPerHour() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdSubmissionMsgsPerHour
+}
+
+// GetSmtpdDnsbl returns DNSBL & DNSWL zones (zone[=weight])
+func (c *Config) GetSmtpdDnsbl() []string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdDnsbl == "_" {
+		return []string{}
+	}
+	return strings.Split(c.cfg.SmtpdDnsbl, ";")
+}
+
+// GetSmtpdDnsblTagScore returns DNSBL score from which messages are tagged
+func (c *Config) GetSmtpdDnsblTagScore() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdDnsblTagScore
+}
+
+// GetSmtpdDnsblTempfailScore returns DNSBL score from which clients are
+// temporarily rejected
+func (c *Config) GetSmtpdDnsblTempfailScore() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdDnsblTempfailScore
+}
+
+// GetSmtpdDnsblRejectScore returns DNSBL score from which clients are
+// rejected
+func (c *Config) GetSmtpdDnsblRejectScore() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdDnsblRejectScore
+}
+
+// GetSmtpdDnsblCacheTtl returns TTL in seconds of cached DNSBL results
+func (c *Config) GetSmtpdDnsblCacheTtl() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdDnsblCacheTtl
+}
+
+// GetSmtpdAttachmentHashEnabled returns true if attachment hashes are checked
+func (c *Config) GetSmtpdAttachmentHashEnabled() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdAttachmentHashEnabled
+}
+
+// GetSmtpdAttachmentHashBlocklist returns path of local attachment hash
+// blocklist
+func (c *Config) GetSmtpdAttachmentHashBlocklist() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdAttachmentHashBlocklist == "_" {
+		return ""
+	}
+	return c.cfg.SmtpdAttachmentHashBlocklist
+}
+
+// GetSmtpdAttachmentHashLookup returns URI of threat-intel lookup service
+func (c *Config) GetSmtpdAttachmentHashLookup() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.SmtpdAttachmentHashLookup == "_" {
+		return ""
+	}
+	return c.cfg.SmtpdAttachmentHashLookup
+}
+
+// GetSmtpdAttachmentHashAction returns action for messages with a malicious
+// attachment
+func (c *Config) GetSmtpdAttachmentHashAction() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdAttachmentHashAction
+}
+
+// GetSmtpdAttachmentHashCacheTtl returns TTL in seconds of cached lookup
+// verdicts
+func (c *Config) GetSmtpdAttachmentHashCacheTtl() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdAttachmentHashCacheTtl
+}
+
+// GetSmtpdClamavDsns returns clamav dsns
+func (c *Config) GetSmtpdClamavDsns() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdClamavDsns
+}
+
+// GetSmtpdConcurrencyIncoming returns ConcurrencyIncoming
+func (c *Config) GetSmtpdConcurrencyIncoming() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SmtpdConcurrencyIncoming
+}
+
+// GetLaunchDeliverd returns true if deliverd have to be launched
+func (c *Config) GetLaunchDeliverd() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.LaunchDeliverd
+}
+
+// RFC
+
+// return getRFCHeloNeedsFqnOrAddress
+func (c *Config) getRFCHeloNeedsFqnOrAddress() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.RFCHeloNeedsFqnOrAddress
+}
+
+// returns RFCHeloMandatory
+func (c *Config) getRFCHeloMandatory() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.RFCHeloMandatory
+}
+
+// nsqd
+// GetNsqdEnableLogging return loging enable/disable for nsqd
+/*func (c *Config) GetNsqdEnableLogging() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.NsqdEnbleLogging
+}*/
+
+// GetNSQLookupdTcpAddresses returns lookupd tcp adresses
+func (c *Config) GetNSQLookupdTcpAddresses() (addr []string) {
+	if c.cfg.NSQLookupdTcpAddresses == "_" {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	p := strings.Split(c.cfg.NSQLookupdTcpAddresses, ";")
+	for _, a := range p {
+		addr = append(addr, a)
+	}
+	return
+}
+
+// GetNSQLookupdHttpAddresses returns lookupd HTTP adresses
+func (c *Config) GetNSQLookupdHttpAddresses() (addr []string) {
+	if c.cfg.NSQLookupdHttpAddresses == "_" {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	p := strings.Split(c.cfg.NSQLookupdHttpAddresses, ";")
+	for _, a := range p {
+		addr = append(addr, a)
+	}
+	return
+}
+
+// microservices
+
+// GetMicroservicesUri returns defined URI for a hookId
+func (c *Config) GetMicroservicesUri(hookId string) []string {
+	c.Lock()
+	defer c.Unlock()
+	switch hookId {
+	case "smtpdnewclient":
+		if c.cfg.MsUriSmtpdNewClient != "_" {
+			return strings.Split(c.cfg.MsUriSmtpdNewClient, ";")
+		}
+	case "smtpddata":
+		if c.cfg.MsUriSmtpdData != "_" {
+			return strings.Split(c.cfg.MsUriSmtpdData, ";")
+		}
+	}
+	return []string{}
+
+}
+
+// REST server
+
+// GetRestServerLaunch return true if REST server must be launched
+func (c *Config) GetRestServerLaunch() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.LaunchRestServer
+}
+
+// GetRestServerIp return the ip that the REST server should listen on
+func (c *Config) GetRestServerIp() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.RestServerIp
+}
+
+// GetRestServerPort return the port that the REST server should listen on
+func (c *Config) GetRestServerPort() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.RestServerPort
+}
+
+// GetRestServerIsTls return RestServerIsTls
+func (c *Config) GetRestServerIsTls() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.RestServerIsTls
+}
+
+// GetRestServerLogin return RestServerLogin
+func (c *Config) GetRestServerLogin() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.RestServerLogin
+}
+
+// SetRestServerLogin is used to set REST server login
+func (c *Config) SetRestServerLogin(login string) {
+	c.Lock()
+	defer c.Unlock()
+	c.cfg.RestServerLogin = login
+}
+
+// GetRestServerPasswd return RestServerPasswd
+func (c *Config) GetRestServerPasswd() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.RestServerPasswd
+}
+
+// SetRestServerPasswd set RestServerPasswd
+func (c *Config) SetRestServerPasswd(passwd string) {
+	c.Lock()
+	defer c.Unlock()
+	c.cfg.RestServerPasswd = passwd
+}
+
+// gRPC server
+
+// GetGrpcServerLaunch returns true if gRPC management server must be
+// launched
+func (c *Config) GetGrpcServerLaunch() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.LaunchGrpcServer
+}
+
+// GetGrpcServerIp returns the ip that the gRPC server should listen on
+func (c *Config) GetGrpcServerIp() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.GrpcServerIp
+}
+
+// GetGrpcServerPort returns the port that the gRPC server should listen on
+func (c *Config) GetGrpcServerPort() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.GrpcServerPort
+}
+
+// GetGrpcServerCert returns path of the certificate of the gRPC server
+// (relative to base path)
+func (c *Config) GetGrpcServerCert() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.GrpcServerCert
+}
+
+// GetGrpcServerKey returns path of the key of the gRPC server (relative to
+// base path)
+func (c *Config) GetGrpcServerKey() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.GrpcServerKey
+}
+
+// GetGrpcServerClientCa returns path of the CA certificates signing
+// certificates of gRPC clients (relative to base path)
+func (c *Config) GetGrpcServerClientCa() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.GrpcServerClientCa
+}
+
+// GetGrpcServerClients returns common names of certificates of gRPC clients
+// allowed (empty: all certificates signed by client CA)
+func (c *Config) GetGrpcServerClients() []string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.GrpcServerClients == "_" {
+		return []string{}
+	}
+	return strings.Split(c.cfg.GrpcServerClients, ";")
+}
+
+// deliverd
+
+// GetDeliverdMaxInFlight returns DeliverdMaxInFlight
+func (c *Config) GetDeliverdMaxInFlight() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdMaxInFlight
+}
+
+// GetLocalIps returns ordered lits of local IP (net.IP) to use when sending mail
+func (c *Config) GetLocalIps() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.LocalIps
+	/*
+		// no mix beetween & and |
+		failover := strings.Count(localIps, "&") != 0
+		roundRobin := strings.Count(localIps, "|") != 0
+
+		if failover && roundRobin {
+			return nil, errors.New("mixing & and | are not allowed in config TMAIL_DELIVERD_LOCAL_IPS")
+		}
+
+		var sIps []string
 
 		// one local ip
 		if !failover && !roundRobin {
@@ -516,6 +1842,56 @@ func (c *Config) GetDeliverdRemoteTimeout() int {
 	return c.cfg.DeliverdRemoteTimeout
 }
 
+// GetDeliverdTimeouts returns timeouts of remote deliveries (see
+// smtpx.ParseTimeouts)
+func (c *Config) GetDeliverdTimeouts() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.DeliverdTimeouts == "_" {
+		return ""
+	}
+	return c.cfg.DeliverdTimeouts
+}
+
+// GetDeliverdShutdownGrace returns time in seconds current deliveries have
+// to end when tmail stops (or restarts)
+func (c *Config) GetDeliverdShutdownGrace() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdShutdownGrace
+}
+
+// GetDeliverdOAuth2TokenUrl returns URL of the OAuth2 token endpoint
+// exchanging refresh tokens of xoauth2 routes ("" if none)
+func (c *Config) GetDeliverdOAuth2TokenUrl() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.DeliverdOAuth2TokenUrl == "_" {
+		return ""
+	}
+	return c.cfg.DeliverdOAuth2TokenUrl
+}
+
+// GetDeliverdOAuth2ClientId returns OAuth2 client ID of tmail
+func (c *Config) GetDeliverdOAuth2ClientId() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.DeliverdOAuth2ClientId == "_" {
+		return ""
+	}
+	return c.cfg.DeliverdOAuth2ClientId
+}
+
+// GetDeliverdOAuth2ClientSecret returns OAuth2 client secret of tmail
+func (c *Config) GetDeliverdOAuth2ClientSecret() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.DeliverdOAuth2ClientSecret == "_" {
+		return ""
+	}
+	return c.cfg.DeliverdOAuth2ClientSecret
+}
+
 // GetDeliverdQueueLifetime return queue lifetime in minutes
 func (c *Config) GetDeliverdQueueLifetime() int {
 	c.Lock()
@@ -544,6 +1920,198 @@ func (c *Config) GetDeliverdDkimSign() bool {
 	return c.cfg.DeliverdDkimSign
 }
 
+// GetDeliverdArcSealDomain returns the domain whose DKIM keys are used to
+// ARC seal relayed messages ("" if ARC sealing is disabled)
+func (c *Config) GetDeliverdArcSealDomain() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.DeliverdArcSealDomain == "_" {
+		return ""
+	}
+	return strings.ToLower(c.cfg.DeliverdArcSealDomain)
+}
+
+// GetDeliverdBdatChunkSize returns the size of BDAT chunks used when remote
+// server supports CHUNKING. 0 means CHUNKING is not used
+func (c *Config) GetDeliverdBdatChunkSize() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdBdatChunkSize
+}
+
+// GetDeliverdRemoteBatchMaxRcpt returns the max number of recipients of a
+// same queued message grouped in a single remote transaction
+func (c *Config) GetDeliverdRemoteBatchMaxRcpt() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdRemoteBatchMaxRcpt
+}
+
+// GetDeliverdBouncedKeep returns how long (hours) bounced messages are kept
+// for redirection (0: not kept)
+func (c *Config) GetDeliverdBouncedKeep() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdBouncedKeep
+}
+
+// GetDeliverdDnsCacheTtl returns lifetime in seconds of cached DNS responses
+// (0: no cache)
+func (c *Config) GetDeliverdDnsCacheTtl() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdDnsCacheTtl
+}
+
+// GetDeliverdDnsPrefetchWindow returns the window in seconds used to select
+// queued messages for DNS prefetch (0: no prefetch)
+func (c *Config) GetDeliverdDnsPrefetchWindow() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdDnsPrefetchWindow
+}
+
+// GetDeliverdDnsPrefetchWorkers returns the number of parallel DNS prefetch
+// workers
+func (c *Config) GetDeliverdDnsPrefetchWorkers() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdDnsPrefetchWorkers
+}
+
+// GetDeliverdRouteBreakerFailures returns the number of consecutive
+// connection failures of a route which opens its circuit breaker (0: never)
+func (c *Config) GetDeliverdRouteBreakerFailures() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdRouteBreakerFailures
+}
+
+// GetDeliverdRouteBreakerCooldown returns the number of seconds a route with
+// an open circuit breaker is not used
+func (c *Config) GetDeliverdRouteBreakerCooldown() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdRouteBreakerCooldown
+}
+
+// GetDeliverdIpFamily returns the IP family preference of routes without
+// preference (ipv6-first, ipv4-first, ipv6-only, ipv4-only or "" for
+// resolver order)
+func (c *Config) GetDeliverdIpFamily() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdIpFamily
+}
+
+// GetDeliverdHappyEyeballsDelay returns the head start in milliseconds of
+// a connection attempt before the next one is started in parallel (0:
+// sequential attempts)
+func (c *Config) GetDeliverdHappyEyeballsDelay() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdHappyEyeballsDelay
+}
+
+// GetDeliverdAutoscaleEnabled returns true if deliverd workers must be
+// autoscaled (up to deliverd_max_in_flight)
+func (c *Config) GetDeliverdAutoscaleEnabled() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdAutoscaleEnabled
+}
+
+// GetDeliverdAutoscaleMin returns the min number of deliverd workers
+func (c *Config) GetDeliverdAutoscaleMin() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdAutoscaleMin
+}
+
+// GetDeliverdAutoscaleInterval returns interval in seconds between two
+// autoscale checks
+func (c *Config) GetDeliverdAutoscaleInterval() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdAutoscaleInterval
+}
+
+// GetDeliverdAutoscaleCooldown returns min delay in seconds between two
+// changes of workers count
+func (c *Config) GetDeliverdAutoscaleCooldown() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdAutoscaleCooldown
+}
+
+// GetDeliverdAutoscaleMaxDeferralRate returns the deferral rate (percent)
+// above which workers are scaled down
+func (c *Config) GetDeliverdAutoscaleMaxDeferralRate() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdAutoscaleMaxDeferralRate
+}
+
+// GetDeliverdRetrySchedule returns retry schedule of normal messages
+// ("" : delay is increased by one minute on each attempt)
+func (c *Config) GetDeliverdRetrySchedule() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.DeliverdRetrySchedule == "_" {
+		return ""
+	}
+	return c.cfg.DeliverdRetrySchedule
+}
+
+// GetDeliverdRetryScheduleBounce returns retry schedule of bounces
+// ("": schedule of normal messages)
+func (c *Config) GetDeliverdRetryScheduleBounce() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.DeliverdRetryScheduleBounce == "_" {
+		return ""
+	}
+	return c.cfg.DeliverdRetryScheduleBounce
+}
+
+// GetDeliverdRetrySchedulePriority returns retry schedule of priority
+// messages ("": schedule of normal messages)
+func (c *Config) GetDeliverdRetrySchedulePriority() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.DeliverdRetrySchedulePriority == "_" {
+		return ""
+	}
+	return c.cfg.DeliverdRetrySchedulePriority
+}
+
+// GetDeliverdQueueLifetimeBounce returns queue lifetime of bounces in
+// minutes (0: deliverd_queue_lifetime)
+func (c *Config) GetDeliverdQueueLifetimeBounce() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdQueueLifetimeBounce
+}
+
+// GetDeliverdQueueLifetimePriority returns queue lifetime of priority
+// messages in minutes (0: deliverd_queue_lifetime)
+func (c *Config) GetDeliverdQueueLifetimePriority() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdQueueLifetimePriority
+}
+
+// GetDeliverdPrioritySenders returns senders (addresses, domains or
+// authenticated users) of priority messages
+func (c *Config) GetDeliverdPrioritySenders() []string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.DeliverdPrioritySenders == "_" {
+		return []string{}
+	}
+	return strings.Split(c.cfg.DeliverdPrioritySenders, ";")
+}
+
 // GetUsersHomeBase returns users home base
 func (c *Config) GetUsersHomeBase() string {
 	c.Lock()
@@ -558,6 +2126,14 @@ func (c *Config) GetUserMailboxDefaultQuota() string {
 	return c.cfg.UserMailboxDefaultQuota
 }
 
+// GetUsersMailboxDefaultDriver returns the default mailbox driver
+// (dovecot or maildir)
+func (c *Config) GetUsersMailboxDefaultDriver() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.UsersMailboxDefaultDriver
+}
+
 // GetDovecotSupportEnabled returns DovecotSupportEnabled
 func (c *Config) GetDovecotSupportEnabled() bool {
 	c.Lock()
@@ -571,3 +2147,111 @@ func (c *Config) GetDovecotLda() string {
 	defer c.Unlock()
 	return c.cfg.DovecotLda
 }
+
+// GetDovecotLmtp returns LMTP URI used for local deliveries
+// (empty if dovecot-lda must be used)
+func (c *Config) GetDovecotLmtp() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.DovecotLmtp == "_" {
+		return ""
+	}
+	return c.cfg.DovecotLmtp
+}
+
+// GetSieveMaxScriptSize returns the maximum size of a sieve script
+func (c *Config) GetSieveMaxScriptSize() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.SieveMaxScriptSize
+}
+
+// GetManageSieveListen returns address the ManageSieve server listens on
+// (empty if it's disabled)
+func (c *Config) GetManageSieveListen() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.ManageSieveListen == "_" {
+		return ""
+	}
+	return c.cfg.ManageSieveListen
+}
+
+// GetManageSieveRequireTls returns true if ManageSieve clients must use
+// STARTTLS before authentication
+func (c *Config) GetManageSieveRequireTls() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.ManageSieveRequireTls
+}
+
+// GetJournalStoreDriver returns driver of journal store (disk or s3)
+func (c *Config) GetJournalStoreDriver() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.JournalStoreDriver
+}
+
+// GetJournalStoreSource returns source of journal store (empty if it's
+// disabled)
+func (c *Config) GetJournalStoreSource() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.JournalStoreSource == "_" {
+		return ""
+	}
+	return c.cfg.JournalStoreSource
+}
+
+// GetDeliverdDelayWarning returns delay in hours after which sender is
+// warned that its message is not delivered yet (0: no warning)
+func (c *Config) GetDeliverdDelayWarning() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.DeliverdDelayWarning
+}
+
+// GetDeliverdDelayWarningOptOut returns domains of senders which don't
+// receive delay warnings
+func (c *Config) GetDeliverdDelayWarningOptOut() []string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.DeliverdDelayWarningOptOut == "_" {
+		return []string{}
+	}
+	return strings.Split(c.cfg.DeliverdDelayWarningOptOut, ";")
+}
+
+// GetNotificationLanguages returns languages of notifications by domain
+// (domain:lang separated by ;)
+func (c *Config) GetNotificationLanguages() string {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg.NotificationLanguages == "_" {
+		return ""
+	}
+	return c.cfg.NotificationLanguages
+}
+
+// GetMessageTraceRetention returns number of days message events are kept
+// (0: messages are not traced)
+func (c *Config) GetMessageTraceRetention() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.MessageTraceRetention
+}
+
+// GetBatvLifetime returns number of days tagged senders are valid
+func (c *Config) GetBatvLifetime() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.BatvLifetime
+}
+
+// GetBatvKeyRotation returns number of days after which BATV keys are
+// replaced
+func (c *Config) GetBatvKeyRotation() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.BatvKeyRotation
+}
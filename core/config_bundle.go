@@ -0,0 +1,514 @@
+package core
+
+// Signed configuration bundles
+// A bundle holds routes, delivery policies, throttle limits and greylist
+// whitelist, it's exported from a master node (tmail bundle export), signed
+// with its RSA private key (tmail bundle sign) and fetched over HTTPS by edge
+// relays (bundle_url), which verify it with the public key
+// (bundle_public_key). Bundles are applied in a transaction: on validation
+// failure the current configuration is kept. Older bundles are refused,
+// applied bundles are kept in history for manual rollback.
+// Credentials of routes (SMTP AUTH password, SOCKS5 proxy) are encrypted
+// with bundle_secret_key (AES-256-GCM), they are never in clear text in
+// bundles nor in history.
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/toorop/tmail/smtpx"
+)
+
+// configBundleMaxSize is the max size of a signed bundle
+const configBundleMaxSize = 16 * 1024 * 1024
+
+// configBundleSecretPrefix prefixes encrypted credentials
+const configBundleSecretPrefix = "tmailenc1:"
+
+// ConfigBundle represents configuration distributed to relays
+type ConfigBundle struct {
+	Version           int64 // must grow, older bundles are refused
+	CreatedAt         time.Time
+	Routes            []BundleRoute
+	DeliveryPolicies  []DeliveryPolicy
+	ThrottleLimits    []ThrottleLimit
+	GreylistWhitelist []string // networks (entries added by auto whitelisting are kept)
+}
+
+// BundleRoute represents a route in a bundle
+type BundleRoute struct {
+	Host           string
+	LocalIp        string
+	RemoteHost     string
+	RemotePort     int
+	Priority       int
+	User           string
+	MailFrom       string
+	SmtpAuthLogin  string
+	SmtpAuthPasswd string
+	ForwardClient  string
+	RetrySchedule  string
+	Proxy          string
+	SmtpAuthMech   string
+	Weight         int
+	MxFallback     bool
+	IpFamily       string
+	Timeouts       string
+}
+
+// SignedConfigBundle is the distributed form of a bundle
+type SignedConfigBundle struct {
+	Payload   []byte // JSON bundle
+	Signature []byte // RSA PKCS#1 v1.5 SHA-256 signature of payload
+}
+
+// ConfigBundleHistory represents an applied bundle
+type ConfigBundleHistory struct {
+	Id         int64
+	Version    int64
+	Sha256     string
+	Source     string
+	Payload    string `sql:"type:text;"`
+	AppliedAt  time.Time
+	RolledBack bool // bundle has been rolled back, it's not applied again by rollbacks
+}
+
+// configBundleAEAD returns cipher of credentials (bundle_secret_key)
+func configBundleAEAD() (cipher.AEAD, error) {
+	k, err := hex.DecodeString(Cfg.GetBundleSecretKey())
+	if err != nil || len(k) != 32 {
+		return nil, errors.New("no valid bundle_secret_key (64 hex characters) to encrypt credentials of routes")
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// configBundleSeal encrypts credential value of route to host ("" is not
+// encrypted)
+func configBundleSeal(value, host string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	aead, err := configBundleAEAD()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(host))
+	return configBundleSecretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// configBundleOpen decrypts credential value of route to host, clear text
+// credentials are refused
+func configBundleOpen(value, host string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(value, configBundleSecretPrefix) {
+		return "", errors.New("credentials of route to " + host + " are not encrypted")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(value[len(configBundleSecretPrefix):])
+	if err != nil {
+		return "", errors.New("bad encrypted credentials of route to " + host)
+	}
+	aead, err := configBundleAEAD()
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("bad encrypted credentials of route to " + host)
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(host))
+	if err != nil {
+		return "", errors.New("unable to decrypt credentials of route to " + host + " (bad bundle_secret_key)")
+	}
+	return string(plain), nil
+}
+
+// proxyHasCredentials returns true if proxy URI holds a password
+func proxyHasCredentials(proxy string) bool {
+	p, err := smtpx.ParseProxy(proxy)
+	return err == nil && p.Password != ""
+}
+
+// configBundleRoute returns route r as bundle route, credentials are encrypted
+func configBundleRoute(r Route) (br BundleRoute, err error) {
+	br = BundleRoute{
+		Host:          r.Host,
+		LocalIp:       r.LocalIp.String,
+		RemoteHost:    r.RemoteHost,
+		RemotePort:    int(r.RemotePort.Int64),
+		Priority:      int(r.Priority.Int64),
+		User:          r.User.String,
+		MailFrom:      r.MailFrom.String,
+		SmtpAuthLogin: r.SmtpAuthLogin.String,
+		ForwardClient: r.ForwardClient.String,
+		RetrySchedule: r.RetrySchedule.String,
+		Proxy:         r.Proxy.String,
+		SmtpAuthMech:  r.SmtpAuthMech.String,
+		Weight:        int(r.Weight.Int64),
+		MxFallback:    r.MxFallback,
+		IpFamily:      r.IpFamily.String,
+		Timeouts:      r.Timeouts.String,
+	}
+	if br.SmtpAuthPasswd, err = configBundleSeal(r.SmtpAuthPasswd.String, r.Host); err != nil {
+		return
+	}
+	if proxyHasCredentials(br.Proxy) {
+		br.Proxy, err = configBundleSeal(br.Proxy, r.Host)
+	}
+	return
+}
+
+// ConfigBundleExport returns current configuration as bundle version
+func ConfigBundleExport(version int64) (bundle ConfigBundle, err error) {
+	bundle = ConfigBundle{Version: version, CreatedAt: time.Now()}
+	routes, err := GetAllRoutes()
+	if err != nil {
+		return
+	}
+	for _, r := range routes {
+		var br BundleRoute
+		if br, err = configBundleRoute(r); err != nil {
+			return
+		}
+		bundle.Routes = append(bundle.Routes, br)
+	}
+	if bundle.DeliveryPolicies, err = DeliveryPolicyList(); err != nil {
+		return
+	}
+	if err = DB.Order("login asc").Find(&bundle.ThrottleLimits).Error; err != nil {
+		return
+	}
+	whitelist := []GreylistWhitelist{}
+	if err = DB.Where("auto = ?", false).Order("network asc").Find(&whitelist).Error; err != nil {
+		return
+	}
+	for _, w := range whitelist {
+		bundle.GreylistWhitelist = append(bundle.GreylistWhitelist, w.Network)
+	}
+	return
+}
+
+// ConfigBundleSign signs JSON bundle with PEM RSA private key
+func ConfigBundleSign(payload, privateKeyPem []byte) (signed SignedConfigBundle, err error) {
+	// check bundle
+	if _, err = configBundleParse(payload); err != nil {
+		return
+	}
+	block, _ := pem.Decode(privateKeyPem)
+	if block == nil {
+		return signed, errors.New("no PEM private key found")
+	}
+	var key *rsa.PrivateKey
+	if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		k, err8 := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err8 != nil {
+			return signed, errors.New("unable to parse private key - " + err.Error())
+		}
+		var ok bool
+		if key, ok = k.(*rsa.PrivateKey); !ok {
+			return signed, errors.New("private key is not a RSA key")
+		}
+		err = nil
+	}
+	hashed := sha256.Sum256(payload)
+	signed.Payload = payload
+	signed.Signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	return
+}
+
+// configBundleVerify verifies signed bundle with public key of config
+func configBundleVerify(signed SignedConfigBundle) error {
+	keyFile := Cfg.GetBundlePublicKey()
+	if keyFile == "" {
+		return errors.New("no public key to verify bundle (bundle_public_key)")
+	}
+	keyPem, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(keyPem)
+	if block == nil {
+		return errors.New("no PEM public key found in " + keyFile)
+	}
+	k, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return errors.New("unable to parse public key " + keyFile + " - " + err.Error())
+	}
+	key, ok := k.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("public key " + keyFile + " is not a RSA key")
+	}
+	hashed := sha256.Sum256(signed.Payload)
+	if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signed.Signature); err != nil {
+		return errors.New("bad bundle signature")
+	}
+	return nil
+}
+
+// configBundleParse parses and validates JSON bundle
+func configBundleParse(payload []byte) (bundle ConfigBundle, err error) {
+	if err = json.Unmarshal(payload, &bundle); err != nil {
+		return bundle, errors.New("bad bundle - " + err.Error())
+	}
+	if bundle.Version <= 0 {
+		return bundle, errors.New("bad bundle version")
+	}
+	for i := range bundle.Routes {
+		r := &bundle.Routes[i]
+		if r.SmtpAuthPasswd, err = configBundleOpen(r.SmtpAuthPasswd, r.Host); err != nil {
+			return bundle, err
+		}
+		if strings.HasPrefix(r.Proxy, configBundleSecretPrefix) {
+			if r.Proxy, err = configBundleOpen(r.Proxy, r.Host); err != nil {
+				return bundle, err
+			}
+		} else if proxyHasCredentials(r.Proxy) {
+			return bundle, errors.New("credentials of proxy of route to " + r.Host + " are not encrypted")
+		}
+		if _, err = newRoute(r.Host, r.LocalIp, r.RemoteHost, r.RemotePort, r.Priority, r.User, r.MailFrom, r.SmtpAuthLogin, r.SmtpAuthPasswd, r.ForwardClient, r.RetrySchedule, r.Proxy, r.SmtpAuthMech, r.Weight, r.MxFallback, r.IpFamily, r.Timeouts); err != nil {
+			return bundle, fmt.Errorf("bad route to %s - %s", r.Host, err)
+		}
+	}
+	for _, p := range bundle.DeliveryPolicies {
+		if strings.TrimSpace(p.Domain) == "" || p.MaxConns < 0 || p.MaxMsgsPerConn < 0 || p.MsgsPerMinute < 0 || p.BackoffMultiplier < 0 {
+			return bundle, errors.New("bad delivery policy " + p.Domain)
+		}
+		if p.RetrySchedule != "" {
+			if _, err = parseRetrySchedule(p.RetrySchedule); err != nil {
+				return bundle, fmt.Errorf("bad delivery policy %s - %s", p.Domain, err)
+			}
+		}
+	}
+	for _, l := range bundle.ThrottleLimits {
+		if strings.TrimSpace(l.Login) == "" || l.MsgsPerHour < 0 || l.MaxRcpt < 0 || l.MaxSessions < 0 {
+			return bundle, errors.New("bad throttle limit " + l.Login)
+		}
+	}
+	for _, network := range bundle.GreylistWhitelist {
+		if _, err = greylistParseNetwork(network); err != nil {
+			return bundle, err
+		}
+	}
+	return bundle, nil
+}
+
+// configBundleVersion returns the highest version of applied bundles (0 if
+// none), a rolled back bundle is not applied again by the fetcher
+func configBundleVersion() (int64, error) {
+	last := ConfigBundleHistory{}
+	err := DB.Order("version desc").First(&last).Error
+	if err == gorm.RecordNotFound {
+		return 0, nil
+	}
+	return last.Version, err
+}
+
+// configBundleApply replaces configuration by bundle in a transaction
+func configBundleApply(bundle ConfigBundle, payload []byte, source string) error {
+	tx := DB.Begin()
+	rollback := func(err error) error {
+		tx.Rollback()
+		return errors.New("bundle " + source + " not applied, configuration unchanged - " + err.Error())
+	}
+	if err := tx.Delete(Route{}).Error; err != nil {
+		return rollback(err)
+	}
+	for _, r := range bundle.Routes {
+		route, err := newRoute(r.Host, r.LocalIp, r.RemoteHost, r.RemotePort, r.Priority, r.User, r.MailFrom, r.SmtpAuthLogin, r.SmtpAuthPasswd, r.ForwardClient, r.RetrySchedule, r.Proxy, r.SmtpAuthMech, r.Weight, r.MxFallback, r.IpFamily, r.Timeouts)
+		if err != nil {
+			return rollback(err)
+		}
+		if err = tx.Create(route).Error; err != nil {
+			return rollback(err)
+		}
+	}
+	if err := tx.Delete(DeliveryPolicy{}).Error; err != nil {
+		return rollback(err)
+	}
+	for _, p := range bundle.DeliveryPolicies {
+		p.Id = 0
+		p.Domain = strings.ToLower(strings.TrimSpace(p.Domain))
+		if err := tx.Create(&p).Error; err != nil {
+			return rollback(err)
+		}
+	}
+	if err := tx.Delete(ThrottleLimit{}).Error; err != nil {
+		return rollback(err)
+	}
+	for _, l := range bundle.ThrottleLimits {
+		l.Id = 0
+		l.Login = strings.ToLower(l.Login)
+		if err := tx.Create(&l).Error; err != nil {
+			return rollback(err)
+		}
+	}
+	if err := tx.Where("auto = ?", false).Delete(GreylistWhitelist{}).Error; err != nil {
+		return rollback(err)
+	}
+	for _, network := range bundle.GreylistWhitelist {
+		network, _ = greylistParseNetwork(network)
+		if err := tx.Where("network = ?", network).Delete(GreylistWhitelist{}).Error; err != nil {
+			return rollback(err)
+		}
+		if err := tx.Create(&GreylistWhitelist{Network: network, AddedAt: time.Now()}).Error; err != nil {
+			return rollback(err)
+		}
+	}
+	hash := sha256.Sum256(payload)
+	history := ConfigBundleHistory{
+		Version:   bundle.Version,
+		Sha256:    hex.EncodeToString(hash[:]),
+		Source:    source,
+		Payload:   string(payload),
+		AppliedAt: time.Now(),
+	}
+	if err := tx.Create(&history).Error; err != nil {
+		return rollback(err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return rollback(err)
+	}
+	Log.Info(fmt.Sprintf("bundle %s version %d applied", source, bundle.Version))
+	return nil
+}
+
+// configBundleFetch returns signed bundle from source: HTTPS URL or file
+func configBundleFetch(source string) (signed SignedConfigBundle, err error) {
+	var raw []byte
+	if strings.Contains(source, "://") {
+		if !strings.HasPrefix(strings.ToLower(source), "https://") {
+			return signed, errors.New("bundles must be fetched over HTTPS")
+		}
+		client := http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Get(source)
+		if err != nil {
+			return signed, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return signed, fmt.Errorf("unable to fetch bundle %s - HTTP %d", source, resp.StatusCode)
+		}
+		if raw, err = ioutil.ReadAll(io.LimitReader(resp.Body, configBundleMaxSize+1)); err != nil {
+			return signed, err
+		}
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return signed, err
+		}
+		defer f.Close()
+		if raw, err = ioutil.ReadAll(io.LimitReader(f, configBundleMaxSize+1)); err != nil {
+			return signed, err
+		}
+	}
+	if len(raw) > configBundleMaxSize {
+		return signed, fmt.Errorf("bundle %s is too large (max %d bytes)", source, configBundleMaxSize)
+	}
+	if err = json.Unmarshal(raw, &signed); err != nil {
+		return signed, errors.New("bad signed bundle - " + err.Error())
+	}
+	return
+}
+
+// ConfigBundleApply fetches, verifies and applies bundle from source (HTTPS
+// URL or file), older bundles are applied only if force is true
+// it returns false if bundle is already applied
+func ConfigBundleApply(source string, force bool) (applied bool, err error) {
+	signed, err := configBundleFetch(source)
+	if err != nil {
+		return false, err
+	}
+	if err = configBundleVerify(signed); err != nil {
+		return false, err
+	}
+	bundle, err := configBundleParse(signed.Payload)
+	if err != nil {
+		return false, err
+	}
+	current, err := configBundleVersion()
+	if err != nil {
+		return false, err
+	}
+	if bundle.Version == current && !force {
+		return false, nil
+	}
+	if bundle.Version < current && !force {
+		return false, fmt.Errorf("bundle version %d is older than current version %d", bundle.Version, current)
+	}
+	return true, configBundleApply(bundle, signed.Payload, source)
+}
+
+// ConfigBundleRollback marks the current bundle as rolled back and applies
+// again the last bundle applied before it which has not been rolled back
+func ConfigBundleRollback() (version int64, err error) {
+	current := ConfigBundleHistory{}
+	if err = DB.Order("id desc").First(&current).Error; err != nil {
+		if err == gorm.RecordNotFound {
+			err = errors.New("no bundle applied")
+		}
+		return
+	}
+	previous := ConfigBundleHistory{}
+	err = DB.Where("id < ? AND sha256 != ? AND rolled_back = ?", current.Id, current.Sha256, false).Order("id desc").First(&previous).Error
+	if err == gorm.RecordNotFound {
+		return 0, errors.New("no previous bundle")
+	}
+	if err != nil {
+		return
+	}
+	bundle, err := configBundleParse([]byte(previous.Payload))
+	if err != nil {
+		return
+	}
+	if err = DB.Model(ConfigBundleHistory{}).Where("sha256 = ?", current.Sha256).Update("rolled_back", true).Error; err != nil {
+		return
+	}
+	return bundle.Version, configBundleApply(bundle, []byte(previous.Payload), "rollback to "+previous.Sha256)
+}
+
+// ConfigBundleHistoryList returns applied bundles (last first)
+func ConfigBundleHistoryList() (history []ConfigBundleHistory, err error) {
+	history = []ConfigBundleHistory{}
+	err = DB.Select("id, version, sha256, source, applied_at, rolled_back").Order("id desc").Find(&history).Error
+	return
+}
+
+// LaunchConfigBundleFetcher fetches and applies bundle from bundle_url
+// periodically
+func LaunchConfigBundleFetcher() {
+	for {
+		applied, err := ConfigBundleApply(Cfg.GetBundleUrl(), false)
+		if err != nil {
+			Log.Error("bundle - " + err.Error())
+		} else if applied {
+			Log.Info("bundle - new configuration applied from " + Cfg.GetBundleUrl())
+		}
+		time.Sleep(time.Duration(Cfg.GetBundlePollInterval()) * time.Second)
+	}
+}
@@ -0,0 +1,243 @@
+package core
+
+// Configuration reload
+// On SIGHUP (tmail reload) conf/tmail.cfg is read again, validated and
+// swapped with the running configuration: getters read the running one so
+// limits, filters, routes and delivery settings apply to the next commands
+// of SMTP sessions and to the next deliveries, in-flight sessions are not
+// dropped. Parameters only read at startup (listeners, DB, stores, NSQ,
+// logger, launched services...) are kept, tmail must be restarted to change
+// them. On error the running configuration is kept.
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/toorop/tmail/smtpx"
+)
+
+// configStaticParams are parameters only read at startup
+var configStaticParams = map[string]bool{
+	"role":                           true,
+	"cluster_mode_enabled":           true,
+	"cluster_node_id":                true,
+	"tempdir":                        true,
+	"logpath":                        true,
+	"log_format":                     true,
+	"debug_enabled":                  true,
+	"db_driver":                      true,
+	"db_source":                      true,
+	"store_driver":                   true,
+	"store_source":                   true,
+	"store_encryption_key":           true,
+	"store_encryption_required":      true,
+	"journal_store_driver":           true,
+	"journal_store_source":           true,
+	"nsqd_eanble_logging":            true,
+	"nsq_lookupd_tcp_addresses":      true,
+	"nsq_lookupd_http_addresses":     true,
+	"smtpd_launch":                   true,
+	"smtpd_dsns":                     true,
+	"smtpd_proxy_protocol_listeners": true,
+	"smtpd_submission_listeners":     true,
+	"smtpd_scan_async_workers":       true,
+	"deliverd_launch":                true,
+	"deliverd_max_in_flight":         true,
+	"deliverd_autoscale_enabled":     true,
+	"deliverd_dns_prefetch_workers":  true,
+	"monitor_interval":               true,
+	"metrics_listen":                 true,
+	"metrics_rollups_enabled":        true,
+	"webhook_enabled":                true,
+	"smtpd_dmarc_reports_enabled":    true,
+	"digest_enabled":                 true,
+	"bundle_url":                     true,
+	"message_trace_retention":        true,
+	"acme_enabled":                   true,
+	"acme_http_listen":               true,
+	"managesieve_listen":             true,
+	"rest_server_launch":             true,
+	"rest_server_ip":                 true,
+	"rest_server_port":               true,
+	"rest_server_is_tls":             true,
+	"rest_server_login":              true,
+	"rest_server_passwd":             true,
+	"grpc_server_launch":             true,
+	"grpc_server_ip":                 true,
+	"grpc_server_port":               true,
+	"grpc_server_cert":               true,
+	"grpc_server_key":                true,
+	"grpc_server_client_ca":          true,
+	"grpc_server_clients":            true,
+}
+
+// ConfigFile returns path of config file (conf/tmail.cfg)
+func ConfigFile() string {
+	return path.Join(GetBasePath(), "conf", "tmail.cfg")
+}
+
+// configFileRead returns values of config file: shell lines
+// "export TMAIL_NAME=value" (or "TMAIL_NAME=value"), keyed by variable name
+func configFileRead(file string) (values map[string]string, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	values = make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		p := strings.Index(line, "=")
+		if p < 1 {
+			continue
+		}
+		name, value := line[:p], strings.TrimSpace(line[p+1:])
+		if len(value) > 1 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[name] = value
+	}
+	return values, scanner.Err()
+}
+
+// configFromFile loads and validates config of file, environment is used
+// for parameters missing from file
+func configFromFile(file string) (*Config, error) {
+	values, err := configFileRead(file)
+	if err != nil {
+		return nil, errors.New("unable to read config file - " + err.Error())
+	}
+	fresh := &Config{}
+	if err = fresh.load("tmail", func(name string) string {
+		if value, ok := values[name]; ok {
+			return value
+		}
+		return os.Getenv(name)
+	}); err != nil {
+		return nil, err
+	}
+	if err = fresh.validate(); err != nil {
+		return nil, err
+	}
+	return fresh, nil
+}
+
+// validate checks values which are parsed when they are used
+func (c *Config) validate() (err error) {
+	if err = dbCheckDriver(c.GetDbDriver()); err != nil {
+		return
+	}
+	if c.GetLaunchSmtpd() {
+		if _, err = GetDsnsFromString(c.GetSmtpdDsns()); err != nil {
+			return errors.New("bad smtpd_dsns - " + err.Error())
+		}
+	}
+	if _, err = smtpx.ParseFamily(c.GetDeliverdIpFamily()); err != nil {
+		return errors.New("bad deliverd_ip_family - " + err.Error())
+	}
+	if _, err = smtpx.ParseTimeouts(c.GetDeliverdTimeouts()); err != nil {
+		return errors.New("bad deliverd_timeouts - " + err.Error())
+	}
+	if _, err = ParseSize(c.GetSmtpdSendingBytesPerDay()); err != nil {
+		return errors.New("bad smtpd_sending_bytes_per_day - " + err.Error())
+	}
+	schedules := map[string]string{
+		"deliverd_retry_schedule":          c.GetDeliverdRetrySchedule(),
+		"deliverd_retry_schedule_bounce":   c.GetDeliverdRetryScheduleBounce(),
+		"deliverd_retry_schedule_priority": c.GetDeliverdRetrySchedulePriority(),
+	}
+	for name, schedule := range schedules {
+		if schedule == "" {
+			continue
+		}
+		if _, err = parseRetrySchedule(schedule); err != nil {
+			return errors.New("bad " + name + " - " + err.Error())
+		}
+	}
+	if c.GetBatvLifetime() < 1 || c.GetBatvLifetime() > batvMaxLifetime || c.GetBatvLifetime() >= c.GetBatvKeyRotation() {
+		return errors.New("bad batv_lifetime - must be between 1 and " + strconv.Itoa(batvMaxLifetime) + " days and lower than batv_key_rotation")
+	}
+	return nil
+}
+
+// ConfigReload reloads config from config file, it returns names of
+// parameters changed and names of changed parameters which need a restart
+func ConfigReload() (changed, restart []string, err error) {
+	fresh, err := configFromFile(ConfigFile())
+	if err != nil {
+		return nil, nil, err
+	}
+	Cfg.Lock()
+	running := reflect.ValueOf(&Cfg.cfg).Elem()
+	next := reflect.ValueOf(&fresh.cfg).Elem()
+	typ := running.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		if reflect.DeepEqual(running.Field(i).Interface(), next.Field(i).Interface()) {
+			continue
+		}
+		name := typ.Field(i).Tag.Get("name")
+		if configStaticParams[name] {
+			restart = append(restart, name)
+			continue
+		}
+		running.Field(i).Set(next.Field(i))
+		changed = append(changed, name)
+	}
+	Cfg.Unlock()
+	configReloaded(changed)
+	return
+}
+
+// configReloaded flushes caches of results depending on changed parameters
+func configReloaded(changed []string) {
+	for _, name := range changed {
+		switch {
+		case strings.HasPrefix(name, "smtpd_dnsbl"):
+			dnsblCache.Lock()
+			dnsblCache.results = make(map[string]dnsblResult)
+			dnsblCache.Unlock()
+		case strings.HasPrefix(name, "smtpd_auth_"):
+			authCache.Lock()
+			authCache.entries = make(map[string]authCacheEntry)
+			authCache.Unlock()
+		case strings.HasPrefix(name, "smtpd_attachment_hash"):
+			attachmentHashCache.Lock()
+			attachmentHashCache.verdicts = make(map[string]attachmentHashVerdict)
+			attachmentHashCache.Unlock()
+		}
+	}
+}
+
+// ConfigCheck validates config file and checks that DB it points to has
+// all tables of this version of tmail (tables are not created nor migrated).
+// It doesn't depend on Cfg nor DB: tmail config check runs it without
+// bootstrapping the scope.
+func ConfigCheck() error {
+	fresh, err := configFromFile(ConfigFile())
+	if err != nil {
+		return err
+	}
+	db, err := gorm.Open(fresh.GetDbDriver(), fresh.GetDbSource())
+	if err != nil {
+		return errors.New("unable to open DB " + fresh.GetDbDriver() + " " + fresh.GetDbSource() + " - " + err.Error())
+	}
+	defer db.Close()
+	if err = db.DB().Ping(); err != nil {
+		return errors.New("unable to access DB " + fresh.GetDbDriver() + " " + fresh.GetDbSource() + " - " + err.Error())
+	}
+	if !IsOkDB(db) {
+		return errors.New("DB " + fresh.GetDbDriver() + " " + fresh.GetDbSource() + " misses some tables, run tmail to create them")
+	}
+	return nil
+}
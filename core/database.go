@@ -34,6 +34,117 @@ func IsOkDB(DB gorm.DB) bool {
 	if !DB.HasTable(&DkimConfig{}) {
 		return false
 	}
+	if !DB.HasTable(&QuarantinedMessage{}) {
+		return false
+	}
+	if !DB.HasTable(&DmarcReportRecord{}) {
+		return false
+	}
+	if !DB.HasTable(&QueueFreeze{}) {
+		return false
+	}
+	if !DB.HasTable(&GreylistTriplet{}) {
+		return false
+	}
+	if !DB.HasTable(&GreylistWhitelist{}) {
+		return false
+	}
+	if !DB.HasTable(&FirstSeen{}) {
+		return false
+	}
+	if !DB.HasTable(&ThrottleLimit{}) {
+		return false
+	}
+	if !DB.HasTable(&ThrottleCounter{}) {
+		return false
+	}
+	if !DB.HasTable(&DeliveryPolicy{}) {
+		return false
+	}
+	if !DB.HasTable(&DigestSubscription{}) {
+		return false
+	}
+	if !DB.HasTable(&DigestCounter{}) {
+		return false
+	}
+	if !DB.HasTable(&ScanJob{}) {
+		return false
+	}
+	if !DB.HasTable(&ConfigBundleHistory{}) {
+		return false
+	}
+	if !DB.HasTable(&Webhook{}) {
+		return false
+	}
+	if !DB.HasTable(&TLSCertificate{}) {
+		return false
+	}
+	if !DB.HasTable(&MetricsRollup{}) {
+		return false
+	}
+	if !DB.HasTable(&BouncedMessage{}) {
+		return false
+	}
+	if !DB.HasTable(&RedirectAudit{}) {
+		return false
+	}
+	if !DB.HasTable(&AddressRewrite{}) {
+		return false
+	}
+	if !DB.HasTable(&ClusterLease{}) {
+		return false
+	}
+	if !DB.HasTable(&AcmeCacheEntry{}) {
+		return false
+	}
+	if !DB.HasTable(&MailGroup{}) {
+		return false
+	}
+	if !DB.HasTable(&MailGroupMember{}) {
+		return false
+	}
+	if !DB.HasTable(&SieveScript{}) {
+		return false
+	}
+	if !DB.HasTable(&SieveVacationLog{}) {
+		return false
+	}
+	if !DB.HasTable(&Vacation{}) {
+		return false
+	}
+	if !DB.HasTable(&JournalRule{}) {
+		return false
+	}
+	if !DB.HasTable(&ClusterNode{}) {
+		return false
+	}
+	if !DB.HasTable(&RouteHealth{}) {
+		return false
+	}
+	if !DB.HasTable(&SendingQuota{}) {
+		return false
+	}
+	if !DB.HasTable(&SendingCounter{}) {
+		return false
+	}
+	if !DB.HasTable(&HeaderRule{}) {
+		return false
+	}
+	if !DB.HasTable(&MessageEvent{}) {
+		return false
+	}
+	if !DB.HasTable(&BatvDomain{}) {
+		return false
+	}
+	if !DB.HasTable(&RelayPolicy{}) {
+		return false
+	}
+	if !DB.HasTable(&RelayLogin{}) {
+		return false
+	}
+	if !DB.HasTable(&WebhookRetry{}) {
+		return false
+	}
 	return true
 }
 
@@ -113,14 +224,249 @@ func InitDB(DB gorm.DB) error {
 		}
 	}
 
+	if !DB.HasTable(&QuarantinedMessage{}) {
+		if err = DB.CreateTable(&QuarantinedMessage{}).Error; err != nil {
+			return errors.New("Unable to create table quarantined_message - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&DmarcReportRecord{}) {
+		if err = DB.CreateTable(&DmarcReportRecord{}).Error; err != nil {
+			return errors.New("Unable to create table dmarc_report_record - " + err.Error())
+		}
+		// Index
+		if err = DB.Model(&DmarcReportRecord{}).AddIndex("idx_dmarc_policy_domain_day", "policy_domain", "day").Error; err != nil {
+			return errors.New("Unable to add index idx_dmarc_policy_domain_day on table dmarc_report_record - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&QueueFreeze{}) {
+		if err = DB.CreateTable(&QueueFreeze{}).Error; err != nil {
+			return errors.New("Unable to create table queue_freeze - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&GreylistTriplet{}) {
+		if err = DB.CreateTable(&GreylistTriplet{}).Error; err != nil {
+			return errors.New("Unable to create table greylist_triplet - " + err.Error())
+		}
+		// Index
+		if err = DB.Model(&GreylistTriplet{}).AddIndex("idx_greylist_triplet", "network", "mail_from", "rcpt_to").Error; err != nil {
+			return errors.New("Unable to add index idx_greylist_triplet on table greylist_triplet - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&GreylistWhitelist{}) {
+		if err = DB.CreateTable(&GreylistWhitelist{}).Error; err != nil {
+			return errors.New("Unable to create table greylist_whitelist - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&FirstSeen{}) {
+		if err = DB.CreateTable(&FirstSeen{}).Error; err != nil {
+			return errors.New("Unable to create table first_seen - " + err.Error())
+		}
+		// Index
+		if err = DB.Model(&FirstSeen{}).AddIndex("idx_first_seen_kind_value", "kind", "value").Error; err != nil {
+			return errors.New("Unable to add index idx_first_seen_kind_value on table first_seen - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&ThrottleLimit{}) {
+		if err = DB.CreateTable(&ThrottleLimit{}).Error; err != nil {
+			return errors.New("Unable to create table throttle_limit - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&ThrottleCounter{}) {
+		if err = DB.CreateTable(&ThrottleCounter{}).Error; err != nil {
+			return errors.New("Unable to create table throttle_counter - " + err.Error())
+		}
+		// Index
+		if err = DB.Model(&ThrottleCounter{}).AddIndex("idx_throttle_counter_sender_window", "sender", "window_start").Error; err != nil {
+			return errors.New("Unable to add index idx_throttle_counter_sender_window on table throttle_counter - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&DeliveryPolicy{}) {
+		if err = DB.CreateTable(&DeliveryPolicy{}).Error; err != nil {
+			return errors.New("Unable to create table delivery_policy - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&DigestSubscription{}) {
+		if err = DB.CreateTable(&DigestSubscription{}).Error; err != nil {
+			return errors.New("Unable to create table digest_subscription - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&DigestCounter{}) {
+		if err = DB.CreateTable(&DigestCounter{}).Error; err != nil {
+			return errors.New("Unable to create table digest_counter - " + err.Error())
+		}
+		// Index
+		if err = DB.Model(&DigestCounter{}).AddIndex("idx_digest_counter_domain_day", "domain", "day").Error; err != nil {
+			return errors.New("Unable to add index idx_digest_counter_domain_day on table digest_counter - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&ScanJob{}) {
+		if err = DB.CreateTable(&ScanJob{}).Error; err != nil {
+			return errors.New("Unable to create table scan_job - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&ConfigBundleHistory{}) {
+		if err = DB.CreateTable(&ConfigBundleHistory{}).Error; err != nil {
+			return errors.New("Unable to create table config_bundle_history - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&Webhook{}) {
+		if err = DB.CreateTable(&Webhook{}).Error; err != nil {
+			return errors.New("Unable to create table webhook - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&TLSCertificate{}) {
+		if err = DB.CreateTable(&TLSCertificate{}).Error; err != nil {
+			return errors.New("Unable to create table tls_certificate - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&MetricsRollup{}) {
+		if err = DB.CreateTable(&MetricsRollup{}).Error; err != nil {
+			return errors.New("Unable to create table metrics_rollup - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&BouncedMessage{}) {
+		if err = DB.CreateTable(&BouncedMessage{}).Error; err != nil {
+			return errors.New("Unable to create table bounced_message - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&RedirectAudit{}) {
+		if err = DB.CreateTable(&RedirectAudit{}).Error; err != nil {
+			return errors.New("Unable to create table redirect_audit - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&AddressRewrite{}) {
+		if err = DB.CreateTable(&AddressRewrite{}).Error; err != nil {
+			return errors.New("Unable to create table address_rewrite - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&ClusterLease{}) {
+		if err = DB.CreateTable(&ClusterLease{}).Error; err != nil {
+			return errors.New("Unable to create table cluster_lease - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&AcmeCacheEntry{}) {
+		if err = DB.CreateTable(&AcmeCacheEntry{}).Error; err != nil {
+			return errors.New("Unable to create table acme_cache_entry - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&MailGroup{}) {
+		if err = DB.CreateTable(&MailGroup{}).Error; err != nil {
+			return errors.New("Unable to create table mail_group - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&MailGroupMember{}) {
+		if err = DB.CreateTable(&MailGroupMember{}).Error; err != nil {
+			return errors.New("Unable to create table mail_group_member - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&SieveScript{}) {
+		if err = DB.CreateTable(&SieveScript{}).Error; err != nil {
+			return errors.New("Unable to create table sieve_script - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&SieveVacationLog{}) {
+		if err = DB.CreateTable(&SieveVacationLog{}).Error; err != nil {
+			return errors.New("Unable to create table sieve_vacation_log - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&Vacation{}) {
+		if err = DB.CreateTable(&Vacation{}).Error; err != nil {
+			return errors.New("Unable to create table vacation - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&JournalRule{}) {
+		if err = DB.CreateTable(&JournalRule{}).Error; err != nil {
+			return errors.New("Unable to create table journal_rule - " + err.Error())
+		}
+	}
+
+	if !DB.HasTable(&ClusterNode{}) {
+		if err = DB.CreateTable(&ClusterNode{}).Error; err != nil {
+			return errors.New("Unable to create table cluster_node - " + err.Error())
+		}
+	}
+	if !DB.HasTable(&RouteHealth{}) {
+		if err = DB.CreateTable(&RouteHealth{}).Error; err != nil {
+			return errors.New("Unable to create table route_health - " + err.Error())
+		}
+	}
+	if !DB.HasTable(&SendingQuota{}) {
+		if err = DB.CreateTable(&SendingQuota{}).Error; err != nil {
+			return errors.New("Unable to create table sending_quota - " + err.Error())
+		}
+	}
+	if !DB.HasTable(&SendingCounter{}) {
+		if err = DB.CreateTable(&SendingCounter{}).Error; err != nil {
+			return errors.New("Unable to create table sending_counter - " + err.Error())
+		}
+	}
+	if !DB.HasTable(&HeaderRule{}) {
+		if err = DB.CreateTable(&HeaderRule{}).Error; err != nil {
+			return errors.New("Unable to create table header_rule - " + err.Error())
+		}
+	}
+	if !DB.HasTable(&MessageEvent{}) {
+		if err = DB.CreateTable(&MessageEvent{}).Error; err != nil {
+			return errors.New("Unable to create table message_event - " + err.Error())
+		}
+	}
+	if !DB.HasTable(&BatvDomain{}) {
+		if err = DB.CreateTable(&BatvDomain{}).Error; err != nil {
+			return errors.New("Unable to create table batv_domain - " + err.Error())
+		}
+	}
+	if !DB.HasTable(&RelayPolicy{}) {
+		if err = DB.CreateTable(&RelayPolicy{}).Error; err != nil {
+			return errors.New("Unable to create table relay_policy - " + err.Error())
+		}
+	}
+	if !DB.HasTable(&RelayLogin{}) {
+		if err = DB.CreateTable(&RelayLogin{}).Error; err != nil {
+			return errors.New("Unable to create table relay_login - " + err.Error())
+		}
+	}
+	if !DB.HasTable(&WebhookRetry{}) {
+		if err = DB.CreateTable(&WebhookRetry{}).Error; err != nil {
+			return errors.New("Unable to create table webhook_retry - " + err.Error())
+		}
+	}
+
 	return nil
 }
 
 // AutoMigrateDB will keep tables reflecting structs
 func AutoMigrateDB(DB gorm.DB) error {
 	// if tables exists check if they reflects struts
-	if err := DB.AutoMigrate(&User{}, &Alias{}, &RcptHost{}, &RelayIpOk{}, &QMessage{}, &Route{}, &DkimConfig{}).Error; err != nil {
+	if err := DB.AutoMigrate(&User{}, &Alias{}, &RcptHost{}, &RelayIpOk{}, &QMessage{}, &Route{}, &DkimConfig{}, &QuarantinedMessage{}, &DmarcReportRecord{}, &QueueFreeze{}, &GreylistTriplet{}, &GreylistWhitelist{}, &FirstSeen{}, &ThrottleLimit{}, &ThrottleCounter{}, &DeliveryPolicy{}, &DigestSubscription{}, &DigestCounter{}, &ScanJob{}, &ConfigBundleHistory{}, &Webhook{}, &TLSCertificate{}, &MetricsRollup{}, &BouncedMessage{}, &RedirectAudit{}, &AddressRewrite{}, &MailGroup{}, &MailGroupMember{}, &SieveScript{}, &SieveVacationLog{}, &Vacation{}, &JournalRule{}, &ClusterNode{}, &ClusterLease{}, &AcmeCacheEntry{}, &RouteHealth{}, &SendingQuota{}, &SendingCounter{}, &HeaderRule{}, &MessageEvent{}, &BatvDomain{}, &RelayPolicy{}, &RelayLogin{}, &WebhookRetry{}).Error; err != nil {
 		return errors.New("Unable autoMigrateDB - " + err.Error())
 	}
-	return nil
+	dbMigrateIndexes(DB)
+	// indexes needed by upserts
+	return dbMigrateUniqueIndexes(DB)
 }
@@ -0,0 +1,176 @@
+package core
+
+// Database dialects
+// tmail supports sqlite3, mysql and postgres (db_driver), queries which
+// differ between them are built here.
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// supported DB drivers
+const (
+	DbDriverSqlite   = "sqlite3"
+	DbDriverMysql    = "mysql"
+	DbDriverPostgres = "postgres"
+)
+
+// dbUniqueIndexes are unique indexes needed by upserts (dbIncrement)
+var dbUniqueIndexes = []struct {
+	model   interface{}
+	name    string
+	columns []string
+}{
+	{&ThrottleCounter{}, "uix_throttle_counter_sender_window", []string{"sender", "window_start"}},
+	{&FirstSeen{}, "uix_first_seen_kind_value", []string{"kind", "value"}},
+	{&RouteHealth{}, "uix_route_health_route_id", []string{"route_id"}},
+	{&SendingCounter{}, "uix_sending_counter_login_day", []string{"login", "day"}},
+}
+
+// dbIndexes are indexes of searches of large tables
+var dbIndexes = []struct {
+	model   interface{}
+	name    string
+	columns []string
+}{
+	{&MessageEvent{}, "idx_message_event_uuid", []string{"uuid"}},
+	{&MessageEvent{}, "idx_message_event_message_id", []string{"message_id"}},
+	{&MessageEvent{}, "idx_message_event_mail_from", []string{"mail_from"}},
+	{&MessageEvent{}, "idx_message_event_occurred_at", []string{"occurred_at"}},
+}
+
+// dbCheckDriver returns an error if driver is not supported
+func dbCheckDriver(driver string) error {
+	switch driver {
+	case DbDriverSqlite, DbDriverMysql, DbDriverPostgres:
+		return nil
+	}
+	return errors.New("unsupported DB driver " + driver + " (" + DbDriverSqlite + ", " + DbDriverMysql + " or " + DbDriverPostgres + " expected)")
+}
+
+// dbQuote quotes identifier (column or table name)
+func dbQuote(name string) string {
+	if Cfg.GetDbDriver() == DbDriverMysql {
+		return "`" + name + "`"
+	}
+	return `"` + name + `"`
+}
+
+// dbForUpdate returns tx locking selected rows until the end of tx, rows
+// locked by another transaction are skipped (postgres only, others DB
+// must check claims with conditional updates)
+func dbForUpdate(tx *gorm.DB) *gorm.DB {
+	if Cfg.GetDbDriver() == DbDriverPostgres {
+		return tx.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED")
+	}
+	return tx
+}
+
+// dbIncrement increments counters of the row of model table identified by
+// keys and sets columns of updates, the row is created (with keys and
+// inserts) if it doesn't exist. It's atomic (upsert): several processes can
+// update the same counter.
+// table must have an unique index on keys columns (dbUniqueIndexes).
+func dbIncrement(model interface{}, keys map[string]interface{}, counters []string, inserts, updates map[string]interface{}) error {
+	amounts := map[string]interface{}{}
+	for _, c := range counters {
+		amounts[c] = 1
+	}
+	return dbAdd(model, keys, amounts, inserts, updates)
+}
+
+// dbAdd is dbIncrement with amounts added to counters (counter: amount)
+func dbAdd(model interface{}, keys map[string]interface{}, amounts map[string]interface{}, inserts, updates map[string]interface{}) error {
+	counters := dbSortedKeys(amounts)
+	table := DB.NewScope(model).TableName()
+	columns, where, args := []string{}, []string{}, []interface{}{}
+	for _, k := range dbSortedKeys(keys) {
+		columns = append(columns, dbQuote(k))
+		where = append(where, dbQuote(k)+" = ?")
+		args = append(args, keys[k])
+	}
+	// counters are created with 0 (columns have no default)
+	insertArgs := append([]interface{}{}, args...)
+	for _, c := range counters {
+		columns = append(columns, dbQuote(c))
+		insertArgs = append(insertArgs, 0)
+	}
+	for _, k := range dbSortedKeys(inserts) {
+		columns = append(columns, dbQuote(k))
+		insertArgs = append(insertArgs, inserts[k])
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+
+	// create row if needed...
+	var insert string
+	switch Cfg.GetDbDriver() {
+	case DbDriverMysql:
+		insert = "INSERT IGNORE INTO %s (%s) VALUES (%s)"
+	case DbDriverPostgres:
+		insert = "INSERT INTO %s (%s) VALUES (%s) ON CONFLICT DO NOTHING"
+	default:
+		insert = "INSERT OR IGNORE INTO %s (%s) VALUES (%s)"
+	}
+	if err := DB.Exec(fmt.Sprintf(insert, dbQuote(table), strings.Join(columns, ", "), placeholders), insertArgs...).Error; err != nil {
+		return err
+	}
+	// ...and increment it
+	set, updateArgs := []string{}, []interface{}{}
+	for _, c := range counters {
+		set = append(set, dbQuote(c)+" = "+dbQuote(c)+" + ?")
+		updateArgs = append(updateArgs, amounts[c])
+	}
+	for _, k := range dbSortedKeys(updates) {
+		set = append(set, dbQuote(k)+" = ?")
+		updateArgs = append(updateArgs, updates[k])
+	}
+	return DB.Exec(fmt.Sprintf("UPDATE %s SET %s WHERE %s", dbQuote(table), strings.Join(set, ", "), strings.Join(where, " AND ")), append(updateArgs, args...)...).Error
+}
+
+// dbSortedKeys returns keys of m sorted (queries are stable)
+func dbSortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// dbMigrateIndexes adds indexes of dbIndexes to tables created before them,
+// error of an index which already exists is ignored (drivers don't all
+// support CREATE INDEX IF NOT EXISTS)
+func dbMigrateIndexes(DB gorm.DB) {
+	for _, idx := range dbIndexes {
+		DB.Model(idx.model).AddIndex(idx.name, idx.columns...)
+	}
+}
+
+// dbMigrateUniqueIndexes adds unique indexes of dbUniqueIndexes, if rows are
+// duplicated (counters created by concurrent processes before the index)
+// only the first one is kept
+func dbMigrateUniqueIndexes(DB gorm.DB) error {
+	for _, idx := range dbUniqueIndexes {
+		if DB.Model(idx.model).AddUniqueIndex(idx.name, idx.columns...).Error == nil {
+			continue
+		}
+		table, columns := DB.NewScope(idx.model).TableName(), []string{}
+		for _, c := range idx.columns {
+			columns = append(columns, dbQuote(c))
+		}
+		// derived table: mysql can't select from the table it deletes from
+		dedup := fmt.Sprintf("DELETE FROM %s WHERE id NOT IN (SELECT id FROM (SELECT MIN(id) AS id FROM %s GROUP BY %s) AS keep)", dbQuote(table), dbQuote(table), strings.Join(columns, ", "))
+		if err := DB.Exec(dedup).Error; err != nil {
+			return errors.New("Unable to remove duplicates from table " + table + " - " + err.Error())
+		}
+		if err := DB.Model(idx.model).AddUniqueIndex(idx.name, idx.columns...).Error; err != nil {
+			return errors.New("Unable to add index " + idx.name + " on table " + table + " - " + err.Error())
+		}
+	}
+	return nil
+}
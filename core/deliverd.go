@@ -1,11 +1,11 @@
 package core
 
 import (
+	"context"
 	"github.com/bitly/go-nsq"
 	"log"
-	"os"
-	"os/signal"
-	"syscall"
+	"sync"
+	"time"
 )
 
 /*type deliverd struct {
@@ -15,10 +15,14 @@ func New() *deliverd {
 	return &deliverd{}
 }*/
 
+// consumer of deliverd (nil if deliverd is not launched)
+var deliverdConsumer struct {
+	sync.Mutex
+	consumer *nsq.Consumer
+}
+
 // Run
 func LaunchDeliverd() {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	cfg := nsq.NewConfig()
 
 	cfg.UserAgent = "tmail/deliverd"
@@ -52,14 +56,46 @@ func LaunchDeliverd() {
 		log.Fatalln(err)
 	}
 
+	deliverdConsumer.Lock()
+	deliverdConsumer.consumer = consumer
+	deliverdConsumer.Unlock()
 	Log.Info("deliverd launched")
 
-	for {
-		select {
-		case <-consumer.StopChan:
-			return
-		case <-sigChan:
-			consumer.Stop()
-		}
+	// workers autoscaling
+	if Cfg.GetDeliverdAutoscaleEnabled() {
+		go launchAutoscaler(consumer)
+	}
+
+	// DNS prefetch
+	if Cfg.GetDeliverdDnsPrefetchWindow() != 0 && Cfg.GetDeliverdDnsCacheTtl() != 0 {
+		go launchDnsPrefetcher()
+	}
+
+	// idle remote connections
+	go launchRemotePoolJanitor()
+
+	// stopped by DeliverdStop
+	<-consumer.StopChan
+}
+
+// DeliverdStop stops deliverd: no more messages are received, current
+// deliveries have deliverd_shutdown_grace seconds to end (messages of
+// deliveries not ended are delivered again on next start)
+func DeliverdStop() {
+	deliverdConsumer.Lock()
+	consumer := deliverdConsumer.consumer
+	deliverdConsumer.consumer = nil
+	deliverdConsumer.Unlock()
+	if consumer == nil {
+		return
+	}
+	consumer.Stop()
+	grace := time.Duration(Cfg.GetDeliverdShutdownGrace()) * time.Second
+	select {
+	case <-consumer.StopChan:
+		Log.Info("deliverd stopped")
+	case <-time.After(grace):
+		Log.Info("deliverd - deliveries not ended after " + grace.String() + ", they will be done again on next start")
 	}
+	remotePool.CloseAll(context.Background())
 }
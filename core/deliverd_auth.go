@@ -1,111 +1,169 @@
-// Modified version of the standard auth.go librarie
-
-// Copyright 2010 The Go Authors. All rights reserved.
-// Use of this source code is governed by a BSD-style
-// license that can be found in the LICENSE file.
-
 package core
 
+// SMTP AUTH of routes
+// Mechanism of a route is plain, cram-md5, scram-sha-256 or xoauth2, or the
+// best mechanism announced by the remote host (SCRAM-SHA-256, CRAM-MD5 then
+// PLAIN) if it's not set. With xoauth2 the access token is given by the
+// OAuth2TokenProvider (SetOAuth2TokenProvider). By default the password of
+// the route is a refresh token exchanged at deliverd_oauth2_token_url
+// (refresh_token grant), or the access token if no token URL is set.
+
 import (
-	"crypto/hmac"
-	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
-	//"net"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toorop/tmail/smtpx"
 )
 
-// Auth is implemented by an SMTP authentication mechanism.
-type DeliverdAuth interface {
-	// Start begins an authentication with a server.
-	// It returns the name of the authentication protocol
-	// and optionally data to include in the initial AUTH message
-	// sent to the server. It can return proto == "" to indicate
-	// that the authentication should be skipped.
-	// If it returns a non-nil error, the SMTP client aborts
-	// the authentication attempt and closes the connection.
-	Start(server *ServerInfo) (proto string, toServer []byte, err error)
+// SMTP AUTH mechanisms of routes
+var routeAuthMechs = []string{"plain", "cram-md5", "scram-sha-256", "xoauth2"}
 
-	// Next continues the authentication. The server has just sent
-	// the fromServer data. If more is true, the server expects a
-	// response, which Next should return as toServer; otherwise
-	// Next should return toServer == nil.
-	// If Next returns a non-nil error, the SMTP client aborts
-	// the authentication attempt and closes the connection.
-	Next(fromServer []byte, more bool) (toServer []byte, err error)
+// OAuth2TokenProvider returns access tokens for XOAUTH2
+type OAuth2TokenProvider interface {
+	// Token returns access token of login, secret is the password of
+	// the route (refresh token...)
+	Token(login, secret string) (string, error)
 }
 
-// ServerInfo records information about an SMTP server.
-type ServerInfo struct {
-	//Address net.TCPAddr // SMTP adrress
-	Name string   // SMTP server name
-	TLS  bool     // using TLS, with valid certificate for Name
-	Auth []string // advertised authentication mechanisms
-}
+var oauth2 = struct {
+	sync.Mutex
+	provider OAuth2TokenProvider
+}{}
 
-type plainAuth struct {
-	identity, username, password string
-	host                         string
+// oauth2AccessToken is an access token got with a refresh token
+type oauth2AccessToken struct {
+	token     string
+	expiresAt time.Time
+	refresh   string // refresh token to use next (rotated by the server)
 }
 
-// PlainAuth returns an Auth that implements the PLAIN authentication
-// mechanism as defined in RFC 4616.
-// The returned Auth uses the given username and password to authenticate
-// on TLS connections to host and act as identity. Usually identity will be
-// left blank to act as username.
-func PlainAuth(identity, username, password, host string) DeliverdAuth {
-	return &plainAuth{identity, username, password, host}
+// access tokens by hash of login & refresh token of route
+var oauth2Tokens = struct {
+	sync.Mutex
+	tokens map[string]oauth2AccessToken
+}{tokens: make(map[string]oauth2AccessToken)}
+
+// SetOAuth2TokenProvider sets provider of XOAUTH2 access tokens
+func SetOAuth2TokenProvider(p OAuth2TokenProvider) {
+	oauth2.Lock()
+	oauth2.provider = p
+	oauth2.Unlock()
 }
 
-func (a *plainAuth) Start(server *ServerInfo) (string, []byte, error) {
-	if !server.TLS {
-		advertised := false
-		for _, mechanism := range server.Auth {
-			if mechanism == "PLAIN" {
-				advertised = true
-				break
-			}
-		}
-		if !advertised {
-			return "", nil, errors.New("unencrypted connection")
-		}
+// oauth2Token returns access token of login
+func oauth2Token(login, secret string) (string, error) {
+	oauth2.Lock()
+	p := oauth2.provider
+	oauth2.Unlock()
+	if p != nil {
+		return p.Token(login, secret)
 	}
-	if server.Name != a.host {
-		return "", nil, errors.New("wrong host name")
+	if Cfg.GetDeliverdOAuth2TokenUrl() == "" {
+		return secret, nil
 	}
-	resp := []byte(a.identity + "\x00" + a.username + "\x00" + a.password)
-	return "PLAIN", resp, nil
+	return oauth2Refresh(login, secret)
 }
 
-func (a *plainAuth) Next(fromServer []byte, more bool) ([]byte, error) {
-	if more {
-		// We've already sent everything.
-		return nil, errors.New("unexpected server challenge")
+// oauth2Refresh returns access token of login, refresh is the refresh token
+// of its route
+func oauth2Refresh(login, refresh string) (string, error) {
+	sum := sha256.Sum256([]byte(login + "\x00" + refresh))
+	key := hex.EncodeToString(sum[:])
+	oauth2Tokens.Lock()
+	cached, ok := oauth2Tokens.tokens[key]
+	oauth2Tokens.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.token, nil
 	}
-	return nil, nil
-}
-
-type cramMD5Auth struct {
-	username, secret string
-}
-
-// CRAMMD5Auth returns an Auth that implements the CRAM-MD5 authentication
-// mechanism as defined in RFC 2195.
-// The returned Auth uses the given username and secret to authenticate
-// to the server using the challenge-response mechanism.
-func CRAMMD5Auth(username, secret string) DeliverdAuth {
-	return &cramMD5Auth{username, secret}
-}
-
-func (a *cramMD5Auth) Start(server *ServerInfo) (string, []byte, error) {
-	return "CRAM-MD5", nil, nil
+	if ok && cached.refresh != "" {
+		refresh = cached.refresh
+	}
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refresh},
+		"client_id":     {Cfg.GetDeliverdOAuth2ClientId()},
+	}
+	if secret := Cfg.GetDeliverdOAuth2ClientSecret(); secret != "" {
+		form.Set("client_secret", secret)
+	}
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.PostForm(Cfg.GetDeliverdOAuth2TokenUrl(), form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+	r := struct {
+		AccessToken  string `json:"access_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+		Error        string `json:"error"`
+	}{}
+	if err = json.Unmarshal(body, &r); err != nil && resp.StatusCode == 200 {
+		return "", errors.New("bad token endpoint response - " + err.Error())
+	}
+	if resp.StatusCode != 200 || r.AccessToken == "" {
+		return "", fmt.Errorf("token endpoint refused refresh token - HTTP %d %s", resp.StatusCode, r.Error)
+	}
+	// expires a minute before the server says
+	lifetime := time.Duration(r.ExpiresIn)*time.Second - time.Minute
+	if r.ExpiresIn == 0 {
+		lifetime = 0
+	}
+	next := refresh
+	if r.RefreshToken != "" && r.RefreshToken != refresh {
+		next = r.RefreshToken
+		// rotated refresh token replaces the previous one in routes
+		if err = DB.Model(Route{}).Where("smtp_auth_login = ? AND smtp_auth_passwd = ?", login, refresh).Update("smtp_auth_passwd", next).Error; err != nil {
+			Log.Error("deliverd - unable to store rotated OAuth2 refresh token of " + login + " - " + err.Error())
+		}
+	}
+	oauth2Tokens.Lock()
+	oauth2Tokens.tokens[key] = oauth2AccessToken{token: r.AccessToken, expiresAt: time.Now().Add(lifetime), refresh: next}
+	oauth2Tokens.Unlock()
+	return r.AccessToken, nil
 }
 
-func (a *cramMD5Auth) Next(fromServer []byte, more bool) ([]byte, error) {
-	if more {
-		d := hmac.New(md5.New, []byte(a.secret))
-		d.Write(fromServer)
-		s := make([]byte, 0, d.Size())
-		return []byte(fmt.Sprintf("%s %x", a.username, d.Sum(s))), nil
+// routeAuth returns SMTP AUTH of route of client
+func routeAuth(client *smtpClient) (smtpx.Auth, error) {
+	login, passwd := client.route.SmtpAuthLogin.String, client.route.SmtpAuthPasswd.String
+	mech := strings.ToLower(client.route.SmtpAuthMech.String)
+	if mech == "" {
+		_, auths := client.Extension("AUTH")
+		announced := strings.Fields(strings.ToUpper(auths))
+		switch {
+		case IsStringInSlice("SCRAM-SHA-256", announced):
+			mech = "scram-sha-256"
+		case IsStringInSlice("CRAM-MD5", announced):
+			mech = "cram-md5"
+		default:
+			mech = "plain"
+		}
+	}
+	switch mech {
+	case "scram-sha-256":
+		return smtpx.ScramSha256Auth(login, passwd), nil
+	case "cram-md5":
+		return smtpx.CRAMMD5Auth(login, passwd), nil
+	case "xoauth2":
+		token, err := oauth2Token(login, passwd)
+		if err != nil {
+			return nil, errors.New("unable to get OAuth2 access token of " + login + " - " + err.Error())
+		}
+		return smtpx.XOAuth2Auth(login, token), nil
 	}
-	return nil, nil
+	return smtpx.PlainAuth("", login, passwd, client.route.RemoteHost), nil
 }
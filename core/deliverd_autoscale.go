@@ -0,0 +1,105 @@
+package core
+
+// deliverd workers autoscaling
+// The number of concurrent deliveries (nsq max in flight) is adjusted between
+// deliverd_autoscale_min and deliverd_max_in_flight according to the number
+// of messages waiting for delivery and to the deferral rate.
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitly/go-nsq"
+)
+
+// autoscaleStats counts deliveries & deferrals since last autoscale check
+var autoscaleStats struct {
+	attempts  int64
+	deferrals int64
+}
+
+// autoscaleAttempt must be called on each delivery attempt
+func autoscaleAttempt() {
+	atomic.AddInt64(&autoscaleStats.attempts, 1)
+}
+
+// autoscaleDeferral must be called on each deferred delivery
+func autoscaleDeferral() {
+	atomic.AddInt64(&autoscaleStats.deferrals, 1)
+}
+
+// autoscaleTarget returns the number of workers needed. Workers are halved
+// if deferral rate is over maxDeferralRate (remote servers are struggling,
+// more workers won't help) or if waiting messages are less than half of
+// workers. They are, at most, doubled if waiting messages exceed workers.
+func autoscaleTarget(current, min, max, waiting int, deferralRate, maxDeferralRate float64) (target int) {
+	target = current
+	switch {
+	case deferralRate > maxDeferralRate:
+		target = current / 2
+	case waiting > current:
+		target = current * 2
+		if waiting < target {
+			target = waiting
+		}
+	case waiting < current/2:
+		target = current / 2
+		if waiting > target {
+			target = waiting
+		}
+	}
+	if target < min {
+		target = min
+	}
+	if target > max {
+		target = max
+	}
+	return
+}
+
+// launchAutoscaler launches autoscaling loop for consumer
+func launchAutoscaler(consumer *nsq.Consumer) {
+	min := Cfg.GetDeliverdAutoscaleMin()
+	max := Cfg.GetDeliverdMaxInFlight()
+	interval := time.Duration(Cfg.GetDeliverdAutoscaleInterval()) * time.Second
+	cooldown := time.Duration(Cfg.GetDeliverdAutoscaleCooldown()) * time.Second
+	maxDeferralRate := float64(Cfg.GetDeliverdAutoscaleMaxDeferralRate()) / 100
+	if min < 1 {
+		min = 1
+	}
+	if min > max {
+		min = max
+	}
+
+	// start at min
+	current := min
+	consumer.ChangeMaxInFlight(current)
+	lastChange := time.Now()
+	Log.Info(fmt.Sprintf("deliverd autoscaler launched - workers: %d to %d", min, max))
+	for {
+		time.Sleep(interval)
+		attempts := atomic.SwapInt64(&autoscaleStats.attempts, 0)
+		deferrals := atomic.SwapInt64(&autoscaleStats.deferrals, 0)
+		if time.Since(lastChange) < cooldown {
+			continue
+		}
+		var waiting int
+		if err := DB.Model(QMessage{}).Where("status = ? AND next_delivery_scheduled_at <= ?", 2, time.Now()).Count(&waiting).Error; err != nil {
+			Log.Error("deliverd autoscaler - unable to count waiting messages - " + err.Error())
+			continue
+		}
+		deferralRate := 0.0
+		if attempts != 0 {
+			deferralRate = float64(deferrals) / float64(attempts)
+		}
+		target := autoscaleTarget(current, min, max, waiting, deferralRate, maxDeferralRate)
+		if target == current {
+			continue
+		}
+		Log.Info(fmt.Sprintf("deliverd autoscaler - workers %d -> %d (waiting messages: %d, deferral rate: %.0f%%)", current, target, waiting, deferralRate*100))
+		consumer.ChangeMaxInFlight(target)
+		current = target
+		lastChange = time.Now()
+	}
+}
@@ -1,18 +1,15 @@
 package core
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"path"
 	"runtime/debug"
-	"text/template"
+	"strings"
 	"time"
 
 	"github.com/bitly/go-nsq"
 	"github.com/jinzhu/gorm"
-	"github.com/toorop/tmail/message"
 )
 
 type delivery struct {
@@ -21,23 +18,33 @@ type delivery struct {
 	qMsg    *QMessage
 	rawData *[]byte
 	qStore  Storer
+	log     *Logger // carries delivery, message & smtpd session ids
+	// retry schedule of route used ("": none)
+	routeRetrySchedule string
+	// last SMTP reply code (0: none)
+	replyCode int
+	// notification sent on permanent failure ("": NotificationBounce)
+	notification string
+	// address of remote server ("": none, message trace)
+	remoteAddr string
 }
 
 // processMsg processes message
 func (d *delivery) processMsg() {
 	var err error
 	flagBounce := false
+	defer monitorGoroutineStart("deliverd")()
 
 	// Recover on panic
 	defer func() {
 		if err := recover(); err != nil {
-			Log.Error(fmt.Sprintf("deliverd %s : PANIC \r\n %s \r\n %s", d.id, err, debug.Stack()))
+			d.log.Error(fmt.Sprintf("deliverd %s : PANIC \r\n %s \r\n %s", d.id, err, debug.Stack()))
 		}
 	}()
 
 	// decode message from json
 	if err = json.Unmarshal([]byte(d.nsqMsg.Body), d.qMsg); err != nil {
-		Log.Error("deliverd: unable to parse nsq message - " + err.Error())
+		d.log.Error("deliverd: unable to parse nsq message - " + err.Error())
 		// TODO
 		// in this case :
 		// on expire le message de la queue par contre on ne
@@ -46,49 +53,105 @@ func (d *delivery) processMsg() {
 		// y a des problemes
 		return
 	}
+	publication := d.qMsg.Publication
 
 	// Get updated version of qMessage from db (check if exist)
 	if err = d.qMsg.UpdateFromDb(); err != nil {
 		// si on ne le trouve pas en DB il y a de forte chance pour que le message ait déja
 		// été traité
 		if err == gorm.RecordNotFound {
-			Log.Info(fmt.Sprintf("deliverd %s : queued message %s not in Db, already delivered, discarding", d.id, d.qMsg.Uuid))
-			d.discard()
+			d.log.Info(fmt.Sprintf("deliverd %s : queued message %s not in Db, already delivered, discarding", d.id, d.qMsg.Uuid))
+			d.finish()
 		} else {
-			Log.Error(fmt.Sprintf("deliverd %s : unable to get queued message  %s from Db - %s", d.id, d.qMsg.Uuid, err))
-			d.requeue()
+			// message is not claimed, state in DB is unchanged
+			d.log.Error(fmt.Sprintf("deliverd %s : unable to get queued message  %s from Db - %s", d.id, d.qMsg.Uuid, err))
+			d.nsqRequeue(time.Minute)
 		}
 		return
 	}
+	d.log = d.log.With("message", d.qMsg.Uuid, "session", d.qMsg.SessionId, "rcpt", d.qMsg.RcptTo)
+
+	// Stale copy ? (message has been published again: flushed, released...)
+	if publication != d.qMsg.Publication {
+		d.log.Info(fmt.Sprintf("deliverd %s : queued message %s has been published again, discarding stale copy", d.id, d.qMsg.Uuid))
+		d.nsqMsg.Finish()
+		return
+	}
 
 	// Already in delivery ?
 	if d.qMsg.Status == 0 {
+		// in cluster mode expired leases are released by heartbeats
+		if Cfg.GetClusterModeEnabled() {
+			d.log.Info(fmt.Sprintf("deliverd %s : queued message %s is leased by node %s until %s", d.id, d.qMsg.Uuid, d.qMsg.LeaseOwner, d.qMsg.LeaseExpiresAt.Format(time.RFC3339)))
+			return
+		}
 		// if lastupdate is too old, something fails, requeue message
 		if time.Since(d.qMsg.LastUpdate) > 3600*time.Second {
-			Log.Error(fmt.Sprintf("deliverd %s : queued message  %s is marked as being in delivery for more than one hour. I will try to requeue it.", d.id, d.qMsg.Uuid))
-			d.requeue(2)
+			d.log.Error(fmt.Sprintf("deliverd %s : queued message  %s is marked as being in delivery for more than one hour. I will try to requeue it.", d.id, d.qMsg.Uuid))
+			// lease of a previous process is not fenced
+			d.qMsg.Status = 2
+			if err := d.qMsg.SaveInDb(); err != nil {
+				d.log.Error(fmt.Sprintf("deliverd %s : unable to requeue queued message %s - %s", d.id, d.qMsg.Uuid, err))
+			}
+			d.nsqRequeue(time.Minute)
 			return
 		}
-		Log.Info(fmt.Sprintf("deliverd %s : queued message %s is marked as being in delivery by another process", d.id, d.qMsg.Uuid))
+		d.log.Info(fmt.Sprintf("deliverd %s : queued message %s is marked as being in delivery by another process", d.id, d.qMsg.Uuid))
 		return
 	}
 
 	// Discard ?
 	if d.qMsg.Status == 1 {
-		d.qMsg.Status = 0
-		d.qMsg.SaveInDb()
+		if !d.claim() {
+			return
+		}
 		d.discard()
 		return
 	}
 
+	// On hold ? (released messages are published again)
+	if d.qMsg.Status == 5 {
+		d.log.Info(fmt.Sprintf("deliverd %s : queued message %s is on hold", d.id, d.qMsg.Uuid))
+		d.nsqMsg.Finish()
+		return
+	}
+
+	// Waiting for scan (accept-then-scan), published again after scan
+	if d.qMsg.Status == 6 {
+		d.log.Info(fmt.Sprintf("deliverd %s : queued message %s is waiting for scan", d.id, d.qMsg.Uuid))
+		d.nsqMsg.Finish()
+		return
+	}
+
+	// Not scheduled yet (delay of retry schedule is over NSQ max requeue)
+	if d.qMsg.Status == 2 && d.qMsg.NextDeliveryScheduledAt.Sub(time.Now()) > time.Second {
+		d.nsqMsg.RequeueWithoutBackoff(retryRequeueDelay(d.qMsg.NextDeliveryScheduledAt.Sub(time.Now())))
+		return
+	}
+
 	// Bounce  ?
 	if d.qMsg.Status == 3 {
 		flagBounce = true
 	}
 
+	// Frozen ?
+	if !flagBounce && !d.qMsg.Thawed {
+		freeze, err := queueFrozenBy(d.qMsg)
+		if err != nil {
+			d.log.Error(fmt.Sprintf("deliverd %s : unable to check if queued message %s is frozen - %s", d.id, d.qMsg.Uuid, err))
+			d.nsqRequeue(time.Minute)
+			return
+		}
+		if freeze != nil {
+			d.freeze(freeze)
+			return
+		}
+	}
+
 	// update status to: delivery in progress
-	d.qMsg.Status = 0
-	d.qMsg.SaveInDb()
+	if !d.claim() {
+		return
+	}
 
 	// {"Id":7,"Key":"7f88b72858ae57c17b6f5e89c1579924615d7876","MailFrom":"toorop@toorop.fr",
 	// "RcptTo":"toorop@toorop.fr","Host":"toorop.fr","AddedAt":"2014-12-02T09:05:59.342268145+01:00",
@@ -102,22 +165,23 @@ func (d *delivery) processMsg() {
 		// TODO
 		// On va considerer que c'est une erreur temporaire
 		// il se peut que le store soit momentanément injoignable
-		Log.Error(fmt.Sprintf("deliverd %s : unable to get rawmail of queued message %s from store- %s", d.id, d.qMsg.Uuid, err))
+		d.log.Error(fmt.Sprintf("deliverd %s : unable to get rawmail of queued message %s from store- %s", d.id, d.qMsg.Uuid, err))
 		d.requeue()
 		return
 	}
 	//d.qStore = qStore
 	dataReader, err := d.qStore.Get(d.qMsg.Uuid)
 	if err != nil {
-		Log.Error("unable to retrieve raw mail from store. " + err.Error())
+		d.log.Error("unable to retrieve raw mail from store. " + err.Error())
 		d.dieTemp("unable to retrieve raw mail from store", false)
 		return
 	}
+	defer dataReader.Close()
 
 	// get rawData
 	t, err := ioutil.ReadAll(dataReader)
 	if err != nil {
-		Log.Error("unable to read raw mail from dataReader. " + err.Error())
+		d.log.Error("unable to read raw mail from dataReader. " + err.Error())
 		d.dieTemp("unable to read raw mail from dataReader", false)
 		return
 	}
@@ -125,17 +189,30 @@ func (d *delivery) processMsg() {
 
 	// Bounce  ?
 	if flagBounce {
+		if d.qMsg.BounceReason != "" {
+			d.bounce(d.qMsg.BounceReason)
+			return
+		}
 		d.bounce("bounced by admin")
 		return
 	}
 
+	// in-process hooks
+	if reply := hooksDelivery(d.qMsg, d.rawData); reply.Code != 0 {
+		d.log.Info(fmt.Sprintf("deliverd %s : delivery of queued message %s refused by hook - %d %s", d.id, d.qMsg.Uuid, reply.Code, reply.Msg))
+		d.handleSMTPError(reply.Code, fmt.Sprintf("%d %s", reply.Code, reply.Msg))
+		return
+	}
+
+	autoscaleAttempt()
+
 	//
 	// Local or  remote ?
 	//
 
 	local, err := isLocalDelivery(d.qMsg.RcptTo)
 	if err != nil {
-		Log.Error("unable to check if it's local delivery. " + err.Error())
+		d.log.Error("unable to check if it's local delivery. " + err.Error())
 		d.dieTemp("unable to check if it's local delivery", false)
 		return
 	}
@@ -148,19 +225,38 @@ func (d *delivery) processMsg() {
 }
 
 func (d *delivery) dieOk() {
-	Log.Info("deliverd " + d.id + ": success")
-	if err := d.qMsg.Delete(); err != nil {
-		Log.Error("deliverd " + d.id + ": unable remove queued message " + d.qMsg.Uuid + " from queue." + err.Error())
+	d.log.Info("deliverd " + d.id + ": success")
+	metricsDeliveryAttempt("success", d.replyCode)
+	clusterDelivery("success")
+	sendingDelivery(d.qMsg.AuthUser, false)
+	d.traceDelivery(d.qMsg, TraceDelivered, "")
+	d.digestDelivery(digestKindSent, "")
+	d.webhookDelivery(WebhookEventDelivered, "")
+	if err := d.qMsg.DeleteLeased(ClusterNodeId()); err != nil {
+		d.log.Error("deliverd " + d.id + ": unable remove queued message " + d.qMsg.Uuid + " from queue." + err.Error())
 	}
-	d.nsqMsg.Finish()
+	d.finish()
 }
 
 // dieTemp die when a 4** error occured
 func (d *delivery) dieTemp(msg string, logit bool) {
 	if logit {
-		Log.Info("deliverd " + d.id + ": temp failure - " + msg)
+		d.log.Info("deliverd " + d.id + ": temp failure - " + msg)
 	}
-	if time.Since(d.qMsg.AddedAt) < time.Duration(Cfg.GetDeliverdQueueLifetime())*time.Minute {
+	// lifetime of a message with a future release starts at its release
+	queuedAt := d.qMsg.AddedAt
+	if d.qMsg.SendAt.After(queuedAt) {
+		queuedAt = d.qMsg.SendAt
+	}
+	if time.Since(queuedAt) < d.queueLifetime() {
+		autoscaleDeferral()
+		d.qMsg.LastError = msg
+		metricsDeliveryAttempt("temp", d.replyCode)
+		clusterDelivery("temp")
+		d.traceDelivery(d.qMsg, TraceDeferred, msg)
+		d.digestDelivery(digestKindDeferred, msg)
+		d.webhookDelivery(WebhookEventDeferred, msg)
+		d.delayWarning(queuedAt, msg)
 		d.requeue()
 		return
 	}
@@ -168,11 +264,81 @@ func (d *delivery) dieTemp(msg string, logit bool) {
 	d.diePerm(msg, logit)
 }
 
+// delayWarning sends once a delay DSN to sender of message queued at
+// queuedAt (deliverd_delay_warning), msg is the last error. Each recipient
+// is a QMessage of the same uuid: the warning is claimed for all rows of the
+// uuid and lists every recipient still in queue, so the sender gets a
+// single DSN.
+func (d *delivery) delayWarning(queuedAt time.Time, msg string) {
+	warning := time.Duration(Cfg.GetDeliverdDelayWarning()) * time.Hour
+	if warning == 0 || d.qMsg.DelayWarned || time.Since(queuedAt) < warning || d.qMsg.MailFrom == "" || d.qMsg.MailFrom == "#@[]" {
+		return
+	}
+	if notificationDelayOptOut(d.qMsg.MailFrom) {
+		return
+	}
+	siblings := []QMessage{}
+	if err := DB.Where("uuid = ? AND delay_warned = ?", d.qMsg.Uuid, false).Order("id").Find(&siblings).Error; err != nil && err != gorm.RecordNotFound {
+		d.log.Error("deliverd " + d.id + ": unable to get recipients of message queued as " + d.qMsg.Uuid + " - " + err.Error())
+		return
+	}
+	r := DB.Model(QMessage{}).Where("uuid = ? AND delay_warned = ?", d.qMsg.Uuid, false).UpdateColumn("delay_warned", true)
+	if r.Error != nil {
+		d.log.Error("deliverd " + d.id + ": unable to claim delay warning of message queued as " + d.qMsg.Uuid + " - " + r.Error.Error())
+		return
+	}
+	d.qMsg.DelayWarned = true
+	// already sent by the delivery of another recipient
+	if r.RowsAffected == 0 {
+		return
+	}
+	raw := []byte{}
+	if d.rawData != nil {
+		raw = *d.rawData
+	}
+	data := notificationDataOf(d.qMsg, msg, raw)
+	data.GiveUpAt = queuedAt.Add(d.queueLifetime()).Format(Time822)
+	// last remote response
+	if d.replyCode != 0 {
+		data.DiagnosticCode = msg
+		data.Delayed[0].DiagnosticCode = msg
+	}
+	rcpts := []string{d.qMsg.RcptTo}
+	for i := range siblings {
+		sibling := &siblings[i]
+		if sibling.Id == d.qMsg.Id {
+			continue
+		}
+		errMsg := sibling.LastError
+		if errMsg == "" {
+			errMsg = "not delivered yet"
+		}
+		data.Delayed = append(data.Delayed, NotificationRcpt{Address: sibling.RcptTo, ErrMsg: errMsg, Status: rxNotificationStatus.FindString(errMsg)})
+		rcpts = append(rcpts, sibling.RcptTo)
+	}
+	id, err := notificationQueue(NotificationDelay, data)
+	if err != nil {
+		d.log.Error("deliverd " + d.id + ": unable to send delay warning of message queued as " + d.qMsg.Uuid + " - " + err.Error())
+		// next attempt of a recipient will try again
+		if err = DB.Model(QMessage{}).Where("uuid = ?", d.qMsg.Uuid).UpdateColumn("delay_warned", false).Error; err != nil {
+			d.log.Error("deliverd " + d.id + ": unable to reset delay warning of message queued as " + d.qMsg.Uuid + " - " + err.Error())
+		}
+		d.qMsg.DelayWarned = false
+		return
+	}
+	d.log.Info("deliverd " + d.id + ": message from: " + d.qMsg.MailFrom + " to: " + strings.Join(rcpts, ", ") + " is delayed, warning queued with id " + id)
+}
+
 // diePerm when a 5** error occured
 func (d *delivery) diePerm(msg string, logit bool) {
 	if logit {
-		Log.Info("deliverd " + d.id + ": perm failure - " + msg)
+		d.log.Info("deliverd " + d.id + ": perm failure - " + msg)
 	}
+	metricsDeliveryAttempt("perm", d.replyCode)
+	clusterDelivery("perm")
+	sendingDelivery(d.qMsg.AuthUser, true)
+	d.traceDelivery(d.qMsg, TraceBounced, msg)
+	d.digestDelivery(digestKindBounced, msg)
 	// bounce message
 	d.bounce(msg)
 	return
@@ -180,49 +346,49 @@ func (d *delivery) diePerm(msg string, logit bool) {
 
 // discard remove a message from queue
 func (d *delivery) discard() {
-	Log.Info("deliverd " + d.id + " discard message queued as " + d.qMsg.Uuid)
-	if err := d.qMsg.Delete(); err != nil {
-		Log.Error("deliverd " + d.id + ": unable remove message queued as " + d.qMsg.Uuid + " from queue. " + err.Error())
+	d.log.Info("deliverd " + d.id + " discard message queued as " + d.qMsg.Uuid)
+	d.traceDelivery(d.qMsg, TraceDiscarded, "")
+	if err := d.qMsg.DeleteLeased(ClusterNodeId()); err != nil {
+		d.log.Error("deliverd " + d.id + ": unable remove message queued as " + d.qMsg.Uuid + " from queue. " + err.Error())
 		d.requeue(1)
 	} else {
-		d.nsqMsg.Finish()
+		d.finish()
 	}
 	return
 }
 
 // bounce creates & enqueues a bounce message
 func (d *delivery) bounce(errMsg string) {
+	d.webhookDelivery(WebhookEventBounced, errMsg)
 	// If returnPath =="" -> double bounce -> discard
 	if d.qMsg.MailFrom == "" {
-		Log.Info("deliverd " + d.id + ": message from: " + d.qMsg.MailFrom + " to: " + d.qMsg.RcptTo + " double bounce: discarding")
-		if err := d.qMsg.Delete(); err != nil {
-			Log.Error("deliverd " + d.id + ": unable remove message queued as " + d.qMsg.Uuid + " from queue. " + err.Error())
+		d.log.Info("deliverd " + d.id + ": message from: " + d.qMsg.MailFrom + " to: " + d.qMsg.RcptTo + " double bounce: discarding")
+		if err := d.qMsg.DeleteLeased(ClusterNodeId()); err != nil {
+			d.log.Error("deliverd " + d.id + ": unable remove message queued as " + d.qMsg.Uuid + " from queue. " + err.Error())
 			d.requeue(1)
 		} else {
-			d.nsqMsg.Finish()
+			d.finish()
 		}
 		return
 	}
 
 	// triple bounce
 	if d.qMsg.MailFrom == "#@[]" {
-		Log.Info("deliverd " + d.id + ": message from: " + d.qMsg.MailFrom + " to: " + d.qMsg.RcptTo + " triple bounce: discarding")
-		if err := d.qMsg.Delete(); err != nil {
-			Log.Error("deliverd " + d.id + ": unable remove message " + d.qMsg.Uuid + " from queue. " + err.Error())
+		d.log.Info("deliverd " + d.id + ": message from: " + d.qMsg.MailFrom + " to: " + d.qMsg.RcptTo + " triple bounce: discarding")
+		if err := d.qMsg.DeleteLeased(ClusterNodeId()); err != nil {
+			d.log.Error("deliverd " + d.id + ": unable remove message " + d.qMsg.Uuid + " from queue. " + err.Error())
 			d.requeue(1)
 		} else {
-			d.nsqMsg.Finish()
+			d.finish()
 		}
 		return
 	}
 
-	type templateData struct {
-		Date        string
-		Me          string
-		RcptTo      string
-		OriRcptTo   string
-		ErrMsg      string
-		BouncedMail string
+	// keep a copy for redirection
+	if d.rawData != nil {
+		if err := bouncedKeep(d.qMsg, *d.rawData, errMsg); err != nil {
+			d.log.Error("deliverd " + d.id + ": unable to keep bounced message queued as " + d.qMsg.Uuid + " - " + err.Error())
+		}
 	}
 
 	// Si ça bounce car le mail a disparu de la queue:
@@ -231,60 +397,58 @@ func (d *delivery) bounce(errMsg string) {
 		d.rawData = &t
 	}
 
-	tData := templateData{time.Now().Format(Time822), Cfg.GetMe(), d.qMsg.MailFrom, d.qMsg.RcptTo, errMsg, string(*d.rawData)}
-	t, err := template.ParseFiles(path.Join(GetBasePath(), "tpl/bounce.tpl"))
-	if err != nil {
-		Log.Error("deliverd " + d.id + ": unable to bounce message queued as " + d.qMsg.Uuid + " " + err.Error())
-		d.requeue(3)
-		return
+	// bounce or over quota notification
+	kind := NotificationBounce
+	if d.notification != "" {
+		kind = d.notification
 	}
-
-	bouncedMailBuf := new(bytes.Buffer)
-	err = t.Execute(bouncedMailBuf, tData)
+	id, err := notificationQueue(kind, notificationDataOf(d.qMsg, errMsg, *d.rawData))
 	if err != nil {
-		Log.Error("deliverd " + d.id + ": unable to bounce message queued as " + d.qMsg.Uuid + " " + err.Error())
+		d.log.Error("deliverd " + d.id + ": unable to bounce message queued as " + d.qMsg.Uuid + " " + err.Error())
 		d.requeue(3)
 		return
 	}
-	b, err := ioutil.ReadAll(bouncedMailBuf)
-	if err != nil {
-		Log.Error("deliverd " + d.id + ": unable to bounce message queued as " + d.qMsg.Uuid + " " + err.Error())
-		d.requeue(3)
-		return
+
+	if err := d.qMsg.DeleteLeased(ClusterNodeId()); err != nil {
+		d.log.Error("deliverd " + d.id + ": unable remove bounced message queued as " + d.qMsg.Uuid + " from queue. " + err.Error())
+		d.requeue(1)
+	} else {
+		d.finish()
 	}
 
-	// unix2dos it
-	err = Unix2dos(&b)
-	if err != nil {
-		Log.Error("deliverd " + d.id + ": unable to convert bounce from unix to dos. " + err.Error())
-		d.requeue(3)
+	d.log.Info("deliverd " + d.id + ": message from: " + d.qMsg.MailFrom + " to: " + d.qMsg.RcptTo + " queued with id " + id + " for being bounced.")
+	return
+}
+
+// freeze marks message as frozen, it will be requeued when thawed
+func (d *delivery) freeze(freeze *QueueFreeze) {
+	d.log.Info(fmt.Sprintf("deliverd %s : queued message %s from %s to %s is frozen by freeze %d (%s %s)", d.id, d.qMsg.Uuid, d.qMsg.MailFrom, d.qMsg.RcptTo, freeze.Id, freeze.Scope, freeze.Value))
+	d.qMsg.Status = 4
+	if err := d.qMsg.SaveInDb(); err != nil {
+		d.log.Error(fmt.Sprintf("deliverd %s : unable to freeze queued message %s - %s", d.id, d.qMsg.Uuid, err))
+		d.nsqRequeue(time.Minute)
 		return
 	}
+	d.finish()
+}
 
-	// enqueue
-	envelope := message.Envelope{MailFrom: "", RcptTo: []string{d.qMsg.MailFrom}}
-	/*message, err := message.New(&b)
-	if err != nil {
-		Log.Error("deliverd " + d.id + ": unable to bounce message " + d.qMsg.Key + " " + err.Error())
-		d.requeue(3)
-		return
-	}*/
-	id, err := QueueAddMessage(&b, envelope, "")
+// claim marks message as being in delivery, it returns false if message
+// can't be delivered by this process (nsq message is handled)
+func (d *delivery) claim() bool {
+	claimed, err := d.qMsg.Claim()
 	if err != nil {
-		Log.Error("deliverd " + d.id + ": unable to bounce message queued as " + d.qMsg.Uuid + " " + err.Error())
-		d.requeue(3)
-		return
+		// status is unchanged in DB, qMsg must not be saved
+		d.log.Error(fmt.Sprintf("deliverd %s : unable to mark queued message %s as being in delivery - %s", d.id, d.qMsg.Uuid, err))
+		d.nsqMsg.RequeueWithoutBackoff(time.Minute)
+		return false
 	}
-
-	if err := d.qMsg.Delete(); err != nil {
-		Log.Error("deliverd " + d.id + ": unable remove bounced message queued as " + d.qMsg.Uuid + " from queue. " + err.Error())
-		d.requeue(1)
-	} else {
+	if !claimed {
+		// another process delivers it (nsq may deliver a message twice)
+		d.log.Info(fmt.Sprintf("deliverd %s : queued message %s is claimed by another process", d.id, d.qMsg.Uuid))
 		d.nsqMsg.Finish()
+		return false
 	}
-
-	Log.Info("deliverd " + d.id + ": message from: " + d.qMsg.MailFrom + " to: " + d.qMsg.RcptTo + " queued with id " + id + " for being bounced.")
-	return
+	return true
 }
 
 // requeue requeues the message increasing the delay
@@ -301,18 +465,55 @@ func (d *delivery) requeue(newStatus ...uint32) {
 	//if d.qMsg.Status == 1 || d.qMsg.Status == 3 {
 	//	return
 	//}
-	// Calcul du delais, pour le moment on accroit betement de 60 secondes a chaque tentative
-	delay := time.Duration(d.nsqMsg.Attempts*60) * time.Second
-	// Todo update next delivery en DB
+	// delay from retry schedule
+	delay := d.retryDelay()
+	d.qMsg.DeliveryFailedCount++
 	d.qMsg.NextDeliveryScheduledAt = time.Now().Add(delay)
 	d.qMsg.Status = status
-	d.qMsg.SaveInDb() // Todo: check error
-	d.nsqMsg.RequeueWithoutBackoff(delay)
+	if err := d.qMsg.SaveLeased(ClusterNodeId()); err != nil {
+		d.log.Error("deliverd " + d.id + ": unable to requeue message queued as " + d.qMsg.Uuid + " - " + err.Error())
+		// another node delivers it
+		if err == ErrLeaseLost {
+			d.finish()
+			return
+		}
+	}
+	d.nsqRequeue(retryRequeueDelay(delay))
 	return
 }
 
+// finish finishes nsq message of d
+func (d *delivery) finish() {
+	if d.nsqMsg != nil {
+		d.nsqMsg.Finish()
+	}
+}
+
+// nsqRequeue requeues nsq message of d for delay
+func (d *delivery) nsqRequeue(delay time.Duration) {
+	if d.nsqMsg != nil {
+		d.nsqMsg.RequeueWithoutBackoff(delay)
+	}
+}
+
+// member returns delivery of q, recipient added to the transaction of d.
+// It has no nsq message: the one of q is handled according to the state of
+// q when it's received (deleted, scheduled later...).
+func (d *delivery) member(q *QMessage) *delivery {
+	return &delivery{
+		id:                 d.id,
+		qMsg:               q,
+		rawData:            d.rawData,
+		qStore:             d.qStore,
+		log:                Log.With("subsystem", "deliverd", "delivery", d.id, "message", q.Uuid, "session", q.SessionId, "rcpt", q.RcptTo),
+		routeRetrySchedule: d.routeRetrySchedule,
+		remoteAddr:         d.remoteAddr,
+	}
+}
+
 // handleSmtpError handles SMTP error response
 func (d *delivery) handleSMTPError(code int, message string) {
+	d.replyCode = code
 	if code > 499 {
 		d.diePerm(message, false)
 		return
@@ -0,0 +1,60 @@
+package core
+
+// Forward of original client details (XCLIENT/XFORWARD) to remote hosts
+// of routes having the forward client option (internal MTAs trusting us).
+// Details are taken from the Received header added by smtpd.
+
+import (
+	"strings"
+
+	"github.com/toorop/tmail/message"
+)
+
+// forwardClientAttrs returns client attributes to forward, parsed from
+// Received header added by tmail smtpd:
+// Received: from IP (REVERSE) [(HELO)] [(authenticated as LOGIN)] by ...; tmail VERSION; UUID
+// ok is false if message has not been received by smtpd (eg bounces)
+func forwardClientAttrs(rawMessage *[]byte, queueId string) (attrs [][2]string, ok bool) {
+	received := message.RawGetHeaderValue(rawMessage, "received")
+	if !strings.Contains(received, "; tmail ") || !strings.HasPrefix(received, "from ") {
+		return nil, false
+	}
+	p := strings.Index(received, " by ")
+	if p == -1 {
+		return nil, false
+	}
+	from := strings.TrimSpace(received[5:p])
+	fields := strings.SplitN(from, " ", 2)
+	addr := fields[0]
+	name, helo, login := "[UNAVAILABLE]", "", ""
+	if len(fields) == 2 {
+		// (REVERSE) (HELO) (authenticated as LOGIN)
+		for i, c := range strings.Split(strings.Trim(fields[1], "()"), ") (") {
+			switch {
+			case i == 0:
+				if c != "no reverse" {
+					name = strings.TrimSuffix(c, ".")
+				}
+			case strings.HasPrefix(c, "authenticated as "):
+				login = strings.TrimPrefix(c, "authenticated as ")
+			case c == "submission", strings.HasPrefix(c, "dnsbl "):
+			default:
+				helo = c
+			}
+		}
+	}
+	proto := "SMTP"
+	if strings.Contains(received, " with ESMTP") {
+		proto = "ESMTP"
+	}
+
+	attrs = [][2]string{{"NAME", name}, {"ADDR", addr}, {"PROTO", proto}}
+	if helo != "" {
+		attrs = append(attrs, [2]string{"HELO", helo})
+	}
+	if login != "" {
+		attrs = append(attrs, [2]string{"LOGIN", login})
+	}
+	attrs = append(attrs, [2]string{"IDENT", queueId}, [2]string{"SOURCE", "REMOTE"})
+	return attrs, true
+}
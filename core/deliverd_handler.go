@@ -19,6 +19,7 @@ func (h *deliveryHandler) HandleMessage(m *nsq.Message) error {
 		m.RequeueWithoutBackoff(10 * time.Minute)
 	}
 
+	d.log = Log.With("subsystem", "deliverd", "delivery", d.id)
 	d.nsqMsg = m
 	d.qMsg = new(QMessage)
 	// disable autoresponse otherwise no goroutines
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os/exec"
+	"path"
 	"strconv"
 	"strings"
 	"syscall"
@@ -15,13 +16,33 @@ import (
 	"github.com/toorop/tmail/message"
 )
 
+// localActionDone returns true if local delivery action has been done by
+// a previous attempt
+func (d *delivery) localActionDone(action string) bool {
+	return IsStringInSlice(action, strings.Split(d.qMsg.LocalActions, "\n"))
+}
+
+// localActionRecord records local delivery action as done, it's not done
+// again if delivery is retried
+func (d *delivery) localActionRecord(action string) {
+	actions := action
+	if d.qMsg.LocalActions != "" {
+		actions = d.qMsg.LocalActions + "\n" + action
+	}
+	if err := DB.Model(QMessage{}).Where("id = ?", d.qMsg.Id).UpdateColumn("local_actions", actions).Error; err != nil {
+		d.log.Error(fmt.Sprintf("delivery-local %s: unable to record action %s: %s", d.id, action, err))
+		return
+	}
+	d.qMsg.LocalActions = actions
+}
+
 // deliverLocal handle local delivery
 func deliverLocal(d *delivery) {
 	var dataBuf *bytes.Buffer
 	mailboxAvailable := false
 	localRcpt := []string{}
 
-	Log.Info(fmt.Sprintf("delivery-local %s: starting new delivery from %s to %s - Message-Id: %s - Queue-Id: %s", d.id, d.qMsg.MailFrom, d.qMsg.RcptTo, d.qMsg.MessageId, d.qMsg.Uuid))
+	d.log.Info(fmt.Sprintf("delivery-local %s: starting new delivery from %s to %s - Message-Id: %s - Queue-Id: %s", d.id, d.qMsg.MailFrom, d.qMsg.RcptTo, d.qMsg.MessageId, d.qMsg.Uuid))
 	deliverTo := d.qMsg.RcptTo
 
 	// if it's not a local user checks for alias
@@ -37,6 +58,39 @@ func deliverLocal(d *delivery) {
 
 	// If there non mailbox for this RCPT
 	if !mailboxAvailable {
+		// group
+		group, err := MailGroupGet(d.qMsg.RcptTo)
+		if err != nil && err != gorm.RecordNotFound {
+			d.dieTemp(fmt.Sprintf("delivery-local %s: unable to check if %s is a group. %s", d.id, d.qMsg.RcptTo, err), true)
+			return
+		}
+		if err == nil {
+			deliverGroup(d, &group)
+			return
+		}
+
+		// virtual aliases (not expanded by smtpd if message is requeued or
+		// redirected)
+		rcpts, err := AliasExpand(d.qMsg.RcptTo)
+		if err != nil {
+			if _, ok := err.(*AliasLoopError); ok {
+				d.diePerm(fmt.Sprintf("delivery-local %s: %s", d.id, err), true)
+				return
+			}
+			d.dieTemp(fmt.Sprintf("delivery-local %s: unable to expand virtual aliases of %s. %s", d.id, d.qMsg.RcptTo, err), true)
+			return
+		}
+		if len(rcpts) != 1 || rcpts[0] != d.qMsg.RcptTo {
+			uuid, err := QueueAddMessage(d.rawData, message.Envelope{MailFrom: d.qMsg.MailFrom, RcptTo: rcpts}, "")
+			if err != nil {
+				d.dieTemp(fmt.Sprintf("delivery-local %s: unable to requeue aliased msg: %s", d.id, err), true)
+				return
+			}
+			d.log.Info(fmt.Sprintf("delivery-local %s: rcpt is a virtual alias, mail is requeue with ID %s for final rcpt: %s", d.id, uuid, strings.Join(rcpts, " ")))
+			d.dieOk()
+			return
+		}
+
 		localDom := strings.Split(d.qMsg.RcptTo, "@")
 		// first checks if it's an email alias ?
 		alias, err := AliasGet(d.qMsg.RcptTo)
@@ -105,7 +159,18 @@ func deliverLocal(d *delivery) {
 						return
 					}
 				}
-				Log.Info(fmt.Sprintf("delivery-local %s: cmd %s succeeded", d.id, alias.Pipe))
+				d.log.Info(fmt.Sprintf("delivery-local %s: cmd %s succeeded", d.id, alias.Pipe))
+			}
+
+			// minilist: group without owner
+			// rem: no minilist for domainAlias
+			if alias.IsMiniList && !alias.IsDomAlias && alias.DeliverTo != "" {
+				members := []MailGroupMember{}
+				for _, rcpt := range strings.Split(alias.DeliverTo, ";") {
+					members = append(members, MailGroupMember{Address: rcpt})
+				}
+				mailGroupRequeue(d, &MailGroup{Address: alias.Alias, Policy: GroupPolicyAnyone}, members)
+				return
 			}
 
 			// deliverTo
@@ -118,20 +183,22 @@ func deliverLocal(d *delivery) {
 					MailFrom: d.qMsg.MailFrom,
 					RcptTo:   localRcpt,
 				}
-				// rem: no minilist for domainAlias
-				if alias.IsMiniList && !alias.IsDomAlias {
-					enveloppe.MailFrom = alias.Alias
-				}
 				uuid, err := QueueAddMessage(d.rawData, enveloppe, "")
 				if err != nil {
 					d.dieTemp(fmt.Sprintf("delivery-local %s: unable to requeue aliased msg: %s", d.id, err), true)
 					return
 				}
-				Log.Info(fmt.Sprintf("delivery-local %s: rcpt is an alias, mail is requeue with ID %s for final rcpt: %s", d.id, uuid, strings.Join(localRcpt, " ")))
+				d.log.Info(fmt.Sprintf("delivery-local %s: rcpt is an alias, mail is requeue with ID %s for final rcpt: %s", d.id, uuid, strings.Join(localRcpt, " ")))
 			}
 			d.dieOk()
 			return
 		}
+		// role address (postmaster, abuse)
+		if roleAddressesIsRouted(d.qMsg.RcptTo) {
+			deliverRoleAddress(d)
+			return
+		}
+
 		// search for a catchall
 		user, err = UserGetCatchallForDomain(localDom[1])
 		if err != nil {
@@ -149,59 +216,179 @@ func deliverLocal(d *delivery) {
 	// Received
 	*d.rawData = append([]byte("Received: tmail deliverd local "+d.id+"; "+time.Now().Format(Time822)+"\r\n"), *d.rawData...)
 
+	// sieve script & vacation of user
+	folders := []string{""}
+	if user != nil && user.HaveMailbox {
+		var replied, stop bool
+		if folders, replied, stop = sieveDeliver(d, user); stop {
+			return
+		}
+		if !replied {
+			vacationDeliver(d, user)
+		}
+	}
+
+	// built-in Maildir ?
+	maildir := user != nil && user.HaveMailbox && user.MailboxDriver == MailboxDriverMaildir
+
+	// LMTP
+	if lmtpURI := Cfg.GetDovecotLmtp(); lmtpURI != "" && !maildir {
+		if len(folders) != 1 || folders[0] != "" {
+			d.log.Info(fmt.Sprintf("delivery-local %s: sieve folders %s are not supported by LMTP, message is delivered to INBOX", d.id, strings.Join(folders, ", ")))
+		}
+		deliverLocalLmtp(d, lmtpURI, deliverTo)
+		return
+	}
+
 	// Delivered-To
 	*d.rawData = append([]byte("Delivered-To: "+deliverTo+"\r\n"), *d.rawData...)
 
 	// Return path
 	*d.rawData = append([]byte("Return-Path: "+d.qMsg.MailFrom+"\r\n"), *d.rawData...)
 
-	dataBuf = bytes.NewBuffer(*d.rawData)
+	if maildir {
+		deliverLocalMaildir(d, user, folders)
+		return
+	}
+
+	for _, folder := range folders {
+		if d.localActionDone("folder " + folder) {
+			continue
+		}
+		dataBuf = bytes.NewBuffer(*d.rawData)
+
+		args := []string{"-d", deliverTo}
+		if folder != "" {
+			args = append(args, "-m", folder)
+		}
+		cmd := exec.Command(Cfg.GetDovecotLda(), args...)
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			d.dieTemp(fmt.Sprintf("delivery-local %s: unable to create pipe to dovecot-lda stdin: %s", d.id, err), true)
+			return
+		}
+
+		if err := cmd.Start(); err != nil {
+			d.dieTemp(fmt.Sprintf("delivery-local %s: unable to run dovecot-lda: %s", d.id, err), true)
+			return
+		}
+
+		_, err = io.Copy(stdin, dataBuf)
+		if err != nil {
+			d.dieTemp(fmt.Sprintf("delivery-local %s: unable to pipe mail to dovecot-lda: %s", d.id, err), true)
+			return
+		}
+		stdin.Close()
 
-	cmd := exec.Command(Cfg.GetDovecotLda(), "-d", deliverTo)
-	stdin, err := cmd.StdinPipe()
+		if err := cmd.Wait(); err != nil {
+			t := strings.Split(err.Error(), " ")
+			if len(t) != 3 {
+				d.dieTemp(fmt.Sprintf("delivery-local %s: unexpected response from dovecot-lda: %s", d.id, err), true)
+				return
+			}
+			errCode, err := strconv.ParseUint(t[2], 10, 64)
+			if err != nil {
+				d.dieTemp(fmt.Sprintf("delivery-local %s: unable to parse response from dovecot-lda: %s", d.id, err), true)
+				return
+			}
+			switch errCode {
+			case 64:
+				d.dieTemp(fmt.Sprintf("delivery-local %s: dovecot-lda return: 64 - Invalid parameter given", d.id), true)
+			case 67:
+				d.diePerm(fmt.Sprintf("delivery-local %s: the destination user %s was not found", d.id, deliverTo), true)
+			case 77:
+				d.notification = NotificationOverQuota
+				d.diePerm(fmt.Sprintf("delivery-local %s: the destination user %s is over quota", d.id, deliverTo), true)
+			case 75:
+				d.dieTemp(fmt.Sprintf("delivery-local %s: dovecot temporary failure. Checks dovecot log for more info", d.id), true)
+			default:
+				d.dieTemp(fmt.Sprintf("delivery-local %s: unexpected response code recieved from dovecot-lda: %d", d.id, errCode), true)
+			}
+			return
+		}
+		if folder == "" {
+			d.log.Info(fmt.Sprintf("delivery-local %s: delivered to %s", d.id, deliverTo))
+		} else {
+			d.log.Info(fmt.Sprintf("delivery-local %s: delivered to %s in folder %s", d.id, deliverTo, folder))
+		}
+		d.localActionRecord("folder " + folder)
+	}
+
+	d.dieOk()
+}
+
+// deliverLocalLmtp delivers message to local mailstore via LMTP
+// Return-Path and Delivered-To headers are added by LMTP server
+func deliverLocalLmtp(d *delivery, lmtpURI, deliverTo string) {
+	client, err := newLMTPClient(lmtpURI)
 	if err != nil {
-		d.dieTemp(fmt.Sprintf("delivery-local %s: unable to create pipe to dovecot-lda stdin: %s", d.id, err), true)
+		d.dieTemp(fmt.Sprintf("delivery-local %s: unable to connect to LMTP server %s: %s", d.id, lmtpURI, err), true)
 		return
 	}
+	defer client.close()
 
-	if err := cmd.Start(); err != nil {
-		d.dieTemp(fmt.Sprintf("delivery-local %s: unable to run dovecot-lda: %s", d.id, err), true)
+	code, msg, err := client.Hello()
+	if err != nil {
+		d.handleSMTPError(code, fmt.Sprintf("delivery-local %s: LHLO failed - %d - %s - %s", d.id, code, msg, err))
 		return
 	}
-
-	_, err = io.Copy(stdin, dataBuf)
+	code, msg, err = client.Mail(d.qMsg.MailFrom)
 	if err != nil {
-		d.dieTemp(fmt.Sprintf("delivery-local %s: unable to pipe mail to dovecot-lda: %s", d.id, err), true)
+		d.handleSMTPError(code, fmt.Sprintf("delivery-local %s: LMTP MAIL FROM %s failed - %d - %s - %s", d.id, d.qMsg.MailFrom, code, msg, err))
+		return
+	}
+	code, msg, err = client.Rcpt(deliverTo)
+	if err != nil {
+		d.handleSMTPError(code, fmt.Sprintf("delivery-local %s: LMTP RCPT TO %s failed - %d - %s - %s", d.id, deliverTo, code, msg, err))
+		return
+	}
+	replies, code, msg, err := client.LmtpData(*d.rawData, 1)
+	if err != nil {
+		message := fmt.Sprintf("delivery-local %s: LMTP DATA failed - %d - %s - %s", d.id, code, msg, err)
+		if code == 0 {
+			d.dieTemp(message, true)
+		} else {
+			d.handleSMTPError(code, message)
+		}
 		return
 	}
-	stdin.Close()
+	if replies[0].Err != nil {
+		d.handleSMTPError(replies[0].Code, fmt.Sprintf("delivery-local %s: LMTP delivery to %s failed - %d - %s", d.id, deliverTo, replies[0].Code, replies[0].Msg))
+		return
+	}
+	client.Quit()
+	d.log.Info(fmt.Sprintf("delivery-local %s: delivered to %s via LMTP", d.id, deliverTo))
+	d.dieOk()
+}
 
-	if err := cmd.Wait(); err != nil {
-		t := strings.Split(err.Error(), " ")
-		if len(t) != 3 {
-			d.dieTemp(fmt.Sprintf("delivery-local %s: unexpected response from dovecot-lda: %s", d.id, err), true)
+// deliverLocalMaildir delivers message in folders ("" for inbox) of user
+// Maildir (home/Maildir)
+func deliverLocalMaildir(d *delivery, user *User, folders []string) {
+	quota, err := ParseSize(user.MailboxQuota)
+	if err != nil {
+		d.dieTemp(fmt.Sprintf("delivery-local %s: unable to parse mailbox quota of %s: %s", d.id, user.Login, err), true)
+		return
+	}
+	for _, folder := range folders {
+		if d.localActionDone("folder " + folder) {
+			continue
+		}
+		err = maildirFolderDeliver(path.Join(user.Home, "Maildir"), folder, *d.rawData, quota)
+		if err == ErrMaildirOverQuota {
+			d.notification = NotificationOverQuota
+			d.diePerm(fmt.Sprintf("delivery-local %s: the destination user %s is over quota", d.id, user.Login), true)
 			return
 		}
-		errCode, err := strconv.ParseUint(t[2], 10, 64)
 		if err != nil {
-			d.dieTemp(fmt.Sprintf("delivery-local %s: unable to parse response from dovecot-lda: %s", d.id, err), true)
+			d.dieTemp(fmt.Sprintf("delivery-local %s: unable to deliver to Maildir of %s: %s", d.id, user.Login, err), true)
 			return
 		}
-		switch errCode {
-		case 64:
-			d.dieTemp(fmt.Sprintf("delivery-local %s: dovecot-lda return: 64 - Invalid parameter given", d.id), true)
-		case 67:
-			d.diePerm(fmt.Sprintf("delivery-local %s: the destination user %s was not found", d.id, deliverTo), true)
-		case 77:
-			d.diePerm(fmt.Sprintf("delivery-local %s: the destination user %s is over quota", d.id, deliverTo), true)
-		case 75:
-			d.dieTemp(fmt.Sprintf("delivery-local %s: dovecot temporary failure. Checks dovecot log for more info", d.id), true)
-		default:
-			d.dieTemp(fmt.Sprintf("delivery-local %s: unexpected response code recieved from dovecot-lda: %d", d.id, errCode), true)
+		if folder == "" {
+			d.log.Info(fmt.Sprintf("delivery-local %s: delivered to %s (Maildir)", d.id, user.Login))
+		} else {
+			d.log.Info(fmt.Sprintf("delivery-local %s: delivered to %s in folder %s (Maildir)", d.id, user.Login, folder))
 		}
-		return
+		d.localActionRecord("folder " + folder)
 	}
-	Log.Info(fmt.Sprintf("delivery-local %s: delivered to %s", d.id, deliverTo))
-
 	d.dieOk()
 }
@@ -0,0 +1,205 @@
+package core
+
+// Delivery policies: outbound rate shaping per destination domain
+// Policies are stored in DB (domain "*" is the default policy) and reloaded
+// by deliverd every deliveryPolicyRefresh. Limits are enforced by each
+// deliverd process, messages over them are deferred.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// delay between reloads of policies
+	deliveryPolicyRefresh = 30 * time.Second
+	// delay of messages deferred because max connections is reached
+	deliveryPolicyConnsDelay = 30 * time.Second
+	// first backoff delay & max backoff delay
+	deliveryBackoffBase = 60 * time.Second
+	deliveryBackoffMax  = time.Hour
+)
+
+// DeliveryPolicy represents delivery limits for a destination domain
+// 0 means unlimited (no backoff for BackoffMultiplier)
+type DeliveryPolicy struct {
+	Id                int64
+	Domain            string  `sql:"unique"`
+	MaxConns          int     // concurrent connections
+	MaxMsgsPerConn    int     // messages per connection (connections are reused if > 1)
+	MsgsPerMinute     int     // messages per minute
+	BackoffMultiplier float64 // deliveries are suspended on 421 & 4xx greeting, the delay is multiplied on each new one
+	RetrySchedule     string  // overrides retry schedule of messages to this domain ("": no override)
+}
+
+// deliveryBackoff represents a suspension of deliveries to a domain
+type deliveryBackoff struct {
+	level int
+	until time.Time
+}
+
+var deliveryPolicies = struct {
+	sync.Mutex
+	policies map[string]DeliveryPolicy
+	loadedAt time.Time
+}{}
+
+var deliveryShaping = struct {
+	sync.Mutex
+	conns    map[string]int
+	sent     map[string][]time.Time
+	backoffs map[string]*deliveryBackoff
+}{
+	conns:    make(map[string]int),
+	sent:     make(map[string][]time.Time),
+	backoffs: make(map[string]*deliveryBackoff),
+}
+
+// deliveryPolicyOf returns policy for destination domain host
+func deliveryPolicyOf(host string) DeliveryPolicy {
+	deliveryPolicies.Lock()
+	defer deliveryPolicies.Unlock()
+	if time.Since(deliveryPolicies.loadedAt) > deliveryPolicyRefresh {
+		policies, err := DeliveryPolicyList()
+		if err != nil {
+			Log.Error("deliverd - unable to load delivery policies - " + err.Error())
+		} else {
+			deliveryPolicies.policies = make(map[string]DeliveryPolicy)
+			for _, p := range policies {
+				deliveryPolicies.policies[p.Domain] = p
+			}
+		}
+		deliveryPolicies.loadedAt = time.Now()
+	}
+	if p, ok := deliveryPolicies.policies[strings.ToLower(host)]; ok {
+		return p
+	}
+	return deliveryPolicies.policies["*"]
+}
+
+// deliveryShape reserves a connection to host according to policy p, reuse
+// is true if the delivery reuses an idle connection: idle connections are
+// already counted in the max connections of p
+// if limits are reached release is nil and delivery must be deferred for
+// delay.
+func deliveryShape(p DeliveryPolicy, host string, reuse bool) (release func(), delay time.Duration, reason string) {
+	host = strings.ToLower(host)
+	now := time.Now()
+	deliveryShaping.Lock()
+	defer deliveryShaping.Unlock()
+	if b, ok := deliveryShaping.backoffs[host]; ok && now.Before(b.until) {
+		return nil, b.until.Sub(now), fmt.Sprintf("deliveries are suspended until %v", b.until.Format(time.RFC3339))
+	}
+	if p.MaxConns > 0 && !reuse && deliveryShaping.conns[host]+remotePoolIdle(host) >= p.MaxConns {
+		return nil, deliveryPolicyConnsDelay, fmt.Sprintf("max connections reached (%d)", p.MaxConns)
+	}
+	if p.MsgsPerMinute > 0 {
+		sent := deliveryShaping.sent[host]
+		for len(sent) != 0 && now.Sub(sent[0]) > time.Minute {
+			sent = sent[1:]
+		}
+		deliveryShaping.sent[host] = sent
+		if len(sent) >= p.MsgsPerMinute {
+			return nil, sent[0].Add(time.Minute).Sub(now), fmt.Sprintf("max messages per minute reached (%d)", p.MsgsPerMinute)
+		}
+		deliveryShaping.sent[host] = append(sent, now)
+	}
+	deliveryShaping.conns[host]++
+	return func() {
+		deliveryShaping.Lock()
+		defer deliveryShaping.Unlock()
+		if deliveryShaping.conns[host]--; deliveryShaping.conns[host] < 1 {
+			delete(deliveryShaping.conns, host)
+		}
+	}, 0, ""
+}
+
+// deliveryBackoffIncr suspends deliveries to host, it returns the delay of
+// suspension (0 if policy has no backoff)
+func deliveryBackoffIncr(p DeliveryPolicy, host string) time.Duration {
+	if p.BackoffMultiplier <= 0 {
+		return 0
+	}
+	host = strings.ToLower(host)
+	deliveryShaping.Lock()
+	defer deliveryShaping.Unlock()
+	b, ok := deliveryShaping.backoffs[host]
+	if !ok {
+		b = &deliveryBackoff{}
+		deliveryShaping.backoffs[host] = b
+	}
+	delay := time.Duration(float64(deliveryBackoffBase) * math.Pow(p.BackoffMultiplier, float64(b.level)))
+	if delay > deliveryBackoffMax {
+		delay = deliveryBackoffMax
+	}
+	b.level++
+	b.until = time.Now().Add(delay)
+	return delay
+}
+
+// deliveryBackoffReset ends backoff of host
+func deliveryBackoffReset(host string) {
+	deliveryShaping.Lock()
+	defer deliveryShaping.Unlock()
+	delete(deliveryShaping.backoffs, strings.ToLower(host))
+}
+
+// shapingDefer requeues message for delay, delivery has not been attempted
+func (d *delivery) shapingDefer(delay time.Duration, reason string) {
+	Log.Info(fmt.Sprintf("deliverd-remote %s: delivery to %s deferred for %v by delivery policy - %s", d.id, d.qMsg.Host, delay, reason))
+	d.qMsg.NextDeliveryScheduledAt = time.Now().Add(delay)
+	d.qMsg.Status = 2
+	if err := d.qMsg.SaveLeased(ClusterNodeId()); err != nil {
+		Log.Error(fmt.Sprintf("deliverd-remote %s: unable to save queued message %s - %s", d.id, d.qMsg.Uuid, err))
+	}
+	d.nsqRequeue(delay)
+}
+
+// remoteBackoff suspends deliveries to destination of d according to
+// policy p
+func (d *delivery) remoteBackoff(p DeliveryPolicy, code int) {
+	if delay := deliveryBackoffIncr(p, d.qMsg.Host); delay != 0 {
+		Log.Info(fmt.Sprintf("deliverd-remote %s: remote server replied %d, deliveries to %s are suspended for %v", d.id, code, d.qMsg.Host, delay))
+	}
+}
+
+// DeliveryPolicySet adds or updates policy of destination domain
+func DeliveryPolicySet(domain string, maxConns, maxMsgsPerConn, msgsPerMinute int, backoffMultiplier float64, retrySchedule string) error {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if domain == "" {
+		return errors.New("domain is empty")
+	}
+	if maxConns < 0 || maxMsgsPerConn < 0 || msgsPerMinute < 0 || backoffMultiplier < 0 {
+		return errors.New("limits must be positive")
+	}
+	retrySchedule = strings.TrimSpace(retrySchedule)
+	if retrySchedule != "" {
+		if _, err := parseRetrySchedule(retrySchedule); err != nil {
+			return err
+		}
+	}
+	p := DeliveryPolicy{}
+	if err := DB.Where("domain = ?", domain).First(&p).Error; err != nil && err != gorm.RecordNotFound {
+		return err
+	}
+	p.Domain, p.MaxConns, p.MaxMsgsPerConn, p.MsgsPerMinute, p.BackoffMultiplier, p.RetrySchedule = domain, maxConns, maxMsgsPerConn, msgsPerMinute, backoffMultiplier, retrySchedule
+	return DB.Save(&p).Error
+}
+
+// DeliveryPolicyDel removes policy of destination domain
+func DeliveryPolicyDel(domain string) error {
+	return DB.Where("domain = ?", strings.ToLower(strings.TrimSpace(domain))).Delete(DeliveryPolicy{}).Error
+}
+
+// DeliveryPolicyList returns delivery policies
+func DeliveryPolicyList() (policies []DeliveryPolicy, err error) {
+	policies = []DeliveryPolicy{}
+	err = DB.Order("domain asc").Find(&policies).Error
+	return
+}
@@ -0,0 +1,62 @@
+package core
+
+// Pool of remote SMTP connections
+// When delivery policy of a destination allows several messages per
+// connection, connections are kept open after a delivery and reused (after
+// a RSET) by next deliveries to the same destination through the same
+// routes. Idle connections count in the max connections of the policy.
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/toorop/tmail/smtpx"
+)
+
+// idle connections are closed after this delay
+const remotePoolIdleTimeout = 30 * time.Second
+
+var remotePool = smtpx.NewPool(remotePoolIdleTimeout)
+
+// remotePoolKey returns key of connections to host through routes
+func remotePoolKey(host string, routes *[]Route) string {
+	key := host
+	for _, r := range *routes {
+		key += fmt.Sprintf("|%d", r.Id)
+	}
+	return key
+}
+
+// remotePoolGet returns an idle connection of key through routes and the
+// number of messages it has delivered (nil if there is none)
+func remotePoolGet(key string, routes *[]Route) (*smtpClient, int) {
+	c, msgs := remotePool.Get(context.Background(), key)
+	if c == nil {
+		return nil, 0
+	}
+	return wrapSMTPClient(c, routes), msgs
+}
+
+// remotePoolIdle returns the number of idle connections to host (all routes)
+func remotePoolIdle(host string) int {
+	return remotePool.Idle(func(key string) bool {
+		return key == host || strings.HasPrefix(key, host+"|")
+	})
+}
+
+// remotePoolPut keeps client open for next deliveries of key, at most max
+// connections are kept
+// it returns false if client has not been kept
+func remotePoolPut(key string, client *smtpClient, msgs, max int) bool {
+	return remotePool.Put(key, client.Client, msgs, max)
+}
+
+// launchRemotePoolJanitor closes idle connections
+func launchRemotePoolJanitor() {
+	for {
+		time.Sleep(remotePoolIdleTimeout / 2)
+		remotePool.CloseIdle(context.Background())
+	}
+}
@@ -2,51 +2,344 @@ package core
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
+	"net/textproto"
 	"strings"
 	"time"
-
-	"github.com/toorop/go-dkim"
 )
 
 func deliverRemote(d *delivery) {
-	Log.Info(fmt.Sprintf("delivery-remote %s: starting new delivery from %s to %s - Message-Id: %s - Queue-Id: %s", d.id, d.qMsg.MailFrom, d.qMsg.RcptTo, d.qMsg.MessageId, d.qMsg.Uuid))
+	d.log.Info(fmt.Sprintf("delivery-remote %s: starting new delivery from %s to %s - Message-Id: %s - Queue-Id: %s", d.id, d.qMsg.MailFrom, d.qMsg.RcptTo, d.qMsg.MessageId, d.qMsg.Uuid))
 
 	// gatling tests
-	//Log.Info(fmt.Sprintf("deliverd-remote %s: done for gatling test", d.id))
+	//d.log.Info(fmt.Sprintf("deliverd-remote %s: done for gatling test", d.id))
 	//d.dieOk()
 	//return
 
 	// Get routes
 	routes, err := getRoutes(d.qMsg.MailFrom, d.qMsg.Host, d.qMsg.AuthUser)
-	Log.Debug("deliverd-remote: ", routes, err)
+	d.log.Debug("deliverd-remote: ", routes, err)
 	if err != nil {
 		d.dieTemp("unable to get route to host "+d.qMsg.Host+". "+err.Error(), true)
 		return
 	}
+	// recipients of the message with the same destination are added to
+	// the transaction
+	d.qMsg.Destination = routesDestination(routes)
+	if err = routesDestinationsResolve(d.qMsg); err != nil {
+		d.log.Error(fmt.Sprintf("deliverd-remote %s - unable to resolve destinations of recipients of queued message %s - %s", d.id, d.qMsg.Uuid, err))
+	}
+
+	// Routes with open circuit breaker
+	routes, err = routeHealthFilter(d.qMsg.Host, routes)
+	if err != nil {
+		d.dieTemp(err.Error(), true)
+		return
+	}
+
+	// Retry schedule of route
+	for _, r := range *routes {
+		if r.RetrySchedule.Valid && r.RetrySchedule.String != "" {
+			d.routeRetrySchedule = r.RetrySchedule.String
+			break
+		}
+	}
+
+	// BATV: sender is tagged
+	mailFrom, err := batvSign(d.qMsg.MailFrom)
+	if err != nil {
+		d.dieTemp("unable to tag sender "+d.qMsg.MailFrom+". "+err.Error(), true)
+		return
+	}
+
+	// Get client: idle connection from pool or new one, delivery policy of
+	// destination
+	startedAt := time.Now()
+	policy := deliveryPolicyOf(d.qMsg.Host)
+	var client *smtpClient
+	poolKey := remotePoolKey(d.qMsg.Host, routes)
+	poolMsgs := 0
+	if policy.MaxMsgsPerConn > 1 {
+		client, poolMsgs = remotePoolGet(poolKey, routes)
+	}
+	release, delay, reason := deliveryShape(policy, d.qMsg.Host, client != nil)
+	if release == nil {
+		if client != nil && !remotePoolPut(poolKey, client, poolMsgs, policy.MaxConns) {
+			client.close()
+		}
+		d.shapingDefer(delay, reason)
+		return
+	}
+	defer release()
+	if client != nil {
+		d.log.Info(fmt.Sprintf("deliverd-remote %s - %s - reusing connection (%d messages already delivered)", d.id, client.RemoteAddr(), poolMsgs))
+	} else {
+		client, err = newSMTPClient(routes)
+		if err != nil {
+			if tpErr, ok := err.(*textproto.Error); ok && tpErr.Code > 399 && tpErr.Code < 500 {
+				d.remoteBackoff(policy, tpErr.Code)
+			}
+			d.log.Error(fmt.Sprintf("deliverd-remote %s - unable to get SMTP client. %v", d.id, err.Error()))
+			d.dieTemp("unable to get client", false)
+			return
+		}
+		if client = remoteSession(d, policy, routes, client); client == nil {
+			return
+		}
+	}
+	// parked connections are kept open
+	parked := false
+	d.remoteAddr = client.RemoteAddr()
+	defer func() {
+		if !parked {
+			client.close()
+		}
+	}()
+
+	// MAIL FROM
+	code, msg, err := client.Mail(mailFrom, d.passthroughParams(client, d.qMsg.MailParams)...)
+	if err != nil {
+		message := fmt.Sprintf("deliverd-remote %s - %s - MAIL FROM %s failed %s - %s", d.id, client.RemoteAddr(), d.qMsg.MailFrom, msg, err)
+		d.log.Error(message)
+		d.remoteSMTPError(policy, code, message)
+		return
+	}
+
+	// RCPT TO
+	code, msg, err = client.Rcpt(d.qMsg.RcptTo, d.passthroughParams(client, d.qMsg.RcptParams)...)
+	if err != nil {
+		message := fmt.Sprintf("deliverd-remote %s - %s - RCPT TO %s failed - %s - %s", d.id, client.RemoteAddr(), d.qMsg.RcptTo, msg, err)
+		d.log.Error(message)
+		d.remoteSMTPError(policy, code, message)
+		return
+	}
+
+	// Batch: others recipients of the same message reached through the same
+	// routes, each one is delivered, deferred or bounced on its own
+	var batch []*QMessage
+	limits := client.Limits()
+	max := Cfg.GetDeliverdRemoteBatchMaxRcpt()
+	if limits.RcptMax != 0 && max > limits.RcptMax {
+		// RCPTMAX announced by remote host (LIMITS)
+		max = limits.RcptMax
+	}
+	if max > 1 {
+		var filter func(*QMessage) bool
+		if limits.RcptDomainMax != 0 {
+			// RCPTDOMAINMAX announced by remote host (LIMITS)
+			domains := map[string]bool{strings.ToLower(d.qMsg.Host): true}
+			filter = func(q *QMessage) bool {
+				host := strings.ToLower(q.Host)
+				if !domains[host] && len(domains) >= limits.RcptDomainMax {
+					return false
+				}
+				domains[host] = true
+				return true
+			}
+		}
+		claimed, err := d.qMsg.ClaimBatch(max-1, filter)
+		if err != nil {
+			d.log.Error(fmt.Sprintf("deliverd-remote %s - unable to claim batch for queued message %s - %s", d.id, d.qMsg.Uuid, err))
+		}
+		for _, q := range claimed {
+			q.Destination = d.qMsg.Destination
+			if reply := hooksDelivery(q, d.rawData); reply.Code != 0 {
+				d.log.Info(fmt.Sprintf("deliverd-remote %s - delivery of batched recipient %s refused by hook - %d %s", d.id, q.RcptTo, reply.Code, reply.Msg))
+				d.member(q).handleSMTPError(reply.Code, fmt.Sprintf("%d %s", reply.Code, reply.Msg))
+				continue
+			}
+			code, msg, err = client.Rcpt(q.RcptTo, d.passthroughParams(client, q.RcptParams)...)
+			if err != nil {
+				message := fmt.Sprintf("deliverd-remote %s - %s - batch RCPT TO %s failed - %d - %s - %s", d.id, client.RemoteAddr(), q.RcptTo, code, msg, err)
+				d.log.Info(message)
+				d.batchFailed(q, code, message)
+				continue
+			}
+			batch = append(batch, q)
+		}
+		if len(batch) != 0 {
+			d.log.Info(fmt.Sprintf("deliverd-remote %s - %s - %d recipients added to transaction", d.id, client.RemoteAddr(), len(batch)))
+		}
+	}
+	// if transaction fails, batched recipients get the same reply (or are
+	// released if there is no reply)
+	batchDone := false
+	failCode, failMessage := 0, ""
+	fail := func(code int, message string) {
+		failCode, failMessage = code, message
+		d.remoteSMTPError(policy, code, message)
+	}
+	batchDelivered := func() {
+		batchDone = true
+		for _, q := range batch {
+			d.log.Info(fmt.Sprintf("deliverd-remote %s: success for batched recipient %s", d.id, q.RcptTo))
+			d.traceDelivery(q, TraceDelivered, "batched with "+d.qMsg.RcptTo)
+			if err := q.DeleteLeased(ClusterNodeId()); err != nil {
+				d.log.Error(fmt.Sprintf("deliverd-remote %s: unable remove batched message %d from queue - %s", d.id, q.Id, err))
+			}
+		}
+	}
+	defer func() {
+		if batchDone {
+			return
+		}
+		for _, q := range batch {
+			d.batchFailed(q, failCode, failMessage)
+		}
+	}()
+
+	// add Received headers
+	*d.rawData = append([]byte("Received: tmail deliverd remote "+d.id+"; "+time.Now().Format(Time822)+"\r\n"), *d.rawData...)
 
-	// Get client
-	client, err := newSMTPClient(routes)
+	// ARC
+	instance, err := arcSeal(d.rawData, d.qMsg.AuthResults)
 	if err != nil {
-		Log.Error(fmt.Sprintf("deliverd-remote %s - unable to get SMTP client. %v", d.id, err.Error()))
-		d.dieTemp("unable to get client", false)
+		message := "deliverd-remote " + d.id + " - ARC sealing failed - " + err.Error()
+		d.log.Error(message)
+		d.dieTemp(message, false)
 		return
 	}
-	defer client.close()
+	if instance != 0 {
+		d.log.Debug(fmt.Sprintf("deliverd-remote %s: message ARC sealed (i=%d)", d.id, instance))
+	}
+
+	// DKIM ?
+	if Cfg.GetDeliverdDkimSign() {
+		domain, err := dkimSign(d.rawData, d.qMsg.MailFrom)
+		if err != nil {
+			message := "deliverd-remote " + d.id + " - DKIM signing failed - " + err.Error()
+			d.log.Error(message)
+			d.dieTemp(message, false)
+			return
+		}
+		if domain != "" {
+			d.log.Debug(fmt.Sprintf("deliverd-remote %s: message signed with dkim for domain %s", d.id, domain))
+		}
+	}
+
+	// LMTP: one reply per recipient
+	if client.IsLMTP() {
+		replies, code, msg, err := client.LmtpData(*d.rawData, len(batch)+1)
+		if err != nil {
+			message := fmt.Sprintf("deliverd-remote %s - %s - LMTP DATA command failed - %d - %s - %s", d.id, client.RemoteAddr(), code, msg, err)
+			d.log.Error(message)
+			if code != 0 {
+				fail(code, message)
+			} else {
+				d.dieTemp(message, false)
+			}
+			return
+		}
+		// batched recipients
+		delivered := []*QMessage{}
+		for i, q := range batch {
+			r := replies[i+1]
+			if r.Err != nil {
+				message := fmt.Sprintf("deliverd-remote %s - %s - LMTP delivery to %s failed - %d - %s", d.id, client.RemoteAddr(), q.RcptTo, r.Code, r.Msg)
+				d.log.Info(message)
+				d.batchFailed(q, r.Code, message)
+				continue
+			}
+			delivered = append(delivered, q)
+		}
+		batch = delivered
+		d.log.Info(fmt.Sprintf("deliverd-remote %s - %s - reply to LMTP DATA cmd for %s: %d - %s - %v", d.id, client.RemoteAddr(), d.qMsg.RcptTo, replies[0].Code, replies[0].Msg, replies[0].Err))
+		if replies[0].Err != nil {
+			message := fmt.Sprintf("deliverd-remote %s - %s - LMTP delivery to %s failed - %d - %s", d.id, client.RemoteAddr(), d.qMsg.RcptTo, replies[0].Code, replies[0].Msg)
+			d.log.Error(message)
+			// batched recipients have been delivered
+			client.Quit()
+			batchDelivered()
+			d.remoteSMTPError(policy, replies[0].Code, message)
+			return
+		}
+	} else if ok, _ := client.Extension("CHUNKING"); ok && Cfg.GetDeliverdBdatChunkSize() > 0 {
+		// CHUNKING
+		code, msg, err = client.Bdat(*d.rawData, Cfg.GetDeliverdBdatChunkSize())
+		d.log.Info(fmt.Sprintf("deliverd-remote %s - %s - reply to BDAT cmd: %d - %s - %v", d.id, client.RemoteAddr(), code, msg, err))
+		if err != nil {
+			message := fmt.Sprintf("deliverd-remote %s - %s - BDAT command failed - %d - %s - %s", d.id, client.RemoteAddr(), code, msg, err)
+			d.log.Error(message)
+			if code != 0 {
+				fail(code, message)
+			} else {
+				d.dieTemp(message, false)
+			}
+			return
+		}
+	} else {
+		// DATA
+		dataPipe, code, msg, err := client.Data()
+		if err != nil {
+			message := fmt.Sprintf("deliverd-remote %s - %s - DATA command failed - %s - %s", d.id, client.RemoteAddr(), msg, err)
+			d.log.Error(message)
+			fail(code, message)
+			return
+		}
+
+		dataBuf := bytes.NewBuffer(*d.rawData)
+		_, err = io.Copy(dataPipe, dataBuf)
+		if err != nil {
+			message := "deliverd-remote " + d.id + " - " + client.RemoteAddr() + " - unable to copy dataBuf to dataPipe DKIM config for domain " + " - " + err.Error()
+			d.log.Error(message)
+			d.dieTemp(message, false)
+			return
+		}
+
+		code, msg, err = dataPipe.Finish(context.Background())
+		d.log.Info(fmt.Sprintf("deliverd-remote %s - %s - reply to DATA cmd: %d - %s - %v", d.id, client.RemoteAddr(), code, msg, err))
+		if err != nil {
+			message := fmt.Sprintf("deliverd-remote %s - %s - DATA command failed - %s - %s", d.id, client.RemoteAddr(), msg, err)
+			d.log.Error(message)
+			d.dieTemp(message, false)
+			return
+		}
+
+		if code != 250 {
+			message := fmt.Sprintf("deliverd-remote %s - %s - DATA command failed - %d - %s", d.id, client.RemoteAddr(), code, msg)
+			d.log.Error(message)
+			fail(code, message)
+			return
+		}
+	}
+
+	// Bye, or connection is kept for next deliveries
+	batchDelivered()
+	if !client.forwardClient() && poolMsgs+1 < policy.MaxMsgsPerConn && (limits.MailMax == 0 || poolMsgs+1 < limits.MailMax) {
+		parked = remotePoolPut(poolKey, client, poolMsgs+1, policy.MaxConns)
+	}
+	if !parked {
+		client.Quit()
+	}
+	deliveryBackoffReset(d.qMsg.Host)
+	metricsRouteLatency(client.route.RemoteHost, time.Since(startedAt))
+	d.replyCode = code
+	d.dieOk()
+}
+
+// remoteSession sets up session on new connection client (EHLO, STARTTLS,
+// XCLIENT/XFORWARD, AUTH)
+// it returns the client to use or nil if delivery has failed (client is
+// closed)
+func remoteSession(d *delivery, policy DeliveryPolicy, routes *[]Route, client *smtpClient) *smtpClient {
 	// EHLO
 	code, msg, err := client.Hello()
 	if err != nil {
 		switch {
 		case code > 399 && code < 500:
+			d.remoteBackoff(policy, code)
+			client.close()
 			d.dieTemp(fmt.Sprintf("deliverd-remote %s - %s - HELO failed %v - remote server reply %d %s ", d.id, client.RemoteAddr(), err.Error(), code, msg), true)
-			return
+			return nil
 		case code > 499:
+			client.close()
 			d.diePerm(fmt.Sprintf("deliverd-remote %s - %s - HELO failed %v - remote server reply %d %s ", d.id, client.RemoteAddr(), err.Error(), code, msg), true)
-			return
+			return nil
 		default:
-			Log.Info(fmt.Sprintf("deliverd-remote %s - %s - HELO unexpected code, remote server reply %d %s ", d.id, client.RemoteAddr(), code, msg))
+			d.log.Info(fmt.Sprintf("deliverd-remote %s - %s - HELO unexpected code, remote server reply %d %s ", d.id, client.RemoteAddr(), code, msg))
 		}
 	}
 
@@ -60,141 +353,100 @@ func deliverRemote(d *delivery) {
 		//config.ServerName = Cfg.GetMe()
 		code, msg, err = client.StartTLS(&config)
 		if err != nil {
-			Log.Info(fmt.Sprintf("deliverd-remote %s - %s - TLS negociation failed %d - %s - %v .", d.id, client.conn.RemoteAddr().String(), code, msg, err))
+			d.log.Info(fmt.Sprintf("deliverd-remote %s - %s - TLS negociation failed %d - %s - %v .", d.id, client.RemoteAddr(), code, msg, err))
 			if Cfg.GetDeliverdRemoteTLSFallback() {
 				// fall back to noTLS
 				client.close()
 				client, err = newSMTPClient(routes)
 				if err != nil {
-					Log.Error(fmt.Sprintf("deliverd-remote %s - unable to get connected SMTP client - %v", d.id, err.Error()))
+					d.log.Error(fmt.Sprintf("deliverd-remote %s - unable to get connected SMTP client - %v", d.id, err.Error()))
 					d.dieTemp("unable to get client", false)
-					return
+					return nil
 				}
-				defer client.close()
 				code, msg, err = client.Hello()
 				if err != nil {
 					switch {
 					case code > 399 && code < 500:
+						d.remoteBackoff(policy, code)
+						client.close()
 						d.dieTemp(fmt.Sprintf("deliverd-remote %s - %s - HELO failed %v - remote server reply %d %s ", d.id, client.RemoteAddr(), err.Error(), code, msg), true)
-						return
+						return nil
 					case code > 499:
+						client.close()
 						d.diePerm(fmt.Sprintf("deliverd-remote %s - %s - HELO failed %v - remote server reply %d %s ", d.id, client.RemoteAddr(), err.Error(), code, msg), true)
-						return
+						return nil
 					default:
-						Log.Info(fmt.Sprintf("deliverd-remote %s - %s - HELO unexpected code, remote server reply %d %s ", d.id, client.RemoteAddr(), code, msg))
+						d.log.Info(fmt.Sprintf("deliverd-remote %s - %s - HELO unexpected code, remote server reply %d %s ", d.id, client.RemoteAddr(), code, msg))
 					}
 				}
 			} else {
-				d.diePerm(fmt.Sprintf("deliverd-remote %s - %s - TLS negociation failed %d - %s - %v .", d.id, client.conn.RemoteAddr().String(), code, msg, err), true)
-				return
+				client.close()
+				d.diePerm(fmt.Sprintf("deliverd-remote %s - %s - TLS negociation failed %d - %s - %v .", d.id, client.RemoteAddr(), code, msg, err), true)
+				return nil
 			}
 		} else {
-			Log.Info(fmt.Sprintf("deliverd-remote %s - %s - TLS negociation succeed - %s %s", d.id, client.RemoteAddr(), client.TLSGetVersion(), client.TLSGetCipherSuite()))
+			d.log.Info(fmt.Sprintf("deliverd-remote %s - %s - TLS negociation succeed - %s %s", d.id, client.RemoteAddr(), client.TLSGetVersion(), client.TLSGetCipherSuite()))
+			metricsTLSSession("outbound", client.TLSGetVersion())
+		}
+	}
+
+	// XCLIENT/XFORWARD
+	if client.forwardClient() {
+		verb := strings.ToUpper(client.route.ForwardClient.String)
+		if attrs, ok := forwardClientAttrs(d.rawData, d.qMsg.Uuid); ok {
+			code, msg, err = client.ForwardClient(verb, attrs)
+			if err != nil {
+				message := fmt.Sprintf("deliverd-remote %s - %s - %s failed - %d - %s - %s", d.id, client.RemoteAddr(), verb, code, msg, err)
+				d.log.Error(message)
+				client.close()
+				d.dieTemp(message, false)
+				return nil
+			}
 		}
 	}
 
 	// SMTP AUTH
 	if client.route.SmtpAuthLogin.Valid && client.route.SmtpAuthPasswd.Valid && len(client.route.SmtpAuthLogin.String) != 0 && len(client.route.SmtpAuthLogin.String) != 0 {
-		var auth DeliverdAuth
-		_, auths := client.Extension("AUTH")
-		if strings.Contains(auths, "CRAM-MD5") {
-			auth = CRAMMD5Auth(client.route.SmtpAuthLogin.String, client.route.SmtpAuthPasswd.String)
-		} else { // PLAIN
-			auth = PlainAuth("", client.route.SmtpAuthLogin.String, client.route.SmtpAuthPasswd.String, client.route.RemoteHost)
+		auth, err := routeAuth(client)
+		if err != nil {
+			message := fmt.Sprintf("deliverd-remote %s - %s - AUTH failed - %s", d.id, client.RemoteAddr(), err)
+			d.log.Error(message)
+			client.close()
+			d.dieTemp(message, false)
+			return nil
 		}
 		if auth != nil {
 			_, msg, err := client.Auth(auth)
 			if err != nil {
 				message := fmt.Sprintf("deliverd-remote %s - %s - AUTH failed - %s - %s", d.id, client.RemoteAddr(), msg, err)
-				Log.Error(message)
+				d.log.Error(message)
+				client.close()
 				d.diePerm(message, false)
-				return
-			}
-		}
-	}
-
-	// MAIL FROM
-	code, msg, err = client.Mail(d.qMsg.MailFrom)
-	if err != nil {
-		message := fmt.Sprintf("deliverd-remote %s - %s - MAIL FROM %s failed %s - %s", d.id, client.RemoteAddr(), d.qMsg.MailFrom, msg, err)
-		Log.Error(message)
-		d.handleSMTPError(code, message)
-		return
-	}
-
-	// RCPT TO
-	code, msg, err = client.Rcpt(d.qMsg.RcptTo)
-	if err != nil {
-		message := fmt.Sprintf("deliverd-remote %s - %s - RCPT TO %s failed - %s - %s", d.id, client.RemoteAddr(), d.qMsg.RcptTo, msg, err)
-		Log.Error(message)
-		d.handleSMTPError(code, message)
-		return
-	}
-
-	// DATA
-	dataPipe, code, msg, err := client.Data()
-	if err != nil {
-		message := fmt.Sprintf("deliverd-remote %s - %s - DATA command failed - %s - %s", d.id, client.RemoteAddr(), msg, err)
-		Log.Error(message)
-		d.handleSMTPError(code, message)
-		return
-	}
-
-	// add Received headers
-	*d.rawData = append([]byte("Received: tmail deliverd remote "+d.id+"; "+time.Now().Format(Time822)+"\r\n"), *d.rawData...)
-
-	// DKIM ?
-	if Cfg.GetDeliverdDkimSign() {
-		userDomain := strings.SplitN(d.qMsg.MailFrom, "@", 2)
-		if len(userDomain) == 2 {
-			dkc, err := DkimGetConfig(userDomain[1])
-			if err != nil {
-				message := "deliverd-remote " + d.id + " - unable to get DKIM config for domain " + userDomain[1] + " - " + err.Error()
-				Log.Error(message)
-				d.dieTemp(message, false)
-				return
-			}
-			if dkc != nil {
-				Log.Debug(fmt.Sprintf("deliverd-remote %s: add dkim sign", d.id))
-				dkimOptions := dkim.NewSigOptions()
-				dkimOptions.PrivateKey = []byte(dkc.PrivKey)
-				dkimOptions.AddSignatureTimestamp = true
-				dkimOptions.Domain = userDomain[1]
-				dkimOptions.Selector = dkc.Selector
-				dkimOptions.Headers = []string{"from", "subject", "date", "message-id"}
-				dkim.Sign(d.rawData, dkimOptions)
-				Log.Debug(fmt.Sprintf("deliverd-remote %s: end dkim sign", d.id))
+				return nil
 			}
 		}
 	}
+	return client
+}
 
-	dataBuf := bytes.NewBuffer(*d.rawData)
-	_, err = io.Copy(dataPipe, dataBuf)
-	if err != nil {
-		message := "deliverd-remote " + d.id + " - " + client.RemoteAddr() + " - unable to copy dataBuf to dataPipe DKIM config for domain " + " - " + err.Error()
-		Log.Error(message)
-		d.dieTemp(message, false)
+// batchFailed handles failure of batched recipient q: it's deferred or
+// bounced on its own according to reply code, or released (delivered on its
+// own) if there is no reply
+func (d *delivery) batchFailed(q *QMessage, code int, message string) {
+	if code > 399 {
+		d.member(q).handleSMTPError(code, message)
 		return
 	}
-
-	dataPipe.WriteCloser.Close()
-	code, msg, err = dataPipe.s.text.ReadResponse(-1)
-	Log.Info(fmt.Sprintf("deliverd-remote %s - %s - reply to DATA cmd: %d - %s - %v", d.id, client.RemoteAddr(), code, msg, err))
-	if err != nil {
-		message := fmt.Sprintf("deliverd-remote %s - %s - DATA command failed - %s - %s", d.id, client.RemoteAddr(), msg, err)
-		Log.Error(message)
-		d.dieTemp(message, false)
-		return
+	if err := q.Release(); err != nil {
+		d.log.Error(fmt.Sprintf("deliverd-remote %s - unable to release batched message %d - %s", d.id, q.Id, err))
 	}
+}
 
-	if code != 250 {
-		message := fmt.Sprintf("deliverd-remote %s - %s - DATA command failed - %d - %s", d.id, client.RemoteAddr(), code, msg)
-		Log.Error(message)
-		d.handleSMTPError(code, message)
-		return
+// remoteSMTPError handles error replied by remote server, deliveries to
+// destination are suspended on 421
+func (d *delivery) remoteSMTPError(policy DeliveryPolicy, code int, message string) {
+	if code == 421 {
+		d.remoteBackoff(policy, code)
 	}
-
-	// Bye
-	client.Quit()
-	d.dieOk()
+	d.handleSMTPError(code, message)
 }
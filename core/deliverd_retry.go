@@ -0,0 +1,129 @@
+package core
+
+// Retry schedules
+// Delays between delivery attempts and queue lifetime depend on the class of
+// the message: bounce (empty MAIL FROM), priority (sender in
+// deliverd_priority_senders) or normal. Schedule can be overridden per route
+// and per destination domain (delivery policy).
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toorop/tmail/message"
+)
+
+// message classes
+const (
+	retryClassNormal   = "normal"
+	retryClassBounce   = "bounce"
+	retryClassPriority = "priority"
+)
+
+// max delay of a NSQ requeue (nsqd MaxReqTimeout), messages scheduled later
+// are requeued until they are due
+const retryMaxRequeue = time.Hour
+
+// parseRetrySchedule parses schedule: comma separated delays (s, m, h or d)
+func parseRetrySchedule(schedule string) (delays []time.Duration, err error) {
+	for _, raw := range strings.Split(schedule, ",") {
+		raw = strings.TrimSpace(raw)
+		var delay time.Duration
+		if strings.HasSuffix(raw, "d") {
+			var days int
+			days, err = strconv.Atoi(strings.TrimSuffix(raw, "d"))
+			delay = time.Duration(days) * 24 * time.Hour
+		} else {
+			delay, err = time.ParseDuration(raw)
+		}
+		if err != nil || delay <= 0 {
+			return nil, errors.New("bad delay " + raw + " in retry schedule " + schedule)
+		}
+		delays = append(delays, delay)
+	}
+	return
+}
+
+// retryClass returns class of queued message q
+func retryClass(q *QMessage) string {
+	if q.MailFrom == "" {
+		return retryClassBounce
+	}
+	from := strings.ToLower(q.MailFrom)
+	domain := strings.ToLower(message.GetHostFromAddress(q.MailFrom))
+	for _, sender := range Cfg.GetDeliverdPrioritySenders() {
+		sender = strings.ToLower(strings.TrimSpace(sender))
+		if sender == "" {
+			continue
+		}
+		if sender == from || sender == domain || (q.AuthUser != "" && sender == strings.ToLower(q.AuthUser)) {
+			return retryClassPriority
+		}
+	}
+	return retryClassNormal
+}
+
+// retrySchedule returns retry schedule of d: route, destination domain or
+// class schedule ("" if none)
+func (d *delivery) retrySchedule() string {
+	if d.routeRetrySchedule != "" {
+		return d.routeRetrySchedule
+	}
+	if p := deliveryPolicyOf(d.qMsg.Host); p.RetrySchedule != "" {
+		return p.RetrySchedule
+	}
+	switch retryClass(d.qMsg) {
+	case retryClassBounce:
+		if schedule := Cfg.GetDeliverdRetryScheduleBounce(); schedule != "" {
+			return schedule
+		}
+	case retryClassPriority:
+		if schedule := Cfg.GetDeliverdRetrySchedulePriority(); schedule != "" {
+			return schedule
+		}
+	}
+	return Cfg.GetDeliverdRetrySchedule()
+}
+
+// retryDelay returns delay before next attempt of d
+func (d *delivery) retryDelay() time.Duration {
+	failed := int(d.qMsg.DeliveryFailedCount)
+	if schedule := d.retrySchedule(); schedule != "" {
+		delays, err := parseRetrySchedule(schedule)
+		if err == nil {
+			if failed >= len(delays) {
+				failed = len(delays) - 1
+			}
+			return delays[failed]
+		}
+		Log.Error("deliverd " + d.id + ": " + err.Error())
+	}
+	// one more minute on each attempt
+	return time.Duration(failed+1) * time.Minute
+}
+
+// queueLifetime returns max queue lifetime of d
+func (d *delivery) queueLifetime() time.Duration {
+	lifetime := 0
+	switch retryClass(d.qMsg) {
+	case retryClassBounce:
+		lifetime = Cfg.GetDeliverdQueueLifetimeBounce()
+	case retryClassPriority:
+		lifetime = Cfg.GetDeliverdQueueLifetimePriority()
+	}
+	if lifetime == 0 {
+		lifetime = Cfg.GetDeliverdQueueLifetime()
+	}
+	return time.Duration(lifetime) * time.Minute
+}
+
+// retryRequeueDelay returns delay of NSQ requeue for a message scheduled in
+// delay
+func retryRequeueDelay(delay time.Duration) time.Duration {
+	if delay > retryMaxRequeue {
+		return retryMaxRequeue
+	}
+	return delay
+}
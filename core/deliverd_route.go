@@ -4,8 +4,11 @@ import (
 	//"errors"
 	"database/sql"
 	"errors"
-	"net"
+	"sort"
+	"strconv"
 	"strings"
+
+	"github.com/toorop/tmail/smtpx"
 )
 
 // Route represents a route in DB
@@ -20,6 +23,14 @@ type Route struct {
 	SmtpAuthPasswd sql.NullString
 	MailFrom       sql.NullString
 	User           sql.NullString
+	ForwardClient  sql.NullString // xclient or xforward: forward original client details to remote host
+	RetrySchedule  sql.NullString // overrides retry schedule of messages using this route
+	Proxy          sql.NullString // socks5://[user:password@]host:port, proxy://host:port or proxy2://host:port (PROXY protocol v1/v2)
+	SmtpAuthMech   sql.NullString // plain, cram-md5, scram-sha-256 or xoauth2 (best announced if null)
+	Weight         sql.NullInt64  // relative weight among routes of the same priority (1 if null)
+	MxFallback     bool           // deliver following MX records when all routes of destination are down
+	IpFamily       sql.NullString // ipv6-first, ipv4-first, ipv6-only or ipv4-only (deliverd_ip_family if null)
+	Timeouts       sql.NullString // timeouts overriding deliverd_timeouts (eg: connect=10s,data-term=10m)
 }
 
 // routes represents all the routes allowed to access remote MX
@@ -40,28 +51,40 @@ func GetAllRoutes() (routes []Route, err error) {
 }
 
 // add en new route
-func AddRoute(host, localIp, remoteHost string, remotePort, priority int, user, mailFrom, smtpAuthLogin, smtpAuthPasswd string) error {
-	var err error
-	route := new(Route)
+func AddRoute(host, localIp, remoteHost string, remotePort, priority int, user, mailFrom, smtpAuthLogin, smtpAuthPasswd, forwardClient, retrySchedule, proxy, smtpAuthMech string, weight int, mxFallback bool, ipFamily, timeouts string) error {
+	route, err := newRoute(host, localIp, remoteHost, remotePort, priority, user, mailFrom, smtpAuthLogin, smtpAuthPasswd, forwardClient, retrySchedule, proxy, smtpAuthMech, weight, mxFallback, ipFamily, timeouts)
+	if err != nil {
+		return err
+	}
+	return DB.Create(route).Error
+}
+
+// newRoute returns a new route (not saved) after validation of its fields
+func newRoute(host, localIp, remoteHost string, remotePort, priority int, user, mailFrom, smtpAuthLogin, smtpAuthPasswd, forwardClient, retrySchedule, proxy, smtpAuthMech string, weight int, mxFallback bool, ipFamily, timeouts string) (route *Route, err error) {
+	route = new(Route)
 
 	// detination host (not null)
 	route.Host = strings.ToLower(strings.TrimSpace(host))
 	if route.Host == "" {
-		return errors.New("host (user@host) must not be nul nor empty")
+		return nil, errors.New("host (user@host) must not be nul nor empty")
 	}
 
 	// localIP
 	if strings.Index(localIp, "&") != -1 && strings.Index(localIp, "|") != -1 {
-		return errors.New("mixed & and | are not allowed in routes")
+		return nil, errors.New("mixed & and | are not allowed in routes")
 	}
 	if err = route.LocalIp.Scan(strings.TrimSpace(localIp)); err != nil {
-		return err
+		return nil, err
 	}
 
 	// Remote host (not null)
-	route.RemoteHost = strings.ToLower(strings.TrimSpace(remoteHost))
+	// can be an LMTP destination: lmtp://host:port or lmtp:///path/to/socket
+	route.RemoteHost = strings.TrimSpace(remoteHost)
+	if !smtpx.IsLMTPURI(route.RemoteHost) {
+		route.RemoteHost = strings.ToLower(route.RemoteHost)
+	}
 	if route.RemoteHost == "" {
-		return errors.New("remotHost must not b nul nor empty")
+		return nil, errors.New("remotHost must not b nul nor empty")
 	}
 
 	// Remote port
@@ -69,20 +92,56 @@ func AddRoute(host, localIp, remoteHost string, remotePort, priority int, user,
 		route.RemotePort.Scan(remotePort)
 	} else {
 		if err = route.RemotePort.Scan(25); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
 	// Priority
 	if err = route.Priority.Scan(priority); err != nil {
-		return err
+		return nil, err
+	}
+
+	// Weight (routes of the same priority)
+	if weight < 0 {
+		return nil, errors.New("weight must be positive")
+	}
+	if weight != 0 {
+		if err = route.Weight.Scan(weight); err != nil {
+			return nil, err
+		}
+	}
+	if mxFallback && smtpx.IsLMTPURI(route.RemoteHost) {
+		return nil, errors.New("mx fallback is not available for LMTP routes")
+	}
+	route.MxFallback = mxFallback
+
+	// IP family preference
+	if ipFamily != "" {
+		family, err := smtpx.ParseFamily(ipFamily)
+		if err != nil {
+			return nil, err
+		}
+		if err = route.IpFamily.Scan(string(family)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Timeouts
+	if timeouts != "" {
+		t, err := smtpx.ParseTimeouts(timeouts)
+		if err != nil {
+			return nil, err
+		}
+		if err = route.Timeouts.Scan(t.String()); err != nil {
+			return nil, err
+		}
 	}
 
 	// SMTPAUTH Login
 	smtpAuthLogin = strings.TrimSpace(smtpAuthLogin)
 	if smtpAuthLogin != "" {
 		if err = route.SmtpAuthLogin.Scan(smtpAuthLogin); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
@@ -90,7 +149,7 @@ func AddRoute(host, localIp, remoteHost string, remotePort, priority int, user,
 	smtpAuthPasswd = strings.TrimSpace(smtpAuthPasswd)
 	if smtpAuthPasswd != "" {
 		if err = route.SmtpAuthPasswd.Scan(smtpAuthPasswd); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
@@ -98,7 +157,7 @@ func AddRoute(host, localIp, remoteHost string, remotePort, priority int, user,
 	mailFrom = strings.TrimSpace(mailFrom)
 	if mailFrom != "" {
 		if err = route.MailFrom.Scan(strings.ToLower(mailFrom)); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
@@ -106,11 +165,61 @@ func AddRoute(host, localIp, remoteHost string, remotePort, priority int, user,
 	user = strings.TrimSpace(user)
 	if user != "" {
 		if err = route.User.Scan(user); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	return DB.Create(route).Error
+	// Forward client details (XCLIENT or XFORWARD)
+	forwardClient = strings.ToLower(strings.TrimSpace(forwardClient))
+	if forwardClient != "" {
+		if forwardClient != "xclient" && forwardClient != "xforward" {
+			return nil, errors.New("forward client must be xclient or xforward")
+		}
+		if smtpx.IsLMTPURI(route.RemoteHost) {
+			return nil, errors.New("forward client is not available for LMTP routes")
+		}
+		if err = route.ForwardClient.Scan(forwardClient); err != nil {
+			return nil, err
+		}
+	}
+
+	// Retry schedule
+	retrySchedule = strings.TrimSpace(retrySchedule)
+	if retrySchedule != "" {
+		if _, err = parseRetrySchedule(retrySchedule); err != nil {
+			return nil, err
+		}
+		if err = route.RetrySchedule.Scan(retrySchedule); err != nil {
+			return nil, err
+		}
+	}
+
+	// Proxy
+	proxy = strings.TrimSpace(proxy)
+	if proxy != "" {
+		if smtpx.IsLMTPURI(route.RemoteHost) {
+			return nil, errors.New("proxy is not available for LMTP routes")
+		}
+		if _, err = smtpx.ParseProxy(proxy); err != nil {
+			return nil, err
+		}
+		if err = route.Proxy.Scan(proxy); err != nil {
+			return nil, err
+		}
+	}
+
+	// SMTP AUTH mechanism
+	smtpAuthMech = strings.ToLower(strings.TrimSpace(smtpAuthMech))
+	if smtpAuthMech != "" {
+		if !IsStringInSlice(smtpAuthMech, routeAuthMechs) {
+			return nil, errors.New("SMTP AUTH mechanism must be one of " + strings.Join(routeAuthMechs, ", "))
+		}
+		if err = route.SmtpAuthMech.Scan(smtpAuthMech); err != nil {
+			return nil, err
+		}
+	}
+
+	return route, nil
 }
 
 // DelRoute delete a route
@@ -118,7 +227,10 @@ func DelRoute(id int64) error {
 	r := Route{
 		Id: id,
 	}
-	return DB.Delete(&r).Error
+	if err := DB.Delete(&r).Error; err != nil {
+		return err
+	}
+	return RouteHealthReset(id)
 }
 
 // getRoutes returns matchingRoutes for the specified destination host
@@ -143,14 +255,14 @@ func getRoutes(mailFrom, host, authUser string) (r *[]Route, err error) {
 
 	// On teste si il y a une route correspondant à: authUser + host + mailFrom
 	if haveAuthUser {
-		if err = DB.Order("priority asc").Where("user=? and host=? and mail_from=?", authUser, host, mailFrom).Find(&routes).Error; err != nil {
+		if err = DB.Order("priority asc").Where(dbQuote("user")+"=? and host=? and mail_from=?", authUser, host, mailFrom).Find(&routes).Error; err != nil {
 			return
 		}
 
 		// On teste si il y a une route correspondant à: authUserHost + host + mailFrom
 		if len(routes) == 0 {
 			if len(authUserHost) != 0 {
-				if err = DB.Order("priority asc").Where("user=? and host=? and mail_from=?", authUserHost, host, mailFrom).Find(&routes).Error; err != nil {
+				if err = DB.Order("priority asc").Where(dbQuote("user")+"=? and host=? and mail_from=?", authUserHost, host, mailFrom).Find(&routes).Error; err != nil {
 					return
 				}
 			}
@@ -158,41 +270,41 @@ func getRoutes(mailFrom, host, authUser string) (r *[]Route, err error) {
 
 		// On teste si il y a une route correspondant à: authUser + host + mailFromHost
 		if len(routes) == 0 {
-			if err = DB.Order("priority asc").Where("user=? and host is null and mail_from is null", authUserHost).Find(&routes).Error; err != nil {
+			if err = DB.Order("priority asc").Where(dbQuote("user")+"=? and host is null and mail_from is null", authUserHost).Find(&routes).Error; err != nil {
 				return
 			}
 		}
 
 		// On teste si il y a une route correspondant à: authUserHost + host + mailFromHost
 		if len(routes) == 0 && len(authUserHost) != 0 {
-			if err = DB.Order("priority asc").Where("user=? and host=? and mail_from=?", authUserHost, host, mailFromHost).Find(&routes).Error; err != nil {
+			if err = DB.Order("priority asc").Where(dbQuote("user")+"=? and host=? and mail_from=?", authUserHost, host, mailFromHost).Find(&routes).Error; err != nil {
 				return
 			}
 		}
 
 		// On teste si il y a une route correspondant à: authUser + host
 		if len(routes) == 0 {
-			if err = DB.Order("priority asc").Where("user=? and host=? and mail_from is null", authUser, host).Find(&routes).Error; err != nil {
+			if err = DB.Order("priority asc").Where(dbQuote("user")+"=? and host=? and mail_from is null", authUser, host).Find(&routes).Error; err != nil {
 				return
 			}
 		}
 
 		// On teste si il y a une route correspondant à: authUserHost + host
 		if len(routes) == 0 && len(authUserHost) != 0 {
-			if err = DB.Order("priority asc").Where("user=? and host=? and mail_from is null", authUserHost, host).Find(&routes).Error; err != nil {
+			if err = DB.Order("priority asc").Where(dbQuote("user")+"=? and host=? and mail_from is null", authUserHost, host).Find(&routes).Error; err != nil {
 				return
 			}
 		}
 		// On teste si il y a une route correspondant à: authUser
 		if len(routes) == 0 {
-			if err = DB.Order("priority asc").Where("user=? and host is null and mail_from is null", authUser).Find(&routes).Error; err != nil {
+			if err = DB.Order("priority asc").Where(dbQuote("user")+"=? and host is null and mail_from is null", authUser).Find(&routes).Error; err != nil {
 				return
 			}
 		}
 
 		// On teste si il y a une route correspondant à: authUserHost
 		if len(routes) == 0 && len(authUserHost) != 0 {
-			if err = DB.Order("priority asc").Where("user=? and host is null and mail_from is null", authUserHost).Find(&routes).Error; err != nil {
+			if err = DB.Order("priority asc").Where(dbQuote("user")+"=? and host is null and mail_from is null", authUserHost).Find(&routes).Error; err != nil {
 				return
 			}
 		}
@@ -200,32 +312,103 @@ func getRoutes(mailFrom, host, authUser string) (r *[]Route, err error) {
 
 	// On cherche les routes spécifiques à cet host
 	if len(routes) == 0 {
-		if err = DB.Order("priority asc").Where("host=? and user is null and mail_from is null", host).Find(&routes).Error; err != nil {
+		if err = DB.Order("priority asc").Where("host=? and "+dbQuote("user")+" is null and mail_from is null", host).Find(&routes).Error; err != nil {
 			return
 		}
 	}
 
 	// Sinon on cherche une wildcard
 	if len(routes) == 0 {
-		if err = DB.Order("priority asc").Where("host=? and user is null and mail_from is null", "*").Find(&routes).Error; err != nil {
+		if err = DB.Order("priority asc").Where("host=? and "+dbQuote("user")+" is null and mail_from is null", "*").Find(&routes).Error; err != nil {
 			return
 		}
 	}
 
 	// Sinon on prends les MX
 	if len(routes) == 0 {
-		mxs, err := net.LookupMX(host)
-		if err != nil {
-			return r, err
+		return routesFromMX(host)
+	}
+	return routesDefaults(routes), nil
+}
+
+// routesDestination returns destination reached through routes: ids of
+// routes or hosts of MX (routes following MX records)
+func routesDestination(routes *[]Route) string {
+	keys := []string{}
+	for _, r := range *routes {
+		if r.Id != 0 {
+			keys = append(keys, "route:"+strconv.FormatInt(r.Id, 10))
+		} else {
+			keys = append(keys, "mx:"+strings.ToLower(strings.TrimSuffix(r.RemoteHost, ".")))
 		}
-		for _, mx := range mxs {
-			routes = append(routes, Route{
-				RemoteHost: mx.Host,
-				RemotePort: sql.NullInt64{25, true},
-			})
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+// routesDestinationLocal is the destination of local recipients (they are
+// never batched)
+const routesDestinationLocal = "local"
+
+// routesDestinationsResolve stores destinations of recipients of the message
+// of q (same Uuid) whose destination is not known yet: routes are resolved
+// once by host of recipients (the whole message shares sender and
+// authenticated user), not once by recipient and attempt. Recipients are
+// then grouped by destination (see ClaimBatch).
+func routesDestinationsResolve(q *QMessage) error {
+	hosts := []struct {
+		Host string
+	}{}
+	table := dbQuote(DB.NewScope(QMessage{}).TableName())
+	if err := DB.Raw("SELECT DISTINCT host FROM "+table+" WHERE uuid = ? AND (destination = ? OR destination IS NULL)", q.Uuid, "").Scan(&hosts).Error; err != nil {
+		return err
+	}
+	for _, h := range hosts {
+		dest := q.Destination
+		if h.Host != q.Host {
+			local, err := isLocalDelivery("postmaster@" + h.Host)
+			if err != nil {
+				return err
+			}
+			if local {
+				dest = routesDestinationLocal
+			} else {
+				routes, err := getRoutes(q.MailFrom, h.Host, q.AuthUser)
+				if err != nil {
+					// resolved on first attempt of its recipients
+					continue
+				}
+				dest = routesDestination(routes)
+			}
+		}
+		if err := DB.Model(QMessage{}).Where("uuid = ? AND host = ? AND (destination = ? OR destination IS NULL)", q.Uuid, h.Host, "").UpdateColumn("destination", dest).Error; err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
+// routesFromMX returns routes following MX records of host
+func routesFromMX(host string) (r *[]Route, err error) {
+	routes := []Route{}
+	mxs, err := dnsLookupMX(host)
+	if err != nil {
+		return r, err
+	}
+	// MX preference is the priority of route (random order among equal
+	// preferences, see routeWeightedOrder)
+	for _, mx := range mxs {
+		routes = append(routes, Route{
+			RemoteHost: mx.Host,
+			RemotePort: sql.NullInt64{25, true},
+			Priority:   sql.NullInt64{Int64: int64(mx.Pref), Valid: true},
+		})
+	}
+	return routesDefaults(routes), nil
+}
+
+// routesDefaults sets default values of routes
+func routesDefaults(routes []Route) *[]Route {
 	// On ajoute les IP locales
 	for i, route := range routes {
 		//Log.Debug(route)
@@ -243,8 +426,11 @@ func getRoutes(mailFrom, host, authUser string) (r *[]Route, err error) {
 			routes[i].Priority = sql.NullInt64{1, true}
 		}
 
+		// Pas de poids on le met a 1
+		if !route.Weight.Valid || route.Weight.Int64 < 1 {
+			routes[i].Weight = sql.NullInt64{Int64: 1, Valid: true}
+		}
 	}
 	//Log.Debug(routes)
-	r = &routes
-	return
+	return &routes
 }
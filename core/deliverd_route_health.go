@@ -0,0 +1,219 @@
+package core
+
+// Health of routes
+// Each connection attempt through a route (smart host) is recorded: failure
+// rate by hour and consecutive failures. A route which fails
+// deliverd_route_breaker_failures times in a row is quarantined (circuit
+// breaker open) for deliverd_route_breaker_cooldown seconds, then it's tried
+// again (one more failure opens the breaker again).
+// Routes following MX records (no route in DB) are not tracked.
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// failure rates are computed by window of this duration
+const routeHealthWindow = time.Hour
+
+// RouteHealth represents health of a route
+type RouteHealth struct {
+	Id                  int64
+	RouteId             int64
+	RemoteHost          string
+	WindowStart         time.Time
+	Attempts            int64 // since WindowStart
+	Failures            int64 // since WindowStart
+	ConsecutiveFailures int64
+	LastError           string
+	LastFailureAt       time.Time
+	LastSuccessAt       time.Time
+	OpenUntil           time.Time // circuit breaker is open until
+}
+
+// FailureRate returns % of failed attempts in current window
+func (h RouteHealth) FailureRate() float64 {
+	if h.Attempts == 0 {
+		return 0
+	}
+	return float64(h.Failures) * 100 / float64(h.Attempts)
+}
+
+// IsOpen returns true if circuit breaker of route is open
+func (h RouteHealth) IsOpen() bool {
+	return h.OpenUntil.After(time.Now())
+}
+
+// routeBreakerEnabled returns true if circuit breakers are enabled
+func routeBreakerEnabled() bool {
+	return Cfg.GetDeliverdRouteBreakerFailures() > 0
+}
+
+// routeHealthFilter returns routes to host without those whose circuit
+// breaker is open. If all routes are down, routes following MX records of
+// host are returned if one of them has the MX fallback option, else an
+// error is returned.
+func routeHealthFilter(host string, routes *[]Route) (*[]Route, error) {
+	isOpen, err := routeHealthOpen(*routes)
+	if err != nil {
+		return nil, err
+	}
+	if len(isOpen) == 0 {
+		return routes, nil
+	}
+	up, mxFallback := []Route{}, false
+	for _, r := range *routes {
+		if r.Id == 0 || !isOpen[r.Id] {
+			up = append(up, r)
+		}
+		mxFallback = mxFallback || r.MxFallback
+	}
+	if len(up) != 0 {
+		return &up, nil
+	}
+	if !mxFallback {
+		return nil, errors.New("all routes to " + host + " are down (circuit breakers open)")
+	}
+	Log.Info("deliverd-remote - all routes to " + host + " are down (circuit breakers open), fallback to MX")
+	return routesFromMX(host)
+}
+
+// routeHealthOpen returns IDs of routes whose circuit breaker is open
+func routeHealthOpen(routes []Route) (map[int64]bool, error) {
+	isOpen, ids := map[int64]bool{}, []int64{}
+	for _, r := range routes {
+		if r.Id != 0 {
+			ids = append(ids, r.Id)
+		}
+	}
+	if !routeBreakerEnabled() || len(ids) == 0 {
+		return isOpen, nil
+	}
+	open := []RouteHealth{}
+	if err := DB.Where("route_id IN (?) AND open_until > ?", ids, time.Now()).Find(&open).Error; err != nil {
+		return nil, err
+	}
+	for _, h := range open {
+		isOpen[h.RouteId] = true
+	}
+	return isOpen, nil
+}
+
+// routeWeightedOrder returns routes (sorted by priority) in the order they
+// must be tried: routes of the same priority are in random order weighted
+// by their weights
+func routeWeightedOrder(routes []Route) []Route {
+	ordered := make([]Route, 0, len(routes))
+	for start := 0; start < len(routes); {
+		end := start + 1
+		for end < len(routes) && routes[end].Priority.Int64 == routes[start].Priority.Int64 {
+			end++
+		}
+		group := append([]Route{}, routes[start:end]...)
+		for len(group) != 0 {
+			total := int64(0)
+			for _, r := range group {
+				total += routeWeight(r)
+			}
+			pick, n := rand.Int63n(total), 0
+			for n = range group {
+				if pick -= routeWeight(group[n]); pick < 0 {
+					break
+				}
+			}
+			ordered = append(ordered, group[n])
+			group = append(group[:n], group[n+1:]...)
+		}
+		start = end
+	}
+	return ordered
+}
+
+// routeWeight returns weight of route
+func routeWeight(r Route) int64 {
+	if !r.Weight.Valid || r.Weight.Int64 < 1 {
+		return 1
+	}
+	return r.Weight.Int64
+}
+
+// routeHealthRecord records result of a connection attempt through route
+// (err is nil on success)
+func routeHealthRecord(route *Route, err error) {
+	if route.Id == 0 {
+		return
+	}
+	if e := routeHealthUpdate(route, err, time.Now()); e != nil {
+		Log.Error("deliverd-remote - unable to record health of route " + strconv.FormatInt(route.Id, 10) + " - " + e.Error())
+	}
+}
+
+// routeHealthUpdate updates health of route and opens its circuit breaker
+// if needed
+func routeHealthUpdate(route *Route, failure error, now time.Time) error {
+	// new window
+	if err := DB.Model(RouteHealth{}).Where("route_id = ? AND window_start < ?", route.Id, now.Add(-routeHealthWindow)).Updates(map[string]interface{}{"window_start": now, "attempts": 0, "failures": 0}).Error; err != nil {
+		return err
+	}
+
+	keys := map[string]interface{}{"route_id": route.Id}
+	inserts := map[string]interface{}{
+		"remote_host":          route.RemoteHost,
+		"window_start":         now,
+		"consecutive_failures": 0,
+		"failures":             0,
+		"last_error":           "",
+		"last_failure_at":      time.Time{},
+		"last_success_at":      time.Time{},
+		"open_until":           time.Time{},
+	}
+	if failure == nil {
+		delete(inserts, "last_success_at")
+		delete(inserts, "consecutive_failures")
+		return dbIncrement(&RouteHealth{}, keys, []string{"attempts"}, inserts, map[string]interface{}{"consecutive_failures": 0, "last_success_at": now})
+	}
+	for _, c := range []string{"failures", "consecutive_failures", "last_error", "last_failure_at"} {
+		delete(inserts, c)
+	}
+	updates := map[string]interface{}{"last_error": failure.Error(), "last_failure_at": now}
+	if err := dbIncrement(&RouteHealth{}, keys, []string{"attempts", "failures", "consecutive_failures"}, inserts, updates); err != nil {
+		return err
+	}
+
+	// circuit breaker
+	if !routeBreakerEnabled() {
+		return nil
+	}
+	health := RouteHealth{}
+	if err := DB.Where("route_id = ?", route.Id).First(&health).Error; err != nil {
+		return err
+	}
+	if health.ConsecutiveFailures < int64(Cfg.GetDeliverdRouteBreakerFailures()) {
+		return nil
+	}
+	// another process may have opened it
+	cooldown := time.Duration(Cfg.GetDeliverdRouteBreakerCooldown()) * time.Second
+	r := DB.Model(RouteHealth{}).Where("route_id = ? AND open_until <= ?", route.Id, now).Update("open_until", now.Add(cooldown))
+	if r.Error != nil {
+		return r.Error
+	}
+	if r.RowsAffected == 1 {
+		Log.Info("deliverd-remote - route " + strconv.FormatInt(route.Id, 10) + " to " + route.RemoteHost + " is down after " + strconv.FormatInt(health.ConsecutiveFailures, 10) + " consecutive failures, circuit breaker open for " + cooldown.String())
+	}
+	return nil
+}
+
+// RouteHealthList returns health of routes
+func RouteHealthList() (health []RouteHealth, err error) {
+	health = []RouteHealth{}
+	err = DB.Order("route_id").Find(&health).Error
+	return
+}
+
+// RouteHealthReset resets health of route routeId (closes its circuit
+// breaker)
+func RouteHealthReset(routeId int64) error {
+	return DB.Where("route_id = ?", routeId).Delete(RouteHealth{}).Error
+}
@@ -0,0 +1,423 @@
+package core
+
+// Digests for domain administrators
+// Domains opt in (tmail digest subscribe) to receive a daily or weekly digest:
+// volumes, top deferral reasons, DMARC failures of the domain, quarantined
+// messages and mailboxes near their quota. Events are counted per domain and
+// per day only for subscribed domains, digests are sent after midnight UTC.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/mail"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/toorop/tmail/message"
+)
+
+// kinds of counted events
+const (
+	digestKindSent      = "sent"
+	digestKindReceived  = "received"
+	digestKindDeferred  = "deferred"
+	digestKindBounced   = "bounced"
+	digestKindDmarcFail = "dmarc-fail"
+)
+
+// number of items in top lists
+const digestTopSize = 10
+
+// DigestSubscription represents the opt-in of a domain
+type DigestSubscription struct {
+	Id         int64
+	Domain     string `sql:"unique"`
+	Frequency  string // daily or weekly
+	Recipients string `sql:"type:text;"` // addresses separated by ";"
+	LastSentAt time.Time
+}
+
+// DigestCounter represents events of a domain during a day
+type DigestCounter struct {
+	Id     int64
+	Domain string
+	Day    string // YYYY-MM-DD (UTC)
+	Kind   string
+	Reason string // deferral reason, source IP of DMARC failure
+	Count  int
+}
+
+// digestItem is an entry of a top list
+type digestItem struct {
+	Reason string
+	Count  int
+}
+
+// digestItems sorts items by count (desc)
+type digestItems []digestItem
+
+func (s digestItems) Len() int      { return len(s) }
+func (s digestItems) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s digestItems) Less(i, j int) bool {
+	if s[i].Count == s[j].Count {
+		return s[i].Reason < s[j].Reason
+	}
+	return s[i].Count > s[j].Count
+}
+
+// digestQuota represents a mailbox near its quota
+type digestQuota struct {
+	Login string
+	Usage int // percent
+	Quota string
+}
+
+// digestLock serializes counters updates
+var digestLock sync.Mutex
+
+// subscribed domains (reloaded every minute)
+var digestDomains = struct {
+	sync.Mutex
+	domains  map[string]bool
+	loadedAt time.Time
+}{}
+
+// digestSubscribed returns true if domain receives digests
+func digestSubscribed(domain string) bool {
+	digestDomains.Lock()
+	defer digestDomains.Unlock()
+	if time.Since(digestDomains.loadedAt) > time.Minute {
+		subscriptions, err := DigestSubscriptionList()
+		if err != nil {
+			Log.Error("digest - unable to load subscriptions - " + err.Error())
+		} else {
+			digestDomains.domains = make(map[string]bool)
+			for _, s := range subscriptions {
+				digestDomains.domains[s.Domain] = true
+			}
+		}
+		digestDomains.loadedAt = time.Now()
+	}
+	return digestDomains.domains[strings.ToLower(domain)]
+}
+
+// digestCount counts an event of domain (only if it receives digests)
+func digestCount(domain, kind, reason string) {
+	domain = strings.ToLower(domain)
+	if domain == "" || !digestSubscribed(domain) {
+		return
+	}
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+	day := time.Now().UTC().Format("2006-01-02")
+	digestLock.Lock()
+	defer digestLock.Unlock()
+	c := DigestCounter{}
+	err := DB.Where("domain = ? AND day = ? AND kind = ? AND reason = ?", domain, day, kind, reason).First(&c).Error
+	if err == gorm.RecordNotFound {
+		c = DigestCounter{Domain: domain, Day: day, Kind: kind, Reason: reason}
+	} else if err != nil {
+		Log.Error("digest - unable to get counter of " + domain + " - " + err.Error())
+		return
+	}
+	c.Count++
+	if err = DB.Save(&c).Error; err != nil {
+		Log.Error("digest - unable to save counter of " + domain + " - " + err.Error())
+	}
+}
+
+// digestDelivery counts a delivery event of d for sender and recipient
+// domains
+func (d *delivery) digestDelivery(kind, reason string) {
+	if reason != "" {
+		// ids are unique, they must not split reasons
+		reason = strings.Join(strings.Fields(strings.Replace(reason, d.id, "", -1)), " ")
+	}
+	senderDomain, rcptDomain := message.GetHostFromAddress(d.qMsg.MailFrom), d.qMsg.Host
+	switch kind {
+	case digestKindSent:
+		digestCount(senderDomain, digestKindSent, "")
+		digestCount(rcptDomain, digestKindReceived, "")
+	default:
+		digestCount(senderDomain, kind, reason)
+		if !strings.EqualFold(senderDomain, rcptDomain) {
+			digestCount(rcptDomain, kind, reason)
+		}
+	}
+}
+
+// digestDmarcFailure counts a DMARC failure for the domain of e
+func digestDmarcFailure(e dmarcEvaluation, sourceIp string) {
+	domain := e.policyDomain
+	if domain == "" {
+		domain = e.fromDomain
+	}
+	digestCount(domain, digestKindDmarcFail, sourceIp)
+}
+
+// digestFrom returns From address of digests
+func digestFrom() string {
+	if from := Cfg.GetDigestFrom(); from != "" {
+		return from
+	}
+	return "postmaster@" + Cfg.GetMe()
+}
+
+// digestTop returns the top of items
+func digestTop(counts map[string]int) []digestItem {
+	items := []digestItem{}
+	for reason, count := range counts {
+		items = append(items, digestItem{reason, count})
+	}
+	sort.Sort(digestItems(items))
+	if len(items) > digestTopSize {
+		items = items[:digestTopSize]
+	}
+	return items
+}
+
+// digestQuotaWarnings returns mailboxes of domain (maildir driver) over
+// digest_quota_warning percent of their quota
+func digestQuotaWarnings(domain string) (warnings []digestQuota, err error) {
+	warnings = []digestQuota{}
+	users := []User{}
+	if err = DB.Where("login LIKE ? AND have_mailbox = ?", "%@"+domain, true).Find(&users).Error; err != nil {
+		return
+	}
+	threshold := Cfg.GetDigestQuotaWarning()
+	for _, u := range users {
+		if u.MailboxDriver != "maildir" || u.MailboxQuota == "" {
+			continue
+		}
+		quota, err := ParseSize(u.MailboxQuota)
+		if err != nil || quota == 0 {
+			continue
+		}
+		size, err := maildirSize(path.Join(u.Home, "Maildir"))
+		if err != nil {
+			Log.Error("digest - unable to get mailbox size of " + u.Login + " - " + err.Error())
+			continue
+		}
+		if usage := int(size * 100 / quota); usage >= threshold {
+			warnings = append(warnings, digestQuota{u.Login, usage, u.MailboxQuota})
+		}
+	}
+	return
+}
+
+// digestMessage returns the digest of domain for days [begin, end[ sent to
+// recipients
+func digestMessage(domain string, recipients []string, begin, end time.Time) ([]byte, error) {
+	type templateData struct {
+		Date              string
+		From              string
+		To                string
+		Domain            string
+		Me                string
+		MessageId         string
+		Begin             string
+		End               string
+		Sent              int
+		Received          int
+		Deferred          int
+		Bounced           int
+		DmarcFailures     int
+		TopDeferrals      []digestItem
+		DmarcSources      []digestItem
+		Quarantined       int
+		QuarantineReasons []digestItem
+		QuotaWarnings     []digestQuota
+	}
+	uuid, err := NewUUID()
+	if err != nil {
+		return nil, err
+	}
+	tData := templateData{
+		Date:      time.Now().Format(Time822),
+		From:      digestFrom(),
+		To:        strings.Join(recipients, ", "),
+		Domain:    domain,
+		Me:        Cfg.GetMe(),
+		MessageId: fmt.Sprintf("%s@%s", uuid, Cfg.GetMe()),
+		Begin:     begin.Format("2006-01-02"),
+		End:       end.Add(-24 * time.Hour).Format("2006-01-02"),
+	}
+
+	// counters
+	counters := []DigestCounter{}
+	if err = DB.Where("domain = ? AND day >= ? AND day < ?", domain, begin.Format("2006-01-02"), end.Format("2006-01-02")).Find(&counters).Error; err != nil {
+		return nil, err
+	}
+	deferrals, dmarcSources := make(map[string]int), make(map[string]int)
+	for _, c := range counters {
+		switch c.Kind {
+		case digestKindSent:
+			tData.Sent += c.Count
+		case digestKindReceived:
+			tData.Received += c.Count
+		case digestKindDeferred:
+			tData.Deferred += c.Count
+			deferrals[c.Reason] += c.Count
+		case digestKindBounced:
+			tData.Bounced += c.Count
+		case digestKindDmarcFail:
+			tData.DmarcFailures += c.Count
+			dmarcSources[c.Reason] += c.Count
+		}
+	}
+	tData.TopDeferrals, tData.DmarcSources = digestTop(deferrals), digestTop(dmarcSources)
+
+	// quarantine
+	quarantined := []QuarantinedMessage{}
+	if err = DB.Where("rcpt_to LIKE ? AND added_at >= ? AND added_at < ?", "%@"+domain+"%", begin, end).Find(&quarantined).Error; err != nil {
+		return nil, err
+	}
+	reasons := make(map[string]int)
+	for _, q := range quarantined {
+		reasons[q.Reason]++
+	}
+	tData.Quarantined, tData.QuarantineReasons = len(quarantined), digestTop(reasons)
+
+	// quota
+	if tData.QuotaWarnings, err = digestQuotaWarnings(domain); err != nil {
+		return nil, err
+	}
+
+	t, err := template.ParseFiles(path.Join(GetBasePath(), "tpl/digest.tpl"))
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err = t.Execute(buf, tData); err != nil {
+		return nil, err
+	}
+	b := buf.Bytes()
+	err = Unix2dos(&b)
+	return b, err
+}
+
+// digestPeriod returns the days covered by a digest of frequency sent at now
+func digestPeriod(frequency string, now time.Time) (begin, end time.Time) {
+	end = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if frequency == "weekly" {
+		return end.Add(-7 * 24 * time.Hour), end
+	}
+	return end.Add(-24 * time.Hour), end
+}
+
+// digestSend sends digests due at now and removes old counters
+func digestSend(now time.Time) error {
+	subscriptions, err := DigestSubscriptionList()
+	if err != nil {
+		return err
+	}
+	for _, s := range subscriptions {
+		if s.Frequency == "weekly" && now.Weekday() != time.Monday {
+			continue
+		}
+		begin, end := digestPeriod(s.Frequency, now)
+		if !s.LastSentAt.Before(end) {
+			continue
+		}
+		recipients := strings.Split(s.Recipients, ";")
+		mail, err := digestMessage(s.Domain, recipients, begin, end)
+		if err != nil {
+			Log.Error("digest - unable to build digest for " + s.Domain + " - " + err.Error())
+			continue
+		}
+		envelope := message.Envelope{MailFrom: digestFrom(), RcptTo: recipients}
+		id, err := QueueAddMessage(&mail, envelope, "")
+		if err != nil {
+			Log.Error("digest - unable to queue digest for " + s.Domain + " - " + err.Error())
+			continue
+		}
+		Log.Info(fmt.Sprintf("digest - %s digest for %s queued as %s", s.Frequency, s.Domain, id))
+		s.LastSentAt = now
+		if err = DB.Save(&s).Error; err != nil {
+			Log.Error("digest - unable to update subscription of " + s.Domain + " - " + err.Error())
+		}
+	}
+	// weekly digests need 7 days
+	return DB.Where("day < ?", now.Add(-8*24*time.Hour).Format("2006-01-02")).Delete(DigestCounter{}).Error
+}
+
+// LaunchDigestReporter sends digests daily (after midnight UTC)
+func LaunchDigestReporter() {
+	Log.Info("digest reporter launched")
+	for {
+		// digests are sent by the leader node
+		if !ClusterLeader("digest-reporter", time.Hour) {
+			Log.Debug("digest - digests are sent by another node")
+		} else if err := digestSend(time.Now().UTC()); err != nil {
+			Log.Error("digest - " + err.Error())
+		}
+		now := time.Now().UTC()
+		next := time.Date(now.Year(), now.Month(), now.Day(), 0, 10, 0, 0, time.UTC).Add(24 * time.Hour)
+		time.Sleep(next.Sub(now))
+	}
+}
+
+// DigestSubscribe subscribes domain to digests (frequency: daily or weekly)
+func DigestSubscribe(domain, frequency string, recipients []string) error {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if _, err := RcpthostGet(domain); err != nil {
+		if err == gorm.RecordNotFound {
+			return errors.New(domain + " is not in rcpthosts")
+		}
+		return err
+	}
+	frequency = strings.ToLower(frequency)
+	if frequency != "daily" && frequency != "weekly" {
+		return errors.New("frequency must be daily or weekly")
+	}
+	if len(recipients) == 0 {
+		return errors.New("no recipient")
+	}
+	for i, r := range recipients {
+		a, err := mail.ParseAddress(strings.TrimSpace(r))
+		if err != nil {
+			return errors.New("bad recipient " + r)
+		}
+		recipients[i] = a.Address
+	}
+	s := DigestSubscription{}
+	if err := DB.Where("domain = ?", domain).First(&s).Error; err != nil && err != gorm.RecordNotFound {
+		return err
+	}
+	s.Domain, s.Frequency, s.Recipients = domain, frequency, strings.Join(recipients, ";")
+	return DB.Save(&s).Error
+}
+
+// DigestUnsubscribe unsubscribes domain from digests
+func DigestUnsubscribe(domain string) error {
+	return DB.Where("domain = ?", strings.ToLower(strings.TrimSpace(domain))).Delete(DigestSubscription{}).Error
+}
+
+// DigestSubscriptionList returns subscriptions to digests
+func DigestSubscriptionList() (subscriptions []DigestSubscription, err error) {
+	subscriptions = []DigestSubscription{}
+	err = DB.Order("domain asc").Find(&subscriptions).Error
+	return
+}
+
+// DigestPreview returns the digest of domain for the current period (today
+// included)
+func DigestPreview(domain string) ([]byte, error) {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	s := DigestSubscription{}
+	if err := DB.Where("domain = ?", domain).First(&s).Error; err != nil {
+		if err == gorm.RecordNotFound {
+			return nil, errors.New(domain + " is not subscribed to digests")
+		}
+		return nil, err
+	}
+	begin, end := digestPeriod(s.Frequency, time.Now().UTC().Add(24*time.Hour))
+	return digestMessage(domain, strings.Split(s.Recipients, ";"), begin, end)
+}
@@ -8,11 +8,14 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"net/mail"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/jinzhu/gorm"
+	"github.com/toorop/go-dkim"
+	"github.com/toorop/tmail/message"
 )
 
 // DkimConfig represents DKIM configuration for a domain
@@ -22,9 +25,17 @@ type DkimConfig struct {
 	PubKey   string `sql:"type:text;"`
 	PrivKey  string `sql:"type:text;"`
 	Selector string
-	Headers  string
+	Headers  string // signed headers separated by ":"
+	// header/body canonicalization: simple or relaxed (eg: relaxed/relaxed)
+	Canonicalization string
 }
 
+// DKIM signing defaults
+const (
+	dkimDefaultCanonicalization = "relaxed/relaxed"
+	dkimDefaultHeaders          = "from:subject:date:message-id"
+)
+
 // DkimEnable enabled DKIM on domain
 func DkimEnable(domain string) (dkc *DkimConfig, err error) {
 	domain = strings.ToLower(strings.TrimSpace(domain))
@@ -37,10 +48,25 @@ func DkimEnable(domain string) (dkc *DkimConfig, err error) {
 		return nil, errors.New("DKIM is already enabled on " + domain)
 	}
 
+	// save
+	dkc = &DkimConfig{
+		Domain:           domain,
+		Headers:          dkimDefaultHeaders,
+		Canonicalization: dkimDefaultCanonicalization,
+	}
+	if err = dkc.newKeys(); err != nil {
+		return nil, err
+	}
+	err = DB.Save(dkc).Error
+	return dkc, err
+}
+
+// newKeys creates a new key pair and a new selector
+func (dkc *DkimConfig) newKeys() error {
 	// Create new key pairs
 	privKey, err := rsa.GenerateKey(rand.Reader, 1024)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	privKeyBlock := pem.Block{
 		Type:    "RSA PRIVATE KEY",
@@ -51,7 +77,7 @@ func DkimEnable(domain string) (dkc *DkimConfig, err error) {
 	privKeyPem := string(pem.EncodeToMemory(&privKeyBlock))
 	pubKeyDer, err := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	pubKeyBlock := pem.Block{
 		Type:    "PUBLIC KEY",
@@ -63,18 +89,110 @@ func DkimEnable(domain string) (dkc *DkimConfig, err error) {
 
 	// selector: unique to prevent collision with existing record
 	selector := strconv.FormatInt(time.Now().Unix(), 10)
-
-	// save
-	dkc = &DkimConfig{
-		Domain:   domain,
-		PubKey:   pubKey,
-		PrivKey:  privKeyPem,
-		Selector: selector,
-		Headers:  "",
+	if selector == dkc.Selector {
+		selector += "r"
 	}
 
+	dkc.PubKey = pubKey
+	dkc.PrivKey = privKeyPem
+	dkc.Selector = selector
+	return nil
+}
+
+// DkimRotate replaces keys (and selector) of domain domain
+// The previous selector is returned, its DNS record can be removed once
+// messages signed with it have been delivered.
+func DkimRotate(domain string) (dkc *DkimConfig, oldSelector string, err error) {
+	dkc, err = DkimGetConfig(domain)
+	if err != nil {
+		return nil, "", err
+	}
+	if dkc == nil {
+		return nil, "", errors.New("DKIM is not enabled on " + domain)
+	}
+	oldSelector = dkc.Selector
+	if err = dkc.newKeys(); err != nil {
+		return nil, "", err
+	}
 	err = DB.Save(dkc).Error
-	return dkc, err
+	return dkc, oldSelector, err
+}
+
+// DkimSetOptions sets canonicalization and signed headers for domain domain
+// empty values are left unchanged
+// canonicalization: header/body (simple or relaxed), eg: relaxed/simple
+// headers: headers separated by ":", eg: from:subject:date
+func DkimSetOptions(domain, canonicalization, headers string) error {
+	dkc, err := DkimGetConfig(domain)
+	if err != nil {
+		return err
+	}
+	if dkc == nil {
+		return errors.New("DKIM is not enabled on " + domain)
+	}
+	if canonicalization != "" {
+		canonicalization = strings.ToLower(strings.TrimSpace(canonicalization))
+		t := strings.Split(canonicalization, "/")
+		if len(t) > 2 {
+			return errors.New("bad canonicalization " + canonicalization)
+		}
+		for _, c := range t {
+			if c != "simple" && c != "relaxed" {
+				return errors.New("bad canonicalization " + canonicalization)
+			}
+		}
+		dkc.Canonicalization = canonicalization
+	}
+	if headers != "" {
+		headers = strings.ToLower(strings.Replace(headers, " ", "", -1))
+		if !IsStringInSlice("from", strings.Split(headers, ":")) {
+			return errors.New("From header must be signed")
+		}
+		dkc.Headers = headers
+	}
+	return DB.Save(dkc).Error
+}
+
+// dkimSign signs raw message with the DKIM config of envelope sender domain
+// or, if there is no config for this domain, of From header domain.
+// It returns the signing domain or an empty string if message was not
+// signed.
+func dkimSign(raw *[]byte, mailFrom string) (domain string, err error) {
+	domains := []string{}
+	if d := message.GetHostFromAddress(mailFrom); d != "" {
+		domains = append(domains, d)
+	}
+	if from, err := mail.ParseAddress(message.RawGetHeaderValue(raw, "from")); err == nil {
+		if d := message.GetHostFromAddress(from.Address); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	for _, domain = range domains {
+		dkc, err := DkimGetConfig(domain)
+		if err != nil {
+			return "", err
+		}
+		if dkc == nil {
+			continue
+		}
+		dkimOptions := dkim.NewSigOptions()
+		dkimOptions.PrivateKey = []byte(dkc.PrivKey)
+		dkimOptions.AddSignatureTimestamp = true
+		dkimOptions.Domain = domain
+		dkimOptions.Selector = dkc.Selector
+		dkimOptions.Headers = strings.Split(dkimDefaultHeaders, ":")
+		if dkc.Headers != "" {
+			dkimOptions.Headers = strings.Split(dkc.Headers, ":")
+		}
+		if dkc.Canonicalization != "" {
+			dkimOptions.Canonicalization = dkc.Canonicalization
+		}
+		if err = dkim.Sign(raw, dkimOptions); err != nil {
+			return "", errors.New("unable to sign message for domain " + domain + " - " + err.Error())
+		}
+		return domain, nil
+	}
+	return "", nil
 }
 
 // DkimDisable Disable DKIM for domain domain by removing his
@@ -103,3 +221,38 @@ func DkimGetConfig(domain string) (dkc *DkimConfig, err error) {
 	}
 	return dkc, nil
 }
+
+// dkimResult is the result of a DKIM verification
+type dkimResult string
+
+const (
+	dkimNone      dkimResult = "none"
+	dkimPass      dkimResult = "pass"
+	dkimFail      dkimResult = "fail"
+	dkimTemperror dkimResult = "temperror"
+)
+
+// dkimVerify verifies DKIM signature of raw message and returns the result
+// and the signing domain (d= tag)
+func dkimVerify(raw *[]byte) (result dkimResult, domain string) {
+	signature := message.RawGetHeaderValue(raw, "dkim-signature")
+	if signature == "" {
+		return dkimNone, ""
+	}
+	for _, tag := range strings.Split(signature, ";") {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "d" {
+			domain = strings.ToLower(strings.TrimSpace(kv[1]))
+		}
+	}
+	status, _ := dkim.Verify(raw)
+	switch status {
+	case dkim.SUCCESS:
+		return dkimPass, domain
+	case dkim.TEMPFAIL:
+		return dkimTemperror, domain
+	case dkim.NOTSIGNED:
+		return dkimNone, domain
+	}
+	return dkimFail, domain
+}
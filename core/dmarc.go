@@ -0,0 +1,188 @@
+package core
+
+// DMARC (RFC 7489) evaluation
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// dmarcResult is the result of a DMARC evaluation
+type dmarcResult string
+
+const (
+	dmarcNone      dmarcResult = "none"
+	dmarcPass      dmarcResult = "pass"
+	dmarcFail      dmarcResult = "fail"
+	dmarcTemperror dmarcResult = "temperror"
+	dmarcPermerror dmarcResult = "permerror"
+)
+
+// dmarcRecord represents a DMARC policy record
+type dmarcRecord struct {
+	policy          string // none, quarantine, reject
+	subdomainPolicy string
+	adkim           string // r (relaxed) or s (strict)
+	aspf            string
+	pct             int
+	rua             []string
+}
+
+// dmarcEvaluation is the outcome of the evaluation of a message
+type dmarcEvaluation struct {
+	result       dmarcResult
+	fromDomain   string
+	policyDomain string // domain where the record was found
+	policy       string // policy published by domain
+	disposition  string // policy to apply: none, quarantine or reject
+	record       *dmarcRecord
+	dkimAligned  bool
+	spfAligned   bool
+}
+
+// dmarcParseRecord parses a DMARC TXT record
+func dmarcParseRecord(txt string) (*dmarcRecord, bool) {
+	r := &dmarcRecord{adkim: "r", aspf: "r", pct: 100}
+	tags := strings.Split(txt, ";")
+	if strings.Replace(strings.TrimSpace(tags[0]), " ", "", -1) != "v=DMARC1" {
+		return nil, false
+	}
+	for _, tag := range tags[1:] {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "p":
+			r.policy = strings.ToLower(value)
+		case "sp":
+			r.subdomainPolicy = strings.ToLower(value)
+		case "adkim":
+			r.adkim = strings.ToLower(value)
+		case "aspf":
+			r.aspf = strings.ToLower(value)
+		case "pct":
+			if pct, err := strconv.Atoi(value); err == nil && pct >= 0 && pct <= 100 {
+				r.pct = pct
+			}
+		case "rua":
+			for _, uri := range strings.Split(value, ",") {
+				r.rua = append(r.rua, strings.TrimSpace(uri))
+			}
+		}
+	}
+	switch r.policy {
+	case "none", "quarantine", "reject":
+	default:
+		return nil, false
+	}
+	switch r.subdomainPolicy {
+	case "":
+		r.subdomainPolicy = r.policy
+	case "none", "quarantine", "reject":
+	default:
+		r.subdomainPolicy = r.policy
+	}
+	return r, true
+}
+
+// dmarcGetRecord returns the DMARC record published by domain
+// (nil if there is none)
+func dmarcGetRecord(domain string) (*dmarcRecord, error) {
+	txts, err := net.LookupTXT("_dmarc." + domain)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such host") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, txt := range txts {
+		if r, ok := dmarcParseRecord(txt); ok {
+			return r, nil
+		}
+	}
+	return nil, nil
+}
+
+// orgDomain returns the organizational domain of domain
+// There is no public suffix list here: the organizational domain is the last
+// two labels, or three if the last two look like a ccTLD second level
+// domain (co.uk, com.au...)
+func orgDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	labels := strings.Split(domain, ".")
+	n := 2
+	if len(labels) > 2 && len(labels[len(labels)-1]) == 2 && len(labels[len(labels)-2]) <= 3 {
+		n = 3
+	}
+	if len(labels) <= n {
+		return domain
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+// dmarcAligned checks identifier alignment (RFC 7489 3.1)
+func dmarcAligned(domain, fromDomain, mode string) bool {
+	domain = strings.ToLower(domain)
+	if mode == "s" {
+		return domain == fromDomain
+	}
+	return orgDomain(domain) == orgDomain(fromDomain)
+}
+
+// dmarcEvaluate evaluates DMARC for a message whose RFC5322.From domain is
+// fromDomain
+func dmarcEvaluate(fromDomain string, spf spfResult, spfDomain string, dkim dkimResult, dkimDomain string) (e dmarcEvaluation) {
+	e.fromDomain = strings.ToLower(fromDomain)
+	e.disposition = "none"
+	record, err := dmarcGetRecord(e.fromDomain)
+	if err != nil {
+		e.result = dmarcTemperror
+		return
+	}
+	isSubdomain := false
+	e.policyDomain = e.fromDomain
+	if record == nil {
+		org := orgDomain(e.fromDomain)
+		if org != e.fromDomain {
+			if record, err = dmarcGetRecord(org); err != nil {
+				e.result = dmarcTemperror
+				return
+			}
+			isSubdomain = true
+			e.policyDomain = org
+		}
+	}
+	if record == nil {
+		e.result = dmarcNone
+		return
+	}
+	e.record = record
+	e.policy = record.policy
+	if isSubdomain {
+		e.policy = record.subdomainPolicy
+	}
+
+	e.spfAligned = spf == spfPass && dmarcAligned(spfDomain, e.fromDomain, record.aspf)
+	e.dkimAligned = dkim == dkimPass && dmarcAligned(dkimDomain, e.fromDomain, record.adkim)
+	if e.spfAligned || e.dkimAligned {
+		e.result = dmarcPass
+		return
+	}
+	e.result = dmarcFail
+	e.disposition = e.policy
+	// RFC 7489 6.6.4: pct sampling, messages not sampled get the next
+	// less strict policy
+	if record.pct < 100 && rand.Intn(100) >= record.pct {
+		switch e.disposition {
+		case "reject":
+			e.disposition = "quarantine"
+		case "quarantine":
+			e.disposition = "none"
+		}
+	}
+	return
+}
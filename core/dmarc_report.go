@@ -0,0 +1,431 @@
+package core
+
+// DMARC aggregate reports (RFC 7489 7.2)
+// Results of DMARC evaluations are aggregated per policy domain and per day,
+// reports are sent daily to the rua (mailto) addresses published by domains.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/toorop/tmail/message"
+)
+
+// DmarcReportRecord represents aggregated DMARC results (one row of a report)
+type DmarcReportRecord struct {
+	Id             int64
+	PolicyDomain   string
+	Day            string // YYYY-MM-DD (UTC)
+	SourceIp       string
+	HeaderFrom     string
+	Disposition    string
+	DkimEvaluated  string // pass or fail (aligned)
+	SpfEvaluated   string
+	DkimDomain     string
+	DkimResult     string
+	SpfDomain      string
+	SpfResult      string
+	Count          int
+	PolicyAdkim    string
+	PolicyAspf     string
+	PolicyP        string
+	PolicySp       string
+	PolicyPct      int
+	Rua            string `sql:"type:text;"` // addresses separated by ";"
+	LastReceivedAt time.Time
+}
+
+// records which could not be reported (no valid or authorized rua, report
+// too big) are kept this number of days, reports are tried again daily
+const dmarcRecordsMaxAge = 7
+
+// dmarcReportLock serializes counters updates
+var dmarcReportLock sync.Mutex
+
+// dmarcEvaluatedResult returns "pass" or "fail"
+func dmarcEvaluatedResult(aligned bool) string {
+	if aligned {
+		return "pass"
+	}
+	return "fail"
+}
+
+// dmarcReportAdd aggregates the result of an evaluation
+func dmarcReportAdd(e dmarcEvaluation, sourceIp string, spf spfResult, spfDomain string, dkim dkimResult, dkimDomain string) error {
+	if e.record == nil || len(e.record.rua) == 0 {
+		return nil
+	}
+	r := DmarcReportRecord{
+		PolicyDomain:  e.policyDomain,
+		Day:           time.Now().UTC().Format("2006-01-02"),
+		SourceIp:      sourceIp,
+		HeaderFrom:    e.fromDomain,
+		Disposition:   e.disposition,
+		DkimEvaluated: dmarcEvaluatedResult(e.dkimAligned),
+		SpfEvaluated:  dmarcEvaluatedResult(e.spfAligned),
+		DkimDomain:    dkimDomain,
+		DkimResult:    string(dkim),
+		SpfDomain:     spfDomain,
+		SpfResult:     string(spf),
+	}
+	dmarcReportLock.Lock()
+	defer dmarcReportLock.Unlock()
+	err := DB.Where("policy_domain = ? AND day = ? AND source_ip = ? AND header_from = ? AND disposition = ? AND dkim_evaluated = ? AND spf_evaluated = ? AND dkim_domain = ? AND dkim_result = ? AND spf_domain = ? AND spf_result = ?",
+		r.PolicyDomain, r.Day, r.SourceIp, r.HeaderFrom, r.Disposition, r.DkimEvaluated, r.SpfEvaluated, r.DkimDomain, r.DkimResult, r.SpfDomain, r.SpfResult).First(&r).Error
+	if err != nil && err != gorm.RecordNotFound {
+		return err
+	}
+	r.Count++
+	r.PolicyAdkim = e.record.adkim
+	r.PolicyAspf = e.record.aspf
+	r.PolicyP = e.record.policy
+	r.PolicySp = e.record.subdomainPolicy
+	r.PolicyPct = e.record.pct
+	r.Rua = strings.Join(e.record.rua, ";")
+	r.LastReceivedAt = time.Now()
+	return DB.Save(&r).Error
+}
+
+// XML aggregate report (RFC 7489 appendix C)
+type dmarcFeedback struct {
+	XMLName         xml.Name         `xml:"feedback"`
+	ReportMetadata  dmarcXMLMetadata `xml:"report_metadata"`
+	PolicyPublished dmarcXMLPolicy   `xml:"policy_published"`
+	Records         []dmarcXMLRecord `xml:"record"`
+}
+
+type dmarcXMLMetadata struct {
+	OrgName   string `xml:"org_name"`
+	Email     string `xml:"email"`
+	ReportId  string `xml:"report_id"`
+	DateBegin int64  `xml:"date_range>begin"`
+	DateEnd   int64  `xml:"date_range>end"`
+}
+
+type dmarcXMLPolicy struct {
+	Domain string `xml:"domain"`
+	Adkim  string `xml:"adkim"`
+	Aspf   string `xml:"aspf"`
+	P      string `xml:"p"`
+	Sp     string `xml:"sp"`
+	Pct    int    `xml:"pct"`
+}
+
+type dmarcXMLRecord struct {
+	SourceIp    string               `xml:"row>source_ip"`
+	Count       int                  `xml:"row>count"`
+	Disposition string               `xml:"row>policy_evaluated>disposition"`
+	Dkim        string               `xml:"row>policy_evaluated>dkim"`
+	Spf         string               `xml:"row>policy_evaluated>spf"`
+	HeaderFrom  string               `xml:"identifiers>header_from"`
+	DkimResults []dmarcXMLAuthResult `xml:"auth_results>dkim"`
+	SpfResult   dmarcXMLAuthResult   `xml:"auth_results>spf"`
+}
+
+type dmarcXMLAuthResult struct {
+	Domain string `xml:"domain"`
+	Result string `xml:"result"`
+}
+
+// dmarcReportFrom returns From address of reports
+func dmarcReportFrom() string {
+	if from := Cfg.GetSmtpdDmarcReportsFrom(); from != "" {
+		return from
+	}
+	return "dmarc-noreply@" + Cfg.GetMe()
+}
+
+// dmarcBuildReport returns the XML aggregate report of policy domain records
+func dmarcBuildReport(domain string, records []DmarcReportRecord) (report []byte, reportId string, begin, end time.Time, err error) {
+	if len(records) == 0 {
+		return nil, "", begin, end, errors.New("no record for " + domain)
+	}
+	uuid, err := NewUUID()
+	if err != nil {
+		return
+	}
+	reportId = uuid
+	last := records[0]
+	for i, r := range records {
+		day, err := time.Parse("2006-01-02", r.Day)
+		if err != nil {
+			return nil, "", begin, end, err
+		}
+		if i == 0 || day.Before(begin) {
+			begin = day
+		}
+		if day.Add(24*time.Hour - time.Second).After(end) {
+			end = day.Add(24*time.Hour - time.Second)
+		}
+		if r.LastReceivedAt.After(last.LastReceivedAt) {
+			last = r
+		}
+	}
+	feedback := dmarcFeedback{
+		ReportMetadata: dmarcXMLMetadata{
+			OrgName:   Cfg.GetSmtpdDmarcReportsOrgName(),
+			Email:     dmarcReportFrom(),
+			ReportId:  reportId,
+			DateBegin: begin.Unix(),
+			DateEnd:   end.Unix(),
+		},
+		PolicyPublished: dmarcXMLPolicy{
+			Domain: domain,
+			Adkim:  last.PolicyAdkim,
+			Aspf:   last.PolicyAspf,
+			P:      last.PolicyP,
+			Sp:     last.PolicySp,
+			Pct:    last.PolicyPct,
+		},
+	}
+	for _, r := range records {
+		rec := dmarcXMLRecord{
+			SourceIp:    r.SourceIp,
+			Count:       r.Count,
+			Disposition: r.Disposition,
+			Dkim:        r.DkimEvaluated,
+			Spf:         r.SpfEvaluated,
+			HeaderFrom:  r.HeaderFrom,
+			SpfResult:   dmarcXMLAuthResult{r.SpfDomain, r.SpfResult},
+		}
+		if r.DkimDomain != "" {
+			rec.DkimResults = append(rec.DkimResults, dmarcXMLAuthResult{r.DkimDomain, r.DkimResult})
+		}
+		feedback.Records = append(feedback.Records, rec)
+	}
+	x, err := xml.MarshalIndent(feedback, "", "  ")
+	if err != nil {
+		return
+	}
+	report = append([]byte(xml.Header), x...)
+	return
+}
+
+// dmarcGetPendingRecords returns records of days before day (all if day is
+// empty) grouped by policy domain
+func dmarcGetPendingRecords(domain, day string) (map[string][]DmarcReportRecord, error) {
+	records := []DmarcReportRecord{}
+	q := DB.Order("policy_domain, id")
+	if domain != "" {
+		q = q.Where("policy_domain = ?", strings.ToLower(domain))
+	}
+	if day != "" {
+		q = q.Where("day < ?", day)
+	}
+	if err := q.Find(&records).Error; err != nil {
+		return nil, err
+	}
+	byDomain := make(map[string][]DmarcReportRecord)
+	for _, r := range records {
+		byDomain[r.PolicyDomain] = append(byDomain[r.PolicyDomain], r)
+	}
+	return byDomain, nil
+}
+
+// DmarcReportsPreview returns pending XML reports (including today) by
+// policy domain
+func DmarcReportsPreview(domain string) (map[string]string, error) {
+	byDomain, err := dmarcGetPendingRecords(domain, "")
+	if err != nil {
+		return nil, err
+	}
+	reports := make(map[string]string)
+	for d, records := range byDomain {
+		report, _, _, _, err := dmarcBuildReport(d, records)
+		if err != nil {
+			return nil, err
+		}
+		reports[d] = string(report)
+	}
+	return reports, nil
+}
+
+// dmarcParseRua parses a rua URI (mailto:address!size)
+func dmarcParseRua(uri string) (address string, maxSize int64, err error) {
+	uri = strings.TrimSpace(uri)
+	if !strings.HasPrefix(strings.ToLower(uri), "mailto:") {
+		return "", 0, errors.New("unsupported rua URI " + uri)
+	}
+	address = uri[7:]
+	if p := strings.Index(address, "!"); p != -1 {
+		if maxSize, err = ParseSize(address[p+1:]); err != nil {
+			return "", 0, err
+		}
+		address = address[:p]
+	}
+	if strings.Index(address, "@") == -1 {
+		return "", 0, errors.New("bad rua address " + address)
+	}
+	return
+}
+
+// dmarcRuaAuthorized checks that a rua address outside of the policy domain
+// accepts reports for it (RFC 7489 7.1)
+func dmarcRuaAuthorized(domain, address string) bool {
+	ruaDomain := strings.ToLower(message.GetHostFromAddress(address))
+	if orgDomain(ruaDomain) == orgDomain(domain) {
+		return true
+	}
+	txts, err := net.LookupTXT(domain + "._report._dmarc." + ruaDomain)
+	if err != nil {
+		return false
+	}
+	for _, txt := range txts {
+		if strings.HasPrefix(strings.Replace(txt, " ", "", -1), "v=DMARC1") {
+			return true
+		}
+	}
+	return false
+}
+
+// dmarcReportMessage returns the mail carrying a gzipped report
+func dmarcReportMessage(domain, to, reportId string, begin, end time.Time, gzipped []byte) ([]byte, error) {
+	type templateData struct {
+		Date       string
+		From       string
+		To         string
+		Domain     string
+		Me         string
+		ReportId   string
+		MessageId  string
+		Boundary   string
+		Filename   string
+		Attachment string
+	}
+	// base64, 76 chars per line
+	b64 := base64.StdEncoding.EncodeToString(gzipped)
+	lines := []string{}
+	for len(b64) > 76 {
+		lines = append(lines, b64[:76])
+		b64 = b64[76:]
+	}
+	lines = append(lines, b64)
+
+	tData := templateData{
+		Date:       time.Now().Format(Time822),
+		From:       dmarcReportFrom(),
+		To:         to,
+		Domain:     domain,
+		Me:         Cfg.GetMe(),
+		ReportId:   reportId,
+		MessageId:  fmt.Sprintf("%s@%s", reportId, Cfg.GetMe()),
+		Boundary:   "tmail-" + reportId,
+		Filename:   fmt.Sprintf("%s!%s!%d!%d.xml.gz", Cfg.GetMe(), domain, begin.Unix(), end.Unix()),
+		Attachment: strings.Join(lines, "\n"),
+	}
+	t, err := template.ParseFiles(path.Join(GetBasePath(), "tpl/dmarc_report.tpl"))
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err = t.Execute(buf, tData); err != nil {
+		return nil, err
+	}
+	b := buf.Bytes()
+	err = Unix2dos(&b)
+	return b, err
+}
+
+// dmarcSendReports sends reports of days before today
+func dmarcSendReports() error {
+	byDomain, err := dmarcGetPendingRecords("", time.Now().UTC().Format("2006-01-02"))
+	if err != nil {
+		return err
+	}
+	maxSize := int64(Cfg.GetSmtpdDmarcReportsMaxSize())
+	for domain, records := range byDomain {
+		report, reportId, begin, end, err := dmarcBuildReport(domain, records)
+		if err != nil {
+			Log.Error("dmarc-report - unable to build report for " + domain + " - " + err.Error())
+			continue
+		}
+		gzipped := new(bytes.Buffer)
+		gz := gzip.NewWriter(gzipped)
+		if _, err = gz.Write(report); err == nil {
+			err = gz.Close()
+		}
+		if err != nil {
+			Log.Error("dmarc-report - unable to compress report for " + domain + " - " + err.Error())
+			continue
+		}
+
+		// send to each rua
+		queueErr, sent := false, false
+		for _, uri := range strings.Split(records[len(records)-1].Rua, ";") {
+			address, ruaMaxSize, err := dmarcParseRua(uri)
+			if err != nil {
+				Log.Info("dmarc-report - " + domain + " - " + err.Error())
+				continue
+			}
+			if !dmarcRuaAuthorized(domain, address) {
+				Log.Info(fmt.Sprintf("dmarc-report - %s - %s is not authorized to receive reports", domain, address))
+				continue
+			}
+			mail, err := dmarcReportMessage(domain, address, reportId, begin, end, gzipped.Bytes())
+			if err != nil {
+				Log.Error("dmarc-report - unable to build message for " + domain + " - " + err.Error())
+				queueErr = true
+				continue
+			}
+			size := int64(len(mail))
+			if (maxSize != 0 && size > maxSize) || (ruaMaxSize != 0 && size > ruaMaxSize) {
+				Log.Info(fmt.Sprintf("dmarc-report - %s - report for %s is too big (%d bytes)", domain, address, size))
+				continue
+			}
+			envelope := message.Envelope{MailFrom: dmarcReportFrom(), RcptTo: []string{address}}
+			id, err := QueueAddMessage(&mail, envelope, "")
+			if err != nil {
+				Log.Error("dmarc-report - unable to queue report for " + domain + " - " + err.Error())
+				queueErr = true
+				continue
+			}
+			Log.Info(fmt.Sprintf("dmarc-report - report %s for %s queued as %s for %s", reportId, domain, id, address))
+			sent = true
+		}
+		if queueErr {
+			// will retry on next run
+			continue
+		}
+		if !sent {
+			// kept until a report is sent or they are too old
+			if begin.After(time.Now().UTC().AddDate(0, 0, -dmarcRecordsMaxAge)) {
+				continue
+			}
+			Log.Info(fmt.Sprintf("dmarc-report - %s - no report sent since %s, records removed", domain, begin.Format("2006-01-02")))
+		}
+		for _, r := range records {
+			if err = DB.Delete(&r).Error; err != nil {
+				Log.Error("dmarc-report - unable to remove record - " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// LaunchDmarcReporter sends DMARC aggregate reports daily (after midnight
+// UTC)
+func LaunchDmarcReporter() {
+	Log.Info("dmarc reporter launched")
+	for {
+		// reports are sent by the leader node
+		if !ClusterLeader("dmarc-reporter", time.Hour) {
+			Log.Debug("dmarc-report - reports are sent by another node")
+		} else if err := dmarcSendReports(); err != nil {
+			Log.Error("dmarc-report - unable to get pending reports - " + err.Error())
+		}
+		now := time.Now().UTC()
+		next := time.Date(now.Year(), now.Month(), now.Day(), 0, 5, 0, 0, time.UTC).Add(24 * time.Hour)
+		time.Sleep(next.Sub(now))
+	}
+}
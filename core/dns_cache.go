@@ -0,0 +1,144 @@
+package core
+
+// DNS cache & prefetcher
+// deliverd resolves MX and IP of destinations through this cache; the
+// prefetcher fills it for messages which will be delivered soon so delivery
+// doesn't block on DNS.
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+type dnsCacheEntry struct {
+	mxs       []*net.MX
+	ips       []net.IP
+	expiresAt time.Time
+}
+
+var dnsCache = struct {
+	sync.Mutex
+	mx map[string]dnsCacheEntry
+	ip map[string]dnsCacheEntry
+}{
+	mx: make(map[string]dnsCacheEntry),
+	ip: make(map[string]dnsCacheEntry),
+}
+
+// dnsLookupMX returns MX of host (cached)
+func dnsLookupMX(host string) ([]*net.MX, error) {
+	dnsCache.Lock()
+	e, ok := dnsCache.mx[host]
+	dnsCache.Unlock()
+	if ok && time.Now().Before(e.expiresAt) {
+		return e.mxs, nil
+	}
+	mxs, err := net.LookupMX(host)
+	if err != nil {
+		return nil, err
+	}
+	if ttl := Cfg.GetDeliverdDnsCacheTtl(); ttl != 0 {
+		dnsCache.Lock()
+		dnsCache.mx[host] = dnsCacheEntry{mxs: mxs, expiresAt: time.Now().Add(time.Duration(ttl) * time.Second)}
+		dnsCache.Unlock()
+	}
+	return mxs, nil
+}
+
+// dnsLookupIP returns IP of host (cached)
+func dnsLookupIP(host string) ([]net.IP, error) {
+	dnsCache.Lock()
+	e, ok := dnsCache.ip[host]
+	dnsCache.Unlock()
+	if ok && time.Now().Before(e.expiresAt) {
+		return e.ips, nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	if ttl := Cfg.GetDeliverdDnsCacheTtl(); ttl != 0 {
+		dnsCache.Lock()
+		dnsCache.ip[host] = dnsCacheEntry{ips: ips, expiresAt: time.Now().Add(time.Duration(ttl) * time.Second)}
+		dnsCache.Unlock()
+	}
+	return ips, nil
+}
+
+// dnsCachePurge removes expired entries
+func dnsCachePurge() {
+	now := time.Now()
+	dnsCache.Lock()
+	defer dnsCache.Unlock()
+	for host, e := range dnsCache.mx {
+		if now.After(e.expiresAt) {
+			delete(dnsCache.mx, host)
+		}
+	}
+	for host, e := range dnsCache.ip {
+		if now.After(e.expiresAt) {
+			delete(dnsCache.ip, host)
+		}
+	}
+}
+
+// dnsPrefetch resolves MX & IP of remote hosts of messages scheduled for
+// delivery before the end of window
+func dnsPrefetch(window time.Duration, workers int) error {
+	hosts := []string{}
+	err := DB.Model(QMessage{}).Where("status = ? AND next_delivery_scheduled_at <= ?", 2, time.Now().Add(window)).Pluck("DISTINCT host", &hosts).Error
+	if err != nil {
+		return err
+	}
+
+	toResolve := make(chan string)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for host := range toResolve {
+				mxs, err := dnsLookupMX(host)
+				if err != nil {
+					Log.Debug(fmt.Sprintf("dns-prefetch - unable to get MX of %s - %s", host, err))
+					continue
+				}
+				for _, mx := range mxs {
+					if _, err := dnsLookupIP(mx.Host); err != nil {
+						Log.Debug(fmt.Sprintf("dns-prefetch - unable to get IP of %s - %s", mx.Host, err))
+					}
+				}
+			}
+		}()
+	}
+	for _, host := range hosts {
+		// local ?
+		local, err := IsInRcptHost(host)
+		if err != nil || local {
+			continue
+		}
+		toResolve <- host
+	}
+	close(toResolve)
+	wg.Wait()
+	return nil
+}
+
+// launchDnsPrefetcher launches DNS prefetch loop
+func launchDnsPrefetcher() {
+	window := time.Duration(Cfg.GetDeliverdDnsPrefetchWindow()) * time.Second
+	workers := Cfg.GetDeliverdDnsPrefetchWorkers()
+	if workers < 1 {
+		workers = 1
+	}
+	Log.Info("deliverd dns prefetcher launched")
+	for {
+		dnsCachePurge()
+		if err := dnsPrefetch(window, workers); err != nil {
+			Log.Error("dns-prefetch - unable to get hosts from queue - " + err.Error())
+		}
+		time.Sleep(window / 2)
+	}
+}
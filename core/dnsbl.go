@@ -0,0 +1,233 @@
+package core
+
+// DNSBL / DNSWL
+// Client IP is looked up in the zones of smtpd_dnsbl when the client
+// connects, weights of the zones listing it are added into a score. Negative
+// weights are for DNSWL. At MAIL, client is rejected or temporarily rejected
+// if score reaches smtpd_dnsbl_reject_score or smtpd_dnsbl_tempfail_score,
+// message is tagged if score reaches smtpd_dnsbl_tag_score.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timeout of DNSBL lookups
+const dnsblTimeout = 5 * time.Second
+
+// dnsblZone represents a DNSBL (weight > 0) or a DNSWL (weight < 0)
+type dnsblZone struct {
+	zone   string
+	weight int
+}
+
+// dnsblResult is the result of DNSBL lookups for an IP
+type dnsblResult struct {
+	score     int
+	listed    []string // zone=return code
+	expiresAt time.Time
+}
+
+// cache of results
+var dnsblCache = struct {
+	sync.Mutex
+	results map[string]dnsblResult
+}{
+	results: make(map[string]dnsblResult),
+}
+
+// String returns result as it's logged
+func (r *dnsblResult) String() string {
+	if len(r.listed) == 0 {
+		return fmt.Sprintf("score %d", r.score)
+	}
+	return fmt.Sprintf("score %d (%s)", r.score, strings.Join(r.listed, ", "))
+}
+
+// dnsblZones returns zones of smtpd_dnsbl (zone[=weight], default weight: 1)
+func dnsblZones() (zones []dnsblZone, err error) {
+	for _, entry := range Cfg.GetSmtpdDnsbl() {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		z := dnsblZone{zone: entry, weight: 1}
+		if p := strings.Index(entry, "="); p != -1 {
+			z.zone = entry[:p]
+			if z.weight, err = strconv.Atoi(entry[p+1:]); err != nil {
+				return nil, errors.New("bad weight for DNSBL " + entry)
+			}
+		}
+		zones = append(zones, z)
+	}
+	return
+}
+
+// dnsblReverse returns ip in DNSBL query form (reversed octets or nibbles)
+func dnsblReverse(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	ip = ip.To16()
+	nibbles := make([]string, 0, 32)
+	for i := len(ip) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, strconv.FormatUint(uint64(ip[i]&0x0f), 16), strconv.FormatUint(uint64(ip[i]>>4), 16))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// dnsblLookup looks up ip in DNSBL & DNSWL zones (cached)
+func dnsblLookup(ip net.IP) (r dnsblResult, err error) {
+	key := ip.String()
+	dnsblCache.Lock()
+	r, ok := dnsblCache.results[key]
+	dnsblCache.Unlock()
+	if ok && time.Now().Before(r.expiresAt) {
+		return r, nil
+	}
+	zones, err := dnsblZones()
+	if err != nil || len(zones) == 0 {
+		return
+	}
+
+	type answer struct {
+		zone dnsblZone
+		code string
+	}
+	answers := make(chan answer, len(zones))
+	reversed := dnsblReverse(ip)
+	for _, z := range zones {
+		go func(z dnsblZone) {
+			code := ""
+			addrs, err := net.LookupHost(reversed + "." + z.zone)
+			// 127.255.255.0/24: error codes (query refused, ...)
+			if err == nil && len(addrs) != 0 && strings.HasPrefix(addrs[0], "127.") && !strings.HasPrefix(addrs[0], "127.255.255.") {
+				code = addrs[0]
+			}
+			answers <- answer{z, code}
+		}(z)
+	}
+	r = dnsblResult{listed: []string{}}
+	timeout := time.After(dnsblTimeout)
+	for range zones {
+		select {
+		case a := <-answers:
+			if a.code != "" {
+				r.score += a.zone.weight
+				r.listed = append(r.listed, a.zone.zone+"="+a.code)
+			}
+		case <-timeout:
+			r.listed = append(r.listed, "timeout")
+			sort.Strings(r.listed)
+			return r, nil
+		}
+	}
+	sort.Strings(r.listed)
+	if ttl := Cfg.GetSmtpdDnsblCacheTtl(); ttl != 0 {
+		r.expiresAt = time.Now().Add(time.Duration(ttl) * time.Second)
+		dnsblCachePurge()
+		dnsblCache.Lock()
+		dnsblCache.results[key] = r
+		dnsblCache.Unlock()
+	}
+	return r, nil
+}
+
+// dnsblCachePurge removes expired results
+func dnsblCachePurge() {
+	now := time.Now()
+	dnsblCache.Lock()
+	defer dnsblCache.Unlock()
+	for key, r := range dnsblCache.results {
+		if now.After(r.expiresAt) {
+			delete(dnsblCache.results, key)
+		}
+	}
+}
+
+// dnsblVerdict returns verdict for DNSBL result r
+func dnsblVerdict(r *dnsblResult) (v smtpdVerdict) {
+	v.check = "dnsbl"
+	v.reason = r.String()
+	reject, tempfail, tag := Cfg.GetSmtpdDnsblRejectScore(), Cfg.GetSmtpdDnsblTempfailScore(), Cfg.GetSmtpdDnsblTagScore()
+	switch {
+	case reject > 0 && r.score >= reject:
+		v.action, v.reply = smtpdActionReject, "554 5.7.1 client IP is blacklisted"
+	case tempfail > 0 && r.score >= tempfail:
+		v.action, v.reply = smtpdActionTempfail, "451 4.7.1 client IP is blacklisted, please try again later"
+	case tag > 0 && r.score >= tag:
+		v.action = smtpdActionTag
+	}
+	return
+}
+
+// dnsblCheck looks up client IP in DNSBL & DNSWL zones
+func (s *SMTPServerSession) dnsblCheck() {
+	if len(Cfg.GetSmtpdDnsbl()) == 0 || s.isTrusted() {
+		return
+	}
+	ip := s.remoteIP()
+	if ip == nil {
+		return
+	}
+	r, err := dnsblLookup(ip)
+	if err != nil {
+		s.logError("GREETING - dnsbl - " + err.Error())
+		return
+	}
+	s.dnsbl = &r
+	s.log("GREETING - dnsbl - " + r.String())
+}
+
+// smtpDnsbl rejects (or temporarily rejects) client if its DNSBL score is
+// over threshold
+// it returns true if client has been rejected (reply has been sent)
+func (s *SMTPServerSession) smtpDnsbl() bool {
+	if s.dnsbl == nil || s.isTrusted() {
+		return false
+	}
+	v := dnsblVerdict(s.dnsbl)
+	if v.action != smtpdActionReject && v.action != smtpdActionTempfail {
+		return false
+	}
+	if isShadowCheck(v.check) {
+		s.shadowRecord(v)
+		return false
+	}
+	s.log(fmt.Sprintf("MAIL - %s - %s - %s", v.check, v.action, v.reason))
+	s.out(v.reply)
+	return true
+}
+
+// checkDnsbl tags message if DNSBL score of client is over threshold
+// on replay client IP is looked up.
+func checkDnsbl(ctx *smtpdCheckContext, rawMessage *[]byte) (v smtpdVerdict) {
+	v.check = "dnsbl"
+	if ctx.trusted {
+		return
+	}
+	r := ctx.dnsbl
+	if r == nil && ctx.replay && ctx.remoteIP != nil {
+		result, err := dnsblLookup(ctx.remoteIP)
+		if err != nil {
+			ctx.logError("dnsbl - " + err.Error())
+			return
+		}
+		r = &result
+	}
+	if r == nil {
+		return
+	}
+	v = dnsblVerdict(r)
+	// reject & tempfail are enforced at MAIL
+	if !ctx.replay && v.action != smtpdActionTag {
+		v.action = smtpdActionAccept
+	}
+	return
+}
@@ -0,0 +1,150 @@
+package core
+
+// First-seen tracking of sender domains, DKIM domains & client IPs
+// Their "newness" is exposed to checks (smtpdCheckContext.newness): brand
+// new sender domains can be tagged (or worse) and are greylisted more
+// aggressively (auto whitelisted networks are ignored).
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/toorop/tmail/message"
+)
+
+// first-seen kinds
+const (
+	firstSeenSenderDomain = "sender-domain"
+	firstSeenDkimDomain   = "dkim-domain"
+	firstSeenClientIP     = "client-ip"
+)
+
+// FirstSeen represents the first time a sender domain, a DKIM domain or a
+// client IP has been seen
+type FirstSeen struct {
+	Id          int64
+	Kind        string
+	Value       string
+	FirstSeenAt time.Time
+	LastSeenAt  time.Time
+	Count       int64
+}
+
+// firstSeenAge returns age of value (0 if it has never been seen), if
+// record is true value is recorded as seen now
+func firstSeenAge(kind, value string, record bool) (age time.Duration, err error) {
+	value = strings.ToLower(value)
+	fs := FirstSeen{}
+	err = DB.Where("kind = ? AND value = ?", kind, value).First(&fs).Error
+	if err != nil && err != gorm.RecordNotFound {
+		return 0, err
+	}
+	now := time.Now()
+	if err == nil {
+		age = now.Sub(fs.FirstSeenAt)
+	}
+	if !record {
+		return age, nil
+	}
+	return age, dbIncrement(&FirstSeen{}, map[string]interface{}{"kind": kind, "value": value}, []string{"count"}, map[string]interface{}{"first_seen_at": now}, map[string]interface{}{"last_seen_at": now})
+}
+
+// firstSeenIsNew returns true if age is under newness threshold
+func firstSeenIsNew(age time.Duration) bool {
+	return age < time.Duration(Cfg.GetSmtpdNewnessThreshold())*time.Hour
+}
+
+// firstSeenSenderDomainOf returns the sender domain (MAIL FROM domain or HELO
+// for null sender)
+func firstSeenSenderDomainOf(mailFrom, helo string) string {
+	if mailFrom == "" {
+		return helo
+	}
+	return message.GetHostFromAddress(mailFrom)
+}
+
+// senderDomainIsNew returns true if sender domain of current transaction is
+// new (it's not recorded)
+func (s *SMTPServerSession) senderDomainIsNew() bool {
+	if !Cfg.GetSmtpdNewnessEnabled() {
+		return false
+	}
+	domain := firstSeenSenderDomainOf(s.envelope.MailFrom, s.helo)
+	if domain == "" {
+		return false
+	}
+	age, err := firstSeenAge(firstSeenSenderDomain, domain, false)
+	if err != nil {
+		s.logError("newness - unable to get age of " + domain + " - " + err.Error())
+		return false
+	}
+	return firstSeenIsNew(age)
+}
+
+// firstSeenFormatAge returns age as it's displayed in X-Tmail-Newness header
+func firstSeenFormatAge(age time.Duration) string {
+	if firstSeenIsNew(age) {
+		if age == 0 {
+			return "new"
+		}
+		return fmt.Sprintf("new, %dh", int(age.Hours()))
+	}
+	return fmt.Sprintf("%dd", int(age.Hours()/24))
+}
+
+// checkNewness records & evaluates newness of sender domain, DKIM domain
+// and client IP
+// A message is new if its sender domain is new and it's not signed by a
+// known DKIM domain.
+func checkNewness(ctx *smtpdCheckContext, rawMessage *[]byte) (v smtpdVerdict) {
+	v.check = "newness"
+	if !Cfg.GetSmtpdNewnessEnabled() || ctx.trusted {
+		return
+	}
+	ctx.newness = make(map[string]time.Duration)
+	values := map[string]string{
+		firstSeenSenderDomain: firstSeenSenderDomainOf(ctx.envelope.MailFrom, ctx.helo),
+		firstSeenDkimDomain:   ctx.dkimDomain,
+	}
+	if ctx.remoteIP != nil {
+		values[firstSeenClientIP] = ctx.remoteIP.String()
+	}
+	fields := []string{}
+	for _, kind := range []string{firstSeenSenderDomain, firstSeenDkimDomain, firstSeenClientIP} {
+		if values[kind] == "" {
+			continue
+		}
+		age, err := firstSeenAge(kind, values[kind], !ctx.replay)
+		if err != nil {
+			ctx.logError("newness - unable to get age of " + values[kind] + " - " + err.Error())
+			return
+		}
+		ctx.newness[kind] = age
+		fields = append(fields, fmt.Sprintf("%s=%s (%s)", kind, values[kind], firstSeenFormatAge(age)))
+	}
+	if len(fields) != 0 {
+		v.headers = append(v.headers, "X-Tmail-Newness: "+strings.Join(fields, "; "))
+	}
+
+	senderAge, ok := ctx.newness[firstSeenSenderDomain]
+	if !ok || !firstSeenIsNew(senderAge) {
+		return
+	}
+	if dkimAge, ok := ctx.newness[firstSeenDkimDomain]; ok && !firstSeenIsNew(dkimAge) {
+		return
+	}
+	action, err := parseSmtpdAction(Cfg.GetSmtpdNewnessAction())
+	if err != nil {
+		ctx.logError("newness - bad action in config - " + err.Error())
+		action = smtpdActionTag
+	}
+	v.action = action
+	v.reason = "new sender domain " + values[firstSeenSenderDomain]
+	v.reply = "451 4.7.1 new sender domain, please try again later"
+	if action == smtpdActionReject {
+		v.reply = "550 5.7.1 new sender domain"
+	}
+	return
+}
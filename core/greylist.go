@@ -0,0 +1,284 @@
+package core
+
+// Greylisting
+// On first contact from an unknown (client network, sender, recipient)
+// triplet smtpd replies 450. The triplet passes if the client retries after
+// smtpd_greylist_delay (and before smtpd_greylist_expire).
+// Networks (/24 for IPv4, /64 for IPv6) having passed
+// smtpd_greylist_auto_whitelist triplets are whitelisted. Networks
+// whitelisted by admins are cached one minute.
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// GreylistTriplet represents a greylisted triplet
+type GreylistTriplet struct {
+	Id        int64
+	Network   string
+	MailFrom  string
+	RcptTo    string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Passed    bool
+	Attempts  int
+}
+
+// greylistWhitelistCacheTTL is the max age of the cached networks
+// whitelisted by admins
+const greylistWhitelistCacheTTL = 1 * time.Minute
+
+var greylistWhitelistCache = struct {
+	sync.Mutex
+	networks []*net.IPNet
+	loadedAt time.Time
+}{}
+
+// GreylistWhitelist represents a whitelisted network
+type GreylistWhitelist struct {
+	Id        int64
+	Network   string `sql:"unique"`
+	Auto      bool   // added by auto whitelisting
+	AddedAt   time.Time
+	ExpiresAt time.Time // auto whitelisting only
+}
+
+// greylistNetwork returns network of ip (/24 for IPv4, /64 for IPv6)
+func greylistNetwork(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
+
+// greylistIsWhitelisted returns true if ip is in a whitelisted network
+// if strict is true, auto whitelisted networks are ignored
+func greylistIsWhitelisted(ip net.IP, strict bool) (bool, error) {
+	// auto whitelisting: network of ip
+	if !strict {
+		wl := GreylistWhitelist{}
+		err := DB.Where("network = ? AND auto = ?", greylistNetwork(ip), true).First(&wl).Error
+		if err != nil && err != gorm.RecordNotFound {
+			return false, err
+		}
+		if err == nil {
+			if time.Now().Before(wl.ExpiresAt) {
+				return true, nil
+			}
+			if err = DB.Delete(&wl).Error; err != nil {
+				return false, err
+			}
+		}
+	}
+	// networks whitelisted by admins
+	networks, err := greylistManualWhitelist()
+	if err != nil {
+		return false, err
+	}
+	for _, ipNet := range networks {
+		if ipNet.Contains(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// greylistManualWhitelist returns networks whitelisted by admins, they are
+// cached greylistWhitelistCacheTTL
+func greylistManualWhitelist() ([]*net.IPNet, error) {
+	greylistWhitelistCache.Lock()
+	defer greylistWhitelistCache.Unlock()
+	if time.Since(greylistWhitelistCache.loadedAt) > greylistWhitelistCacheTTL {
+		whitelist := []GreylistWhitelist{}
+		if err := DB.Where("auto = ?", false).Find(&whitelist).Error; err != nil && err != gorm.RecordNotFound {
+			return nil, err
+		}
+		networks := []*net.IPNet{}
+		for _, wl := range whitelist {
+			if _, ipNet, err := net.ParseCIDR(wl.Network); err == nil {
+				networks = append(networks, ipNet)
+			}
+		}
+		greylistWhitelistCache.networks, greylistWhitelistCache.loadedAt = networks, time.Now()
+	}
+	return greylistWhitelistCache.networks, nil
+}
+
+// greylistWhitelistReload forces a reload of networks whitelisted by admins
+func greylistWhitelistReload() {
+	greylistWhitelistCache.Lock()
+	greylistWhitelistCache.loadedAt = time.Time{}
+	greylistWhitelistCache.Unlock()
+}
+
+// greylistCheck returns true if triplet (ip, mailFrom, rcptTo) passes
+// if strict is true (new sender domain) auto whitelisting is ignored
+func greylistCheck(ip net.IP, mailFrom, rcptTo string, strict bool) (pass bool, err error) {
+	network := greylistNetwork(ip)
+	if pass, err = greylistIsWhitelisted(ip, strict); pass || err != nil {
+		return
+	}
+	now := time.Now()
+	t := GreylistTriplet{}
+	err = DB.Where("network = ? AND mail_from = ? AND rcpt_to = ?", network, strings.ToLower(mailFrom), strings.ToLower(rcptTo)).First(&t).Error
+	if err != nil && err != gorm.RecordNotFound {
+		return false, err
+	}
+	// new triplet (or expired)
+	if err == gorm.RecordNotFound || (!t.Passed && now.Sub(t.FirstSeen) > time.Duration(Cfg.GetSmtpdGreylistExpire())*time.Second) || (t.Passed && now.Sub(t.LastSeen) > time.Duration(Cfg.GetSmtpdGreylistPassedTtl())*24*time.Hour) {
+		t.Network, t.MailFrom, t.RcptTo = network, strings.ToLower(mailFrom), strings.ToLower(rcptTo)
+		t.FirstSeen, t.LastSeen, t.Passed, t.Attempts = now, now, false, 1
+		return false, DB.Save(&t).Error
+	}
+	t.LastSeen = now
+	t.Attempts++
+	if t.Passed {
+		return true, DB.Save(&t).Error
+	}
+	if now.Sub(t.FirstSeen) < time.Duration(Cfg.GetSmtpdGreylistDelay())*time.Second {
+		return false, DB.Save(&t).Error
+	}
+	t.Passed = true
+	if err = DB.Save(&t).Error; err != nil {
+		return
+	}
+	if strict {
+		return true, nil
+	}
+	return true, greylistAutoWhitelist(network)
+}
+
+// greylistAutoWhitelist whitelists network if it has passed enough triplets
+func greylistAutoWhitelist(network string) error {
+	threshold := Cfg.GetSmtpdGreylistAutoWhitelist()
+	if threshold == 0 {
+		return nil
+	}
+	var count int
+	if err := DB.Model(GreylistTriplet{}).Where("network = ? AND passed = ?", network, true).Count(&count).Error; err != nil {
+		return err
+	}
+	if count < threshold {
+		return nil
+	}
+	Log.Info("greylist - network " + network + " auto whitelisted")
+	return DB.Create(&GreylistWhitelist{
+		Network:   network,
+		Auto:      true,
+		AddedAt:   time.Now(),
+		ExpiresAt: time.Now().Add(time.Duration(Cfg.GetSmtpdGreylistPassedTtl()) * 24 * time.Hour),
+	}).Error
+}
+
+// smtpGreylist greylists rcptTo for current session
+// it returns true if rcpt is greylisted (reply has been sent)
+func (s *SMTPServerSession) smtpGreylist(rcptTo string) bool {
+	if !Cfg.GetSmtpdGreylistEnabled() || s.isTrusted() {
+		return false
+	}
+	ip := s.remoteIP()
+	if ip == nil {
+		return false
+	}
+	pass, err := greylistCheck(ip, s.envelope.MailFrom, rcptTo, s.senderDomainIsNew())
+	if err != nil {
+		s.logError("RCPT - greylist check failed - " + err.Error())
+		return false
+	}
+	if pass {
+		return false
+	}
+	v := smtpdVerdict{
+		check:  "greylist",
+		action: smtpdActionTempfail,
+		reply:  "450 4.7.1 Greylisted, please try again later",
+		reason: "greylisted " + greylistNetwork(ip) + " " + s.envelope.MailFrom + " " + rcptTo,
+	}
+	if isShadowCheck(v.check) {
+		s.shadowRecord(v)
+		return false
+	}
+	s.log("RCPT - " + v.reason)
+	s.out(v.reply)
+	return true
+}
+
+// GreylistList returns greylisted triplets
+func GreylistList() (triplets []GreylistTriplet, err error) {
+	triplets = []GreylistTriplet{}
+	err = DB.Order("id asc").Find(&triplets).Error
+	return
+}
+
+// GreylistFlush removes expired triplets and auto whitelisted networks (all
+// triplets if all is true)
+func GreylistFlush(all bool) error {
+	if all {
+		return DB.Delete(GreylistTriplet{}).Error
+	}
+	now := time.Now()
+	if err := DB.Where("passed = ? AND first_seen < ?", false, now.Add(-time.Duration(Cfg.GetSmtpdGreylistExpire())*time.Second)).Delete(GreylistTriplet{}).Error; err != nil {
+		return err
+	}
+	passedTtl := time.Duration(Cfg.GetSmtpdGreylistPassedTtl()) * 24 * time.Hour
+	if err := DB.Where("passed = ? AND last_seen < ?", true, now.Add(-passedTtl)).Delete(GreylistTriplet{}).Error; err != nil {
+		return err
+	}
+	return DB.Where("auto = ? AND expires_at < ?", true, now).Delete(GreylistWhitelist{}).Error
+}
+
+// greylistParseNetwork returns network (IP or CIDR) in CIDR notation
+func greylistParseNetwork(network string) (string, error) {
+	network = strings.TrimSpace(network)
+	if ip := net.ParseIP(network); ip != nil {
+		if ip.To4() != nil {
+			network += "/32"
+		} else {
+			network += "/128"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(network)
+	if err != nil {
+		return "", errors.New("bad network " + network)
+	}
+	return ipNet.String(), nil
+}
+
+// GreylistWhitelistAdd whitelists network (IP or CIDR)
+func GreylistWhitelistAdd(network string) error {
+	network, err := greylistParseNetwork(network)
+	if err != nil {
+		return err
+	}
+	wl := GreylistWhitelist{}
+	err = DB.Where("network = ?", network).First(&wl).Error
+	if err != nil && err != gorm.RecordNotFound {
+		return err
+	}
+	wl.Network, wl.Auto, wl.AddedAt = network, false, time.Now()
+	defer greylistWhitelistReload()
+	return DB.Save(&wl).Error
+}
+
+// GreylistWhitelistDel removes network (IP or CIDR) from whitelist
+func GreylistWhitelistDel(network string) error {
+	network, err := greylistParseNetwork(network)
+	if err != nil {
+		return err
+	}
+	defer greylistWhitelistReload()
+	return DB.Where("network = ?", network).Delete(GreylistWhitelist{}).Error
+}
+
+// GreylistWhitelistList returns whitelisted networks
+func GreylistWhitelistList() (whitelist []GreylistWhitelist, err error) {
+	whitelist = []GreylistWhitelist{}
+	err = DB.Order("id asc").Find(&whitelist).Error
+	return
+}
@@ -0,0 +1,381 @@
+package core
+
+// Groups (distribution addresses)
+// A group is a local address expanded to its members by deliverd. Posting is
+// restricted by the group policy: anyone, members or owners (address of
+// envelope sender or of From header), it's enforced by smtpd at the end of
+// DATA (5.7.1) so denied messages are never bounced to forgeable senders.
+// Copies have their subject prefixed (SubjectPrefix), Reply-To set to the
+// group (ReplyToGroup) and List-Id, List-Post & List-Unsubscribe headers
+// (RFC 2919, RFC 2369). They are sent with first owner as envelope sender
+// (bounces go to owners), or with the group address if it has no owner,
+// the X-Tmail-Group header stops loops. A minilist alias (Alias.IsMiniList)
+// is delivered as a group without owner whose members are its DeliverTo.
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/toorop/tmail/message"
+)
+
+// groups posting policies
+const (
+	GroupPolicyAnyone  = "anyone"
+	GroupPolicyMembers = "members"
+	GroupPolicyOwners  = "owners"
+)
+
+// header added to copies of group messages
+const groupHeader = "X-Tmail-Group"
+
+// MailGroup represents a group address
+type MailGroup struct {
+	Id            int64
+	Address       string `sql:"unique"`
+	Description   string
+	Policy        string // anyone, members or owners
+	SubjectPrefix string
+	ReplyToGroup  bool
+	Unsubscribe   string // List-Unsubscribe URL (mailto: first owner if empty)
+	CreatedAt     time.Time
+}
+
+// MailGroupMember represents a member of a group
+type MailGroupMember struct {
+	Id      int64
+	GroupId int64
+	Address string
+	IsOwner bool
+}
+
+// mailGroupCheck normalizes & checks options of group
+func mailGroupCheck(group *MailGroup) error {
+	group.Policy = strings.ToLower(strings.TrimSpace(group.Policy))
+	switch group.Policy {
+	case "":
+		group.Policy = GroupPolicyAnyone
+	case GroupPolicyAnyone, GroupPolicyMembers, GroupPolicyOwners:
+	default:
+		return errors.New("policy must be " + GroupPolicyAnyone + ", " + GroupPolicyMembers + " or " + GroupPolicyOwners)
+	}
+	group.Description = strings.TrimSpace(group.Description)
+	group.SubjectPrefix = strings.TrimSpace(group.SubjectPrefix)
+	group.Unsubscribe = strings.TrimSpace(group.Unsubscribe)
+	if group.Unsubscribe != "" {
+		u, err := url.Parse(group.Unsubscribe)
+		if err != nil || (u.Scheme != "mailto" && u.Scheme != "http" && u.Scheme != "https") {
+			return errors.New("bad unsubscribe URL " + group.Unsubscribe + ", mailto, http or https URL expected")
+		}
+	}
+	return nil
+}
+
+// MailGroupAdd adds group
+func MailGroupAdd(group MailGroup) (MailGroup, error) {
+	a, err := mail.ParseAddress(strings.TrimSpace(group.Address))
+	if err != nil || strings.Count(a.Address, "@") != 1 {
+		return group, errors.New("bad group address " + group.Address)
+	}
+	group.Address = strings.ToLower(a.Address)
+	domain := strings.Split(group.Address, "@")[1]
+	rcpthost, err := RcpthostGet(domain)
+	if err != nil {
+		if err == gorm.RecordNotFound {
+			return group, errors.New("domain " + domain + " is not handled by tmail")
+		}
+		return group, err
+	}
+	if !rcpthost.IsLocal {
+		return group, errors.New("domain part of group must be a local domain handled by tmail")
+	}
+	if err = mailGroupCheck(&group); err != nil {
+		return group, err
+	}
+	// address must be free
+	if _, err = MailGroupGet(group.Address); err != gorm.RecordNotFound {
+		if err == nil {
+			err = errors.New(group.Address + " already exists")
+		}
+		return group, err
+	}
+	for _, exists := range []func(string) (bool, error){UserExists, AliasExists} {
+		found, err := exists(group.Address)
+		if err != nil {
+			return group, err
+		}
+		if found {
+			return group, errors.New(group.Address + " is an existing user or alias")
+		}
+	}
+	group.Id = 0
+	group.CreatedAt = time.Now()
+	err = DB.Create(&group).Error
+	return group, err
+}
+
+// MailGroupUpdate updates options of group address
+func MailGroupUpdate(address string, options MailGroup) (MailGroup, error) {
+	group, err := MailGroupGet(address)
+	if err != nil {
+		return group, err
+	}
+	group.Description = options.Description
+	group.Policy = options.Policy
+	group.SubjectPrefix = options.SubjectPrefix
+	group.ReplyToGroup = options.ReplyToGroup
+	group.Unsubscribe = options.Unsubscribe
+	if err = mailGroupCheck(&group); err != nil {
+		return group, err
+	}
+	err = DB.Save(&group).Error
+	return group, err
+}
+
+// MailGroupGet returns group address
+func MailGroupGet(address string) (group MailGroup, err error) {
+	err = DB.Where("address = ?", strings.ToLower(address)).First(&group).Error
+	return
+}
+
+// MailGroupDel removes group address and its members
+func MailGroupDel(address string) error {
+	group, err := MailGroupGet(address)
+	if err != nil {
+		return err
+	}
+	tx := DB.Begin()
+	if err = tx.Where("group_id = ?", group.Id).Delete(&MailGroupMember{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Delete(&group).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// MailGroupList returns groups
+func MailGroupList() (groups []MailGroup, err error) {
+	groups = []MailGroup{}
+	err = DB.Order("address").Find(&groups).Error
+	return
+}
+
+// MailGroupMembers returns members of group address
+func MailGroupMembers(address string) (members []MailGroupMember, err error) {
+	members = []MailGroupMember{}
+	group, err := MailGroupGet(address)
+	if err != nil {
+		return
+	}
+	err = DB.Where("group_id = ?", group.Id).Order("id").Find(&members).Error
+	return
+}
+
+// MailGroupMemberAdd adds member to group address (or updates its owner
+// flag)
+func MailGroupMemberAdd(address, member string, isOwner bool) (MailGroupMember, error) {
+	m := MailGroupMember{}
+	group, err := MailGroupGet(address)
+	if err != nil {
+		return m, err
+	}
+	a, err := mail.ParseAddress(strings.TrimSpace(member))
+	if err != nil || strings.Count(a.Address, "@") != 1 {
+		return m, errors.New("bad member address " + member)
+	}
+	member = strings.ToLower(a.Address)
+	if member == group.Address {
+		return m, errors.New("a group can't be a member of itself")
+	}
+	err = DB.Where("group_id = ? and address = ?", group.Id, member).First(&m).Error
+	if err != nil && err != gorm.RecordNotFound {
+		return m, err
+	}
+	m.GroupId, m.Address, m.IsOwner = group.Id, member, isOwner
+	err = DB.Save(&m).Error
+	return m, err
+}
+
+// MailGroupMemberDel removes member of group address
+func MailGroupMemberDel(address, member string) error {
+	group, err := MailGroupGet(address)
+	if err != nil {
+		return err
+	}
+	m := MailGroupMember{}
+	if err = DB.Where("group_id = ? and address = ?", group.Id, strings.ToLower(strings.TrimSpace(member))).First(&m).Error; err != nil {
+		return err
+	}
+	return DB.Delete(&m).Error
+}
+
+// mailGroupPostAllowed returns true if one of senders can post to group
+func mailGroupPostAllowed(group *MailGroup, members []MailGroupMember, senders ...string) bool {
+	if group.Policy == GroupPolicyAnyone {
+		return true
+	}
+	for _, m := range members {
+		if group.Policy == GroupPolicyOwners && !m.IsOwner {
+			continue
+		}
+		for _, sender := range senders {
+			if sender != "" && strings.EqualFold(sender, m.Address) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mailGroupPostDenied returns groups among rcpts which senders are not
+// allowed to post to
+func mailGroupPostDenied(rcpts []string, senders ...string) (denied []string, err error) {
+	groups := []MailGroup{}
+	if err = DB.Where("address IN (?)", rcpts).Find(&groups).Error; err != nil {
+		if err == gorm.RecordNotFound {
+			err = nil
+		}
+		return
+	}
+	for i := range groups {
+		if groups[i].Policy == GroupPolicyAnyone {
+			continue
+		}
+		members := []MailGroupMember{}
+		if err = DB.Where("group_id = ?", groups[i].Id).Find(&members).Error; err != nil && err != gorm.RecordNotFound {
+			return nil, err
+		}
+		if !mailGroupPostAllowed(&groups[i], members, senders...) {
+			denied = append(denied, groups[i].Address)
+		}
+	}
+	return denied, nil
+}
+
+// smtpdGroupPost rejects message raw if its senders are not allowed to post
+// to one of the groups of the envelope, it returns true if message is
+// rejected
+func (s *SMTPServerSession) smtpdGroupPost(raw *[]byte) bool {
+	from := ""
+	if a, err := mail.ParseAddress(message.RawGetHeaderValue(raw, "from")); err == nil {
+		from = a.Address
+	}
+	denied, err := mailGroupPostDenied(s.envelope.RcptTo, s.envelope.MailFrom, from)
+	if err != nil {
+		s.logError("DATA - unable to check posting policy of groups. " + err.Error())
+		s.out("451 4.3.0 oops, problem with groups")
+		return true
+	}
+	if len(denied) == 0 {
+		return false
+	}
+	s.log("DATA - " + s.envelope.MailFrom + " is not allowed to post to group(s) " + strings.Join(denied, " "))
+	metricsMessage(smtpdActionReject, "group")
+	s.traceMessage(TraceFiltered, 0, "group - posting denied")
+	s.out("550 5.7.1 Sorry, you are not allowed to post to " + denied[0])
+	return true
+}
+
+// mailGroupHeaders sets group headers of copies of raw message
+func mailGroupHeaders(group *MailGroup, owner string, raw *[]byte) {
+	for _, header := range []string{"list-id", "list-post", "list-unsubscribe", "precedence"} {
+		rawRemoveHeader(raw, header)
+	}
+	if group.SubjectPrefix != "" {
+		subject := message.RawGetHeaderValue(raw, "subject")
+		if !strings.Contains(subject, group.SubjectPrefix) {
+			rawRemoveHeader(raw, "subject")
+			prependHeader(raw, strings.TrimSpace("Subject: "+group.SubjectPrefix+" "+subject))
+		}
+	}
+	if group.ReplyToGroup {
+		rawRemoveHeader(raw, "reply-to")
+		prependHeader(raw, "Reply-To: <"+group.Address+">")
+	}
+	unsubscribe := group.Unsubscribe
+	if unsubscribe == "" && owner != "" {
+		unsubscribe = "mailto:" + owner + "?subject=" + url.QueryEscape("unsubscribe "+group.Address)
+	}
+	if unsubscribe != "" {
+		prependHeader(raw, "List-Unsubscribe: <"+unsubscribe+">")
+	}
+	if group.Policy == GroupPolicyAnyone {
+		prependHeader(raw, "List-Post: <mailto:"+group.Address+">")
+	} else {
+		prependHeader(raw, "List-Post: NO")
+	}
+	listId := "<" + strings.Replace(group.Address, "@", ".", 1) + ">"
+	if group.Description != "" {
+		listId = group.Description + " " + listId
+	}
+	prependHeader(raw, "List-Id: "+listId)
+	prependHeader(raw, "Precedence: list")
+	prependHeader(raw, groupHeader+": "+group.Address)
+}
+
+// deliverGroup expands group rcpt of delivery d to its members
+func deliverGroup(d *delivery, group *MailGroup) {
+	// loop
+	for _, field := range message.RawGetHeaderFields(d.rawData) {
+		p := strings.Index(field, ":")
+		if p != -1 && strings.EqualFold(field[:p], groupHeader) && strings.EqualFold(strings.TrimSpace(field[p+1:]), group.Address) {
+			d.diePerm(fmt.Sprintf("delivery-local %s: loop detected, message has already been sent to group %s", d.id, group.Address), true)
+			return
+		}
+	}
+	members, err := MailGroupMembers(group.Address)
+	if err != nil {
+		d.dieTemp(fmt.Sprintf("delivery-local %s: unable to get members of group %s. %s", d.id, group.Address, err), true)
+		return
+	}
+	// policy is enforced by smtpd, messages requeued by deliverd (aliases)
+	// are discarded, a bounce would go to a forgeable sender
+	from := ""
+	if a, err := mail.ParseAddress(message.RawGetHeaderValue(d.rawData, "from")); err == nil {
+		from = a.Address
+	}
+	if !mailGroupPostAllowed(group, members, d.qMsg.MailFrom, from) {
+		d.log.Info(fmt.Sprintf("delivery-local %s: %s is not allowed to post to group %s (policy %s)", d.id, d.qMsg.MailFrom, group.Address, group.Policy))
+		d.discard()
+		return
+	}
+	mailGroupRequeue(d, group, members)
+}
+
+// mailGroupRequeue queues copies of message of delivery d for members of
+// group
+func mailGroupRequeue(d *delivery, group *MailGroup, members []MailGroupMember) {
+	rcpts, owner := []string{}, ""
+	for _, m := range members {
+		rcpts = append(rcpts, m.Address)
+		if m.IsOwner && owner == "" {
+			owner = m.Address
+		}
+	}
+	if len(rcpts) == 0 {
+		d.log.Info(fmt.Sprintf("delivery-local %s: group %s has no member", d.id, group.Address))
+		d.dieOk()
+		return
+	}
+	raw := append([]byte{}, *d.rawData...)
+	mailGroupHeaders(group, owner, &raw)
+	envelope := message.Envelope{MailFrom: group.Address, RcptTo: rcpts}
+	if owner != "" {
+		envelope.MailFrom = owner
+	}
+	uuid, err := QueueAddMessage(&raw, envelope, "")
+	if err != nil {
+		d.dieTemp(fmt.Sprintf("delivery-local %s: unable to queue copies for group %s: %s", d.id, group.Address, err), true)
+		return
+	}
+	d.log.Info(fmt.Sprintf("delivery-local %s: rcpt is group %s, mail is requeue with ID %s for %d members", d.id, group.Address, uuid, len(rcpts)))
+	d.dieOk()
+}
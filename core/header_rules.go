@@ -0,0 +1,315 @@
+package core
+
+// Header rules
+// Header rules rewrite messages accepted by smtpd before they are queued
+// (after journaling and the Received header of tmail): add, remove or
+// replace headers, rewrite the domain of From addresses, append a
+// disclaimer. A rule applies to the messages of a listener, of an
+// authenticated user, of a sender domain and/or to a recipient domain.
+// Rules are stored in DB, applied by priority and reloaded every
+// headerRulesCacheTTL or on SIGHUP (tmail headers reload).
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toorop/tmail/message"
+)
+
+// header rules actions
+const (
+	HeaderActionAdd        = "add"         // adds Header: Value
+	HeaderActionRemove     = "remove"      // removes Header fields (whose value matches Match)
+	HeaderActionReplace    = "replace"     // replaces Header fields by Header: Value
+	HeaderActionFromDomain = "from-domain" // rewrites domain of From addresses to Value
+	HeaderActionDisclaimer = "disclaimer"  // appends Value to body
+)
+
+// listener of header rules matching submission listeners
+const headerRuleSubmission = "submission"
+
+// header rules are reloaded from DB with this interval
+const headerRulesCacheTTL = 1 * time.Minute
+
+// HeaderRule represents a header rewriting rule
+// Empty matching fields match all messages
+type HeaderRule struct {
+	Id           int64
+	Priority     int    // rules are applied by priority, then by id
+	Listener     string // ip:port, :port or submission
+	AuthUser     string // login, * for authenticated users, - for others
+	SenderDomain string
+	RcptDomain   string // domain of one of the recipients
+	Action       string
+	Header       string
+	Value        string
+	Match        string // regexp on values of headers to remove
+	CreatedAt    time.Time
+}
+
+var headerRulesCache = struct {
+	sync.Mutex
+	rules    []HeaderRule
+	loadedAt time.Time
+}{}
+
+// HeaderRuleAdd adds a header rule
+func HeaderRuleAdd(rule HeaderRule) (HeaderRule, error) {
+	rule.Action = strings.ToLower(strings.TrimSpace(rule.Action))
+	rule.Header = strings.TrimSpace(rule.Header)
+	rule.Listener = strings.ToLower(strings.TrimSpace(rule.Listener))
+	rule.AuthUser = strings.ToLower(strings.TrimSpace(rule.AuthUser))
+	rule.SenderDomain = strings.ToLower(strings.TrimSpace(rule.SenderDomain))
+	rule.RcptDomain = strings.ToLower(strings.TrimSpace(rule.RcptDomain))
+	switch rule.Action {
+	case HeaderActionAdd, HeaderActionRemove, HeaderActionReplace:
+		if rule.Header == "" || strings.ContainsAny(rule.Header, ": \t\r\n") {
+			return rule, errors.New("bad header name " + rule.Header)
+		}
+		if rule.Action != HeaderActionRemove && rule.Value == "" {
+			return rule, errors.New("value of header " + rule.Header + " is missing")
+		}
+	case HeaderActionFromDomain, HeaderActionDisclaimer:
+		if rule.Value == "" {
+			return rule, errors.New("value is missing (domain or disclaimer)")
+		}
+	default:
+		return rule, errors.New("action must be " + HeaderActionAdd + ", " + HeaderActionRemove + ", " + HeaderActionReplace + ", " + HeaderActionFromDomain + " or " + HeaderActionDisclaimer)
+	}
+	if strings.ContainsAny(rule.Value, "\r\n") && rule.Action != HeaderActionDisclaimer {
+		return rule, errors.New("value must be a single line")
+	}
+	if rule.Match != "" {
+		if rule.Action != HeaderActionRemove {
+			return rule, errors.New("match is only used by " + HeaderActionRemove)
+		}
+		if _, err := regexp.Compile(rule.Match); err != nil {
+			return rule, errors.New("bad match regexp - " + err.Error())
+		}
+	}
+	if rule.Listener != "" && rule.Listener != headerRuleSubmission {
+		if _, _, err := net.SplitHostPort(rule.Listener); err != nil {
+			return rule, errors.New("bad listener " + rule.Listener + " (ip:port, :port or " + headerRuleSubmission + " expected)")
+		}
+	}
+	rule.Id = 0
+	rule.CreatedAt = time.Now()
+	if err := DB.Create(&rule).Error; err != nil {
+		return rule, err
+	}
+	HeaderRulesReload()
+	return rule, nil
+}
+
+// HeaderRuleDel removes header rule id
+func HeaderRuleDel(id int64) error {
+	rule := HeaderRule{}
+	if err := DB.Where("id = ?", id).First(&rule).Error; err != nil {
+		return err
+	}
+	if err := DB.Delete(&rule).Error; err != nil {
+		return err
+	}
+	HeaderRulesReload()
+	return nil
+}
+
+// HeaderRuleList returns header rules in the order they are applied
+func HeaderRuleList() (rules []HeaderRule, err error) {
+	rules = []HeaderRule{}
+	err = DB.Order("priority, id").Find(&rules).Error
+	return
+}
+
+// HeaderRulesReload forces a reload of header rules
+func HeaderRulesReload() {
+	headerRulesCache.Lock()
+	headerRulesCache.loadedAt = time.Time{}
+	headerRulesCache.Unlock()
+}
+
+// headerRules returns header rules (cached)
+func headerRules() []HeaderRule {
+	headerRulesCache.Lock()
+	defer headerRulesCache.Unlock()
+	if time.Since(headerRulesCache.loadedAt) > headerRulesCacheTTL {
+		rules, err := HeaderRuleList()
+		if err != nil {
+			Log.Error("header rules - unable to get header rules - " + err.Error())
+			return headerRulesCache.rules
+		}
+		headerRulesCache.rules, headerRulesCache.loadedAt = rules, time.Now()
+	}
+	return headerRulesCache.rules
+}
+
+// headerRuleMatch returns true if rule applies to current transaction
+func (s *SMTPServerSession) headerRuleMatch(rule HeaderRule) bool {
+	switch rule.Listener {
+	case "":
+	case headerRuleSubmission:
+		if !s.submission {
+			return false
+		}
+	default:
+		if !listenerMatch(rule.Listener, s.conn.LocalAddr()) {
+			return false
+		}
+	}
+	switch rule.AuthUser {
+	case "":
+	case "*":
+		if s.user == nil {
+			return false
+		}
+	case "-":
+		if s.user != nil {
+			return false
+		}
+	default:
+		if s.user == nil || strings.ToLower(s.user.Login) != rule.AuthUser {
+			return false
+		}
+	}
+	if rule.SenderDomain != "" && journalDomain(s.envelope.MailFrom) != rule.SenderDomain {
+		return false
+	}
+	if rule.RcptDomain == "" {
+		return true
+	}
+	for _, rcpt := range s.envelope.RcptTo {
+		if journalDomain(rcpt) == rule.RcptDomain {
+			return true
+		}
+	}
+	return false
+}
+
+// headerRulesApply applies header rules matching current transaction to
+// raw message
+func (s *SMTPServerSession) headerRulesApply(raw *[]byte) {
+	for _, rule := range headerRules() {
+		if !s.headerRuleMatch(rule) {
+			continue
+		}
+		if err := headerRuleApply(rule, raw); err != nil {
+			s.logError("MAIL - header rule " + strconv.FormatInt(rule.Id, 10) + " not applied - " + err.Error())
+			continue
+		}
+		s.logDebug("MAIL - header rule " + strconv.FormatInt(rule.Id, 10) + " applied (" + rule.Action + ")")
+	}
+}
+
+// headerFieldName returns name of header field (lower case)
+func headerFieldName(field string) string {
+	if p := strings.Index(field, ":"); p != -1 {
+		return strings.ToLower(strings.TrimSpace(field[:p]))
+	}
+	return ""
+}
+
+// headerFieldValue returns unfolded value of header field
+func headerFieldValue(field string) string {
+	value := field[strings.Index(field, ":")+1:]
+	return strings.TrimSpace(strings.NewReplacer("\r\n", "", "\n", "").Replace(value))
+}
+
+// headerField returns folded header field name: value
+func headerField(name, value string) string {
+	h := []byte(name + ": " + value)
+	message.FoldHeader(&h)
+	return string(h)
+}
+
+// headerRuleApply applies rule to raw message
+func headerRuleApply(rule HeaderRule, raw *[]byte) error {
+	if rule.Action == HeaderActionDisclaimer {
+		return headerDisclaimer(raw, rule.Value)
+	}
+	name := strings.ToLower(rule.Header)
+	var match *regexp.Regexp
+	if rule.Match != "" {
+		var err error
+		if match, err = regexp.Compile(rule.Match); err != nil {
+			return err
+		}
+	}
+	fields, kept, position := message.RawGetHeaderFields(raw), []string{}, -1
+	for _, field := range fields {
+		switch {
+		case rule.Action == HeaderActionFromDomain && headerFieldName(field) == "from":
+			addresses, err := mail.ParseAddressList(headerFieldValue(field))
+			if err != nil {
+				return errors.New("unable to parse From - " + err.Error())
+			}
+			rewritten := []string{}
+			for _, a := range addresses {
+				a.Address = a.Address[:strings.LastIndex(a.Address, "@")+1] + rule.Value
+				rewritten = append(rewritten, a.String())
+			}
+			kept = append(kept, headerField("From", strings.Join(rewritten, ", ")))
+		case (rule.Action == HeaderActionRemove || rule.Action == HeaderActionReplace) && headerFieldName(field) == name:
+			if match != nil && !match.MatchString(headerFieldValue(field)) {
+				kept = append(kept, field)
+			} else if position == -1 {
+				position = len(kept)
+			}
+		default:
+			kept = append(kept, field)
+		}
+	}
+	switch rule.Action {
+	case HeaderActionAdd:
+		kept = append([]string{headerField(rule.Header, rule.Value)}, kept...)
+	case HeaderActionReplace:
+		if position == -1 {
+			position = 0
+		}
+		kept = append(kept[:position], append([]string{headerField(rule.Header, rule.Value)}, kept[position:]...)...)
+	}
+	message.RawSetHeaderFields(raw, kept)
+	return nil
+}
+
+// headerDisclaimer appends text to body of raw message (text/plain or
+// multipart/mixed, a text/plain part is added)
+func headerDisclaimer(raw *[]byte, text string) error {
+	mediaType, params := "text/plain", map[string]string{}
+	if ct := message.RawGetHeaderValue(raw, "content-type"); ct != "" {
+		var err error
+		if mediaType, params, err = mime.ParseMediaType(ct); err != nil {
+			return errors.New("unable to parse Content-Type - " + err.Error())
+		}
+	}
+	text = strings.Replace(strings.Replace(text, "\r\n", "\n", -1), "\n", "\r\n", -1)
+	switch {
+	case mediaType == "text/plain":
+		if strings.ToLower(message.RawGetHeaderValue(raw, "content-transfer-encoding")) == "base64" {
+			return errors.New("disclaimer can't be added to base64 encoded body")
+		}
+		if !bytes.HasSuffix(*raw, []byte("\r\n")) {
+			*raw = append(*raw, 13, 10)
+		}
+		*raw = append(*raw, []byte("\r\n"+text+"\r\n")...)
+	case mediaType == "multipart/mixed" && params["boundary"] != "":
+		end := []byte("\r\n--" + params["boundary"] + "--")
+		p := bytes.LastIndex(*raw, end)
+		if p == -1 {
+			return errors.New("end of multipart body not found")
+		}
+		part := fmt.Sprintf("\r\n--%s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n%s", params["boundary"], text)
+		*raw = append((*raw)[:p], append([]byte(part), (*raw)[p:]...)...)
+	default:
+		return errors.New("disclaimer can't be added to " + mediaType + " messages")
+	}
+	return nil
+}
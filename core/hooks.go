@@ -0,0 +1,266 @@
+package core
+
+// In-process hooks
+// Programs embedding tmail register Go funcs which are called at phases of
+// SMTP sessions and deliveries (RegisterHook, RegisterSmtpdConnectHook and
+// RegisterSmtpdDataHook are shortcuts for the CONNECT and DATA phases) and
+// with delivery events (the events of webhooks).
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/toorop/tmail/message"
+)
+
+// HookReply is the reply of a smtpd hook, if Code is not 0 the SMTP
+// transaction is refused with Code & Msg (and connection is closed if Close
+// is true)
+type HookReply struct {
+	Code  int
+	Msg   string
+	Close bool
+}
+
+// SmtpdConnectHook is called when a client connects, before greeting
+type SmtpdConnectHook func(sessionId, remoteAddr string) HookReply
+
+// SmtpdDataHook is called with the message received by DATA/BDAT, before
+// queueing. extraHeaders are prepended to message
+type SmtpdDataHook func(sessionId string, envelope message.Envelope, rawMessage []byte) (reply HookReply, extraHeaders []string)
+
+// EventHook is called with delivery events (accepted, delivered...)
+type EventHook func(e WebhookEvent)
+
+// HookPhase is a phase of SMTP sessions (or of deliveries) where hooks
+// registered by RegisterHook are called
+type HookPhase int
+
+const (
+	// HookConnect: client connects, before greeting
+	HookConnect HookPhase = iota
+	// HookHelo: HELO/EHLO, Helo may be rewritten
+	HookHelo
+	// HookMail: MAIL, sender (Envelope.MailFrom) may be rewritten
+	HookMail
+	// HookRcpt: RCPT, before relay checks, Rcpt may be rewritten
+	HookRcpt
+	// HookData: message received, after checks and milters, message may be
+	// rewritten and headers added
+	HookData
+	// HookQueue: final message (Received, header rules), before queueing,
+	// message may be rewritten and headers added
+	HookQueue
+	// HookDelivery: before each delivery attempt of a queued message to
+	// Rcpt, a 4xx reply defers it and a 5xx one bounces it. Message, which
+	// may be shared by recipients delivered in the same transaction, is read
+	// only and Metadata is the one stored with the queued message.
+	HookDelivery
+)
+
+var hookPhaseNames = []string{"connect", "helo", "mail", "rcpt", "data", "queue", "delivery"}
+
+// String returns name of phase
+func (p HookPhase) String() string {
+	if p < 0 || int(p) >= len(hookPhaseNames) {
+		return fmt.Sprintf("phase %d", p)
+	}
+	return hookPhaseNames[p]
+}
+
+// SMTPSession is the SMTP session (or the delivery) given to hooks of a
+// phase. Fields which are not rewritable in phase are copies: changes are
+// ignored.
+type SMTPSession struct {
+	Phase      HookPhase
+	SessionId  string // smtpd session ("" if message has not been received by smtpd)
+	RemoteAddr string
+	LocalAddr  string
+	Helo       string
+	TLS        bool
+	AuthUser   string // authenticated user ("" if none)
+	Envelope   message.Envelope
+	// Rcpt is the recipient of RCPT and DELIVERY phases
+	Rcpt string
+	// Metadata are kept for the session and stored with messages it queues
+	// (given to DELIVERY hooks)
+	Metadata map[string]string
+	// Headers are added to message (DATA & QUEUE phases)
+	Headers []string
+	message *[]byte
+}
+
+// Message returns reader of message (nil before DATA phase)
+func (s *SMTPSession) Message() io.Reader {
+	if s.message == nil {
+		return nil
+	}
+	return bytes.NewReader(*s.message)
+}
+
+// SetMessage replaces message by raw (DATA & QUEUE phases), raw must be a
+// complete message (headers and body, CRLF line endings)
+func (s *SMTPSession) SetMessage(raw []byte) {
+	if s.message == nil || (s.Phase != HookData && s.Phase != HookQueue) {
+		return
+	}
+	*s.message = raw
+}
+
+// Hook is called at phase of SMTP sessions (or deliveries) it's registered
+// for, if Code of reply is not 0 the command (or the delivery) is refused
+type Hook func(s *SMTPSession) HookReply
+
+var hooks = struct {
+	sync.RWMutex
+	event  []EventHook
+	phases map[HookPhase][]Hook
+}{
+	phases: make(map[HookPhase][]Hook),
+}
+
+// RegisterHook registers h called at phase, hooks of a phase are called in
+// order of registration until one of them refuses
+func RegisterHook(phase HookPhase, h Hook) {
+	hooks.Lock()
+	hooks.phases[phase] = append(hooks.phases[phase], h)
+	hooks.Unlock()
+}
+
+// hooksOf returns hooks registered for phase
+func hooksOf(phase HookPhase) []Hook {
+	hooks.RLock()
+	defer hooks.RUnlock()
+	return hooks.phases[phase]
+}
+
+// RegisterSmtpdConnectHook registers h as a hook of HookConnect
+func RegisterSmtpdConnectHook(h SmtpdConnectHook) {
+	RegisterHook(HookConnect, func(s *SMTPSession) HookReply {
+		return h(s.SessionId, s.RemoteAddr)
+	})
+}
+
+// RegisterSmtpdDataHook registers h as a hook of HookData, its extra headers
+// are headers of the phase
+func RegisterSmtpdDataHook(h SmtpdDataHook) {
+	RegisterHook(HookData, func(s *SMTPSession) HookReply {
+		reply, extraHeaders := h(s.SessionId, s.Envelope, *s.message)
+		s.Headers = append(s.Headers, extraHeaders...)
+		return reply
+	})
+}
+
+// RegisterEventHook registers h, it's called even if webhooks are disabled
+// and must not block
+func RegisterEventHook(h EventHook) {
+	hooks.Lock()
+	hooks.event = append(hooks.event, h)
+	hooks.Unlock()
+}
+
+// hookReply sends reply r to client, returns true if transaction is refused
+func (s *SMTPServerSession) hookReply(r HookReply) (stop bool) {
+	if r.Code == 0 {
+		return false
+	}
+	outMsg := fmt.Sprintf("%d %s", r.Code, r.Msg)
+	s.log("hook smtp response: " + outMsg)
+	s.out(outMsg)
+	if r.Close {
+		s.exitAsap()
+	}
+	return true
+}
+
+// hooksEvent calls Event hooks
+func hooksEvent(e WebhookEvent) {
+	hooks.RLock()
+	registered := hooks.event
+	hooks.RUnlock()
+	for _, h := range registered {
+		h(e)
+	}
+}
+
+// hookSession returns view of s given to hooks of phase
+func (s *SMTPServerSession) hookSession(phase HookPhase) *SMTPSession {
+	if s.hookMetadata == nil {
+		s.hookMetadata = make(map[string]string)
+	}
+	hs := &SMTPSession{
+		Phase:      phase,
+		SessionId:  s.uuid,
+		RemoteAddr: s.conn.RemoteAddr().String(),
+		LocalAddr:  s.conn.LocalAddr().String(),
+		Helo:       s.helo,
+		TLS:        s.tls,
+		Envelope:   s.envelope,
+		Metadata:   s.hookMetadata,
+	}
+	hs.Envelope.RcptTo = append([]string{}, s.envelope.RcptTo...)
+	if s.user != nil {
+		hs.AuthUser = s.user.Login
+	}
+	return hs
+}
+
+// hooksRun calls hooks of phase of hs, returns true if command is refused
+func (s *SMTPServerSession) hooksRun(hs *SMTPSession) (stop bool) {
+	for _, h := range hooksOf(hs.Phase) {
+		if s.hookReply(h(hs)) {
+			s.log("hook - " + hs.Phase.String() + " refused")
+			return true
+		}
+	}
+	return false
+}
+
+// hooksMessage calls hooks of phase (DATA or QUEUE) with rawMessage, which
+// may be rewritten, and adds headers of hooks
+func (s *SMTPServerSession) hooksMessage(phase HookPhase, rawMessage *[]byte) (stop bool) {
+	if len(hooksOf(phase)) == 0 {
+		return false
+	}
+	hs := s.hookSession(phase)
+	hs.message = rawMessage
+	if s.hooksRun(hs) {
+		return true
+	}
+	for _, header2add := range hs.Headers {
+		h := []byte(header2add)
+		message.FoldHeader(&h)
+		*rawMessage = append([]byte(fmt.Sprintf("%s\r\n", h)), *rawMessage...)
+	}
+	return false
+}
+
+// hooksDelivery calls DELIVERY hooks with queued message q, it returns the
+// reply of the hook refusing delivery (Code 0 if none)
+func hooksDelivery(q *QMessage, rawData *[]byte) HookReply {
+	registered := hooksOf(HookDelivery)
+	if len(registered) == 0 {
+		return HookReply{}
+	}
+	hs := &SMTPSession{
+		Phase:     HookDelivery,
+		SessionId: q.SessionId,
+		AuthUser:  q.AuthUser,
+		Envelope:  message.Envelope{MailFrom: q.MailFrom, RcptTo: []string{q.RcptTo}},
+		Rcpt:      q.RcptTo,
+		Metadata:  make(map[string]string),
+		message:   rawData,
+	}
+	if q.Metadata != "" {
+		json.Unmarshal([]byte(q.Metadata), &hs.Metadata)
+	}
+	for _, h := range registered {
+		if r := h(hs); r.Code != 0 {
+			return r
+		}
+	}
+	return HookReply{}
+}
@@ -0,0 +1,101 @@
+package core
+
+// Identities
+// The hostname presented in banner, EHLO reply & Received header (smtpd)
+// and in EHLO/LHLO (deliverd) is resolved by an IdentityProvider from the
+// context of the connection, so one process can present several mail
+// identities. The default provider uses identities of config and falls back
+// to me.
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// IdentityContext is the context of a connection
+type IdentityContext struct {
+	// Listener is the local address of smtpd session (nil for deliverd)
+	Listener net.Addr
+	// LocalIP is the local IP of connection (nil if unknown)
+	LocalIP net.IP
+	// RouteId is the id of route of deliverd connection (0 for smtpd or
+	// default route)
+	RouteId int64
+	// RemoteHost is the host of deliverd connection ("" for smtpd)
+	RemoteHost string
+}
+
+// IdentityProvider resolves hostname of connections
+type IdentityProvider interface {
+	// Hostname returns hostname of connection of ctx ("" for default: me)
+	Hostname(ctx IdentityContext) string
+}
+
+// configIdentityProvider resolves identities of config
+// selector=hostname, selector is a listener (ip:port or :port), a local IP
+// or route:ID
+type configIdentityProvider struct{}
+
+// Hostname implements IdentityProvider
+func (configIdentityProvider) Hostname(ctx IdentityContext) string {
+	for _, identity := range Cfg.GetIdentities() {
+		p := strings.LastIndex(identity, "=")
+		if p == -1 {
+			continue
+		}
+		selector, hostname := strings.TrimSpace(identity[:p]), strings.TrimSpace(identity[p+1:])
+		switch {
+		case strings.HasPrefix(selector, "route:"):
+			id, err := strconv.ParseInt(selector[6:], 10, 64)
+			if err == nil && ctx.RouteId != 0 && id == ctx.RouteId {
+				return hostname
+			}
+		case net.ParseIP(selector) != nil:
+			if ctx.LocalIP != nil && net.ParseIP(selector).Equal(ctx.LocalIP) {
+				return hostname
+			}
+		default:
+			if ctx.Listener != nil && listenerMatch(selector, ctx.Listener) {
+				return hostname
+			}
+		}
+	}
+	return ""
+}
+
+var identity = struct {
+	sync.Mutex
+	provider IdentityProvider
+}{provider: configIdentityProvider{}}
+
+// SetIdentityProvider replaces the provider of identities (config
+// identities)
+func SetIdentityProvider(p IdentityProvider) {
+	identity.Lock()
+	identity.provider = p
+	identity.Unlock()
+}
+
+// identityHostname returns hostname of connection of ctx
+func identityHostname(ctx IdentityContext) string {
+	identity.Lock()
+	p := identity.provider
+	identity.Unlock()
+	if p != nil {
+		if hostname := p.Hostname(ctx); hostname != "" {
+			return hostname
+		}
+	}
+	return Cfg.GetMe()
+}
+
+// addrIP returns IP of addr (IP:PORT, nil if it hasn't)
+func addrIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
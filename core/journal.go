@@ -0,0 +1,272 @@
+package core
+
+// Journaling (compliance archiving)
+// Journal rules (global or for a domain, for inbound, outbound or both
+// directions) copy every message accepted by smtpd, as received before
+// any filter alters it, to an archive address (journal report: envelope
+// metadata and original message attached) and/or to the journal store
+// (message and its metadata in JSON). A message is inbound for its local
+// recipients (domain of rcpt in local rcpthosts), outbound for the others.
+// If journaling fails the message is temporary rejected.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toorop/tmail/message"
+)
+
+// journal rules directions
+const (
+	JournalInbound  = "inbound"
+	JournalOutbound = "outbound"
+	JournalBoth     = "both"
+)
+
+// journal rules are reloaded from DB with this interval
+const journalCacheTTL = 1 * time.Minute
+
+// JournalRule represents a journaling rule
+type JournalRule struct {
+	Id        int64
+	Domain    string // "" for all domains
+	Direction string // inbound, outbound or both
+	Address   string // archive address (optional)
+	Archive   bool   // copy to journal store
+	CreatedAt time.Time
+}
+
+// JournalMetadata is the envelope of a journaled message
+type JournalMetadata struct {
+	Uuid       string
+	SessionId  string
+	MailFrom   string
+	RcptTo     []string
+	Direction  string
+	MessageId  string
+	Subject    string
+	RemoteAddr string
+	Helo       string
+	AuthUser   string
+	ReceivedAt time.Time
+	Size       int
+	Sha256     string
+}
+
+var journalCache = struct {
+	sync.Mutex
+	rules    []JournalRule
+	loadedAt time.Time
+}{}
+
+// journalStore returns journal store
+func journalStore() (Storer, error) {
+	source := Cfg.GetJournalStoreSource()
+	if source == "" {
+		return nil, errors.New("journal store is not enabled (journal_store_source)")
+	}
+	return NewStore(Cfg.GetJournalStoreDriver(), source)
+}
+
+// JournalRuleAdd adds a journal rule
+func JournalRuleAdd(rule JournalRule) (JournalRule, error) {
+	rule.Domain = strings.ToLower(strings.TrimSpace(rule.Domain))
+	rule.Direction = strings.ToLower(strings.TrimSpace(rule.Direction))
+	switch rule.Direction {
+	case "":
+		rule.Direction = JournalBoth
+	case JournalInbound, JournalOutbound, JournalBoth:
+	default:
+		return rule, errors.New("direction must be " + JournalInbound + ", " + JournalOutbound + " or " + JournalBoth)
+	}
+	if rule.Domain != "" {
+		if _, err := RcpthostGet(rule.Domain); err != nil {
+			return rule, errors.New("domain " + rule.Domain + " is not handled by tmail")
+		}
+	}
+	if rule.Address = strings.TrimSpace(rule.Address); rule.Address != "" {
+		a, err := mail.ParseAddress(rule.Address)
+		if err != nil {
+			return rule, errors.New("bad archive address " + rule.Address)
+		}
+		rule.Address = a.Address
+	}
+	if rule.Address == "" && !rule.Archive {
+		return rule, errors.New("an archive address or the journal store is needed")
+	}
+	if rule.Archive && Cfg.GetJournalStoreSource() == "" {
+		return rule, errors.New("journal store is not enabled (journal_store_source)")
+	}
+	rule.Id = 0
+	rule.CreatedAt = time.Now()
+	if err := DB.Create(&rule).Error; err != nil {
+		return rule, err
+	}
+	journalCacheReset()
+	return rule, nil
+}
+
+// JournalRuleDel removes journal rule id
+func JournalRuleDel(id int64) error {
+	rule := JournalRule{}
+	if err := DB.Where("id = ?", id).First(&rule).Error; err != nil {
+		return err
+	}
+	if err := DB.Delete(&rule).Error; err != nil {
+		return err
+	}
+	journalCacheReset()
+	return nil
+}
+
+// JournalRuleList returns journal rules
+func JournalRuleList() (rules []JournalRule, err error) {
+	rules = []JournalRule{}
+	err = DB.Order("domain, id").Find(&rules).Error
+	return
+}
+
+// journalCacheReset forces a reload of journal rules
+func journalCacheReset() {
+	journalCache.Lock()
+	journalCache.loadedAt = time.Time{}
+	journalCache.Unlock()
+}
+
+// journalRules returns journal rules (cached)
+func journalRules() []JournalRule {
+	journalCache.Lock()
+	defer journalCache.Unlock()
+	if time.Since(journalCache.loadedAt) > journalCacheTTL {
+		rules, err := JournalRuleList()
+		if err != nil {
+			Log.Error("journal - unable to get journal rules - " + err.Error())
+			return journalCache.rules
+		}
+		journalCache.rules, journalCache.loadedAt = rules, time.Now()
+	}
+	return journalCache.rules
+}
+
+// journalDomain returns domain part of address
+func journalDomain(address string) string {
+	return strings.ToLower(address[strings.LastIndex(address, "@")+1:])
+}
+
+// journalMatch returns rules matching envelope and direction of message
+func journalMatch(envelope message.Envelope) (rules []JournalRule, direction string) {
+	all := journalRules()
+	if len(all) == 0 {
+		return nil, ""
+	}
+	inbound, outbound := false, false
+	matched := make(map[int64]bool)
+	for _, rcpt := range envelope.RcptTo {
+		rcptDomain, local := journalDomain(rcpt), false
+		if rcpthost, err := RcpthostGet(rcptDomain); err == nil {
+			local = rcpthost.IsLocal
+		}
+		dir, domain := JournalOutbound, journalDomain(envelope.MailFrom)
+		if local {
+			dir, domain = JournalInbound, rcptDomain
+			inbound = true
+		} else {
+			outbound = true
+		}
+		for _, rule := range all {
+			if matched[rule.Id] || (rule.Direction != JournalBoth && rule.Direction != dir) {
+				continue
+			}
+			if rule.Domain == "" || rule.Domain == domain {
+				matched[rule.Id] = true
+				rules = append(rules, rule)
+			}
+		}
+	}
+	switch {
+	case inbound && outbound:
+		direction = JournalBoth
+	case inbound:
+		direction = JournalInbound
+	default:
+		direction = JournalOutbound
+	}
+	return
+}
+
+// journalMessage journals raw (original message) as described by meta
+// following rules
+func journalMessage(raw *[]byte, meta JournalMetadata, rules []JournalRule) error {
+	var err error
+	if meta.Uuid, err = NewUUID(); err != nil {
+		return err
+	}
+	meta.MessageId = string(message.RawGetMessageId(raw))
+	meta.Subject = message.RawGetHeaderValue(raw, "subject")
+	meta.Size = len(*raw)
+	sum := sha256.Sum256(*raw)
+	meta.Sha256 = hex.EncodeToString(sum[:])
+
+	addresses, archive := []string{}, false
+	for _, rule := range rules {
+		if rule.Address != "" && !IsStringInSlice(rule.Address, addresses) {
+			addresses = append(addresses, rule.Address)
+		}
+		archive = archive || rule.Archive
+	}
+
+	// journal store
+	if archive {
+		store, err := journalStore()
+		if err != nil {
+			return err
+		}
+		js, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		if err = store.Put(meta.Uuid+".eml", bytes.NewReader(*raw)); err != nil {
+			return err
+		}
+		if err = store.Put(meta.Uuid+".json", bytes.NewReader(js)); err != nil {
+			return err
+		}
+	}
+
+	// journal report to archive addresses
+	if len(addresses) != 0 {
+		report := journalReport(raw, meta)
+		if _, err = QueueAddMessage(&report, message.Envelope{MailFrom: "", RcptTo: addresses}, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// journalReport returns journal report of raw message: envelope metadata &
+// original message attached
+func journalReport(raw *[]byte, meta JournalMetadata) []byte {
+	boundary := "journal-" + meta.Uuid
+	b := new(bytes.Buffer)
+	fmt.Fprintf(b, "Date: %s\r\nFrom: <postmaster@%s>\r\nTo: undisclosed-recipients:;\r\n", time.Now().Format(Time822), Cfg.GetMe())
+	fmt.Fprintf(b, "Subject: Journal: %s\r\nMessage-ID: <%s@%s>\r\nX-Tmail-Journal: %s\r\nAuto-Submitted: auto-generated\r\n", meta.Subject, meta.Uuid, Cfg.GetMe(), meta.Uuid)
+	fmt.Fprintf(b, "MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"%s\"\r\n\r\n", boundary)
+	fmt.Fprintf(b, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n", boundary)
+	fmt.Fprintf(b, "Sender: %s\r\nRecipients: %s\r\nDirection: %s\r\nMessage-ID: %s\r\nSubject: %s\r\n", meta.MailFrom, strings.Join(meta.RcptTo, ", "), meta.Direction, meta.MessageId, meta.Subject)
+	fmt.Fprintf(b, "Remote-Address: %s\r\nHelo: %s\r\nAuthenticated-User: %s\r\nSession: %s\r\nReceived-At: %s\r\nSize: %d\r\nSHA-256: %s\r\n", meta.RemoteAddr, meta.Helo, meta.AuthUser, meta.SessionId, meta.ReceivedAt.Format(time.RFC3339), meta.Size, meta.Sha256)
+	fmt.Fprintf(b, "\r\n--%s\r\nContent-Type: message/rfc822\r\nContent-Disposition: attachment; filename=\"%s.eml\"\r\n\r\n", boundary, meta.Uuid)
+	b.Write(*raw)
+	if !bytes.HasSuffix(*raw, []byte("\r\n")) {
+		b.WriteString("\r\n")
+	}
+	fmt.Fprintf(b, "--%s--\r\n", boundary)
+	return b.Bytes()
+}
@@ -0,0 +1,27 @@
+package core
+
+// LMTP client (RFC 2033)
+// An LMTP client is an smtpClient speaking LHLO instead of EHLO and
+// reading one reply per accepted recipient after DATA.
+
+import (
+	"context"
+
+	"github.com/toorop/tmail/smtpx"
+)
+
+// newLMTPClient returns a connected LMTP client
+func newLMTPClient(uri string) (client *smtpClient, err error) {
+	c, err := smtpx.DialLMTP(context.Background(), uri, smtpxOptions())
+	if err != nil {
+		return nil, err
+	}
+	c.OnClose = monitorConnOpened("lmtpclient")
+	return &smtpClient{Client: c}, nil
+}
+
+// LmtpData sends DATA and data, then reads a reply per accepted recipient
+// (rcptCount). Replies are returned in RCPT order.
+func (s *smtpClient) LmtpData(data []byte, rcptCount int) (replies []smtpx.Reply, code int, msg string, err error) {
+	return s.LMTPData(context.Background(), data, rcptCount)
+}
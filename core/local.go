@@ -29,45 +29,6 @@ func isLocalDelivery(rcpt string) (bool, error) {
 // Alias
 // catchall
 func IsValidLocalRcpt(rcpt string) (bool, error) {
-	// mailbox
-	u, err := UserGetByLogin(rcpt)
-	if err != nil && err != gorm.RecordNotFound {
-		return false, err
-	}
-	if err == nil && u.HaveMailbox {
-		return true, nil
-	}
-	// email alias
-	exists, err := AliasExists(rcpt)
-	if err != nil {
-		return false, err
-	}
-	if exists {
-		return true, nil
-	}
-	// domain alias
-	localDom := strings.Split(rcpt, "@")
-	if len(localDom) != 2 {
-		return false, errors.New("bad address format in IsValidLocalRcpt. Got " + rcpt)
-	}
-	exists, err = AliasExists(localDom[1])
-	if err != nil {
-		return false, err
-	}
-	if exists {
-		alias, err := AliasGet(localDom[1])
-		if err != nil {
-			return false, err
-		}
-		return IsValidLocalRcpt(localDom[0] + "@" + alias.DeliverTo)
-	}
-	// Catchall
-	u, err = UserGetCatchallForDomain(localDom[1])
-	if err != nil && err != gorm.RecordNotFound {
-		return false, err
-	}
-	if err == nil {
-		return true, nil
-	}
-	return false, nil
+	_, valid, err := aliasLookup(rcpt)
+	return valid, err
 }
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	//"io/ioutil"
@@ -8,22 +9,40 @@ import (
 	"os"
 	//"path"
 	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Simple logger package to log to stdout
+// Records are written in the human readable format (text) or as structured
+// records (json or logfmt). Structured records carry the fields of the
+// logger (subsystem, session, message...) so a message can be traced from
+// smtpd to deliverd.
 
 type Logger struct {
 	debugEnabled bool
+	format       string   // text, json or logfmt
+	hostname     string   // for structured records
+	fields       []string // key, value...
+	structured   *log.Logger
 	debug        *log.Logger
 	info         *log.Logger
 	err          *log.Logger
 	trace        *log.Logger
 }
 
-func NewLogger(out io.Writer, debugEnabled bool) (*Logger, error) {
+func NewLogger(out io.Writer, debugEnabled bool, format string) (*Logger, error) {
 	hostname, _ := os.Hostname()
+	format = strings.ToLower(format)
+	if format != "text" && format != "json" && format != "logfmt" {
+		return nil, fmt.Errorf("bad log format %s, text, json or logfmt expected", format)
+	}
 	return &Logger{
 		debugEnabled: debugEnabled,
+		format:       format,
+		hostname:     hostname,
+		structured:   log.New(out, "", 0),
 		debug:        log.New(out, "["+hostname+"] ", log.Ldate|log.Ltime|log.Lmicroseconds),
 		info:         log.New(out, "["+hostname+"] ", log.Ldate|log.Ltime|log.Lmicroseconds),
 		err:          log.New(out, "["+hostname+"] ", log.Ldate|log.Ltime|log.Lmicroseconds),
@@ -31,10 +50,65 @@ func NewLogger(out io.Writer, debugEnabled bool) (*Logger, error) {
 	}, nil
 }
 
+// With returns a logger adding fields (key, value...) to structured records
+func (l *Logger) With(fields ...string) *Logger {
+	child := *l
+	child.fields = make([]string, 0, len(l.fields)+len(fields))
+	child.fields = append(child.fields, l.fields...)
+	child.fields = append(child.fields, fields...)
+	return &child
+}
+
+// record writes a structured record
+func (l *Logger) record(level, msg string, extra ...string) {
+	fields := append([]string{"time", time.Now().Format(time.RFC3339Nano), "level", level, "host", l.hostname}, l.fields...)
+	fields = append(fields, extra...)
+	fields = append(fields, "msg", msg)
+	parts := []string{}
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i+1] == "" {
+			continue
+		}
+		if l.format == "json" {
+			k, _ := json.Marshal(fields[i])
+			v, _ := json.Marshal(fields[i+1])
+			parts = append(parts, string(k)+":"+string(v))
+		} else {
+			parts = append(parts, fields[i]+"="+logfmtValue(fields[i+1]))
+		}
+	}
+	if l.format == "json" {
+		l.structured.Println("{" + strings.Join(parts, ",") + "}")
+	} else {
+		l.structured.Println(strings.Join(parts, " "))
+	}
+}
+
+// logfmtValue returns value quoted if needed
+func logfmtValue(value string) string {
+	if strings.ContainsAny(value, " =\"\\\t\r\n") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// join returns v joined as message
+func (l *Logger) join(v []interface{}) string {
+	msg := ""
+	for i := range v {
+		msg = fmt.Sprintf("%s %v", msg, v[i])
+	}
+	return strings.TrimSpace(msg)
+}
+
 func (l *Logger) Debug(v ...interface{}) {
 	if !l.debugEnabled {
 		return
 	}
+	if l.format != "text" {
+		l.record("debug", l.join(v))
+		return
+	}
 	msg := "DEBUG -"
 	for i := range v {
 		msg = fmt.Sprintf("%s %v", msg, v[i])
@@ -43,6 +117,10 @@ func (l *Logger) Debug(v ...interface{}) {
 }
 
 func (l *Logger) Info(v ...interface{}) {
+	if l.format != "text" {
+		l.record("info", l.join(v))
+		return
+	}
 	msg := "INFO -"
 	for i := range v {
 		msg = fmt.Sprintf("%s %v", msg, v[i])
@@ -51,6 +129,10 @@ func (l *Logger) Info(v ...interface{}) {
 }
 
 func (l *Logger) Error(v ...interface{}) {
+	if l.format != "text" {
+		l.record("error", l.join(v))
+		return
+	}
 	msg := "ERROR -"
 	for i := range v {
 		msg = fmt.Sprintf("%s %v", msg, v[i])
@@ -60,6 +142,10 @@ func (l *Logger) Error(v ...interface{}) {
 
 func (l *Logger) Trace(v ...interface{}) {
 	stack := debug.Stack()
+	if l.format != "text" {
+		l.record("trace", l.join(v), "stack", string(stack))
+		return
+	}
 	msg := "TRACE -"
 	for i := range v {
 		msg = fmt.Sprintf("%s %v", msg, v[i])
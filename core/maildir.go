@@ -0,0 +1,183 @@
+package core
+
+// Built-in Maildir delivery
+// http://cr.yp.to/proto/maildir.html
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// MailboxDriverDovecot mailbox is handled by dovecot (LDA or LMTP)
+	MailboxDriverDovecot = "dovecot"
+	// MailboxDriverMaildir mailbox is a Maildir written by tmail
+	MailboxDriverMaildir = "maildir"
+)
+
+// ErrMaildirOverQuota is returned when the message doesn't fit in quota
+var ErrMaildirOverQuota = errors.New("mailbox is over quota")
+
+// maildirDeliveryCounter makes unique names among goroutines of the process
+var maildirDeliveryCounter uint64
+
+// IsValidMailboxDriver checks if driver is a supported mailbox driver
+func IsValidMailboxDriver(driver string) bool {
+	return driver == MailboxDriverDovecot || driver == MailboxDriverMaildir
+}
+
+// ParseSize parses a size with an optional K, M or G unit (eg 10G)
+// and returns it in bytes
+func ParseSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	if size == "" {
+		return 0, nil
+	}
+	mult := int64(1)
+	switch size[len(size)-1] {
+	case 'K':
+		mult = 1024
+	case 'M':
+		mult = 1024 * 1024
+	case 'G':
+		mult = 1024 * 1024 * 1024
+	}
+	if mult != 1 {
+		size = size[:len(size)-1]
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("bad size: " + size)
+	}
+	return n * mult, nil
+}
+
+// maildirMakeDirs creates tmp, new & cur sub directories if needed
+func maildirMakeDirs(maildir string) error {
+	for _, d := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(path.Join(maildir, d), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maildirSize returns the size of messages in new & cur of maildir and of
+// its Maildir++ folders
+func maildirSize(maildir string) (size int64, err error) {
+	dirs := []string{"new", "cur"}
+	folders, _ := filepath.Glob(path.Join(maildir, ".?*"))
+	for _, folder := range folders {
+		if name := path.Base(folder); name != ".." {
+			dirs = append(dirs, path.Join(name, "new"), path.Join(name, "cur"))
+		}
+	}
+	for _, d := range dirs {
+		err = filepath.Walk(path.Join(maildir, d), func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				// message moved or deleted by MUA in the meantime
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !info.IsDir() {
+				size += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// maildirUniqueName returns a unique file name for a new message
+// time.MusecPpidQcounter.hostname,S=size
+func maildirUniqueName(size int) string {
+	now := time.Now()
+	host := strings.NewReplacer("/", "\\057", ":", "\\072").Replace(Cfg.GetMe())
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s,S=%d", now.Unix(), now.Nanosecond()/1000, os.Getpid(), atomic.AddUint64(&maildirDeliveryCounter, 1), host, size)
+}
+
+// maildirDeliver writes data in maildir
+// if quota is not 0 and the message doesn't fit ErrMaildirOverQuota is
+// returned
+func maildirDeliver(maildir string, data []byte, quota int64) error {
+	if err := maildirMakeDirs(maildir); err != nil {
+		return err
+	}
+	if quota != 0 {
+		size, err := maildirSize(maildir)
+		if err != nil {
+			return err
+		}
+		if size+int64(len(data)) > quota {
+			return ErrMaildirOverQuota
+		}
+	}
+
+	name := maildirUniqueName(len(data))
+	tmpPath := path.Join(maildir, "tmp", name)
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	// link + unlink rather than rename, to never overwrite an existing
+	// message
+	if err = os.Link(tmpPath, path.Join(maildir, "new", name)); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Remove(tmpPath)
+}
+
+// maildirFolderDeliver writes data in Maildir++ folder of maildir (eg
+// Lists/Golang is written in maildir/.Lists.Golang), "" is the inbox
+// quota applies to the whole maildir
+func maildirFolderDeliver(maildir, folder string, data []byte, quota int64) error {
+	if folder == "" {
+		return maildirDeliver(maildir, data, quota)
+	}
+	if quota != 0 {
+		size, err := maildirSize(maildir)
+		if err != nil {
+			return err
+		}
+		if size+int64(len(data)) > quota {
+			return ErrMaildirOverQuota
+		}
+	}
+	dir := path.Join(maildir, "."+strings.Replace(folder, "/", ".", -1))
+	if err := maildirMakeDirs(dir); err != nil {
+		return err
+	}
+	marker := path.Join(dir, "maildirfolder")
+	if _, err := os.Stat(marker); os.IsNotExist(err) {
+		f, err := os.OpenFile(marker, os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		f.Close()
+	}
+	return maildirDeliver(dir, data, 0)
+}
@@ -24,22 +24,61 @@ type QMessage struct {
 	LastUpdate              time.Time
 	AddedAt                 time.Time
 	NextDeliveryScheduledAt time.Time
-	Status                  uint32 // 0 delivery in progress, 1 to be discarded, 2 scheduled, 3 to be bounced
+	Status                  uint32 // 0 delivery in progress, 1 to be discarded, 2 scheduled, 3 to be bounced, 4 frozen, 5 on hold, 6 waiting for scan
 	DeliveryFailedCount     uint32
+	LastError               string    `sql:"type:text;"` // error of last delivery attempt
+	Thawed                  bool      // thawed by admin, delivered even if it matches a freeze
+	SendAt                  time.Time // future release: not delivered before (zero if none)
+	BounceReason            string    // reason of a bounce decided before delivery (scan)
+	SessionId               string    // smtpd session which received message ("" if none), for log correlation
+	MailParams              string    // ESMTP parameters of MAIL passed through to next hop (space separated)
+	RcptParams              string    // ESMTP parameters of RCPT passed through to next hop (space separated)
+	LeaseOwner              string    // node delivering message (cluster)
+	LeaseExpiresAt          time.Time // lease is renewed by heartbeats of its owner
+	DelayWarned             bool      // sender has been warned that delivery is delayed
+	Destination             string    `sql:"type:text;"` // routes of recipient (resolved for all recipients on first attempt of the message, then by each attempt), recipients of a message with the same destination are delivered in one transaction
+	Metadata                string    `sql:"type:text;"` // metadata set by in-process hooks (JSON), given to DELIVERY hooks
+	AuthResults             string    `sql:"type:text;"` // results of smtpd authentication checks, sealed by ARC
+	Publication             uint32    // incremented on each publication, older copies in NSQ are stale
+	LocalActions            string    `sql:"type:text;"` // local delivery actions done (sieve redirects, vacation, folders), not done again on retry
 }
 
+// ErrLeaseLost is returned if message in delivery is leased by another
+// node (lease of this node has expired)
+var ErrLeaseLost = errors.New("lease of queued message is lost")
+
 // Delete delete message from queue
 func (q *QMessage) Delete() error {
 	q.Lock()
 	defer q.Unlock()
-	var err error
 	// remove from DB
-	if err = DB.Delete(q).Error; err != nil {
+	if err := DB.Delete(q).Error; err != nil {
 		return err
 	}
-	// If there is no other reference in DB, remove raw message from store
+	return q.deleteRaw()
+}
+
+// DeleteLeased deletes message from queue if it's still leased by owner
+// (fencing), ErrLeaseLost is returned otherwise
+func (q *QMessage) DeleteLeased(owner string) error {
+	q.Lock()
+	defer q.Unlock()
+	r := DB.Where("id = ? AND lease_owner = ?", q.Id, owner).Delete(QMessage{})
+	if r.Error != nil {
+		return r.Error
+	}
+	if r.RowsAffected != 1 {
+		return ErrLeaseLost
+	}
+	return q.deleteRaw()
+}
+
+// deleteRaw removes raw message from store if there is no other reference
+// in DB
+func (q *QMessage) deleteRaw() error {
+	var err error
 	var c uint
-	if err = DB.Model(QMessage{}).Where("`key` = ?", q.Uuid).Count(&c).Error; err != nil {
+	if err = DB.Model(QMessage{}).Where("uuid = ?", q.Uuid).Count(&c).Error; err != nil {
 		return err
 	}
 	if c != 0 {
@@ -72,18 +111,50 @@ func (q *QMessage) SaveInDb() error {
 	return DB.Save(q).Error
 }
 
+// SaveLeased saves delivery state of message if it's still leased by owner
+// (fencing), ErrLeaseLost is returned otherwise. DelayWarned is not saved:
+// it's set for all recipients of the message by delayWarning.
+func (q *QMessage) SaveLeased(owner string) error {
+	q.Lock()
+	defer q.Unlock()
+	q.LastUpdate = time.Now()
+	r := DB.Model(QMessage{}).Where("id = ? AND lease_owner = ?", q.Id, owner).Updates(map[string]interface{}{
+		"status":                     q.Status,
+		"delivery_failed_count":      q.DeliveryFailedCount,
+		"next_delivery_scheduled_at": q.NextDeliveryScheduledAt,
+		"last_update":                q.LastUpdate,
+		"last_error":                 q.LastError,
+		"destination":                q.Destination,
+	})
+	if r.Error != nil {
+		return r.Error
+	}
+	if r.RowsAffected != 1 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
 // Discard mark message as being discarded on next delivery attemp
 func (q *QMessage) Discard() error {
 	if q.Status == 0 {
 		return errors.New("delivery in progress, message status can't be changed")
 	}
+	frozen := q.Status == 4 || q.Status == 5 || q.Status == 6
 	q.Lock()
 	q.Status = 1
 	q.Unlock()
-	return q.SaveInDb()
+	if err := q.SaveInDb(); err != nil {
+		return err
+	}
+	// frozen & held messages are not in nsq queue anymore
+	if frozen {
+		return q.publish()
+	}
+	return nil
 }
 
-// Bounce mark message as being bounced on next delivery attemp
+// Bounce mark message as being bounced, it's bounced now
 func (q *QMessage) Bounce() error {
 	if q.Status == 0 {
 		return errors.New("delivery in progress, message status can't be changed")
@@ -91,7 +162,116 @@ func (q *QMessage) Bounce() error {
 	q.Lock()
 	q.Status = 3
 	q.Unlock()
-	return q.SaveInDb()
+	if err := q.SaveInDb(); err != nil {
+		return err
+	}
+	return q.publish()
+}
+
+// Claim marks q as being in delivery and leases it to this node, it returns
+// false if another deliverd process has claimed it (or changed its status)
+// since q was read from DB
+func (q *QMessage) Claim() (bool, error) {
+	q.Lock()
+	defer q.Unlock()
+	tx := DB.Begin()
+	if Cfg.GetDbDriver() == DbDriverPostgres {
+		// row is locked by the deliverd process claiming it
+		locked := []QMessage{}
+		if err := dbForUpdate(tx).Where("id = ? AND status = ?", q.Id, q.Status).Find(&locked).Error; err != nil {
+			tx.Rollback()
+			return false, err
+		}
+		if len(locked) == 0 {
+			tx.Rollback()
+			return false, nil
+		}
+	}
+	now, owner := time.Now(), ClusterNodeId()
+	lease := now.Add(clusterLeaseTTL())
+	r := tx.Model(QMessage{}).Where("id = ? AND status = ?", q.Id, q.Status).Updates(map[string]interface{}{"status": 0, "last_update": now, "lease_owner": owner, "lease_expires_at": lease})
+	if r.Error != nil {
+		tx.Rollback()
+		return false, r.Error
+	}
+	if r.RowsAffected != 1 {
+		tx.Rollback()
+		return false, nil
+	}
+	if err := tx.Commit().Error; err != nil {
+		return false, err
+	}
+	q.Status, q.LastUpdate, q.LeaseOwner, q.LeaseExpiresAt = 0, now, owner, lease
+	return true, nil
+}
+
+// ClaimBatch returns up to max other scheduled messages sharing body (Uuid)
+// and destination (routes, see routesDestinationsResolve) with q, accepted
+// by filter if it's not nil. Returned messages are marked as being in
+// delivery, they must be deleted once delivered, deferred, bounced or
+// released.
+func (q *QMessage) ClaimBatch(max int, filter func(*QMessage) bool) (batch []*QMessage, err error) {
+	if q.Destination == "" || q.Destination == routesDestinationLocal {
+		return nil, nil
+	}
+	scheduled := []QMessage{}
+	err = DB.Where("uuid = ? AND destination = ? AND id != ? AND status = ? AND next_delivery_scheduled_at <= ?", q.Uuid, q.Destination, q.Id, 2, time.Now()).Order("id").Limit(max).Find(&scheduled).Error
+	if err != nil {
+		return nil, err
+	}
+	candidates := []*QMessage{}
+	for i := range scheduled {
+		if filter == nil || filter(&scheduled[i]) {
+			candidates = append(candidates, &scheduled[i])
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	tx := DB.Begin()
+	for i := range candidates {
+		// another deliverd process may have claimed it in the meantime
+		lease := time.Now().Add(clusterLeaseTTL())
+		r := tx.Model(QMessage{}).Where("id = ? AND status = ?", candidates[i].Id, 2).Updates(map[string]interface{}{"status": 0, "last_update": time.Now(), "lease_owner": ClusterNodeId(), "lease_expires_at": lease})
+		if r.Error != nil {
+			tx.Rollback()
+			return nil, r.Error
+		}
+		if r.RowsAffected == 1 {
+			candidates[i].Status, candidates[i].LeaseOwner, candidates[i].LeaseExpiresAt = 0, ClusterNodeId(), lease
+			batch = append(batch, candidates[i])
+		}
+	}
+	if err = tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// Release marks a message claimed by ClaimBatch as scheduled again, it will
+// be delivered on its own
+func (q *QMessage) Release() error {
+	q.Lock()
+	q.Status = 2
+	q.Unlock()
+	return q.SaveLeased(ClusterNodeId())
+}
+
+// publish publishes message on nsq "todeliver" topic
+// copies of q previously published are stale: deliverd discards them
+func (q *QMessage) publish() error {
+	q.Lock()
+	q.Publication++
+	err := DB.Model(QMessage{}).Where("id = ?", q.Id).UpdateColumn("publication", q.Publication).Error
+	var jMsg []byte
+	if err == nil {
+		jMsg, err = json.Marshal(q)
+	}
+	q.Unlock()
+	if err != nil {
+		return err
+	}
+	return NsqQueueProducer.Publish("todeliver", jMsg)
 }
 
 // QueueGetMessageById return a message from is key
@@ -106,6 +286,19 @@ func QueueGetMessageById(id int64) (msg QMessage, err error) {
 
 // QueueAddMessage add a new mail in queue
 func QueueAddMessage(rawMess *[]byte, envelope message.Envelope, authUser string) (uuid string, err error) {
+	return QueueAddMessageAt(rawMess, envelope, authUser, time.Time{})
+}
+
+// QueueAddMessageAt add message to queue, it will not be delivered before
+// sendAt (zero: now)
+func QueueAddMessageAt(rawMess *[]byte, envelope message.Envelope, authUser string, sendAt time.Time) (uuid string, err error) {
+	return queueAdd(rawMess, envelope, authUser, sendAt, 2, "")
+}
+
+// queueAdd add message to queue with status (2: scheduled, 6: waiting for
+// scan), messages waiting for scan are published after scan. sessionId is
+// the smtpd session which received message ("" if none).
+func queueAdd(rawMess *[]byte, envelope message.Envelope, authUser string, sendAt time.Time, status uint32, sessionId string) (uuid string, err error) {
 	qStore, err := NewStore(Cfg.GetStoreDriver(), Cfg.GetStoreSource())
 	if err != nil {
 		return
@@ -121,6 +314,15 @@ func QueueAddMessage(rawMess *[]byte, envelope message.Envelope, authUser string
 	}
 
 	messageId := message.RawGetMessageId(rawMess)
+	metadata := ""
+	if len(envelope.Metadata) != 0 {
+		m, err := json.Marshal(envelope.Metadata)
+		if err != nil {
+			qStore.Del(uuid)
+			return "", err
+		}
+		metadata = string(m)
+	}
 
 	cloop := 0
 	qmessages := []QMessage{}
@@ -135,8 +337,17 @@ func QueueAddMessage(rawMess *[]byte, envelope message.Envelope, authUser string
 			LastUpdate:              time.Now(),
 			AddedAt:                 time.Now(),
 			NextDeliveryScheduledAt: time.Now(),
-			Status:                  2,
+			Status:                  status,
 			DeliveryFailedCount:     0,
+			SessionId:               sessionId,
+			MailParams:              strings.Join(envelope.MailParams, " "),
+			RcptParams:              strings.Join(envelope.RcptParams[rcptTo], " "),
+			Metadata:                metadata,
+			AuthResults:             envelope.AuthResults,
+		}
+		if sendAt.After(qm.AddedAt) {
+			qm.SendAt = sendAt
+			qm.NextDeliveryScheduledAt = sendAt
 		}
 
 		// create record in db
@@ -151,6 +362,10 @@ func QueueAddMessage(rawMess *[]byte, envelope message.Envelope, authUser string
 		qmessages = append(qmessages, qm)
 	}
 
+	if status != 2 {
+		return
+	}
+
 	// publish qmessage
 	// TODO: to avoid the copy of the Lock -> qmsg.Publish()
 	for _, qmsg := range qmessages {
@@ -176,6 +391,33 @@ func QueueAddMessage(rawMess *[]byte, envelope message.Envelope, authUser string
 	return
 }
 
+// QueueInject puts raw message from mailFrom to rcptTo in queue (REST
+// injection), it will not be delivered before sendAt (zero: now)
+func QueueInject(rawMess []byte, mailFrom string, rcptTo []string, sendAt time.Time) (uuid string, err error) {
+	if len(rcptTo) == 0 {
+		return "", errors.New("no recipient")
+	}
+	if len(bytes.TrimSpace(rawMess)) == 0 {
+		return "", errors.New("message is empty")
+	}
+	if err = Unix2dos(&rawMess); err != nil {
+		return
+	}
+	envelope := message.Envelope{
+		MailFrom: RemoveBrackets(mailFrom),
+		RcptTo:   []string{},
+	}
+	for _, rcpt := range rcptTo {
+		rcpt = RemoveBrackets(strings.TrimSpace(rcpt))
+		if !strings.Contains(rcpt, "@") {
+			return "", errors.New("invalid recipient " + rcpt)
+		}
+		envelope.RcptTo = append(envelope.RcptTo, rcpt)
+	}
+	rawMess = append([]byte("X-Env-From: "+envelope.MailFrom+"\r\n"), rawMess...)
+	return QueueAddMessageAt(&rawMess, envelope, "", sendAt)
+}
+
 // QueueListMessages return all message in queue
 func QueueListMessages() ([]QMessage, error) {
 	messages := []QMessage{}
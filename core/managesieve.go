@@ -0,0 +1,392 @@
+package core
+
+// ManageSieve server (RFC 5804)
+// Users manage their sieve scripts with a ManageSieve client. Only SASL
+// PLAIN is supported, if managesieve_require_tls is set clients must use
+// STARTTLS before authentication. Before authentication, sessions are
+// limited in number, in line & literal length and in idle time.
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// managesieve timeouts (before and after authentication)
+const (
+	manageSieveAuthTimeout = 1 * time.Minute
+	manageSieveTimeout     = 10 * time.Minute
+)
+
+// maximum length of lines (and literals before authentication)
+const manageSieveMaxLine = 8192
+
+// maximum number of sessions not authenticated
+const manageSieveMaxUnauthenticated = 32
+
+// number of sessions not authenticated
+var manageSieveUnauthenticated int32
+
+// errManageSieveLineTooLong is returned if a line is too long
+var errManageSieveLineTooLong = errors.New("line too long")
+
+// manageSieveSession is a ManageSieve client connection
+type manageSieveSession struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	tlsConfig *tls.Config
+	tls       bool
+	user      string
+}
+
+// LaunchManageSieve launches ManageSieve server
+func LaunchManageSieve() {
+	addr := Cfg.GetManageSieveListen()
+	tlsConfig, err := smtpdTLSConfig()
+	if err != nil {
+		Log.Error("managesieve - unable to load TLS config, STARTTLS is disabled:", err)
+		tlsConfig = nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		Log.Error("managesieve - unable to listen on", addr, "-", err)
+		return
+	}
+	Log.Info("managesieve " + addr + " launched.")
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			Log.Error("managesieve - accept failed:", err)
+			continue
+		}
+		if atomic.AddInt32(&manageSieveUnauthenticated, 1) > manageSieveMaxUnauthenticated {
+			atomic.AddInt32(&manageSieveUnauthenticated, -1)
+			Log.Info("managesieve - " + conn.RemoteAddr().String() + " - too many sessions not authenticated, connection refused")
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			conn.Write([]byte("BYE \"too many connections\"\r\n"))
+			conn.Close()
+			continue
+		}
+		s := &manageSieveSession{conn: conn, r: bufio.NewReader(conn), tlsConfig: tlsConfig}
+		go s.serve()
+	}
+}
+
+// write sends lines to client
+func (s *manageSieveSession) write(lines ...string) {
+	s.conn.SetWriteDeadline(time.Now().Add(manageSieveTimeout))
+	s.conn.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+}
+
+// quote returns str as a quoted string
+func (s *manageSieveSession) quote(str string) string {
+	return `"` + strings.Replace(strings.Replace(str, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+// ok sends OK response
+func (s *manageSieveSession) ok(msg string) {
+	s.write("OK " + s.quote(msg))
+}
+
+// no sends NO response
+func (s *manageSieveSession) no(msg string) {
+	s.write("NO " + s.quote(msg))
+}
+
+// capabilities sends capabilities
+func (s *manageSieveSession) capabilities() {
+	lines := []string{
+		`"IMPLEMENTATION" "tmail"`,
+		`"SIEVE" ` + s.quote(strings.Join(sieveExtensions, " ")),
+	}
+	if s.tls || !Cfg.GetManageSieveRequireTls() {
+		lines = append(lines, `"SASL" "PLAIN"`)
+	} else {
+		lines = append(lines, `"SASL" ""`)
+	}
+	if !s.tls && s.tlsConfig != nil {
+		lines = append(lines, `"STARTTLS"`)
+	}
+	if s.user == "" {
+		lines = append(lines, `"VERSION" "1.0"`)
+	} else {
+		lines = append(lines, `"VERSION" "1.0"`, `"OWNER" `+s.quote(s.user))
+	}
+	s.write(lines...)
+	s.ok("tmail ManageSieve ready")
+}
+
+// timeout returns read timeout of session
+func (s *manageSieveSession) timeout() time.Duration {
+	if s.user == "" {
+		return manageSieveAuthTimeout
+	}
+	return manageSieveTimeout
+}
+
+// readLine reads a line (at most manageSieveMaxLine bytes)
+func (s *manageSieveSession) readLine() (string, error) {
+	s.conn.SetReadDeadline(time.Now().Add(s.timeout()))
+	line := []byte{}
+	for {
+		chunk, err := s.r.ReadSlice('\n')
+		if len(line)+len(chunk) > manageSieveMaxLine {
+			return "", errManageSieveLineTooLong
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// readCommand reads a command and its arguments (atoms, quoted strings or
+// literals)
+func (s *manageSieveSession) readCommand() (cmd string, args []string, err error) {
+	line, err := s.readLine()
+	if err != nil {
+		return
+	}
+	max := Cfg.GetSieveMaxScriptSize()
+	if s.user == "" {
+		max = manageSieveMaxLine
+	}
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			break
+		}
+		switch {
+		case line[0] == '"':
+			str, i, escaped := []byte{}, 1, false
+			for ; i < len(line); i++ {
+				if escaped {
+					str, escaped = append(str, line[i]), false
+				} else if line[i] == '\\' {
+					escaped = true
+				} else if line[i] == '"' {
+					break
+				} else {
+					str = append(str, line[i])
+				}
+			}
+			if i == len(line) {
+				return "", nil, errors.New("unterminated quoted string")
+			}
+			args = append(args, string(str))
+			line = line[i+1:]
+		case line[0] == '{' && strings.HasSuffix(line, "}"):
+			n, err := strconv.Atoi(strings.TrimSuffix(line[1:len(line)-1], "+"))
+			if err != nil || n < 0 || (max != 0 && n > max) {
+				return "", nil, errors.New("bad literal size")
+			}
+			// synchronizing literal: client waits for a continuation
+			if !strings.HasSuffix(line, "+}") {
+				s.write("+ ready for literal")
+			}
+			literal := make([]byte, n)
+			s.conn.SetReadDeadline(time.Now().Add(s.timeout()))
+			if _, err = io.ReadFull(s.r, literal); err != nil {
+				return "", nil, err
+			}
+			args = append(args, string(literal))
+			if line, err = s.readLine(); err != nil {
+				return "", nil, err
+			}
+		default:
+			p := strings.Index(line, " ")
+			if p == -1 {
+				p = len(line)
+			}
+			if cmd == "" {
+				cmd = strings.ToUpper(line[:p])
+			} else {
+				args = append(args, line[:p])
+			}
+			line = line[p:]
+		}
+	}
+	return
+}
+
+// serve handles session
+func (s *manageSieveSession) serve() {
+	defer s.conn.Close()
+	defer func() {
+		if s.user == "" {
+			atomic.AddInt32(&manageSieveUnauthenticated, -1)
+		}
+	}()
+	remote := s.conn.RemoteAddr().String()
+	s.capabilities()
+	for {
+		cmd, args, err := s.readCommand()
+		if err != nil {
+			if err != io.EOF {
+				s.write("BYE " + s.quote(err.Error()))
+			}
+			return
+		}
+		switch cmd {
+		case "CAPABILITY":
+			s.capabilities()
+		case "NOOP":
+			s.ok("NOOP completed")
+		case "LOGOUT":
+			s.ok("bye")
+			return
+		case "STARTTLS":
+			if s.tls || s.tlsConfig == nil {
+				s.no("STARTTLS not available")
+				continue
+			}
+			s.ok("begin TLS negotiation")
+			tlsConn := tls.Server(s.conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				Log.Error("managesieve - " + remote + " - TLS handshake failed: " + err.Error())
+				return
+			}
+			s.conn, s.r, s.tls = tlsConn, bufio.NewReader(tlsConn), true
+			s.capabilities()
+		case "AUTHENTICATE":
+			s.authenticate(remote, args)
+		default:
+			if s.user == "" {
+				s.no("authentication required")
+				continue
+			}
+			s.command(cmd, args)
+		}
+	}
+}
+
+// authenticate handles AUTHENTICATE "PLAIN" [initial response]
+func (s *manageSieveSession) authenticate(remote string, args []string) {
+	if s.user != "" {
+		s.no("already authenticated")
+		return
+	}
+	if !s.tls && Cfg.GetManageSieveRequireTls() {
+		s.write(`NO (ENCRYPT-NEEDED) "STARTTLS required"`)
+		return
+	}
+	if len(args) == 0 || strings.ToUpper(args[0]) != "PLAIN" {
+		s.no("unsupported SASL mechanism")
+		return
+	}
+	response := ""
+	if len(args) > 1 {
+		response = args[1]
+	} else {
+		s.write(`""`)
+		line, err := s.readLine()
+		if err != nil {
+			return
+		}
+		response = strings.Trim(line, `"`)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	parts := strings.Split(string(decoded), "\x00")
+	if err != nil || len(parts) != 3 {
+		s.no("bad SASL response")
+		return
+	}
+	if parts[0] != "" && !strings.EqualFold(parts[0], parts[1]) {
+		s.no("authorization identity must be the authentication identity")
+		return
+	}
+	user, err := authenticate(parts[1], parts[2])
+	if err != nil {
+		Log.Info("managesieve - " + remote + " - authentication failed for " + parts[1] + ": " + err.Error())
+		time.Sleep(2 * time.Second)
+		s.no("authentication failed")
+		return
+	}
+	s.user = user.Login
+	atomic.AddInt32(&manageSieveUnauthenticated, -1)
+	Log.Info("managesieve - " + remote + " - " + s.user + " authenticated")
+	s.ok("authenticated")
+}
+
+// command handles commands of an authenticated session
+func (s *manageSieveSession) command(cmd string, args []string) {
+	nArgs := map[string]int{"HAVESPACE": 2, "PUTSCRIPT": 2, "CHECKSCRIPT": 1, "LISTSCRIPTS": 0, "SETACTIVE": 1, "GETSCRIPT": 1, "DELETESCRIPT": 1, "RENAMESCRIPT": 2}
+	n, ok := nArgs[cmd]
+	if !ok {
+		s.no("unknown command " + cmd)
+		return
+	}
+	if len(args) != n {
+		s.no(fmt.Sprintf("%s expects %d arguments", cmd, n))
+		return
+	}
+	var err error
+	switch cmd {
+	case "HAVESPACE":
+		size, err := strconv.Atoi(args[1])
+		if err != nil {
+			s.no("bad size")
+		} else if max := Cfg.GetSieveMaxScriptSize(); max != 0 && size > max {
+			s.write(`NO (QUOTA/MAXSIZE) "script is too big"`)
+		} else {
+			s.ok("putscript would succeed")
+		}
+		return
+	case "CHECKSCRIPT":
+		err = SieveScriptCheck(args[0])
+	case "PUTSCRIPT":
+		_, err = SieveScriptPut(s.user, args[0], args[1])
+	case "LISTSCRIPTS":
+		var scripts []SieveScript
+		if scripts, err = SieveScriptList(s.user); err == nil {
+			lines := []string{}
+			for _, script := range scripts {
+				if script.Active {
+					lines = append(lines, s.quote(script.Name)+" ACTIVE")
+				} else {
+					lines = append(lines, s.quote(script.Name))
+				}
+			}
+			if len(lines) != 0 {
+				s.write(lines...)
+			}
+		}
+	case "SETACTIVE":
+		err = SieveScriptActivate(s.user, args[0])
+	case "GETSCRIPT":
+		var script SieveScript
+		if script, err = SieveScriptGet(s.user, args[0]); err == nil {
+			s.write(fmt.Sprintf("{%d}", len(script.Content)), script.Content)
+		}
+	case "DELETESCRIPT":
+		err = SieveScriptDel(s.user, args[0])
+	case "RENAMESCRIPT":
+		err = SieveScriptRename(s.user, args[0], args[1])
+	}
+	if err == gorm.RecordNotFound {
+		s.write(`NO (NONEXISTENT) "no such script"`)
+		return
+	}
+	if err != nil {
+		s.no(err.Error())
+		return
+	}
+	if cmd == "PUTSCRIPT" || cmd == "DELETESCRIPT" || cmd == "SETACTIVE" || cmd == "RENAMESCRIPT" {
+		Log.Info("managesieve - " + s.user + " - " + cmd + " " + strings.Join(args[:1], " "))
+	}
+	s.ok(strings.ToLower(cmd) + " completed")
+}
@@ -0,0 +1,286 @@
+package core
+
+// Message tracing
+// Events of the life of messages are stored in DB: accepted (received by
+// smtpd), filtered (verdict of a check, a milter, a microservice or a
+// hook), queued, each delivery attempt (deferred, with remote address and
+// reply) and the final disposition (delivered, bounced or discarded).
+// Events are kept message_trace_retention days (0: tracing disabled).
+// Events of smtpd are recorded at the end of the transaction, with the queue
+// id of the message ("" if it's not queued).
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// message events
+const (
+	TraceAccepted  = "accepted"
+	TraceFiltered  = "filtered"
+	TraceRejected  = "rejected" // temporary failure of smtpd (journal, queue)
+	TraceQueued    = "queued"
+	TraceDeferred  = "deferred"
+	TraceDelivered = "delivered"
+	TraceBounced   = "bounced"
+	TraceDiscarded = "discarded"
+)
+
+// default max number of messages returned by MessageTraceSearch
+const messageTraceSearchLimit = 50
+
+// MessageEvent represents an event of the life of a message
+type MessageEvent struct {
+	Id         int64
+	Uuid       string // queue id ("" if message is not queued)
+	SessionId  string // smtpd session
+	MessageId  string
+	MailFrom   string
+	RcptTo     string // recipients separated by ", "
+	AuthUser   string
+	Event      string
+	OccurredAt time.Time
+	RemoteAddr string // client (smtpd) or remote server (delivery)
+	Code       int    // SMTP reply code (0 if none)
+	Detail     string `sql:"type:text;"`
+}
+
+// MessageTimeline represents events of a message
+type MessageTimeline struct {
+	Uuid      string
+	SessionId string
+	MessageId string
+	MailFrom  string
+	Events    []MessageEvent
+}
+
+// MessageTraceQuery represents a search of messages, empty fields match all
+// messages
+type MessageTraceQuery struct {
+	MessageId string
+	MailFrom  string
+	RcptTo    string // one of the recipients
+	Since     time.Time
+	Until     time.Time
+	Limit     int // max messages (default messageTraceSearchLimit)
+}
+
+// messageTraceEnabled returns true if events are recorded
+func messageTraceEnabled() bool {
+	return Cfg.GetMessageTraceRetention() > 0
+}
+
+// messageTraceRecord records event e
+func messageTraceRecord(e MessageEvent) {
+	if !messageTraceEnabled() {
+		return
+	}
+	e.Id = 0
+	e.MessageId = strings.Trim(e.MessageId, "<>")
+	if e.OccurredAt.IsZero() {
+		e.OccurredAt = time.Now()
+	}
+	if err := DB.Create(&e).Error; err != nil {
+		Log.Error("trace - unable to record event " + e.Event + " of message " + e.Uuid + " - " + err.Error())
+	}
+}
+
+// traceReplyCode returns code of SMTP reply (0 if none)
+func traceReplyCode(reply string) int {
+	if len(reply) < 3 {
+		return 0
+	}
+	code, _ := strconv.Atoi(reply[:3])
+	return code
+}
+
+// traceMessage adds event of current transaction of session s (recorded
+// by traceFlush)
+func (s *SMTPServerSession) traceMessage(event string, code int, detail string) {
+	if !messageTraceEnabled() {
+		return
+	}
+	authUser := ""
+	if s.user != nil {
+		authUser = s.user.Login
+	}
+	s.trace = append(s.trace, MessageEvent{
+		SessionId:  s.uuid,
+		MailFrom:   s.envelope.MailFrom,
+		RcptTo:     strings.Join(s.envelope.RcptTo, ", "),
+		AuthUser:   authUser,
+		Event:      event,
+		OccurredAt: time.Now(),
+		RemoteAddr: s.conn.RemoteAddr().String(),
+		Code:       code,
+		Detail:     detail,
+	})
+}
+
+// traceFlush records events of current transaction of session s, queueId
+// is "" if message is not queued
+func (s *SMTPServerSession) traceFlush(queueId, messageId string) {
+	for _, e := range s.trace {
+		e.Uuid, e.MessageId = queueId, messageId
+		messageTraceRecord(e)
+	}
+	s.trace = nil
+}
+
+// traceDelivery records delivery event of q (attempt of d)
+func (d *delivery) traceDelivery(q *QMessage, event, detail string) {
+	messageTraceRecord(MessageEvent{
+		Uuid:       q.Uuid,
+		SessionId:  q.SessionId,
+		MessageId:  q.MessageId,
+		MailFrom:   q.MailFrom,
+		RcptTo:     q.RcptTo,
+		AuthUser:   q.AuthUser,
+		Event:      event,
+		RemoteAddr: d.remoteAddr,
+		Code:       d.replyCode,
+		Detail:     detail,
+	})
+}
+
+// MessageTrace returns events of message id (queue id or Message-ID), a
+// Message-ID may match several messages
+func MessageTrace(id string) (timelines []MessageTimeline, err error) {
+	id = strings.Trim(strings.TrimSpace(id), "<>")
+	if id == "" {
+		return nil, errors.New("queue id or Message-ID expected")
+	}
+	events := []MessageEvent{}
+	if err = DB.Where("uuid = ? OR message_id = ?", id, id).Order("occurred_at, id").Find(&events).Error; err != nil {
+		return
+	}
+	return messageTimelines(events, 0)
+}
+
+// MessageTraceSearch returns events of messages matching q (the most recent
+// first). Messages are selected in DB (at most q.Limit), then their events
+// are loaded with one query.
+func MessageTraceSearch(q MessageTraceQuery) ([]MessageTimeline, error) {
+	where, args := []string{"1 = 1"}, []interface{}{}
+	if q.MessageId = strings.Trim(strings.TrimSpace(q.MessageId), "<>"); q.MessageId != "" {
+		where, args = append(where, "message_id = ?"), append(args, q.MessageId)
+	}
+	if q.MailFrom = strings.TrimSpace(q.MailFrom); q.MailFrom != "" {
+		where, args = append(where, "mail_from = ?"), append(args, q.MailFrom)
+	}
+	if q.RcptTo = strings.TrimSpace(q.RcptTo); q.RcptTo != "" {
+		where, args = append(where, "rcpt_to LIKE ?"), append(args, "%"+q.RcptTo+"%")
+	}
+	if !q.Since.IsZero() {
+		where, args = append(where, "occurred_at >= ?"), append(args, q.Since)
+	}
+	if !q.Until.IsZero() {
+		where, args = append(where, "occurred_at <= ?"), append(args, q.Until)
+	}
+	if q.Limit <= 0 {
+		q.Limit = messageTraceSearchLimit
+	}
+	// messages matching q, the most recent first
+	keys := []struct {
+		Uuid      string
+		SessionId string
+		MessageId string
+		Last      time.Time
+	}{}
+	table := dbQuote(DB.NewScope(MessageEvent{}).TableName())
+	query := "SELECT uuid, session_id, message_id, MAX(occurred_at) AS last FROM " + table + " WHERE " + strings.Join(where, " AND ") + " GROUP BY uuid, session_id, message_id ORDER BY last DESC LIMIT ?"
+	if err := DB.Raw(query, append(args, q.Limit)...).Scan(&keys).Error; err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return []MessageTimeline{}, nil
+	}
+	uuids, others := []string{}, []string{}
+	for _, k := range keys {
+		if k.Uuid != "" {
+			uuids = append(uuids, k.Uuid)
+		} else {
+			others = append(others, k.SessionId)
+		}
+	}
+	where, args = []string{}, []interface{}{}
+	if len(uuids) != 0 {
+		where, args = append(where, "uuid IN (?)"), append(args, uuids)
+	}
+	if len(others) != 0 {
+		where, args = append(where, "(uuid = ? AND session_id IN (?))"), append(args, "", others)
+	}
+	events := []MessageEvent{}
+	if err := DB.Where(strings.Join(where, " OR "), args...).Order("occurred_at, id").Find(&events).Error; err != nil {
+		return nil, err
+	}
+	// timelines in order of keys
+	byKey := make(map[string][]MessageEvent)
+	for _, e := range events {
+		key := messageTraceKey(e.Uuid, e.SessionId, e.MessageId)
+		byKey[key] = append(byKey[key], e)
+	}
+	timelines, seen := []MessageTimeline{}, map[string]bool{}
+	for _, k := range keys {
+		key := messageTraceKey(k.Uuid, k.SessionId, k.MessageId)
+		if seen[key] || len(byKey[key]) == 0 {
+			continue
+		}
+		seen[key] = true
+		first := byKey[key][0]
+		timelines = append(timelines, MessageTimeline{Uuid: first.Uuid, SessionId: first.SessionId, MessageId: first.MessageId, MailFrom: first.MailFrom, Events: byKey[key]})
+	}
+	return timelines, nil
+}
+
+// messageTraceKey returns key of timeline of an event: queue id, smtpd
+// session & Message-ID of messages which are not queued
+func messageTraceKey(uuid, sessionId, messageId string) string {
+	if uuid != "" {
+		return uuid
+	}
+	return sessionId + " " + messageId
+}
+
+// messageTimelines returns timelines of messages of events (at most limit
+// messages if limit != 0, in order of events), with all their events
+func messageTimelines(events []MessageEvent, limit int) ([]MessageTimeline, error) {
+	timelines, seen := []MessageTimeline{}, map[string]bool{}
+	for _, e := range events {
+		key := messageTraceKey(e.Uuid, e.SessionId, e.MessageId)
+		if seen[key] {
+			continue
+		}
+		if limit != 0 && len(timelines) == limit {
+			break
+		}
+		seen[key] = true
+		timelines = append(timelines, MessageTimeline{Uuid: e.Uuid, SessionId: e.SessionId, MessageId: e.MessageId, MailFrom: e.MailFrom})
+	}
+	for i := range timelines {
+		t := &timelines[i]
+		where, args := "uuid = ?", []interface{}{t.Uuid}
+		if t.Uuid == "" {
+			where, args = "uuid = ? AND session_id = ? AND message_id = ?", []interface{}{"", t.SessionId, t.MessageId}
+		}
+		if err := DB.Where(where, args...).Order("occurred_at, id").Find(&t.Events).Error; err != nil {
+			return nil, err
+		}
+	}
+	return timelines, nil
+}
+
+// LaunchMessageTracePurge removes events older than message_trace_retention
+// days
+func LaunchMessageTracePurge() {
+	Log.Info("message trace purge launched")
+	for {
+		retention := time.Duration(Cfg.GetMessageTraceRetention()) * 24 * time.Hour
+		if err := DB.Where("occurred_at < ?", time.Now().Add(-retention)).Delete(MessageEvent{}).Error; err != nil {
+			Log.Error("trace - unable to purge events - " + err.Error())
+		}
+		time.Sleep(time.Hour)
+	}
+}
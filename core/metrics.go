@@ -0,0 +1,271 @@
+package core
+
+// Prometheus metrics
+// Counters and histograms are kept in memory, gauges (sessions, queue,
+// self monitoring) are computed on scrape. They are exported in the Prometheus text format on
+// /metrics of the metrics listener (metrics_listen, disabled if empty).
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// buckets of histograms (seconds)
+var (
+	metricsRouteLatencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+)
+
+// metricsHistogram represents an histogram, series are indexed by their
+// labels
+type metricsHistogram struct {
+	buckets []float64
+	series  map[string]*metricsSeries
+}
+
+// metricsSeries represents a serie of an histogram
+type metricsSeries struct {
+	counts []uint64 // per bucket (not cumulative)
+	sum    float64
+	count  uint64
+}
+
+// newMetricsHistogram returns an histogram with buckets
+func newMetricsHistogram(buckets []float64) *metricsHistogram {
+	return &metricsHistogram{buckets: buckets, series: make(map[string]*metricsSeries)}
+}
+
+// observe adds value to serie labels
+func (h *metricsHistogram) observe(labels string, value float64) {
+	s, ok := h.series[labels]
+	if !ok {
+		s = &metricsSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[labels] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// write writes histogram name in Prometheus text format
+func (h *metricsHistogram) write(out *bytes.Buffer, name, help string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, labels := range metricsSortedKeys(h.series) {
+		s := h.series[labels]
+		sep := ""
+		if labels != "" {
+			sep = ","
+		}
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(out, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(out, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, s.count)
+		fmt.Fprintf(out, "%s_sum%s %s\n", name, metricsBraces(labels), strconv.FormatFloat(s.sum, 'g', -1, 64))
+		fmt.Fprintf(out, "%s_count%s %d\n", name, metricsBraces(labels), s.count)
+	}
+}
+
+var metrics = struct {
+	sync.Mutex
+	messages     map[string]uint64 // smtpd messages per result & reason
+	attempts     map[string]uint64 // delivery attempts per result & code
+	tlsSessions  map[string]uint64 // TLS sessions per direction & version
+	routeLatency *metricsHistogram
+}{
+	messages:     make(map[string]uint64),
+	attempts:     make(map[string]uint64),
+	tlsSessions:  make(map[string]uint64),
+	routeLatency: newMetricsHistogram(metricsRouteLatencyBuckets),
+}
+
+// metricsLabels returns labels (name, value, name, value...) in Prometheus
+// format
+func metricsLabels(pairs ...string) string {
+	labels := []string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value := strings.Replace(pairs[i+1], `\`, `\\`, -1)
+		value = strings.Replace(value, `"`, `\"`, -1)
+		value = strings.Replace(value, "\n", `\n`, -1)
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", pairs[i], value))
+	}
+	return strings.Join(labels, ",")
+}
+
+// metricsBraces returns labels between braces ("" if there is no label)
+func metricsBraces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+// metricsSortedKeys returns keys of m sorted
+func metricsSortedKeys(m interface{}) (keys []string) {
+	switch m := m.(type) {
+	case map[string]uint64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*metricsSeries:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return
+}
+
+// metricsMessage counts a message received by smtpd, reason is the name of
+// the check which decided
+func metricsMessage(action smtpdAction, reason string) {
+	if reason == "" {
+		reason = "none"
+	}
+	metrics.Lock()
+	metrics.messages[metricsLabels("result", action.String(), "reason", reason)]++
+	metricsRollupCount("smtpd", action.String(), reason)
+	metrics.Unlock()
+}
+
+// metricsDeliveryAttempt counts a delivery attempt, code is the SMTP reply
+// code (0 if none)
+func metricsDeliveryAttempt(result string, code int) {
+	c := "none"
+	if code != 0 {
+		c = strconv.Itoa(code)
+	}
+	metrics.Lock()
+	metrics.attempts[metricsLabels("result", result, "code", c)]++
+	metricsRollupCount("delivery", result, c)
+	metrics.Unlock()
+}
+
+// metricsTLSSession counts a TLS session, direction is inbound or outbound
+func metricsTLSSession(direction, version string) {
+	metrics.Lock()
+	metrics.tlsSessions[metricsLabels("direction", direction, "version", version)]++
+	metrics.Unlock()
+}
+
+// metricsRouteLatency records duration of a delivery through route
+func metricsRouteLatency(route string, duration time.Duration) {
+	metrics.Lock()
+	metrics.routeLatency.observe(metricsLabels("route", route), duration.Seconds())
+	metrics.Unlock()
+}
+
+// metricsWriteCounter writes counter name in Prometheus text format
+func metricsWriteCounter(out *bytes.Buffer, name, help string, values map[string]uint64) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, labels := range metricsSortedKeys(values) {
+		fmt.Fprintf(out, "%s%s %d\n", name, metricsBraces(labels), values[labels])
+	}
+}
+
+// metricsWriteGauge writes gauge name in Prometheus text format
+func metricsWriteGauge(out *bytes.Buffer, name, help string, values map[string]uint64) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, labels := range metricsSortedKeys(values) {
+		fmt.Fprintf(out, "%s%s %d\n", name, metricsBraces(labels), values[labels])
+	}
+}
+
+// metricsQueue writes queue gauges, messages are counted by the DB
+func metricsQueue(out *bytes.Buffer) error {
+	rows := []struct {
+		Status uint32
+		Count  uint64
+	}{}
+	table := dbQuote(DB.NewScope(QMessage{}).TableName())
+	if err := DB.Raw("SELECT status, COUNT(*) AS count FROM " + table + " GROUP BY status").Scan(&rows).Error; err != nil {
+		return err
+	}
+	perStatus := make(map[string]uint64)
+	for _, r := range rows {
+		perStatus[metricsLabels("status", strconv.Itoa(int(r.Status)))] = r.Count
+	}
+	metricsWriteGauge(out, "tmail_queue_messages", "Messages in queue per status", perStatus)
+	oldest := []QMessage{}
+	if err := DB.Select("added_at").Order("added_at").Limit(1).Find(&oldest).Error; err != nil && err != gorm.RecordNotFound {
+		return err
+	}
+	age := uint64(0)
+	if len(oldest) != 0 {
+		age = uint64(time.Since(oldest[0].AddedAt).Seconds())
+	}
+	metricsWriteGauge(out, "tmail_queue_oldest_message_age_seconds", "Age of the oldest message in queue", map[string]uint64{"": age})
+	return nil
+}
+
+// metricsMonitor writes counters of self monitoring
+func metricsMonitor(out *bytes.Buffer) {
+	stats := MonitorGetStats()
+	metricsWriteGauge(out, "tmail_goroutines", "Goroutines", map[string]uint64{"": uint64(stats.Goroutines)})
+	if stats.OpenFds >= 0 {
+		metricsWriteGauge(out, "tmail_open_fds", "Open file descriptors", map[string]uint64{"": uint64(stats.OpenFds)})
+	}
+	goroutines, conns, oldest := make(map[string]uint64), make(map[string]uint64), make(map[string]uint64)
+	for name, ss := range stats.Subsystems {
+		labels := metricsLabels("subsystem", name)
+		goroutines[labels] = uint64(ss.Goroutines)
+		conns[labels] = uint64(ss.OpenConns)
+		oldest[labels] = uint64(ss.OldestConnAge.Seconds())
+	}
+	metricsWriteGauge(out, "tmail_subsystem_goroutines", "Goroutines per subsystem", goroutines)
+	metricsWriteGauge(out, "tmail_subsystem_connections", "Open connections per subsystem", conns)
+	metricsWriteGauge(out, "tmail_subsystem_oldest_connection_age_seconds", "Age of the oldest open connection per subsystem", oldest)
+}
+
+// metricsHandler exports metrics
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	out := &bytes.Buffer{}
+	sessions := MonitorGetStats().Subsystems["smtpd"].OpenConns
+	fmt.Fprintf(out, "# HELP tmail_smtpd_sessions_active Active inbound SMTP sessions\n# TYPE tmail_smtpd_sessions_active gauge\ntmail_smtpd_sessions_active %d\n", sessions)
+	memUsed, memBudget, memRefusals := smtpdMemoryStats()
+	fmt.Fprintf(out, "# HELP tmail_smtpd_memory_used_bytes Approximate memory used by smtpd sessions\n# TYPE tmail_smtpd_memory_used_bytes gauge\ntmail_smtpd_memory_used_bytes %d\n", memUsed)
+	fmt.Fprintf(out, "# HELP tmail_smtpd_memory_budget_bytes Memory budget of smtpd sessions (0: unlimited)\n# TYPE tmail_smtpd_memory_budget_bytes gauge\ntmail_smtpd_memory_budget_bytes %d\n", memBudget)
+	refusals := make(map[string]uint64)
+	for stage, count := range memRefusals {
+		refusals[metricsLabels("stage", stage)] = count
+	}
+	metricsWriteCounter(out, "tmail_smtpd_memory_refusals_total", "Connections, transactions and messages refused because of memory budget per stage", refusals)
+	if err := metricsQueue(out); err != nil {
+		Log.Error("metrics - unable to get queue - " + err.Error())
+		http.Error(w, "unable to get queue", 500)
+		return
+	}
+	metricsMonitor(out)
+	metrics.Lock()
+	metricsWriteCounter(out, "tmail_smtpd_messages_total", "Messages received by smtpd per result and reason", metrics.messages)
+	metricsWriteCounter(out, "tmail_deliverd_attempts_total", "Delivery attempts per result and SMTP reply code", metrics.attempts)
+	metricsWriteCounter(out, "tmail_tls_sessions_total", "TLS sessions per direction and version", metrics.tlsSessions)
+	metrics.routeLatency.write(out, "tmail_deliverd_route_latency_seconds", "Duration of successful remote deliveries per route")
+	metrics.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(out.Bytes())
+}
+
+// LaunchMetricsServer launches the HTTP server exporting metrics
+func LaunchMetricsServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	addr := Cfg.GetMetricsListen()
+	Log.Info("metrics server listening on " + addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		Log.Error("metrics server stopped - " + err.Error())
+	}
+}
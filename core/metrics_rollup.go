@@ -0,0 +1,202 @@
+package core
+
+// Metrics rollups
+// Counters of messages received by smtpd and of delivery attempts are stored
+// in DB every 5 minutes (raw rollups), then summed by hour and by day.
+// Retention: raw 7 days, hourly 90 days, daily 2 years. Rollups survive
+// restarts and Prometheus retention, they are queried with MetricsHistory
+// (REST /metrics/history).
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// MetricsRollup represents a counter during a period
+type MetricsRollup struct {
+	Id     int64
+	Tier   string    // raw (5 minutes), hourly or daily
+	Period time.Time // start of period (UTC)
+	Kind   string    // smtpd (messages received) or delivery (attempts)
+	Result string    // accept, reject... (smtpd) or success, temp, perm (delivery)
+	Detail string    // reason (smtpd) or SMTP code (delivery)
+	Count  int64
+}
+
+// metricsRollupTier is a tier of rollups
+type metricsRollupTier struct {
+	name      string
+	period    time.Duration
+	retention time.Duration
+}
+
+var metricsRollupTiers = []metricsRollupTier{
+	{"raw", 5 * time.Minute, 7 * 24 * time.Hour},
+	{"hourly", time.Hour, 90 * 24 * time.Hour},
+	{"daily", 24 * time.Hour, 2 * 365 * 24 * time.Hour},
+}
+
+// periods are aggregated only once this delay is over after their end: raw
+// rollups of all nodes are flushed (every raw period)
+const metricsRollupGrace = 3 * 5 * time.Minute
+
+// metricsRollupKey identifies a counter
+type metricsRollupKey struct {
+	kind, result, detail string
+}
+
+// counters since last flush
+var metricsRollupPending = make(map[metricsRollupKey]int64)
+
+// metricsRollupCount counts an event for rollups (caller holds metrics lock)
+func metricsRollupCount(kind, result, detail string) {
+	metricsRollupPending[metricsRollupKey{kind, result, detail}]++
+}
+
+// metricsRollupFlush stores counters since last flush as raw rollups of
+// period, counters are kept on error
+func metricsRollupFlush(period time.Time) error {
+	metrics.Lock()
+	pending := metricsRollupPending
+	metricsRollupPending = make(map[metricsRollupKey]int64)
+	metrics.Unlock()
+	tx := DB.Begin()
+	for k, count := range pending {
+		rollup := MetricsRollup{Tier: "raw", Period: period, Kind: k.kind, Result: k.result, Detail: k.detail, Count: count}
+		if err := tx.Create(&rollup).Error; err != nil {
+			tx.Rollback()
+			metrics.Lock()
+			for k, count := range pending {
+				metricsRollupPending[k] += count
+			}
+			metrics.Unlock()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// metricsRollupAggregate sums rollups of tier from into tier to for the
+// complete periods of to which are not aggregated yet and whose rollups of
+// tier from are all stored (metricsRollupGrace)
+func metricsRollupAggregate(from, to metricsRollupTier, now time.Time) error {
+	end := now.Add(-metricsRollupGrace).Truncate(to.period)
+	start := now.Add(-from.retention).Truncate(to.period)
+	last := MetricsRollup{}
+	err := DB.Where("tier = ?", to.name).Order("period desc").First(&last).Error
+	if err == nil && last.Period.Add(to.period).After(start) {
+		start = last.Period.Add(to.period)
+	} else if err != nil && err != gorm.RecordNotFound {
+		return err
+	}
+	// skip periods without rollup
+	next := MetricsRollup{}
+	err = DB.Where("tier = ? AND period >= ?", from.name, start).Order("period").First(&next).Error
+	if err == gorm.RecordNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	start = next.Period.Truncate(to.period)
+	for period := start; period.Before(end); period = period.Add(to.period) {
+		rows := []MetricsRollup{}
+		if err = DB.Where("tier = ? AND period >= ? AND period < ?", from.name, period, period.Add(to.period)).Find(&rows).Error; err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			continue
+		}
+		sums := make(map[metricsRollupKey]int64)
+		for _, r := range rows {
+			sums[metricsRollupKey{r.Kind, r.Result, r.Detail}] += r.Count
+		}
+		tx := DB.Begin()
+		// another node may have done it (periods are complete, its sums
+		// are the same)
+		var c uint
+		if err = tx.Model(MetricsRollup{}).Where("tier = ? AND period = ?", to.name, period).Count(&c).Error; err != nil || c != 0 {
+			tx.Rollback()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		for k, count := range sums {
+			rollup := MetricsRollup{Tier: to.name, Period: period, Kind: k.kind, Result: k.result, Detail: k.detail, Count: count}
+			if err = tx.Create(&rollup).Error; err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err = tx.Commit().Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metricsRollupRun stores pending counters, aggregates and purges rollups
+func metricsRollupRun(now time.Time) error {
+	if err := metricsRollupFlush(now.Truncate(metricsRollupTiers[0].period).Add(-metricsRollupTiers[0].period)); err != nil {
+		return errors.New("unable to store counters - " + err.Error())
+	}
+	for i := 1; i < len(metricsRollupTiers); i++ {
+		if err := metricsRollupAggregate(metricsRollupTiers[i-1], metricsRollupTiers[i], now); err != nil {
+			return errors.New("unable to aggregate " + metricsRollupTiers[i].name + " rollups - " + err.Error())
+		}
+	}
+	for _, tier := range metricsRollupTiers {
+		if err := DB.Where("tier = ? AND period < ?", tier.name, now.Add(-tier.retention)).Delete(MetricsRollup{}).Error; err != nil {
+			return errors.New("unable to purge " + tier.name + " rollups - " + err.Error())
+		}
+	}
+	return nil
+}
+
+// LaunchMetricsRollups stores rollups every 5 minutes
+func LaunchMetricsRollups() {
+	Log.Info("metrics rollups launched")
+	for {
+		now := time.Now().UTC()
+		time.Sleep(now.Truncate(metricsRollupTiers[0].period).Add(metricsRollupTiers[0].period).Sub(now))
+		if err := metricsRollupRun(time.Now().UTC()); err != nil {
+			Log.Error("metrics rollups - " + err.Error())
+		}
+	}
+}
+
+// MetricsHistory returns rollups of kind (all if empty) whose period is
+// between from and to. tier is raw, hourly or daily, if empty it's chosen
+// according to the range (raw up to 2 days, hourly up to 60 days).
+func MetricsHistory(kind, tier string, from, to time.Time) (rollups []MetricsRollup, err error) {
+	if !to.After(from) {
+		return nil, errors.New("end of range must be after its start")
+	}
+	if tier == "" {
+		switch r := to.Sub(from); {
+		case r <= 48*time.Hour:
+			tier = "raw"
+		case r <= 60*24*time.Hour:
+			tier = "hourly"
+		default:
+			tier = "daily"
+		}
+	}
+	found := false
+	for _, t := range metricsRollupTiers {
+		found = found || t.name == tier
+	}
+	if !found {
+		return nil, fmt.Errorf("bad tier %s, must be raw, hourly or daily", tier)
+	}
+	rollups = []MetricsRollup{}
+	q := DB.Where("tier = ? AND period >= ? AND period < ?", tier, from.UTC(), to.UTC())
+	if kind != "" {
+		q = q.Where("kind = ?", kind)
+	}
+	err = q.Order("period, kind, result, detail").Find(&rollups).Error
+	return
+}
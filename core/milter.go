@@ -0,0 +1,364 @@
+package core
+
+// Milter client (sendmail milter protocol v6)
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// milter commands (MTA -> milter)
+const (
+	milterCmdAbort   = 'A'
+	milterCmdBody    = 'B'
+	milterCmdConnect = 'C'
+	milterCmdMacro   = 'D'
+	milterCmdEOB     = 'E'
+	milterCmdHelo    = 'H'
+	milterCmdHeader  = 'L'
+	milterCmdMail    = 'M'
+	milterCmdEOH     = 'N'
+	milterCmdOptNeg  = 'O'
+	milterCmdQuit    = 'Q'
+	milterCmdRcpt    = 'R'
+	milterCmdData    = 'T'
+)
+
+// milter replies (milter -> MTA)
+const (
+	milterRespAccept     = 'a'
+	milterRespContinue   = 'c'
+	milterRespDiscard    = 'd'
+	milterRespReject     = 'r'
+	milterRespTempfail   = 't'
+	milterRespReplyCode  = 'y'
+	milterRespProgress   = 'p'
+	milterRespAddHeader  = 'h'
+	milterRespInsHeader  = 'i'
+	milterRespChgHeader  = 'm'
+	milterRespQuarantine = 'q'
+)
+
+// actions we allow milters to do
+const (
+	milterActAddHeaders = 0x01
+	milterActChgHeaders = 0x10
+	milterActQuarantine = 0x20
+)
+
+// protocol flags
+const (
+	milterProtoNoConnect = 0x01
+	milterProtoNoHelo    = 0x02
+	milterProtoNoMail    = 0x04
+	milterProtoNoRcpt    = 0x08
+	milterProtoNoBody    = 0x10
+	milterProtoNoHeaders = 0x20
+	milterProtoNoEOH     = 0x40
+	milterProtoNrHeader  = 0x80
+	milterProtoNoData    = 0x200
+	milterProtoNrConnect = 0x1000
+	milterProtoNrHelo    = 0x2000
+	milterProtoNrMail    = 0x4000
+	milterProtoNrRcpt    = 0x8000
+	milterProtoNrData    = 0x10000
+	milterProtoNrEOH     = 0x40000
+	milterProtoNrBody    = 0x80000
+	milterProtoLeadSpace = 0x100000
+)
+
+const (
+	milterVersion      = 6
+	milterMaxBodyChunk = 65535
+)
+
+var errMilterProtocol = errors.New("milter protocol error")
+
+// milterMod is a modification requested by a milter at end of body
+type milterMod struct {
+	cmd   byte
+	index uint32
+	name  string
+	value string
+}
+
+// milterReply is the reply of a milter to a command
+type milterReply struct {
+	cmd  byte
+	text string // SMTP reply (replycode) or quarantine reason
+	mods []milterMod
+}
+
+// milterClient is a connection to a milter
+type milterClient struct {
+	uri       string
+	network   string
+	address   string
+	timeout   time.Duration
+	onFailure onfailure
+	conn      net.Conn
+	reader    *bufio.Reader
+	protocol  uint32
+	actions   uint32
+	// milter accepted the message (or connection), no more commands are
+	// sent until the next message
+	accepted bool
+	done     bool // accepted the connection or failed
+}
+
+// newMilterClient returns a milter client parsing URI
+// inet://host:port?timeout=10&onfailure=tempfail or unix:///path/to/socket
+func newMilterClient(uri string) (*milterClient, error) {
+	m := &milterClient{
+		uri:       strings.Split(uri, "?")[0],
+		timeout:   10 * time.Second,
+		onFailure: CONTINUE,
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	switch parsed.Scheme {
+	case "inet", "tcp":
+		m.network, m.address = "tcp", parsed.Host
+	case "unix":
+		m.network, m.address = "unix", parsed.Path
+	default:
+		return nil, errors.New("unsupported milter scheme " + parsed.Scheme)
+	}
+	if t := parsed.Query().Get("timeout"); t != "" {
+		timeout, err := strconv.ParseUint(t, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		m.timeout = time.Duration(timeout) * time.Second
+	}
+	switch parsed.Query().Get("onfailure") {
+	case "tempfail":
+		m.onFailure = TEMPFAIL
+	case "permfail":
+		m.onFailure = PERMFAIL
+	}
+	return m, nil
+}
+
+// connect connects to milter & negotiates options
+func (m *milterClient) connect() (err error) {
+	if m.conn, err = net.DialTimeout(m.network, m.address, m.timeout); err != nil {
+		return err
+	}
+	m.reader = bufio.NewReader(m.conn)
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data, milterVersion)
+	binary.BigEndian.PutUint32(data[4:], milterActAddHeaders|milterActChgHeaders|milterActQuarantine)
+	binary.BigEndian.PutUint32(data[8:], 0x1fffff)
+	if err = m.send(milterCmdOptNeg, data); err != nil {
+		return err
+	}
+	cmd, resp, err := m.read()
+	if err != nil {
+		return err
+	}
+	if cmd != milterCmdOptNeg || len(resp) < 12 {
+		return errMilterProtocol
+	}
+	if binary.BigEndian.Uint32(resp) < 2 {
+		return errors.New("unsupported milter version")
+	}
+	m.actions = binary.BigEndian.Uint32(resp[4:])
+	m.protocol = binary.BigEndian.Uint32(resp[8:])
+	return nil
+}
+
+// close sends QUIT then closes connection
+func (m *milterClient) close() {
+	if m.conn == nil {
+		return
+	}
+	m.send(milterCmdQuit, nil)
+	m.conn.Close()
+	m.conn = nil
+}
+
+// send sends a command
+func (m *milterClient) send(cmd byte, data []byte) error {
+	m.conn.SetWriteDeadline(time.Now().Add(m.timeout))
+	packet := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(len(data)+1))
+	packet[4] = cmd
+	_, err := m.conn.Write(append(packet, data...))
+	return err
+}
+
+// read reads a packet
+func (m *milterClient) read() (cmd byte, data []byte, err error) {
+	m.conn.SetReadDeadline(time.Now().Add(m.timeout))
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(m.reader, header); err != nil {
+		return
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size == 0 || size > 1<<20 {
+		return 0, nil, errMilterProtocol
+	}
+	packet := make([]byte, size)
+	if _, err = io.ReadFull(m.reader, packet); err != nil {
+		return
+	}
+	return packet[0], packet[1:], nil
+}
+
+// milterCString returns s as a NUL terminated string
+func milterCString(s ...string) []byte {
+	data := []byte{}
+	for _, str := range s {
+		data = append(data, []byte(str)...)
+		data = append(data, 0)
+	}
+	return data
+}
+
+// milterSplitCStrings splits NUL terminated strings
+func milterSplitCStrings(data []byte) []string {
+	return strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00")
+}
+
+// macros sends macros for command cmd
+func (m *milterClient) macros(cmd byte, macros ...string) error {
+	if len(macros) == 0 {
+		return nil
+	}
+	return m.send(milterCmdMacro, append([]byte{cmd}, milterCString(macros...)...))
+}
+
+// cmd sends command and returns milter reply
+// noReply is the protocol flag telling that milter doesn't reply to this
+// command
+func (m *milterClient) cmd(cmd byte, data []byte, noReply uint32) (reply milterReply, err error) {
+	if err = m.send(cmd, data); err != nil {
+		return
+	}
+	if noReply != 0 && m.protocol&noReply != 0 {
+		reply.cmd = milterRespContinue
+		return
+	}
+	for {
+		c, resp, err := m.read()
+		if err != nil {
+			return reply, err
+		}
+		switch c {
+		case milterRespProgress:
+			continue
+		case milterRespAccept, milterRespContinue, milterRespDiscard, milterRespReject, milterRespTempfail:
+			reply.cmd = c
+			return reply, nil
+		case milterRespReplyCode:
+			reply.cmd = c
+			reply.text = strings.TrimRight(string(resp), "\x00\r\n")
+			// multiline replies
+			reply.text = strings.Replace(reply.text, "\r\n", " ", -1)
+			return reply, nil
+		case milterRespAddHeader:
+			if m.actions&milterActAddHeaders == 0 || cmd != milterCmdEOB {
+				return reply, errMilterProtocol
+			}
+			t := milterSplitCStrings(resp)
+			if len(t) != 2 {
+				return reply, errMilterProtocol
+			}
+			reply.mods = append(reply.mods, milterMod{cmd: c, name: t[0], value: t[1]})
+		case milterRespInsHeader, milterRespChgHeader:
+			if (c == milterRespInsHeader && m.actions&milterActAddHeaders == 0) || (c == milterRespChgHeader && m.actions&milterActChgHeaders == 0) || cmd != milterCmdEOB || len(resp) < 4 {
+				return reply, errMilterProtocol
+			}
+			t := milterSplitCStrings(resp[4:])
+			if len(t) != 2 {
+				return reply, errMilterProtocol
+			}
+			reply.mods = append(reply.mods, milterMod{cmd: c, index: binary.BigEndian.Uint32(resp), name: t[0], value: t[1]})
+		case milterRespQuarantine:
+			if m.actions&milterActQuarantine == 0 || cmd != milterCmdEOB {
+				return reply, errMilterProtocol
+			}
+			reply.mods = append(reply.mods, milterMod{cmd: c, value: strings.TrimRight(string(resp), "\x00")})
+		default:
+			return reply, fmt.Errorf("unexpected milter reply %q", c)
+		}
+	}
+}
+
+// milterApplyHeaderMods applies header modifications to raw message
+func milterApplyHeaderMods(rawMessage *[]byte, mods []milterMod, leadSpace bool) {
+	p := strings.Index(string(*rawMessage), "\r\n\r\n")
+	if p == -1 {
+		return
+	}
+	headers := strings.Split(string((*rawMessage)[:p]), "\r\n")
+	body := (*rawMessage)[p+4:]
+	toHeader := func(name, value string) string {
+		value = strings.Replace(value, "\n", "\r\n", -1)
+		value = strings.Replace(value, "\r\r\n", "\r\n", -1)
+		if !leadSpace {
+			value = " " + value
+		}
+		return name + ":" + value
+	}
+	// index of header field starts (folded lines are part of headers)
+	fieldStarts := func() []int {
+		starts := []int{}
+		for i, h := range headers {
+			if len(h) != 0 && h[0] != ' ' && h[0] != '\t' {
+				starts = append(starts, i)
+			}
+		}
+		return starts
+	}
+	fieldEnd := func(start int) int {
+		end := start + 1
+		for end < len(headers) && len(headers[end]) != 0 && (headers[end][0] == ' ' || headers[end][0] == '\t') {
+			end++
+		}
+		return end
+	}
+	for _, mod := range mods {
+		switch mod.cmd {
+		case milterRespAddHeader:
+			headers = append(headers, toHeader(mod.name, mod.value))
+		case milterRespInsHeader:
+			starts := fieldStarts()
+			pos := len(headers)
+			if int(mod.index) < len(starts) {
+				pos = starts[mod.index]
+			}
+			headers = append(headers[:pos], append([]string{toHeader(mod.name, mod.value)}, headers[pos:]...)...)
+		case milterRespChgHeader:
+			// index is the nth occurrence (1 based) of header name
+			n := uint32(0)
+			for _, start := range fieldStarts() {
+				if !strings.HasPrefix(strings.ToLower(headers[start]), strings.ToLower(mod.name)+":") {
+					continue
+				}
+				if n++; n != mod.index {
+					continue
+				}
+				end := fieldEnd(start)
+				if mod.value == "" {
+					headers = append(headers[:start], headers[end:]...)
+				} else {
+					headers = append(headers[:start], append([]string{toHeader(mod.name, mod.value)}, headers[end:]...)...)
+				}
+				break
+			}
+		}
+	}
+	*rawMessage = append([]byte(strings.Join(headers, "\r\n")+"\r\n\r\n"), body...)
+}
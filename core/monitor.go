@@ -0,0 +1,174 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Self monitoring
+// Tracks goroutines, open file descriptors and connections per subsystem and
+// raises an alert (log) when one of them grows monotonically, which is
+// generally the sign of a leak.
+
+// monitorSubsystem represents counters of a subsystem (smtpd, deliverd, ...)
+type monitorSubsystem struct {
+	goroutines int64
+	conns      map[uint64]time.Time
+}
+
+// MonitorSubsystemStats represents a snapshot of a subsystem counters
+type MonitorSubsystemStats struct {
+	Goroutines    int64
+	OpenConns     int
+	OldestConnAge time.Duration
+}
+
+// MonitorStats represents a snapshot of monitored counters
+type MonitorStats struct {
+	Goroutines int
+	OpenFds    int // -1 if unavailable
+	Subsystems map[string]MonitorSubsystemStats
+}
+
+var monitor = struct {
+	sync.Mutex
+	subsystems map[string]*monitorSubsystem
+	nextConnId uint64
+	samples    map[string][]int64
+}{
+	subsystems: make(map[string]*monitorSubsystem),
+	samples:    make(map[string][]int64),
+}
+
+// monitorGetSubsystem returns subsystem (creates it if needed)
+// monitor must be locked
+func monitorGetSubsystem(name string) *monitorSubsystem {
+	ss, ok := monitor.subsystems[name]
+	if !ok {
+		ss = &monitorSubsystem{conns: make(map[uint64]time.Time)}
+		monitor.subsystems[name] = ss
+	}
+	return ss
+}
+
+// monitorGoroutineStart must be called when a goroutine starts, the returned
+// func must be called when it ends
+func monitorGoroutineStart(subsystem string) (done func()) {
+	monitor.Lock()
+	monitorGetSubsystem(subsystem).goroutines++
+	monitor.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			monitor.Lock()
+			monitorGetSubsystem(subsystem).goroutines--
+			monitor.Unlock()
+		})
+	}
+}
+
+// monitorConnOpened must be called when a connection is opened, the returned
+// func must be called when it is closed (it can be called more than once)
+func monitorConnOpened(subsystem string) (closed func()) {
+	monitor.Lock()
+	monitor.nextConnId++
+	id := monitor.nextConnId
+	monitorGetSubsystem(subsystem).conns[id] = time.Now()
+	monitor.Unlock()
+	return func() {
+		monitor.Lock()
+		delete(monitorGetSubsystem(subsystem).conns, id)
+		monitor.Unlock()
+	}
+}
+
+// countOpenFds returns the number of open file descriptors of the process
+// (linux only, -1 otherwise)
+func countOpenFds() int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fds)
+}
+
+// MonitorGetStats returns a snapshot of monitored counters
+func MonitorGetStats() MonitorStats {
+	stats := MonitorStats{
+		Goroutines: runtime.NumGoroutine(),
+		OpenFds:    countOpenFds(),
+		Subsystems: make(map[string]MonitorSubsystemStats),
+	}
+	monitor.Lock()
+	defer monitor.Unlock()
+	for name, ss := range monitor.subsystems {
+		s := MonitorSubsystemStats{
+			Goroutines: ss.goroutines,
+			OpenConns:  len(ss.conns),
+		}
+		for _, openedAt := range ss.conns {
+			if age := time.Since(openedAt); age > s.OldestConnAge {
+				s.OldestConnAge = age
+			}
+		}
+		stats.Subsystems[name] = s
+	}
+	return stats
+}
+
+// monitorSample records value for serie and returns true if the serie has
+// grown on each of the last threshold samples
+func monitorSample(serie string, value int64, threshold int) bool {
+	monitor.Lock()
+	defer monitor.Unlock()
+	samples := append(monitor.samples[serie], value)
+	if len(samples) > threshold+1 {
+		samples = samples[len(samples)-threshold-1:]
+	}
+	monitor.samples[serie] = samples
+	if len(samples) < threshold+1 {
+		return false
+	}
+	for i := 1; i < len(samples); i++ {
+		if samples[i] <= samples[i-1] {
+			return false
+		}
+	}
+	return true
+}
+
+// LaunchMonitor launches self monitoring
+func LaunchMonitor() {
+	interval := time.Duration(Cfg.GetMonitorInterval()) * time.Second
+	threshold := Cfg.GetMonitorAlertThreshold()
+	Log.Info("monitor launched")
+	for {
+		time.Sleep(interval)
+		stats := MonitorGetStats()
+		series := map[string]int64{
+			"goroutines": int64(stats.Goroutines),
+		}
+		if stats.OpenFds != -1 {
+			series["fds"] = int64(stats.OpenFds)
+		}
+		for name, ss := range stats.Subsystems {
+			series[name+".goroutines"] = ss.Goroutines
+			series[name+".conns"] = int64(ss.OpenConns)
+		}
+		names := make([]string, 0, len(series))
+		for name := range series {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if monitorSample(name, series[name], threshold) {
+				Log.Error(fmt.Sprintf("monitor - %s has grown monotonically on the last %d samples (now %d), possible leak", name, threshold, series[name]))
+			}
+		}
+		Log.Debug(fmt.Sprintf("monitor - goroutines: %d - fds: %d", stats.Goroutines, stats.OpenFds))
+	}
+}
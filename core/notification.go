@@ -0,0 +1,243 @@
+package core
+
+// Notifications sent to senders by deliverd: bounces, delay warnings and
+// over quota bounces. They are rendered from templates (text/template) of
+// the tpl directory, the first existing one of:
+// tpl/DOMAIN/KIND.LANG.tpl, tpl/DOMAIN/KIND.tpl, tpl/KIND.LANG.tpl,
+// tpl/KIND.tpl
+// DOMAIN is the domain of the notified address (or one of its parents) and
+// LANG its language (notification_languages).
+// Delay warnings are DSN (RFC 3464, action delayed) sent once per message
+// deferred for deliverd_delay_warning hours, senders domains can opt out
+// (deliverd_delay_warning_optout).
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/toorop/tmail/message"
+)
+
+// enhanced status code (RFC 3463) of a reply
+var rxNotificationStatus = regexp.MustCompile(`\b[245]\.[0-9]{1,3}\.[0-9]{1,3}\b`)
+
+// notification kinds (names of templates)
+const (
+	NotificationBounce    = "bounce"
+	NotificationDelay     = "delay"
+	NotificationOverQuota = "over_quota"
+)
+
+// NotificationData is the data of notification templates
+type NotificationData struct {
+	Date           string
+	Me             string
+	RcptTo         string // notified address (sender of the failed message)
+	OriRcptTo      string // recipient of the failed message
+	ErrMsg         string
+	BouncedMail    string // failed message
+	BouncedHeaders string // headers of failed message
+	QueuedAt       string
+	Delay          string // time spent in queue
+	Retries        uint32 // failed delivery attempts
+	GiveUpAt       string // date of bounce if delivery keeps failing (delay)
+	Lang           string
+	Boundary       string             // of multipart/report (DSN)
+	Status         string             // enhanced status code of ErrMsg ("" if none)
+	DiagnosticCode string             // last remote response ("" if none)
+	Delayed        []NotificationRcpt // recipients still being retried (delay)
+}
+
+// NotificationRcpt is a recipient of a delayed message
+type NotificationRcpt struct {
+	Address        string
+	ErrMsg         string
+	Status         string // enhanced status code of ErrMsg ("" if none)
+	DiagnosticCode string // last remote response ("" if none)
+}
+
+// notificationKindOk returns true if kind is a notification kind
+func notificationKindOk(kind string) bool {
+	return kind == NotificationBounce || kind == NotificationDelay || kind == NotificationOverQuota
+}
+
+// notificationLang returns language of notifications sent to address
+// (notification_languages: domain:lang separated by ;, parent domains and
+// TLD match), "" for default language
+func notificationLang(address string) string {
+	domain := strings.ToLower(address[strings.LastIndex(address, "@")+1:])
+	langs := map[string]string{}
+	for _, entry := range strings.Split(Cfg.GetNotificationLanguages(), ";") {
+		if p := strings.Index(entry, ":"); p > 0 {
+			langs[strings.ToLower(strings.TrimSpace(entry[:p]))] = strings.TrimSpace(entry[p+1:])
+		}
+	}
+	for d := domain; d != ""; {
+		if lang, ok := langs[d]; ok {
+			return lang
+		}
+		p := strings.Index(d, ".")
+		if p == -1 {
+			break
+		}
+		d = d[p+1:]
+	}
+	return ""
+}
+
+// notificationTemplatePath returns path of template of kind for domain in
+// lang
+func notificationTemplatePath(kind, domain, lang string) (string, error) {
+	if !notificationKindOk(kind) {
+		return "", errors.New("unknown notification " + kind + " (" + NotificationBounce + ", " + NotificationDelay + " or " + NotificationOverQuota + " expected)")
+	}
+	domain = strings.ToLower(domain)
+	names := []string{kind + ".tpl"}
+	if lang != "" && !strings.ContainsAny(lang, "/\\") {
+		names = append([]string{kind + "." + lang + ".tpl"}, names...)
+	}
+	dirs := []string{}
+	for d := domain; d != ""; {
+		// domain and its parents (not TLD), no path in domain
+		if (d == domain || strings.Contains(d, ".")) && !strings.ContainsAny(d, "/\\") && !strings.HasPrefix(d, ".") {
+			dirs = append(dirs, d)
+		}
+		p := strings.Index(d, ".")
+		if p == -1 {
+			break
+		}
+		d = d[p+1:]
+	}
+	dirs = append(dirs, "")
+	for _, dir := range dirs {
+		for _, name := range names {
+			p := path.Join(GetBasePath(), "tpl", dir, name)
+			if _, err := os.Stat(p); err == nil {
+				return p, nil
+			}
+		}
+	}
+	// over quota notification is a bounce
+	if kind == NotificationOverQuota {
+		return notificationTemplatePath(NotificationBounce, domain, lang)
+	}
+	return "", errors.New("no template for notification " + kind)
+}
+
+// NotificationRender renders notification kind of data, lang is the
+// language of the notified address if empty
+func NotificationRender(kind string, data NotificationData) ([]byte, error) {
+	if data.Lang == "" {
+		data.Lang = notificationLang(data.RcptTo)
+	}
+	// header field of DSN
+	data.DiagnosticCode = strings.Join(strings.Fields(data.DiagnosticCode), " ")
+	for i := range data.Delayed {
+		data.Delayed[i].DiagnosticCode = strings.Join(strings.Fields(data.Delayed[i].DiagnosticCode), " ")
+	}
+	tplPath, err := notificationTemplatePath(kind, data.RcptTo[strings.LastIndex(data.RcptTo, "@")+1:], data.Lang)
+	if err != nil {
+		return nil, err
+	}
+	t, err := template.ParseFiles(tplPath)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err = t.Execute(buf, data); err != nil {
+		return nil, err
+	}
+	b := buf.Bytes()
+	err = Unix2dos(&b)
+	return b, err
+}
+
+// notificationDataOf returns template data of notification about q
+func notificationDataOf(q *QMessage, errMsg string, raw []byte) NotificationData {
+	queuedAt := q.AddedAt
+	if q.SendAt.After(queuedAt) {
+		queuedAt = q.SendAt
+	}
+	boundary, _ := NewUUID()
+	data := NotificationData{
+		Date:        time.Now().Format(Time822),
+		Me:          Cfg.GetMe(),
+		RcptTo:      q.MailFrom,
+		OriRcptTo:   q.RcptTo,
+		ErrMsg:      errMsg,
+		BouncedMail: string(raw),
+		QueuedAt:    queuedAt.Format(Time822),
+		Delay:       (time.Since(queuedAt) / time.Minute * time.Minute).String(),
+		Retries:     q.DeliveryFailedCount,
+		Boundary:    "tmail-" + boundary,
+		Status:      rxNotificationStatus.FindString(errMsg),
+	}
+	data.Delayed = []NotificationRcpt{{Address: q.RcptTo, ErrMsg: errMsg, Status: data.Status}}
+	if p := bytes.Index(raw, []byte("\r\n\r\n")); p != -1 {
+		data.BouncedHeaders = string(raw[:p+2])
+	} else if p = bytes.Index(raw, []byte("\n\n")); p != -1 {
+		data.BouncedHeaders = string(raw[:p+1])
+	} else {
+		data.BouncedHeaders = string(raw)
+	}
+	return data
+}
+
+// notificationDelayOptOut returns true if domain of sender (or one of its
+// parents) opted out of delay warnings
+func notificationDelayOptOut(sender string) bool {
+	domain := strings.ToLower(sender[strings.LastIndex(sender, "@")+1:])
+	for _, optOut := range Cfg.GetDeliverdDelayWarningOptOut() {
+		optOut = strings.ToLower(strings.TrimSpace(optOut))
+		if optOut != "" && (domain == optOut || strings.HasSuffix(domain, "."+optOut)) {
+			return true
+		}
+	}
+	return false
+}
+
+// notificationQueue queues notification kind about q, it returns the
+// queued id
+func notificationQueue(kind string, data NotificationData) (string, error) {
+	b, err := NotificationRender(kind, data)
+	if err != nil {
+		return "", err
+	}
+	return QueueAddMessage(&b, message.Envelope{MailFrom: "", RcptTo: []string{data.RcptTo}}, "")
+}
+
+// notificationSample is the failed message of previews
+const notificationSample = "Date: Mon, 12 Oct 2026 10:00:00 +0000\r\n" +
+	"From: sender@example.com\r\n" +
+	"To: recipient@example.net\r\n" +
+	"Subject: Sample message\r\n" +
+	"Message-ID: <sample@example.com>\r\n" +
+	"\r\n" +
+	"This is a sample message.\r\n"
+
+// NotificationPreview renders notification kind sent to sender about a
+// message to rcpt which failed with errMsg. raw is the failed message
+// (a sample if nil), lang the language ("" for the language of sender).
+func NotificationPreview(kind, sender, rcpt, errMsg, lang string, raw []byte) ([]byte, error) {
+	if !strings.Contains(sender, "@") || !strings.Contains(rcpt, "@") {
+		return nil, errors.New("sender and recipient must be email addresses")
+	}
+	if raw == nil {
+		raw = []byte(notificationSample)
+	}
+	q := &QMessage{MailFrom: sender, RcptTo: rcpt, AddedAt: time.Now().Add(-4 * time.Hour), DeliveryFailedCount: 3}
+	data := notificationDataOf(q, errMsg, raw)
+	data.Lang = lang
+	data.GiveUpAt = q.AddedAt.Add(time.Duration(Cfg.GetDeliverdQueueLifetime()) * time.Minute).Format(Time822)
+	if strings.HasPrefix(errMsg, "4") || strings.HasPrefix(errMsg, "5") {
+		data.DiagnosticCode = errMsg
+		data.Delayed[0].DiagnosticCode = errMsg
+	}
+	return NotificationRender(kind, data)
+}
@@ -0,0 +1,315 @@
+package core
+
+// Quarantine
+// Messages flagged by checks (virus, spam, DMARC...) are stored with their
+// verdict (check, reason and headers added by the check) until they are
+// released (queued for delivery), deleted or expired (quarantine_lifetime
+// days). If quarantine_digest_enabled is set, local recipients receive a
+// daily digest of their messages put in quarantine.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/toorop/tmail/message"
+)
+
+// QuarantinedMessage represents a message put in quarantine by smtpd
+type QuarantinedMessage struct {
+	Id         int64
+	Uuid       string // key of raw message in quarantine store
+	MailFrom   string
+	RcptTo     string `sql:"type:text;"` // recipients separated by ";"
+	AuthUser   string
+	MessageId  string
+	Subject    string
+	Size       int
+	RemoteAddr string
+	Check      string
+	Reason     string // check: reason
+	AddedAt    time.Time
+	ExpiresAt  time.Time // zero: never
+	Notified   bool      // included in digests of recipients
+	// local recipients whose digest included message (separated by ";")
+	NotifiedRcpts string `sql:"type:text;"`
+}
+
+// getQuarantineStore returns quarantine store
+func getQuarantineStore() (Storer, error) {
+	source := Cfg.GetQuarantineStoreSource()
+	if source == "" {
+		return nil, errors.New("quarantine is not enabled (quarantine_store_source)")
+	}
+	return NewStore(Cfg.GetStoreDriver(), source)
+}
+
+// QuarantineEnabled returns true if quarantine is available
+func QuarantineEnabled() bool {
+	return Cfg.GetQuarantineStoreSource() != ""
+}
+
+// QuarantineAdd puts message in quarantine
+func QuarantineAdd(rawMess *[]byte, envelope message.Envelope, authUser, remoteAddr, check, reason string) (uuid string, err error) {
+	qStore, err := getQuarantineStore()
+	if err != nil {
+		return
+	}
+	uuid, err = NewUUID()
+	if err != nil {
+		return
+	}
+	if err = qStore.Put(uuid, bytes.NewReader(*rawMess)); err != nil {
+		return
+	}
+	qm := QuarantinedMessage{
+		Uuid:       uuid,
+		MailFrom:   envelope.MailFrom,
+		RcptTo:     strings.Join(envelope.RcptTo, ";"),
+		AuthUser:   authUser,
+		MessageId:  string(message.RawGetMessageId(rawMess)),
+		Subject:    message.RawGetHeaderValue(rawMess, "subject"),
+		Size:       len(*rawMess),
+		RemoteAddr: remoteAddr,
+		Check:      check,
+		Reason:     check + ": " + reason,
+		AddedAt:    time.Now(),
+	}
+	if lifetime := Cfg.GetQuarantineLifetime(); lifetime > 0 {
+		qm.ExpiresAt = qm.AddedAt.Add(time.Duration(lifetime) * 24 * time.Hour)
+	}
+	if err = DB.Create(&qm).Error; err != nil {
+		qStore.Del(uuid)
+	}
+	return
+}
+
+// QuarantineList returns all quarantined messages
+func QuarantineList() (messages []QuarantinedMessage, err error) {
+	messages = []QuarantinedMessage{}
+	err = DB.Order("id asc").Find(&messages).Error
+	return
+}
+
+// QuarantineGet returns quarantined message id
+func QuarantineGet(id int64) (qm QuarantinedMessage, err error) {
+	err = DB.Where("id = ?", id).First(&qm).Error
+	return
+}
+
+// GetRaw returns raw message of quarantined message
+func (qm *QuarantinedMessage) GetRaw() ([]byte, error) {
+	qStore, err := getQuarantineStore()
+	if err != nil {
+		return nil, err
+	}
+	r, err := qStore.Get(qm.Uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// QuarantineHeaders returns headers of quarantined message id
+func QuarantineHeaders(id int64) (string, error) {
+	qm, err := QuarantineGet(id)
+	if err != nil {
+		return "", err
+	}
+	raw, err := qm.GetRaw()
+	if err != nil {
+		return "", err
+	}
+	return string(message.RawGetHeaders(&raw)), nil
+}
+
+// QuarantineDel removes message from quarantine
+func QuarantineDel(id int64) error {
+	qm, err := QuarantineGet(id)
+	if err != nil {
+		return err
+	}
+	if err = DB.Delete(&qm).Error; err != nil {
+		return err
+	}
+	qStore, err := getQuarantineStore()
+	if err != nil {
+		return err
+	}
+	err = qStore.Del(qm.Uuid)
+	if err != nil && strings.Contains(err.Error(), "no such file") {
+		err = nil
+	}
+	return err
+}
+
+// QuarantineRelease queues quarantined message for delivery and removes it
+// from quarantine
+func QuarantineRelease(id int64) (queueId string, err error) {
+	qm, err := QuarantineGet(id)
+	if err != nil {
+		return
+	}
+	raw, err := qm.GetRaw()
+	if err != nil {
+		return
+	}
+	envelope := message.Envelope{MailFrom: qm.MailFrom, RcptTo: strings.Split(qm.RcptTo, ";")}
+	if queueId, err = QueueAddMessage(&raw, envelope, qm.AuthUser); err != nil {
+		return
+	}
+	err = QuarantineDel(id)
+	return
+}
+
+// quarantinePurge removes expired messages
+func quarantinePurge(now time.Time) error {
+	expired := []QuarantinedMessage{}
+	if err := DB.Where("expires_at > ? AND expires_at < ?", time.Time{}, now).Find(&expired).Error; err != nil {
+		return err
+	}
+	for _, qm := range expired {
+		if err := QuarantineDel(qm.Id); err != nil && err != gorm.RecordNotFound {
+			return err
+		}
+		Log.Info(fmt.Sprintf("quarantine - message %d (%s) expired", qm.Id, qm.Uuid))
+	}
+	return nil
+}
+
+// quarantineDigestMessage returns digest of messages quarantined for rcpt
+func quarantineDigestMessage(rcpt string, messages []QuarantinedMessage) ([]byte, error) {
+	uuid, err := NewUUID()
+	if err != nil {
+		return nil, err
+	}
+	tData := struct {
+		Date      string
+		From      string
+		To        string
+		Me        string
+		MessageId string
+		Lifetime  int
+		Messages  []QuarantinedMessage
+	}{time.Now().Format(Time822), digestFrom(), rcpt, Cfg.GetMe(), fmt.Sprintf("%s@%s", uuid, Cfg.GetMe()), Cfg.GetQuarantineLifetime(), messages}
+	t, err := template.ParseFiles(path.Join(GetBasePath(), "tpl/quarantine_digest.tpl"))
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err = t.Execute(buf, tData); err != nil {
+		return nil, err
+	}
+	b := buf.Bytes()
+	err = Unix2dos(&b)
+	return b, err
+}
+
+// quarantineDigestSend sends to local recipients digests of their messages
+// put in quarantine since last digest. Each message records recipients
+// notified, it's notified once all its local recipients are: a failure for
+// a recipient doesn't send again digests of the others.
+func quarantineDigestSend() error {
+	messages := []QuarantinedMessage{}
+	if err := DB.Where("notified = ?", false).Order("id asc").Find(&messages).Error; err != nil {
+		return err
+	}
+	byRcpt := make(map[string][]*QuarantinedMessage)
+	localRcpts := make(map[int64][]string)
+	for i := range messages {
+		qm := &messages[i]
+		notified := strings.Split(qm.NotifiedRcpts, ";")
+		for _, rcpt := range strings.Split(qm.RcptTo, ";") {
+			rcpt = strings.ToLower(rcpt)
+			p := strings.LastIndex(rcpt, "@")
+			if p == -1 {
+				continue
+			}
+			rcpthost, err := RcpthostGet(rcpt[p+1:])
+			if err != nil || !rcpthost.IsLocal {
+				continue
+			}
+			localRcpts[qm.Id] = append(localRcpts[qm.Id], rcpt)
+			if !IsStringInSlice(rcpt, notified) {
+				byRcpt[rcpt] = append(byRcpt[rcpt], qm)
+			}
+		}
+	}
+	var failed error
+	for rcpt, list := range byRcpt {
+		digested := []QuarantinedMessage{}
+		for _, qm := range list {
+			digested = append(digested, *qm)
+		}
+		mail, err := quarantineDigestMessage(rcpt, digested)
+		if err == nil {
+			var id string
+			if id, err = QueueAddMessage(&mail, message.Envelope{MailFrom: digestFrom(), RcptTo: []string{rcpt}}, ""); err == nil {
+				Log.Info(fmt.Sprintf("quarantine - digest of %d messages for %s queued as %s", len(list), rcpt, id))
+			}
+		}
+		if err != nil {
+			Log.Error("quarantine - unable to send digest to " + rcpt + " - " + err.Error())
+			failed = err
+			continue
+		}
+		for _, qm := range list {
+			if qm.NotifiedRcpts == "" {
+				qm.NotifiedRcpts = rcpt
+			} else {
+				qm.NotifiedRcpts += ";" + rcpt
+			}
+			notified := strings.Split(qm.NotifiedRcpts, ";")
+			qm.Notified = true
+			for _, local := range localRcpts[qm.Id] {
+				if !IsStringInSlice(local, notified) {
+					qm.Notified = false
+				}
+			}
+			if err = DB.Model(QuarantinedMessage{}).Where("id = ?", qm.Id).Updates(map[string]interface{}{"notified_rcpts": qm.NotifiedRcpts, "notified": qm.Notified}).Error; err != nil {
+				return err
+			}
+		}
+	}
+	// messages without local recipient
+	for i := range messages {
+		if len(localRcpts[messages[i].Id]) == 0 {
+			if err := DB.Model(QuarantinedMessage{}).Where("id = ?", messages[i].Id).UpdateColumn("notified", true).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return failed
+}
+
+// LaunchQuarantineHousekeeper removes expired messages every hour and sends
+// digests daily (after midnight UTC)
+func LaunchQuarantineHousekeeper() {
+	Log.Info("quarantine housekeeper launched")
+	lastDigest := time.Now().UTC().Format("2006-01-02")
+	for {
+		// housekeeping is done by the leader node
+		if !ClusterLeader("quarantine-housekeeper", 2*time.Hour) {
+			time.Sleep(time.Hour)
+			continue
+		}
+		if err := quarantinePurge(time.Now()); err != nil {
+			Log.Error("quarantine - unable to purge expired messages - " + err.Error())
+		}
+		if today := time.Now().UTC().Format("2006-01-02"); Cfg.GetQuarantineDigestEnabled() && today != lastDigest {
+			if err := quarantineDigestSend(); err != nil {
+				Log.Error("quarantine - unable to send digests - " + err.Error())
+			} else {
+				lastDigest = today
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,178 @@
+package core
+
+// Queue freeze: outbound delivery of messages matching a freeze (all, sender
+// domain, user or destination host) is halted, smtpd keeps accepting mails.
+// Frozen messages stay in queue (status 4) until they are thawed or the
+// freeze is removed.
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/toorop/tmail/message"
+)
+
+// freeze scopes
+const (
+	QueueFreezeAll    = "all"
+	QueueFreezeDomain = "domain" // sender domain (MAIL FROM or authenticated user)
+	QueueFreezeUser   = "user"   // sender (MAIL FROM or authenticated user)
+	QueueFreezeHost   = "host"   // destination host
+)
+
+// QueueFreeze represents a freeze of outbound delivery
+type QueueFreeze struct {
+	Id        int64
+	Scope     string
+	Value     string
+	Reason    string
+	CreatedAt time.Time
+}
+
+// QueueThawFilter represents a filter on frozen messages to thaw
+// empty fields match all messages
+type QueueThawFilter struct {
+	Id       int64
+	MailFrom string
+	RcptTo   string
+	User     string
+	Host     string
+}
+
+// match returns true if q is frozen by f
+func (f *QueueFreeze) match(q *QMessage) bool {
+	switch f.Scope {
+	case QueueFreezeAll:
+		return true
+	case QueueFreezeDomain:
+		return message.GetHostFromAddress(strings.ToLower(q.MailFrom)) == f.Value || (strings.Contains(q.AuthUser, "@") && message.GetHostFromAddress(strings.ToLower(q.AuthUser)) == f.Value)
+	case QueueFreezeUser:
+		return strings.ToLower(q.MailFrom) == f.Value || strings.ToLower(q.AuthUser) == f.Value
+	case QueueFreezeHost:
+		return strings.ToLower(q.Host) == f.Value
+	}
+	return false
+}
+
+// QueueFreezeAdd adds a freeze
+func QueueFreezeAdd(scope, value, reason string) (freeze QueueFreeze, err error) {
+	freeze = QueueFreeze{
+		Scope:     strings.ToLower(strings.TrimSpace(scope)),
+		Value:     strings.ToLower(strings.TrimSpace(value)),
+		Reason:    reason,
+		CreatedAt: time.Now(),
+	}
+	switch freeze.Scope {
+	case QueueFreezeAll:
+		freeze.Value = ""
+	case QueueFreezeDomain, QueueFreezeUser, QueueFreezeHost:
+		if freeze.Value == "" {
+			return freeze, errors.New("a value is required for freeze scope " + freeze.Scope)
+		}
+	default:
+		return freeze, errors.New("unknown freeze scope " + scope)
+	}
+	err = DB.Create(&freeze).Error
+	return
+}
+
+// QueueFreezeList returns freezes
+func QueueFreezeList() (freezes []QueueFreeze, err error) {
+	freezes = []QueueFreeze{}
+	err = DB.Order("id asc").Find(&freezes).Error
+	return
+}
+
+// QueueFreezeDel removes freeze id
+// frozen messages are requeued, those matching another freeze will be frozen
+// again. Messages thawed by force which don't match another freeze are
+// subject to future freezes again.
+func QueueFreezeDel(id int64) (requeued int, err error) {
+	freeze := QueueFreeze{}
+	if err = DB.Where("id = ?", id).First(&freeze).Error; err != nil {
+		return
+	}
+	if err = DB.Delete(&freeze).Error; err != nil {
+		return
+	}
+	if err = queueThawedClear(); err != nil {
+		return
+	}
+	return QueueThaw(QueueThawFilter{}, false)
+}
+
+// queueThawedClear clears the thawed flag of messages which don't match a
+// freeze anymore
+func queueThawedClear() error {
+	messages := []QMessage{}
+	if err := DB.Where("thawed = ?", true).Find(&messages).Error; err != nil {
+		return err
+	}
+	for i := range messages {
+		freeze, err := queueFrozenBy(&messages[i])
+		if err != nil {
+			return err
+		}
+		if freeze != nil {
+			continue
+		}
+		if err = DB.Model(QMessage{}).Where("id = ?", messages[i].Id).Update("thawed", false).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queueFrozenBy returns the freeze matching q, nil if q is not frozen
+func queueFrozenBy(q *QMessage) (*QueueFreeze, error) {
+	freezes, err := QueueFreezeList()
+	if err != nil {
+		return nil, err
+	}
+	for i := range freezes {
+		if freezes[i].match(q) {
+			return &freezes[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// QueueThaw requeues frozen messages matching filter
+// if force is true, thawed messages are delivered even if they match a
+// freeze.
+func QueueThaw(filter QueueThawFilter, force bool) (thawed int, err error) {
+	messages := []QMessage{}
+	if err = DB.Where("status = ?", 4).Find(&messages).Error; err != nil {
+		return
+	}
+	for i := range messages {
+		q := &messages[i]
+		if filter.Id != 0 && q.Id != filter.Id {
+			continue
+		}
+		if filter.MailFrom != "" && !strings.EqualFold(q.MailFrom, filter.MailFrom) {
+			continue
+		}
+		if filter.RcptTo != "" && !strings.EqualFold(q.RcptTo, filter.RcptTo) {
+			continue
+		}
+		if filter.User != "" && !strings.EqualFold(q.AuthUser, filter.User) {
+			continue
+		}
+		if filter.Host != "" && !strings.EqualFold(q.Host, filter.Host) {
+			continue
+		}
+		q.Status = 2
+		q.Thawed = force
+		q.NextDeliveryScheduledAt = time.Now()
+		if err = q.SaveInDb(); err != nil {
+			return
+		}
+		if err = q.publish(); err != nil {
+			return
+		}
+		thawed++
+	}
+	return
+}
@@ -0,0 +1,120 @@
+package core
+
+// Queue administration
+// Messages can be put on hold (status 5): they stay in queue and are not
+// delivered until they are released. Messages can be flushed (delivery is
+// attempted now) or bounced now. Targets are a message ID or a destination
+// domain (all its messages).
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// queueTargetMessages returns messages of target (message ID or destination
+// domain), byId is true if target is a message ID
+func queueTargetMessages(target string) (messages []QMessage, byId bool, err error) {
+	messages = []QMessage{}
+	target = strings.ToLower(strings.TrimSpace(target))
+	if target == "" {
+		return nil, false, errors.New("target (message ID or domain) is empty")
+	}
+	if id, err := strconv.ParseInt(target, 10, 64); err == nil {
+		if err = DB.Where("id = ?", id).Find(&messages).Error; err == nil && len(messages) == 0 {
+			err = gorm.RecordNotFound
+		}
+		return messages, true, err
+	}
+	err = DB.Where("host = ?", target).Find(&messages).Error
+	return
+}
+
+// queueApply applies f to messages of target and returns the number of
+// messages changed
+// messages of a domain which can't be changed (delivery in progress, ...)
+// are skipped
+func queueApply(target string, f func(q *QMessage) error) (count int, err error) {
+	messages, byId, err := queueTargetMessages(target)
+	if err != nil {
+		return 0, err
+	}
+	for i := range messages {
+		if err = f(&messages[i]); err != nil {
+			if byId {
+				return 0, err
+			}
+			continue
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Hold puts message on hold, it will not be delivered until it's released
+func (q *QMessage) Hold() error {
+	switch q.Status {
+	case 0:
+		return errors.New("delivery in progress, message status can't be changed")
+	case 5:
+		return errors.New("message is already on hold")
+	case 6:
+		return errors.New("message is waiting for scan, its status can't be changed")
+	}
+	q.Lock()
+	q.Status = 5
+	q.Unlock()
+	return q.SaveInDb()
+}
+
+// Unhold releases message on hold, its delivery is attempted now
+func (q *QMessage) Unhold() error {
+	if q.Status != 5 {
+		return errors.New("message is not on hold")
+	}
+	q.Lock()
+	q.Status = 2
+	q.NextDeliveryScheduledAt = time.Now()
+	q.Unlock()
+	if err := q.SaveInDb(); err != nil {
+		return err
+	}
+	return q.publish()
+}
+
+// Flush forces an immediate delivery attempt of scheduled message
+func (q *QMessage) Flush() error {
+	if q.Status != 2 {
+		return errors.New("message is not scheduled for delivery")
+	}
+	q.Lock()
+	q.NextDeliveryScheduledAt = time.Now()
+	q.Unlock()
+	if err := q.SaveInDb(); err != nil {
+		return err
+	}
+	return q.publish()
+}
+
+// QueueHold puts messages of target on hold
+func QueueHold(target string) (int, error) {
+	return queueApply(target, func(q *QMessage) error { return q.Hold() })
+}
+
+// QueueRelease releases messages of target on hold
+func QueueRelease(target string) (int, error) {
+	return queueApply(target, func(q *QMessage) error { return q.Unhold() })
+}
+
+// QueueFlush forces an immediate delivery attempt of messages of target
+func QueueFlush(target string) (int, error) {
+	return queueApply(target, func(q *QMessage) error { return q.Flush() })
+}
+
+// QueueBounce bounces messages of target now
+func QueueBounce(target string) (int, error) {
+	return queueApply(target, func(q *QMessage) error { return q.Bounce() })
+}
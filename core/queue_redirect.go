@@ -0,0 +1,230 @@
+package core
+
+// Redirection by operator
+// A queued message, or a bounced one kept for deliverd_bounced_keep hours,
+// can be redirected to another recipient (departed employee, misaddressed
+// mail...): it's queued again for the new recipient with a X-Tmail-Redirected
+// header, the queued message is removed, and the redirection is recorded
+// (RedirectAudit).
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/toorop/tmail/message"
+)
+
+// header added to redirected messages
+const redirectHeader = "X-Tmail-Redirected"
+
+// BouncedMessage represents a bounced message kept for redirection
+type BouncedMessage struct {
+	Id         int64
+	Uuid       string // key of raw message in queue store
+	MailFrom   string
+	RcptTo     string
+	AuthUser   string
+	MessageId  string
+	Error      string `sql:"type:text;"`
+	BouncedAt  time.Time
+	Redirected bool
+}
+
+// RedirectAudit represents a redirection by an operator
+type RedirectAudit struct {
+	Id           int64
+	Source       string // queue or bounced
+	SourceId     int64  // id of queued or bounced message
+	MessageId    string
+	MailFrom     string
+	OriginalRcpt string
+	NewRcpt      string
+	Operator     string
+	QueueId      string // queue ID of redirected message
+	CreatedAt    time.Time
+}
+
+// getQueueStore returns queue store
+func getQueueStore() (Storer, error) {
+	return NewStore(Cfg.GetStoreDriver(), Cfg.GetStoreSource())
+}
+
+// bouncedKeep keeps a copy of bounced message q, expired copies are removed
+func bouncedKeep(q *QMessage, raw []byte, errMsg string) error {
+	keep := Cfg.GetDeliverdBouncedKeep()
+	if keep <= 0 {
+		return nil
+	}
+	if err := bouncedPurge(time.Now().Add(-time.Duration(keep) * time.Hour)); err != nil {
+		return err
+	}
+	qStore, err := getQueueStore()
+	if err != nil {
+		return err
+	}
+	uuid, err := NewUUID()
+	if err != nil {
+		return err
+	}
+	if err = qStore.Put(uuid, bytes.NewReader(raw)); err != nil {
+		return err
+	}
+	bm := BouncedMessage{
+		Uuid:      uuid,
+		MailFrom:  q.MailFrom,
+		RcptTo:    q.RcptTo,
+		AuthUser:  q.AuthUser,
+		MessageId: q.MessageId,
+		Error:     errMsg,
+		BouncedAt: time.Now(),
+	}
+	if err = DB.Create(&bm).Error; err != nil {
+		qStore.Del(uuid)
+	}
+	return err
+}
+
+// bouncedPurge removes bounced messages bounced before
+func bouncedPurge(before time.Time) error {
+	expired := []BouncedMessage{}
+	if err := DB.Where("bounced_at < ?", before).Find(&expired).Error; err != nil {
+		return err
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+	qStore, err := getQueueStore()
+	if err != nil {
+		return err
+	}
+	for _, bm := range expired {
+		if err = DB.Delete(&bm).Error; err != nil {
+			return err
+		}
+		if err = qStore.Del(bm.Uuid); err != nil && !strings.Contains(err.Error(), "no such file") {
+			return err
+		}
+	}
+	return nil
+}
+
+// BouncedList returns bounced messages kept for redirection
+func BouncedList() (messages []BouncedMessage, err error) {
+	messages = []BouncedMessage{}
+	err = DB.Order("id asc").Find(&messages).Error
+	return
+}
+
+// RedirectAuditList returns redirections
+func RedirectAuditList() (audits []RedirectAudit, err error) {
+	audits = []RedirectAudit{}
+	err = DB.Order("id asc").Find(&audits).Error
+	return
+}
+
+// redirect queues raw message for audit.NewRcpt and records the
+// redirection
+func redirect(raw []byte, audit RedirectAudit, authUser string) (RedirectAudit, error) {
+	a, err := mail.ParseAddress(strings.TrimSpace(audit.NewRcpt))
+	if err != nil {
+		return audit, errors.New("bad recipient " + audit.NewRcpt + " - " + err.Error())
+	}
+	audit.NewRcpt = strings.ToLower(a.Address)
+	if audit.Operator == "" {
+		audit.Operator = "unknown"
+	}
+	audit.CreatedAt = time.Now()
+	prependHeader(&raw, fmt.Sprintf("%s: from <%s> to <%s> by %s on %s", redirectHeader, audit.OriginalRcpt, audit.NewRcpt, audit.Operator, audit.CreatedAt.Format(Time822)))
+	envelope := message.Envelope{MailFrom: audit.MailFrom, RcptTo: []string{audit.NewRcpt}}
+	if audit.QueueId, err = QueueAddMessage(&raw, envelope, authUser); err != nil {
+		return audit, err
+	}
+	if err = DB.Create(&audit).Error; err != nil {
+		Log.Error(fmt.Sprintf("redirect - %s %d redirected to %s (queued as %s) but unable to record it - %s", audit.Source, audit.SourceId, audit.NewRcpt, audit.QueueId, err))
+	}
+	Log.Info(fmt.Sprintf("redirect - %s %d from %s to %s redirected to %s by %s, queued as %s", audit.Source, audit.SourceId, audit.MailFrom, audit.OriginalRcpt, audit.NewRcpt, audit.Operator, audit.QueueId))
+	return audit, nil
+}
+
+// QueueRedirect redirects queued message id to rcptTo, operator is recorded
+func QueueRedirect(id int64, rcptTo, operator string) (RedirectAudit, error) {
+	q, err := QueueGetMessageById(id)
+	if err != nil {
+		return RedirectAudit{}, err
+	}
+	switch q.Status {
+	case 0:
+		return RedirectAudit{}, errors.New("delivery in progress, message can't be redirected")
+	case 6:
+		return RedirectAudit{}, errors.New("message is waiting for scan, it can't be redirected")
+	}
+	// message is marked as being in delivery: deliverd processes and other
+	// redirections leave it
+	status := q.Status
+	claimed, err := q.Claim()
+	if err != nil {
+		return RedirectAudit{}, err
+	}
+	if !claimed {
+		return RedirectAudit{}, errors.New("message has been changed by another process (delivery in progress?), it can't be redirected")
+	}
+	audit, err := queueRedirectClaimed(&q, rcptTo, operator)
+	if err != nil {
+		if errRelease := DB.Model(QMessage{}).Where("id = ? AND status = ?", q.Id, 0).Updates(map[string]interface{}{"status": status, "lease_owner": ""}).Error; errRelease != nil {
+			Log.Error(fmt.Sprintf("queue - unable to release message %d after failed redirection - %s", q.Id, errRelease))
+		}
+		return audit, err
+	}
+	return audit, q.Delete()
+}
+
+// queueRedirectClaimed redirects claimed queued message q to rcptTo
+func queueRedirectClaimed(q *QMessage, rcptTo, operator string) (RedirectAudit, error) {
+	qStore, err := getQueueStore()
+	if err != nil {
+		return RedirectAudit{}, err
+	}
+	r, err := qStore.Get(q.Uuid)
+	if err != nil {
+		return RedirectAudit{}, err
+	}
+	defer r.Close()
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return RedirectAudit{}, err
+	}
+	return redirect(raw, RedirectAudit{Source: "queue", SourceId: q.Id, MessageId: q.MessageId, MailFrom: q.MailFrom, OriginalRcpt: q.RcptTo, NewRcpt: rcptTo, Operator: operator}, q.AuthUser)
+}
+
+// BouncedRedirect redirects bounced message id to rcptTo, operator is
+// recorded
+func BouncedRedirect(id int64, rcptTo, operator string) (RedirectAudit, error) {
+	bm := BouncedMessage{}
+	if err := DB.Where("id = ?", id).First(&bm).Error; err != nil {
+		return RedirectAudit{}, err
+	}
+	qStore, err := getQueueStore()
+	if err != nil {
+		return RedirectAudit{}, err
+	}
+	r, err := qStore.Get(bm.Uuid)
+	if err != nil {
+		return RedirectAudit{}, err
+	}
+	defer r.Close()
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return RedirectAudit{}, err
+	}
+	audit, err := redirect(raw, RedirectAudit{Source: "bounced", SourceId: bm.Id, MessageId: bm.MessageId, MailFrom: bm.MailFrom, OriginalRcpt: bm.RcptTo, NewRcpt: rcptTo, Operator: operator}, bm.AuthUser)
+	if err != nil {
+		return audit, err
+	}
+	bm.Redirected = true
+	return audit, DB.Save(&bm).Error
+}
@@ -0,0 +1,189 @@
+package core
+
+// Replay of stored messages (quarantine or capture directory) through the
+// current filter chain, offline.
+// Verdicts are only reported: messages are neither queued, quarantined nor
+// counted in DMARC reports.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/toorop/tmail/message"
+)
+
+// ReplayVerdict represents the verdict of a check on replay
+type ReplayVerdict struct {
+	Check  string
+	Action string
+	Reason string
+	Shadow bool // check runs in shadow mode, it's not enforced
+}
+
+// ReplayResult represents the result of the replay of a message
+type ReplayResult struct {
+	Source              string // quarantine ID or file path
+	MailFrom            string
+	RcptTo              []string
+	OriginalDisposition string
+	Disposition         string
+	Changed             bool
+	Verdicts            []ReplayVerdict
+	Err                 string
+}
+
+// replayMessage runs the filter chain on raw message
+func replayMessage(raw []byte, envelope message.Envelope, remoteIP net.IP, helo string, trusted bool) (verdicts []ReplayVerdict, disposition smtpdAction) {
+	logPrefix := "replay " + strings.Join(envelope.RcptTo, ",") + " -"
+	ctx := &smtpdCheckContext{
+		envelope: envelope,
+		remoteIP: remoteIP,
+		helo:     helo,
+		trusted:  trusted,
+		replay:   true,
+		log: func(msg ...string) {
+			Log.Debug(logPrefix, strings.Join(msg, " "))
+		},
+		logError: func(msg ...string) {
+			Log.Error(logPrefix, strings.Join(msg, " "))
+		},
+	}
+	if Cfg.GetSmtpdAuthResultsEnabled() && !trusted && remoteIP != nil {
+		ctx.spfResult, ctx.spfDomain = spfCheck(remoteIP, envelope.MailFrom, helo)
+	}
+	for _, check := range smtpdDataChecks {
+		v := roleAddressesExempt(check(ctx, &raw), envelope)
+		shadow := isShadowCheck(v.check)
+		verdicts = append(verdicts, ReplayVerdict{v.check, v.action.String(), v.reason, shadow})
+		if !shadow && v.action > disposition {
+			disposition = v.action
+		}
+		// transaction would be over
+		if !shadow && v.action > smtpdActionTag {
+			break
+		}
+		for _, h := range v.headers {
+			prependHeader(&raw, h)
+		}
+	}
+	return
+}
+
+// replayIsTrusted returns true if checks are skipped for client
+func replayIsTrusted(authUser string, remoteIP net.IP) bool {
+	if authUser != "" {
+		return true
+	}
+	if remoteIP == nil {
+		return false
+	}
+	ok, err := IpCanRelay(&net.TCPAddr{IP: remoteIP})
+	return err == nil && ok
+}
+
+// replay replays raw message and fills result
+func (r *ReplayResult) replay(raw []byte, remoteIP net.IP, trusted bool) {
+	envelope := message.Envelope{MailFrom: r.MailFrom, RcptTo: r.RcptTo}
+	verdicts, disposition := replayMessage(raw, envelope, remoteIP, "", trusted)
+	r.Verdicts = verdicts
+	r.Disposition = disposition.String()
+	r.Changed = r.Disposition != r.OriginalDisposition
+}
+
+// ReplayQuarantine replays quarantined messages (all if ids is empty)
+func ReplayQuarantine(ids []int64) (results []ReplayResult, err error) {
+	messages := []QuarantinedMessage{}
+	if len(ids) == 0 {
+		if messages, err = QuarantineList(); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, id := range ids {
+			qm, err := QuarantineGet(id)
+			if err != nil {
+				return nil, fmt.Errorf("unable to get quarantined message %d - %s", id, err)
+			}
+			messages = append(messages, qm)
+		}
+	}
+	for _, qm := range messages {
+		r := ReplayResult{
+			Source:              strconv.FormatInt(qm.Id, 10),
+			MailFrom:            qm.MailFrom,
+			RcptTo:              strings.Split(qm.RcptTo, ";"),
+			OriginalDisposition: smtpdActionQuarantine.String(),
+		}
+		raw, err := qm.GetRaw()
+		if err != nil {
+			r.Err = err.Error()
+			results = append(results, r)
+			continue
+		}
+		var remoteIP net.IP
+		if host, _, err := net.SplitHostPort(qm.RemoteAddr); err == nil {
+			remoteIP = net.ParseIP(host)
+		}
+		r.replay(raw, remoteIP, replayIsTrusted(qm.AuthUser, remoteIP))
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// ReplayDir replays messages stored in directory dir (one raw message per
+// file). The envelope is rebuilt from X-Env-From, To & Cc headers and the
+// client IP from the first Received header.
+// Original disposition is tag if message has a X-Tmail-Tag header, else
+// disposition.
+func ReplayDir(dir, disposition string) (results []ReplayResult, err error) {
+	if disposition == "" {
+		disposition = smtpdActionAccept.String()
+	}
+	if _, err = parseSmtpdAction(disposition); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		r := ReplayResult{Source: path.Join(dir, f.Name()), OriginalDisposition: disposition}
+		raw, err := ioutil.ReadFile(r.Source)
+		if err != nil {
+			r.Err = err.Error()
+			results = append(results, r)
+			continue
+		}
+		if err = Unix2dos(&raw); err != nil {
+			r.Err = err.Error()
+			results = append(results, r)
+			continue
+		}
+		if message.RawHaveHeader(&raw, "x-tmail-tag") {
+			r.OriginalDisposition = smtpdActionTag.String()
+		}
+		r.MailFrom = RemoveBrackets(message.RawGetHeaderValue(&raw, "x-env-from"))
+		for _, h := range []string{"to", "cc"} {
+			if addrs, err := mail.ParseAddressList(message.RawGetHeaderValue(&raw, h)); err == nil {
+				for _, a := range addrs {
+					r.RcptTo = append(r.RcptTo, a.Address)
+				}
+			}
+		}
+		// Received: from IP (...)
+		var remoteIP net.IP
+		if received := strings.Fields(message.RawGetHeaderValue(&raw, "received")); len(received) > 1 && received[0] == "from" {
+			remoteIP = net.ParseIP(received[1])
+		}
+		r.replay(raw, remoteIP, replayIsTrusted("", remoteIP))
+		results = append(results, r)
+	}
+	return results, nil
+}
@@ -0,0 +1,35 @@
+package core
+
+// Process roles
+// Several tmail processes can share the same queue (DB, store & nsqlookupd
+// in cluster mode): role smtpd runs only acceptance (smtpd), role deliverd
+// runs only delivery (deliverd), so each role can be scaled and firewalled
+// on its own. Role all (default) runs both.
+
+import "errors"
+
+// Roles
+const (
+	RoleAll      = "all"
+	RoleSmtpd    = "smtpd"
+	RoleDeliverd = "deliverd"
+)
+
+// RoleCheck returns an error if role of config is unknown
+func RoleCheck() error {
+	switch Cfg.GetRole() {
+	case RoleAll, RoleSmtpd, RoleDeliverd:
+		return nil
+	}
+	return errors.New("bad role " + Cfg.GetRole() + ", must be " + RoleAll + ", " + RoleSmtpd + " or " + RoleDeliverd)
+}
+
+// RoleSmtpdEnabled returns true if smtpd has to be launched
+func RoleSmtpdEnabled() bool {
+	return Cfg.GetLaunchSmtpd() && Cfg.GetRole() != RoleDeliverd
+}
+
+// RoleDeliverdEnabled returns true if deliverd has to be launched
+func RoleDeliverdEnabled() bool {
+	return Cfg.GetRole() != RoleSmtpd
+}
@@ -0,0 +1,139 @@
+package core
+
+// Role addresses (postmaster@, abuse@, ... RFC 5321 4.5.1 & RFC 2142)
+// They exist for every local domain: if there is no mailbox nor alias for
+// them, messages are routed to role_addresses_route (operator mailbox or
+// ticket webhook).
+// They are exempted from spam rejection: messages are tagged instead.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/toorop/tmail/message"
+)
+
+// checks not exempted for role addresses
+var roleAddressesNotExemptedChecks = []string{"clamav", "attachment-hash"}
+
+// isRoleAddress returns true if address is a role address
+func isRoleAddress(address string) bool {
+	p := strings.LastIndex(address, "@")
+	if p == -1 {
+		return false
+	}
+	return IsStringInSlice(strings.ToLower(address[:p]), Cfg.GetRoleAddresses())
+}
+
+// roleAddressesExempt downgrades verdict v to tag (if it's reject or
+// quarantine) if all recipients are role addresses
+func roleAddressesExempt(v smtpdVerdict, envelope message.Envelope) smtpdVerdict {
+	if (v.action != smtpdActionReject && v.action != smtpdActionQuarantine) || len(envelope.RcptTo) == 0 {
+		return v
+	}
+	if IsStringInSlice(v.check, roleAddressesNotExemptedChecks) {
+		return v
+	}
+	for _, rcpt := range envelope.RcptTo {
+		if !isRoleAddress(rcpt) {
+			return v
+		}
+	}
+	v.reason = fmt.Sprintf("%s (%s exempted for role address)", v.reason, v.action)
+	v.action = smtpdActionTag
+	return v
+}
+
+// roleAddressesIsRouted returns true if messages to role address rcpt,
+// which have no mailbox, are routed
+func roleAddressesIsRouted(rcpt string) bool {
+	return Cfg.GetRoleAddressesRoute() != "" && isRoleAddress(rcpt)
+}
+
+// deliverRoleAddress delivers message for role address (without mailbox)
+// to role addresses route
+func deliverRoleAddress(d *delivery) {
+	route := Cfg.GetRoleAddressesRoute()
+	if strings.HasPrefix(route, "http://") || strings.HasPrefix(route, "https://") {
+		if err := roleAddressesPostWebhook(route, d); err != nil {
+			d.dieTemp(fmt.Sprintf("delivery-local %s: unable to post message for role address %s to %s. %s", d.id, d.qMsg.RcptTo, route, err), true)
+			return
+		}
+		Log.Info(fmt.Sprintf("delivery-local %s: message for role address %s posted to %s", d.id, d.qMsg.RcptTo, route))
+		d.dieOk()
+		return
+	}
+	if strings.ToLower(route) == strings.ToLower(d.qMsg.RcptTo) {
+		d.dieTemp(fmt.Sprintf("delivery-local %s: role addresses route %s loops", d.id, route), true)
+		return
+	}
+	envelope := message.Envelope{
+		MailFrom: d.qMsg.MailFrom,
+		RcptTo:   []string{route},
+	}
+	uuid, err := QueueAddMessage(d.rawData, envelope, "")
+	if err != nil {
+		d.dieTemp(fmt.Sprintf("delivery-local %s: unable to requeue msg for role address: %s", d.id, err), true)
+		return
+	}
+	Log.Info(fmt.Sprintf("delivery-local %s: rcpt is a role address, mail is requeue with ID %s for %s", d.id, uuid, route))
+	d.dieOk()
+}
+
+// roleAddressesPostWebhook posts raw message to webhook url
+func roleAddressesPostWebhook(url string, d *delivery) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(*d.rawData))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "message/rfc822")
+	req.Header.Set("X-Tmail-Mail-From", d.qMsg.MailFrom)
+	req.Header.Set("X-Tmail-Rcpt-To", d.qMsg.RcptTo)
+	req.Header.Set("X-Tmail-Queue-Id", d.qMsg.Uuid)
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return errors.New(resp.Status + " " + string(body))
+	}
+	return nil
+}
+
+// RoleAddressesCheck logs role addresses of local domains which don't
+// exist (no mailbox nor alias) if they are not routed
+func RoleAddressesCheck() error {
+	if Cfg.GetRoleAddressesRoute() != "" {
+		return nil
+	}
+	rcpthosts, err := RcpthostGetAll()
+	if err != nil {
+		return err
+	}
+	for _, rcpthost := range rcpthosts {
+		if !rcpthost.IsLocal || rcpthost.IsAlias {
+			continue
+		}
+		for _, role := range Cfg.GetRoleAddresses() {
+			address := role + "@" + rcpthost.Hostname
+			exists, err := IsValidLocalRcpt(address)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				Log.Info("role address " + address + " doesn't exist, create it or define TMAIL_ROLE_ADDRESSES_ROUTE")
+			}
+		}
+	}
+	return nil
+}
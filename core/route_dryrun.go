@@ -0,0 +1,166 @@
+package core
+
+// Dry run of routing
+// RouteDryRunOf runs the routing decision of deliverd for a recipient
+// (routes, circuit breakers, MX records, local IPs and remote addresses)
+// without sending any mail, a live probe (EHLO and STARTTLS) is optional.
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/toorop/tmail/smtpx"
+)
+
+// RouteDryRun is the routing decision for a recipient
+type RouteDryRun struct {
+	Sender    string
+	Recipient string
+	Host      string
+	Local     bool // local delivery, no route is used
+	FromMX    bool // routes follow MX records
+	Routes    []RouteDryRunRoute
+	Error     string      // no route can be used
+	Probe     *RouteProbe // nil if not probed
+}
+
+// RouteDryRunRoute is a route deliverd would try (by priority)
+type RouteDryRunRoute struct {
+	RouteId     int64           // 0 for MX records
+	Description string          // without credentials
+	Down        bool            // circuit breaker open, route is skipped
+	Attempts    []smtpx.Attempt // connections tried in this order
+	Error       string          // route can't be used (bad local IP, DNS failure...)
+}
+
+// RouteProbe is the result of a live probe
+type RouteProbe struct {
+	RouteId    int64
+	LocalAddr  string
+	RemoteAddr string
+	LocalName  string // EHLO
+	Hello      string // EHLO reply
+	StartTLS   bool   // STARTTLS announced
+	TLSVersion string
+	TLSCipher  string
+	Error      string
+}
+
+// RouteDryRunOf returns the routing decision of a message from sender to
+// recipient (authUser is the authenticated user, "" if none). The route is
+// probed (connection, EHLO and STARTTLS if announced) if probe is true.
+func RouteDryRunOf(sender, recipient, authUser string, probe bool) (*RouteDryRun, error) {
+	p := strings.LastIndex(recipient, "@")
+	if p < 1 || p == len(recipient)-1 {
+		return nil, errors.New("bad recipient " + recipient)
+	}
+	dr := &RouteDryRun{Sender: sender, Recipient: recipient, Host: strings.ToLower(recipient[p+1:])}
+
+	local, err := isLocalDelivery(recipient)
+	if err != nil {
+		return nil, err
+	}
+	if local {
+		dr.Local = true
+		return dr, nil
+	}
+
+	routes, err := getRoutes(sender, dr.Host, authUser)
+	if err != nil {
+		return nil, errors.New("unable to get route to host " + dr.Host + ". " + err.Error())
+	}
+	isOpen, err := routeHealthOpen(*routes)
+	if err != nil {
+		return nil, err
+	}
+	up, mxFallback := []Route{}, false
+	for _, r := range *routes {
+		if r.Id != 0 && isOpen[r.Id] {
+			dr.Routes = append(dr.Routes, RouteDryRunRoute{RouteId: r.Id, Description: r.describe(), Down: true})
+			continue
+		}
+		up = append(up, r)
+		mxFallback = mxFallback || r.MxFallback
+	}
+	dr.FromMX = len(*routes) != 0 && (*routes)[0].Id == 0
+	if len(up) == 0 {
+		if !mxFallback {
+			dr.Error = "all routes to " + dr.Host + " are down (circuit breakers open)"
+			return dr, nil
+		}
+		if routes, err = routesFromMX(dr.Host); err != nil {
+			dr.Error = "fallback to MX - " + err.Error()
+			return dr, nil
+		}
+		up, dr.FromMX = *routes, true
+	}
+
+	opts := smtpxOptions()
+	for i := range up {
+		dryRoute := RouteDryRunRoute{RouteId: up[i].Id, Description: up[i].describe()}
+		if up[i].Id == 0 {
+			dryRoute.Description = fmt.Sprintf("%s:%d preference %d", up[i].RemoteHost, up[i].RemotePort.Int64, up[i].Priority.Int64)
+		}
+		xroutes, err := smtpxRoutes(&[]Route{up[i]})
+		if err == nil && !smtpx.IsLMTPURI(up[i].RemoteHost) {
+			dryRoute.Attempts, err = smtpx.Attempts(context.Background(), &xroutes[0], opts)
+		}
+		if err != nil {
+			dryRoute.Error = err.Error()
+		}
+		dr.Routes = append(dr.Routes, dryRoute)
+	}
+	if probe {
+		dr.Probe = routeDryRunProbe(up)
+	}
+	return dr, nil
+}
+
+// routeDryRunProbe connects through routes, sends EHLO and STARTTLS (if
+// announced) then QUIT. It dials with smtpx directly: results of the probe
+// (run from the CLI host) are not recorded in health of routes.
+func routeDryRunProbe(routes []Route) *RouteProbe {
+	probe := &RouteProbe{}
+	xroutes, err := smtpxRoutes(&routes)
+	if err != nil {
+		probe.Error = err.Error()
+		return probe
+	}
+	c, err := smtpx.Dial(context.Background(), xroutes, smtpxOptions())
+	if err != nil {
+		probe.Error = err.Error()
+		return probe
+	}
+	ctx := IdentityContext{LocalIP: addrIP(c.LocalAddr())}
+	if c.Route != nil {
+		ctx.RouteId, ctx.RemoteHost = c.Route.ID, c.Route.RemoteHost
+	}
+	c.LocalName = identityHostname(ctx)
+	client := wrapSMTPClient(c, &routes)
+	defer client.close()
+	if client.route != nil {
+		probe.RouteId = client.route.Id
+	}
+	probe.LocalAddr, probe.RemoteAddr, probe.LocalName = client.LocalAddr(), client.RemoteAddr(), client.LocalName
+	code, msg, err := client.Hello()
+	if err != nil {
+		probe.Error = "EHLO failed - " + err.Error()
+		return probe
+	}
+	probe.Hello = fmt.Sprintf("%d %s", code, strings.TrimSpace(strings.Split(msg, "\n")[0]))
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		probe.StartTLS = true
+		var config tls.Config
+		config.InsecureSkipVerify = Cfg.GetDeliverdRemoteTLSSkipVerify()
+		if _, _, err = client.StartTLS(&config); err != nil {
+			probe.Error = "STARTTLS failed - " + err.Error()
+			return probe
+		}
+		probe.TLSVersion, probe.TLSCipher = client.TLSGetVersion(), client.TLSGetCipherSuite()
+	}
+	client.Quit()
+	return probe
+}
@@ -0,0 +1,275 @@
+package core
+
+// Route plans
+// A plan adds and removes routes at once. It can be checked first (dry
+// run): the routes of each destination whose behavior changes are shown
+// before and after. Plans are applied in a transaction (all or nothing),
+// then, if asked, new routes of changed destinations are probed (connection
+// & EHLO): if a probe fails the plan is rolled back.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/toorop/tmail/smtpx"
+)
+
+// RoutePlan represents changes of routes
+type RoutePlan struct {
+	Add    []BundleRoute // routes to add
+	Delete []int64       // ids of routes to remove
+}
+
+// RouteChange represents routes of a destination before and after a plan
+type RouteChange struct {
+	Destination string   // host [user] [mail from]
+	Before      []string // routes in order of priority (none: MX records)
+	After       []string
+}
+
+// routesByPriority sorts routes by priority
+type routesByPriority []Route
+
+func (r routesByPriority) Len() int      { return len(r) }
+func (r routesByPriority) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r routesByPriority) Less(i, j int) bool {
+	if r[i].Priority.Int64 == r[j].Priority.Int64 {
+		return r[i].Id < r[j].Id
+	}
+	return r[i].Priority.Int64 < r[j].Priority.Int64
+}
+
+// destination returns destination of route r
+func (r *Route) destination() string {
+	d := r.Host
+	if r.User.Valid && r.User.String != "" {
+		d += " user " + r.User.String
+	}
+	if r.MailFrom.Valid && r.MailFrom.String != "" {
+		d += " mail from " + r.MailFrom.String
+	}
+	return d
+}
+
+// credentialFingerprint returns a short fingerprint of secret of route to
+// host, changes of credentials are shown without revealing them
+func credentialFingerprint(host, login, secret string) string {
+	sum := sha256.Sum256([]byte(host + "\x00" + login + "\x00" + secret))
+	return "sha256:" + hex.EncodeToString(sum[:4])
+}
+
+// describe returns a description of route r, credentials are replaced by
+// their fingerprint
+func (r *Route) describe() string {
+	id := "new"
+	if r.Id != 0 {
+		id = fmt.Sprintf("%d", r.Id)
+	}
+	d := fmt.Sprintf("%s: %s:%d priority %d", id, r.RemoteHost, r.RemotePort.Int64, r.Priority.Int64)
+	if r.LocalIp.Valid && r.LocalIp.String != "" {
+		d += " from " + r.LocalIp.String
+	}
+	if r.SmtpAuthLogin.Valid && r.SmtpAuthLogin.String != "" {
+		d += " auth " + r.SmtpAuthLogin.String
+		if r.SmtpAuthMech.Valid && r.SmtpAuthMech.String != "" {
+			d += " (" + r.SmtpAuthMech.String + ")"
+		}
+		if r.SmtpAuthPasswd.Valid && r.SmtpAuthPasswd.String != "" {
+			d += " password " + credentialFingerprint(r.Host, r.SmtpAuthLogin.String, r.SmtpAuthPasswd.String)
+		}
+	}
+	if r.ForwardClient.Valid && r.ForwardClient.String != "" {
+		d += " " + r.ForwardClient.String
+	}
+	if r.RetrySchedule.Valid && r.RetrySchedule.String != "" {
+		d += " retry " + r.RetrySchedule.String
+	}
+	if r.Proxy.Valid && r.Proxy.String != "" {
+		if p, err := smtpx.ParseProxy(r.Proxy.String); err == nil {
+			d += " via " + p.String()
+			if p.Password != "" {
+				d += " password " + credentialFingerprint(r.Host, p.User, p.Password)
+			}
+		}
+	}
+	if r.Weight.Valid && r.Weight.Int64 > 1 {
+		d += fmt.Sprintf(" weight %d", r.Weight.Int64)
+	}
+	if r.MxFallback {
+		d += " mx fallback"
+	}
+	if r.IpFamily.Valid && r.IpFamily.String != "" {
+		d += " " + r.IpFamily.String
+	}
+	if r.Timeouts.Valid && r.Timeouts.String != "" {
+		d += " timeouts " + r.Timeouts.String
+	}
+	return d
+}
+
+// routePlanPrepare validates plan, it returns current routes, routes to
+// delete and routes to add
+func routePlanPrepare(plan RoutePlan) (current, deleted, added []Route, err error) {
+	if current, err = GetAllRoutes(); err != nil {
+		return
+	}
+	for _, id := range plan.Delete {
+		found := false
+		for _, r := range current {
+			if r.Id == id {
+				deleted, found = append(deleted, r), true
+				break
+			}
+		}
+		if !found {
+			return nil, nil, nil, fmt.Errorf("no such route %d", id)
+		}
+	}
+	for _, r := range plan.Add {
+		route, err := newRoute(r.Host, r.LocalIp, r.RemoteHost, r.RemotePort, r.Priority, r.User, r.MailFrom, r.SmtpAuthLogin, r.SmtpAuthPasswd, r.ForwardClient, r.RetrySchedule, r.Proxy, r.SmtpAuthMech, r.Weight, r.MxFallback, r.IpFamily, r.Timeouts)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("bad route to %s - %s", r.Host, err)
+		}
+		added = append(added, *route)
+	}
+	return
+}
+
+// routesByDestination groups routes by destination
+func routesByDestination(routes []Route) map[string][]Route {
+	m := make(map[string][]Route)
+	for _, r := range routes {
+		m[r.destination()] = append(m[r.destination()], r)
+	}
+	for d := range m {
+		sort.Sort(routesByPriority(m[d]))
+	}
+	return m
+}
+
+// routePlanChanges returns destinations whose routes change
+func routePlanChanges(current, deleted, added []Route) []RouteChange {
+	next := []Route{}
+	for _, r := range current {
+		isDeleted := false
+		for _, d := range deleted {
+			if d.Id == r.Id {
+				isDeleted = true
+				break
+			}
+		}
+		if !isDeleted {
+			next = append(next, r)
+		}
+	}
+	next = append(next, added...)
+	before, after := routesByDestination(current), routesByDestination(next)
+	destinations := []string{}
+	for d := range before {
+		destinations = append(destinations, d)
+	}
+	for d := range after {
+		if _, ok := before[d]; !ok {
+			destinations = append(destinations, d)
+		}
+	}
+	sort.Strings(destinations)
+	changes := []RouteChange{}
+	for _, d := range destinations {
+		change := RouteChange{Destination: d, Before: []string{}, After: []string{}}
+		for _, r := range before[d] {
+			change.Before = append(change.Before, r.describe())
+		}
+		for _, r := range after[d] {
+			change.After = append(change.After, r.describe())
+		}
+		if strings.Join(change.Before, "\n") != strings.Join(change.After, "\n") {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// RoutePlanDiff validates plan and returns destinations whose routes would
+// change (dry run)
+func RoutePlanDiff(plan RoutePlan) ([]RouteChange, error) {
+	current, deleted, added, err := routePlanPrepare(plan)
+	if err != nil {
+		return nil, err
+	}
+	return routePlanChanges(current, deleted, added), nil
+}
+
+// routePlanExec deletes and creates routes in a transaction
+func routePlanExec(deleted, added []Route) error {
+	tx := DB.Begin()
+	for _, r := range deleted {
+		if err := tx.Delete(&Route{Id: r.Id}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for i := range added {
+		if err := tx.Create(&added[i]).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// routeProbe connects through routes and sends EHLO
+func routeProbe(routes []Route) error {
+	client, err := newSMTPClient(&routes)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	if _, _, err = client.Hello(); err != nil {
+		return err
+	}
+	client.Quit()
+	return nil
+}
+
+// RoutePlanApply applies plan atomically and returns changed destinations.
+// If probe is true new routes of changed destinations are probed, plan is
+// rolled back if a probe fails.
+func RoutePlanApply(plan RoutePlan, probe bool) ([]RouteChange, error) {
+	current, deleted, added, err := routePlanPrepare(plan)
+	if err != nil {
+		return nil, err
+	}
+	changes := routePlanChanges(current, deleted, added)
+	if err = routePlanExec(deleted, added); err != nil {
+		return nil, errors.New("plan not applied, routes unchanged - " + err.Error())
+	}
+	Log.Info(fmt.Sprintf("routes - plan applied: %d added, %d removed, %d destinations changed", len(added), len(deleted), len(changes)))
+	for _, change := range changes {
+		Log.Info(fmt.Sprintf("routes - %s changed from [%s] to [%s]", change.Destination, strings.Join(change.Before, "; "), strings.Join(change.After, "; ")))
+	}
+	if !probe {
+		return changes, nil
+	}
+	after := routesByDestination(added)
+	for _, change := range changes {
+		routes, ok := after[change.Destination]
+		if !ok {
+			// routes removed only
+			continue
+		}
+		if err = routeProbe(routes); err == nil {
+			continue
+		}
+		Log.Error("routes - canary probe of " + change.Destination + " failed, rolling back plan - " + err.Error())
+		if errRollback := routePlanExec(added, deleted); errRollback != nil {
+			return changes, errors.New("canary probe of " + change.Destination + " failed - " + err.Error() + " - and rollback failed - " + errRollback.Error())
+		}
+		return changes, errors.New("plan rolled back, canary probe of " + change.Destination + " failed - " + err.Error())
+	}
+	return changes, nil
+}
@@ -0,0 +1,239 @@
+package core
+
+// Rspamd client (HTTP protocol)
+// smtpd_rspamd: http://host:port?timeout=20&onfailure=tempfail
+// smtpd_rspamd_controller (learning): http://host:port
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toorop/tmail/message"
+)
+
+// rspamd represents a rspamd worker
+type rspamd struct {
+	url       string
+	timeout   time.Duration
+	onFailure onfailure
+}
+
+// rspamdResult is the reply of rspamd to /checkv2
+type rspamdResult struct {
+	Action        string  `json:"action"`
+	Score         float64 `json:"score"`
+	RequiredScore float64 `json:"required_score"`
+	Symbols       map[string]struct {
+		Score float64 `json:"score"`
+	} `json:"symbols"`
+	Messages struct {
+		SmtpMessage string `json:"smtp_message"`
+	} `json:"messages"`
+}
+
+// newRspamd returns a rspamd client parsing uri
+func newRspamd(uri string) (*rspamd, error) {
+	r := &rspamd{
+		url:       strings.TrimSuffix(strings.Split(uri, "?")[0], "/"),
+		timeout:   20 * time.Second,
+		onFailure: TEMPFAIL,
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if t := parsed.Query().Get("timeout"); t != "" {
+		timeout, err := strconv.ParseUint(t, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		r.timeout = time.Duration(timeout) * time.Second
+	}
+	switch parsed.Query().Get("onfailure") {
+	case "continue":
+		r.onFailure = CONTINUE
+	case "permfail":
+		r.onFailure = PERMFAIL
+	}
+	return r, nil
+}
+
+// check submits message to rspamd
+func (r *rspamd) check(ctx *smtpdCheckContext, rawMessage *[]byte) (result rspamdResult, err error) {
+	req, err := http.NewRequest("POST", r.url+"/checkv2", bytes.NewReader(*rawMessage))
+	if err != nil {
+		return
+	}
+	if ctx.remoteIP != nil {
+		req.Header.Set("IP", ctx.remoteIP.String())
+	}
+	if ctx.helo != "" {
+		req.Header.Set("Helo", ctx.helo)
+	}
+	if ctx.authUser != "" {
+		req.Header.Set("User", ctx.authUser)
+	}
+	req.Header.Set("From", ctx.envelope.MailFrom)
+	for _, rcpt := range ctx.envelope.RcptTo {
+		req.Header.Add("Rcpt", rcpt)
+	}
+	req.Header.Set("MTA-Name", Cfg.GetMe())
+	client := &http.Client{
+		Timeout: r.timeout,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != 200 {
+		return result, errors.New(resp.Status + " " + string(body))
+	}
+	err = json.Unmarshal(body, &result)
+	return
+}
+
+// headers returns X-Spam headers for result
+func (result *rspamdResult) headers() []string {
+	flag := "NO"
+	if result.Action != "no action" && result.Action != "greylist" {
+		flag = "YES"
+	}
+	symbols := []string{}
+	for name := range result.Symbols {
+		symbols = append(symbols, name)
+	}
+	sort.Strings(symbols)
+	headers := []string{
+		"X-Spam-Flag: " + flag,
+		fmt.Sprintf("X-Spam-Score: %.2f / %.2f", result.Score, result.RequiredScore),
+		"X-Spam-Action: " + result.Action,
+	}
+	if len(symbols) != 0 {
+		headers = append(headers, "X-Spam-Symbols: "+strings.Join(symbols, ", "))
+	}
+	return headers
+}
+
+// checkRspamd submits message to rspamd and applies its action
+func checkRspamd(ctx *smtpdCheckContext, rawMessage *[]byte) (v smtpdVerdict) {
+	v.check = "rspamd"
+	uri := Cfg.GetSmtpdRspamd()
+	if uri == "" {
+		return
+	}
+	r, err := newRspamd(uri)
+	if err == nil {
+		var result rspamdResult
+		if result, err = r.check(ctx, rawMessage); err == nil {
+			rspamdStripHeaders(rawMessage)
+			return rspamdVerdict(v, result)
+		}
+	}
+	ctx.logError("MAIL - rspamd: " + err.Error())
+	v.reason = "scanner failure"
+	if r == nil || r.onFailure == TEMPFAIL {
+		v.action, v.reply = smtpdActionTempfail, "454 4.3.0 scanner failure"
+	} else if r.onFailure == PERMFAIL {
+		v.action, v.reply = smtpdActionReject, "554 5.3.0 scanner failure"
+	}
+	return
+}
+
+// rspamdStripHeaders removes X-Spam-* header fields of rawMessage, the
+// ones added from rspamd result must not be pre-seeded by the sender
+func rspamdStripHeaders(rawMessage *[]byte) {
+	fields, kept := message.RawGetHeaderFields(rawMessage), []string{}
+	for _, f := range fields {
+		if !strings.HasPrefix(headerFieldName(f), "x-spam-") {
+			kept = append(kept, f)
+		}
+	}
+	if len(kept) != len(fields) {
+		message.RawSetHeaderFields(rawMessage, kept)
+	}
+}
+
+// rspamdVerdict returns verdict for rspamd result
+func rspamdVerdict(v smtpdVerdict, result rspamdResult) smtpdVerdict {
+	v.reason = fmt.Sprintf("%s (score %.2f / %.2f)", result.Action, result.Score, result.RequiredScore)
+	v.headers = result.headers()
+	switch result.Action {
+	case "add header", "rewrite subject":
+		v.action = smtpdActionTag
+	case "greylist":
+		v.action, v.reply = smtpdActionTempfail, "451 4.7.1 Greylisted, please try again later"
+	case "soft reject":
+		v.action, v.reply = smtpdActionTempfail, "451 4.7.1 Try again later"
+	case "reject":
+		v.action, v.reply = smtpdActionReject, "554 5.7.1 Spam message rejected"
+	}
+	// rspamd message replaces text of the reply (codes are kept)
+	if result.Messages.SmtpMessage != "" && v.reply != "" {
+		v.reply = v.reply[:10] + result.Messages.SmtpMessage
+	}
+	return v
+}
+
+// RspamdLearn submits message to rspamd controller as spam or ham
+func RspamdLearn(rawMessage []byte, spam bool) error {
+	controller := Cfg.GetSmtpdRspamdController()
+	if controller == "" {
+		return errors.New("rspamd controller is not defined (smtpd_rspamd_controller)")
+	}
+	endpoint := "/learnham"
+	if spam {
+		endpoint = "/learnspam"
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(controller, "/")+endpoint, bytes.NewReader(rawMessage))
+	if err != nil {
+		return err
+	}
+	if password := Cfg.GetSmtpdRspamdPassword(); password != "" {
+		req.Header.Set("Password", password)
+	}
+	client := &http.Client{
+		Timeout: 60 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		// already learned is not an error
+		if resp.StatusCode == 208 || strings.Contains(string(body), "already learned") {
+			return nil
+		}
+		return errors.New(resp.Status + " " + string(body))
+	}
+	return nil
+}
+
+// RspamdLearnQuarantined submits quarantined message id to rspamd controller
+// as spam or ham
+func RspamdLearnQuarantined(id int64, spam bool) error {
+	qm, err := QuarantineGet(id)
+	if err != nil {
+		return err
+	}
+	raw, err := qm.GetRaw()
+	if err != nil {
+		return err
+	}
+	return RspamdLearn(raw, spam)
+}
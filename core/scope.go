@@ -37,26 +37,45 @@ func ScopeBootstrap() (err error) {
 	if err != nil {
 		return
 	}
+	return scopeInit(nil)
+}
 
-	// logger
-	var out io.Writer
-	logPath := Cfg.GetLogPath()
-	if logPath == "stdout" {
-		out = os.Stdout
-	} else if logPath == "discard" {
-		out = ioutil.Discard
-	} else {
-		file := path.Join(logPath, "current.log")
-		out, err = os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-		if err != nil {
-			return
+// ScopeBootstrapFromMap bootstraps with config values (see
+// InitConfigFromMap), log is written to logOut if it's not nil
+func ScopeBootstrapFromMap(values map[string]string, logOut io.Writer) (err error) {
+	Cfg, err = InitConfigFromMap(values)
+	if err != nil {
+		return
+	}
+	return scopeInit(logOut)
+}
+
+// scopeInit inits logger, DB & queue producer from Cfg
+func scopeInit(out io.Writer) (err error) {
+	// logger (out is provided by programs embedding tmail)
+	if out == nil {
+		logPath := Cfg.GetLogPath()
+		if logPath == "stdout" {
+			out = os.Stdout
+		} else if logPath == "discard" {
+			out = ioutil.Discard
+		} else {
+			file := path.Join(logPath, "current.log")
+			out, err = os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+			if err != nil {
+				return
+			}
 		}
 	}
-	Log, err = NewLogger(out, Cfg.GetDebugEnabled())
+	Log, err = NewLogger(out, Cfg.GetDebugEnabled(), Cfg.GetLogFormat())
 	if err != nil {
 		return
 	}
 
+	if err = Cfg.validate(); err != nil {
+		return
+	}
+
 	// Init DB
 	DB, err = gorm.Open(Cfg.GetDbDriver(), Cfg.GetDbSource())
 	if err != nil {
@@ -87,6 +106,15 @@ func ScopeBootstrap() (err error) {
 	return
 }
 
+// InitMailQueueProducer inits producer for queue if it's not initialized
+// yet (deliverd queues bounces)
+func InitMailQueueProducer() error {
+	if NsqQueueProducer != nil {
+		return nil
+	}
+	return initMailQueueProducer()
+}
+
 // initMailQueueProducer init producer for queue
 func initMailQueueProducer() (err error) {
 	nsqCfg := nsq.NewConfig()
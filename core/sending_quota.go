@@ -0,0 +1,348 @@
+package core
+
+// Sending quotas of authenticated users
+// Messages, recipients and bytes sent by each authenticated user are counted
+// by day (UTC) in DB (counters are shared by smtpd processes and cluster
+// nodes), deliverd counts delivered and bounced messages of the user.
+// A user who reaches one of their daily quotas (smtpd_sending_*_per_day,
+// overridden per user by SendingQuota) is refused (450) until the end of the
+// day, a user who exceeds them (a message pushed counters over quotas) or
+// whose bounce rate goes over smtpd_sending_max_bounce_rate is suspended for
+// smtpd_sending_suspend_duration: smtpd refuses their messages (450).
+// Reputation of a user is the % of their deliveries which didn't bounce during
+// the last sendingHistoryDays days.
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// counters are kept this number of days (reputation)
+const sendingHistoryDays = 7
+
+// SendingQuota represents sending quotas and suspension of an authenticated
+// user, 0 means the global quota applies
+type SendingQuota struct {
+	Id             int64
+	Login          string `sql:"unique"`
+	MsgsPerDay     int
+	RcptsPerDay    int
+	BytesPerDay    int64
+	SuspendedUntil time.Time
+	SuspendReason  string
+}
+
+// SendingCounter represents what an authenticated user sent during a day
+type SendingCounter struct {
+	Id         int64
+	Login      string
+	Day        time.Time
+	Messages   int64
+	Recipients int64
+	Bytes      int64
+	Delivered  int64 // deliveries (success)
+	Bounced    int64 // deliveries (permanent failure)
+}
+
+// BounceRate returns % of bounced deliveries
+func (c SendingCounter) BounceRate() float64 {
+	if c.Delivered+c.Bounced == 0 {
+		return 0
+	}
+	return float64(c.Bounced) * 100 / float64(c.Delivered+c.Bounced)
+}
+
+// SendingStatus represents sending state of an authenticated user
+type SendingStatus struct {
+	SendingQuota // global quotas applied
+	Today        SendingCounter
+	BounceRate   float64 // % of bounced deliveries today
+	Reputation   float64 // % of deliveries which didn't bounce during last days
+	Suspended    bool
+}
+
+// sendingDay returns day of t
+func sendingDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// sendingQuotaOf returns quotas of user login (global quotas applied)
+func sendingQuotaOf(login string) (quota SendingQuota, err error) {
+	login = strings.ToLower(login)
+	err = DB.Where("login = ?", login).First(&quota).Error
+	if err == gorm.RecordNotFound {
+		quota, err = SendingQuota{Login: login}, nil
+	}
+	if err != nil {
+		return
+	}
+	if quota.MsgsPerDay == 0 {
+		quota.MsgsPerDay = Cfg.GetSmtpdSendingMsgsPerDay()
+	}
+	if quota.RcptsPerDay == 0 {
+		quota.RcptsPerDay = Cfg.GetSmtpdSendingRcptsPerDay()
+	}
+	if quota.BytesPerDay == 0 {
+		// checked by scopeInit
+		quota.BytesPerDay, _ = ParseSize(Cfg.GetSmtpdSendingBytesPerDay())
+	}
+	return
+}
+
+// sendingCounterOf returns counter of user login for day
+func sendingCounterOf(login string, day time.Time) (counter SendingCounter, err error) {
+	login = strings.ToLower(login)
+	err = DB.Where("login = ? AND day = ?", login, day).First(&counter).Error
+	if err == gorm.RecordNotFound {
+		counter, err = SendingCounter{Login: login, Day: day}, nil
+	}
+	return
+}
+
+// sendingQuotaReached returns why counter reached quota ("" if it didn't)
+func sendingQuotaReached(quota SendingQuota, counter SendingCounter) string {
+	return sendingQuotaOver(quota, counter, 0)
+}
+
+// sendingQuotaExceeded returns why counter exceeded quota ("" if it didn't)
+func sendingQuotaExceeded(quota SendingQuota, counter SendingCounter) string {
+	return sendingQuotaOver(quota, counter, 1)
+}
+
+// sendingQuotaOver returns why counter is at least quota + over ("" if it
+// isn't)
+func sendingQuotaOver(quota SendingQuota, counter SendingCounter, over int64) string {
+	switch {
+	case quota.MsgsPerDay != 0 && counter.Messages >= int64(quota.MsgsPerDay)+over:
+		return fmt.Sprintf("%d messages today (quota %d)", counter.Messages, quota.MsgsPerDay)
+	case quota.RcptsPerDay != 0 && counter.Recipients >= int64(quota.RcptsPerDay)+over:
+		return fmt.Sprintf("%d recipients today (quota %d)", counter.Recipients, quota.RcptsPerDay)
+	case quota.BytesPerDay != 0 && counter.Bytes >= quota.BytesPerDay+over:
+		return fmt.Sprintf("%d bytes today (quota %d)", counter.Bytes, quota.BytesPerDay)
+	}
+	return ""
+}
+
+// sendingSuspend suspends user login for smtpd_sending_suspend_duration
+func sendingSuspend(login, reason string) error {
+	login = strings.ToLower(login)
+	quota := SendingQuota{}
+	err := DB.Where("login = ?", login).First(&quota).Error
+	if err != nil && err != gorm.RecordNotFound {
+		return err
+	}
+	if quota.SuspendedUntil.After(time.Now()) {
+		return nil
+	}
+	quota.Login, quota.SuspendReason = login, reason
+	quota.SuspendedUntil = time.Now().Add(time.Duration(Cfg.GetSmtpdSendingSuspendDuration()) * time.Minute)
+	if err = DB.Save(&quota).Error; err != nil {
+		return err
+	}
+	Log.Info("sending - user " + login + " suspended until " + quota.SuspendedUntil.Format(time.RFC3339) + " - " + reason)
+	return nil
+}
+
+// sendingAdd adds amounts to today counter of user login, counters older
+// than sendingHistoryDays are removed
+func sendingAdd(login string, amounts map[string]interface{}) (SendingCounter, error) {
+	day := sendingDay(time.Now())
+	counter, err := sendingCounterOf(login, day)
+	if err != nil {
+		return counter, err
+	}
+	if counter.Id == 0 {
+		if err = DB.Where("day < ?", day.AddDate(0, 0, -sendingHistoryDays)).Delete(SendingCounter{}).Error; err != nil {
+			return counter, err
+		}
+	}
+	// counters are shared by processes
+	if err = dbAdd(&SendingCounter{}, map[string]interface{}{"login": counter.Login, "day": day}, amounts, nil, nil); err != nil {
+		return counter, err
+	}
+	return sendingCounterOf(login, day)
+}
+
+// sendingCheck checks if authenticated user of session can send a message
+// (MAIL) or one more recipient (rcpt)
+// it returns true if user is suspended or reached their quotas (reply has
+// been sent)
+func (s *SMTPServerSession) sendingCheck(rcpt bool) bool {
+	if s.user == nil {
+		return false
+	}
+	quota, err := sendingQuotaOf(s.user.Login)
+	if err != nil {
+		s.logError("SENDING - unable to get quotas of " + s.user.Login + " - " + err.Error())
+		return false
+	}
+	if quota.SuspendedUntil.After(time.Now()) {
+		s.log("SENDING - " + s.user.Login + " is suspended until " + quota.SuspendedUntil.Format(time.RFC3339) + " - " + quota.SuspendReason)
+		s.out("450 4.7.1 sending is suspended for this account, try again later")
+		return true
+	}
+	counter, err := sendingCounterOf(s.user.Login, sendingDay(time.Now()))
+	if err != nil {
+		s.logError("SENDING - unable to get counter of " + s.user.Login + " - " + err.Error())
+		return false
+	}
+	if rcpt {
+		counter.Recipients += int64(len(s.envelope.RcptTo))
+	}
+	reason := sendingQuotaReached(quota, counter)
+	if reason == "" {
+		return false
+	}
+	s.log("SENDING - daily quota of " + s.user.Login + " reached - " + reason)
+	if rcpt {
+		s.out("452 4.5.3 daily recipients quota reached")
+		return true
+	}
+	// daily counter blocks until the end of the UTC day
+	s.out("450 4.7.1 daily sending quota reached, try again later")
+	return true
+}
+
+// sendingMessageQueued counts message of size bytes queued for authenticated
+// user of session, the user is suspended if they exceeded their quotas (the
+// last allowed message doesn't suspend them)
+func (s *SMTPServerSession) sendingMessageQueued(size int) {
+	if s.user == nil {
+		return
+	}
+	counter, err := sendingAdd(s.user.Login, map[string]interface{}{"messages": 1, "recipients": len(s.envelope.RcptTo), "bytes": size})
+	if err != nil {
+		s.logError("SENDING - unable to update counter of " + s.user.Login + " - " + err.Error())
+		return
+	}
+	quota, err := sendingQuotaOf(s.user.Login)
+	if err != nil {
+		s.logError("SENDING - unable to get quotas of " + s.user.Login + " - " + err.Error())
+		return
+	}
+	if reason := sendingQuotaExceeded(quota, counter); reason != "" {
+		if err = sendingSuspend(s.user.Login, reason); err != nil {
+			s.logError("SENDING - unable to suspend " + s.user.Login + " - " + err.Error())
+		}
+	}
+}
+
+// sendingDelivery counts delivery of a message of authenticated user login
+// (bounced: permanent failure), the user is suspended if their bounce rate is
+// too high
+func sendingDelivery(login string, bounced bool) {
+	if login == "" {
+		return
+	}
+	result := "delivered"
+	if bounced {
+		result = "bounced"
+	}
+	counter, err := sendingAdd(login, map[string]interface{}{result: 1})
+	if err != nil {
+		Log.Error("sending - unable to update counter of " + login + " - " + err.Error())
+		return
+	}
+	max := Cfg.GetSmtpdSendingMaxBounceRate()
+	if !bounced || max == 0 || counter.Delivered+counter.Bounced < int64(Cfg.GetSmtpdSendingBounceRateMin()) {
+		return
+	}
+	if rate := counter.BounceRate(); rate > float64(max) {
+		if err = sendingSuspend(login, fmt.Sprintf("bounce rate %.1f%% today (max %d%%)", rate, max)); err != nil {
+			Log.Error("sending - unable to suspend " + login + " - " + err.Error())
+		}
+	}
+}
+
+// SendingStatusOf returns sending status of user login
+func SendingStatusOf(login string) (status SendingStatus, err error) {
+	if status.SendingQuota, err = sendingQuotaOf(login); err != nil {
+		return
+	}
+	status.Suspended = status.SuspendedUntil.After(time.Now())
+	counters := []SendingCounter{}
+	day := sendingDay(time.Now())
+	if err = DB.Where("login = ? AND day >= ?", status.Login, day.AddDate(0, 0, -sendingHistoryDays)).Find(&counters).Error; err != nil {
+		return
+	}
+	status.Today = SendingCounter{Login: status.Login, Day: day}
+	history := SendingCounter{}
+	for _, c := range counters {
+		if c.Day.Equal(day) {
+			status.Today = c
+		}
+		history.Delivered += c.Delivered
+		history.Bounced += c.Bounced
+	}
+	status.BounceRate = status.Today.BounceRate()
+	status.Reputation = 100 - history.BounceRate()
+	return
+}
+
+// SendingStatusList returns sending status of users which sent messages
+// during last days or have quotas
+func SendingStatusList() (statuses []SendingStatus, err error) {
+	statuses = []SendingStatus{}
+	logins := map[string]bool{}
+	counters := []SendingCounter{}
+	if err = DB.Where("day >= ?", sendingDay(time.Now()).AddDate(0, 0, -sendingHistoryDays)).Find(&counters).Error; err != nil {
+		return
+	}
+	for _, c := range counters {
+		logins[c.Login] = true
+	}
+	quotas := []SendingQuota{}
+	if err = DB.Find(&quotas).Error; err != nil {
+		return
+	}
+	for _, q := range quotas {
+		logins[q.Login] = true
+	}
+	sorted := []string{}
+	for login := range logins {
+		sorted = append(sorted, login)
+	}
+	sort.Strings(sorted)
+	for _, login := range sorted {
+		status, err := SendingStatusOf(login)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	return
+}
+
+// SendingQuotaSet sets sending quotas of user login (0: global quota)
+func SendingQuotaSet(login string, msgsPerDay, rcptsPerDay int, bytesPerDay int64) error {
+	login = strings.ToLower(login)
+	if msgsPerDay < 0 || rcptsPerDay < 0 || bytesPerDay < 0 {
+		return errors.New("quotas must be positive")
+	}
+	if _, err := UserGetByLogin(login); err != nil {
+		if err == gorm.RecordNotFound {
+			return errors.New("user " + login + " doesn't exist")
+		}
+		return err
+	}
+	quota := SendingQuota{}
+	if err := DB.Where("login = ?", login).First(&quota).Error; err != nil && err != gorm.RecordNotFound {
+		return err
+	}
+	quota.Login, quota.MsgsPerDay, quota.RcptsPerDay, quota.BytesPerDay = login, msgsPerDay, rcptsPerDay, bytesPerDay
+	return DB.Save(&quota).Error
+}
+
+// SendingReset resets counters of user login and lifts their suspension
+func SendingReset(login string) error {
+	login = strings.ToLower(login)
+	if err := DB.Where("login = ?", login).Delete(SendingCounter{}).Error; err != nil {
+		return err
+	}
+	return DB.Model(SendingQuota{}).Where("login = ?", login).Updates(map[string]interface{}{"suspended_until": time.Time{}, "suspend_reason": ""}).Error
+}
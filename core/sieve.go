@@ -0,0 +1,601 @@
+package core
+
+// Sieve (RFC 5228) scripts of local users
+// Scripts are parsed into commands which are run at local delivery (see
+// sieve_exec.go). Supported: require, if/elsif/else, stop, keep, discard,
+// fileinto, redirect and vacation (RFC 5230) commands, address, envelope,
+// header, exists, size, allof, anyof, not, true and false tests, with
+// i;ascii-casemap & i;octet comparators and :is, :contains & :matches
+// match types.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// sieveExtensions are extensions which can be required
+var sieveExtensions = []string{"fileinto", "envelope", "vacation", "comparator-i;octet", "comparator-i;ascii-casemap"}
+
+// sieve tokens types
+const (
+	sieveTokenIdentifier = iota
+	sieveTokenTag
+	sieveTokenNumber
+	sieveTokenString
+	sieveTokenSpecial // [ ] ( ) , ; { }
+	sieveTokenEOF
+)
+
+// sieveToken is a token of a script
+type sieveToken struct {
+	typ   int
+	value string
+	num   int64
+	line  int
+}
+
+// sieveArg is an argument of a command or a test: tag, number, string or
+// string list
+type sieveArg struct {
+	tag    string
+	num    int64
+	strs   []string
+	isNum  bool
+	isList bool
+	line   int
+}
+
+// sieveTest is a test
+type sieveTest struct {
+	name  string
+	args  []sieveArg
+	tests []*sieveTest
+	line  int
+}
+
+// sieveCommand is a command
+type sieveCommand struct {
+	name  string
+	args  []sieveArg
+	tests []*sieveTest
+	block []*sieveCommand
+	line  int
+}
+
+// sieveScript is a parsed script
+type sieveScript struct {
+	commands []*sieveCommand
+	require  []string
+}
+
+// tagged arguments (tag -> kind of value: "" none, num, str or list)
+var (
+	sieveMatchTags   = map[string]string{":comparator": "str", ":is": "", ":contains": "", ":matches": ""}
+	sieveAddressTags = map[string]string{":comparator": "str", ":is": "", ":contains": "", ":matches": "", ":all": "", ":localpart": "", ":domain": ""}
+	sieveSizeTags    = map[string]string{":over": "", ":under": ""}
+	sieveVacTags     = map[string]string{":days": "num", ":subject": "str", ":from": "str", ":addresses": "list", ":mime": "", ":handle": "str"}
+)
+
+// sieveError returns an error at line
+func sieveError(line int, msg string) error {
+	return fmt.Errorf("line %d: %s", line, msg)
+}
+
+// sieveIsIdentChar returns true if c can be in an identifier
+func sieveIsIdentChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+// sieveLex splits script in tokens
+func sieveLex(script string) ([]sieveToken, error) {
+	tokens := []sieveToken{}
+	line := 1
+	for i := 0; i < len(script); {
+		c := script[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(script) && script[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(script) && script[i+1] == '*':
+			end := strings.Index(script[i+2:], "*/")
+			if end == -1 {
+				return nil, sieveError(line, "unterminated comment")
+			}
+			line += strings.Count(script[i:i+2+end], "\n")
+			i += end + 4
+		case strings.IndexByte("[](),;{}", c) != -1:
+			tokens = append(tokens, sieveToken{typ: sieveTokenSpecial, value: string(c), line: line})
+			i++
+		case c == '"':
+			start := line
+			value := []byte{}
+			for i++; ; i++ {
+				if i >= len(script) {
+					return nil, sieveError(start, "unterminated string")
+				}
+				c = script[i]
+				if c == '"' {
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(script) {
+					i++
+					c = script[i]
+				}
+				if c == '\n' {
+					line++
+				}
+				value = append(value, c)
+			}
+			tokens = append(tokens, sieveToken{typ: sieveTokenString, value: string(value), line: start})
+		case c == ':':
+			j := i + 1
+			for j < len(script) && sieveIsIdentChar(script[j], j == i+1) {
+				j++
+			}
+			if j == i+1 {
+				return nil, sieveError(line, "bad tag")
+			}
+			tokens = append(tokens, sieveToken{typ: sieveTokenTag, value: strings.ToLower(script[i:j]), line: line})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(script) && script[j] >= '0' && script[j] <= '9' {
+				j++
+			}
+			n, err := strconv.ParseInt(script[i:j], 10, 64)
+			if err != nil {
+				return nil, sieveError(line, "bad number "+script[i:j])
+			}
+			if j < len(script) {
+				switch script[j] {
+				case 'K', 'k':
+					n, j = n<<10, j+1
+				case 'M', 'm':
+					n, j = n<<20, j+1
+				case 'G', 'g':
+					n, j = n<<30, j+1
+				}
+			}
+			tokens = append(tokens, sieveToken{typ: sieveTokenNumber, num: n, line: line})
+			i = j
+		case sieveIsIdentChar(c, true):
+			j := i
+			for j < len(script) && sieveIsIdentChar(script[j], j == i) {
+				j++
+			}
+			identifier := strings.ToLower(script[i:j])
+			if identifier != "text" || j >= len(script) || script[j] != ':' {
+				tokens = append(tokens, sieveToken{typ: sieveTokenIdentifier, value: identifier, line: line})
+				i = j
+				continue
+			}
+			// multi-line string: text: CRLF lines CRLF . CRLF
+			start := line
+			eol := strings.IndexByte(script[j:], '\n')
+			if eol == -1 {
+				return nil, sieveError(start, "unterminated multi-line string")
+			}
+			if rest := strings.TrimSpace(script[j+1 : j+eol]); rest != "" && !strings.HasPrefix(rest, "#") {
+				return nil, sieveError(start, "bad multi-line string")
+			}
+			i = j + eol + 1
+			line++
+			value := ""
+			for {
+				if i >= len(script) {
+					return nil, sieveError(start, "unterminated multi-line string")
+				}
+				var l string
+				if eol = strings.IndexByte(script[i:], '\n'); eol == -1 {
+					l, i = script[i:], len(script)
+				} else {
+					l, i = script[i:i+eol], i+eol+1
+				}
+				line++
+				l = strings.TrimSuffix(l, "\r")
+				if l == "." {
+					break
+				}
+				// dot-stuffing
+				if strings.HasPrefix(l, "..") {
+					l = l[1:]
+				}
+				value += l + "\r\n"
+			}
+			tokens = append(tokens, sieveToken{typ: sieveTokenString, value: value, line: start})
+		default:
+			return nil, sieveError(line, fmt.Sprintf("unexpected character %q", c))
+		}
+	}
+	return append(tokens, sieveToken{typ: sieveTokenEOF, line: line}), nil
+}
+
+// sieveParser parses tokens of a script
+type sieveParser struct {
+	tokens []sieveToken
+	pos    int
+}
+
+// peek returns next token
+func (p *sieveParser) peek() sieveToken {
+	return p.tokens[p.pos]
+}
+
+// next returns and consumes next token
+func (p *sieveParser) next() sieveToken {
+	t := p.tokens[p.pos]
+	if t.typ != sieveTokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// isSpecial returns true if next token is special character value
+func (p *sieveParser) isSpecial(value string) bool {
+	t := p.peek()
+	return t.typ == sieveTokenSpecial && t.value == value
+}
+
+// commands parses commands until end of block (or of script)
+func (p *sieveParser) commands(inBlock bool) ([]*sieveCommand, error) {
+	cmds := []*sieveCommand{}
+	for {
+		t := p.peek()
+		switch {
+		case t.typ == sieveTokenEOF:
+			if inBlock {
+				return nil, sieveError(t.line, "missing }")
+			}
+			return cmds, nil
+		case p.isSpecial("}"):
+			if !inBlock {
+				return nil, sieveError(t.line, "unexpected }")
+			}
+			p.next()
+			return cmds, nil
+		case t.typ != sieveTokenIdentifier:
+			return nil, sieveError(t.line, "command expected")
+		}
+		p.next()
+		cmd := &sieveCommand{name: t.value, line: t.line}
+		var err error
+		if cmd.args, cmd.tests, err = p.arguments(); err != nil {
+			return nil, err
+		}
+		switch {
+		case p.isSpecial(";"):
+			p.next()
+		case p.isSpecial("{"):
+			p.next()
+			if cmd.block, err = p.commands(true); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, sieveError(p.peek().line, "; or { expected after "+cmd.name)
+		}
+		cmds = append(cmds, cmd)
+	}
+}
+
+// arguments parses arguments then test or test list
+func (p *sieveParser) arguments() (args []sieveArg, tests []*sieveTest, err error) {
+	for {
+		t := p.peek()
+		switch {
+		case t.typ == sieveTokenTag:
+			args = append(args, sieveArg{tag: t.value, line: t.line})
+		case t.typ == sieveTokenNumber:
+			args = append(args, sieveArg{num: t.num, isNum: true, line: t.line})
+		case t.typ == sieveTokenString:
+			args = append(args, sieveArg{strs: []string{t.value}, line: t.line})
+		case p.isSpecial("["):
+			p.next()
+			arg := sieveArg{isList: true, line: t.line}
+			for {
+				s := p.next()
+				if s.typ != sieveTokenString {
+					return nil, nil, sieveError(s.line, "string expected in list")
+				}
+				arg.strs = append(arg.strs, s.value)
+				if p.isSpecial("]") {
+					break
+				}
+				if !p.isSpecial(",") {
+					return nil, nil, sieveError(p.peek().line, ", or ] expected in list")
+				}
+				p.next()
+			}
+			args = append(args, arg)
+		case t.typ == sieveTokenIdentifier:
+			test, err := p.test()
+			if err != nil {
+				return nil, nil, err
+			}
+			return args, []*sieveTest{test}, nil
+		case p.isSpecial("("):
+			p.next()
+			for {
+				if p.peek().typ != sieveTokenIdentifier {
+					return nil, nil, sieveError(p.peek().line, "test expected")
+				}
+				test, err := p.test()
+				if err != nil {
+					return nil, nil, err
+				}
+				tests = append(tests, test)
+				if p.isSpecial(")") {
+					p.next()
+					return args, tests, nil
+				}
+				if !p.isSpecial(",") {
+					return nil, nil, sieveError(p.peek().line, ", or ) expected in test list")
+				}
+				p.next()
+			}
+		default:
+			return args, nil, nil
+		}
+		p.next()
+	}
+}
+
+// test parses a test
+func (p *sieveParser) test() (*sieveTest, error) {
+	t := p.next()
+	test := &sieveTest{name: t.value, line: t.line}
+	var err error
+	test.args, test.tests, err = p.arguments()
+	return test, err
+}
+
+// sieveTagged separates tagged arguments of tags from positional
+// arguments
+func sieveTagged(args []sieveArg, tags map[string]string) (tagged map[string]sieveArg, positional []sieveArg, err error) {
+	tagged = make(map[string]sieveArg)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg.tag == "" {
+			positional = append(positional, arg)
+			continue
+		}
+		kind, ok := tags[arg.tag]
+		if !ok {
+			return nil, nil, sieveError(arg.line, "unexpected tag "+arg.tag)
+		}
+		if _, ok = tagged[arg.tag]; ok {
+			return nil, nil, sieveError(arg.line, "duplicate tag "+arg.tag)
+		}
+		value := arg
+		if kind != "" {
+			i++
+			if i == len(args) || args[i].tag != "" || (kind == "num") != args[i].isNum || (kind == "str" && args[i].isList) {
+				return nil, nil, sieveError(arg.line, "bad value of "+arg.tag)
+			}
+			value = args[i]
+		}
+		tagged[arg.tag] = value
+	}
+	return
+}
+
+// sieveMatch is the comparator, match type & address part of a test
+type sieveMatch struct {
+	comparator  string
+	matchType   string
+	addressPart string
+}
+
+// sieveMatchOptions returns match options of tagged arguments
+func sieveMatchOptions(tagged map[string]sieveArg, line int) (m sieveMatch, err error) {
+	m = sieveMatch{"i;ascii-casemap", ":is", ":all"}
+	for _, group := range [][]string{{":is", ":contains", ":matches"}, {":all", ":localpart", ":domain"}} {
+		found := 0
+		for _, tag := range group {
+			if _, ok := tagged[tag]; ok {
+				found++
+				if group[0] == ":is" {
+					m.matchType = tag
+				} else {
+					m.addressPart = tag
+				}
+			}
+		}
+		if found > 1 {
+			return m, sieveError(line, "only one of "+strings.Join(group, ", ")+" can be used")
+		}
+	}
+	if c, ok := tagged[":comparator"]; ok {
+		m.comparator = strings.ToLower(c.strs[0])
+		if m.comparator != "i;ascii-casemap" && m.comparator != "i;octet" {
+			return m, sieveError(line, "unsupported comparator "+m.comparator)
+		}
+	}
+	return
+}
+
+// sieveStrings checks that positional arguments are n strings (or string
+// lists: list is true)
+func sieveStrings(positional []sieveArg, n int, list bool, line int, name string) error {
+	if len(positional) != n {
+		return sieveError(line, fmt.Sprintf("%s expects %d argument(s)", name, n))
+	}
+	for _, arg := range positional {
+		if arg.isNum || (arg.isList && !list) {
+			return sieveError(arg.line, "bad argument of "+name)
+		}
+	}
+	return nil
+}
+
+// sieveCompile parses & checks script
+func sieveCompile(script string) (*sieveScript, error) {
+	tokens, err := sieveLex(script)
+	if err != nil {
+		return nil, err
+	}
+	p := &sieveParser{tokens: tokens}
+	s := &sieveScript{}
+	if s.commands, err = p.commands(false); err != nil {
+		return nil, err
+	}
+	return s, s.check(s.commands, true)
+}
+
+// required returns an error if extension is not required
+func (s *sieveScript) required(extension string, line int) error {
+	if !IsStringInSlice(extension, s.require) {
+		return sieveError(line, "missing require \""+extension+"\"")
+	}
+	return nil
+}
+
+// check checks commands
+func (s *sieveScript) check(cmds []*sieveCommand, top bool) error {
+	for i, cmd := range cmds {
+		prev := ""
+		if i > 0 {
+			prev = cmds[i-1].name
+		}
+		switch cmd.name {
+		case "if", "elsif", "else":
+			if cmd.name != "if" && prev != "if" && prev != "elsif" {
+				return sieveError(cmd.line, cmd.name+" without if")
+			}
+			if len(cmd.args) != 0 || (cmd.name == "else") != (len(cmd.tests) == 0) || (cmd.name != "else" && len(cmd.tests) != 1) {
+				return sieveError(cmd.line, "bad arguments of "+cmd.name)
+			}
+			if cmd.block == nil {
+				return sieveError(cmd.line, "block expected after "+cmd.name)
+			}
+			for _, t := range cmd.tests {
+				if err := s.checkTest(t); err != nil {
+					return err
+				}
+			}
+			if err := s.check(cmd.block, false); err != nil {
+				return err
+			}
+			continue
+		}
+		if cmd.block != nil || len(cmd.tests) != 0 {
+			return sieveError(cmd.line, "unexpected block or test after "+cmd.name)
+		}
+		switch cmd.name {
+		case "require":
+			if !top || (i > 0 && prev != "require") {
+				return sieveError(cmd.line, "require must be at the beginning of script")
+			}
+			if err := sieveStrings(cmd.args, 1, true, cmd.line, cmd.name); err != nil {
+				return err
+			}
+			for _, ext := range cmd.args[0].strs {
+				ext = strings.ToLower(ext)
+				if !IsStringInSlice(ext, sieveExtensions) {
+					return sieveError(cmd.line, "unsupported extension "+ext)
+				}
+				s.require = append(s.require, ext)
+			}
+		case "stop", "keep", "discard":
+			if len(cmd.args) != 0 {
+				return sieveError(cmd.line, cmd.name+" expects no argument")
+			}
+		case "fileinto", "redirect":
+			if cmd.name == "fileinto" {
+				if err := s.required("fileinto", cmd.line); err != nil {
+					return err
+				}
+			}
+			if err := sieveStrings(cmd.args, 1, false, cmd.line, cmd.name); err != nil {
+				return err
+			}
+		case "vacation":
+			if err := s.required("vacation", cmd.line); err != nil {
+				return err
+			}
+			_, positional, err := sieveTagged(cmd.args, sieveVacTags)
+			if err != nil {
+				return err
+			}
+			if err = sieveStrings(positional, 1, false, cmd.line, cmd.name); err != nil {
+				return err
+			}
+		default:
+			return sieveError(cmd.line, "unknown command "+cmd.name)
+		}
+	}
+	return nil
+}
+
+// checkTest checks test t
+func (s *sieveScript) checkTest(t *sieveTest) error {
+	switch t.name {
+	case "true", "false":
+		if len(t.args) != 0 || len(t.tests) != 0 {
+			return sieveError(t.line, t.name+" expects no argument")
+		}
+		return nil
+	case "not", "allof", "anyof":
+		if len(t.args) != 0 || len(t.tests) == 0 || (t.name == "not" && len(t.tests) != 1) {
+			return sieveError(t.line, "bad arguments of "+t.name)
+		}
+		for _, sub := range t.tests {
+			if err := s.checkTest(sub); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(t.tests) != 0 {
+		return sieveError(t.line, "unexpected test in "+t.name)
+	}
+	switch t.name {
+	case "exists":
+		return sieveStrings(t.args, 1, true, t.line, t.name)
+	case "size":
+		tagged, positional, err := sieveTagged(t.args, sieveSizeTags)
+		if err != nil {
+			return err
+		}
+		if len(tagged) != 1 || len(positional) != 1 || !positional[0].isNum {
+			return sieveError(t.line, "size expects :over or :under and a number")
+		}
+		return nil
+	case "header", "address", "envelope":
+		tags := sieveAddressTags
+		if t.name == "header" {
+			tags = sieveMatchTags
+		}
+		if t.name == "envelope" {
+			if err := s.required("envelope", t.line); err != nil {
+				return err
+			}
+		}
+		tagged, positional, err := sieveTagged(t.args, tags)
+		if err != nil {
+			return err
+		}
+		if _, err = sieveMatchOptions(tagged, t.line); err != nil {
+			return err
+		}
+		if err = sieveStrings(positional, 2, true, t.line, t.name); err != nil {
+			return err
+		}
+		if t.name == "envelope" {
+			for _, part := range positional[0].strs {
+				if part = strings.ToLower(part); part != "from" && part != "to" {
+					return sieveError(t.line, "unsupported envelope part "+part)
+				}
+			}
+		}
+		return nil
+	}
+	return sieveError(t.line, "unknown test "+t.name)
+}
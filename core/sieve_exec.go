@@ -0,0 +1,429 @@
+package core
+
+// Sieve interpreter
+// Script of the user is run at local delivery. Actions: keep (INBOX),
+// fileinto folders (Maildir++ folders with the maildir driver, -m of
+// dovecot-lda, INBOX with LMTP), redirect (queued, at most
+// sieveMaxRedirects, not for messages already redirected by this user),
+// discard and vacation. If script fails message is kept (implicit keep).
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+
+	"github.com/toorop/tmail/message"
+)
+
+// maximum number of redirect actions of a script
+const sieveMaxRedirects = 10
+
+// header added to messages redirected by a script
+const sieveRedirectHeader = "X-Tmail-Sieve-Redirected"
+
+// sieveMessage is a message tested by a script
+type sieveMessage struct {
+	mailFrom string
+	rcptTo   string
+	size     int64
+	headers  map[string][]string // lower case name -> decoded values
+}
+
+// sieveVacation is a vacation action
+type sieveVacation struct {
+	days      int
+	subject   string
+	from      string
+	handle    string
+	reason    string
+	mime      bool
+	addresses []string
+}
+
+// sieveActions are actions of a script
+type sieveActions struct {
+	implicitKeep bool
+	folders      []string // "INBOX" for keep
+	redirects    []string
+	vacation     *sieveVacation
+}
+
+// newSieveMessage returns raw message as tested by scripts
+func newSieveMessage(raw *[]byte, mailFrom, rcptTo string) *sieveMessage {
+	msg := &sieveMessage{
+		mailFrom: mailFrom,
+		rcptTo:   rcptTo,
+		size:     int64(len(*raw)),
+		headers:  make(map[string][]string),
+	}
+	decoder := new(mime.WordDecoder)
+	for _, field := range message.RawGetHeaderFields(raw) {
+		p := strings.Index(field, ":")
+		if p == -1 {
+			continue
+		}
+		value := strings.TrimSpace(strings.Replace(field[p+1:], "\r\n", "", -1))
+		if decoded, err := decoder.DecodeHeader(value); err == nil {
+			value = decoded
+		}
+		name := strings.ToLower(strings.TrimSpace(field[:p]))
+		msg.headers[name] = append(msg.headers[name], value)
+	}
+	return msg
+}
+
+// run runs script on msg
+func (s *sieveScript) run(msg *sieveMessage) (*sieveActions, error) {
+	actions := &sieveActions{implicitKeep: true}
+	if _, err := s.exec(s.commands, msg, actions); err != nil {
+		return nil, err
+	}
+	if actions.implicitKeep && !IsStringInSlice("INBOX", actions.folders) {
+		actions.folders = append(actions.folders, "INBOX")
+	}
+	return actions, nil
+}
+
+// exec runs commands, it returns true on stop
+func (s *sieveScript) exec(cmds []*sieveCommand, msg *sieveMessage, actions *sieveActions) (bool, error) {
+	// a branch of current if has been taken
+	taken := false
+	for _, cmd := range cmds {
+		switch cmd.name {
+		case "if", "elsif", "else":
+			if cmd.name == "if" {
+				taken = false
+			}
+			if taken {
+				continue
+			}
+			ok := true
+			if cmd.name != "else" {
+				var err error
+				if ok, err = s.test(cmd.tests[0], msg); err != nil {
+					return false, err
+				}
+			}
+			if !ok {
+				continue
+			}
+			taken = true
+			if stop, err := s.exec(cmd.block, msg, actions); stop || err != nil {
+				return stop, err
+			}
+		case "stop":
+			return true, nil
+		case "keep":
+			actions.implicitKeep = false
+			if !IsStringInSlice("INBOX", actions.folders) {
+				actions.folders = append(actions.folders, "INBOX")
+			}
+		case "discard":
+			actions.implicitKeep = false
+		case "fileinto":
+			folder, err := sieveFolder(cmd.args[0].strs[0])
+			if err != nil {
+				return false, sieveError(cmd.line, err.Error())
+			}
+			actions.implicitKeep = false
+			if !IsStringInSlice(folder, actions.folders) {
+				actions.folders = append(actions.folders, folder)
+			}
+		case "redirect":
+			a, err := mail.ParseAddress(cmd.args[0].strs[0])
+			if err != nil {
+				return false, sieveError(cmd.line, "bad redirect address "+cmd.args[0].strs[0])
+			}
+			actions.implicitKeep = false
+			if IsStringInSlice(a.Address, actions.redirects) {
+				continue
+			}
+			if len(actions.redirects) == sieveMaxRedirects {
+				return false, sieveError(cmd.line, fmt.Sprintf("more than %d redirects", sieveMaxRedirects))
+			}
+			actions.redirects = append(actions.redirects, a.Address)
+		case "vacation":
+			if actions.vacation != nil {
+				return false, sieveError(cmd.line, "duplicate vacation")
+			}
+			tagged, positional, _ := sieveTagged(cmd.args, sieveVacTags)
+			v := &sieveVacation{days: 7, reason: positional[0].strs[0]}
+			if days, ok := tagged[":days"]; ok && days.num > 0 {
+				v.days = int(days.num)
+			}
+			if subject, ok := tagged[":subject"]; ok {
+				v.subject = subject.strs[0]
+			}
+			if from, ok := tagged[":from"]; ok {
+				v.from = from.strs[0]
+			}
+			if addresses, ok := tagged[":addresses"]; ok {
+				v.addresses = addresses.strs
+			}
+			_, v.mime = tagged[":mime"]
+			if handle, ok := tagged[":handle"]; ok {
+				v.handle = handle.strs[0]
+			} else {
+				sum := sha256.Sum256([]byte(v.subject + "\x00" + v.from + "\x00" + v.reason))
+				v.handle = hex.EncodeToString(sum[:8])
+			}
+			actions.vacation = v
+		}
+	}
+	return false, nil
+}
+
+// test evaluates test t on msg
+func (s *sieveScript) test(t *sieveTest, msg *sieveMessage) (bool, error) {
+	switch t.name {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "not":
+		ok, err := s.test(t.tests[0], msg)
+		return !ok, err
+	case "allof", "anyof":
+		for _, sub := range t.tests {
+			ok, err := s.test(sub, msg)
+			if err != nil {
+				return false, err
+			}
+			if ok == (t.name == "anyof") {
+				return ok, nil
+			}
+		}
+		return t.name == "allof", nil
+	case "exists":
+		for _, name := range t.args[0].strs {
+			if len(msg.headers[strings.ToLower(name)]) == 0 {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "size":
+		tagged, positional, _ := sieveTagged(t.args, sieveSizeTags)
+		if _, over := tagged[":over"]; over {
+			return msg.size > positional[0].num, nil
+		}
+		return msg.size < positional[0].num, nil
+	}
+
+	// header, address & envelope
+	tags := sieveAddressTags
+	if t.name == "header" {
+		tags = sieveMatchTags
+	}
+	tagged, positional, _ := sieveTagged(t.args, tags)
+	m, _ := sieveMatchOptions(tagged, t.line)
+	values := []string{}
+	for _, name := range positional[0].strs {
+		name = strings.ToLower(name)
+		switch t.name {
+		case "header":
+			values = append(values, msg.headers[name]...)
+		case "address":
+			for _, h := range msg.headers[name] {
+				addresses, err := mail.ParseAddressList(h)
+				if err != nil {
+					values = append(values, sieveAddressPart(h, m.addressPart))
+					continue
+				}
+				for _, a := range addresses {
+					values = append(values, sieveAddressPart(a.Address, m.addressPart))
+				}
+			}
+		case "envelope":
+			if name == "from" {
+				values = append(values, sieveAddressPart(msg.mailFrom, m.addressPart))
+			} else {
+				values = append(values, sieveAddressPart(msg.rcptTo, m.addressPart))
+			}
+		}
+	}
+	for _, value := range values {
+		for _, key := range positional[1].strs {
+			if sieveMatchValue(m, value, key) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// sieveAddressPart returns part (:all, :localpart or :domain) of address
+func sieveAddressPart(address, part string) string {
+	p := strings.LastIndex(address, "@")
+	switch {
+	case part == ":localpart" && p != -1:
+		return address[:p]
+	case part == ":domain":
+		return address[p+1:]
+	}
+	return address
+}
+
+// sieveASCIILower lower cases ASCII letters of s (i;ascii-casemap)
+func sieveASCIILower(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
+
+// sieveMatchValue returns true if value matches key
+func sieveMatchValue(m sieveMatch, value, key string) bool {
+	if m.comparator == "i;ascii-casemap" {
+		value, key = sieveASCIILower(value), sieveASCIILower(key)
+	}
+	switch m.matchType {
+	case ":contains":
+		return strings.Contains(value, key)
+	case ":matches":
+		return sieveGlob(value, key)
+	}
+	return value == key
+}
+
+// sieveGlob returns true if value matches pattern (* any sequence, ? any
+// character, \ escapes)
+func sieveGlob(value, pattern string) bool {
+	type globToken struct {
+		kind rune // 0 (literal), * or ?
+		r    rune
+	}
+	tokens := []globToken{}
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			tokens, escaped = append(tokens, globToken{0, r}), false
+		case r == '\\':
+			escaped = true
+		case r == '*' || r == '?':
+			tokens = append(tokens, globToken{r, r})
+		default:
+			tokens = append(tokens, globToken{0, r})
+		}
+	}
+	v := []rune(value)
+	vi, ti, starTi, starVi := 0, 0, -1, 0
+	for vi < len(v) {
+		switch {
+		case ti < len(tokens) && (tokens[ti].kind == '?' || (tokens[ti].kind == 0 && tokens[ti].r == v[vi])):
+			vi++
+			ti++
+		case ti < len(tokens) && tokens[ti].kind == '*':
+			starTi, starVi = ti, vi
+			ti++
+		case starTi != -1:
+			starVi++
+			ti, vi = starTi+1, starVi
+		default:
+			return false
+		}
+	}
+	for ti < len(tokens) && tokens[ti].kind == '*' {
+		ti++
+	}
+	return ti == len(tokens)
+}
+
+// sieveFolder returns checked folder name ("INBOX" for inbox)
+func sieveFolder(folder string) (string, error) {
+	folder = strings.Trim(strings.TrimSpace(folder), "/")
+	if folder == "" || strings.EqualFold(folder, "INBOX") {
+		return "INBOX", nil
+	}
+	for _, part := range strings.Split(folder, "/") {
+		if part == "" || strings.HasPrefix(part, ".") || strings.ContainsAny(part, "\x00\r\n") {
+			return "", errors.New("bad folder name " + folder)
+		}
+	}
+	return folder, nil
+}
+
+// sieveDeliver runs active script of user on message of delivery d, it
+// queues redirects and vacation response and returns folders where message
+// has to be delivered ("" for INBOX). replied is true if script has a
+// vacation action, if stop is true delivery is over.
+// Redirects and vacation response are recorded on the queued message, they
+// are not queued again if delivery is retried.
+func sieveDeliver(d *delivery, user *User) (folders []string, replied, stop bool) {
+	folders = []string{""}
+	script, err := sieveActiveScript(user.Login)
+	if err != nil {
+		d.dieTemp(fmt.Sprintf("delivery-local %s: unable to get sieve script of %s: %s", d.id, user.Login, err), true)
+		return nil, false, true
+	}
+	if script == nil {
+		return
+	}
+	msg := newSieveMessage(d.rawData, d.qMsg.MailFrom, d.qMsg.RcptTo)
+	s, err := sieveCompile(script.Content)
+	var actions *sieveActions
+	if err == nil {
+		actions, err = s.run(msg)
+	}
+	if err != nil {
+		d.log.Error(fmt.Sprintf("delivery-local %s: sieve script %s of %s failed, message is kept: %s", d.id, script.Name, user.Login, err))
+		return
+	}
+
+	// redirects (not twice by the same user)
+	if len(actions.redirects) != 0 {
+		redirectedBy := fmt.Sprintf("%s: %s", sieveRedirectHeader, user.Login)
+		if strings.Contains(string(message.RawGetHeaders(d.rawData)), redirectedBy) {
+			d.log.Info(fmt.Sprintf("delivery-local %s: message already redirected by %s, sieve redirects ignored", d.id, user.Login))
+			if len(actions.folders) == 0 {
+				actions.folders = []string{"INBOX"}
+			}
+		} else {
+			raw := append([]byte(redirectedBy+"\r\n"), *d.rawData...)
+			for _, rcpt := range actions.redirects {
+				if d.localActionDone("redirect " + rcpt) {
+					continue
+				}
+				uuid, err := QueueAddMessage(&raw, message.Envelope{MailFrom: d.qMsg.MailFrom, RcptTo: []string{rcpt}}, "")
+				if err != nil {
+					d.dieTemp(fmt.Sprintf("delivery-local %s: unable to queue sieve redirect to %s: %s", d.id, rcpt, err), true)
+					return nil, false, true
+				}
+				d.log.Info(fmt.Sprintf("delivery-local %s: sieve script of %s redirects message to %s, queued as %s", d.id, user.Login, rcpt, uuid))
+				d.localActionRecord("redirect " + rcpt)
+			}
+		}
+	}
+
+	// vacation
+	if actions.vacation != nil {
+		replied = true
+	}
+	if replied && !d.localActionDone("vacation") {
+		if err = vacationRespond(d, user, msg, actions.vacation); err != nil {
+			d.log.Error(fmt.Sprintf("delivery-local %s: unable to send vacation response of %s: %s", d.id, user.Login, err))
+		} else {
+			d.localActionRecord("vacation")
+		}
+	}
+
+	if len(actions.folders) == 0 {
+		d.log.Info(fmt.Sprintf("delivery-local %s: message discarded by sieve script of %s", d.id, user.Login))
+		d.dieOk()
+		return nil, replied, true
+	}
+	folders = []string{}
+	for _, folder := range actions.folders {
+		if folder == "INBOX" {
+			folder = ""
+		}
+		folders = append(folders, folder)
+	}
+	return folders, replied, false
+}
@@ -0,0 +1,189 @@
+package core
+
+// Sieve scripts of users
+// A user can have several scripts, only the active one is run at delivery.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// SieveScript is a sieve script of a user
+type SieveScript struct {
+	Id        int64
+	Login     string
+	Name      string
+	Content   string `sql:"type:text;"`
+	Active    bool
+	UpdatedAt time.Time
+}
+
+// SieveVacationLog records vacation responses (sieve actions & mailbox
+// vacations) sent to a sender
+type SieveVacationLog struct {
+	Id     int64
+	Login  string
+	Handle string
+	Sender string
+	SentAt time.Time
+}
+
+// sieveCheckName checks name of a script
+func sieveCheckName(name string) error {
+	if name == "" || len(name) > 128 || strings.ContainsAny(name, "/\\\x00\r\n") {
+		return errors.New("bad script name " + name)
+	}
+	return nil
+}
+
+// sieveUserLogin returns login of user, error if user doesn't exist
+func sieveUserLogin(login string) (string, error) {
+	login = strings.ToLower(strings.TrimSpace(login))
+	exists, err := UserExists(login)
+	if err != nil {
+		return login, err
+	}
+	if !exists {
+		return login, errors.New("no such user " + login)
+	}
+	return login, nil
+}
+
+// SieveScriptCheck returns an error if content is not a valid script
+func SieveScriptCheck(content string) error {
+	if max := Cfg.GetSieveMaxScriptSize(); max != 0 && len(content) > max {
+		return fmt.Errorf("script is too big (%d bytes, max %d)", len(content), max)
+	}
+	_, err := sieveCompile(content)
+	return err
+}
+
+// SieveScriptPut adds or replaces script name of user login
+func SieveScriptPut(login, name, content string) (script SieveScript, err error) {
+	if login, err = sieveUserLogin(login); err != nil {
+		return
+	}
+	if err = sieveCheckName(name); err != nil {
+		return
+	}
+	if err = SieveScriptCheck(content); err != nil {
+		return
+	}
+	script, err = SieveScriptGet(login, name)
+	if err != nil && err != gorm.RecordNotFound {
+		return
+	}
+	script.Login, script.Name, script.Content = login, name, content
+	script.UpdatedAt = time.Now()
+	err = DB.Save(&script).Error
+	return
+}
+
+// SieveScriptGet returns script name of user login
+func SieveScriptGet(login, name string) (script SieveScript, err error) {
+	err = DB.Where("login = ? and name = ?", strings.ToLower(login), name).First(&script).Error
+	return
+}
+
+// SieveScriptList returns scripts of user login
+func SieveScriptList(login string) (scripts []SieveScript, err error) {
+	scripts = []SieveScript{}
+	err = DB.Where("login = ?", strings.ToLower(login)).Order("name").Find(&scripts).Error
+	return
+}
+
+// SieveScriptDel removes script name of user login
+// active script can't be removed
+func SieveScriptDel(login, name string) error {
+	script, err := SieveScriptGet(login, name)
+	if err != nil {
+		return err
+	}
+	if script.Active {
+		return errors.New("script " + name + " is active")
+	}
+	return DB.Delete(&script).Error
+}
+
+// SieveScriptActivate activates script name of user login, if name is empty
+// all scripts of user are deactivated
+func SieveScriptActivate(login, name string) error {
+	login = strings.ToLower(login)
+	if name != "" {
+		if _, err := SieveScriptGet(login, name); err != nil {
+			return err
+		}
+	}
+	tx := DB.Begin()
+	if err := tx.Model(&SieveScript{}).Where("login = ? and active = ?", login, true).Update("active", false).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if name != "" {
+		if err := tx.Model(&SieveScript{}).Where("login = ? and name = ?", login, name).Update("active", true).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// SieveScriptRename renames script oldName of user login
+func SieveScriptRename(login, oldName, newName string) error {
+	if err := sieveCheckName(newName); err != nil {
+		return err
+	}
+	script, err := SieveScriptGet(login, oldName)
+	if err != nil {
+		return err
+	}
+	if _, err = SieveScriptGet(login, newName); err != gorm.RecordNotFound {
+		if err == nil {
+			err = errors.New("script " + newName + " already exists")
+		}
+		return err
+	}
+	script.Name = newName
+	script.UpdatedAt = time.Now()
+	return DB.Save(&script).Error
+}
+
+// sieveActiveScript returns active script of user login (nil if none)
+func sieveActiveScript(login string) (*SieveScript, error) {
+	script := SieveScript{}
+	err := DB.Where("login = ? and active = ?", strings.ToLower(login), true).First(&script).Error
+	if err == gorm.RecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &script, nil
+}
+
+// sieveVacationSent returns true if vacation response handle of login has
+// been sent to sender in the last period
+func sieveVacationSent(login, handle, sender string, period time.Duration) (bool, error) {
+	l := SieveVacationLog{}
+	err := DB.Where("login = ? and handle = ? and sender = ? and sent_at > ?", login, handle, sender, time.Now().Add(-period)).First(&l).Error
+	if err == gorm.RecordNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// sieveVacationRecord records vacation response handle of login sent to
+// sender
+func sieveVacationRecord(login, handle, sender string) error {
+	l := SieveVacationLog{}
+	err := DB.Where("login = ? and handle = ? and sender = ?", login, handle, sender).First(&l).Error
+	if err != nil && err != gorm.RecordNotFound {
+		return err
+	}
+	l.Login, l.Handle, l.Sender, l.SentAt = login, handle, sender, time.Now()
+	return DB.Save(&l).Error
+}
@@ -0,0 +1,172 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sieveTestMessage returns a message from alice to bob
+func sieveTestMessage() *sieveMessage {
+	raw := []byte("From: Alice <alice@example.com>\r\nTo: bob@example.net\r\nSubject: =?utf-8?q?Caf=C3=A9?= meeting\r\nX-Spam-Flag: YES\r\n\r\nHello\r\n")
+	return newSieveMessage(&raw, "alice@example.com", "bob@example.net")
+}
+
+// sieveTestRun compiles and runs script on msg
+func sieveTestRun(t *testing.T, script string, msg *sieveMessage) *sieveActions {
+	s, err := sieveCompile(script)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	actions, err := s.run(msg)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return actions
+}
+
+func TestSieveCompileErrors(t *testing.T) {
+	for script, msg := range map[string]string{
+		`fileinto "Junk";`:                           "missing require",
+		`require "imap4flags";`:                      "imap4flags",
+		`if true { keep; `:                           "",
+		`keep`:                                       "",
+		`if header :is "subject" { keep; }`:          "",
+		`"unterminated`:                              "",
+		`if size :over { keep; }`:                    "",
+		`require "vacation"; vacation :days "x" "";`: "",
+		`redirect;`:                                  "",
+		`elsif true { keep; }`:                       "",
+	} {
+		_, err := sieveCompile(script)
+		if assert.Error(t, err, script) && msg != "" {
+			assert.Contains(t, err.Error(), msg, script)
+		}
+	}
+}
+
+func TestSieveCompile(t *testing.T) {
+	scripts := []string{
+		"",
+		"# comment\r\nkeep;",
+		"/* multi\r\nline */ discard;",
+		`require ["fileinto", "envelope"]; if envelope :domain :is "from" "example.com" { fileinto "Friends"; stop; }`,
+		"require \"vacation\";\r\nvacation :days 3 :subject \"Away\" text:\r\nI am away.\r\n..dot stuffed\r\n.\r\n;",
+		`if anyof (not exists "x-foo", size :under 10K) { keep; } elsif true { discard; } else { keep; }`,
+		`if header :comparator "i;octet" :matches "subject" "Caf? *" { keep; }`,
+	}
+	for _, script := range scripts {
+		_, err := sieveCompile(script)
+		assert.NoError(t, err, script)
+	}
+}
+
+func TestSieveImplicitKeep(t *testing.T) {
+	actions := sieveTestRun(t, ``, sieveTestMessage())
+	assert.Equal(t, []string{"INBOX"}, actions.folders)
+	assert.Empty(t, actions.redirects)
+	assert.Nil(t, actions.vacation)
+}
+
+func TestSieveFileinto(t *testing.T) {
+	script := `require "fileinto"; if header :contains "x-spam-flag" "yes" { fileinto "Junk"; stop; } fileinto "Other";`
+	actions := sieveTestRun(t, script, sieveTestMessage())
+	assert.Equal(t, []string{"Junk"}, actions.folders)
+
+	_, err := sieveCompile(`require "fileinto"; fileinto "../etc";`)
+	if assert.NoError(t, err) {
+		s, _ := sieveCompile(`require "fileinto"; fileinto "../etc";`)
+		_, err = s.run(sieveTestMessage())
+		assert.Error(t, err)
+	}
+}
+
+func TestSieveDiscardRedirect(t *testing.T) {
+	actions := sieveTestRun(t, `discard;`, sieveTestMessage())
+	assert.Empty(t, actions.folders)
+
+	actions = sieveTestRun(t, `redirect "carol@example.org"; redirect "carol@example.org"; keep;`, sieveTestMessage())
+	assert.Equal(t, []string{"carol@example.org"}, actions.redirects)
+	assert.Equal(t, []string{"INBOX"}, actions.folders)
+
+	script := ""
+	for i := 0; i <= sieveMaxRedirects; i++ {
+		script += `redirect "user` + string(rune('a'+i)) + `@example.org";`
+	}
+	s, err := sieveCompile(script)
+	if assert.NoError(t, err) {
+		_, err = s.run(sieveTestMessage())
+		assert.Error(t, err)
+	}
+}
+
+func TestSieveTests(t *testing.T) {
+	msg := sieveTestMessage()
+	for script, match := range map[string]bool{
+		`if address :domain :is "from" "example.com" { discard; }`:                  true,
+		`if address :localpart :is "from" "bob" { discard; }`:                       false,
+		`if envelope :all :is "to" "bob@example.net" { discard; }`:                  true,
+		`if header :is "subject" "café meeting" { discard; }`:                       true,
+		`if header :comparator "i;octet" :is "subject" "café meeting" { discard; }`: false,
+		`if header :matches "subject" "Caf? *" { discard; }`:                        true,
+		`if exists ["from", "x-none"] { discard; }`:                                 false,
+		`if size :over 10 { discard; }`:                                             true,
+		`if size :under 10 { discard; }`:                                            false,
+		`if allof (true, not false) { discard; }`:                                   true,
+		`if anyof (false, header :contains "to" "nobody") { discard; }`:             false,
+		`if false { keep; } elsif true { discard; }`:                                true,
+	} {
+		actions := sieveTestRun(t, `require "envelope"; `+script, msg)
+		assert.Equal(t, match, len(actions.folders) == 0, script)
+	}
+}
+
+func TestSieveVacation(t *testing.T) {
+	actions := sieveTestRun(t, `require "vacation"; vacation :days 3 :subject "Away" :addresses ["bob@example.org"] "I am away";`, sieveTestMessage())
+	if assert.NotNil(t, actions.vacation) {
+		assert.Equal(t, 3, actions.vacation.days)
+		assert.Equal(t, "Away", actions.vacation.subject)
+		assert.Equal(t, "I am away", actions.vacation.reason)
+		assert.Equal(t, []string{"bob@example.org"}, actions.vacation.addresses)
+		assert.NotEmpty(t, actions.vacation.handle)
+	}
+	assert.Equal(t, []string{"INBOX"}, actions.folders)
+}
+
+func TestSieveGlob(t *testing.T) {
+	for pattern, match := range map[string]bool{
+		"*":       true,
+		"hello*":  true,
+		"h?llo*":  true,
+		"*world":  true,
+		"*o*o*":   true,
+		"hello":   false,
+		"\\*":     false,
+		"*x*":     false,
+		"hello ?": false,
+	} {
+		assert.Equal(t, match, sieveGlob("hello world", pattern), pattern)
+	}
+	assert.True(t, sieveGlob("a*b", "a\\*b"))
+}
+
+func TestSieveFolder(t *testing.T) {
+	for folder, expected := range map[string]string{
+		"":            "INBOX",
+		"inbox":       "INBOX",
+		"Junk":        "Junk",
+		"/Lists/Go/":  "Lists/Go",
+		"../etc":      "",
+		"Lists//Go":   "",
+		"a\r\nb":      "",
+		"Lists/.hide": "",
+	} {
+		f, err := sieveFolder(folder)
+		if expected == "" {
+			assert.Error(t, err, folder)
+			continue
+		}
+		assert.NoError(t, err, folder)
+		assert.Equal(t, expected, f, folder)
+	}
+}
@@ -1,371 +1,242 @@
-// strongly inspired by http://golang.org/src/net/smtp/smtp.go
-
 package core
 
+// SMTP client of deliverd
+// smtpClient binds the smtpx client to tmail: routes, local name, timeouts
+// and monitoring are taken from config & DB.
+
 import (
+	"context"
 	"crypto/tls"
-	"encoding/base64"
 	"errors"
 	"fmt"
-	"io"
-	"math/rand"
 	"net"
 	"net/textproto"
 	"strings"
 	"time"
+
+	"github.com/toorop/tmail/smtpx"
 )
 
 // smtpClient represent an SMTP client
 type smtpClient struct {
-	text    *textproto.Conn
-	route   *Route
-	conn    net.Conn
-	connTLS *tls.Conn
-	// map of supported extensions
-	ext map[string]string
-	// whether the Client is using TLS
-	tls bool
-	// supported auth mechanisms
-	auth []string
+	*smtpx.Client
+	route *Route
 }
 
-// newSMTPClient return a connected SMTP client
-func newSMTPClient(routes *[]Route) (client *smtpClient, err error) {
-	for _, route := range *routes {
-		localIPs := []net.IP{}
-		remoteAddresses := []net.TCPAddr{}
-		// no mix beetween failover and round robin for local IP
-		failover := strings.Count(route.LocalIp.String, "&") != 0
-		roundRobin := strings.Count(route.LocalIp.String, "|") != 0
-		if failover && roundRobin {
-			return nil, fmt.Errorf("failover and round-robin are mixed in route %d for local IP", route.Id)
-		}
+// smtpxOptions returns options of smtpx clients
+func smtpxOptions() smtpx.Options {
+	return smtpx.Options{
+		LocalName:     Cfg.GetMe(),
+		Resolver:      smtpxResolver{},
+		FallbackDelay: time.Duration(Cfg.GetDeliverdHappyEyeballsDelay()) * time.Millisecond,
+		Timeouts:      deliverdTimeouts(),
+		Debug:         Log.Debug,
+	}
+}
 
-		// Contient les IP sous forme de string
-		var sIps []string
+// deliverdTimeouts returns timeouts of remote deliveries: deliverd_timeouts
+// (deliverd_remote_timeout for end of data if not set)
+func deliverdTimeouts() smtpx.Timeouts {
+	timeouts := smtpx.Timeouts{DataTerm: time.Duration(Cfg.GetDeliverdRemoteTimeout()) * time.Second}
+	// checked by scopeInit
+	global, _ := smtpx.ParseTimeouts(Cfg.GetDeliverdTimeouts())
+	return timeouts.Merge(global)
+}
 
-		// On a une seule IP locale
-		if !failover && !roundRobin {
-			sIps = []string{route.LocalIp.String}
-		} else { // multiple locales ips
-			var sep string
-			if failover {
-				sep = "&"
-			} else {
-				sep = "|"
-			}
-			sIps = strings.Split(route.LocalIp.String, sep)
+// smtpxResolver resolves host names with the DNS cache
+type smtpxResolver struct{}
 
-			// if roundRobin we need to shuffle IPs
-			rSIps := make([]string, len(sIps))
-			perm := rand.Perm(len(sIps))
-			for i, v := range perm {
-				rSIps[v] = sIps[i]
-			}
-			sIps = rSIps
-			rSIps = nil
-		}
+// LookupIP implements smtpx.Resolver
+func (smtpxResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return dnsLookupIP(host)
+}
 
-		// IP string to net.IP
-		for _, ipStr := range sIps {
-			ip := net.ParseIP(ipStr)
-			if ip == nil {
-				return nil, errors.New("invalid IP " + ipStr + " found in localIp routes: " + route.LocalIp.String)
-			}
-			localIPs = append(localIPs, ip)
+// smtpxRoutes returns smtpx routes of routes
+func smtpxRoutes(routes *[]Route) ([]smtpx.Route, error) {
+	xroutes := []smtpx.Route{}
+	for _, route := range *routes {
+		xroute := smtpx.Route{
+			ID:         route.Id,
+			RemoteHost: route.RemoteHost,
+			RemotePort: int(route.RemotePort.Int64),
 		}
-
-		// remoteAdresses
-		// Hostname or IP
-		// IP ?
-		ip := net.ParseIP(route.RemoteHost)
-		if ip != nil { // ip
-			remoteAddresses = append(remoteAddresses, net.TCPAddr{
-				IP:   ip,
-				Port: int(route.RemotePort.Int64),
-			})
-			// hostname
-		} else {
-			ips, err := net.LookupIP(route.RemoteHost)
-			// TODO: no such host -> perm failure
-			if err != nil {
-				return nil, err
+		if !smtpx.IsLMTPURI(route.RemoteHost) {
+			family := Cfg.GetDeliverdIpFamily()
+			if route.IpFamily.Valid && route.IpFamily.String != "" {
+				family = route.IpFamily.String
 			}
-			for _, i := range ips {
-				remoteAddresses = append(remoteAddresses, net.TCPAddr{
-					IP:   i,
-					Port: int(route.RemotePort.Int64),
-				})
+			var err error
+			if xroute.Family, err = smtpx.ParseFamily(family); err != nil {
+				return nil, fmt.Errorf("route %d - %s", route.Id, err)
 			}
-		}
-
-		// try routes & returns first OK
-		for _, localIP := range localIPs {
-			for _, remoteAddr := range remoteAddresses {
-				// IPv4 <-> IPv4 or IPv6 <-> IPv6
-				if IsIPV4(localIP.String()) != IsIPV4(remoteAddr.IP.String()) {
-					continue
+			if route.Timeouts.Valid && route.Timeouts.String != "" {
+				if xroute.Timeouts, err = smtpx.ParseTimeouts(route.Timeouts.String); err != nil {
+					return nil, fmt.Errorf("route %d - %s", route.Id, err)
 				}
-				// TODO timeout en config
-				//err, conn := dial(remoteAddr, localIP.String())
-
-				localAddr, err := net.ResolveTCPAddr("tcp", localIP.String()+":0")
-				if err != nil {
-					return nil, errors.New("bad local IP: " + localIP.String() + ". " + err.Error())
+			}
+			// no mix beetween failover and round robin for local IP
+			failover := strings.Count(route.LocalIp.String, "&") != 0
+			roundRobin := strings.Count(route.LocalIp.String, "|") != 0
+			if failover && roundRobin {
+				return nil, fmt.Errorf("failover and round-robin are mixed in route %d for local IP", route.Id)
+			}
+			sep := "&"
+			if roundRobin {
+				sep = "|"
+			}
+			for _, ipStr := range strings.Split(route.LocalIp.String, sep) {
+				ip := net.ParseIP(ipStr)
+				if ip == nil {
+					return nil, errors.New("invalid IP " + ipStr + " found in localIp routes: " + route.LocalIp.String)
 				}
-
-				// Dial timeout
-				connectTimer := time.NewTimer(time.Duration(30) * time.Second)
-				done := make(chan error, 1)
-				var conn net.Conn
-				go func() {
-					conn, err = net.DialTCP("tcp", localAddr, &remoteAddr)
-					done <- err
-				}()
-
-				select {
-				case err = <-done:
-					if err == nil {
-						client := &smtpClient{
-							conn: conn,
-						}
-						client.text = textproto.NewConn(conn)
-						_, _, err := client.text.ReadCodeLine(220)
-						if err == nil {
-							client.route = &route
-							return client, nil
-						}
-					}
-					return nil, err
-				// Timeout
-				case <-connectTimer.C:
-					err = errors.New("timeout")
+				xroute.LocalIPs = append(xroute.LocalIPs, ip)
+			}
+			xroute.RoundRobin = roundRobin
+			if route.Proxy.Valid && route.Proxy.String != "" {
+				proxy, err := smtpx.ParseProxy(route.Proxy.String)
+				if err != nil {
+					return nil, fmt.Errorf("route %d - %s", route.Id, err)
 				}
-				Log.Debug("unable to get a SMTP client", localIP, "->", remoteAddr.IP.String(), ":", remoteAddr.Port, "-", err.Error())
+				xroute.Proxy = proxy
 			}
 		}
+		xroutes = append(xroutes, xroute)
 	}
-	// All routes have been tested -> Fail !
-	return nil, errors.New("unable to get a client, all routes have been tested")
+	return xroutes, nil
 }
 
-// CloseConn close connection
-func (s *smtpClient) close() error {
-	return s.text.Close()
+// wrapSMTPClient returns the smtpClient of c, connected through one of routes
+func wrapSMTPClient(c *smtpx.Client, routes *[]Route) *smtpClient {
+	client := &smtpClient{Client: c}
+	if c.Route != nil {
+		for i := range *routes {
+			if (*routes)[i].Id == c.Route.ID {
+				client.route = &(*routes)[i]
+				break
+			}
+		}
+	}
+	return client
 }
 
-// cmd send a command and return reply
-func (s *smtpClient) cmd(timeoutSeconds, expectedCode int, format string, args ...interface{}) (int, string, error) {
-	var id uint
-	var err error
-	timeout := make(chan bool, 1)
-	done := make(chan bool, 1)
-	timer := time.AfterFunc(time.Duration(timeoutSeconds)*time.Second, func() {
-		timeout <- true
-	})
-	defer timer.Stop()
-	go func() {
-		id, err = s.text.Cmd(format, args...)
-		done <- true
-	}()
-
-	select {
-	case <-timeout:
-		return 0, "", errors.New("server do not reply in time -> timeout")
-	case <-done:
-		if err != nil {
-			return 0, "", err
+// newSMTPClient return a connected SMTP client
+// Routes are tried by priority (weighted order among routes of the same
+// priority), result of each attempt is recorded in route health.
+func newSMTPClient(routes *[]Route) (client *smtpClient, err error) {
+	ordered := routeWeightedOrder(*routes)
+	xroutes, err := smtpxRoutes(&ordered)
+	if err != nil {
+		return nil, err
+	}
+	var c *smtpx.Client
+	err = errors.New("unable to get a client, all routes have been tested")
+	for i := range xroutes {
+		c, err = smtpx.Dial(context.Background(), xroutes[i:i+1], smtpxOptions())
+		routeHealthRecord(&ordered[i], err)
+		if err == nil {
+			break
 		}
-		s.text.StartResponse(id)
-		defer s.text.EndResponse(id)
-		code, msg, err := s.text.ReadResponse(expectedCode)
-		return code, msg, err
+		// error greeting
+		if _, ok := err.(*textproto.Error); ok {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, err
 	}
+	if c.IsLMTP() {
+		c.OnClose = monitorConnOpened("lmtpclient")
+	} else {
+		c.OnClose = monitorConnOpened("smtpclient")
+	}
+	// identity (EHLO/LHLO)
+	ctx := IdentityContext{LocalIP: addrIP(c.LocalAddr())}
+	if c.Route != nil {
+		ctx.RouteId, ctx.RemoteHost = c.Route.ID, c.Route.RemoteHost
+	}
+	c.LocalName = identityHostname(ctx)
+	return wrapSMTPClient(c, routes), nil
 }
 
-// Extension reports whether an extension is support by the server.
-func (s *smtpClient) Extension(ext string) (bool, string) {
-	if s.ext == nil {
-		return false, ""
-	}
-	ext = strings.ToUpper(ext)
-	param, ok := s.ext[ext]
-	return ok, param
+// close closes connection
+func (s *smtpClient) close() error {
+	return s.Close()
 }
 
 // TLSGetVersion  returne TLS/SSL version
 func (s *smtpClient) TLSGetVersion() string {
-	if !s.tls {
+	state, ok := s.TLSConnectionState()
+	if !ok {
 		return "no TLS"
 	}
-	return tlsGetVersion(s.connTLS.ConnectionState().Version)
+	return tlsGetVersion(state.Version)
 }
 
 // TLSGetCipherSuite return cipher suite use for TLS connection
 func (s *smtpClient) TLSGetCipherSuite() string {
-	if !s.tls {
+	state, ok := s.TLSConnectionState()
+	if !ok {
 		return "No TLS"
 	}
-	return tlsGetCipherSuite(s.connTLS.ConnectionState().CipherSuite)
+	return tlsGetCipherSuite(state.CipherSuite)
 }
 
-// RemoteAddr return remote address (IP:PORT)
-func (s *smtpClient) RemoteAddr() string {
-	if s.tls {
-		return s.connTLS.RemoteAddr().String()
-	}
-	return s.conn.RemoteAddr().String()
-}
-
-// LocalAddr return local address (IP:PORT)
-func (s *smtpClient) LocalAddr() string {
-	if s.tls {
-		return s.connTLS.LocalAddr().String()
-	}
-	return s.conn.LocalAddr().String()
+// forwardClient returns true if client attributes are forwarded
+// (XCLIENT/XFORWARD) on route of client
+func (s *smtpClient) forwardClient() bool {
+	return s.route != nil && s.route.ForwardClient.Valid && s.route.ForwardClient.String != ""
 }
 
 // SMTP commands
+// deliveries are bounded by timeouts of commands, they are not canceled
 
-// SMTP NOOP
-func (s *smtpClient) Noop() (code int, msg string, err error) {
-	return s.cmd(30, 200, "NOOP")
+// SMTP RSET
+func (s *smtpClient) Rset() (code int, msg string, err error) {
+	return s.Client.Rset(context.Background())
 }
 
 // Hello: try EHLO, if failed HELO
+// (LHLO for LMTP client)
 func (s *smtpClient) Hello() (code int, msg string, err error) {
-	code, msg, err = s.Ehlo()
-	if err == nil {
-		return
-	}
-	return s.Helo()
-}
-
-// SMTP HELO
-func (s *smtpClient) Ehlo() (code int, msg string, err error) {
-	code, msg, err = s.cmd(10, 250, "EHLO %s", Cfg.GetMe())
-	if err != nil {
-		return code, msg, err
-	}
-	ext := make(map[string]string)
-	extList := strings.Split(msg, "\n")
-	if len(extList) > 1 {
-		extList = extList[1:]
-		for _, line := range extList {
-			args := strings.SplitN(line, " ", 2)
-			if len(args) > 1 {
-				ext[args[0]] = args[1]
-			} else {
-				ext[args[0]] = ""
-			}
-		}
-	}
-	if mechs, ok := ext["AUTH"]; ok {
-		s.auth = strings.Split(mechs, " ")
-	}
-	s.ext = ext
-	return
-}
-
-// SMTP HELO
-func (s *smtpClient) Helo() (code int, msg string, err error) {
-	s.ext = nil
-	code, msg, err = s.cmd(30, 250, "HELO %s", Cfg.GetMe())
-	return
+	return s.Client.Hello(context.Background())
 }
 
 // StartTLS sends the STARTTLS command and encrypts all further communication.
 func (s *smtpClient) StartTLS(config *tls.Config) (code int, msg string, err error) {
-	s.tls = false
-	code, msg, err = s.cmd(30, 220, "STARTTLS")
-	if err != nil {
-		return
-	}
-	s.connTLS = tls.Client(s.conn, config)
-	s.text = textproto.NewConn(s.connTLS)
-	code, msg, err = s.Ehlo()
-	if err != nil {
-		return
-	}
-	s.tls = true
-	return
+	return s.Client.StartTLS(context.Background(), config)
 }
 
 // AUTH
-func (s *smtpClient) Auth(a DeliverdAuth) (code int, msg string, err error) {
-	encoding := base64.StdEncoding
-	mech, resp, err := a.Start(&ServerInfo{Cfg.GetMe(), s.tls, s.auth})
-	if err != nil {
-		s.Quit()
-		return
-	}
-	resp64 := make([]byte, encoding.EncodedLen(len(resp)))
-	encoding.Encode(resp64, resp)
-	code, msg64, err := s.cmd(30, 0, "AUTH %s %s", mech, resp64)
-	for err == nil {
-		var msg []byte
-		switch code {
-		case 334:
-			msg, err = encoding.DecodeString(msg64)
-		case 235:
-			// the last message isn't base64 because it isn't a challenge
-			msg = []byte(msg64)
-		default:
-			err = &textproto.Error{Code: code, Msg: msg64}
-		}
-		if err == nil {
-			resp, err = a.Next(msg, code == 334)
-		}
-		if err != nil {
-			// abort the AUTH
-			s.cmd(10, 501, "*")
-			s.Quit()
-			break
-		}
-		if resp == nil {
-			break
-		}
-		resp64 = make([]byte, encoding.EncodedLen(len(resp)))
-		encoding.Encode(resp64, resp)
-		code, msg64, err = s.cmd(30, 0, string(resp64))
-	}
-	return
+func (s *smtpClient) Auth(a smtpx.Auth) (code int, msg string, err error) {
+	return s.Client.Auth(context.Background(), a)
+}
+
+// XCLIENT/XFORWARD
+func (s *smtpClient) ForwardClient(verb string, attrs [][2]string) (code int, msg string, err error) {
+	return s.Client.ForwardClient(context.Background(), verb, attrs)
 }
 
 // MAIL
-func (s *smtpClient) Mail(from string) (code int, msg string, err error) {
-	return s.cmd(30, 250, "MAIL FROM:<%s>", from)
+func (s *smtpClient) Mail(from string, params ...string) (code int, msg string, err error) {
+	return s.Client.Mail(context.Background(), from, params...)
 }
 
 // RCPT
-func (s *smtpClient) Rcpt(to string) (code int, msg string, err error) {
-	code, msg, err = s.cmd(30, -1, "RCPT TO:<%s>", to)
-	if code != 250 && code != 251 {
-		err = errors.New(msg)
-	}
-	return
+func (s *smtpClient) Rcpt(to string, params ...string) (code int, msg string, err error) {
+	return s.Client.Rcpt(context.Background(), to, params...)
 }
 
 // DATA
-type dataCloser struct {
-	s *smtpClient
-	io.WriteCloser
+func (s *smtpClient) Data() (*smtpx.DataWriter, int, string, error) {
+	return s.Client.Data(context.Background())
 }
 
-// Data issues a DATA command to the server and returns a writer that
-// can be used to write the data. The caller should close the writer
-// before calling any more methods on c.
-func (s *smtpClient) Data() (*dataCloser, int, string, error) {
-	code, msg, err := s.cmd(30, 354, "DATA")
-	if err != nil {
-		return nil, code, msg, err
-	}
-	return &dataCloser{s, s.text.DotWriter()}, code, msg, nil
+// BDAT (RFC 3030 CHUNKING)
+func (s *smtpClient) Bdat(data []byte, chunkSize int) (code int, msg string, err error) {
+	return s.Client.Bdat(context.Background(), data, chunkSize)
 }
 
 // QUIT
 func (s *smtpClient) Quit() (code int, msg string, err error) {
-	code, msg, err = s.cmd(10, 221, "QUIT")
-	s.text.Close()
-	return
+	return s.Client.Quit(context.Background())
 }
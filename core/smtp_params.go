@@ -0,0 +1,102 @@
+package core
+
+// ESMTP parameters passthrough
+// MAIL & RCPT parameters of the registry (smtpd_passthrough_params or
+// RegisterPassthroughParam) are accepted by smtpd, queued with the message
+// and sent to the next hop if it announces their extension, they are
+// dropped otherwise. Parameters which are not registered are refused (MAIL)
+// or ignored (RCPT) as before.
+// Registry entries are PARAM or PARAM:EXTENSION (extension of the parameter
+// if its name differs, eg BY:DELIVERBY).
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var passthroughParams = struct {
+	sync.RWMutex
+	registered map[string]string // param -> extension
+}{registered: make(map[string]string)}
+
+// RegisterPassthroughParam registers MAIL/RCPT parameter param of EHLO
+// extension extension (param if empty)
+func RegisterPassthroughParam(param, extension string) {
+	param, extension = strings.ToUpper(param), strings.ToUpper(extension)
+	if extension == "" {
+		extension = param
+	}
+	passthroughParams.Lock()
+	passthroughParams.registered[param] = extension
+	passthroughParams.Unlock()
+}
+
+// passthroughRegistry returns registered parameters (param -> extension)
+func passthroughRegistry() map[string]string {
+	registry := make(map[string]string)
+	for _, entry := range Cfg.GetSmtpdPassthroughParams() {
+		param, extension := strings.ToUpper(strings.TrimSpace(entry)), ""
+		if p := strings.Index(param, ":"); p != -1 {
+			param, extension = param[:p], param[p+1:]
+		}
+		if extension == "" {
+			extension = param
+		}
+		registry[param] = extension
+	}
+	passthroughParams.RLock()
+	for param, extension := range passthroughParams.registered {
+		registry[param] = extension
+	}
+	passthroughParams.RUnlock()
+	return registry
+}
+
+// passthroughParamRegistered returns true if param (KEYWORD[=value]) is
+// registered
+func passthroughParamRegistered(param string) bool {
+	_, ok := passthroughRegistry()[strings.ToUpper(strings.SplitN(param, "=", 2)[0])]
+	return ok
+}
+
+// passthroughExtensions returns EHLO extensions of registered parameters
+func passthroughExtensions() []string {
+	extensions := []string{}
+	for _, extension := range passthroughRegistry() {
+		if !IsStringInSlice(extension, extensions) {
+			extensions = append(extensions, extension)
+		}
+	}
+	return extensions
+}
+
+// passthroughFilter returns queued parameters (space separated) whose
+// extension is announced by client, and the dropped ones
+func passthroughFilter(client *smtpClient, params string) (forwarded, dropped []string) {
+	if params == "" {
+		return nil, nil
+	}
+	registry := passthroughRegistry()
+	for _, param := range strings.Fields(params) {
+		extension, ok := registry[strings.ToUpper(strings.SplitN(param, "=", 2)[0])]
+		if ok {
+			if announced, _ := client.Extension(extension); announced {
+				forwarded = append(forwarded, param)
+				continue
+			}
+		}
+		dropped = append(dropped, param)
+	}
+	return
+}
+
+// passthroughParams returns queued parameters forwarded to client, dropped
+// ones are logged
+func (d *delivery) passthroughParams(client *smtpClient, params string) []string {
+	forwarded, dropped := passthroughFilter(client, params)
+	if len(dropped) != 0 {
+		d.log.Info(fmt.Sprintf("deliverd-remote %s - %s - ESMTP parameters not announced by peer, dropped: %s", d.id, client.RemoteAddr(), strings.Join(dropped, " ")))
+	}
+	return forwarded
+}
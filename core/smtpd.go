@@ -1,12 +1,26 @@
 package core
 
 import (
+	"crypto/rand"
 	"crypto/tls"
 	"log"
 	"net"
-	"path"
 )
 
+// smtpdTLSConfig returns TLS config of smtpd (SMTPS listeners & STARTTLS)
+// certificate is chosen by SNI (see tls_sni.go)
+func smtpdTLSConfig() (*tls.Config, error) {
+	if err := tlsCertsInit(); err != nil {
+		return nil, err
+	}
+	// TODO: http://fastah.blackbuck.mobi/blog/securing-https-in-go/
+	return &tls.Config{
+		GetCertificate:     tlsGetCertificate,
+		InsecureSkipVerify: true,
+		Rand:               rand.Reader,
+	}, nil
+}
+
 // Smtpd SMTP Server
 type Smtpd struct {
 	dsn dsn
@@ -20,28 +34,23 @@ func NewSmtpd(d dsn) *Smtpd {
 // ListenAndServe launch server
 func (s *Smtpd) ListenAndServe() {
 	var listener net.Listener
-	var err error
 	var tlsConfig *tls.Config
-	// SSL ?
+	var err error
+	// SSL ? (SMTPS: TLS handshake on connect)
 	if s.dsn.ssl {
-		cert, err := tls.LoadX509KeyPair(path.Join(GetBasePath(), "ssl/server.crt"), path.Join(GetBasePath(), "ssl/server.key"))
+		tlsConfig, err = smtpdTLSConfig()
 		if err != nil {
 			log.Fatalln("unable to load SSL keys for smtpd.", "dsn:", s.dsn.tcpAddr, "ssl", s.dsn.ssl, "err:", err)
 		}
-		// TODO: http://fastah.blackbuck.mobi/blog/securing-https-in-go/
-		tlsConfig = &tls.Config{
-			Certificates:       []tls.Certificate{cert},
-			InsecureSkipVerify: true,
-		}
-		listener, err = tls.Listen(s.dsn.tcpAddr.Network(), s.dsn.tcpAddr.String(), tlsConfig)
-		if err != nil {
-			log.Fatalln("unable to create TLS listener.", err)
-		}
-	} else {
-		listener, err = net.Listen(s.dsn.tcpAddr.Network(), s.dsn.tcpAddr.String())
-		if err != nil {
-			log.Fatalln("unable to create listener")
-		}
+	}
+	listener, err = smtpdListen(s.dsn.tcpAddr.Network(), s.dsn.tcpAddr.String())
+	if err != nil {
+		log.Fatalln("unable to create listener")
+	}
+	// PROXY protocol (header is sent before TLS handshake)
+	proxy := proxyProtocolEnabled(listener.Addr())
+	if proxy && len(Cfg.GetSmtpdProxyProtocolTrusted()) == 0 {
+		Log.Error("smtpd " + s.dsn.String() + " - PROXY protocol enabled but no trusted proxy (smtpd_proxy_protocol_trusted), all connections will be refused")
 	}
 	if err != nil {
 		log.Fatalln(err)
@@ -50,16 +59,36 @@ func (s *Smtpd) ListenAndServe() {
 		for {
 			conn, error := listener.Accept()
 			if error != nil {
+				// closed by SmtpdStop
+				if smtpdDraining() {
+					return
+				}
 				log.Println("Client error: ", error)
 			} else {
 				go func(conn net.Conn) {
+					if proxy {
+						proxied, err := proxyProtocolAccept(conn)
+						if err != nil {
+							Log.Info("smtpd " + s.dsn.String() + " - " + conn.RemoteAddr().String() + " - PROXY protocol - " + err.Error())
+							conn.Close()
+							return
+						}
+						conn = proxied
+					}
+					if s.dsn.ssl {
+						conn = tls.Server(conn, tlsConfig)
+					}
+					defer monitorGoroutineStart("smtpd")()
+					defer monitorConnOpened("smtpd")()
 					ChSmtpSessionsCount <- 1
 					defer func() { ChSmtpSessionsCount <- -1 }()
 					sss, err := NewSMTPServerSession(conn, s.dsn.ssl)
 					if err != nil {
 						log.Println("unable to get new SmtpServerSession.", err)
 					} else {
+						smtpdSessionStart(sss)
 						sss.handle()
+						smtpdSessionEnd(sss)
 					}
 				}(conn)
 			}
@@ -0,0 +1,187 @@
+package core
+
+// Authentication-Results (RFC 7601): SPF, DKIM & DMARC checks of inbound
+// messages
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+
+	"github.com/toorop/tmail/message"
+)
+
+// isTrusted returns true if client is an authenticated user or an IP
+// allowed to relay: auth checks are not done for outgoing messages
+func (s *SMTPServerSession) isTrusted() bool {
+	if s.user != nil {
+		return true
+	}
+	ok, err := IpCanRelay(s.conn.RemoteAddr())
+	return err == nil && ok
+}
+
+// remoteIP returns IP of client
+func (s *SMTPServerSession) remoteIP() net.IP {
+	host, _, err := net.SplitHostPort(s.conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// spfCheckMailFrom evaluates SPF on MAIL FROM (or HELO for null sender)
+func (s *SMTPServerSession) spfCheckMailFrom() {
+	s.spfResult, s.spfDomain = "", ""
+	if !Cfg.GetSmtpdAuthResultsEnabled() || s.isTrusted() {
+		return
+	}
+	ip := s.remoteIP()
+	if ip == nil {
+		return
+	}
+	s.spfResult, s.spfDomain = spfCheck(ip, s.envelope.MailFrom, s.helo)
+	s.log(fmt.Sprintf("SPF - %s for %s", s.spfResult, s.spfDomain))
+}
+
+// checkAuthResults verifies DKIM, evaluates DMARC and returns the verdict
+// with the Authentication-Results header to add
+func checkAuthResults(ctx *smtpdCheckContext, rawMessage *[]byte) (v smtpdVerdict) {
+	v.check = "dmarc"
+	if !Cfg.GetSmtpdAuthResultsEnabled() || ctx.trusted {
+		return
+	}
+
+	results := []string{}
+	// SPF
+	if ctx.spfResult != "" {
+		prop := "smtp.mailfrom"
+		if ctx.envelope.MailFrom == "" {
+			prop = "smtp.helo"
+		}
+		results = append(results, fmt.Sprintf("spf=%s %s=%s", ctx.spfResult, prop, ctx.spfDomain))
+	}
+
+	// DKIM
+	dkimRes, dkimDomain := dkimVerify(rawMessage)
+	ctx.log(fmt.Sprintf("DKIM - %s for %s", dkimRes, dkimDomain))
+	if dkimRes == dkimPass {
+		ctx.dkimDomain = dkimDomain
+	}
+	if dkimDomain != "" {
+		results = append(results, fmt.Sprintf("dkim=%s header.d=%s", dkimRes, dkimDomain))
+	} else {
+		results = append(results, "dkim="+string(dkimRes))
+	}
+
+	// ARC
+	arcRes, arcInstances := arcValidate(rawMessage)
+	if arcRes != arcNone {
+		ctx.log(fmt.Sprintf("ARC - %s (%d sets)", arcRes, arcInstances))
+		results = append(results, fmt.Sprintf("arc=%s (i=%d)", arcRes, arcInstances))
+	}
+
+	// DMARC
+	fromDomain := ""
+	if from, err := mail.ParseAddress(message.RawGetHeaderValue(rawMessage, "from")); err == nil {
+		fromDomain = message.GetHostFromAddress(from.Address)
+	}
+	if fromDomain != "" {
+		e := dmarcEvaluate(fromDomain, ctx.spfResult, ctx.spfDomain, dkimRes, dkimDomain)
+		ctx.log(fmt.Sprintf("DMARC - %s for %s - policy: %s - disposition: %s", e.result, e.fromDomain, e.policy, e.disposition))
+		if e.record != nil {
+			results = append(results, fmt.Sprintf("dmarc=%s (p=%s dis=%s) header.from=%s", e.result, e.policy, e.disposition, e.fromDomain))
+		} else {
+			results = append(results, fmt.Sprintf("dmarc=%s header.from=%s", e.result, e.fromDomain))
+		}
+		if Cfg.GetSmtpdDmarcReportsEnabled() && !ctx.replay {
+			if err := dmarcReportAdd(e, ctx.remoteIP.String(), ctx.spfResult, ctx.spfDomain, dkimRes, dkimDomain); err != nil {
+				ctx.logError("DMARC - unable to record result for reports - " + err.Error())
+			}
+		}
+		if e.result == dmarcFail && !ctx.replay && ctx.remoteIP != nil {
+			digestDmarcFailure(e, ctx.remoteIP.String())
+		}
+		switch {
+		case e.result == dmarcTemperror:
+			// DMARC record can't be fetched: the message is deferred if a
+			// DMARC failure would be rejected
+			if dmarcAction(ctx, "reject") >= smtpdActionTempfail {
+				v.action = smtpdActionTempfail
+				v.reason = "DMARC record of " + e.fromDomain + " can't be fetched"
+			}
+		case e.result == dmarcFail && e.disposition != "none":
+			v.action = dmarcAction(ctx, e.disposition)
+			v.reason = fmt.Sprintf("DMARC policy of %s is %s", e.fromDomain, e.disposition)
+			v.reply = "550 5.7.1 rejected by DMARC policy of " + e.fromDomain
+			// failure may be due to a DNS failure of SPF or DKIM checks
+			if v.action == smtpdActionReject && (ctx.spfResult == spfTemperror || dkimRes == dkimTemperror) {
+				v.action = smtpdActionTempfail
+			}
+		}
+		if v.action == smtpdActionTempfail {
+			v.reply = "451 4.7.1 unable to evaluate DMARC policy of " + e.fromDomain + ", try again later"
+		}
+	}
+
+	ctx.authResults = fmt.Sprintf("%s; %s", Cfg.GetMe(), strings.Join(results, "; "))
+	v.headers = append(v.headers, "Authentication-Results: "+ctx.authResults)
+	return
+}
+
+// authResultsStrip removes Authentication-Results header fields carrying our
+// authserv-id from rawMessage (RFC 7601 5): they have not been added by us
+// and must not be trusted downstream
+func authResultsStrip(rawMessage *[]byte) (removed int) {
+	fields, kept := message.RawGetHeaderFields(rawMessage), []string{}
+	for _, f := range fields {
+		if strings.Index(f, ":") != -1 && arcFieldName(f) == "authentication-results" {
+			servId := strings.Fields(strings.SplitN(arcFieldValue(f), ";", 2)[0] + " ")
+			if len(servId) != 0 && strings.EqualFold(servId[0], Cfg.GetMe()) {
+				removed++
+				continue
+			}
+		}
+		kept = append(kept, f)
+	}
+	if removed != 0 {
+		message.RawSetHeaderFields(rawMessage, kept)
+	}
+	return
+}
+
+// dmarcAction returns the action to apply for DMARC disposition
+// If recipients domains have different overrides, the most lenient action is
+// applied: a single reply is given to the whole transaction
+func dmarcAction(ctx *smtpdCheckContext, disposition string) smtpdAction {
+	var action smtpdAction
+	var err error
+	if disposition == "reject" {
+		action, err = parseSmtpdAction(Cfg.GetSmtpdDmarcActionReject())
+	} else {
+		action, err = parseSmtpdAction(Cfg.GetSmtpdDmarcActionQuarantine())
+	}
+	if err != nil {
+		ctx.logError("DMARC - bad action in config - " + err.Error())
+		action = smtpdActionTag
+	}
+	overrides := Cfg.GetSmtpdDmarcOverrides()
+	if len(overrides) == 0 {
+		return action
+	}
+	lenient := smtpdActionReject
+	for _, rcpt := range ctx.envelope.RcptTo {
+		a := action
+		if o, ok := overrides[message.GetHostFromAddress(rcpt)]; ok {
+			if a, err = parseSmtpdAction(o); err != nil {
+				ctx.logError("DMARC - bad action in overrides - " + err.Error())
+				a = smtpdActionTag
+			}
+		}
+		if a < lenient {
+			lenient = a
+		}
+	}
+	return lenient
+}
@@ -0,0 +1,257 @@
+package core
+
+// Content filter (qmail-queue / Postfix content_filter style)
+// The message is given to an external filter:
+//  - exec:///path/to/cmd?arg=-x&arg=-y : message is piped to cmd, exit code
+//    0 accept (if cmd writes something on stdout it replaces the message),
+//    4 tempfail, 5 reject. The first line written on stderr is the reason
+//    (or the SMTP reply if it starts with a 4xx/5xx code).
+//  - smtp://host:port?reinject=ip:port : message is sent to the filter which
+//    re-injects it in tmail through the secondary smtpd listener ip:port
+//    (where the filter is not run). The reply of the filter is the reply
+//    to the client and message is not queued by this session.
+// Options: timeout (seconds, default 60), onfailure (continue, tempfail
+// (default), permfail)
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/toorop/tmail/smtpx"
+)
+
+// contentFilter represents the content filter
+type contentFilter struct {
+	uri       string
+	command   string
+	args      []string
+	address   string // smtp filter
+	reinject  string // smtp filter: local address where filter re-injects messages
+	timeout   time.Duration
+	onFailure onfailure
+}
+
+// newContentFilter returns content filter parsing uri
+func newContentFilter(uri string) (*contentFilter, error) {
+	f := &contentFilter{
+		uri:       strings.Split(uri, "?")[0],
+		timeout:   60 * time.Second,
+		onFailure: TEMPFAIL,
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	switch parsed.Scheme {
+	case "exec":
+		f.command, f.args = parsed.Path, parsed.Query()["arg"]
+	case "smtp":
+		f.address, f.reinject = parsed.Host, parsed.Query().Get("reinject")
+		if f.reinject == "" {
+			return nil, errors.New("reinject option is mandatory for smtp content filter")
+		}
+	default:
+		return nil, errors.New("unsupported content filter scheme " + parsed.Scheme)
+	}
+	if t := parsed.Query().Get("timeout"); t != "" {
+		timeout, err := strconv.ParseUint(t, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		f.timeout = time.Duration(timeout) * time.Second
+	}
+	switch parsed.Query().Get("onfailure") {
+	case "continue":
+		f.onFailure = CONTINUE
+	case "permfail":
+		f.onFailure = PERMFAIL
+	}
+	return f, nil
+}
+
+// checkContentFilter gives message to content filter
+func checkContentFilter(ctx *smtpdCheckContext, rawMessage *[]byte) (v smtpdVerdict) {
+	v.check = "contentfilter"
+	uri := Cfg.GetSmtpdContentFilter()
+	if uri == "" {
+		return
+	}
+	f, err := newContentFilter(uri)
+	if err != nil {
+		ctx.logError("MAIL - content filter: bad uri " + uri + " - " + err.Error())
+		return f.failure(v)
+	}
+	// shadow mode: the message must be neither rewritten nor handed over
+	shadow := isShadowCheck(v.check)
+	if f.command != "" {
+		return f.exec(ctx, rawMessage, v, shadow)
+	}
+	// message re-injected by the filter or replay (no side effects)
+	if f.isReinjection(ctx.localAddr) || ctx.replay {
+		return
+	}
+	if shadow {
+		ctx.log("MAIL - content filter: shadow mode, message is not handed over to " + f.address)
+		return
+	}
+	return f.smtp(ctx, rawMessage, v)
+}
+
+// isReinjection returns true if localAddr (ip:port of the smtpd listener of
+// the session) is the re-injection listener of the filter
+func (f *contentFilter) isReinjection(localAddr string) bool {
+	local, err := net.ResolveTCPAddr("tcp", localAddr)
+	if err != nil {
+		return false
+	}
+	return listenerMatch(f.reinject, local)
+}
+
+// failure returns verdict on content filter failure
+func (f *contentFilter) failure(v smtpdVerdict) smtpdVerdict {
+	v.reason = "content filter failure"
+	if f == nil || f.onFailure == TEMPFAIL {
+		v.action, v.reply = smtpdActionTempfail, "451 4.3.0 content filter failure, try again later"
+	} else if f.onFailure == PERMFAIL {
+		v.action, v.reply = smtpdActionReject, "554 5.3.0 content filter failure"
+	}
+	return v
+}
+
+// exec pipes message to filter command, in shadow mode the message is not
+// rewritten
+func (f *contentFilter) exec(ctx *smtpdCheckContext, rawMessage *[]byte, v smtpdVerdict, shadow bool) smtpdVerdict {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd := exec.Command(f.command, f.args...)
+	cmd.Stdin = bytes.NewReader(*rawMessage)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	cmd.Env = append(os.Environ(),
+		"TMAIL_MAIL_FROM="+ctx.envelope.MailFrom,
+		"TMAIL_RCPT_TO="+strings.Join(ctx.envelope.RcptTo, " "),
+		"TMAIL_REMOTE_IP="+ctx.remoteIP.String(),
+		"TMAIL_HELO="+ctx.helo,
+	)
+	if err := cmd.Start(); err != nil {
+		ctx.logError("MAIL - content filter: unable to exec " + f.command + " - " + err.Error())
+		return f.failure(v)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(f.timeout):
+		cmd.Process.Kill()
+		<-done
+		ctx.logError("MAIL - content filter: " + f.command + " timeout")
+		return f.failure(v)
+	}
+
+	reason := strings.TrimSpace(strings.SplitN(stderr.String(), "\n", 2)[0])
+	if err == nil {
+		if stdout.Len() != 0 && !shadow {
+			rewritten := stdout.Bytes()
+			if err = Unix2dos(&rewritten); err != nil {
+				ctx.logError("MAIL - content filter: " + err.Error())
+				return f.failure(v)
+			}
+			ctx.log("MAIL - content filter: message rewritten by " + f.command)
+			*rawMessage = rewritten
+		}
+		return v
+	}
+	exitError, ok := err.(*exec.ExitError)
+	if !ok {
+		ctx.logError("MAIL - content filter: " + f.command + " failed - " + err.Error())
+		return f.failure(v)
+	}
+	switch exitError.Sys().(syscall.WaitStatus).ExitStatus() {
+	case 4:
+		v.action, v.reason, v.reply = smtpdActionTempfail, reason, "451 4.7.1 message deferred by content filter"
+		if strings.HasPrefix(reason, "4") {
+			v.reply = reason
+		}
+	case 5:
+		v.action, v.reason, v.reply = smtpdActionReject, reason, "554 5.7.1 message rejected by content filter"
+		if strings.HasPrefix(reason, "5") {
+			v.reply = reason
+		}
+	default:
+		ctx.logError(fmt.Sprintf("MAIL - content filter: %s unexpected exit code - %s", f.command, err))
+		return f.failure(v)
+	}
+	if v.reason == "" {
+		v.reason = "rejected by " + f.command
+	}
+	return v
+}
+
+// smtp sends message to filter via SMTP
+// if filter accepts the message, verdict is discard: the message is
+// re-injected by the filter, the reply of the filter is sent to the client
+func (f *contentFilter) smtp(ctx *smtpdCheckContext, rawMessage *[]byte, v smtpdVerdict) smtpdVerdict {
+	// the whole session is limited to the filter timeout
+	tctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+	conn, err := (smtpx.NetDialer{}).Dial(tctx, "tcp", "", f.address)
+	if err != nil {
+		ctx.logError("MAIL - content filter: unable to connect to " + f.address + " - " + err.Error())
+		return f.failure(v)
+	}
+	client := smtpx.NewClient(conn, Cfg.GetMe())
+	client.ServerName = f.address
+	defer client.Close()
+
+	code, msg, err := client.Greeting(tctx)
+	if err == nil {
+		code, msg, err = client.Hello(tctx)
+	}
+	if err == nil {
+		code, msg, err = client.Mail(tctx, ctx.envelope.MailFrom)
+	}
+	for _, rcpt := range ctx.envelope.RcptTo {
+		if err != nil {
+			break
+		}
+		code, msg, err = client.Rcpt(tctx, rcpt)
+	}
+	if err == nil {
+		var dataPipe *smtpx.DataWriter
+		if dataPipe, code, msg, err = client.Data(tctx); err == nil {
+			if _, err = io.Copy(dataPipe, bytes.NewReader(*rawMessage)); err == nil {
+				code, msg, err = dataPipe.Finish(tctx)
+			}
+		}
+	}
+	if err != nil && code == 0 {
+		ctx.logError("MAIL - content filter: " + f.address + " - " + err.Error())
+		return f.failure(v)
+	}
+	client.Quit(tctx)
+	reply := fmt.Sprintf("%d %s", code, strings.Replace(msg, "\n", " ", -1))
+	switch {
+	case code == 250:
+		v.action, v.reason, v.reply = smtpdActionDiscard, "handed over to content filter "+f.address+" - "+reply, reply
+	case code > 399 && code < 500:
+		v.action, v.reason, v.reply = smtpdActionTempfail, reply, reply
+	case code > 499:
+		v.action, v.reason, v.reply = smtpdActionReject, reply, reply
+	default:
+		ctx.logError("MAIL - content filter: " + f.address + " unexpected reply " + reply)
+		return f.failure(v)
+	}
+	return v
+}
@@ -22,6 +22,19 @@ func (d *dsn) String() string {
 	return d.tcpAddr.String() + s
 }
 
+// dsnParseSecurity returns true if security of dsn is implicit TLS (SMTPS)
+// ssl, smtps, tls or true: implicit TLS - starttls, plain or false: clear
+// (upgradable via STARTTLS)
+func dsnParseSecurity(security string) (bool, error) {
+	switch security {
+	case "ssl", "smtps", "tls":
+		return true, nil
+	case "starttls", "plain":
+		return false, nil
+	}
+	return strconv.ParseBool(security)
+}
+
 //getDsnsFromString Get dsn string from config and returns slice of dsn struct
 func GetDsnsFromString(dsnsStr string) (dsns []dsn, err error) {
 	if len(dsnsStr) == 0 {
@@ -41,7 +54,7 @@ func GetDsnsFromString(dsnsStr string) (dsns []dsn, err error) {
 		if err != nil {
 			return dsns, errors.New("bad IP:Port found in dsn" + dsnStr + "from config dsn" + dsnsStr)
 		}
-		ssl, err := strconv.ParseBool(t[2])
+		ssl, err := dsnParseSecurity(t[2])
 		if err != nil {
 			return dsns, ErrBadDsn(err)
 		}
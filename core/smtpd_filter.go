@@ -0,0 +1,213 @@
+package core
+
+// smtpd checks (filters & policies) decisions
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/toorop/tmail/message"
+)
+
+// smtpdAction is the action decided by an smtpd check for a message
+type smtpdAction int
+
+// actions, from the most lenient to the strictest
+const (
+	smtpdActionAccept smtpdAction = iota
+	smtpdActionTag
+	smtpdActionQuarantine
+	smtpdActionDiscard
+	smtpdActionTempfail
+	smtpdActionReject
+)
+
+var smtpdActionNames = []string{"accept", "tag", "quarantine", "discard", "tempfail", "reject"}
+
+// String implements Stringer interface
+func (a smtpdAction) String() string {
+	return smtpdActionNames[a]
+}
+
+// parseSmtpdAction returns action from its name ("none" is an alias of
+// accept)
+func parseSmtpdAction(name string) (smtpdAction, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "none" {
+		return smtpdActionAccept, nil
+	}
+	for i, n := range smtpdActionNames {
+		if n == name {
+			return smtpdAction(i), nil
+		}
+	}
+	return smtpdActionAccept, errors.New("unknown action " + name)
+}
+
+// smtpdVerdict is the decision of an smtpd check
+type smtpdVerdict struct {
+	check   string // name of the check (dmarc, ...)
+	action  smtpdAction
+	reply   string   // SMTP reply on reject, tempfail (or discard)
+	reason  string   // logged, used as tag & quarantine reason
+	headers []string // headers to add if message is accepted
+}
+
+// smtpdCheckContext represents what checks know about the message
+// they check, it's built from the SMTP session or, on replay, from stored
+// messages
+type smtpdCheckContext struct {
+	envelope    message.Envelope
+	remoteIP    net.IP
+	localAddr   string // smtpd listener address (ip:port)
+	helo        string
+	trusted     bool   // authenticated user or relay IP
+	authUser    string // login of authenticated user
+	spfResult   spfResult
+	spfDomain   string
+	dkimDomain  string                   // domain of a valid DKIM signature
+	newness     map[string]time.Duration // age of sender domain, DKIM domain & client IP
+	dnsbl       *dnsblResult             // DNSBL result of client IP (nil if not looked up)
+	authResults string                   // value of our Authentication-Results header (set by checkAuthResults)
+	replay      bool                     // check runs offline: no side effects
+	log         func(msg ...string)
+	logError    func(msg ...string)
+}
+
+// smtpdDataCheck checks a message received via DATA or BDAT
+type smtpdDataCheck func(ctx *smtpdCheckContext, rawMessage *[]byte) smtpdVerdict
+
+// smtpdDataChecks is the filter chain, checks are run in this order
+var smtpdDataChecks = []smtpdDataCheck{checkAuthResults, checkDnsbl, checkNewness, checkAttachmentHash, checkClamav, checkRspamd, checkContentFilter}
+
+// checkContext returns check context of current transaction
+func (s *SMTPServerSession) checkContext() *smtpdCheckContext {
+	return &smtpdCheckContext{
+		envelope:  s.envelope,
+		remoteIP:  s.remoteIP(),
+		localAddr: s.conn.LocalAddr().String(),
+		helo:      s.helo,
+		trusted:   s.isTrusted(),
+		authUser:  s.authUser(),
+		spfResult: s.spfResult,
+		spfDomain: s.spfDomain,
+		dnsbl:     s.dnsbl,
+		log:       s.log,
+		logError:  s.logError,
+	}
+}
+
+// authUser returns login of authenticated user ("" if not authenticated)
+func (s *SMTPServerSession) authUser() string {
+	if s.user == nil {
+		return ""
+	}
+	return s.user.Login
+}
+
+// runDataChecks runs the filter chain on the message being received
+// it returns true if the transaction is over
+func (s *SMTPServerSession) runDataChecks(rawMessage *[]byte) (stop bool) {
+	ctx := s.checkContext()
+	for _, check := range smtpdDataChecks {
+		if s.applyVerdict(check(ctx, rawMessage), rawMessage) {
+			return true
+		}
+	}
+	s.envelope.AuthResults = ctx.authResults
+	return false
+}
+
+// applyVerdict applies verdict to the message being received (if check is
+// not in shadow mode)
+// it returns true if the transaction is over (message rejected, discarded
+// or quarantined)
+func (s *SMTPServerSession) applyVerdict(v smtpdVerdict, rawMessage *[]byte) (stop bool) {
+	v = enforcedVerdict(v, s.envelope, s.log, s.shadowRecord)
+	if v.action != smtpdActionAccept {
+		s.traceMessage(TraceFiltered, traceReplyCode(v.reply), fmt.Sprintf("%s - %s - %s", v.check, v.action, v.reason))
+	}
+	if v.action != smtpdActionAccept && v.action != smtpdActionTempfail {
+		s.webhookMessage(WebhookEventSpam, "", v.check+": "+v.reason, rawMessage)
+	}
+	switch v.action {
+	case smtpdActionReject, smtpdActionTempfail:
+		s.log(fmt.Sprintf("MAIL - %s - %s - %s", v.check, v.action, v.reason))
+		metricsMessage(v.action, v.check)
+		s.out(v.reply)
+		s.shadowCompare(v.action)
+		s.reset()
+		return true
+	case smtpdActionDiscard:
+		s.log(fmt.Sprintf("MAIL - %s - message discarded - %s", v.check, v.reason))
+		metricsMessage(v.action, v.check)
+		if v.reply == "" {
+			v.reply = "250 2.0.0 Ok"
+		}
+		s.out(v.reply)
+		s.shadowCompare(v.action)
+		s.reset()
+		return true
+	case smtpdActionQuarantine:
+		for _, h := range v.headers {
+			prependHeader(rawMessage, h)
+		}
+		authUser := ""
+		if s.user != nil {
+			authUser = s.user.Login
+		}
+		id, err := QuarantineAdd(rawMessage, s.envelope, authUser, s.conn.RemoteAddr().String(), v.check, v.reason)
+		if err != nil {
+			s.logError("MAIL - unable to put message in quarantine -", err.Error())
+			s.out("451 temporary queue error")
+			s.reset()
+			return true
+		}
+		s.log(fmt.Sprintf("MAIL - %s - message quarantined as %s - %s", v.check, id, v.reason))
+		metricsMessage(v.action, v.check)
+		s.out(fmt.Sprintf("250 2.0.0 Ok: queued %s", id))
+		s.shadowCompare(v.action)
+		s.reset()
+		return true
+	}
+	if v.action != smtpdActionAccept {
+		if s.enforcedAction < smtpdActionTag {
+			s.enforcedAction = smtpdActionTag
+		}
+		s.log(fmt.Sprintf("MAIL - %s - message tagged - %s", v.check, v.reason))
+	}
+	for _, h := range v.headers {
+		prependHeader(rawMessage, h)
+	}
+	return false
+}
+
+// enforcedVerdict returns verdict v of a check as it is enforced on a
+// message to envelope: accept if check is in shadow mode (shadow records
+// v), tag if recipients are exempted role addresses or if quarantine is not
+// enabled. Tagged messages get an X-Tmail-Tag header.
+func enforcedVerdict(v smtpdVerdict, envelope message.Envelope, log func(msg ...string), shadow func(v smtpdVerdict)) smtpdVerdict {
+	if isShadowCheck(v.check) {
+		shadow(v)
+		v.action = smtpdActionAccept
+	}
+	v = roleAddressesExempt(v, envelope)
+	if v.action == smtpdActionQuarantine && !QuarantineEnabled() {
+		log(fmt.Sprintf("%s - quarantine is not enabled, message will be tagged", v.check))
+		v.action = smtpdActionTag
+	}
+	if v.action == smtpdActionTag {
+		v.headers = append(v.headers, fmt.Sprintf("X-Tmail-Tag: %s; %s", v.check, v.reason))
+	}
+	return v
+}
+
+// prependHeader folds header and adds it on top of rawMessage
+func prependHeader(rawMessage *[]byte, header string) {
+	h := []byte(header)
+	message.FoldHeader(&h)
+	*rawMessage = append(append(h, 13, 10), *rawMessage...)
+}
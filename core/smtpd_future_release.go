@@ -0,0 +1,136 @@
+package core
+
+// Future release (RFC 4865)
+// Authenticated clients can ask for a delayed delivery with MAIL parameters
+// HOLDFOR (seconds) or HOLDUNTIL (RFC 3339 date), or with a X-Tmail-Send-At
+// header (RFC 3339 or RFC 5322 date). Messages are queued with their release
+// time and deliverd skips them until then.
+// Delay is limited to smtpd_future_release_max_interval seconds (0: disabled).
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toorop/tmail/message"
+)
+
+// header used to schedule delivery of a message
+const futureReleaseHeader = "X-Tmail-Send-At"
+
+// futureReleaseExtension returns FUTURERELEASE EHLO extension ("" if disabled)
+func futureReleaseExtension() string {
+	max := Cfg.GetSmtpdFutureReleaseMaxInterval()
+	if max <= 0 {
+		return ""
+	}
+	maxAt := time.Now().UTC().Add(time.Duration(max) * time.Second)
+	return fmt.Sprintf("FUTURERELEASE %d %s", max, maxAt.Format(time.RFC3339))
+}
+
+// futureReleaseCheck checks that release time at is allowed
+func futureReleaseCheck(at time.Time) error {
+	max := time.Duration(Cfg.GetSmtpdFutureReleaseMaxInterval()) * time.Second
+	if max <= 0 {
+		return errors.New("future release is disabled")
+	}
+	if at.Sub(time.Now()) > max {
+		return fmt.Errorf("release time %s exceeds max interval of %d seconds", at.Format(time.RFC3339), int(max.Seconds()))
+	}
+	return nil
+}
+
+// smtpFutureRelease handles HOLDFOR and HOLDUNTIL parameters of MAIL
+// it returns false if the parameter is refused (reply has been sent)
+func (s *SMTPServerSession) smtpFutureRelease(name, value string) bool {
+	if Cfg.GetSmtpdFutureReleaseMaxInterval() <= 0 {
+		s.log("MAIL FROM - Unsuported extension : " + name)
+		s.pause(2)
+		s.out("501 5.5.4 Invalid arguments")
+		return false
+	}
+	if s.user == nil {
+		s.log("MAIL FROM - future release refused to unauthenticated client")
+		s.pause(2)
+		s.out("554 5.7.1 Future release requires authentication")
+		return false
+	}
+	if !s.sendAt.IsZero() {
+		s.log("MAIL FROM - HOLDFOR and HOLDUNTIL are mutually exclusive")
+		s.pause(2)
+		s.out("501 5.5.4 Invalid arguments")
+		return false
+	}
+	var at time.Time
+	if name == "holdfor" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			s.log("MAIL FROM - bad value for HOLDFOR=" + value)
+			s.pause(2)
+			s.out("501 5.5.4 Invalid arguments")
+			return false
+		}
+		at = time.Now().Add(time.Duration(seconds) * time.Second)
+	} else {
+		var err error
+		if at, err = time.Parse(time.RFC3339, value); err != nil {
+			s.log("MAIL FROM - bad value for HOLDUNTIL=" + value)
+			s.pause(2)
+			s.out("501 5.5.4 Invalid arguments")
+			return false
+		}
+	}
+	if err := futureReleaseCheck(at); err != nil {
+		s.log("MAIL FROM - " + err.Error())
+		s.pause(2)
+		s.out("554 5.3.4 Hold interval exceeds maximum")
+		return false
+	}
+	s.sendAt = at
+	return true
+}
+
+// futureReleaseFromHeader removes X-Tmail-Send-At header from rawMessage and
+// returns its release time if client is allowed to use it (zero otherwise)
+func (s *SMTPServerSession) futureReleaseFromHeader(rawMessage *[]byte) (at time.Time) {
+	value := message.RawGetHeaderValue(rawMessage, futureReleaseHeader)
+	if value == "" {
+		return
+	}
+	rawRemoveHeader(rawMessage, futureReleaseHeader)
+	if s.user == nil {
+		s.log("DATA - " + futureReleaseHeader + " header of unauthenticated client removed")
+		return
+	}
+	at, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		if at, err = mail.ParseDate(value); err != nil {
+			s.log("DATA - bad " + futureReleaseHeader + " header " + value + " ignored")
+			return time.Time{}
+		}
+	}
+	if err = futureReleaseCheck(at); err != nil {
+		s.log("DATA - " + futureReleaseHeader + " header ignored - " + err.Error())
+		return time.Time{}
+	}
+	return at
+}
+
+// rawRemoveHeader removes all fields header from raw message
+func rawRemoveHeader(raw *[]byte, header string) {
+	p := strings.Index(string(*raw), "\r\n\r\n")
+	if p == -1 {
+		return
+	}
+	prefix := strings.ToLower(header) + ":"
+	fields := []string{}
+	for _, field := range message.RawGetHeaderFields(raw) {
+		if !strings.HasPrefix(strings.ToLower(field), prefix) {
+			fields = append(fields, field)
+		}
+	}
+	*raw = append([]byte(strings.Join(fields, "\r\n")), (*raw)[p:]...)
+}
@@ -0,0 +1,118 @@
+package core
+
+// HELP
+// Replies are built from the help file of listener (smtpd_help:
+// listener=file;...). Lines of the file are "TOPIC text": topic "*" is
+// returned by HELP without argument, other topics are commands (HELP MAIL).
+// Commands without text in the file are answered with their RFC reference.
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// RFC references of commands
+var smtpdHelpReferences = map[string]string{
+	"helo":     "HELO domain - RFC 5321 4.1.1.1",
+	"ehlo":     "EHLO domain - RFC 5321 4.1.1.1",
+	"mail":     "MAIL FROM:<reverse-path> [SIZE=size] [HOLDFOR=seconds|HOLDUNTIL=date] - RFC 5321 4.1.1.2, RFC 1870, RFC 4865",
+	"rcpt":     "RCPT TO:<forward-path> - RFC 5321 4.1.1.3",
+	"data":     "DATA - RFC 5321 4.1.1.4",
+	"bdat":     "BDAT size [LAST] - RFC 3030",
+	"rset":     "RSET - RFC 5321 4.1.1.5",
+	"vrfy":     "VRFY string - RFC 5321 4.1.1.6",
+	"expn":     "EXPN string - RFC 5321 4.1.1.7",
+	"help":     "HELP [string] - RFC 5321 4.1.1.8",
+	"noop":     "NOOP - RFC 5321 4.1.1.9",
+	"quit":     "QUIT - RFC 5321 4.1.1.10",
+	"starttls": "STARTTLS - RFC 3207",
+	"auth":     "AUTH mechanism [initial-response] - RFC 4954",
+}
+
+// order of commands in HELP reply
+var smtpdHelpCommands = []string{"helo", "ehlo", "starttls", "auth", "mail", "rcpt", "data", "bdat", "rset", "vrfy", "expn", "noop", "help", "quit"}
+
+// helpFile returns help file of listener of session ("" if none)
+func (s *SMTPServerSession) helpFile() string {
+	for _, entry := range Cfg.GetSmtpdHelp() {
+		p := strings.LastIndex(entry, "=")
+		if p == -1 {
+			s.logError("HELP - bad smtpd_help entry " + entry)
+			continue
+		}
+		if listenerMatch(entry[:p], s.conn.LocalAddr()) {
+			return strings.TrimSpace(entry[p+1:])
+		}
+	}
+	return ""
+}
+
+// helpTexts returns texts of topic in help file
+func helpTexts(file, topic string) (texts []string, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		if strings.ToLower(parts[0]) != topic {
+			continue
+		}
+		text := ""
+		if len(parts) == 2 {
+			text = strings.TrimSpace(parts[1])
+		}
+		texts = append(texts, text)
+	}
+	return texts, scanner.Err()
+}
+
+// smtpHelp handles HELP [topic]
+func (s *SMTPServerSession) smtpHelp(msg []string) {
+	s.resetTimeout()
+	topic := "*"
+	if len(msg) > 1 {
+		topic = strings.ToLower(msg[1])
+		if topic == "*" || s.verbDisabled(topic) {
+			s.out("504 5.5.4 HELP topic unknown")
+			return
+		}
+	}
+	texts := []string{}
+	if file := s.helpFile(); file != "" {
+		var err error
+		if texts, err = helpTexts(file, topic); err != nil {
+			s.logError("HELP - unable to read help file " + file + " - " + err.Error())
+		}
+	}
+	if topic == "*" {
+		commands := []string{}
+		for _, verb := range smtpdHelpCommands {
+			if !s.verbDisabled(verb) {
+				commands = append(commands, strings.ToUpper(verb))
+			}
+		}
+		texts = append(texts, "Commands: "+strings.Join(commands, " "), "For more info use HELP command - RFC 5321")
+	} else if len(texts) == 0 {
+		ref, ok := smtpdHelpReferences[topic]
+		if !ok {
+			s.out("504 5.5.4 HELP topic unknown")
+			return
+		}
+		texts = append(texts, ref)
+	}
+	for i, text := range texts {
+		if i == len(texts)-1 {
+			s.out("214 2.0.0 " + text)
+		} else {
+			s.out("214-2.0.0 " + text)
+		}
+	}
+}
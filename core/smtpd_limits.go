@@ -0,0 +1,69 @@
+package core
+
+// LIMITS extension (RFC 9422)
+// Limits of the session are announced: RCPTMAX (recipients per transaction,
+// see throttleMaxRcpt), MAILMAX (smtpd_max_mail, transactions per session)
+// and RCPTDOMAINMAX (smtpd_max_rcpt_domains, recipient domains per
+// transaction). Limits set to 0 (unlimited) are not announced.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// limitsExtension returns LIMITS extension of session ("" if there is no
+// limit)
+func (s *SMTPServerSession) limitsExtension() string {
+	limits := []string{}
+	if max := s.throttleMaxRcpt(); max != 0 {
+		limits = append(limits, fmt.Sprintf("RCPTMAX=%d", max))
+	}
+	if max := Cfg.GetSmtpdMaxMail(); max != 0 {
+		limits = append(limits, fmt.Sprintf("MAILMAX=%d", max))
+	}
+	if max := Cfg.GetSmtpdMaxRcptDomains(); max != 0 {
+		limits = append(limits, fmt.Sprintf("RCPTDOMAINMAX=%d", max))
+	}
+	if len(limits) == 0 {
+		return ""
+	}
+	return "LIMITS " + strings.Join(limits, " ")
+}
+
+// limitsMail returns true if session reached MAILMAX (session is closed)
+func (s *SMTPServerSession) limitsMail() bool {
+	max := Cfg.GetSmtpdMaxMail()
+	if max == 0 || s.mailCount < max {
+		return false
+	}
+	s.log(fmt.Sprintf("MAIL - max transactions per session reached (%d)", max))
+	s.out("421 4.5.3 too many transactions for this session")
+	s.exitAsap()
+	return true
+}
+
+// limitsRcptDomain returns true if rcptTo would exceed RCPTDOMAINMAX
+// (recipient is refused)
+func (s *SMTPServerSession) limitsRcptDomain(rcptTo string) bool {
+	max := Cfg.GetSmtpdMaxRcptDomains()
+	if max == 0 {
+		return false
+	}
+	domain := strings.ToLower(rcptTo[strings.LastIndex(rcptTo, "@")+1:])
+	domains := []string{}
+	for _, rcpt := range s.envelope.RcptTo {
+		d := strings.ToLower(rcpt[strings.LastIndex(rcpt, "@")+1:])
+		if d == domain {
+			return false
+		}
+		if !IsStringInSlice(d, domains) {
+			domains = append(domains, d)
+		}
+	}
+	if len(domains) < max {
+		return false
+	}
+	s.log(fmt.Sprintf("RCPT - max recipient domains per transaction reached (%d) - %s refused", max, rcptTo))
+	s.out("452 4.5.3 too many recipient domains")
+	return true
+}
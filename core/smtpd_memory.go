@@ -0,0 +1,131 @@
+package core
+
+// Memory accounting
+// Approximate memory used by SMTP sessions (connection buffers, message being
+// received and its parsed copies) is accounted against a global budget
+// (smtpd_memory_budget, in MB, 0: unlimited). Above the high watermark new
+// transactions get 452, when the budget is exhausted new connections get 421
+// and messages being received are refused with 452.
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	// memory accounted for a connection (buffers, TLS, session)
+	smtpdMemorySessionBase = 64 * 1024
+	// message data is accounted by chunks of this size
+	smtpdMemoryChunk = 64 * 1024
+)
+
+var smtpdMemory = struct {
+	sync.Mutex
+	used     int64
+	refusals map[string]uint64 // per stage
+}{refusals: make(map[string]uint64)}
+
+// smtpdMemoryBudget returns memory budget in bytes (0: unlimited)
+func smtpdMemoryBudget() int64 {
+	return int64(Cfg.GetSmtpdMemoryBudget()) * 1024 * 1024
+}
+
+// smtpdMemoryStats returns memory used, budget and refusals per stage
+func smtpdMemoryStats() (used, budget int64, refusals map[string]uint64) {
+	smtpdMemory.Lock()
+	defer smtpdMemory.Unlock()
+	refusals = make(map[string]uint64)
+	for stage, count := range smtpdMemory.refusals {
+		refusals[stage] = count
+	}
+	return smtpdMemory.used, smtpdMemoryBudget(), refusals
+}
+
+// smtpdMemoryHigh returns true if memory used is over the high watermark
+func smtpdMemoryHigh() bool {
+	budget := smtpdMemoryBudget()
+	if budget == 0 {
+		return false
+	}
+	smtpdMemory.Lock()
+	defer smtpdMemory.Unlock()
+	return smtpdMemory.used*100 >= budget*int64(Cfg.GetSmtpdMemoryHighWatermark())
+}
+
+// smtpdMemoryRefused counts a refusal at stage
+func smtpdMemoryRefused(stage string) {
+	smtpdMemory.Lock()
+	smtpdMemory.refusals[stage]++
+	smtpdMemory.Unlock()
+}
+
+// memReserve accounts n bytes for session (transaction if transaction is
+// true) and returns false if budget is exhausted
+func (s *SMTPServerSession) memReserve(n int64, transaction bool) bool {
+	budget := smtpdMemoryBudget()
+	smtpdMemory.Lock()
+	defer smtpdMemory.Unlock()
+	if budget != 0 && smtpdMemory.used+n > budget {
+		return false
+	}
+	smtpdMemory.used += n
+	if transaction {
+		s.memTransaction += n
+	} else {
+		s.memBase += n
+	}
+	return true
+}
+
+// memReleaseTransaction releases memory accounted for current transaction
+func (s *SMTPServerSession) memReleaseTransaction() {
+	smtpdMemory.Lock()
+	smtpdMemory.used -= s.memTransaction
+	s.memTransaction = 0
+	smtpdMemory.Unlock()
+}
+
+// memRelease releases all memory accounted for session
+func (s *SMTPServerSession) memRelease() {
+	s.memReleaseTransaction()
+	smtpdMemory.Lock()
+	smtpdMemory.used -= s.memBase
+	s.memBase = 0
+	smtpdMemory.Unlock()
+}
+
+// memConnect accounts memory of a new connection
+// it returns true if budget is exhausted (session is closed)
+func (s *SMTPServerSession) memConnect() bool {
+	if s.memReserve(smtpdMemorySessionBase, false) {
+		return false
+	}
+	smtpdMemoryRefused("connect")
+	s.log("GREETING - memory budget exhausted")
+	s.out("421 4.3.2 system resources exhausted, try again later")
+	s.exitAsap()
+	return true
+}
+
+// memMail returns true if a new transaction is refused because memory used
+// is over the high watermark (452 has been sent)
+func (s *SMTPServerSession) memMail() bool {
+	if !smtpdMemoryHigh() {
+		return false
+	}
+	smtpdMemoryRefused("mail")
+	used, budget, _ := smtpdMemoryStats()
+	s.log(fmt.Sprintf("MAIL - memory used over high watermark (%d/%d bytes)", used, budget))
+	s.pause(1)
+	s.out("452 4.3.1 insufficient system resources, try again later")
+	return true
+}
+
+// memRefuseMessage refuses message being received at stage (data, bdat or
+// process) because budget is exhausted
+func (s *SMTPServerSession) memRefuseMessage(stage string) {
+	smtpdMemoryRefused(stage)
+	s.log("MAIL - " + stage + " - memory budget exhausted, message refused")
+	s.out("452 4.3.1 insufficient system resources, try again later")
+	s.reset()
+}
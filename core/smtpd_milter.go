@@ -0,0 +1,302 @@
+package core
+
+// milters: smtpd talks to milters defined by smtpd_milters at each phase of
+// the SMTP session
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/toorop/tmail/message"
+)
+
+const (
+	milterReplyReject   = "550 5.7.1 Command rejected"
+	milterReplyTempfail = "451 4.7.1 Service unavailable - try again later"
+)
+
+// milterConnect connects to milters and sends them the CONNECT command
+// it returns true if the session must be closed
+func (s *SMTPServerSession) milterConnect() (stop bool) {
+	for _, uri := range Cfg.GetSmtpdMilters() {
+		m, err := newMilterClient(uri)
+		if err != nil {
+			s.logError("milter - unable to parse milter uri " + uri + " - " + err.Error())
+			continue
+		}
+		s.milters = append(s.milters, m)
+		if err = m.connect(); err != nil {
+			if stop, reply := s.milterFailure(m, err); stop {
+				s.out(strings.Replace(strings.Replace(reply, "550", "554", 1), "451", "421", 1))
+				s.exitAsap()
+				return true
+			}
+		}
+	}
+	if len(s.milters) == 0 {
+		return false
+	}
+
+	remoteAddr := s.conn.RemoteAddr().String()
+	host, port, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host, port = remoteAddr, "0"
+	}
+	family := byte('4')
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		family = '6'
+	}
+	p, _ := strconv.ParseUint(port, 10, 16)
+	data := milterCString("[" + host + "]")
+	data = append(data, family)
+	data = append(data, milterPort(uint16(p))...)
+	data = append(data, milterCString(host)...)
+
+	stop, reply := s.milterRun(milterCmdConnect, data, milterProtoNoConnect, milterProtoNrConnect, "j", s.hostname, "{daemon_name}", "tmail", "_", "["+host+"]")
+	if stop {
+		s.log("milter - connection rejected - " + reply)
+		s.out(strings.Replace(strings.Replace(reply, "550", "554", 1), "451", "421", 1))
+		s.exitAsap()
+	}
+	return stop
+}
+
+// milterHelo sends HELO to milters
+func (s *SMTPServerSession) milterHelo() (stop bool, reply string) {
+	return s.milterRun(milterCmdHelo, milterCString(s.helo), milterProtoNoHelo, milterProtoNrHelo)
+}
+
+// milterMail sends MAIL FROM to milters
+func (s *SMTPServerSession) milterMail() (stop bool, reply string) {
+	macros := []string{"{mail_addr}", s.envelope.MailFrom}
+	if s.user != nil {
+		macros = append(macros, "{auth_authen}", s.user.Login)
+	}
+	if len(s.milters) != 0 {
+		s.milterInTx = true
+	}
+	return s.milterRun(milterCmdMail, milterCString("<"+s.envelope.MailFrom+">"), milterProtoNoMail, milterProtoNrMail, macros...)
+}
+
+// milterRcpt sends RCPT TO to milters
+func (s *SMTPServerSession) milterRcpt(rcptTo string) (stop bool, reply string) {
+	return s.milterRun(milterCmdRcpt, milterCString("<"+rcptTo+">"), milterProtoNoRcpt, milterProtoNrRcpt, "{rcpt_addr}", rcptTo)
+}
+
+// milterRun sends command to active milters and returns SMTP reply if one
+// of them rejects it
+// noStep & noReply are protocol flags telling milter doesn't want the command
+// or doesn't reply to it.
+func (s *SMTPServerSession) milterRun(cmd byte, data []byte, noStep, noReply uint32, macros ...string) (stop bool, reply string) {
+	for _, m := range s.milters {
+		if m.done || m.accepted || m.protocol&noStep != 0 {
+			continue
+		}
+		err := m.macros(cmd, macros...)
+		var r milterReply
+		if err == nil {
+			r, err = m.cmd(cmd, data, noReply)
+		}
+		if err != nil {
+			if stop, reply = s.milterFailure(m, err); stop {
+				return
+			}
+			continue
+		}
+		switch r.cmd {
+		case milterRespAccept:
+			if cmd == milterCmdConnect || cmd == milterCmdHelo {
+				// no more commands for this connection
+				m.done = true
+			} else {
+				m.accepted = true
+			}
+		case milterRespDiscard:
+			s.milterDiscard = true
+			m.accepted = true
+		case milterRespReject:
+			return true, milterReplyReject
+		case milterRespTempfail:
+			return true, milterReplyTempfail
+		case milterRespReplyCode:
+			return true, r.text
+		}
+	}
+	return false, ""
+}
+
+// milterFailure handles milter failure according to its onfailure option
+func (s *SMTPServerSession) milterFailure(m *milterClient, err error) (stop bool, reply string) {
+	s.logError("milter - " + m.uri + " failed - " + err.Error())
+	m.done = true
+	if m.conn != nil {
+		m.conn.Close()
+		m.conn = nil
+	}
+	switch m.onFailure {
+	case TEMPFAIL:
+		return true, milterReplyTempfail
+	case PERMFAIL:
+		return true, milterReplyReject
+	}
+	return false, ""
+}
+
+// milterData sends message to milters (DATA, headers, body, end of body)
+// Header modifications are applied to message and the verdict of milters
+// is returned.
+func (s *SMTPServerSession) milterData(rawMessage *[]byte) (v smtpdVerdict) {
+	v.check = "milter"
+	defer func() {
+		// end of transaction for milters
+		s.milterInTx = false
+		for _, m := range s.milters {
+			m.accepted = false
+		}
+		s.milterDiscard = false
+	}()
+	if len(s.milters) == 0 {
+		return
+	}
+	if s.milterDiscard {
+		v.action, v.reason = smtpdActionDiscard, "discarded by milter"
+		return
+	}
+
+	fields := message.RawGetHeaderFields(rawMessage)
+	body := []byte{}
+	if p := strings.Index(string(*rawMessage), "\r\n\r\n"); p != -1 {
+		body = (*rawMessage)[p+4:]
+	}
+
+	for _, m := range s.milters {
+		if m.done || m.accepted {
+			continue
+		}
+		r, err := s.milterSendMessage(m, fields, body)
+		if err != nil {
+			if stop, reply := s.milterFailure(m, err); stop {
+				v.action, v.reason, v.reply = smtpdActionTempfail, "milter "+m.uri+" failure", reply
+				if reply == milterReplyReject {
+					v.action = smtpdActionReject
+				}
+				return
+			}
+			continue
+		}
+		milterApplyHeaderMods(rawMessage, r.mods, m.protocol&milterProtoLeadSpace != 0)
+		for _, mod := range r.mods {
+			if mod.cmd == milterRespQuarantine && v.action < smtpdActionQuarantine {
+				v.action, v.reason = smtpdActionQuarantine, m.uri+": "+mod.value
+			}
+		}
+		switch r.cmd {
+		case milterRespDiscard:
+			v.action, v.reason = smtpdActionDiscard, "discarded by milter "+m.uri
+		case milterRespReject:
+			v.action, v.reason, v.reply = smtpdActionReject, "rejected by milter "+m.uri, milterReplyReject
+			return
+		case milterRespTempfail:
+			v.action, v.reason, v.reply = smtpdActionTempfail, "tempfail by milter "+m.uri, milterReplyTempfail
+			return
+		case milterRespReplyCode:
+			v.action, v.reason, v.reply = smtpdActionReject, "rejected by milter "+m.uri, r.text
+			if strings.HasPrefix(r.text, "4") {
+				v.action = smtpdActionTempfail
+			}
+			return
+		}
+	}
+	return
+}
+
+// milterStep is a command sent to a milter for a message
+type milterStep struct {
+	cmd     byte
+	data    []byte
+	noStep  uint32 // protocol flag: milter doesn't want this command
+	noReply uint32 // protocol flag: milter doesn't reply to this command
+}
+
+// milterSendMessage sends message to milter m and returns its reply to end
+// of body
+func (s *SMTPServerSession) milterSendMessage(m *milterClient, fields []string, body []byte) (r milterReply, err error) {
+	steps := []milterStep{{milterCmdData, nil, milterProtoNoData, milterProtoNrData}}
+	for _, f := range fields {
+		p := strings.Index(f, ":")
+		if p == -1 {
+			continue
+		}
+		value := strings.Replace(f[p+1:], "\r\n", "\n", -1)
+		if m.protocol&milterProtoLeadSpace == 0 {
+			value = strings.TrimPrefix(value, " ")
+		}
+		steps = append(steps, milterStep{milterCmdHeader, milterCString(f[:p], value), milterProtoNoHeaders, milterProtoNrHeader})
+	}
+	steps = append(steps, milterStep{milterCmdEOH, nil, milterProtoNoEOH, milterProtoNrEOH})
+	for len(body) != 0 {
+		chunk := body
+		if len(chunk) > milterMaxBodyChunk {
+			chunk = body[:milterMaxBodyChunk]
+		}
+		body = body[len(chunk):]
+		steps = append(steps, milterStep{milterCmdBody, chunk, milterProtoNoBody, milterProtoNrBody})
+	}
+
+	for _, step := range steps {
+		if m.protocol&step.noStep != 0 {
+			continue
+		}
+		if r, err = m.cmd(step.cmd, step.data, step.noReply); err != nil {
+			return
+		}
+		switch r.cmd {
+		case milterRespContinue:
+			continue
+		case milterRespAccept:
+			r.cmd = milterRespContinue
+			return
+		default:
+			return
+		}
+	}
+	if err = m.macros(milterCmdEOB, "i", s.uuid); err != nil {
+		return
+	}
+	return m.cmd(milterCmdEOB, nil, 0)
+}
+
+// milterAbort aborts current transaction on milters
+func (s *SMTPServerSession) milterAbort() {
+	if !s.milterInTx {
+		return
+	}
+	for _, m := range s.milters {
+		m.accepted = false
+		if m.done {
+			continue
+		}
+		if err := m.send(milterCmdAbort, nil); err != nil {
+			s.milterFailure(m, err)
+		}
+	}
+	s.milterInTx = false
+	s.milterDiscard = false
+}
+
+// milterClose closes connections to milters
+func (s *SMTPServerSession) milterClose() {
+	for _, m := range s.milters {
+		m.close()
+	}
+	s.milters = nil
+}
+
+// milterPort returns port p as milter expects it (network byte order)
+func milterPort(p uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, p)
+	return b
+}
@@ -0,0 +1,186 @@
+package core
+
+// PROXY protocol (v1 & v2)
+// On listeners of smtpd_proxy_protocol_listeners (behind HAProxy...)
+// connections must start with a PROXY header, the client address it carries
+// replaces the address of the proxy: it's used for logs, relay access,
+// throttling, DNSBL, SPF and Received headers. Headers are accepted from
+// smtpd_proxy_protocol_trusted networks only (none if empty: the listener
+// refuses all connections), other connections are closed.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// max duration to receive PROXY header
+const proxyProtocolTimeout = 10 * time.Second
+
+// signature of PROXY v2 header
+var proxyProtocolV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is a connection whose remote address is given by PROXY header
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+// Read reads from buffered reader (data after header may be buffered)
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns address of client
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// proxyProtocolEnabled returns true if PROXY header is expected on listener
+// local
+func proxyProtocolEnabled(local net.Addr) bool {
+	for _, listener := range Cfg.GetSmtpdProxyProtocolListeners() {
+		if listenerMatch(listener, local) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocolTrusted returns true if PROXY headers of addr are accepted
+func proxyProtocolTrusted(addr net.Addr) bool {
+	trusted := Cfg.GetSmtpdProxyProtocolTrusted()
+	ip := addrIP(addr.String())
+	if ip == nil {
+		return false
+	}
+	for _, network := range trusted {
+		network = strings.TrimSpace(network)
+		if !strings.Contains(network, "/") {
+			if tIP := net.ParseIP(network); tIP != nil && tIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		if _, n, err := net.ParseCIDR(network); err == nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocolAccept reads PROXY header of conn and returns a connection
+// with the address of client
+func proxyProtocolAccept(conn net.Conn) (net.Conn, error) {
+	if len(Cfg.GetSmtpdProxyProtocolTrusted()) == 0 {
+		return nil, errors.New("no trusted proxy (smtpd_proxy_protocol_trusted), connection from " + conn.RemoteAddr().String() + " refused")
+	}
+	if !proxyProtocolTrusted(conn.RemoteAddr()) {
+		return nil, errors.New("connection from untrusted address " + conn.RemoteAddr().String())
+	}
+	conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	r := bufio.NewReader(conn)
+	// v1 header starts with "PROXY", v2 with CR: nothing is read beyond the
+	// header (client waits for the banner)
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, errors.New("unable to read PROXY header - " + err.Error())
+	}
+	var remote net.Addr
+	if first[0] == proxyProtocolV2Sig[0] {
+		remote, err = proxyProtocolReadV2(r)
+	} else {
+		remote, err = proxyProtocolReadV1(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// LOCAL (health checks) or unknown protocol
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxyConn{Conn: conn, r: r, remote: remote}, nil
+}
+
+// proxyProtocolReadV1 reads a text header
+// PROXY TCP4|TCP6|UNKNOWN SRC DST SPORT DPORT\r\n
+func proxyProtocolReadV1(r *bufio.Reader) (net.Addr, error) {
+	line := []byte{}
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.New("unable to read PROXY header - " + err.Error())
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("bad PROXY v1 header, CRLF not found")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("bad PROXY header: " + strings.TrimSpace(string(line)))
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if (fields[1] != "TCP4" && fields[1] != "TCP6") || len(fields) != 6 {
+		return nil, errors.New("bad PROXY v1 header: " + strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("bad source in PROXY v1 header: " + strings.TrimSpace(string(line)))
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// proxyProtocolReadV2 reads a binary header
+func proxyProtocolReadV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.New("unable to read PROXY v2 header - " + err.Error())
+	}
+	if !bytes.Equal(header[:len(proxyProtocolV2Sig)], proxyProtocolV2Sig) {
+		return nil, errors.New("bad PROXY v2 signature")
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("bad PROXY v2 header, version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errors.New("unable to read PROXY v2 addresses - " + err.Error())
+	}
+	switch header[12] & 0x0f {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("bad PROXY v2 command %d", header[12]&0x0f)
+	}
+	switch header[13] >> 4 {
+	case 1: // IPv4
+		if len(payload) < 12 {
+			return nil, errors.New("bad PROXY v2 header, IPv4 addresses truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2: // IPv6
+		if len(payload) < 36 {
+			return nil, errors.New("bad PROXY v2 header, IPv6 addresses truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	// unspec or unix
+	return nil, nil
+}
@@ -0,0 +1,200 @@
+package core
+
+// Relay control
+// Recipients of rcpthosts are always accepted, others are relayed according
+// to the relay policy of the listener of the session:
+//   - default: authenticated users allowed to relay, trusted networks
+//     (tmail relayip) and IPs of recent POP/IMAP logins
+//   - auth: authenticated users allowed to relay only
+//   - networks: trusted networks and IPs of recent POP/IMAP logins only
+//   - none: no relaying, listener only accepts mail for rcpthosts
+// POP/IMAP-before-SMTP: Dovecot reports logins (post-login script running
+// tmail relay login, or REST POST /relay/logins), IPs of logins are allowed
+// to relay during smtpd_pop_before_smtp_lifetime minutes.
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Relay policies
+const (
+	RelayPolicyDefault  = "default"
+	RelayPolicyAuth     = "auth"
+	RelayPolicyNetworks = "networks"
+	RelayPolicyNone     = "none"
+)
+
+// relayPolicySubmission is the listener of policies of submission listeners
+const relayPolicySubmission = "submission"
+
+// RelayPolicy is the relay policy of a listener
+type RelayPolicy struct {
+	Id       int64
+	Listener string `sql:"unique"` // ip:port, :port or submission
+	Policy   string // default, auth, networks or none
+}
+
+// RelayLogin is a POP/IMAP login, IP of client can relay
+type RelayLogin struct {
+	Id       int64
+	Ip       string `sql:"unique"`
+	Login    string
+	LoggedAt time.Time
+}
+
+// RelayPolicySet sets relay policy of listener
+func RelayPolicySet(listener, policy string) (*RelayPolicy, error) {
+	listener = strings.ToLower(strings.TrimSpace(listener))
+	policy = strings.ToLower(strings.TrimSpace(policy))
+	if listener != relayPolicySubmission {
+		if _, _, err := net.SplitHostPort(listener); err != nil {
+			return nil, errors.New("bad listener " + listener + " (ip:port, :port or " + relayPolicySubmission + " expected)")
+		}
+	}
+	switch policy {
+	case RelayPolicyDefault, RelayPolicyAuth, RelayPolicyNetworks, RelayPolicyNone:
+	default:
+		return nil, errors.New("bad relay policy " + policy + " (" + RelayPolicyDefault + ", " + RelayPolicyAuth + ", " + RelayPolicyNetworks + " or " + RelayPolicyNone + " expected)")
+	}
+	p := &RelayPolicy{}
+	err := DB.Where("listener = ?", listener).First(p).Error
+	if err != nil && err != gorm.RecordNotFound {
+		return nil, err
+	}
+	p.Listener, p.Policy = listener, policy
+	return p, DB.Save(p).Error
+}
+
+// RelayPolicyDel removes relay policy of listener (default policy applies)
+func RelayPolicyDel(listener string) error {
+	p := &RelayPolicy{}
+	if err := DB.Where("listener = ?", strings.ToLower(strings.TrimSpace(listener))).First(p).Error; err != nil {
+		return err
+	}
+	return DB.Delete(p).Error
+}
+
+// RelayPolicyGetAll returns relay policies of listeners
+func RelayPolicyGetAll() (policies []RelayPolicy, err error) {
+	policies = []RelayPolicy{}
+	err = DB.Order("listener").Find(&policies).Error
+	if err == gorm.RecordNotFound {
+		err = nil
+	}
+	return
+}
+
+// RelayLoginAdd records a POP/IMAP login of login from ip, ip can relay
+// during smtpd_pop_before_smtp_lifetime minutes
+func RelayLoginAdd(ip, login string) error {
+	parsed := net.ParseIP(strings.TrimSpace(ip))
+	if parsed == nil {
+		return errors.New("Invalid IP: " + ip)
+	}
+	l := &RelayLogin{}
+	err := DB.Where("ip = ?", parsed.String()).First(l).Error
+	if err != nil && err != gorm.RecordNotFound {
+		return err
+	}
+	l.Ip, l.Login, l.LoggedAt = parsed.String(), login, time.Now()
+	if err = DB.Save(l).Error; err != nil {
+		return err
+	}
+	// expired logins
+	return DB.Where("logged_at < ?", time.Now().Add(-relayLoginLifetime())).Delete(RelayLogin{}).Error
+}
+
+// RelayLoginGetAll returns POP/IMAP logins whose IP can relay
+func RelayLoginGetAll() (logins []RelayLogin, err error) {
+	logins = []RelayLogin{}
+	err = DB.Where("logged_at >= ?", time.Now().Add(-relayLoginLifetime())).Order("logged_at desc").Find(&logins).Error
+	if err == gorm.RecordNotFound {
+		err = nil
+	}
+	return
+}
+
+// relayLoginLifetime returns duration IPs of POP/IMAP logins can relay
+func relayLoginLifetime() time.Duration {
+	return time.Duration(Cfg.GetSmtpdPopBeforeSmtpLifetime()) * time.Minute
+}
+
+// relayLoginRecent returns true if a POP/IMAP login from ip is recent
+func relayLoginRecent(ip net.IP) (bool, error) {
+	if relayLoginLifetime() == 0 || ip == nil {
+		return false, nil
+	}
+	err := DB.Where("ip = ? AND logged_at >= ?", ip.String(), time.Now().Add(-relayLoginLifetime())).First(&RelayLogin{}).Error
+	if err == gorm.RecordNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// relayPolicy returns relay policy of listener of s: policy of its
+// address, then of its port, then of submission listeners
+func (s *SMTPServerSession) relayPolicy() (string, error) {
+	if s.relay != "" {
+		return s.relay, nil
+	}
+	policies, err := RelayPolicyGetAll()
+	if err != nil {
+		return "", err
+	}
+	s.relay = RelayPolicyDefault
+	best := 0
+	for _, p := range policies {
+		rank := 0
+		switch {
+		case p.Listener == relayPolicySubmission:
+			if s.submission {
+				rank = 1
+			}
+		case listenerMatch(p.Listener, s.conn.LocalAddr()):
+			rank = 2
+			if host, _, _ := net.SplitHostPort(p.Listener); host != "" && host != "0.0.0.0" && host != "::" {
+				rank = 3
+			}
+		}
+		if rank > best {
+			s.relay, best = p.Policy, rank
+		}
+	}
+	return s.relay, nil
+}
+
+// relayAllowed returns true if client can relay, reply is the response of
+// a denied relaying
+func (s *SMTPServerSession) relayAllowed() (allowed bool, reply string, err error) {
+	policy, err := s.relayPolicy()
+	if err != nil {
+		return false, "", err
+	}
+	if policy == RelayPolicyNone {
+		return false, "550 5.7.1 Relaying denied, this server only accepts mail for its domains", nil
+	}
+	// authenticated user
+	if policy != RelayPolicyNetworks && s.user != nil && s.user.AuthRelay {
+		return true, "", nil
+	}
+	if policy == RelayPolicyAuth {
+		return false, "550 5.7.1 Relaying denied, authentication required", nil
+	}
+	// trusted networks
+	if allowed, err = IpCanRelay(s.conn.RemoteAddr()); allowed || err != nil {
+		return
+	}
+	// POP/IMAP-before-SMTP
+	if allowed, err = relayLoginRecent(s.remoteIP()); allowed || err != nil {
+		return
+	}
+	if policy == RelayPolicyNetworks {
+		return false, "550 5.7.1 Relaying denied, your IP is not allowed to relay", nil
+	}
+	return false, "550 5.7.1 Relaying denied, authentication required", nil
+}
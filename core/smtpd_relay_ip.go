@@ -7,29 +7,63 @@ import (
 	"strings"
 )
 
-// relayOkIp represents an IP that can use SMTP for relaying
+// relayOkIp represents an IP (or a network, CIDR) that can use SMTP for
+// relaying
 type RelayIpOk struct {
 	Id int64
 	Ip string `sql:"unique"`
 }
 
-// remoteIpCanUseSmtp checks if an IP can relay
-func IpCanRelay(ip net.Addr) (bool, error) {
-	err := DB.Where("ip = ?", ip.String()[:strings.Index(ip.String(), ":")]).Find(&RelayIpOk{}).Error
+// IpCanRelay checks if IP of addr can relay: it's an authorized IP or it's
+// in an authorized network
+func IpCanRelay(addr net.Addr) (bool, error) {
+	ip := addrIP(addr.String())
+	if ip == nil {
+		return false, nil
+	}
+	err := DB.Where("ip = ?", ip.String()).Find(&RelayIpOk{}).Error
 	if err == nil {
 		return true, nil
 	}
 	if err != gorm.RecordNotFound {
 		return false, err
 	}
+	networks := []RelayIpOk{}
+	if err = DB.Where("ip LIKE ?", "%/%").Find(&networks).Error; err != nil && err != gorm.RecordNotFound {
+		return false, err
+	}
+	for _, n := range networks {
+		if _, ipNet, err := net.ParseCIDR(n.Ip); err == nil && ipNet.Contains(ip) {
+			return true, nil
+		}
+	}
 	return false, nil
 }
 
-// relayipAdd authorize IP to relay through tmail
+// relayIpParse returns canonical form of IP or network (CIDR) ip
+func relayIpParse(ip string) (string, error) {
+	ip = strings.TrimSpace(ip)
+	if strings.Contains(ip, "/") {
+		_, ipNet, err := net.ParseCIDR(ip)
+		if err != nil {
+			return "", errors.New("Invalid network: " + ip)
+		}
+		return ipNet.String(), nil
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", errors.New("Invalid IP: " + ip)
+	}
+	return parsed.String(), nil
+}
+
+// relayipAdd authorize IP (or network, eg 192.168.0.0/16) to relay
+// through tmail
 func RelayIpAdd(ip string) error {
 	// input validation
-	if net.ParseIP(ip) == nil {
-		return errors.New("Invalid IP: " + ip)
+	ip, err := relayIpParse(ip)
+	if err != nil {
+		return err
 	}
 	rip := RelayIpOk{
 		Ip: ip,
@@ -44,11 +78,12 @@ func RelayIpGetAll() (ips []RelayIpOk, err error) {
 	return
 }
 
-// RelayIpDel remove ip from authorized IP
+// RelayIpDel remove ip (or network) from authorized IP
 func RelayIpDel(ip string) error {
 	// input validation
-	if net.ParseIP(ip) == nil {
-		return errors.New("Invalid IP: " + ip)
+	ip, err := relayIpParse(ip)
+	if err != nil {
+		return err
 	}
 	return DB.Where("ip = ?", ip).Delete(&RelayIpOk{}).Error
 }
@@ -0,0 +1,133 @@
+package core
+
+// STARTTLS & AUTH requirements
+// On listeners of smtpd_require_tls clients must issue STARTTLS before AUTH
+// and MAIL, on listeners of smtpd_require_auth they must authenticate
+// before MAIL. smtpd_require_exceptions waives them for networks (legacy
+// appliances, ...), optionally on a listener only.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// requirement kinds
+const (
+	smtpdRequireTLS  = "tls"
+	smtpdRequireAuth = "auth"
+)
+
+// smtpdRequireException represents an exception to a requirement
+type smtpdRequireException struct {
+	raw      string
+	kind     string // tls, auth or all
+	network  *net.IPNet
+	listener string // "" for all listeners
+}
+
+// parseSmtpdRequireException parses exception kind:network[@listener]
+func parseSmtpdRequireException(raw string) (e smtpdRequireException, err error) {
+	e.raw = strings.TrimSpace(raw)
+	p := strings.Index(e.raw, ":")
+	if p == -1 {
+		return e, errors.New("bad requirement exception " + raw + ", kind is missing")
+	}
+	e.kind = strings.ToLower(e.raw[:p])
+	if e.kind != smtpdRequireTLS && e.kind != smtpdRequireAuth && e.kind != "all" {
+		return e, errors.New("bad requirement exception " + raw + ", unknown kind " + e.kind)
+	}
+	network := e.raw[p+1:]
+	if p = strings.Index(network, "@"); p != -1 {
+		network, e.listener = network[:p], network[p+1:]
+	}
+	if ip := net.ParseIP(network); ip != nil {
+		if ip.To4() != nil {
+			network += "/32"
+		} else {
+			network += "/128"
+		}
+	}
+	if _, e.network, err = net.ParseCIDR(network); err != nil {
+		return e, errors.New("bad requirement exception " + raw + ", bad network " + network)
+	}
+	return
+}
+
+// listenerMatch returns true if local address matches listener (ip:port,
+// :port or *)
+func listenerMatch(listener string, local net.Addr) bool {
+	listener = strings.TrimSpace(listener)
+	if listener == "*" {
+		return true
+	}
+	lHost, lPort, err := net.SplitHostPort(listener)
+	if err != nil {
+		return false
+	}
+	host, port, err := net.SplitHostPort(local.String())
+	if err != nil || port != lPort {
+		return false
+	}
+	if lHost == "" || lHost == "0.0.0.0" || lHost == "::" {
+		return true
+	}
+	lIP, ip := net.ParseIP(lHost), net.ParseIP(host)
+	return lIP != nil && ip != nil && lIP.Equal(ip)
+}
+
+// requirementsInit sets requirements of session, exceptions are logged
+func (s *SMTPServerSession) requirementsInit() {
+	ip := s.remoteIP()
+	for _, kind := range []string{smtpdRequireTLS, smtpdRequireAuth} {
+		required := false
+		listeners := Cfg.GetSmtpdRequireTLS()
+		if kind == smtpdRequireAuth {
+			listeners = Cfg.GetSmtpdRequireAuth()
+		}
+		for _, listener := range listeners {
+			if listenerMatch(listener, s.conn.LocalAddr()) {
+				required = true
+				break
+			}
+		}
+		if required && ip != nil {
+			for _, raw := range Cfg.GetSmtpdRequireExceptions() {
+				e, err := parseSmtpdRequireException(raw)
+				if err != nil {
+					s.logError("GREETING - " + err.Error())
+					continue
+				}
+				if (e.kind == kind || e.kind == "all") && e.network.Contains(ip) && (e.listener == "" || listenerMatch(e.listener, s.conn.LocalAddr())) {
+					s.log(fmt.Sprintf("GREETING - REQUIREMENT EXCEPTION - %s not required for %s on %s (%s)", kind, ip, s.conn.LocalAddr(), e.raw))
+					required = false
+					break
+				}
+			}
+		}
+		if kind == smtpdRequireTLS {
+			s.requireTLS = required
+		} else {
+			s.requireAuth = required
+		}
+	}
+}
+
+// smtpRequirements checks requirements before cmd (AUTH or MAIL)
+// it returns true if they are not met (reply has been sent)
+func (s *SMTPServerSession) smtpRequirements(cmd string) bool {
+	if s.requireTLS && !s.tls {
+		s.log(cmd + " - rejected, STARTTLS is required")
+		s.pause(2)
+		s.out("530 5.7.0 Must issue a STARTTLS command first")
+		return true
+	}
+	if cmd == "MAIL" && s.requireAuth && s.user == nil {
+		s.log(cmd + " - rejected, authentication is required")
+		s.pause(2)
+		s.out("530 5.7.0 Authentication required")
+		return true
+	}
+	return false
+}
@@ -0,0 +1,270 @@
+package core
+
+// SASL mechanisms CRAM-MD5 (RFC 2195) & SCRAM-SHA-256 (RFC 7677)
+// Mechanisms of smtpd_auth_mechanisms are announced. Passwords are not
+// stored: CRAM-MD5 uses HMAC-MD5 states keyed with the password (as Dovecot
+// CRAM-MD5 scheme) and SCRAM-SHA-256 salted keys, both are computed when
+// users are added. They authenticate db users only (users added before
+// have to be added again).
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// iterations of SCRAM-SHA-256 salted passwords
+const scramIterations = 4096
+
+var (
+	// errAuthMalformed is returned if client sends malformed SASL data
+	errAuthMalformed = errors.New("malformed auth input")
+	// errAuthCancelled is returned if client cancels authentication (*)
+	errAuthCancelled = errors.New("authentication cancelled")
+)
+
+// userSaslCredentials computes CRAM-MD5 & SCRAM-SHA-256 credentials of user
+// CRAM-MD5 states are password equivalent, they are stored only if
+// CRAM-MD5 is enabled (password of users must be set again after enabling
+// it)
+func userSaslCredentials(user *User, passwd string) error {
+	user.CramMd5 = ""
+	if saslMechanismEnabled("CRAM-MD5") {
+		if err := userCramMd5(user, passwd); err != nil {
+			return err
+		}
+	}
+
+	// SCRAM-SHA-256: iterations:salt:StoredKey:ServerKey
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	saltedPassword := pbkdf2.Key([]byte(passwd), salt, scramIterations, sha256.Size, sha256.New)
+	storedKey := sha256.Sum256(saslHmac(saltedPassword, "Client Key"))
+	user.ScramSha256 = fmt.Sprintf("%d:%s:%s:%s", scramIterations, base64.StdEncoding.EncodeToString(salt), base64.StdEncoding.EncodeToString(storedKey[:]), base64.StdEncoding.EncodeToString(saslHmac(saltedPassword, "Server Key")))
+	return nil
+}
+
+// userCramMd5 computes CRAM-MD5 credentials of user: MD5 states after inner
+// & outer pads
+func userCramMd5(user *User, passwd string) error {
+	key := []byte(passwd)
+	if len(key) > 64 {
+		sum := md5.Sum(key)
+		key = sum[:]
+	}
+	pad := make([]byte, 64)
+	states := []string{}
+	for _, b := range []byte{0x36, 0x5c} {
+		for i := range pad {
+			pad[i] = b
+			if i < len(key) {
+				pad[i] ^= key[i]
+			}
+		}
+		h := md5.New()
+		h.Write(pad)
+		state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		states = append(states, base64.StdEncoding.EncodeToString(state))
+	}
+	user.CramMd5 = strings.Join(states, ":")
+	return nil
+}
+
+// SaslPurgeDisabledCredentials removes CRAM-MD5 states of users if CRAM-MD5
+// is not enabled
+func SaslPurgeDisabledCredentials() error {
+	if saslMechanismEnabled("CRAM-MD5") {
+		return nil
+	}
+	return DB.Model(User{}).Where("cram_md5 != ?", "").Update("cram_md5", "").Error
+}
+
+// saslHmac returns HMAC-SHA-256 of message with key
+func saslHmac(key []byte, message string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(message))
+	return h.Sum(nil)
+}
+
+// saslMechanismEnabled returns true if mechanism is announced
+func saslMechanismEnabled(mechanism string) bool {
+	for _, m := range Cfg.GetSmtpdAuthMechanisms() {
+		if strings.EqualFold(strings.TrimSpace(m), mechanism) {
+			return true
+		}
+	}
+	return false
+}
+
+// saslUser returns db user login with credentials of a SASL mechanism
+// (nil if user doesn't exist)
+func saslUser(login string) (*User, error) {
+	user, err := UserGetByLogin(login)
+	if err == gorm.RecordNotFound {
+		return nil, nil
+	}
+	return user, err
+}
+
+// authCramMd5 handles AUTH CRAM-MD5, it returns authenticated user
+func (s *SMTPServerSession) authCramMd5() (*User, error) {
+	challenge := fmt.Sprintf("<%d.%d@%s>", os.Getpid(), time.Now().UnixNano(), Cfg.GetMe())
+	s.out("334 " + base64.StdEncoding.EncodeToString([]byte(challenge)))
+	response, err := s.authReadResponse()
+	if err != nil {
+		return nil, err
+	}
+	p := strings.LastIndex(response, " ")
+	if p == -1 {
+		return nil, errAuthMalformed
+	}
+	login, digest := strings.ToLower(response[:p]), response[p+1:]
+	user, err := saslUser(login)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrAuthNoSuchUser
+	}
+	states := strings.Split(user.CramMd5, ":")
+	if len(states) != 2 {
+		return nil, ErrAuthFailed
+	}
+	expected := []byte{}
+	for _, state64 := range states {
+		state, err := base64.StdEncoding.DecodeString(state64)
+		if err != nil {
+			return nil, err
+		}
+		h := md5.New()
+		if err = h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+			return nil, err
+		}
+		if len(expected) == 0 {
+			h.Write([]byte(challenge))
+		} else {
+			h.Write(expected)
+		}
+		expected = h.Sum(nil)
+	}
+	received, err := hex.DecodeString(digest)
+	if err != nil || !hmac.Equal(received, expected) {
+		return nil, ErrAuthFailed
+	}
+	return user, nil
+}
+
+// authScramSha256 handles AUTH SCRAM-SHA-256 with initial response
+// clientFirst (empty if not sent), it returns authenticated user
+func (s *SMTPServerSession) authScramSha256(clientFirst string) (*User, error) {
+	var err error
+	if clientFirst == "" {
+		s.out("334 ")
+		if clientFirst, err = s.authReadResponse(); err != nil {
+			return nil, err
+		}
+	}
+	// gs2 header: no channel binding, no authzid
+	if !strings.HasPrefix(clientFirst, "n,,") && !strings.HasPrefix(clientFirst, "y,,") {
+		return nil, errors.New("SCRAM channel binding and authzid are not supported")
+	}
+	gs2Header, clientFirstBare := clientFirst[:3], clientFirst[3:]
+	var login, clientNonce string
+	for _, attr := range strings.Split(clientFirstBare, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			return nil, errAuthMalformed
+		}
+		switch attr[0] {
+		case 'n':
+			login = strings.ToLower(strings.Replace(strings.Replace(attr[2:], "=2C", ",", -1), "=3D", "=", -1))
+		case 'r':
+			clientNonce = attr[2:]
+		case 'm':
+			return nil, errors.New("SCRAM extensions are not supported")
+		}
+	}
+	if login == "" || clientNonce == "" {
+		return nil, errAuthMalformed
+	}
+
+	// credentials, unknown users get random ones (they fail at proof)
+	user, err := saslUser(login)
+	if err != nil {
+		return nil, err
+	}
+	credentials := []string{}
+	if user != nil {
+		credentials = strings.Split(user.ScramSha256, ":")
+	}
+	if len(credentials) != 4 {
+		random := make([]byte, 16)
+		if _, err = rand.Read(random); err != nil {
+			return nil, err
+		}
+		credentials = []string{strconv.Itoa(scramIterations), base64.StdEncoding.EncodeToString(random), "", ""}
+	}
+	storedKey, _ := base64.StdEncoding.DecodeString(credentials[2])
+	serverKey, _ := base64.StdEncoding.DecodeString(credentials[3])
+
+	b := make([]byte, 18)
+	if _, err = rand.Read(b); err != nil {
+		return nil, err
+	}
+	nonce := clientNonce + base64.StdEncoding.EncodeToString(b)
+	serverFirst := "r=" + nonce + ",s=" + credentials[1] + ",i=" + credentials[0]
+	s.out("334 " + base64.StdEncoding.EncodeToString([]byte(serverFirst)))
+
+	clientFinal, err := s.authReadResponse()
+	if err != nil {
+		return nil, err
+	}
+	p := strings.LastIndex(clientFinal, ",p=")
+	if p == -1 {
+		return nil, errAuthMalformed
+	}
+	clientFinalWithoutProof := clientFinal[:p]
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[p+3:])
+	if err != nil {
+		return nil, errAuthMalformed
+	}
+	if clientFinalWithoutProof != "c="+base64.StdEncoding.EncodeToString([]byte(gs2Header))+",r="+nonce {
+		return nil, ErrAuthFailed
+	}
+	authMessage := clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+	clientSignature := saslHmac(storedKey, authMessage)
+	if user == nil || len(storedKey) == 0 || len(proof) != len(clientSignature) {
+		return nil, ErrAuthFailed
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	if sum := sha256.Sum256(clientKey); !hmac.Equal(sum[:], storedKey) {
+		return nil, ErrAuthFailed
+	}
+
+	// server-final-message, client sends an empty response
+	s.out("334 " + base64.StdEncoding.EncodeToString([]byte("v="+base64.StdEncoding.EncodeToString(saslHmac(serverKey, authMessage)))))
+	if _, err = s.authReadResponse(); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
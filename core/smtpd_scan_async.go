@@ -0,0 +1,379 @@
+package core
+
+// Accept-then-scan
+// On listeners in async scan mode (smtpd_scan_mode: listener=async), the
+// filter chain doesn't run at DATA: messages are queued waiting for scan
+// (status 6) and accepted at once. Workers scan them afterward, messages are
+// then delivered (tagged if needed), quarantined, discarded or bounced.
+// Pending scans are stored (ScanJob) and resumed on restart, scans ending in
+// tempfail are retried.
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toorop/tmail/message"
+)
+
+// scan is retried this number of times on tempfail, message is then
+// delivered
+const scanAsyncMaxAttempts = 10
+
+// scanAsyncLeaseTTL is the lifetime of the lease of a scan, longer than
+// timeouts of scanners
+const scanAsyncLeaseTTL = 10 * time.Minute
+
+// ScanJob represents a message accepted without scan
+type ScanJob struct {
+	Id             int64
+	Uuid           string `sql:"unique"` // uuid of queued message
+	SessionId      string // smtpd session which received message
+	MailFrom       string
+	RcptTo         string `sql:"type:text;"` // addresses separated by ";"
+	AuthUser       string
+	RemoteAddr     string
+	LocalAddr      string
+	Helo           string
+	Trusted        bool
+	SpfResult      string
+	SpfDomain      string
+	Attempts       int
+	CreatedAt      time.Time
+	LeaseOwner     string    // node running scan ("" if none)
+	LeaseExpiresAt time.Time // scan is resumed by another node after
+}
+
+// scanAsyncTask is a scan to do, ctx is the context of the session (nil if
+// scan has been resumed)
+type scanAsyncTask struct {
+	job ScanJob
+	ctx *smtpdCheckContext
+}
+
+var (
+	scanAsyncQueue   = make(chan scanAsyncTask, 1024)
+	scanAsyncPending = struct {
+		sync.Mutex
+		jobs map[int64]bool // queued or running
+	}{jobs: map[int64]bool{}}
+)
+
+// scanAsync returns true if messages of session are scanned after being
+// accepted
+func (s *SMTPServerSession) scanAsync() bool {
+	for _, entry := range Cfg.GetSmtpdScanMode() {
+		p := strings.LastIndex(entry, "=")
+		if p == -1 {
+			s.logError("MAIL - bad smtpd_scan_mode entry " + entry)
+			continue
+		}
+		if listenerMatch(entry[:p], s.conn.LocalAddr()) {
+			return strings.ToLower(strings.TrimSpace(entry[p+1:])) == "async"
+		}
+	}
+	return false
+}
+
+// queueAddForScan puts message in queue waiting for scan
+func (s *SMTPServerSession) queueAddForScan(rawMessage *[]byte, sendAt time.Time) (uuid string, err error) {
+	ctx := s.checkContext()
+	uuid, err = queueAdd(rawMessage, ctx.envelope, ctx.authUser, sendAt, 6, s.uuid)
+	if err != nil {
+		return
+	}
+	job := ScanJob{
+		Uuid:       uuid,
+		SessionId:  s.uuid,
+		MailFrom:   ctx.envelope.MailFrom,
+		RcptTo:     strings.Join(ctx.envelope.RcptTo, ";"),
+		AuthUser:   ctx.authUser,
+		RemoteAddr: s.conn.RemoteAddr().String(),
+		LocalAddr:  ctx.localAddr,
+		Helo:       ctx.helo,
+		Trusted:    ctx.trusted,
+		SpfResult:  string(ctx.spfResult),
+		SpfDomain:  ctx.spfDomain,
+		CreatedAt:  time.Now(),
+	}
+	if err = DB.Create(&job).Error; err != nil {
+		scanAsyncDelete(uuid)
+		return "", err
+	}
+	scanAsyncPush(scanAsyncTask{job, ctx})
+	return
+}
+
+// scanAsyncPush queues task, if queue is full task will be resumed by the
+// next sweep
+func scanAsyncPush(task scanAsyncTask) {
+	scanAsyncPending.Lock()
+	defer scanAsyncPending.Unlock()
+	if scanAsyncPending.jobs[task.job.Id] {
+		return
+	}
+	select {
+	case scanAsyncQueue <- task:
+		scanAsyncPending.jobs[task.job.Id] = true
+	default:
+		Log.Info("smtpd scan - queue is full, scan of " + task.job.Uuid + " delayed")
+	}
+}
+
+// scanAsyncSweep resumes pending scans
+func scanAsyncSweep() {
+	jobs := []ScanJob{}
+	if err := DB.Where("lease_owner = ? OR lease_expires_at < ?", "", time.Now()).Order("id").Find(&jobs).Error; err != nil {
+		Log.Error("smtpd scan - unable to get pending scans - " + err.Error())
+		return
+	}
+	for _, job := range jobs {
+		scanAsyncPush(scanAsyncTask{job, nil})
+	}
+}
+
+// LaunchScanAsync launches workers scanning messages accepted without scan
+func LaunchScanAsync() {
+	workers := Cfg.GetSmtpdScanAsyncWorkers()
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for task := range scanAsyncQueue {
+				scanAsyncRun(task)
+				scanAsyncPending.Lock()
+				delete(scanAsyncPending.jobs, task.job.Id)
+				scanAsyncPending.Unlock()
+			}
+		}()
+	}
+	for {
+		// jobs of dead sessions are swept by the leader node
+		if ClusterLeader("scan-async-sweep", 5*time.Minute) {
+			scanAsyncSweep()
+		}
+		time.Sleep(1 * time.Minute)
+	}
+}
+
+// context returns check context of job
+func (job *ScanJob) context() *smtpdCheckContext {
+	logPrefix := "smtpd scan " + job.Uuid + " -"
+	logger := Log.With("subsystem", "smtpd", "session", job.SessionId, "message", job.Uuid)
+	ctx := &smtpdCheckContext{
+		envelope:  message.Envelope{MailFrom: job.MailFrom, RcptTo: strings.Split(job.RcptTo, ";")},
+		localAddr: job.LocalAddr,
+		helo:      job.Helo,
+		trusted:   job.Trusted,
+		authUser:  job.AuthUser,
+		spfResult: spfResult(job.SpfResult),
+		spfDomain: job.SpfDomain,
+		log: func(msg ...string) {
+			logger.Info(logPrefix, strings.Join(msg, " "))
+		},
+		logError: func(msg ...string) {
+			logger.Error(logPrefix, strings.Join(msg, " "))
+		},
+	}
+	if host, _, err := net.SplitHostPort(job.RemoteAddr); err == nil {
+		ctx.remoteIP = net.ParseIP(host)
+	}
+	return ctx
+}
+
+// claim leases job to this node, it returns false if job is leased by
+// another node or is done
+func (job *ScanJob) claim() (bool, error) {
+	now, owner := time.Now(), ClusterNodeId()
+	lease := now.Add(scanAsyncLeaseTTL)
+	r := DB.Model(ScanJob{}).Where("id = ? AND (lease_owner = ? OR lease_owner = ? OR lease_expires_at < ?)", job.Id, "", owner, now).Updates(map[string]interface{}{"lease_owner": owner, "lease_expires_at": lease})
+	if r.Error != nil {
+		return false, r.Error
+	}
+	if r.RowsAffected != 1 {
+		return false, nil
+	}
+	job.LeaseOwner, job.LeaseExpiresAt = owner, lease
+	return true, nil
+}
+
+// scanAsyncRun runs the filter chain on message of task and applies its
+// verdict
+func scanAsyncRun(task scanAsyncTask) {
+	job := task.job
+	ctx := task.ctx
+	if ctx == nil {
+		ctx = job.context()
+	}
+	claimed, err := job.claim()
+	if err != nil {
+		ctx.logError("unable to claim scan - " + err.Error())
+		return
+	}
+	if !claimed {
+		ctx.log("scan is run by another node")
+		return
+	}
+	qStore, err := NewStore(Cfg.GetStoreDriver(), Cfg.GetStoreSource())
+	if err != nil {
+		ctx.logError("unable to get store - " + err.Error())
+		return
+	}
+	reader, err := qStore.Get(job.Uuid)
+	if err != nil {
+		ctx.logError("unable to get message from store - " + err.Error())
+		return
+	}
+	defer reader.Close()
+	raw, err := ioutil.ReadAll(reader)
+	if err != nil {
+		ctx.logError("unable to read message from store - " + err.Error())
+		return
+	}
+	original := len(raw)
+
+	// verdict
+	v := smtpdVerdict{action: smtpdActionAccept}
+	shadow := func(sv smtpdVerdict) {
+		ctx.log(fmt.Sprintf("%s - SHADOW - would %s - %s", sv.check, sv.action, sv.reason))
+	}
+	for _, check := range smtpdDataChecks {
+		cv := enforcedVerdict(check(ctx, &raw), ctx.envelope, ctx.log, shadow)
+		if cv.action > smtpdActionTag {
+			v = cv
+			break
+		}
+		if cv.action == smtpdActionTag {
+			ctx.log(fmt.Sprintf("%s - message tagged - %s", cv.check, cv.reason))
+		}
+		for _, h := range cv.headers {
+			prependHeader(&raw, h)
+		}
+	}
+
+	switch v.action {
+	case smtpdActionTempfail:
+		job.Attempts++
+		if job.Attempts < scanAsyncMaxAttempts {
+			ctx.log(fmt.Sprintf("%s - tempfail, scan will be retried - %s", v.check, v.reason))
+			DB.Model(&job).Updates(map[string]interface{}{"attempts": job.Attempts, "lease_owner": ""})
+			return
+		}
+		ctx.log(fmt.Sprintf("%s - tempfail, max attempts reached, message will be delivered - %s", v.check, v.reason))
+		err = scanAsyncRelease(qStore, job.Uuid, raw, len(raw) != original, ctx.authResults)
+	case smtpdActionReject:
+		ctx.log(fmt.Sprintf("%s - %s - message will be bounced - %s", v.check, v.action, v.reason))
+		err = scanAsyncBounce(job.Uuid, v.check+": "+v.reason)
+	case smtpdActionDiscard:
+		ctx.log(fmt.Sprintf("%s - message discarded - %s", v.check, v.reason))
+		err = scanAsyncDelete(job.Uuid)
+	case smtpdActionQuarantine:
+		for _, h := range v.headers {
+			prependHeader(&raw, h)
+		}
+		var id string
+		if id, err = QuarantineAdd(&raw, ctx.envelope, job.AuthUser, job.RemoteAddr, v.check, v.reason); err == nil {
+			ctx.log(fmt.Sprintf("%s - message quarantined as %s - %s", v.check, id, v.reason))
+			err = scanAsyncDelete(job.Uuid)
+		}
+	default:
+		err = scanAsyncRelease(qStore, job.Uuid, raw, len(raw) != original, ctx.authResults)
+	}
+	if err != nil {
+		ctx.logError("unable to apply verdict, scan will be retried - " + err.Error())
+		DB.Model(&job).Update("lease_owner", "")
+		return
+	}
+	metricsMessage(v.action, v.check)
+	if v.action != smtpdActionAccept {
+		webhookEmit(WebhookEvent{
+			Event:     WebhookEventSpam,
+			QueueId:   job.Uuid,
+			SessionId: job.SessionId,
+			MessageId: string(message.RawGetMessageId(&raw)),
+			MailFrom:  job.MailFrom,
+			RcptTo:    ctx.envelope.RcptTo,
+			AuthUser:  job.AuthUser,
+			Reason:    v.check + ": " + v.reason,
+		})
+	}
+	if err = DB.Delete(&job).Error; err != nil {
+		ctx.logError("unable to remove scan job - " + err.Error())
+	}
+}
+
+// scanAsyncMessages returns queued messages of uuid waiting for scan
+func scanAsyncMessages(uuid string) (messages []QMessage, err error) {
+	messages = []QMessage{}
+	err = DB.Where("uuid = ? AND status = ?", uuid, 6).Find(&messages).Error
+	return
+}
+
+// scanAsyncRelease schedules delivery of messages of uuid, raw is stored if
+// it has been changed (headers added by checks), authResults are the results
+// of authentication checks
+func scanAsyncRelease(qStore Storer, uuid string, raw []byte, changed bool, authResults string) error {
+	if changed {
+		if err := qStore.Put(uuid, bytes.NewReader(raw)); err != nil {
+			return err
+		}
+	}
+	messages, err := scanAsyncMessages(uuid)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		q := &messages[i]
+		q.Status = 2
+		q.AuthResults = authResults
+		if q.NextDeliveryScheduledAt.Before(time.Now()) {
+			q.NextDeliveryScheduledAt = time.Now()
+		}
+		if err = q.SaveInDb(); err != nil {
+			return err
+		}
+		if err = q.publish(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanAsyncBounce bounces messages of uuid
+func scanAsyncBounce(uuid, reason string) error {
+	messages, err := scanAsyncMessages(uuid)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		q := &messages[i]
+		q.Status = 3
+		q.BounceReason = reason
+		if err = q.SaveInDb(); err != nil {
+			return err
+		}
+		if err = q.publish(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanAsyncDelete removes messages of uuid from queue
+func scanAsyncDelete(uuid string) error {
+	messages, err := scanAsyncMessages(uuid)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		if err = messages[i].Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,13 +2,13 @@ package core
 
 import (
 	"bytes"
-	"crypto/rand"
 	"crypto/tls"
 	"encoding/base64"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/mail"
-	"path"
 	"runtime/debug"
 	"strconv"
 	"strings"
@@ -35,6 +35,9 @@ type SMTPServerSession struct {
 	logger         *Logger
 	timer          *time.Timer // for timeout
 	timeout        time.Duration
+	dataTimeout    time.Duration // between blocks of data
+	tlsTimeout     time.Duration // TLS handshake
+	endOfSession   time.Time     // max end of session (zero if unlimited)
 	tls            bool
 	tlsVersion     string
 	user           *User
@@ -44,8 +47,32 @@ type SMTPServerSession struct {
 	envelope       message.Envelope
 	exitasap       chan int
 	rcptCount      int
+	mailCount      int // accepted transactions (LIMITS MAILMAX)
 	badRcptToCount int
 	vrfyCount      int
+	seenBdat       bool
+	bdatData       []byte
+	sendAt         time.Time // future release
+	memBase        int64     // memory accounted for connection
+	memTransaction int64     // memory accounted for current transaction
+	spfResult      spfResult
+	spfDomain      string
+	dnsbl          *dnsblResult
+	requireTLS     bool
+	requireAuth    bool
+	submission     bool   // session of a submission listener
+	hostname       string // identity presented to client
+	throttleIP     string // client IP counted by throttling
+	throttleUser   string // authenticated user counted by throttling
+	shadowVerdicts []smtpdVerdict
+	enforcedAction smtpdAction
+	milters        []*milterClient
+	milterInTx     bool
+	milterDiscard  bool
+	disabledVerbs  []string
+	trace          []MessageEvent    // events of current transaction
+	hookMetadata   map[string]string // metadata set by hooks (RegisterHook)
+	relay          string            // relay policy of listener ("" until first RCPT)
 }
 
 // NewSMTPServerSession returns a new SMTP session
@@ -62,7 +89,7 @@ func NewSMTPServerSession(conn net.Conn, isTLS bool) (sss *SMTPServerSession, er
 		sss.tls = true
 	}
 
-	sss.logger = Log
+	sss.logger = Log.With("subsystem", "smtpd", "session", sss.uuid, "remote", conn.RemoteAddr().String())
 
 	sss.rcptCount = 0
 	sss.badRcptToCount = 0
@@ -74,6 +101,16 @@ func NewSMTPServerSession(conn net.Conn, isTLS bool) (sss *SMTPServerSession, er
 	// timeout
 	sss.exitasap = make(chan int, 1)
 	sss.timeout = time.Duration(Cfg.GetSmtpdServerTimeout()) * time.Second
+	sss.dataTimeout, sss.tlsTimeout = sss.timeout, sss.timeout
+	if t := Cfg.GetSmtpdDataTimeout(); t > 0 {
+		sss.dataTimeout = time.Duration(t) * time.Second
+	}
+	if t := Cfg.GetSmtpdTLSHandshakeTimeout(); t > 0 {
+		sss.tlsTimeout = time.Duration(t) * time.Second
+	}
+	if t := Cfg.GetSmtpdSessionTimeout(); t > 0 {
+		sss.endOfSession = time.Now().Add(time.Duration(t) * time.Second)
+	}
 	sss.timer = time.AfterFunc(sss.timeout, sss.raiseTimeout)
 
 	return
@@ -81,11 +118,38 @@ func NewSMTPServerSession(conn net.Conn, isTLS bool) (sss *SMTPServerSession, er
 
 // timeout
 func (s *SMTPServerSession) raiseTimeout() {
+	if !s.endOfSession.IsZero() && !time.Now().Before(s.endOfSession) {
+		s.log("session timeout")
+		s.out("421 4.4.2 session timeout, closing connection")
+		s.exitAsap()
+		return
+	}
 	s.log("client timeout")
 	s.out("420 Client timeout.")
 	s.exitAsap()
 }
 
+// armTimeout (re)starts timeout timer for d (or until end of session if
+// it's sooner)
+func (s *SMTPServerSession) armTimeout(d time.Duration) {
+	if !s.endOfSession.IsZero() {
+		if left := s.endOfSession.Sub(time.Now()); left < d {
+			d = left
+		}
+	}
+	s.timer.Reset(d)
+}
+
+// deadline returns deadline of an I/O limited by d (or end of session if
+// it's sooner)
+func (s *SMTPServerSession) deadline(d time.Duration) time.Time {
+	deadline := time.Now().Add(d)
+	if !s.endOfSession.IsZero() && s.endOfSession.Before(deadline) {
+		return s.endOfSession
+	}
+	return deadline
+}
+
 // recoverOnPanic handles panic
 func (s *SMTPServerSession) recoverOnPanic() {
 	if err := recover(); err != nil {
@@ -103,7 +167,7 @@ func (s *SMTPServerSession) exitAsap() {
 
 // resetTimeout reset timeout
 func (s *SMTPServerSession) resetTimeout() {
-	s.timer.Reset(s.timeout)
+	s.armTimeout(s.timeout)
 }
 
 // Reset session
@@ -111,7 +175,20 @@ func (s *SMTPServerSession) reset() {
 	s.envelope.MailFrom = ""
 	s.seenMail = false
 	s.envelope.RcptTo = []string{}
+	s.envelope.MailParams = nil
+	s.envelope.RcptParams = nil
+	s.envelope.Metadata = nil
+	s.envelope.AuthResults = ""
 	s.rcptCount = 0
+	s.bdatData = nil
+	s.seenBdat = false
+	s.sendAt = time.Time{}
+	s.memReleaseTransaction()
+	s.spfResult = ""
+	s.spfDomain = ""
+	s.shadowVerdicts = nil
+	s.enforcedAction = smtpdActionAccept
+	s.milterAbort()
 	s.resetTimeout()
 }
 
@@ -179,12 +256,36 @@ func (s *SMTPServerSession) smtpGreeting() {
 		return
 	}
 	s.log(fmt.Sprintf("starting new transaction %d/%d", SmtpSessionsCount, Cfg.GetSmtpdConcurrencyIncoming()))
+	// throttling
+	if s.throttleConnect() {
+		return
+	}
+	// memory budget
+	if s.memConnect() {
+		return
+	}
 	// Microservices
 	if smtpdNewClient(s) {
 		return
 	}
+	// in-process hooks
+	if s.hooksRun(s.hookSession(HookConnect)) {
+		return
+	}
+	// disabled verbs, STARTTLS & AUTH requirements
+	s.disabledVerbsInit()
+	s.requirementsInit()
+	s.submissionInit()
+	// identity
+	s.hostname = identityHostname(IdentityContext{Listener: s.conn.LocalAddr(), LocalIP: addrIP(s.conn.LocalAddr().String())})
+	// DNSBL
+	s.dnsblCheck()
+	// milters
+	if s.milterConnect() {
+		return
+	}
 
-	o := "220 " + Cfg.GetMe() + " ESMTP"
+	o := "220 " + s.hostname + " ESMTP"
 	if !Cfg.GetHideServerSignature() {
 		o += " - tmail " + Version
 	}
@@ -192,6 +293,7 @@ func (s *SMTPServerSession) smtpGreeting() {
 	s.out(o)
 	if s.tls {
 		s.log("secured via " + tlsGetVersion(s.connTLS.ConnectionState().Version) + " " + tlsGetCipherSuite(s.connTLS.ConnectionState().CipherSuite))
+		metricsTLSSession("inbound", tlsGetVersion(s.connTLS.ConnectionState().Version))
 	}
 }
 
@@ -229,6 +331,13 @@ func (s *SMTPServerSession) heloBase(msg []string) (cont bool) {
 		s.out("504 helo command rejected, need fully-qualified hostname or address #5.5.2")
 		return false
 	}
+	// in-process hooks
+	hs := s.hookSession(HookHelo)
+	if s.hooksRun(hs) {
+		s.helo = ""
+		return false
+	}
+	s.helo = hs.Helo
 	s.seenHelo = true
 	return true
 }
@@ -237,7 +346,12 @@ func (s *SMTPServerSession) heloBase(msg []string) (cont bool) {
 func (s *SMTPServerSession) smtpHelo(msg []string) {
 	defer s.recoverOnPanic()
 	if s.heloBase(msg) {
-		s.out(fmt.Sprintf("250 %s", Cfg.GetMe()))
+		if stop, reply := s.milterHelo(); stop {
+			s.log("HELO - rejected by milter - " + reply)
+			s.out(reply)
+			return
+		}
+		s.out(fmt.Sprintf("250 %s", s.hostname))
 	}
 }
 
@@ -245,17 +359,44 @@ func (s *SMTPServerSession) smtpHelo(msg []string) {
 func (s *SMTPServerSession) smtpEhlo(msg []string) {
 	defer s.recoverOnPanic()
 	if s.heloBase(msg) {
-		s.out(fmt.Sprintf("250-%s", Cfg.GetMe()))
+		if stop, reply := s.milterHelo(); stop {
+			s.log("EHLO - rejected by milter - " + reply)
+			s.out(reply)
+			return
+		}
+		s.out(fmt.Sprintf("250-%s", s.hostname))
 		// Extensions
 		// Size
-		s.out(fmt.Sprintf("250-SIZE %d", Cfg.GetSmtpdMaxDataBytes()))
-		s.out("250-X-PEPPER")
+		extensions := []string{fmt.Sprintf("SIZE %d", s.maxDataBytes()), "X-PEPPER"}
+		// CHUNKING
+		if !s.verbDisabled("bdat") {
+			extensions = append(extensions, "CHUNKING")
+		}
+		// FUTURERELEASE
+		if extension := futureReleaseExtension(); extension != "" {
+			extensions = append(extensions, extension)
+		}
+		// passthrough parameters
+		extensions = append(extensions, passthroughExtensions()...)
+		// LIMITS
+		if extension := s.limitsExtension(); extension != "" {
+			extensions = append(extensions, extension)
+		}
 		// STARTTLS
-		if !s.tls {
-			s.out("250-STARTTLS")
+		if !s.tls && !s.verbDisabled("starttls") {
+			extensions = append(extensions, "STARTTLS")
+		}
+		// Auth (not before STARTTLS if it's required)
+		if (!s.requireTLS || s.tls) && !s.verbDisabled("auth") {
+			extensions = append(extensions, "AUTH "+strings.ToUpper(strings.Join(Cfg.GetSmtpdAuthMechanisms(), " ")))
+		}
+		for i, extension := range extensions {
+			if i == len(extensions)-1 {
+				s.out("250 " + extension)
+			} else {
+				s.out("250-" + extension)
+			}
 		}
-		// Auth
-		s.out("250 AUTH PLAIN")
 	}
 }
 
@@ -273,9 +414,20 @@ func (s *SMTPServerSession) smtpMailFrom(msg []string) {
 		s.out("503 5.5.2 Send hello first")
 		return
 	}
+	if s.smtpRequirements("MAIL") {
+		return
+	}
+	// memory used over high watermark
+	if s.memMail() {
+		return
+	}
+	// LIMITS MAILMAX
+	if s.limitsMail() {
+		return
+	}
 	msgLen := len(msg)
 	// mail from ?
-	if msgLen == 1 || !strings.HasPrefix(strings.ToLower(msg[1]), "from:") || msgLen > 4 {
+	if msgLen == 1 || !strings.HasPrefix(strings.ToLower(msg[1]), "from:") {
 		s.log("MAIL - Bad syntax: %s" + strings.Join(msg, " "))
 		s.pause(2)
 		s.out("501 5.5.4 Syntax: MAIL FROM:<address> [SIZE]")
@@ -297,44 +449,50 @@ func (s *SMTPServerSession) smtpMailFrom(msg []string) {
 		s.envelope.MailFrom = ""
 	}
 
-	// Extensions size
-	if len(extension) != 0 {
-		// Only SIZE is supported (and announced)
-		if len(extension) > 1 {
-			s.log("MAIL - Bad syntax: " + strings.Join(msg, " "))
-			s.pause(2)
-			s.out("501 5.5.4 Syntax: MAIL FROM:<address> [SIZE]")
-			return
+	// Extensions: SIZE, HOLDFOR|HOLDUNTIL (future release), then registered
+	// parameters (passed through to next hop)
+	for _, ext := range extension {
+		extValue := strings.SplitN(ext, "=", 2)
+		keyword := strings.ToLower(extValue[0])
+		builtin := keyword == "size" || keyword == "holdfor" || keyword == "holduntil"
+		if !builtin && passthroughParamRegistered(ext) {
+			s.envelope.MailParams = append(s.envelope.MailParams, ext)
+			continue
 		}
-		// SIZE
-		extValue := strings.Split(extension[0], "=")
 		if len(extValue) != 2 {
 			s.log(fmt.Sprintf("MAIL FROM - Bad syntax : %s ", strings.Join(msg, " ")))
 			s.pause(2)
 			s.out("501 5.5.4 Syntax: MAIL FROM:<address> [SIZE]")
 			return
 		}
-		if strings.ToLower(extValue[0]) != "size" {
+		switch keyword {
+		case "size":
+			if s.maxDataBytes() != 0 {
+				size, err := strconv.ParseInt(extValue[1], 10, 64)
+				if err != nil {
+					s.log(fmt.Sprintf("MAIL FROM - bad value for size extension SIZE=%v", extValue[1]))
+					s.pause(2)
+					s.out("501 5.5.4 Invalid arguments")
+					return
+				}
+				if int(size) > s.maxDataBytes() {
+					s.log(fmt.Sprintf("MAIL FROM - message exceeds fixed maximum message size %d/%d", size, s.maxDataBytes()))
+					s.out("552 message exceeds fixed maximum message size")
+					s.pause(1)
+					return
+				}
+			}
+		case "holdfor", "holduntil":
+			if !s.smtpFutureRelease(keyword, extValue[1]) {
+				s.sendAt = time.Time{}
+				return
+			}
+		default:
 			s.log(fmt.Sprintf("MAIL FROM - Unsuported extension : %s ", extValue[0]))
 			s.pause(2)
 			s.out("501 5.5.4 Invalid arguments")
 			return
 		}
-		if Cfg.GetSmtpdMaxDataBytes() != 0 {
-			size, err := strconv.ParseInt(extValue[1], 10, 64)
-			if err != nil {
-				s.log(fmt.Sprintf("MAIL FROM - bad value for size extension SIZE=%v", extValue[1]))
-				s.pause(2)
-				s.out("501 5.5.4 Invalid arguments")
-				return
-			}
-			if int(size) > Cfg.GetSmtpdMaxDataBytes() {
-				s.log(fmt.Sprintf("MAIL FROM - message exceeds fixed maximum message size %d/%d", size, Cfg.GetSmtpdMaxDataBytes()))
-				s.out("552 message exceeds fixed maximum message size")
-				s.pause(1)
-				return
-			}
-		}
 	}
 
 	// remove <>
@@ -385,8 +543,30 @@ func (s *SMTPServerSession) smtpMailFrom(msg []string) {
 			return
 		}
 	}
+	// in-process hooks
+	hs := s.hookSession(HookMail)
+	if s.hooksRun(hs) {
+		s.reset()
+		return
+	}
+	if hs.Envelope.MailFrom != s.envelope.MailFrom {
+		s.log("MAIL - sender " + s.envelope.MailFrom + " rewritten by hook to " + hs.Envelope.MailFrom)
+		s.envelope.MailFrom = hs.Envelope.MailFrom
+	}
+	if s.submissionSenderCheck() || s.throttleMail() || s.sendingCheck(false) || s.smtpDnsbl() {
+		s.reset()
+		return
+	}
+	if stop, reply := s.milterMail(); stop {
+		s.log("MAIL - rejected by milter - " + reply)
+		s.reset()
+		s.out(reply)
+		return
+	}
 	s.seenMail = true
+	s.mailCount++
 	s.log(fmt.Sprintf("new mail from %s", s.envelope.MailFrom))
+	s.spfCheckMailFrom()
 	s.out("250 ok")
 }
 
@@ -396,9 +576,10 @@ func (s *SMTPServerSession) smtpRcptTo(msg []string) {
 	var err error
 	rcptto := ""
 	s.rcptCount++
-	s.logDebug(fmt.Sprintf("RCPT TO %d/%d", s.rcptCount, Cfg.GetSmtpdMaxRcptTo()))
-	if Cfg.GetSmtpdMaxRcptTo() != 0 && s.rcptCount > Cfg.GetSmtpdMaxRcptTo() {
-		s.log(fmt.Sprintf("max RCPT TO command reached (%d)", Cfg.GetSmtpdMaxRcptTo()))
+	maxRcpt := s.throttleMaxRcpt()
+	s.logDebug(fmt.Sprintf("RCPT TO %d/%d", s.rcptCount, maxRcpt))
+	if maxRcpt != 0 && s.rcptCount > maxRcpt {
+		s.log(fmt.Sprintf("max RCPT TO command reached (%d)", maxRcpt))
 		s.out("451 4.5.3 max RCPT To commands reached for this sessions")
 		return
 	}
@@ -421,11 +602,14 @@ func (s *SMTPServerSession) smtpRcptTo(msg []string) {
 	}
 
 	// rcpt to: user
+	params := []string{}
 	if len(msg[1]) > 3 {
 		t := strings.Split(msg[1], ":")
 		rcptto = strings.Join(t[1:], ":")
+		params = msg[2:]
 	} else if len(msg) > 2 {
 		rcptto = msg[2]
+		params = msg[3:]
 	}
 
 	if len(rcptto) == 0 {
@@ -465,7 +649,47 @@ func (s *SMTPServerSession) smtpRcptTo(msg []string) {
 	}
 	// make domain part insensitive
 	rcptto = localDom[0] + "@" + strings.ToLower(localDom[1])
+	// BATV: valid tags are removed, bounces to untagged addresses are rejected
+	untagged, ok, err := batvCheckRcpt(s.envelope.MailFrom, rcptto)
+	if err != nil {
+		s.logError("RCPT - unable to check BATV tag of " + rcptto + ". " + err.Error())
+		s.out("455 4.3.0 oops, problem with bounce address tag validation")
+		return
+	}
+	if !ok {
+		s.log("RCPT - bounce to " + rcptto + " rejected, address is not tagged (BATV)")
+		s.out("550 5.7.1 Sorry, bounce rejected, this address did not send the message")
+		s.pause(2)
+		return
+	}
+	if untagged != rcptto {
+		s.logDebug("RCPT - BATV tag of " + rcptto + " removed")
+		rcptto = untagged
+		localDom = strings.Split(rcptto, "@")
+	}
+	// rewrite rules
+	if rewritten := RewriteAddress(RewriteRecipient, rcptto); rewritten != rcptto {
+		s.log("RCPT - " + rcptto + " rewritten to " + rewritten)
+		rcptto = rewritten
+		localDom = strings.Split(rcptto, "@")
+	}
+	// in-process hooks
+	hs := s.hookSession(HookRcpt)
+	hs.Rcpt = rcptto
+	if s.hooksRun(hs) {
+		return
+	}
+	if hs.Rcpt != rcptto {
+		if localDom = strings.Split(hs.Rcpt, "@"); len(localDom) != 2 {
+			s.logError("RCPT - " + rcptto + " rewritten by hook to bad address " + hs.Rcpt)
+			s.out("455 4.3.0 oops, problem with recipient rewriting")
+			return
+		}
+		s.log("RCPT - " + rcptto + " rewritten by hook to " + hs.Rcpt)
+		rcptto = hs.Rcpt
+	}
 	// check rcpthost
+	var virtual *Alias
 	if !relay {
 		rcpthost, err := RcpthostGet(localDom[1])
 		if err != nil && err != gorm.RecordNotFound {
@@ -480,12 +704,17 @@ func (s *SMTPServerSession) smtpRcptTo(msg []string) {
 			if rcpthost.IsLocal {
 				s.logDebug(rcpthost.Hostname + " is local")
 				// check destination
-				exists, err := IsValidLocalRcpt(strings.ToLower(rcptto))
+				var exists bool
+				virtual, exists, err = aliasLookup(strings.ToLower(rcptto))
 				if err != nil {
 					s.logError("RCPT - relay access failed while checking validity of local rpctto. " + err.Error())
 					s.out("455 4.3.0 oops, problem with relay access")
 					return
 				}
+				// role address (postmaster, abuse) without mailbox
+				if !exists && roleAddressesIsRouted(rcptto) {
+					exists = true
+				}
 				if !exists {
 					s.log("RCPT - no mailbox here by that name: " + rcptto)
 					s.out("550 5.5.1 Sorry, no mailbox here by that name")
@@ -499,33 +728,92 @@ func (s *SMTPServerSession) smtpRcptTo(msg []string) {
 			}
 		}
 	}
-	// User authentified & access granted ?
-	if !relay && s.user != nil {
-		relay = s.user.AuthRelay
-	}
-
-	// Remote IP authorised ?
+	// Relay policy of listener: authenticated user, trusted networks,
+	// POP/IMAP-before-SMTP
 	if !relay {
-		relay, err = IpCanRelay(s.conn.RemoteAddr())
+		var reply string
+		relay, reply, err = s.relayAllowed()
 		if err != nil {
-			s.logError("RCPT - relay access failed while checking if IP is allowed to relay. " + err.Error())
+			s.logError("RCPT - relay access failed while checking if client is allowed to relay. " + err.Error())
 			s.out("455 4.3.0 oops, problem with relay access")
 			return
 		}
+		if !relay {
+			s.log("Relay access denied (relay policy " + s.relay + ") - from " + s.envelope.MailFrom + " to " + rcptto)
+			s.out(reply)
+			s.pause(2)
+			return
+		}
 	}
 
-	// Relay denied
-	if !relay {
-		s.log("Relay access denied - from " + s.envelope.MailFrom + " to " + rcptto)
-		s.out("554 5.7.1 Relay access denied")
-		s.pause(2)
+	// LIMITS RCPTDOMAINMAX
+	if s.limitsRcptDomain(rcptto) {
+		return
+	}
+
+	// sending quotas of authenticated user
+	if s.sendingCheck(true) {
+		return
+	}
+
+	// greylisting
+	if s.smtpGreylist(rcptto) {
 		return
 	}
 
-	// Check if there is already this recipient
-	if !IsStringInSlice(rcptto, s.envelope.RcptTo) {
-		s.envelope.RcptTo = append(s.envelope.RcptTo, rcptto)
-		s.log("RCPT - + " + rcptto)
+	// milters
+	if stop, reply := s.milterRcpt(rcptto); stop {
+		s.log("RCPT - " + rcptto + " rejected by milter - " + reply)
+		s.out(reply)
+		return
+	}
+
+	// virtual aliases
+	rcpts := []string{rcptto}
+	if virtual != nil {
+		if rcpts, err = aliasExpandVirtual(rcptto, virtual); err != nil {
+			if _, ok := err.(*AliasLoopError); ok {
+				s.log("RCPT - " + rcptto + " rejected - " + err.Error())
+				s.out("550 5.4.6 Routing loop detected")
+				return
+			}
+			s.logError("RCPT - unable to expand virtual aliases of " + rcptto + ". " + err.Error())
+			s.out("455 4.3.0 oops, problem with virtual aliases")
+			return
+		}
+		s.log("RCPT - " + rcptto + " expanded to " + strings.Join(rcpts, " "))
+	}
+	// expanded recipients count against max RCPT
+	if maxRcpt != 0 {
+		count := len(s.envelope.RcptTo)
+		for _, rcpt := range rcpts {
+			if !IsStringInSlice(rcpt, s.envelope.RcptTo) {
+				count++
+			}
+		}
+		if count > maxRcpt {
+			s.log(fmt.Sprintf("RCPT - %s rejected, expansion exceeds max recipients (%d)", rcptto, maxRcpt))
+			s.out("452 4.5.3 Too many recipients")
+			return
+		}
+	}
+
+	for _, rcpt := range rcpts {
+		// Check if there is already this recipient
+		if IsStringInSlice(rcpt, s.envelope.RcptTo) {
+			continue
+		}
+		s.envelope.RcptTo = append(s.envelope.RcptTo, rcpt)
+		s.log("RCPT - + " + rcpt)
+		// registered parameters are passed through to next hop
+		for _, param := range params {
+			if passthroughParamRegistered(param) {
+				if s.envelope.RcptParams == nil {
+					s.envelope.RcptParams = make(map[string][]string)
+				}
+				s.envelope.RcptParams[rcpt] = append(s.envelope.RcptParams[rcpt], param)
+			}
+		}
 	}
 	s.out("250 ok")
 }
@@ -645,6 +933,14 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 		return
 	}
 
+	// RFC 3030 2: DATA and BDAT commands cannot be used in the same transaction
+	if s.seenBdat {
+		s.log("DATA - mixed with BDAT")
+		s.pause(2)
+		s.out("503 5.5.1 DATA not allowed after BDAT")
+		return
+	}
+
 	if len(msg) > 1 {
 		s.log("DATA - invalid syntax: " + strings.Join(msg, " "))
 		s.pause(2)
@@ -665,6 +961,10 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 	flagLineMightMatchDelivered := true
 	flagLineMightMatchCRLF := true
 	state := 1
+	// memory budget: data is dropped when it's exhausted, end of data is
+	// still waited for
+	memReserved := 0
+	memExhausted := false
 
 	doLoop := true
 
@@ -672,7 +972,17 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 		if !doLoop {
 			break
 		}
-		s.resetTimeout()
+		if memExhausted {
+			rawMessage = rawMessage[:0]
+		} else if dataBytes >= memReserved {
+			if s.memReserve(smtpdMemoryChunk, true) {
+				memReserved += smtpdMemoryChunk
+			} else {
+				memExhausted = true
+				rawMessage = nil
+			}
+		}
+		s.armTimeout(s.dataTimeout)
 		_, err := s.conn.Read(ch)
 		s.timer.Stop()
 		if err != nil {
@@ -807,34 +1117,142 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 		}
 
 		// Max databytes reached ?
-		if dataBytes > Cfg.GetSmtpdMaxDataBytes() {
-			s.log(fmt.Sprintf("MAIL - Message size (%d) exceeds maxDataBytes (%d).", dataBytes, Cfg.GetSmtpdMaxDataBytes()))
+		if dataBytes > s.maxDataBytes() {
+			s.log(fmt.Sprintf("MAIL - Message size (%d) exceeds maxDataBytes (%d).", dataBytes, s.maxDataBytes()))
 			s.out("552 5.3.4 sorry, that message size exceeds my databytes limit")
 			//s.purgeConn()
 			s.reset()
 			return
 		}
 	}
+	if memExhausted {
+		s.memRefuseMessage("data")
+		return
+	}
+	s.processMessage(rawMessage)
+}
 
-	// scan
-	// clamav
-	if Cfg.GetSmtpdClamavEnabled() {
-		found, virusName, err := NewClamav().ScanStream(bytes.NewReader(rawMessage))
-		Log.Debug("clamav scan result", found, virusName, err)
-		if err != nil {
-			s.logError("MAIL - clamav: " + err.Error())
-			s.out("454 4.3.0 scanner failure")
-			//s.purgeConn()
-			s.reset()
-			return
-		}
-		if found {
-			s.out("554 5.7.1 message infected by " + virusName)
-			s.log("MAIL - infected by " + virusName)
-			//s.purgeConn()
-			s.reset()
-			return
-		}
+// BDAT (RFC 3030 CHUNKING)
+// chunks are accumulated in s.bdatData until the LAST one is received
+func (s *SMTPServerSession) smtpBdat(msg []string) {
+	defer s.recoverOnPanic()
+	if len(msg) < 2 || len(msg) > 3 || (len(msg) == 3 && strings.ToLower(msg[2]) != "last") {
+		s.log("BDAT - invalid syntax: " + strings.Join(msg, " "))
+		s.pause(2)
+		s.out("501 5.5.4 syntax: BDAT <chunk-size> [LAST]")
+		return
+	}
+	chunkSize, err := strconv.ParseInt(msg[1], 10, 64)
+	if err != nil || chunkSize < 0 {
+		// we don't know how many bytes the client is going to send, the only
+		// safe thing to do is to close the connection
+		s.log("BDAT - invalid chunk size: " + strings.Join(msg, " "))
+		s.out("501 5.5.4 invalid chunk size")
+		s.exitAsap()
+		return
+	}
+	last := len(msg) == 3
+
+	// the chunk is sent whatever our response will be, so if we reject it
+	// we must read it anyway
+	reject := ""
+	if !s.seenMail || len(s.envelope.RcptTo) == 0 {
+		s.log("BDAT - out of sequence")
+		reject = "503 5.5.1 command out of sequence"
+	} else if s.maxDataBytes() != 0 && int64(len(s.bdatData))+chunkSize > int64(s.maxDataBytes()) {
+		s.log(fmt.Sprintf("MAIL - Message size (%d) exceeds maxDataBytes (%d).", int64(len(s.bdatData))+chunkSize, s.maxDataBytes()))
+		reject = "552 5.3.4 sorry, that message size exceeds my databytes limit"
+	} else if !s.memReserve(chunkSize, true) {
+		smtpdMemoryRefused("bdat")
+		s.log("MAIL - bdat - memory budget exhausted, message refused")
+		reject = "452 4.3.1 insufficient system resources, try again later"
+	}
+
+	s.armTimeout(s.dataTimeout)
+	if reject != "" {
+		_, err = io.CopyN(ioutil.Discard, s.conn, chunkSize)
+	} else {
+		// chunk size is sent by the client: the buffer grows with the bytes
+		// really received, not with the announced size
+		buf := bytes.NewBuffer(s.bdatData)
+		_, err = io.CopyN(buf, s.conn, chunkSize)
+		s.bdatData = buf.Bytes()
+	}
+	s.timer.Stop()
+	if err != nil {
+		s.logError("BDAT - unable to read chunk from conn. " + err.Error())
+		s.out("454 something wrong append will reading data from you")
+		s.exitAsap()
+		return
+	}
+
+	if reject != "" {
+		s.pause(2)
+		s.out(reject)
+		s.reset()
+		return
+	}
+	s.seenBdat = true
+
+	if !last {
+		s.out(fmt.Sprintf("250 2.0.0 %d octets received", chunkSize))
+		return
+	}
+
+	// Max hops reached ?
+	hops := message.RawCountHeaders(&s.bdatData, "received", "delivered")
+	if hops > Cfg.GetSmtpdMaxHops() {
+		s.log(fmt.Sprintf("MAIL - Message is looping. Hops : %d", hops))
+		s.out("554 5.4.6 too many hops, this message is looping")
+		s.reset()
+		return
+	}
+	rawMessage := s.bdatData
+	s.bdatData = nil
+	s.processMessage(rawMessage)
+}
+
+// processMessage handles a message received via DATA or BDAT: scan,
+// microservices, headers and finally queueing
+func (s *SMTPServerSession) processMessage(rawMessage []byte) {
+	// message trace
+	var id string
+	s.traceMessage(TraceAccepted, 0, fmt.Sprintf("helo %s, %d bytes", s.helo, len(rawMessage)))
+	defer func() { s.traceFlush(id, string(message.RawGetMessageId(&rawMessage))) }()
+
+	// parsed copies of message (checks, milters, headers)
+	if !s.memReserve(int64(len(rawMessage)), true) {
+		s.memRefuseMessage("process")
+		return
+	}
+
+	// journaling: copy of original message
+	journalEnvelope := s.envelope
+	journalRules, journalDirection := journalMatch(journalEnvelope)
+	var journalRaw []byte
+	if len(journalRules) != 0 {
+		journalRaw = append([]byte{}, rawMessage...)
+	}
+
+	// Authentication-Results with our authserv-id are forged
+	if n := authResultsStrip(&rawMessage); n != 0 {
+		s.log(fmt.Sprintf("MAIL - %d forged Authentication-Results header(s) removed", n))
+	}
+
+	// posting policy of groups
+	if s.smtpdGroupPost(&rawMessage) {
+		return
+	}
+
+	// checks (accept-then-scan: after queueing)
+	scanAsync := s.scanAsync()
+	if !scanAsync && s.runDataChecks(&rawMessage) {
+		return
+	}
+
+	// milters
+	if s.applyVerdict(s.milterData(&rawMessage), &rawMessage) {
+		return
 	}
 
 	// Message-ID
@@ -853,6 +1271,16 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 	// Microservice
 	stop, extraHeader := smtpdData(s, &rawMessage)
 	if stop {
+		metricsMessage(smtpdActionReject, "microservice")
+		s.traceMessage(TraceFiltered, 0, "microservice - reject")
+		s.shadowCompare(smtpdActionReject)
+		return
+	}
+	// in-process hooks
+	if s.hooksMessage(HookData, &rawMessage) {
+		metricsMessage(smtpdActionReject, "hook")
+		s.traceMessage(TraceFiltered, 0, "hook - reject")
+		s.shadowCompare(smtpdActionReject)
 		return
 	}
 	for _, header2add := range *extraHeader {
@@ -886,8 +1314,18 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 		recieved += fmt.Sprintf(" (authenticated as %s)", s.user.Login)
 	}
 
+	// submission (RFC 6409)
+	if s.submission {
+		recieved += " (submission)"
+	}
+
+	// DNSBL
+	if s.dnsbl != nil && len(s.dnsbl.listed) != 0 {
+		recieved += fmt.Sprintf(" (dnsbl %s)", s.dnsbl)
+	}
+
 	// local
-	recieved += fmt.Sprintf(" by %s (%s)", localIP, localHost)
+	recieved += fmt.Sprintf(" by %s (%s) (%s)", s.hostname, localIP, localHost)
 
 	// Proto
 	if s.tls {
@@ -908,22 +1346,87 @@ func (s *SMTPServerSession) smtpData(msg []string) {
 	rawMessage = append(h, rawMessage...)
 	recieved = ""
 
+	// rewrite rules of sender
+	if rewritten := RewriteAddress(RewriteSender, s.envelope.MailFrom); rewritten != s.envelope.MailFrom {
+		s.log("MAIL - sender " + s.envelope.MailFrom + " rewritten to " + rewritten)
+		s.envelope.MailFrom = rewritten
+	}
+
+	// header rules
+	s.headerRulesApply(&rawMessage)
+
 	rawMessage = append([]byte("X-Env-From: "+s.envelope.MailFrom+"\r\n"), rawMessage...)
 
-	// put message in queue
 	authUser := ""
 	if s.user != nil {
 		authUser = s.user.Login
 	}
-	id, err := QueueAddMessage(&rawMessage, s.envelope, authUser)
+
+	// in-process hooks, metadata are stored with queued messages
+	if s.hooksMessage(HookQueue, &rawMessage) {
+		metricsMessage(smtpdActionReject, "hook")
+		s.traceMessage(TraceFiltered, 0, "hook - reject")
+		s.shadowCompare(smtpdActionReject)
+		return
+	}
+	s.envelope.Metadata = s.hookMetadata
+
+	// put message in queue
+	sendAt := s.sendAt
+	if headerAt := s.futureReleaseFromHeader(&rawMessage); sendAt.IsZero() {
+		sendAt = headerAt
+	}
+	if scanAsync {
+		id, err = s.queueAddForScan(&rawMessage, sendAt)
+	} else {
+		id, err = queueAdd(&rawMessage, s.envelope, authUser, sendAt, 2, s.uuid)
+	}
 	if err != nil {
 		s.logError("MAIL - unable to put message in queue -", err.Error())
+		s.traceMessage(TraceRejected, 451, "queue error - "+err.Error())
 		s.out("451 temporary queue error")
 		s.reset()
+		id = ""
 		return
 	}
+	s.traceMessage(TraceQueued, 250, "queued as "+id)
+	// log records of the transaction carry message id
+	sessionLogger := s.logger
+	s.logger = s.logger.With("message", id)
+	defer func() { s.logger = sessionLogger }()
 	s.log("MAIL - message queued as", id)
+	s.webhookMessage(WebhookEventAccepted, id, "", &rawMessage)
+	// journaling, once message is queued: a client retrying after a queue
+	// error doesn't add journal entries
+	if len(journalRules) != 0 {
+		meta := JournalMetadata{
+			SessionId:  s.uuid,
+			MailFrom:   journalEnvelope.MailFrom,
+			RcptTo:     journalEnvelope.RcptTo,
+			Direction:  journalDirection,
+			RemoteAddr: s.conn.RemoteAddr().String(),
+			Helo:       s.helo,
+			AuthUser:   authUser,
+			ReceivedAt: time.Now(),
+		}
+		if err = journalMessage(&journalRaw, meta, journalRules); err != nil {
+			s.logError("MAIL - unable to journal message", id, "-", err.Error())
+		} else {
+			s.log("MAIL - message", id, "journaled ("+journalDirection+")")
+		}
+	}
+	if scanAsync {
+		s.log("MAIL - message", id, "will be scanned after acceptance")
+	} else {
+		metricsMessage(s.enforcedAction, "")
+	}
+	if !sendAt.IsZero() {
+		s.log("MAIL - delivery of", id, "scheduled at", sendAt.Format(time.RFC3339))
+	}
+	s.throttleMessageQueued()
+	s.sendingMessageQueued(len(rawMessage))
 	s.out(fmt.Sprintf("250 2.0.0 Ok: queued %s", id))
+	s.shadowCompare(s.enforcedAction)
 	s.reset()
 	return
 }
@@ -941,7 +1444,7 @@ func (s *SMTPServerSession) smtpStartTLS() {
 		return
 	}
 	//s.out("220 Ready to start TLS")
-	cert, err := tls.LoadX509KeyPair(path.Join(GetBasePath(), "ssl/server.crt"), path.Join(GetBasePath(), "ssl/server.key"))
+	tlsConfig, err := smtpdTLSConfig()
 	if err != nil {
 		msg := "TLS failed unable to load server keys: " + err.Error()
 		s.logError(msg)
@@ -949,20 +1452,16 @@ func (s *SMTPServerSession) smtpStartTLS() {
 		return
 	}
 
-	tlsConfig := tls.Config{
-		Certificates:       []tls.Certificate{cert},
-		InsecureSkipVerify: true,
-	}
-	tlsConfig.Rand = rand.Reader
-
 	s.out("220 Ready to start TLS nego")
 
 	//var tlsConn *tls.Conn
 	//tlsConn = tls.Server(client.socket, TLSconfig)
-	s.connTLS = tls.Server(s.conn, &tlsConfig)
+	s.connTLS = tls.Server(s.conn, tlsConfig)
 	// run a handshake
 	// errors.New("tls: unsupported SSLv2 handshake received")
+	s.connTLS.SetDeadline(s.deadline(s.tlsTimeout))
 	err = s.connTLS.Handshake()
+	s.connTLS.SetDeadline(time.Time{})
 	if err != nil {
 		msg := "454 - TLS handshake failed: " + err.Error()
 		if err.Error() == "tls: unsupported SSLv2 handshake received" {
@@ -974,66 +1473,157 @@ func (s *SMTPServerSession) smtpStartTLS() {
 		return
 	}
 	s.log("connection upgraded to " + tlsGetVersion(s.connTLS.ConnectionState().Version) + " " + tlsGetCipherSuite(s.connTLS.ConnectionState().CipherSuite))
+	metricsTLSSession("inbound", tlsGetVersion(s.connTLS.ConnectionState().Version))
 	//s.conn = net.Conn(tlsConn)
 	s.conn = s.connTLS
 	s.tls = true
 	s.seenHelo = false
 }
 
+// smtpsHandshake runs TLS handshake of SMTPS session (implicit TLS)
+func (s *SMTPServerSession) smtpsHandshake() bool {
+	s.connTLS.SetDeadline(s.deadline(s.tlsTimeout))
+	defer s.connTLS.SetDeadline(time.Time{})
+	if err := s.connTLS.Handshake(); err != nil {
+		s.log("SMTPS - TLS handshake failed: " + err.Error())
+		s.timer.Stop()
+		return false
+	}
+	state := s.connTLS.ConnectionState()
+	s.log("SMTPS - connection encrypted with " + tlsGetVersion(state.Version) + " " + tlsGetCipherSuite(state.CipherSuite))
+	metricsTLSSession("inbound", tlsGetVersion(state.Version))
+	return true
+}
+
 // SMTP AUTH
 // Return boolean closeCon
-// Pour le moment in va juste implémenter PLAIN
+// PLAIN, CRAM-MD5 & SCRAM-SHA-256 (see smtpd_sasl.go)
 func (s *SMTPServerSession) smtpAuth(rawMsg string) {
 	defer s.recoverOnPanic()
-	// TODO si pas TLS
-	//var authType, user, passwd string
-	//TODO si pas plain
+	if s.smtpRequirements("AUTH") {
+		return
+	}
 
-	//
 	splitted := strings.Split(rawMsg, " ")
+	if len(splitted) != 2 && len(splitted) != 3 {
+		s.out("501 malformed auth input (#5.5.4)")
+		s.log("malformed auth input: " + rawMsg)
+		s.exitAsap()
+		return
+	}
+	mechanism := strings.ToUpper(splitted[1])
+	if !saslMechanismEnabled(mechanism) {
+		s.out("504 5.5.4 unrecognized authentication mechanism")
+		s.log("auth mechanism " + mechanism + " is not enabled")
+		return
+	}
+
+	var err error
+	switch mechanism {
+	case "CRAM-MD5":
+		s.user, err = s.authCramMd5()
+	case "SCRAM-SHA-256":
+		initial := ""
+		if len(splitted) == 3 && splitted[2] != "=" {
+			var decoded []byte
+			if decoded, err = base64.StdEncoding.DecodeString(splitted[2]); err != nil {
+				err = errAuthMalformed
+				break
+			}
+			initial = string(decoded)
+		}
+		if err == nil {
+			s.user, err = s.authScramSha256(initial)
+		}
+	default: // PLAIN
+		s.user, err = s.authPlain(splitted)
+	}
+	if err != nil {
+		s.user = nil
+		switch err {
+		case ErrAuthNoSuchUser:
+			s.out("535 authentication failed - No such user (#5.7.1)")
+		case ErrAuthFailed:
+			s.out("535 authentication failed (#5.7.1)")
+		case errAuthMalformed:
+			s.out("501 malformed auth input (#5.5.4)")
+		case errAuthCancelled:
+			s.out("501 authentication cancelled (#5.7.0)")
+			s.log("auth " + mechanism + " cancelled by client")
+			return
+		default:
+			s.out("454 oops, problem with auth (#4.3.0)")
+			s.log("ERROR auth " + rawMsg + " err:" + err.Error())
+			s.exitAsap()
+			return
+		}
+		s.log("auth failed: " + rawMsg + " err:" + err.Error())
+		s.exitAsap()
+		return
+	}
+	s.log("auth succeed for user " + s.user.Login + " (" + mechanism + ")")
+	if s.throttleAuth() {
+		return
+	}
+	s.out("235 ok, go ahead (#2.0.0)")
+}
+
+// authReadLine reads a line of SASL exchange
+func (s *SMTPServerSession) authReadLine() (string, error) {
+	var line []byte
+	ch := make([]byte, 1)
+	for {
+		s.resetTimeout()
+		_, err := s.conn.Read(ch)
+		s.timer.Stop()
+		if err != nil {
+			return "", err
+		}
+		if ch[0] == 10 {
+			s.logDebug("< " + string(line))
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+		line = append(line, ch[0])
+	}
+}
+
+// authReadResponse reads and decodes a response of client to a challenge
+func (s *SMTPServerSession) authReadResponse() (string, error) {
+	line, err := s.authReadLine()
+	if err != nil {
+		s.log("error reading auth err:" + err.Error())
+		return "", errAuthMalformed
+	}
+	if line == "*" {
+		return "", errAuthCancelled
+	}
+	decoded, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		return "", errAuthMalformed
+	}
+	return string(decoded), nil
+}
+
+// authPlain handles AUTH PLAIN, it returns authenticated user
+func (s *SMTPServerSession) authPlain(splitted []string) (*User, error) {
 	var encoded string
 	if len(splitted) == 3 {
 		encoded = splitted[2]
-	} else if len(splitted) == 2 {
-		// refactor: readline function
-		var line []byte
-		ch := make([]byte, 1)
-		// return a
+	} else {
 		s.out("334 ")
 		// get encoded by reading next line
-		for {
-			s.timer.Reset(time.Duration(Cfg.GetSmtpdServerTimeout()) * time.Second)
-			_, err := s.conn.Read(ch)
-			s.timer.Stop()
-			if err != nil {
-				s.out("501 malformed auth input (#5.5.4)")
-				s.log("error reading auth err:" + err.Error())
-				s.exitAsap()
-				return
-			}
-			if ch[0] == 10 {
-				s.timer.Stop()
-				encoded = string(line)
-				s.logDebug("< " + encoded)
-				break
-			}
-			line = append(line, ch[0])
+		line, err := s.authReadLine()
+		if err != nil {
+			s.log("error reading auth err:" + err.Error())
+			return nil, errAuthMalformed
 		}
-
-	} else {
-		s.out("501 malformed auth input (#5.5.4)")
-		s.log("malformed auth input: " + rawMsg)
-		s.exitAsap()
-		return
+		encoded = line
 	}
 
 	// decode  "authorize-id\0userid\0passwd\0"
 	authData, err := base64.StdEncoding.DecodeString(encoded)
 	if err != nil {
-		s.out("501 malformed auth input (#5.5.4)")
-		s.log("malformed auth input: " + rawMsg + " err:" + err.Error())
-		s.exitAsap()
-		return
+		return nil, errAuthMalformed
 	}
 
 	// split
@@ -1044,33 +1634,13 @@ func (s *SMTPServerSession) smtpAuth(rawMsg string) {
 			i++
 			continue
 		}
+		if i > 2 {
+			return nil, errAuthMalformed
+		}
 		t[i] = append(t[i], b)
 	}
 	//authId := string(t[0])
-	authLogin := string(t[1])
-	authPasswd := string(t[2])
-
-	s.user, err = UserGet(authLogin, authPasswd)
-	if err != nil {
-		if err == gorm.RecordNotFound {
-			s.out("535 authentication failed - No such user (#5.7.1)")
-			s.log("auth failed: " + rawMsg + " err:" + err.Error())
-			s.exitAsap()
-			return
-		}
-		if err.Error() == "crypto/bcrypt: hashedPassword is not the hash of the given password" {
-			s.out("535 authentication failed (#5.7.1)")
-			s.log("auth failed: " + rawMsg + " err:" + err.Error())
-			s.exitAsap()
-			return
-		}
-		s.out("454 oops, problem with auth (#4.3.0)")
-		s.log("ERROR auth " + rawMsg + " err:" + err.Error())
-		s.exitAsap()
-		return
-	}
-	s.log("auth succeed for user " + s.user.Login)
-	s.out("235 ok, go ahead (#2.0.0)")
+	return authenticate(string(t[1]), string(t[2]))
 }
 
 // RSET SMTP ahandler
@@ -1094,6 +1664,12 @@ func (s *SMTPServerSession) handle() {
 
 	buffer := make([]byte, 1)
 
+	// SMTPS: TLS handshake before greeting
+	if s.tls && !s.smtpsHandshake() {
+		s.conn.Close()
+		return
+	}
+
 	// welcome (
 	s.smtpGreeting()
 
@@ -1133,36 +1709,49 @@ func (s *SMTPServerSession) handle() {
 				}
 				// get command, first word
 				verb := strings.ToLower(splittedMsg[0])
-				switch verb {
-				case "helo":
-					s.smtpHelo(splittedMsg)
-				case "ehlo":
-					//s.smtpEhlo(splittedMsg)
-					s.smtpEhlo(splittedMsg)
-				case "mail":
-					s.smtpMailFrom(splittedMsg)
-				case "vrfy":
-					s.smtpVrfy(splittedMsg)
-				case "expn":
-					s.smtpExpn(splittedMsg)
-				case "rcpt":
-					s.smtpRcptTo(splittedMsg)
-				case "data":
-					s.smtpData(splittedMsg)
-				case "starttls":
-					s.smtpStartTLS()
-				case "auth":
-					s.smtpAuth(strMsg)
-				case "rset":
-					s.rset()
-				case "noop":
-					s.noop()
-				case "quit":
-					s.smtpQuit()
-				default:
-					rmsg = "502 5.5.1 unimplemented"
-					s.log("unimplemented command from client:", strMsg)
-					s.out(rmsg)
+				if s.verbDisabled(verb) {
+					s.log("disabled command from client:", strMsg)
+					s.out("502 5.5.1 command disabled")
+				} else if verb == "mail" && smtpdDraining() {
+					s.log("tmail is shutting down, MAIL refused")
+					s.out("421 4.3.2 service shutting down, closing connection")
+					s.exitAsap()
+				} else {
+					switch verb {
+					case "helo":
+						s.smtpHelo(splittedMsg)
+					case "ehlo":
+						//s.smtpEhlo(splittedMsg)
+						s.smtpEhlo(splittedMsg)
+					case "mail":
+						s.smtpMailFrom(splittedMsg)
+					case "vrfy":
+						s.smtpVrfy(splittedMsg)
+					case "expn":
+						s.smtpExpn(splittedMsg)
+					case "rcpt":
+						s.smtpRcptTo(splittedMsg)
+					case "data":
+						s.smtpData(splittedMsg)
+					case "bdat":
+						s.smtpBdat(splittedMsg)
+					case "starttls":
+						s.smtpStartTLS()
+					case "auth":
+						s.smtpAuth(strMsg)
+					case "rset":
+						s.rset()
+					case "noop":
+						s.noop()
+					case "help":
+						s.smtpHelp(splittedMsg)
+					case "quit":
+						s.smtpQuit()
+					default:
+						rmsg = "502 5.5.1 unimplemented"
+						s.log("unimplemented command from client:", strMsg)
+						s.out(rmsg)
+					}
 				}
 				//s.resetTimeout()
 				msg = []byte{}
@@ -1172,6 +1761,9 @@ func (s *SMTPServerSession) handle() {
 		}
 	}()
 	<-s.exitasap
+	s.milterClose()
+	s.throttleRelease()
+	s.memRelease()
 	s.conn.Close()
 	s.log("EOT")
 	return
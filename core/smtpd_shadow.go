@@ -0,0 +1,93 @@
+package core
+
+// Shadow mode
+// Checks listed in smtpd_shadow_checks are run, their verdicts are logged and
+// counted but not enforced. Each shadow verdict is compared to the decision
+// actually enforced for the message so rules can be validated on live
+// traffic before being enabled.
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ShadowCheckStats represents the comparison report of a shadow check
+type ShadowCheckStats struct {
+	Verdicts int
+	Agree    int
+	Disagree int
+	// count of "shadow action -> enforced action"
+	Comparison map[string]int
+}
+
+var shadowStats = struct {
+	sync.Mutex
+	checks map[string]*ShadowCheckStats
+}{
+	checks: make(map[string]*ShadowCheckStats),
+}
+
+// isShadowCheck returns true if check must run in shadow mode
+func isShadowCheck(check string) bool {
+	for _, c := range Cfg.GetSmtpdShadowChecks() {
+		if c == check || c == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// shadowRecord records a shadow verdict for current message
+func (s *SMTPServerSession) shadowRecord(v smtpdVerdict) {
+	s.log(fmt.Sprintf("MAIL - %s - SHADOW - would %s - %s", v.check, v.action, v.reason))
+	s.shadowVerdicts = append(s.shadowVerdicts, v)
+}
+
+// shadowCompare compares shadow verdicts of current message to the enforced
+// action and updates stats
+func (s *SMTPServerSession) shadowCompare(enforced smtpdAction) {
+	if len(s.shadowVerdicts) == 0 {
+		return
+	}
+	shadowStats.Lock()
+	defer shadowStats.Unlock()
+	for _, v := range s.shadowVerdicts {
+		stats, ok := shadowStats.checks[v.check]
+		if !ok {
+			stats = &ShadowCheckStats{Comparison: make(map[string]int)}
+			shadowStats.checks[v.check] = stats
+		}
+		stats.Verdicts++
+		stats.Comparison[v.action.String()+" -> "+enforced.String()]++
+		if v.action == enforced {
+			stats.Agree++
+		} else {
+			stats.Disagree++
+			s.log(fmt.Sprintf("MAIL - %s - SHADOW - disagreement: shadow %s, enforced %s", v.check, v.action, enforced))
+		}
+	}
+	s.shadowVerdicts = nil
+}
+
+// ShadowGetStats returns comparison reports of shadow checks
+func ShadowGetStats() map[string]ShadowCheckStats {
+	shadowStats.Lock()
+	defer shadowStats.Unlock()
+	report := make(map[string]ShadowCheckStats)
+	for check, stats := range shadowStats.checks {
+		c := *stats
+		c.Comparison = make(map[string]int)
+		for k, v := range stats.Comparison {
+			c.Comparison[k] = v
+		}
+		report[check] = c
+	}
+	return report
+}
+
+// ShadowResetStats resets comparison reports
+func ShadowResetStats() {
+	shadowStats.Lock()
+	shadowStats.checks = make(map[string]*ShadowCheckStats)
+	shadowStats.Unlock()
+}
@@ -0,0 +1,346 @@
+package core
+
+// Graceful shutdown and restart of smtpd
+// When tmail stops (SIGTERM) listeners are closed, active sessions have
+// smtpd_shutdown_grace seconds to end (MAIL is answered by 421 meanwhile)
+// and remaining ones are closed with a 421 reply. When tmail restarts
+// (SIGUSR2, tmail restart) listeners are handed over: the new executable is
+// started with their sockets (TMAIL_INHERITED_LISTENERS) while this process
+// keeps serving. Once smtpd of the new executable serves (it closes the
+// ready pipe of TMAIL_HANDOVER) this process stops accepting connections,
+// sessions and deliveries end and it exits: the new executable starts its
+// other services (nsqd, deliverd, REST...) when the previous pipe is closed.
+// If the new executable fails to start this process keeps running.
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// environment variable of inherited listeners: address=fd separated by ;
+const inheritedListenersEnv = "TMAIL_INHERITED_LISTENERS"
+
+// environment variable of pipes of a handover: fds ready,previous
+const handoverEnv = "TMAIL_HANDOVER"
+
+// handoverTimeout is the max time the new executable has to serve
+const handoverTimeout = time.Minute
+
+// smtpdListener is a listener of smtpd
+type smtpdListener struct {
+	address  string
+	listener net.Listener
+}
+
+// listeners & sessions of smtpd
+var smtpdState = struct {
+	sync.Mutex
+	listeners []smtpdListener
+	sessions  map[*SMTPServerSession]bool
+	draining  bool
+}{
+	sessions: make(map[*SMTPServerSession]bool),
+}
+
+// smtpdListen returns listener of address, inherited from previous
+// executable if it has been handed over
+func smtpdListen(network, address string) (listener net.Listener, err error) {
+	if fd, ok := inheritedListener(address); ok {
+		file := os.NewFile(fd, address)
+		listener, err = net.FileListener(file)
+		file.Close()
+	} else {
+		listener, err = net.Listen(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	smtpdState.Lock()
+	smtpdState.listeners = append(smtpdState.listeners, smtpdListener{address, listener})
+	smtpdState.Unlock()
+	return listener, nil
+}
+
+// inheritedListener returns fd of listener of address inherited from
+// previous executable
+func inheritedListener(address string) (uintptr, bool) {
+	for _, entry := range strings.Split(os.Getenv(inheritedListenersEnv), ";") {
+		p := strings.LastIndex(entry, "=")
+		if p < 1 || entry[:p] != address {
+			continue
+		}
+		fd, err := strconv.Atoi(entry[p+1:])
+		if err != nil {
+			return 0, false
+		}
+		return uintptr(fd), true
+	}
+	return 0, false
+}
+
+// SmtpdInheritedListenersClose closes inherited listeners which are not
+// listeners of dsns (smtpd_dsns has changed)
+func SmtpdInheritedListenersClose(dsns []dsn) {
+	for _, entry := range strings.Split(os.Getenv(inheritedListenersEnv), ";") {
+		p := strings.LastIndex(entry, "=")
+		if p < 1 {
+			continue
+		}
+		used := false
+		for _, d := range dsns {
+			used = used || d.tcpAddr.String() == entry[:p]
+		}
+		if fd, err := strconv.Atoi(entry[p+1:]); err == nil && !used {
+			syscall.Close(fd)
+		}
+	}
+}
+
+// smtpdDraining returns true if smtpd is stopping
+func smtpdDraining() bool {
+	smtpdState.Lock()
+	defer smtpdState.Unlock()
+	return smtpdState.draining
+}
+
+// smtpdSessionStart registers active session s
+func smtpdSessionStart(s *SMTPServerSession) {
+	smtpdState.Lock()
+	smtpdState.sessions[s] = true
+	smtpdState.Unlock()
+}
+
+// smtpdSessionEnd unregisters session s
+func smtpdSessionEnd(s *SMTPServerSession) {
+	smtpdState.Lock()
+	delete(smtpdState.sessions, s)
+	smtpdState.Unlock()
+}
+
+// smtpdWaitSessions waits (at most d) for the end of active sessions, it
+// returns the number of sessions still active
+func smtpdWaitSessions(d time.Duration) int {
+	deadline := time.Now().Add(d)
+	for {
+		smtpdState.Lock()
+		active := len(smtpdState.sessions)
+		smtpdState.Unlock()
+		if active == 0 || !time.Now().Before(deadline) {
+			return active
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// SmtpdStop stops smtpd: listeners are closed (sockets handed over stay
+// open in the new executable), active sessions have smtpd_shutdown_grace
+// seconds to end, remaining ones are closed (421)
+func SmtpdStop() {
+	smtpdState.Lock()
+	smtpdState.draining = true
+	listeners := smtpdState.listeners
+	smtpdState.listeners = nil
+	smtpdState.Unlock()
+	for _, l := range listeners {
+		l.listener.Close()
+	}
+
+	grace := time.Duration(Cfg.GetSmtpdShutdownGrace()) * time.Second
+	active := smtpdWaitSessions(grace)
+	if active == 0 {
+		return
+	}
+	Log.Info("smtpd - closing " + strconv.Itoa(active) + " sessions not ended after " + grace.String())
+	smtpdState.Lock()
+	for s := range smtpdState.sessions {
+		s.shutdown()
+	}
+	smtpdState.Unlock()
+	smtpdWaitSessions(2 * time.Second)
+}
+
+// Handover is a handover of smtpd listeners to a new executable
+type Handover struct {
+	// Files are extra files of the new executable (fd 3 onwards)
+	Files []*os.File
+	// Env is the environment of the new executable
+	Env      []string
+	ready    *os.File // closed by the new executable once its smtpd serves
+	previous *os.File // kept open until this process exits
+}
+
+// SmtpdHandover prepares handover of smtpd listeners (they keep serving):
+// files of the new executable are copies of listeners and ends of pipes of
+// the handover, its environment is the current one, values of config file
+// (read again), inherited listeners and pipes
+func SmtpdHandover() (*Handover, error) {
+	// config file is optional (environment of programs embedding tmail)
+	values, _ := configFileRead(ConfigFile())
+	h := &Handover{}
+	for _, kv := range os.Environ() {
+		name := kv
+		if p := strings.Index(kv, "="); p != -1 {
+			name = kv[:p]
+		}
+		if _, ok := values[name]; ok || name == inheritedListenersEnv || name == handoverEnv {
+			continue
+		}
+		h.Env = append(h.Env, kv)
+	}
+	for name, value := range values {
+		h.Env = append(h.Env, name+"="+value)
+	}
+
+	smtpdState.Lock()
+	inherited := []string{}
+	for _, l := range smtpdState.listeners {
+		tcpListener, ok := l.listener.(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		file, err := tcpListener.File()
+		if err != nil {
+			smtpdState.Unlock()
+			h.Abort()
+			return nil, errors.New("unable to hand over listener " + l.address + " - " + err.Error())
+		}
+		inherited = append(inherited, l.address+"="+strconv.Itoa(3+len(h.Files)))
+		h.Files = append(h.Files, file)
+	}
+	smtpdState.Unlock()
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		h.Abort()
+		return nil, err
+	}
+	previousR, previous, err := os.Pipe()
+	if err != nil {
+		ready.Close()
+		readyW.Close()
+		h.Abort()
+		return nil, err
+	}
+	h.ready, h.previous = ready, previous
+	h.Env = append(h.Env, inheritedListenersEnv+"="+strings.Join(inherited, ";"), handoverEnv+"="+strconv.Itoa(3+len(h.Files))+","+strconv.Itoa(4+len(h.Files)))
+	h.Files = append(h.Files, readyW, previousR)
+	return h, nil
+}
+
+// Started closes files passed to the new executable (it has its copies)
+func (h *Handover) Started() {
+	for _, f := range h.Files {
+		f.Close()
+	}
+	h.Files = nil
+}
+
+// WaitReady waits (at most handoverTimeout) for smtpd of the new executable
+// to serve, an error is returned if it exited or didn't serve in time
+func (h *Handover) WaitReady() error {
+	done := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := h.ready.Read(b)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return errors.New("new executable exited before serving")
+		}
+		return nil
+	case <-time.After(handoverTimeout):
+		return errors.New("new executable doesn't serve after " + handoverTimeout.String())
+	}
+}
+
+// Abort closes files of a failed handover, listeners are not affected
+func (h *Handover) Abort() {
+	h.Started()
+	for _, f := range []*os.File{h.ready, h.previous} {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+// handoverFds returns fds of pipes of handover from previous executable
+func handoverFds() (ready, previous int, ok bool) {
+	fds := strings.Split(os.Getenv(handoverEnv), ",")
+	if len(fds) != 2 {
+		return 0, 0, false
+	}
+	var err1, err2 error
+	ready, err1 = strconv.Atoi(fds[0])
+	previous, err2 = strconv.Atoi(fds[1])
+	return ready, previous, err1 == nil && err2 == nil
+}
+
+// HandoverChild returns true if this process takes over listeners of a
+// previous executable still running
+func HandoverChild() bool {
+	_, _, ok := handoverFds()
+	return ok
+}
+
+// HandoverReady waits for smtpd to listen on its listeners addresses, then
+// tells previous executable that it serves
+func HandoverReady(listeners int) error {
+	ready, _, ok := handoverFds()
+	if !ok {
+		return nil
+	}
+	deadline := time.Now().Add(handoverTimeout)
+	for {
+		smtpdState.Lock()
+		listening := len(smtpdState.listeners)
+		smtpdState.Unlock()
+		if listening >= listeners {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			return errors.New("smtpd doesn't listen after " + handoverTimeout.String())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	f := os.NewFile(uintptr(ready), "handover ready")
+	_, err := f.Write([]byte{1})
+	f.Close()
+	return err
+}
+
+// HandoverWaitPrevious waits for the exit of previous executable (it holds
+// nsqd and other services until its sessions and deliveries end)
+func HandoverWaitPrevious() {
+	_, previous, ok := handoverFds()
+	if !ok {
+		return
+	}
+	f := os.NewFile(uintptr(previous), "handover previous")
+	b := make([]byte, 1)
+	for {
+		if _, err := f.Read(b); err != nil {
+			break
+		}
+	}
+	f.Close()
+	os.Unsetenv(handoverEnv)
+}
+
+// shutdown closes session (421) when tmail stops
+func (s *SMTPServerSession) shutdown() {
+	s.log("tmail is shutting down, closing session")
+	s.out("421 4.3.2 service shutting down, closing connection")
+	s.timer.Stop()
+	select {
+	case s.exitasap <- 1:
+	default:
+	}
+}
@@ -0,0 +1,85 @@
+package core
+
+// Submission (RFC 6409)
+// On listeners of smtpd_submission_listeners clients must issue STARTTLS
+// before AUTH and authenticate before MAIL (no exceptions), the sender must
+// be the login of the user or one of its aliases, and messages have their
+// own size & rate limits.
+
+import (
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// submissionInit sets submission mode of session
+func (s *SMTPServerSession) submissionInit() {
+	for _, listener := range Cfg.GetSmtpdSubmissionListeners() {
+		if listenerMatch(listener, s.conn.LocalAddr()) {
+			s.submission = true
+			s.requireTLS = true
+			s.requireAuth = true
+			s.log("GREETING - submission listener " + s.conn.LocalAddr().String())
+			return
+		}
+	}
+}
+
+// maxDataBytes returns max size of messages of session (0: unlimited)
+func (s *SMTPServerSession) maxDataBytes() int {
+	if s.submission && Cfg.GetSmtpdSubmissionMaxDataBytes() != 0 {
+		return Cfg.GetSmtpdSubmissionMaxDataBytes()
+	}
+	return Cfg.GetSmtpdMaxDataBytes()
+}
+
+// userOwnsAddress returns true if address is login or an alias of login
+// (address alias delivered to login or login in an alias domain)
+func userOwnsAddress(login, address string) (bool, error) {
+	login, address = strings.ToLower(login), strings.ToLower(address)
+	if address == login {
+		return true, nil
+	}
+	alias, err := AliasGet(address)
+	if err == nil {
+		for _, rcpt := range strings.Split(alias.DeliverTo, ";") {
+			if rcpt == login {
+				return true, nil
+			}
+		}
+	} else if err != gorm.RecordNotFound {
+		return false, err
+	}
+	// domain alias
+	p, q := strings.Index(address, "@"), strings.Index(login, "@")
+	if p == -1 || q == -1 || address[:p] != login[:q] {
+		return false, nil
+	}
+	alias, err = AliasGet(address[p+1:])
+	if err == gorm.RecordNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return alias.IsDomAlias && alias.DeliverTo == login[q+1:], nil
+}
+
+// submissionSenderCheck checks that authenticated user owns sender address
+// it returns true if the user doesn't (reply has been sent)
+func (s *SMTPServerSession) submissionSenderCheck() bool {
+	if !s.submission || s.user == nil {
+		return false
+	}
+	owned, err := userOwnsAddress(s.user.Login, s.envelope.MailFrom)
+	if err != nil {
+		s.logError("MAIL - SUBMISSION - unable to check sender " + s.envelope.MailFrom + " - " + err.Error())
+		s.out("451 4.3.0 unable to check sender address, try again later")
+		return true
+	}
+	if owned {
+		return false
+	}
+	s.log("MAIL - SUBMISSION - " + s.user.Login + " is not allowed to send as <" + s.envelope.MailFrom + ">")
+	s.out("553 5.7.1 sender address not owned by authenticated user")
+	return true
+}
@@ -0,0 +1,35 @@
+package core
+
+// Disabled SMTP verbs
+// smtpd_disabled_verbs lists verbs disabled per listener
+// (listener=VERB,VERB;...): they are replied with a 502 and extensions
+// related to them are not advertised.
+
+import (
+	"strings"
+)
+
+// disabledVerbsInit sets verbs disabled on listener of session
+func (s *SMTPServerSession) disabledVerbsInit() {
+	s.disabledVerbs = []string{}
+	for _, entry := range Cfg.GetSmtpdDisabledVerbs() {
+		p := strings.LastIndex(entry, "=")
+		if p == -1 {
+			s.logError("GREETING - bad smtpd_disabled_verbs entry " + entry)
+			continue
+		}
+		if !listenerMatch(entry[:p], s.conn.LocalAddr()) {
+			continue
+		}
+		for _, verb := range strings.Split(entry[p+1:], ",") {
+			if verb = strings.ToLower(strings.TrimSpace(verb)); verb != "" {
+				s.disabledVerbs = append(s.disabledVerbs, verb)
+			}
+		}
+	}
+}
+
+// verbDisabled returns true if verb is disabled on listener of session
+func (s *SMTPServerSession) verbDisabled(verb string) bool {
+	return IsStringInSlice(verb, s.disabledVerbs)
+}
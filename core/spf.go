@@ -0,0 +1,431 @@
+package core
+
+// SPF (RFC 7208) evaluation
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// spfResult is the result of an SPF evaluation (RFC 7208 2.6)
+type spfResult string
+
+const (
+	spfNone      spfResult = "none"
+	spfNeutral   spfResult = "neutral"
+	spfPass      spfResult = "pass"
+	spfFail      spfResult = "fail"
+	spfSoftfail  spfResult = "softfail"
+	spfTemperror spfResult = "temperror"
+	spfPermerror spfResult = "permerror"
+)
+
+// RFC 7208 4.6.4: DNS lookup limit
+const spfMaxDnsLookups = 10
+
+var (
+	errSpfPerm = errors.New("spf permerror")
+	errSpfTemp = errors.New("spf temperror")
+)
+
+// spfChecker holds the state of an SPF evaluation
+type spfChecker struct {
+	ip         net.IP
+	sender     string // local-part@domain
+	helo       string
+	dnsLookups int
+}
+
+// spfCheck evaluates SPF for ip, sender (MAIL FROM, may be empty) and helo.
+// It returns the result and the domain the result applies to.
+func spfCheck(ip net.IP, sender, helo string) (result spfResult, domain string) {
+	// RFC 7208 2.4: null reverse path -> postmaster@helo
+	if sender == "" || strings.Index(sender, "@") == -1 {
+		sender = "postmaster@" + helo
+	}
+	domain = strings.ToLower(sender[strings.LastIndex(sender, "@")+1:])
+	if domain == "" {
+		return spfNone, domain
+	}
+	c := &spfChecker{ip: ip, sender: sender, helo: helo}
+	return c.checkHost(domain, 0), domain
+}
+
+// checkHost is the check_host() function of RFC 7208 4
+func (c *spfChecker) checkHost(domain string, depth int) spfResult {
+	if depth > spfMaxDnsLookups {
+		return spfPermerror
+	}
+	record, err := spfGetRecord(domain)
+	if err == errSpfTemp {
+		return spfTemperror
+	}
+	if err == errSpfPerm {
+		return spfPermerror
+	}
+	if record == "" {
+		return spfNone
+	}
+
+	redirect := ""
+	for _, term := range strings.Fields(record)[1:] {
+		// modifiers
+		if eq := strings.Index(term, "="); eq != -1 && (strings.Index(term, ":") == -1 || eq < strings.Index(term, ":")) {
+			name := strings.ToLower(term[:eq])
+			if name == "redirect" {
+				if redirect != "" {
+					return spfPermerror
+				}
+				redirect = term[eq+1:]
+			}
+			// exp and unknown modifiers are ignored
+			continue
+		}
+
+		// qualifier
+		qualifier := spfPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier = spfFail
+			term = term[1:]
+		case '~':
+			qualifier = spfSoftfail
+			term = term[1:]
+		case '?':
+			qualifier = spfNeutral
+			term = term[1:]
+		}
+
+		match, err := c.matchMechanism(term, domain, depth)
+		if err == errSpfTemp {
+			return spfTemperror
+		}
+		if err != nil {
+			return spfPermerror
+		}
+		if match {
+			return qualifier
+		}
+	}
+
+	if redirect != "" {
+		if c.dnsLookups++; c.dnsLookups > spfMaxDnsLookups {
+			return spfPermerror
+		}
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return spfPermerror
+		}
+		result := c.checkHost(target, depth+1)
+		// RFC 7208 6.1
+		if result == spfNone {
+			return spfPermerror
+		}
+		return result
+	}
+	return spfNeutral
+}
+
+// matchMechanism returns true if mechanism matches
+func (c *spfChecker) matchMechanism(term, domain string, depth int) (bool, error) {
+	name, arg := term, ""
+	if p := strings.IndexAny(term, ":/"); p != -1 {
+		name, arg = term[:p], term[p:]
+	}
+	name = strings.ToLower(name)
+
+	switch name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return false, errSpfPerm
+		}
+		ipnet := arg[1:]
+		if strings.Index(ipnet, "/") == -1 {
+			if name == "ip4" {
+				ipnet += "/32"
+			} else {
+				ipnet += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(ipnet)
+		if err != nil {
+			return false, errSpfPerm
+		}
+		return n.Contains(c.ip), nil
+	case "a", "mx", "include", "exists", "ptr":
+	default:
+		return false, errSpfPerm
+	}
+
+	// mechanisms which need DNS lookups
+	if c.dnsLookups++; c.dnsLookups > spfMaxDnsLookups {
+		return false, errSpfPerm
+	}
+	target := domain
+	cidr4, cidr6 := 32, 128
+	if strings.HasPrefix(arg, ":") {
+		spec := arg[1:]
+		if p := strings.Index(spec, "/"); p != -1 {
+			spec, arg = spec[:p], spec[p:]
+		} else {
+			arg = ""
+		}
+		var err error
+		if target, err = c.expand(spec, domain); err != nil {
+			return false, err
+		}
+	}
+	if arg != "" {
+		var err error
+		if cidr4, cidr6, err = spfParseDualCidr(arg); err != nil {
+			return false, err
+		}
+	}
+
+	switch name {
+	case "include":
+		switch c.checkHost(target, depth+1) {
+		case spfPass:
+			return true, nil
+		case spfTemperror:
+			return false, errSpfTemp
+		case spfPermerror, spfNone:
+			return false, errSpfPerm
+		}
+		return false, nil
+	case "exists":
+		ips, err := net.LookupIP(target)
+		if err != nil {
+			return false, spfDnsError(err)
+		}
+		return len(ips) != 0, nil
+	case "a":
+		return c.matchHostIPs(target, cidr4, cidr6)
+	case "mx":
+		mxs, err := net.LookupMX(target)
+		if err != nil {
+			return false, spfDnsError(err)
+		}
+		// RFC 7208 4.6.4: no more than 10 MX
+		if len(mxs) > 10 {
+			return false, errSpfPerm
+		}
+		for _, mx := range mxs {
+			match, err := c.matchHostIPs(mx.Host, cidr4, cidr6)
+			if err != nil {
+				return false, err
+			}
+			if match {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "ptr":
+		names, err := net.LookupAddr(c.ip.String())
+		if err != nil {
+			return false, nil
+		}
+		target = strings.ToLower(strings.TrimSuffix(target, "."))
+		for _, n := range names {
+			n = strings.ToLower(strings.TrimSuffix(n, "."))
+			if n == target || strings.HasSuffix(n, "."+target) {
+				// validated name
+				if match, _ := c.matchHostIPs(n, 32, 128); match {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// matchHostIPs returns true if c.ip is in one of the IPs of host (with cidr)
+func (c *spfChecker) matchHostIPs(host string, cidr4, cidr6 int) (bool, error) {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false, spfDnsError(err)
+	}
+	for _, ip := range ips {
+		var mask net.IPMask
+		if ip.To4() != nil {
+			mask = net.CIDRMask(cidr4, 32)
+			ip = ip.To4()
+		} else {
+			mask = net.CIDRMask(cidr6, 128)
+		}
+		n := net.IPNet{IP: ip.Mask(mask), Mask: mask}
+		if n.Contains(c.ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// spfParseDualCidr parses /cidr4//cidr6
+func spfParseDualCidr(arg string) (cidr4, cidr6 int, err error) {
+	cidr4, cidr6 = 32, 128
+	parts := strings.Split(arg, "/")
+	// "", "24", "", "64"
+	if parts[0] != "" || len(parts) > 4 {
+		return 0, 0, errSpfPerm
+	}
+	if len(parts) > 1 && parts[1] != "" {
+		if cidr4, err = strconv.Atoi(parts[1]); err != nil || cidr4 < 0 || cidr4 > 32 {
+			return 0, 0, errSpfPerm
+		}
+	}
+	if len(parts) == 4 {
+		if parts[2] != "" {
+			return 0, 0, errSpfPerm
+		}
+		if cidr6, err = strconv.Atoi(parts[3]); err != nil || cidr6 < 0 || cidr6 > 128 {
+			return 0, 0, errSpfPerm
+		}
+	}
+	return cidr4, cidr6, nil
+}
+
+// expand expands macros (RFC 7208 7)
+func (c *spfChecker) expand(spec, domain string) (string, error) {
+	if strings.Index(spec, "%") == -1 {
+		return spec, nil
+	}
+	out := ""
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			out += string(spec[i])
+			continue
+		}
+		i++
+		if i == len(spec) {
+			return "", errSpfPerm
+		}
+		switch spec[i] {
+		case '%':
+			out += "%"
+			continue
+		case '_':
+			out += " "
+			continue
+		case '-':
+			out += "%20"
+			continue
+		case '{':
+		default:
+			return "", errSpfPerm
+		}
+		end := strings.Index(spec[i:], "}")
+		if end == -1 {
+			return "", errSpfPerm
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+		if macro == "" {
+			return "", errSpfPerm
+		}
+
+		var value string
+		localPart := c.sender[:strings.LastIndex(c.sender, "@")]
+		switch strings.ToLower(macro[:1]) {
+		case "s":
+			value = c.sender
+		case "l":
+			value = localPart
+		case "o":
+			value = c.sender[strings.LastIndex(c.sender, "@")+1:]
+		case "d":
+			value = domain
+		case "i":
+			if ip4 := c.ip.To4(); ip4 != nil {
+				value = ip4.String()
+			} else {
+				// dot-format nibbles
+				nibbles := []string{}
+				for _, b := range c.ip.To16() {
+					nibbles = append(nibbles, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0xf))
+				}
+				value = strings.Join(nibbles, ".")
+			}
+		case "v":
+			if c.ip.To4() != nil {
+				value = "in-addr"
+			} else {
+				value = "ip6"
+			}
+		case "h":
+			value = c.helo
+		case "p":
+			value = "unknown"
+		default:
+			return "", errSpfPerm
+		}
+
+		// transformers: digits, r, delimiters
+		transformers := macro[1:]
+		digits := 0
+		for len(transformers) != 0 && transformers[0] >= '0' && transformers[0] <= '9' {
+			digits = digits*10 + int(transformers[0]-'0')
+			transformers = transformers[1:]
+		}
+		reverse := false
+		if len(transformers) != 0 && (transformers[0] == 'r' || transformers[0] == 'R') {
+			reverse = true
+			transformers = transformers[1:]
+		}
+		delimiters := "."
+		if transformers != "" {
+			if strings.Trim(transformers, ".-+,/_=") != "" {
+				return "", errSpfPerm
+			}
+			delimiters = transformers
+		}
+		labels := strings.FieldsFunc(value, func(r rune) bool {
+			return strings.ContainsRune(delimiters, r)
+		})
+		if reverse {
+			for l, r := 0, len(labels)-1; l < r; l, r = l+1, r-1 {
+				labels[l], labels[r] = labels[r], labels[l]
+			}
+		}
+		if digits != 0 && digits < len(labels) {
+			labels = labels[len(labels)-digits:]
+		}
+		out += strings.Join(labels, ".")
+	}
+	return out, nil
+}
+
+// spfGetRecord returns SPF record of domain ("" if there is none)
+func spfGetRecord(domain string) (string, error) {
+	txts, err := net.LookupTXT(domain)
+	if err != nil {
+		return "", spfDnsError(err)
+	}
+	record := ""
+	for _, txt := range txts {
+		if strings.ToLower(txt) == "v=spf1" || strings.HasPrefix(strings.ToLower(txt), "v=spf1 ") {
+			// RFC 7208 4.5: more than one record -> permerror
+			if record != "" {
+				return "", errSpfPerm
+			}
+			record = txt
+		}
+	}
+	return record, nil
+}
+
+// spfDnsError returns errSpfTemp for DNS failures, nil if the name doesn't
+// exist (no match)
+func spfDnsError(err error) error {
+	if strings.Contains(err.Error(), "no such host") {
+		return nil
+	}
+	return errSpfTemp
+}
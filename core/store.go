@@ -6,19 +6,33 @@ import (
 )
 
 // Storer is a interface for stores
+// Get and Put stream data, readers returned by Get must be closed
 type Storer interface {
 	//TODO should return perm or temp failure
-	Get(key string) (io.Reader, error)
+	Get(key string) (io.ReadCloser, error)
 	Put(key string, reader io.Reader) error
 	Del(key string) error
 }
 
 // NewStore return a new srore
+// if store_encryption_key is set data is encrypted, if
+// store_encryption_required is set too data not encrypted is refused
 func NewStore(driver, source string) (Storer, error) {
+	var store Storer
+	var err error
 	switch driver {
 	case "disk":
-		return NewDiskStore(source)
+		store, err = NewDiskStore(source)
+	case "s3":
+		store, err = NewS3Store(source)
 	default:
 		return nil, errors.New("no such driver " + driver + " for store")
 	}
+	if err != nil {
+		return nil, err
+	}
+	if key := Cfg.GetStoreEncryptionKey(); key != "" {
+		return newCryptStore(store, key, Cfg.GetStoreEncryptionRequired())
+	}
+	return store, nil
 }
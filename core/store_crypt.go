@@ -0,0 +1,222 @@
+package core
+
+// Encryption at rest of stores
+// Data is encrypted with AES-256-GCM by records of cryptStoreChunkSize
+// bytes, so messages are streamed (never loaded in memory to be encrypted):
+// header: cryptStoreMagic + random nonce prefix (8 bytes)
+// records: ciphertext length (uint32, big endian) + ciphertext
+// nonce of a record is prefix + record number (uint32), its additional data
+// is 1 for the last record, 0 for the others (truncation is detected),
+// followed by the key of the object (ciphertexts can't be swapped between
+// objects). Data without header (stored before encryption was enabled) and
+// data of the first format (TMAILENC1, key not bound) are returned as is
+// unless store_encryption_required is set.
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+const (
+	cryptStoreMagic     = "TMAILENC2"
+	cryptStoreMagicV1   = "TMAILENC1"
+	cryptStoreChunkSize = 64 * 1024
+)
+
+// cryptStore encrypts data of store
+type cryptStore struct {
+	store    Storer
+	aead     cipher.AEAD
+	required bool // data not encrypted (or with key not bound) is refused
+}
+
+// newCryptStore returns store encrypting data of store with key (hex), if
+// required is true data not encrypted is refused
+func newCryptStore(store Storer, key string, required bool) (*cryptStore, error) {
+	k, err := hex.DecodeString(key)
+	if err != nil || len(k) != 32 {
+		return nil, errors.New("bad store encryption key, 64 hex characters expected")
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &cryptStore{store, aead, required}, nil
+}
+
+// Get returns reader of decrypted data corresponding to key
+func (s *cryptStore) Get(key string) (io.ReadCloser, error) {
+	r, err := s.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(cryptStoreMagic)+8)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		r.Close()
+		return nil, err
+	}
+	switch {
+	case err == nil && string(header[:len(cryptStoreMagic)]) == cryptStoreMagic:
+		return &cryptStoreDecrypter{src: r, aead: s.aead, prefix: header[len(cryptStoreMagic):], key: []byte(key)}, nil
+	case s.required:
+		r.Close()
+		return nil, errors.New("cryptStore: data of " + key + " is not encrypted or its key is not bound, refused (store_encryption_required)")
+	case err == nil && string(header[:len(cryptStoreMagicV1)]) == cryptStoreMagicV1:
+		return &cryptStoreDecrypter{src: r, aead: s.aead, prefix: header[len(cryptStoreMagicV1):]}, nil
+	}
+	// not encrypted
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(header[:n]), r), r}, nil
+}
+
+// Put encrypts and saves data of reader
+func (s *cryptStore) Put(key string, reader io.Reader) error {
+	prefix := make([]byte, 8)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	return s.store.Put(key, &cryptStoreEncrypter{src: reader, aead: s.aead, prefix: prefix, key: []byte(key), out: append([]byte(cryptStoreMagic), prefix...)})
+}
+
+// Del delete key from store
+func (s *cryptStore) Del(key string) error {
+	return s.store.Del(key)
+}
+
+// cryptStoreNonce returns nonce of record n
+func cryptStoreNonce(prefix []byte, n uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[8:], n)
+	return nonce
+}
+
+// cryptStoreAD returns additional data of a record of object key
+func cryptStoreAD(final bool, key []byte) []byte {
+	ad := []byte{0}
+	if final {
+		ad[0] = 1
+	}
+	return append(ad, key...)
+}
+
+// cryptStoreEncrypter is a reader of encrypted data of src
+type cryptStoreEncrypter struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	key     []byte // key of object
+	counter uint32
+	out     []byte // encrypted data not read yet
+	chunk   []byte // next chunk (read ahead to know the last one)
+	started bool
+	eof     bool // src is consumed
+	done    bool // last record is sealed
+}
+
+// readChunk reads a chunk of src
+func (e *cryptStoreEncrypter) readChunk() ([]byte, error) {
+	buf := make([]byte, cryptStoreChunkSize)
+	n, err := io.ReadFull(e.src, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		e.eof = true
+		err = nil
+	}
+	return buf[:n], err
+}
+
+// Read implements io.Reader
+func (e *cryptStoreEncrypter) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		var err error
+		if !e.started {
+			if e.chunk, err = e.readChunk(); err != nil {
+				return 0, err
+			}
+			e.started = true
+		}
+		current, final := e.chunk, e.eof
+		if !final {
+			if e.chunk, err = e.readChunk(); err != nil {
+				return 0, err
+			}
+			// src ends exactly at the end of current chunk
+			final = e.eof && len(e.chunk) == 0
+		}
+		e.done = final
+		sealed := e.aead.Seal(nil, cryptStoreNonce(e.prefix, e.counter), current, cryptStoreAD(final, e.key))
+		e.counter++
+		e.out = make([]byte, 4, 4+len(sealed))
+		binary.BigEndian.PutUint32(e.out, uint32(len(sealed)))
+		e.out = append(e.out, sealed...)
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// cryptStoreDecrypter is a reader of decrypted data of src
+type cryptStoreDecrypter struct {
+	src     io.ReadCloser
+	aead    cipher.AEAD
+	prefix  []byte
+	key     []byte // key of object (nil for TMAILENC1)
+	counter uint32
+	out     []byte
+	done    bool
+}
+
+// Read implements io.Reader
+func (d *cryptStoreDecrypter) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		length := make([]byte, 4)
+		if _, err := io.ReadFull(d.src, length); err != nil {
+			return 0, errors.New("cryptStore: encrypted data is truncated")
+		}
+		size := binary.BigEndian.Uint32(length)
+		if size > cryptStoreChunkSize+uint32(d.aead.Overhead()) {
+			return 0, errors.New("cryptStore: bad record size")
+		}
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(d.src, sealed); err != nil {
+			return 0, errors.New("cryptStore: encrypted data is truncated")
+		}
+		nonce := cryptStoreNonce(d.prefix, d.counter)
+		plain, err := d.aead.Open(nil, nonce, sealed, cryptStoreAD(false, d.key))
+		if err != nil {
+			if plain, err = d.aead.Open(nil, nonce, sealed, cryptStoreAD(true, d.key)); err != nil {
+				return 0, errors.New("cryptStore: unable to decrypt data (bad key or corrupted data)")
+			}
+			d.done = true
+		}
+		d.counter++
+		d.out = plain
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// Close implements io.Closer
+func (d *cryptStoreDecrypter) Close() error {
+	return d.src.Close()
+}
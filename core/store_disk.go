@@ -1,10 +1,8 @@
 package core
 
 import (
-	"bytes"
 	"errors"
 	"io"
-	"io/ioutil"
 	"os"
 	"path"
 )
@@ -34,17 +32,17 @@ func NewDiskStore(basePath string) (*diskStore, error) {
 	return &diskStore{basePath}, nil
 }
 
-// Get returns io.Reader corresponding to key
-func (s *diskStore) Get(key string) (io.Reader, error) {
+// Get returns reader of data corresponding to key
+func (s *diskStore) Get(key string) (io.ReadCloser, error) {
 	if key == "" {
 		return nil, errors.New("diskStore.Get: key is empty")
 	}
 	spath := s.getStoragePath(key)
-	raw, err := ioutil.ReadFile(spath)
+	f, err := os.Open(spath)
 	if err != nil {
 		return nil, errors.New("diskStore.Get: unable to open " + spath + " for reading." + err.Error())
 	}
-	return io.Reader(bytes.NewReader(raw)), nil
+	return f, nil
 }
 
 // Put save key value in store
@@ -69,6 +67,9 @@ func (s *diskStore) Put(key string, reader io.Reader) error {
 		return err
 	}
 	_, err = io.Copy(f, reader)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
 	return err
 }
 
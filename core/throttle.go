@@ -0,0 +1,296 @@
+package core
+
+// Throttling
+// smtpd limits connections per client IP, concurrent sessions per
+// authenticated user, messages per sender and per hour and recipients per
+// message. Limits are global (config) and can be overridden per
+// authenticated user (ThrottleLimit).
+// Messages counters are stored in DB (shared by cluster nodes), connections
+// and sessions are counted by each smtpd process.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ThrottleLimit represents throttling limits of an authenticated user
+// 0 means the global limit applies
+type ThrottleLimit struct {
+	Id          int64
+	Login       string `sql:"unique"`
+	MsgsPerHour int
+	MaxRcpt     int
+	MaxSessions int
+}
+
+// ThrottleCounter represents the number of messages of a sender (login of
+// authenticated user or MAIL FROM) during an hour
+type ThrottleCounter struct {
+	Id          int64
+	Sender      string
+	WindowStart time.Time
+	Count       int
+}
+
+// ThrottleStats represents connections & sessions of smtpd process
+type ThrottleStats struct {
+	Sessions     int
+	MaxSessions  int
+	Connections  map[string]int // per client IP
+	UserSessions map[string]int // per authenticated user
+}
+
+var throttle = struct {
+	sync.Mutex
+	conns map[string]int
+	users map[string]int
+}{
+	conns: make(map[string]int),
+	users: make(map[string]int),
+}
+
+// throttleLimitOf returns throttling limits of user login
+func throttleLimitOf(login string) (limit ThrottleLimit, err error) {
+	err = DB.Where("login = ?", strings.ToLower(login)).First(&limit).Error
+	if err == gorm.RecordNotFound {
+		err = nil
+	}
+	return
+}
+
+// throttleIncr increments counter key of m and returns its new value
+func throttleIncr(m map[string]int, key string) int {
+	throttle.Lock()
+	defer throttle.Unlock()
+	m[key]++
+	return m[key]
+}
+
+// throttleDecr decrements counter key of m
+func throttleDecr(m map[string]int, key string) {
+	throttle.Lock()
+	defer throttle.Unlock()
+	if m[key]--; m[key] < 1 {
+		delete(m, key)
+	}
+}
+
+// throttleConnect counts connection of client IP
+// it returns true if client has too many connections (session is closed)
+func (s *SMTPServerSession) throttleConnect() bool {
+	ip := s.remoteIP()
+	if ip == nil {
+		return false
+	}
+	s.throttleIP = ip.String()
+	count := throttleIncr(throttle.conns, s.throttleIP)
+	limit := Cfg.GetSmtpdThrottleConnectionsPerIp()
+	if limit == 0 || count <= limit || s.isTrusted() {
+		return false
+	}
+	s.log(fmt.Sprintf("GREETING - THROTTLE - too many connections from %s (%d/%d)", s.throttleIP, count, limit))
+	s.out("421 4.7.0 too many connections from your IP, try again later")
+	s.exitAsap()
+	return true
+}
+
+// throttleAuth counts sessions of authenticated user
+// it returns true if user has too many sessions (session is closed)
+func (s *SMTPServerSession) throttleAuth() bool {
+	if s.user == nil || s.throttleUser != "" {
+		return false
+	}
+	s.throttleUser = s.user.Login
+	count := throttleIncr(throttle.users, s.throttleUser)
+	limit := Cfg.GetSmtpdThrottleUserSessions()
+	l, err := throttleLimitOf(s.user.Login)
+	if err != nil {
+		s.logError("AUTH - THROTTLE - unable to get limits of " + s.user.Login + " - " + err.Error())
+	} else if l.MaxSessions != 0 {
+		limit = l.MaxSessions
+	}
+	if limit == 0 || count <= limit {
+		return false
+	}
+	s.log(fmt.Sprintf("AUTH - THROTTLE - too many sessions for %s (%d/%d)", s.throttleUser, count, limit))
+	s.out("421 4.7.0 too many concurrent sessions for this user, try again later")
+	s.exitAsap()
+	return true
+}
+
+// throttleRelease releases connection & session counted for this session
+func (s *SMTPServerSession) throttleRelease() {
+	if s.throttleIP != "" {
+		throttleDecr(throttle.conns, s.throttleIP)
+		s.throttleIP = ""
+	}
+	if s.throttleUser != "" {
+		throttleDecr(throttle.users, s.throttleUser)
+		s.throttleUser = ""
+	}
+}
+
+// throttleMaxRcpt returns max recipients per message of current session
+func (s *SMTPServerSession) throttleMaxRcpt() int {
+	if s.user != nil {
+		l, err := throttleLimitOf(s.user.Login)
+		if err != nil {
+			s.logError("RCPT - THROTTLE - unable to get limits of " + s.user.Login + " - " + err.Error())
+		} else if l.MaxRcpt != 0 {
+			return l.MaxRcpt
+		}
+	}
+	if s.submission && Cfg.GetSmtpdSubmissionMaxRcptTo() != 0 {
+		return Cfg.GetSmtpdSubmissionMaxRcptTo()
+	}
+	return Cfg.GetSmtpdMaxRcptTo()
+}
+
+// throttleSender returns sender counted of current transaction and its
+// limit of messages per hour ("" if messages of this sender are not counted)
+// messages of submission listeners are counted apart (submission:login)
+func (s *SMTPServerSession) throttleSender() (sender string, limit int) {
+	limit = Cfg.GetSmtpdThrottleMsgsPerHour()
+	if s.submission && s.user != nil {
+		if Cfg.GetSmtpdSubmissionMsgsPerHour() != 0 {
+			limit = Cfg.GetSmtpdSubmissionMsgsPerHour()
+		}
+		l, err := throttleLimitOf(s.user.Login)
+		if err != nil {
+			s.logError("MAIL - THROTTLE - unable to get limits of " + s.user.Login + " - " + err.Error())
+		} else if l.MsgsPerHour != 0 {
+			limit = l.MsgsPerHour
+		}
+		return "submission:" + strings.ToLower(s.user.Login), limit
+	}
+	if s.user != nil {
+		l, err := throttleLimitOf(s.user.Login)
+		if err != nil {
+			s.logError("MAIL - THROTTLE - unable to get limits of " + s.user.Login + " - " + err.Error())
+		} else if l.MsgsPerHour != 0 {
+			limit = l.MsgsPerHour
+		}
+		return strings.ToLower(s.user.Login), limit
+	}
+	if s.envelope.MailFrom == "" || limit == 0 {
+		return "", 0
+	}
+	return strings.ToLower(s.envelope.MailFrom), limit
+}
+
+// throttleMail checks messages rate of sender
+// it returns true if sender goes over its limit (reply has been sent)
+func (s *SMTPServerSession) throttleMail() bool {
+	sender, limit := s.throttleSender()
+	if sender == "" || limit == 0 {
+		return false
+	}
+	counter := ThrottleCounter{}
+	err := DB.Where("sender = ? AND window_start = ?", sender, time.Now().Truncate(time.Hour)).First(&counter).Error
+	if err != nil && err != gorm.RecordNotFound {
+		s.logError("MAIL - THROTTLE - unable to get counter of " + sender + " - " + err.Error())
+		return false
+	}
+	if counter.Count < limit {
+		return false
+	}
+	s.log(fmt.Sprintf("MAIL - THROTTLE - messages rate exceeded for %s (%d/%d per hour)", sender, counter.Count, limit))
+	s.out("450 4.7.1 message rate limit exceeded, try again later")
+	return true
+}
+
+// throttleMessageQueued counts queued message for sender
+func (s *SMTPServerSession) throttleMessageQueued() {
+	sender, limit := s.throttleSender()
+	if sender == "" || limit == 0 {
+		return
+	}
+	if err := throttleCount(sender); err != nil {
+		s.logError("MAIL - THROTTLE - unable to update counter of " + sender + " - " + err.Error())
+	}
+}
+
+// throttleCount increments counter of sender for current hour, counters of
+// previous hours are removed
+func throttleCount(sender string) error {
+	window := time.Now().Truncate(time.Hour)
+	counter := ThrottleCounter{}
+	err := DB.Where("sender = ? AND window_start = ?", sender, window).First(&counter).Error
+	if err == gorm.RecordNotFound {
+		if err = DB.Where("window_start < ?", window).Delete(ThrottleCounter{}).Error; err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	// counters are shared by smtpd processes
+	return dbIncrement(&ThrottleCounter{}, map[string]interface{}{"sender": sender, "window_start": window}, []string{"count"}, nil, nil)
+}
+
+// ThrottleGetStats returns connections & sessions of this process
+func ThrottleGetStats() ThrottleStats {
+	throttle.Lock()
+	defer throttle.Unlock()
+	stats := ThrottleStats{
+		Sessions:     SmtpSessionsCount,
+		MaxSessions:  Cfg.GetSmtpdConcurrencyIncoming(),
+		Connections:  make(map[string]int),
+		UserSessions: make(map[string]int),
+	}
+	for ip, count := range throttle.conns {
+		stats.Connections[ip] = count
+	}
+	for login, count := range throttle.users {
+		stats.UserSessions[login] = count
+	}
+	return stats
+}
+
+// ThrottleCounters returns messages counters of current hour
+func ThrottleCounters() (counters []ThrottleCounter, err error) {
+	counters = []ThrottleCounter{}
+	err = DB.Where("window_start = ?", time.Now().Truncate(time.Hour)).Order("count desc").Find(&counters).Error
+	return
+}
+
+// ThrottleCounterReset resets messages counters of sender
+func ThrottleCounterReset(sender string) error {
+	return DB.Where("sender = ?", strings.ToLower(sender)).Delete(ThrottleCounter{}).Error
+}
+
+// ThrottleLimitSet sets throttling limits of user login (0: global limit)
+func ThrottleLimitSet(login string, msgsPerHour, maxRcpt, maxSessions int) error {
+	login = strings.ToLower(login)
+	if msgsPerHour < 0 || maxRcpt < 0 || maxSessions < 0 {
+		return errors.New("limits must be positive")
+	}
+	if _, err := UserGetByLogin(login); err != nil {
+		if err == gorm.RecordNotFound {
+			return errors.New("user " + login + " doesn't exist")
+		}
+		return err
+	}
+	limit, err := throttleLimitOf(login)
+	if err != nil {
+		return err
+	}
+	limit.Login, limit.MsgsPerHour, limit.MaxRcpt, limit.MaxSessions = login, msgsPerHour, maxRcpt, maxSessions
+	return DB.Save(&limit).Error
+}
+
+// ThrottleLimitDel removes throttling limits of user login
+func ThrottleLimitDel(login string) error {
+	return DB.Where("login = ?", strings.ToLower(login)).Delete(ThrottleLimit{}).Error
+}
+
+// ThrottleLimitList returns throttling limits of users
+func ThrottleLimitList() (limits []ThrottleLimit, err error) {
+	limits = []ThrottleLimit{}
+	err = DB.Order("login asc").Find(&limits).Error
+	return
+}
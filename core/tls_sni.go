@@ -0,0 +1,239 @@
+package core
+
+// SNI certificates
+// smtpd presents the certificate matching the server name sent by client
+// (SNI), ssl/server.crt is presented when none matches. Certificates are
+// loaded from the directory smtpd_tls_certs_dir (pairs NAME.crt & NAME.key)
+// and from DB (TLSCertificate), they are indexed by their DNS names
+// (wildcards *.domain are supported). Certificates are reloaded on SIGHUP
+// (tmail tls reload) without restarting smtpd. If ACME is enabled, names
+// without certificate are served by ACME (see acme.go).
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// TLSCertificate represents a certificate stored in DB
+type TLSCertificate struct {
+	Id        int64
+	Domain    string `sql:"unique"` // first DNS name of certificate
+	CertPem   string `sql:"type:text;" json:"-"`
+	KeyPem    string `sql:"type:text;" json:"-"`
+	NotAfter  time.Time
+	UpdatedAt time.Time
+}
+
+// TLSCertInfo represents a loaded certificate
+type TLSCertInfo struct {
+	Names    []string
+	Source   string // file or db
+	NotAfter time.Time
+}
+
+var tlsCerts = struct {
+	sync.RWMutex
+	loaded   bool
+	byName   map[string]*tls.Certificate
+	fallback *tls.Certificate
+	infos    []TLSCertInfo
+}{}
+
+// tlsCertNames returns DNS names of certificate (leaf is parsed)
+func tlsCertNames(cert *tls.Certificate) ([]string, time.Time, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, time.Time{}, errors.New("empty certificate")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	cert.Leaf = leaf
+	names := []string{}
+	for _, name := range leaf.DNSNames {
+		names = append(names, strings.ToLower(name))
+	}
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = append(names, strings.ToLower(leaf.Subject.CommonName))
+	}
+	return names, leaf.NotAfter, nil
+}
+
+// TLSCertsReload loads certificates from directory & DB, current ones are
+// kept on error
+func TLSCertsReload() (infos []TLSCertInfo, err error) {
+	byName := make(map[string]*tls.Certificate)
+	infos = []TLSCertInfo{}
+	add := func(cert tls.Certificate, source string) error {
+		names, notAfter, err := tlsCertNames(&cert)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			byName[name] = &cert
+		}
+		infos = append(infos, TLSCertInfo{Names: names, Source: source, NotAfter: notAfter})
+		return nil
+	}
+
+	// default certificate
+	var fallback *tls.Certificate
+	cert, err := tls.LoadX509KeyPair(path.Join(GetBasePath(), "ssl/server.crt"), path.Join(GetBasePath(), "ssl/server.key"))
+	if err == nil {
+		fallback = &cert
+		if _, _, err = tlsCertNames(fallback); err != nil {
+			return nil, errors.New("bad certificate ssl/server.crt - " + err.Error())
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.New("unable to load ssl/server.crt - " + err.Error())
+	}
+
+	// directory
+	dir := Cfg.GetSmtpdTLSCertsDir()
+	files, err := filepath.Glob(path.Join(dir, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+	for _, certFile := range files {
+		keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.New("unable to load certificate " + certFile + " - " + err.Error())
+		}
+		if err = add(cert, certFile); err != nil {
+			return nil, errors.New("bad certificate " + certFile + " - " + err.Error())
+		}
+	}
+
+	// DB
+	stored := []TLSCertificate{}
+	if err = DB.Order("domain").Find(&stored).Error; err != nil {
+		return nil, err
+	}
+	for _, c := range stored {
+		cert, err := tls.X509KeyPair([]byte(c.CertPem), []byte(c.KeyPem))
+		if err != nil {
+			return nil, errors.New("unable to load certificate of " + c.Domain + " from DB - " + err.Error())
+		}
+		if err = add(cert, "db"); err != nil {
+			return nil, errors.New("bad certificate of " + c.Domain + " in DB - " + err.Error())
+		}
+	}
+
+	tlsCerts.Lock()
+	tlsCerts.byName, tlsCerts.fallback, tlsCerts.infos, tlsCerts.loaded = byName, fallback, infos, true
+	tlsCerts.Unlock()
+	Log.Info(fmt.Sprintf("TLS - %d SNI certificates loaded", len(infos)))
+	return infos, nil
+}
+
+// tlsLookup returns loaded certificate for name (fallback if none)
+func tlsLookup(name string) (cert *tls.Certificate, fallback *tls.Certificate) {
+	tlsCerts.RLock()
+	defer tlsCerts.RUnlock()
+	if name != "" {
+		if cert, ok := tlsCerts.byName[name]; ok {
+			return cert, nil
+		}
+		// wildcard
+		if p := strings.Index(name, "."); p != -1 {
+			if cert, ok := tlsCerts.byName["*"+name[p:]]; ok {
+				return cert, nil
+			}
+		}
+	}
+	return nil, tlsCerts.fallback
+}
+
+// tlsGetCertificate returns certificate for SNI of hello
+func tlsGetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if Cfg.GetAcmeEnabled() && isAcmeChallenge(hello) {
+		return acmeManager().GetCertificate(hello)
+	}
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	cert, fallback := tlsLookup(name)
+	if cert != nil {
+		return cert, nil
+	}
+	acmeName := name
+	if acmeName == "" {
+		acmeName = strings.ToLower(Cfg.GetMe())
+	}
+	if cert, ok, err := acmeGetCertificate(hello, acmeName); ok && (err == nil || fallback == nil) {
+		return cert, err
+	}
+	if fallback == nil {
+		return nil, errors.New("no certificate for " + name)
+	}
+	return fallback, nil
+}
+
+// tlsCertsInit loads certificates if they are not loaded
+func tlsCertsInit() error {
+	tlsCerts.RLock()
+	loaded := tlsCerts.loaded
+	tlsCerts.RUnlock()
+	if loaded {
+		return nil
+	}
+	infos, err := TLSCertsReload()
+	if err != nil {
+		return err
+	}
+	tlsCerts.RLock()
+	defer tlsCerts.RUnlock()
+	if tlsCerts.fallback == nil && len(infos) == 0 && !Cfg.GetAcmeEnabled() {
+		return errors.New("no certificate found (ssl/server.crt, " + Cfg.GetSmtpdTLSCertsDir() + " or DB)")
+	}
+	return nil
+}
+
+// TLSCertsList returns loaded certificates
+func TLSCertsList() []TLSCertInfo {
+	tlsCerts.RLock()
+	defer tlsCerts.RUnlock()
+	return tlsCerts.infos
+}
+
+// TLSCertificateAdd stores certificate & key (PEM) in DB, it replaces the
+// certificate of the same domain
+func TLSCertificateAdd(certPem, keyPem []byte) (stored TLSCertificate, err error) {
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return
+	}
+	names, notAfter, err := tlsCertNames(&cert)
+	if err != nil {
+		return
+	}
+	if len(names) == 0 {
+		return stored, errors.New("certificate has no DNS name")
+	}
+	err = DB.Where("domain = ?", names[0]).First(&stored).Error
+	if err != nil && err != gorm.RecordNotFound {
+		return
+	}
+	stored.Domain, stored.CertPem, stored.KeyPem = names[0], string(certPem), string(keyPem)
+	stored.NotAfter, stored.UpdatedAt = notAfter, time.Now()
+	err = DB.Save(&stored).Error
+	return
+}
+
+// TLSCertificateDel removes certificate of domain from DB
+func TLSCertificateDel(domain string) error {
+	stored := TLSCertificate{}
+	if err := DB.Where("domain = ?", strings.ToLower(domain)).First(&stored).Error; err != nil {
+		return err
+	}
+	return DB.Delete(&stored).Error
+}
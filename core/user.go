@@ -12,20 +12,23 @@ import (
 
 // User represents a tmail user.
 type User struct {
-	Id           int64
-	Login        string `sql:"unique"`
-	Passwd       string `sql:"not null"`
-	DovePasswd   string `sql:"null"`                     // SHA512 passwd workaround (glibc on most linux flavor doesn't have bcrypt support)
-	Active       string `sql:"type:char(1);default:'Y'"` //rune `sql:"type:char(1);not null;default:'Y'`
-	AuthRelay    bool   `sql:"default:false"`            // authorization of relaying
-	HaveMailbox  bool   `sql:"default:false"`
-	IsCatchall   bool   `sql:"default:false"`
-	MailboxQuota string `sql:"null"`
-	Home         string `sql:"null"` // used by dovecot to store mailbox
+	Id            int64
+	Login         string `sql:"unique"`
+	Passwd        string `sql:"not null"`
+	DovePasswd    string `sql:"null"`                     // SHA512 passwd workaround (glibc on most linux flavor doesn't have bcrypt support)
+	Active        string `sql:"type:char(1);default:'Y'"` //rune `sql:"type:char(1);not null;default:'Y'`
+	AuthRelay     bool   `sql:"default:false"`            // authorization of relaying
+	HaveMailbox   bool   `sql:"default:false"`
+	IsCatchall    bool   `sql:"default:false"`
+	MailboxQuota  string `sql:"null"`
+	MailboxDriver string `sql:"null"` // dovecot or maildir (built-in)
+	Home          string `sql:"null"` // used by dovecot to store mailbox
+	CramMd5       string `sql:"null"` // HMAC-MD5 inner & outer states (CRAM-MD5)
+	ScramSha256   string `sql:"null"` // iterations:salt:StoredKey:ServerKey (SCRAM-SHA-256)
 }
 
 // UserAdd add an user
-func UserAdd(login, passwd, mbQuota string, haveMailbox, authRelay, isCatchall bool) error {
+func UserAdd(login, passwd, mbQuota, mbDriver string, haveMailbox, authRelay, isCatchall bool) error {
 	login = strings.ToLower(login)
 	// login must be < 257 char
 	l := len(login)
@@ -55,8 +58,17 @@ func UserAdd(login, passwd, mbQuota string, haveMailbox, authRelay, isCatchall b
 
 	// if we have to create mailbox, login must be a valid email address
 	if haveMailbox {
+		// mailbox driver
+		if mbDriver == "" {
+			mbDriver = Cfg.GetUsersMailboxDefaultDriver()
+		}
+		if !IsValidMailboxDriver(mbDriver) {
+			return errors.New("unsupported mailbox driver " + mbDriver)
+		}
+		user.MailboxDriver = mbDriver
+
 		// check if dovecot is available
-		if !Cfg.GetDovecotSupportEnabled() {
+		if mbDriver == MailboxDriverDovecot && !Cfg.GetDovecotSupportEnabled() {
 			return errors.New("you must enable (and install) Dovecot support")
 		}
 
@@ -74,6 +86,9 @@ func UserAdd(login, passwd, mbQuota string, haveMailbox, authRelay, isCatchall b
 			// get default
 			mbQuota = Cfg.GetUserMailboxDefaultQuota()
 		}
+		if _, err := ParseSize(mbQuota); err != nil {
+			return errors.New("bad mailbox quota " + mbQuota)
+		}
 		user.MailboxQuota = mbQuota
 
 		// rcpthost must be in rcpthost && must be local && not an alias
@@ -130,6 +145,11 @@ func UserAdd(login, passwd, mbQuota string, haveMailbox, authRelay, isCatchall b
 	if err != nil {
 		return err
 	}
+
+	// CRAM-MD5 & SCRAM-SHA-256
+	if err = userSaslCredentials(user, passwd); err != nil {
+		return err
+	}
 	return DB.Save(user).Error
 }
 
@@ -165,7 +185,7 @@ func UserGetByLogin(login string) (user *User, err error) {
 // UserGetCatchallForDomain return catchall
 func UserGetCatchallForDomain(domain string) (user *User, err error) {
 	user = &User{}
-	err = DB.Where("login LIKE ? AND is_catchall=?", "%"+strings.ToLower(domain), "true").Find(user).Error
+	err = DB.Where("login LIKE ? AND is_catchall=?", "%"+strings.ToLower(domain), true).Find(user).Error
 	return
 }
 
@@ -2,19 +2,53 @@ package core
 
 import (
 	"bytes"
+	"errors"
 	"io/ioutil"
 	"net"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 )
 
+// basePath overrides the default base path (see SetBasePath)
+var basePath string
+
 // GetDistPath returns basePath (where tmail binaries is)
 func GetBasePath() string {
+	if basePath != "" {
+		return basePath
+	}
 	p, _ := filepath.Abs(filepath.Dir(os.Args[0]))
 	return p
 }
 
+// SetBasePath sets base path (db, nsq, ssl & tpl directories) of programs
+// embedding tmail
+func SetBasePath(p string) {
+	basePath = p
+}
+
+// PidFile returns path of the pid file of tmail daemon
+func PidFile() string {
+	return path.Join(GetBasePath(), "tmail.pid")
+}
+
+// SignalDaemon sends sig to tmail daemon (pid file)
+func SignalDaemon(sig syscall.Signal) error {
+	raw, err := ioutil.ReadFile(PidFile())
+	if err != nil {
+		return errors.New("unable to read pid file, is tmail running ? " + err.Error())
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return errors.New("bad pid file " + PidFile())
+	}
+	return syscall.Kill(pid, sig)
+}
+
 // RemoveBrackets removes trailing and ending brackets (<string> -> string)
 func RemoveBrackets(s string) string {
 	if strings.HasPrefix(s, "<") {
@@ -0,0 +1,236 @@
+package core
+
+// Vacation (auto-responder) of mailboxes
+// A mailbox can have a vacation response sent between StartAt and EndAt
+// (zero: no limit) to senders of messages, at most once per sender every
+// Interval days. Responses of vacation sieve actions use the same
+// safeguards: no response to bounces, lists, automatic messages, our own
+// addresses or if the user is not an explicit recipient (To, Cc...).
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/toorop/tmail/message"
+)
+
+// handle of mailbox vacation responses in vacation log
+const vacationHandle = "mailbox-vacation"
+
+// Vacation is the vacation response of a mailbox
+type Vacation struct {
+	Id        int64
+	Login     string `sql:"unique"`
+	Enabled   bool
+	Subject   string // default: "Auto: " + subject of message
+	Body      string `sql:"type:text;"`
+	StartAt   time.Time
+	EndAt     time.Time
+	Interval  int // days between two responses to a sender
+	UpdatedAt time.Time
+}
+
+// IsActive returns true if vacation is enabled at t
+func (v *Vacation) IsActive(t time.Time) bool {
+	if !v.Enabled {
+		return false
+	}
+	if !v.StartAt.IsZero() && t.Before(v.StartAt) {
+		return false
+	}
+	if !v.EndAt.IsZero() && t.After(v.EndAt) {
+		return false
+	}
+	return true
+}
+
+// VacationSet sets vacation of mailbox v.Login
+func VacationSet(v Vacation) (Vacation, error) {
+	user, err := UserGetByLogin(strings.ToLower(strings.TrimSpace(v.Login)))
+	if err != nil {
+		if err == gorm.RecordNotFound {
+			err = errors.New("no such user " + v.Login)
+		}
+		return v, err
+	}
+	if !user.HaveMailbox {
+		return v, errors.New("user " + user.Login + " has no mailbox")
+	}
+	if strings.TrimSpace(v.Body) == "" {
+		return v, errors.New("body of vacation response is empty")
+	}
+	if !v.StartAt.IsZero() && !v.EndAt.IsZero() && v.EndAt.Before(v.StartAt) {
+		return v, errors.New("end of vacation is before its start")
+	}
+	if v.Interval < 0 {
+		return v, errors.New("interval must be a positive number of days")
+	}
+	if v.Interval == 0 {
+		v.Interval = 7
+	}
+	current, err := VacationGet(user.Login)
+	if err != nil && err != gorm.RecordNotFound {
+		return v, err
+	}
+	v.Id, v.Login = current.Id, user.Login
+	v.Subject = strings.TrimSpace(v.Subject)
+	v.UpdatedAt = time.Now()
+	err = DB.Save(&v).Error
+	return v, err
+}
+
+// VacationGet returns vacation of mailbox login
+func VacationGet(login string) (v Vacation, err error) {
+	err = DB.Where("login = ?", strings.ToLower(login)).First(&v).Error
+	return
+}
+
+// VacationDel removes vacation of mailbox login
+func VacationDel(login string) error {
+	v, err := VacationGet(login)
+	if err != nil {
+		return err
+	}
+	return DB.Delete(&v).Error
+}
+
+// VacationList returns vacations
+func VacationList() (vacations []Vacation, err error) {
+	vacations = []Vacation{}
+	err = DB.Order("login").Find(&vacations).Error
+	return
+}
+
+// vacationDeliver sends vacation response of user, if active, to sender of
+// message of delivery d
+func vacationDeliver(d *delivery, user *User) {
+	v, err := VacationGet(user.Login)
+	if err == gorm.RecordNotFound {
+		return
+	}
+	if err != nil {
+		d.log.Error(fmt.Sprintf("delivery-local %s: unable to get vacation of %s: %s", d.id, user.Login, err))
+		return
+	}
+	if !v.IsActive(time.Now()) || d.localActionDone("vacation") {
+		return
+	}
+	msg := newSieveMessage(d.rawData, d.qMsg.MailFrom, d.qMsg.RcptTo)
+	// handle changes with vacation, a new vacation is sent again
+	response := &sieveVacation{
+		days:    v.Interval,
+		subject: v.Subject,
+		reason:  v.Body,
+		handle:  fmt.Sprintf("%s-%d", vacationHandle, v.UpdatedAt.Unix()),
+	}
+	if err = vacationRespond(d, user, msg, response); err != nil {
+		d.log.Error(fmt.Sprintf("delivery-local %s: unable to send vacation response of %s: %s", d.id, user.Login, err))
+		return
+	}
+	d.localActionRecord("vacation")
+}
+
+// vacationRespond sends vacation response v of user to sender of msg
+// (RFC 3834, RFC 5230), at most once every v.days days
+func vacationRespond(d *delivery, user *User, msg *sieveMessage, v *sieveVacation) error {
+	sender := strings.ToLower(msg.mailFrom)
+	addresses := append([]string{msg.rcptTo, user.Login}, v.addresses...)
+	// no response to bounces & our own addresses
+	if sender == "" {
+		return nil
+	}
+	for _, address := range addresses {
+		if strings.EqualFold(sender, address) {
+			return nil
+		}
+	}
+	local, domain := sender, ""
+	if p := strings.LastIndex(sender, "@"); p != -1 {
+		local, domain = sender[:p], sender[p+1:]
+	}
+	if domain == strings.ToLower(Cfg.GetMe()) {
+		return nil
+	}
+	// lists & automatic messages
+	if strings.HasPrefix(local, "owner-") || strings.HasSuffix(local, "-request") || strings.Contains(local, "mailer-daemon") || local == "postmaster" {
+		return nil
+	}
+	for _, h := range []string{"list-id", "list-unsubscribe", "list-post"} {
+		if len(msg.headers[h]) != 0 {
+			return nil
+		}
+	}
+	if as := msg.headers["auto-submitted"]; len(as) != 0 && !strings.EqualFold(strings.TrimSpace(as[0]), "no") {
+		return nil
+	}
+	if p := msg.headers["precedence"]; len(p) != 0 {
+		switch strings.ToLower(strings.TrimSpace(p[0])) {
+		case "bulk", "list", "junk":
+			return nil
+		}
+	}
+
+	// user must be an explicit recipient
+	explicit := false
+	for _, h := range []string{"to", "cc", "bcc", "resent-to", "resent-cc"} {
+		for _, value := range msg.headers[h] {
+			list, err := mail.ParseAddressList(value)
+			if err != nil {
+				continue
+			}
+			for _, a := range list {
+				for _, address := range addresses {
+					if strings.EqualFold(a.Address, address) {
+						explicit = true
+					}
+				}
+			}
+		}
+	}
+	if !explicit {
+		return nil
+	}
+
+	// once every days
+	sent, err := sieveVacationSent(user.Login, v.handle, sender, time.Duration(v.days)*24*time.Hour)
+	if err != nil || sent {
+		return err
+	}
+
+	from := v.from
+	if from == "" {
+		from = msg.rcptTo
+	}
+	subject := v.subject
+	if subject == "" {
+		subject = "Auto: "
+		if s := msg.headers["subject"]; len(s) != 0 {
+			subject += s[0]
+		}
+	}
+	hostname, _ := os.Hostname()
+	response := fmt.Sprintf("From: %s\r\nTo: <%s>\r\nSubject: %s\r\nDate: %s\r\nMessage-ID: <%d.vacation@%s>\r\nAuto-Submitted: auto-replied (vacation)\r\n", from, sender, mime.QEncoding.Encode("utf-8", subject), time.Now().Format(Time822), time.Now().UnixNano(), hostname)
+	if id := msg.headers["message-id"]; len(id) != 0 {
+		response += "In-Reply-To: " + id[0] + "\r\nReferences: " + id[0] + "\r\n"
+	}
+	response += "MIME-Version: 1.0\r\n"
+	if v.mime {
+		// reason is a MIME entity (headers & body)
+		response += strings.Replace(strings.Replace(v.reason, "\r\n", "\n", -1), "\n", "\r\n", -1)
+	} else {
+		response += "Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n" + strings.Replace(strings.Replace(v.reason, "\r\n", "\n", -1), "\n", "\r\n", -1)
+	}
+	raw := []byte(response)
+	uuid, err := QueueAddMessage(&raw, message.Envelope{MailFrom: "", RcptTo: []string{sender}}, "")
+	if err != nil {
+		return err
+	}
+	d.log.Info(fmt.Sprintf("delivery-local %s: vacation response of %s to %s queued as %s", d.id, user.Login, sender, uuid))
+	return sieveVacationRecord(user.Login, v.handle, sender)
+}
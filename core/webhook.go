@@ -0,0 +1,406 @@
+package core
+
+// Delivery webhooks
+// Events (accepted, delivered, deferred, bounced, spam) are POSTed as JSON to
+// the URLs of webhook_urls and of registered webhooks (global, per local
+// domain of recipients or of authenticated user, or per authenticated user).
+// Domain webhooks only get recipients of their domain. Requests are signed
+// with HMAC-SHA256 of the body (X-Tmail-Signature: sha256=HEX) when a secret
+// is set, failed requests are stored (WebhookRetry) and retried with an
+// exponential backoff, retries survive restarts.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/toorop/tmail/message"
+)
+
+// webhook events
+const (
+	WebhookEventAccepted  = "accepted"
+	WebhookEventDelivered = "delivered"
+	WebhookEventDeferred  = "deferred"
+	WebhookEventBounced   = "bounced"
+	WebhookEventSpam      = "spam"
+)
+
+var webhookEvents = []string{WebhookEventAccepted, WebhookEventDelivered, WebhookEventDeferred, WebhookEventBounced, WebhookEventSpam}
+
+// registered webhooks are reloaded from DB with this interval
+const webhookCacheTTL = 1 * time.Minute
+
+// Webhook represents a registered webhook
+type Webhook struct {
+	Id        int64
+	Scope     string // global, domain or user
+	Target    string // domain or user login ("" for global)
+	Url       string
+	Secret    string `json:"-"`
+	Events    string // events separated by ";" ("" for all)
+	CreatedAt time.Time
+}
+
+// WebhookEvent is the JSON body POSTed to webhooks
+type WebhookEvent struct {
+	Event     string
+	Time      time.Time
+	QueueId   string // uuid of queued message
+	SessionId string // smtpd session
+	MessageId string // Message-ID header
+	MailFrom  string
+	RcptTo    []string
+	AuthUser  string
+	Code      int    // SMTP reply code (0 if none)
+	Reason    string // error or check which flagged message
+}
+
+// WebhookRetry represents a failed request waiting for its next attempt
+type WebhookRetry struct {
+	Id            int64
+	HookId        int64 // registered webhook (0 for webhook_urls)
+	Url           string
+	Event         string
+	Body          string `sql:"type:text;"`
+	Attempts      int
+	NextAttemptAt time.Time
+}
+
+// webhookPost is a request to send
+type webhookPost struct {
+	hookId   int64 // registered webhook (0 for webhook_urls)
+	url      string
+	secret   string
+	body     []byte
+	event    string
+	attempts int
+}
+
+var (
+	webhookQueue = make(chan webhookPost, 1024)
+	webhookCache = struct {
+		sync.Mutex
+		hooks    []Webhook
+		loadedAt time.Time
+	}{}
+)
+
+// WebhookAdd registers a webhook for events (none: all)
+func WebhookAdd(scope, target, hookUrl, secret string, events []string) (hook Webhook, err error) {
+	scope = strings.ToLower(strings.TrimSpace(scope))
+	target = strings.ToLower(strings.TrimSpace(target))
+	switch scope {
+	case "", "global":
+		scope, target = "global", ""
+	case "domain":
+		if _, err = RcpthostGet(target); err != nil {
+			if err == gorm.RecordNotFound {
+				err = errors.New(target + " is not in rcpthosts")
+			}
+			return
+		}
+	case "user":
+		if target == "" {
+			return hook, errors.New("user is missing")
+		}
+	default:
+		return hook, errors.New("scope must be global, domain or user")
+	}
+	u, err := url.Parse(hookUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return hook, errors.New("bad webhook URL " + hookUrl)
+	}
+	for i, e := range events {
+		events[i] = strings.ToLower(strings.TrimSpace(e))
+		if !IsStringInSlice(events[i], webhookEvents) {
+			return hook, fmt.Errorf("unknown event %s, expected one of %s", e, strings.Join(webhookEvents, ", "))
+		}
+	}
+	hook = Webhook{
+		Scope:     scope,
+		Target:    target,
+		Url:       hookUrl,
+		Secret:    secret,
+		Events:    strings.Join(events, ";"),
+		CreatedAt: time.Now(),
+	}
+	if err = DB.Create(&hook).Error; err != nil {
+		return
+	}
+	webhookCacheReset()
+	return
+}
+
+// WebhookDel removes webhook id
+func WebhookDel(id int64) error {
+	hook := Webhook{}
+	if err := DB.Where("id = ?", id).First(&hook).Error; err != nil {
+		return err
+	}
+	if err := DB.Delete(&hook).Error; err != nil {
+		return err
+	}
+	webhookCacheReset()
+	return nil
+}
+
+// WebhookList returns registered webhooks
+func WebhookList() (hooks []Webhook, err error) {
+	hooks = []Webhook{}
+	err = DB.Order("id").Find(&hooks).Error
+	return
+}
+
+// webhookCacheReset forces a reload of registered webhooks
+func webhookCacheReset() {
+	webhookCache.Lock()
+	webhookCache.loadedAt = time.Time{}
+	webhookCache.Unlock()
+}
+
+// webhookRegistered returns registered webhooks (cached)
+func webhookRegistered() []Webhook {
+	webhookCache.Lock()
+	defer webhookCache.Unlock()
+	if time.Since(webhookCache.loadedAt) > webhookCacheTTL {
+		hooks, err := WebhookList()
+		if err != nil {
+			Log.Error("webhook - unable to get webhooks - " + err.Error())
+			return webhookCache.hooks
+		}
+		webhookCache.hooks, webhookCache.loadedAt = hooks, time.Now()
+	}
+	return webhookCache.hooks
+}
+
+// scoped returns event e as seen by hook, false if hook doesn't want it.
+// Domain webhooks get events of messages sent by authenticated users of
+// their domain, and events of messages to their domain with only its
+// recipients (sender address is not trusted).
+func (hook *Webhook) scoped(e WebhookEvent) (WebhookEvent, bool) {
+	if hook.Events != "" && !IsStringInSlice(e.Event, strings.Split(hook.Events, ";")) {
+		return e, false
+	}
+	switch hook.Scope {
+	case "domain":
+		if e.AuthUser != "" && strings.EqualFold(message.GetHostFromAddress(e.AuthUser), hook.Target) {
+			return e, true
+		}
+		rcpts := []string{}
+		for _, rcpt := range e.RcptTo {
+			if strings.EqualFold(message.GetHostFromAddress(rcpt), hook.Target) {
+				rcpts = append(rcpts, rcpt)
+			}
+		}
+		e.RcptTo = rcpts
+		return e, len(rcpts) != 0
+	case "user":
+		return e, strings.EqualFold(e.AuthUser, hook.Target)
+	}
+	return e, true
+}
+
+// webhookEmit sends event e to in-process hooks and to webhooks which want
+// it
+func webhookEmit(e WebhookEvent) {
+	e.Time = time.Now()
+	hooksEvent(e)
+	if !Cfg.GetWebhookEnabled() {
+		return
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		Log.Error("webhook - unable to encode event - " + err.Error())
+		return
+	}
+	for _, u := range Cfg.GetWebhookUrls() {
+		webhookPush(webhookPost{url: u, secret: Cfg.GetWebhookSecret(), body: body, event: e.Event})
+	}
+	for _, hook := range webhookRegistered() {
+		scoped, ok := hook.scoped(e)
+		if !ok {
+			continue
+		}
+		hookBody := body
+		if len(scoped.RcptTo) != len(e.RcptTo) {
+			if hookBody, err = json.Marshal(scoped); err != nil {
+				Log.Error("webhook - unable to encode event - " + err.Error())
+				continue
+			}
+		}
+		webhookPush(webhookPost{hookId: hook.Id, url: hook.Url, secret: hook.Secret, body: hookBody, event: e.Event})
+	}
+}
+
+// webhookPush queues request p, it's dropped if queue is full
+func webhookPush(p webhookPost) bool {
+	select {
+	case webhookQueue <- p:
+		return true
+	default:
+		Log.Error("webhook - queue is full, " + p.event + " event to " + p.url + " dropped")
+		return false
+	}
+}
+
+// webhookRetryLater stores failed request p, it will be attempted again
+// after delay
+func webhookRetryLater(p webhookPost, delay time.Duration) error {
+	return DB.Create(&WebhookRetry{
+		HookId:        p.hookId,
+		Url:           p.url,
+		Event:         p.event,
+		Body:          string(p.body),
+		Attempts:      p.attempts,
+		NextAttemptAt: time.Now().Add(delay),
+	}).Error
+}
+
+// webhookRetrySweep queues stored requests whose next attempt is due
+func webhookRetrySweep() {
+	retries := []WebhookRetry{}
+	if err := DB.Where("next_attempt_at <= ?", time.Now()).Order("next_attempt_at").Limit(cap(webhookQueue) / 2).Find(&retries).Error; err != nil {
+		Log.Error("webhook - unable to get retries - " + err.Error())
+		return
+	}
+	for _, r := range retries {
+		p := webhookPost{hookId: r.HookId, url: r.Url, body: []byte(r.Body), event: r.Event, attempts: r.Attempts}
+		if r.HookId == 0 {
+			p.secret = Cfg.GetWebhookSecret()
+		} else {
+			hook := Webhook{}
+			err := DB.Where("id = ?", r.HookId).First(&hook).Error
+			if err != nil && err != gorm.RecordNotFound {
+				Log.Error("webhook - unable to get webhook - " + err.Error())
+				continue
+			}
+			// webhook has been removed
+			if err == gorm.RecordNotFound {
+				DB.Delete(&r)
+				continue
+			}
+			p.url, p.secret = hook.Url, hook.Secret
+		}
+		// another node may have taken it
+		res := DB.Where("id = ?", r.Id).Delete(WebhookRetry{})
+		if res.Error != nil || res.RowsAffected != 1 {
+			continue
+		}
+		if !webhookPush(p) {
+			if err := webhookRetryLater(p, webhookBackoff(p.attempts)); err != nil {
+				Log.Error("webhook - unable to store retry - " + err.Error())
+			}
+		}
+	}
+}
+
+// webhookSend POSTs p
+func webhookSend(p webhookPost) error {
+	req, err := http.NewRequest("POST", p.url, bytes.NewReader(p.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tmail-Event", p.event)
+	if p.secret != "" {
+		mac := hmac.New(sha256.New, []byte(p.secret))
+		mac.Write(p.body)
+		req.Header.Set("X-Tmail-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	client := http.Client{Timeout: time.Duration(Cfg.GetWebhookTimeout()) * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// webhookBackoff returns delay before attempt (10s, 20s, 40s... 1 hour max)
+func webhookBackoff(attempt int) time.Duration {
+	delay := 10 * time.Second
+	for i := 1; i < attempt && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > time.Hour {
+		delay = time.Hour
+	}
+	return delay
+}
+
+// LaunchWebhooks launches workers sending webhooks requests, then sends
+// again stored failed requests when they are due
+func LaunchWebhooks() {
+	for i := 0; i < 4; i++ {
+		go func() {
+			for p := range webhookQueue {
+				err := webhookSend(p)
+				if err == nil {
+					continue
+				}
+				p.attempts++
+				if p.attempts >= Cfg.GetWebhookMaxAttempts() {
+					Log.Error(fmt.Sprintf("webhook - %s event to %s failed %d times, dropped - %s", p.event, p.url, p.attempts, err))
+					continue
+				}
+				delay := webhookBackoff(p.attempts)
+				Log.Info(fmt.Sprintf("webhook - %s event to %s failed, retry in %s - %s", p.event, p.url, delay, err))
+				if err = webhookRetryLater(p, delay); err != nil {
+					Log.Error(fmt.Sprintf("webhook - unable to store retry of %s event to %s, dropped - %s", p.event, p.url, err))
+				}
+			}
+		}()
+	}
+	for {
+		webhookRetrySweep()
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// webhookDelivery emits delivery event of d
+func (d *delivery) webhookDelivery(event, reason string) {
+	webhookEmit(WebhookEvent{
+		Event:     event,
+		QueueId:   d.qMsg.Uuid,
+		SessionId: d.qMsg.SessionId,
+		MessageId: d.qMsg.MessageId,
+		MailFrom:  d.qMsg.MailFrom,
+		RcptTo:    []string{d.qMsg.RcptTo},
+		AuthUser:  d.qMsg.AuthUser,
+		Code:      d.replyCode,
+		Reason:    reason,
+	})
+}
+
+// webhookMessage emits event of message received by session s (queueId ""
+// if message is not queued)
+func (s *SMTPServerSession) webhookMessage(event, queueId, reason string, rawMessage *[]byte) {
+	authUser := ""
+	if s.user != nil {
+		authUser = s.user.Login
+	}
+	webhookEmit(WebhookEvent{
+		Event:     event,
+		QueueId:   queueId,
+		SessionId: s.uuid,
+		MessageId: string(message.RawGetMessageId(rawMessage)),
+		MailFrom:  s.envelope.MailFrom,
+		RcptTo:    s.envelope.RcptTo,
+		AuthUser:  authUser,
+		Reason:    reason,
+	})
+}
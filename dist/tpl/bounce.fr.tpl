@@ -0,0 +1,16 @@
+Date: {{.Date}}
+From: MAILER-DAEMON@{{.Me}}
+To: {{.RcptTo}}
+Subject: echec de remise
+
+Bonjour. Ici le programme tmail deliverd de {{.Me}}
+Je n'ai malheureusement pas pu remettre votre message a
+l'adresse suivante. Cette erreur est definitive, j'abandonne.
+Desole.
+
+<{{.OriRcptTo}}>:
+{{.ErrMsg}}
+
+--- Une copie du message suit cette ligne.
+
+{{.BouncedMail}}
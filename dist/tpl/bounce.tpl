@@ -8,7 +8,7 @@ I'm afraid I wasn't able to deliver your message to the
 following addresses. This is a permanent error; I've given up.
 Sorry it didn't work out.
 
-<{{.RcptTo}}>:
+<{{.OriRcptTo}}>:
 {{.ErrMsg}}
 
 --- Below this line is a copy of the message.
@@ -0,0 +1,42 @@
+Date: {{.Date}}
+From: MAILER-DAEMON@{{.Me}}
+To: {{.RcptTo}}
+Subject: message retarde (nouvelles tentatives en cours)
+Auto-Submitted: auto-replied
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=delivery-status;
+	boundary="{{.Boundary}}"
+
+This is a MIME-encapsulated message.
+
+--{{.Boundary}}
+Content-Type: text/plain; charset=us-ascii
+
+Bonjour. Ici le programme tmail deliverd de {{.Me}}
+Votre message aux adresses suivantes n'a pas encore pu etre remis.
+Cette erreur est temporaire, je reessaierai jusqu'au {{.GiveUpAt}}.
+Vous n'avez pas besoin de renvoyer votre message.
+
+{{range .Delayed}}<{{.Address}}>:
+{{.ErrMsg}}
+
+{{end}}En file d'attente depuis : {{.QueuedAt}} ({{.Delay}}, {{.Retries}} tentatives)
+
+--{{.Boundary}}
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; {{.Me}}
+Arrival-Date: {{.QueuedAt}}
+{{range .Delayed}}
+Final-Recipient: rfc822; {{.Address}}
+Action: delayed
+Status: {{or .Status "4.0.0"}}
+{{if .DiagnosticCode}}Diagnostic-Code: smtp; {{.DiagnosticCode}}
+{{end}}Last-Attempt-Date: {{$.Date}}
+Will-Retry-Until: {{$.GiveUpAt}}
+{{end}}
+--{{.Boundary}}
+Content-Type: text/rfc822-headers
+
+{{.BouncedHeaders}}
+--{{.Boundary}}--
@@ -0,0 +1,42 @@
+Date: {{.Date}}
+From: MAILER-DAEMON@{{.Me}}
+To: {{.RcptTo}}
+Subject: delayed mail (still being retried)
+Auto-Submitted: auto-replied
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=delivery-status;
+	boundary="{{.Boundary}}"
+
+This is a MIME-encapsulated message.
+
+--{{.Boundary}}
+Content-Type: text/plain; charset=us-ascii
+
+Hi. This is the tmail deliverd program at {{.Me}}
+Your message to the following addresses has not been delivered yet.
+This is a temporary error; I'll keep on trying until {{.GiveUpAt}}.
+You don't have to resend your message.
+
+{{range .Delayed}}<{{.Address}}>:
+{{.ErrMsg}}
+
+{{end}}Queued at: {{.QueuedAt}} ({{.Delay}} ago, {{.Retries}} attempts)
+
+--{{.Boundary}}
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; {{.Me}}
+Arrival-Date: {{.QueuedAt}}
+{{range .Delayed}}
+Final-Recipient: rfc822; {{.Address}}
+Action: delayed
+Status: {{or .Status "4.0.0"}}
+{{if .DiagnosticCode}}Diagnostic-Code: smtp; {{.DiagnosticCode}}
+{{end}}Last-Attempt-Date: {{$.Date}}
+Will-Retry-Until: {{$.GiveUpAt}}
+{{end}}
+--{{.Boundary}}
+Content-Type: text/rfc822-headers
+
+{{.BouncedHeaders}}
+--{{.Boundary}}--
@@ -0,0 +1,32 @@
+Date: {{.Date}}
+From: {{.From}}
+To: {{.To}}
+Subject: Mail digest for {{.Domain}} ({{.Begin}}{{if ne .Begin .End}} - {{.End}}{{end}})
+Message-ID: <{{.MessageId}}>
+MIME-Version: 1.0
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: 8bit
+
+Mail digest for {{.Domain}} from {{.Me}}
+Period: {{.Begin}}{{if ne .Begin .End}} - {{.End}}{{end}} (UTC)
+
+Volumes
+  Sent:     {{.Sent}}
+  Received: {{.Received}}
+  Deferred: {{.Deferred}}
+  Bounced:  {{.Bounced}}
+{{if .TopDeferrals}}
+Top deferral reasons
+{{range .TopDeferrals}}  {{.Count}} - {{.Reason}}
+{{end}}{{end}}
+DMARC failures: {{.DmarcFailures}}
+{{range .DmarcSources}}  {{.Count}} from {{.Reason}}
+{{end}}
+Quarantined messages: {{.Quarantined}}
+{{range .QuarantineReasons}}  {{.Count}} - {{.Reason}}
+{{end}}{{if .QuotaWarnings}}
+Mailboxes near their quota
+{{range .QuotaWarnings}}  {{.Login}}: {{.Usage}}% of {{.Quota}}
+{{end}}{{end}}
+--
+You receive this digest because {{.Domain}} is subscribed to digests on {{.Me}}.
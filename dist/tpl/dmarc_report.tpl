@@ -0,0 +1,20 @@
+Date: {{.Date}}
+From: {{.From}}
+To: {{.To}}
+Subject: Report Domain: {{.Domain}} Submitter: {{.Me}} Report-ID: <{{.ReportId}}>
+Message-ID: <{{.MessageId}}>
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="{{.Boundary}}"
+
+--{{.Boundary}}
+Content-Type: text/plain; charset=us-ascii
+
+This is a DMARC aggregate report for {{.Domain}} from {{.Me}}.
+
+--{{.Boundary}}
+Content-Type: application/gzip; name="{{.Filename}}"
+Content-Disposition: attachment; filename="{{.Filename}}"
+Content-Transfer-Encoding: base64
+
+{{.Attachment}}
+--{{.Boundary}}--
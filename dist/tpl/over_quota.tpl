@@ -0,0 +1,17 @@
+Date: {{.Date}}
+From: MAILER-DAEMON@{{.Me}}
+To: {{.RcptTo}}
+Subject: failure notice (mailbox full)
+
+Hi. This is the tmail deliverd program at {{.Me}}
+I'm afraid I wasn't able to deliver your message to the
+following address: the mailbox of the recipient is full.
+This is a permanent error; I've given up.
+Sorry it didn't work out.
+
+<{{.OriRcptTo}}>:
+{{.ErrMsg}}
+
+--- Below this line are the headers of the message.
+
+{{.BouncedHeaders}}
@@ -0,0 +1,21 @@
+Date: {{.Date}}
+From: {{.From}}
+To: {{.To}}
+Subject: Quarantined messages for {{.To}}
+Message-ID: <{{.MessageId}}>
+Auto-Submitted: auto-generated
+MIME-Version: 1.0
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: 8bit
+
+The following messages sent to {{.To}} have been put in quarantine by {{.Me}}.
+{{if .Lifetime}}They will be deleted after {{.Lifetime}} days.
+{{end}}To get one of them delivered, ask your administrator to release it
+(give its ID).
+{{range .Messages}}
+ID:      {{.Id}}
+Date:    {{.AddedAt.UTC.Format "2006-01-02 15:04"}} UTC
+From:    {{.MailFrom}}
+Subject: {{.Subject}}
+Reason:  {{.Reason}}
+{{end}}
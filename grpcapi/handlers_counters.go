@@ -0,0 +1,60 @@
+package grpcapi
+
+import (
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/toorop/tmail/api"
+	"github.com/toorop/tmail/core"
+	"github.com/toorop/tmail/mgmtproto"
+)
+
+// Counters sends live counters of the node every interval seconds (once if
+// interval is 0) until client cancels
+func (s *server) Counters(in *mgmtproto.CountersRequest, stream mgmtproto.Management_CountersServer) error {
+	interval := time.Duration(in.GetInterval()) * time.Second
+	for {
+		if err := stream.Send(nodeCounters()); err != nil {
+			return err
+		}
+		if interval <= 0 {
+			return nil
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// nodeCounters returns current counters of the node
+func nodeCounters() *mgmtproto.NodeCounters {
+	stats, throttle := api.MonitorGetStats(), api.ThrottleGetStats()
+	counters := &mgmtproto.NodeCounters{
+		Node:             proto.String(core.ClusterNodeId()),
+		Time:             proto.Int64(time.Now().Unix()),
+		Goroutines:       proto.Int32(int32(stats.Goroutines)),
+		OpenFds:          proto.Int32(int32(stats.OpenFds)),
+		SmtpdSessions:    proto.Int32(int32(throttle.Sessions)),
+		SmtpdMaxSessions: proto.Int32(int32(throttle.MaxSessions)),
+		Subsystems:       []*mgmtproto.SubsystemCounters{},
+	}
+	names := []string{}
+	for name := range stats.Subsystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ss := stats.Subsystems[name]
+		counters.Subsystems = append(counters.Subsystems, &mgmtproto.SubsystemCounters{
+			Name:          proto.String(name),
+			Goroutines:    proto.Int64(ss.Goroutines),
+			OpenConns:     proto.Int32(int32(ss.OpenConns)),
+			OldestConnAge: proto.Int64(int64(ss.OldestConnAge / time.Second)),
+		})
+	}
+	return counters
+}
@@ -0,0 +1,128 @@
+package grpcapi
+
+import (
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/toorop/tmail/api"
+	"github.com/toorop/tmail/core"
+	"github.com/toorop/tmail/mgmtproto"
+)
+
+// QueueList returns messages in queue
+func (s *server) QueueList(ctx context.Context, in *mgmtproto.Empty) (*mgmtproto.QueuedMessages, error) {
+	messages, err := api.QueueGetMessages()
+	if err != nil {
+		return nil, rpcError(err, codes.Internal, "unable to get messages in queue")
+	}
+	out := &mgmtproto.QueuedMessages{Messages: []*mgmtproto.QueuedMessage{}}
+	for i := range messages {
+		m := &messages[i]
+		out.Messages = append(out.Messages, &mgmtproto.QueuedMessage{
+			Id:                  proto.Int64(m.Id),
+			Uuid:                proto.String(m.Uuid),
+			MailFrom:            proto.String(m.MailFrom),
+			AuthUser:            proto.String(m.AuthUser),
+			RcptTo:              proto.String(m.RcptTo),
+			MessageId:           proto.String(m.MessageId),
+			Host:                proto.String(m.Host),
+			AddedAt:             proto.Int64(m.AddedAt.Unix()),
+			NextDeliveryAt:      proto.Int64(m.NextDeliveryScheduledAt.Unix()),
+			Status:              proto.Uint32(m.Status),
+			DeliveryFailedCount: proto.Uint32(m.DeliveryFailedCount),
+			LastError:           proto.String(m.LastError),
+		})
+	}
+	return out, nil
+}
+
+// QueueDiscard discards a message (deleted without bounce)
+func (s *server) QueueDiscard(ctx context.Context, in *mgmtproto.Id) (*mgmtproto.Empty, error) {
+	if err := api.QueueDiscardMsg(in.GetId()); err != nil {
+		return nil, rpcError(err, codes.FailedPrecondition, "unable to discard message "+strconv.FormatInt(in.GetId(), 10))
+	}
+	logInfo(ctx, "QueueDiscard", "message "+strconv.FormatInt(in.GetId(), 10)+" discarded")
+	return &mgmtproto.Empty{}, nil
+}
+
+// QueueBounce bounces a message
+func (s *server) QueueBounce(ctx context.Context, in *mgmtproto.Id) (*mgmtproto.Empty, error) {
+	if err := api.QueueBounceMsg(in.GetId()); err != nil {
+		return nil, rpcError(err, codes.FailedPrecondition, "unable to bounce message "+strconv.FormatInt(in.GetId(), 10))
+	}
+	logInfo(ctx, "QueueBounce", "message "+strconv.FormatInt(in.GetId(), 10)+" bounced")
+	return &mgmtproto.Empty{}, nil
+}
+
+// QueueHold puts messages of target on hold
+func (s *server) QueueHold(ctx context.Context, in *mgmtproto.Target) (*mgmtproto.Count, error) {
+	n, err := api.QueueHold(in.GetTarget())
+	if err != nil {
+		return nil, rpcError(err, codes.InvalidArgument, "unable to hold messages of "+in.GetTarget())
+	}
+	logInfo(ctx, "QueueHold", strconv.Itoa(n)+" messages of "+in.GetTarget()+" on hold")
+	return &mgmtproto.Count{Count: proto.Int32(int32(n))}, nil
+}
+
+// QueueRelease releases messages of target on hold
+func (s *server) QueueRelease(ctx context.Context, in *mgmtproto.Target) (*mgmtproto.Count, error) {
+	n, err := api.QueueRelease(in.GetTarget())
+	if err != nil {
+		return nil, rpcError(err, codes.InvalidArgument, "unable to release messages of "+in.GetTarget())
+	}
+	logInfo(ctx, "QueueRelease", strconv.Itoa(n)+" messages of "+in.GetTarget()+" released")
+	return &mgmtproto.Count{Count: proto.Int32(int32(n))}, nil
+}
+
+// QueueFlush forces an immediate delivery attempt of messages of target
+func (s *server) QueueFlush(ctx context.Context, in *mgmtproto.Target) (*mgmtproto.Count, error) {
+	n, err := api.QueueFlush(in.GetTarget())
+	if err != nil {
+		return nil, rpcError(err, codes.InvalidArgument, "unable to flush messages of "+in.GetTarget())
+	}
+	logInfo(ctx, "QueueFlush", strconv.Itoa(n)+" messages of "+in.GetTarget()+" flushed")
+	return &mgmtproto.Count{Count: proto.Int32(int32(n))}, nil
+}
+
+// QueueInject puts a message in queue, envelope is in the first chunk, the
+// raw message in data of chunks (smtpd_max_databytes at most)
+func (s *server) QueueInject(stream mgmtproto.Management_QueueInjectServer) error {
+	var first *mgmtproto.InjectChunk
+	raw := []byte{}
+	max := core.Cfg.GetSmtpdMaxDataBytes()
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if first == nil {
+			first = chunk
+		}
+		raw = append(raw, chunk.GetData()...)
+		if max != 0 && len(raw) > max {
+			return grpc.Errorf(codes.ResourceExhausted, "message exceeds %d bytes", max)
+		}
+	}
+	if first == nil {
+		return grpc.Errorf(codes.InvalidArgument, "no message received")
+	}
+	sendAt := time.Time{}
+	if first.GetSendAt() != 0 {
+		sendAt = time.Unix(first.GetSendAt(), 0)
+	}
+	id, err := api.QueueInject(raw, first.GetMailFrom(), first.GetRcptTo(), sendAt)
+	if err != nil {
+		return rpcError(err, codes.InvalidArgument, "unable to queue message")
+	}
+	logInfo(stream.Context(), "QueueInject", "message queued as "+id)
+	return stream.SendAndClose(&mgmtproto.Injected{Id: proto.String(id)})
+}
@@ -0,0 +1,62 @@
+package grpcapi
+
+import (
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+
+	"github.com/toorop/tmail/api"
+	"github.com/toorop/tmail/mgmtproto"
+)
+
+// RouteList returns routes (without SMTP auth passwords)
+func (s *server) RouteList(ctx context.Context, in *mgmtproto.Empty) (*mgmtproto.Routes, error) {
+	routes, err := api.RoutesGet()
+	if err != nil {
+		return nil, rpcError(err, codes.Internal, "unable to get routes")
+	}
+	out := &mgmtproto.Routes{Routes: []*mgmtproto.Route{}}
+	for _, r := range routes {
+		out.Routes = append(out.Routes, &mgmtproto.Route{
+			Id:            proto.Int64(r.Id),
+			Host:          proto.String(r.Host),
+			LocalIp:       proto.String(r.LocalIp.String),
+			RemoteHost:    proto.String(r.RemoteHost),
+			RemotePort:    proto.Int32(int32(r.RemotePort.Int64)),
+			Priority:      proto.Int32(int32(r.Priority.Int64)),
+			User:          proto.String(r.User.String),
+			MailFrom:      proto.String(r.MailFrom.String),
+			SmtpAuthLogin: proto.String(r.SmtpAuthLogin.String),
+			SmtpAuthMech:  proto.String(r.SmtpAuthMech.String),
+			ForwardClient: proto.String(r.ForwardClient.String),
+			RetrySchedule: proto.String(r.RetrySchedule.String),
+			Proxy:         proto.String(r.Proxy.String),
+			Weight:        proto.Int32(int32(r.Weight.Int64)),
+			MxFallback:    proto.Bool(r.MxFallback),
+			IpFamily:      proto.String(r.IpFamily.String),
+			Timeouts:      proto.String(r.Timeouts.String),
+		})
+	}
+	return out, nil
+}
+
+// RouteAdd adds a route
+func (s *server) RouteAdd(ctx context.Context, in *mgmtproto.Route) (*mgmtproto.Empty, error) {
+	err := api.RoutesAdd(in.GetHost(), in.GetLocalIp(), in.GetRemoteHost(), int(in.GetRemotePort()), int(in.GetPriority()), in.GetUser(), in.GetMailFrom(), in.GetSmtpAuthLogin(), in.GetSmtpAuthPasswd(), in.GetForwardClient(), in.GetRetrySchedule(), in.GetProxy(), in.GetSmtpAuthMech(), int(in.GetWeight()), in.GetMxFallback(), in.GetIpFamily(), in.GetTimeouts())
+	if err != nil {
+		return nil, rpcError(err, codes.InvalidArgument, "unable to add route to "+in.GetHost())
+	}
+	logInfo(ctx, "RouteAdd", "route to "+in.GetHost()+" via "+in.GetRemoteHost()+" added")
+	return &mgmtproto.Empty{}, nil
+}
+
+// RouteDel removes a route
+func (s *server) RouteDel(ctx context.Context, in *mgmtproto.Id) (*mgmtproto.Empty, error) {
+	if err := api.RoutesDel(in.GetId()); err != nil {
+		return nil, rpcError(err, codes.InvalidArgument, "unable to delete route "+strconv.FormatInt(in.GetId(), 10))
+	}
+	logInfo(ctx, "RouteDel", "route "+strconv.FormatInt(in.GetId(), 10)+" deleted")
+	return &mgmtproto.Empty{}, nil
+}
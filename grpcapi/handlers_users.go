@@ -0,0 +1,86 @@
+package grpcapi
+
+import (
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+
+	"github.com/toorop/tmail/api"
+	"github.com/toorop/tmail/mgmtproto"
+)
+
+// UserList returns users
+func (s *server) UserList(ctx context.Context, in *mgmtproto.Empty) (*mgmtproto.Users, error) {
+	users, err := api.UserGetAll()
+	if err != nil {
+		return nil, rpcError(err, codes.Internal, "unable to get users")
+	}
+	out := &mgmtproto.Users{Users: []*mgmtproto.User{}}
+	for _, u := range users {
+		out.Users = append(out.Users, &mgmtproto.User{
+			Login:         proto.String(u.Login),
+			MailboxQuota:  proto.String(u.MailboxQuota),
+			MailboxDriver: proto.String(u.MailboxDriver),
+			HaveMailbox:   proto.Bool(u.HaveMailbox),
+			AuthRelay:     proto.Bool(u.AuthRelay),
+			IsCatchall:    proto.Bool(u.IsCatchall),
+			Active:        proto.Bool(u.Active == "Y"),
+		})
+	}
+	return out, nil
+}
+
+// UserAdd adds an user
+func (s *server) UserAdd(ctx context.Context, in *mgmtproto.User) (*mgmtproto.Empty, error) {
+	if err := api.UserAdd(in.GetLogin(), in.GetPasswd(), in.GetMailboxQuota(), in.GetMailboxDriver(), in.GetHaveMailbox(), in.GetAuthRelay(), in.GetIsCatchall()); err != nil {
+		return nil, rpcError(err, codes.InvalidArgument, "unable to add user "+in.GetLogin())
+	}
+	logInfo(ctx, "UserAdd", "user "+in.GetLogin()+" added")
+	return &mgmtproto.Empty{}, nil
+}
+
+// UserDel removes an user
+func (s *server) UserDel(ctx context.Context, in *mgmtproto.Name) (*mgmtproto.Empty, error) {
+	if err := api.UserDel(in.GetName()); err != nil {
+		return nil, rpcError(err, codes.InvalidArgument, "unable to delete user "+in.GetName())
+	}
+	logInfo(ctx, "UserDel", "user "+in.GetName()+" deleted")
+	return &mgmtproto.Empty{}, nil
+}
+
+// AliasList returns aliases
+func (s *server) AliasList(ctx context.Context, in *mgmtproto.Empty) (*mgmtproto.Aliases, error) {
+	aliases, err := api.AliasList()
+	if err != nil {
+		return nil, rpcError(err, codes.Internal, "unable to get aliases")
+	}
+	out := &mgmtproto.Aliases{Aliases: []*mgmtproto.Alias{}}
+	for _, a := range aliases {
+		out.Aliases = append(out.Aliases, &mgmtproto.Alias{
+			Alias:         proto.String(a.Alias),
+			DeliverTo:     proto.String(a.DeliverTo),
+			Pipe:          proto.String(a.Pipe),
+			IsMinilist:    proto.Bool(a.IsMiniList),
+			IsDomainAlias: proto.Bool(a.IsDomAlias),
+		})
+	}
+	return out, nil
+}
+
+// AliasAdd adds an alias
+func (s *server) AliasAdd(ctx context.Context, in *mgmtproto.Alias) (*mgmtproto.Empty, error) {
+	if err := api.AliasAdd(in.GetAlias(), in.GetDeliverTo(), in.GetPipe(), in.GetIsMinilist()); err != nil {
+		return nil, rpcError(err, codes.InvalidArgument, "unable to add alias "+in.GetAlias())
+	}
+	logInfo(ctx, "AliasAdd", "alias "+in.GetAlias()+" added")
+	return &mgmtproto.Empty{}, nil
+}
+
+// AliasDel removes an alias
+func (s *server) AliasDel(ctx context.Context, in *mgmtproto.Name) (*mgmtproto.Empty, error) {
+	if err := api.AliasDel(in.GetName()); err != nil {
+		return nil, rpcError(err, codes.InvalidArgument, "unable to delete alias "+in.GetName())
+	}
+	logInfo(ctx, "AliasDel", "alias "+in.GetName()+" deleted")
+	return &mgmtproto.Empty{}, nil
+}
@@ -0,0 +1,126 @@
+// Package grpcapi is the gRPC management server of tmail (service
+// mgmtproto.Management): queue, users, aliases, routes, live counters and
+// message injection.
+//
+// Clients are authenticated by TLS: their certificate must be signed by
+// grpc_server_client_ca and, if grpc_server_clients is set, its common name
+// must be one of the listed ones.
+package grpcapi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+
+	"github.com/toorop/tmail/core"
+	"github.com/toorop/tmail/mgmtproto"
+)
+
+// server implements mgmtproto.ManagementServer
+type server struct{}
+
+// LaunchServer launches gRPC server
+func LaunchServer() {
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		log.Fatalln("grpc - " + err.Error())
+	}
+	addr := fmt.Sprintf("%s:%d", core.Cfg.GetGrpcServerIp(), core.Cfg.GetGrpcServerPort())
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalln("grpc - " + err.Error())
+	}
+	s := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
+	mgmtproto.RegisterManagementServer(s, &server{})
+	core.Log.Info("grpc " + addr + " TLS launched")
+	log.Fatalln(s.Serve(listener))
+}
+
+// basePathOf returns p relative to base path (if p is relative)
+func basePathOf(p string) string {
+	if path.IsAbs(p) {
+		return p
+	}
+	return path.Join(core.GetBasePath(), p)
+}
+
+// serverTLSConfig returns TLS config of server: clients must present a
+// certificate signed by client CA (and allowed if grpc_server_clients is
+// set)
+func serverTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(basePathOf(core.Cfg.GetGrpcServerCert()), basePathOf(core.Cfg.GetGrpcServerKey()))
+	if err != nil {
+		return nil, errors.New("unable to load certificate of server - " + err.Error())
+	}
+	pem, err := ioutil.ReadFile(basePathOf(core.Cfg.GetGrpcServerClientCa()))
+	if err != nil {
+		return nil, errors.New("unable to read client CA - " + err.Error())
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate found in client CA " + core.Cfg.GetGrpcServerClientCa())
+	}
+	allowed := map[string]bool{}
+	for _, cn := range core.Cfg.GetGrpcServerClients() {
+		if cn = strings.TrimSpace(cn); cn != "" {
+			allowed[cn] = true
+		}
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if len(allowed) == 0 {
+				return nil
+			}
+			for _, chain := range verifiedChains {
+				if len(chain) != 0 && allowed[chain[0].Subject.CommonName] {
+					return nil
+				}
+			}
+			return errors.New("client certificate is not allowed (grpc_server_clients)")
+		},
+	}, nil
+}
+
+// clientOf returns identity of client of ctx: common name of its
+// certificate and address
+func clientOf(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "unknown client"
+	}
+	if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.PeerCertificates) != 0 {
+		return tlsInfo.State.PeerCertificates[0].Subject.CommonName + " " + p.Addr.String()
+	}
+	return p.Addr.String()
+}
+
+// logInfo is a log helper for INFO logs
+func logInfo(ctx context.Context, method string, msg ...string) {
+	core.Log.Info("grpc", clientOf(ctx), "-", method, "-", strings.Join(msg, " "))
+}
+
+// rpcError returns gRPC error of err with code (NotFound if record is not
+// found)
+func rpcError(err error, code codes.Code, msg string) error {
+	if err == gorm.RecordNotFound {
+		code = codes.NotFound
+	}
+	return grpc.Errorf(code, "%s - %s", msg, err.Error())
+}
@@ -4,4 +4,12 @@ package message
 type Envelope struct {
 	MailFrom string
 	RcptTo   []string
+	// ESMTP parameters passed through to next hop (KEYWORD[=value])
+	MailParams []string
+	RcptParams map[string][]string // by recipient
+	// Metadata set by in-process hooks, stored with queued messages
+	Metadata map[string]string
+	// Results of our authentication checks (value of our
+	// Authentication-Results header), used to ARC seal the message
+	AuthResults string
 }
@@ -30,3 +30,29 @@ func Test_FoldHeader(t *testing.T) {
 	println(string(header))
 	assert.NotEmpty(t, header)
 }
+
+func Test_RawCountHeaders(t *testing.T) {
+	raw := []byte("Received: from a\r\nDelivered-To: b@c\r\nreceived: from d\r\nSubject: received\r\n\r\nReceived: body\r\n")
+	assert.Equal(t, 3, RawCountHeaders(&raw, "received", "delivered"))
+}
+
+func Test_RawGetHeaderValue(t *testing.T) {
+	raw := []byte("Subject: foo\r\nFrom: \"Bar\"\r\n <bar@example.com>\r\n\r\nFrom: body\r\n")
+	assert.Equal(t, "\"Bar\" <bar@example.com>", RawGetHeaderValue(&raw, "from"))
+	assert.Equal(t, "foo", RawGetHeaderValue(&raw, "Subject"))
+	assert.Equal(t, "", RawGetHeaderValue(&raw, "To"))
+}
+
+func Test_RawGetHeaderFields(t *testing.T) {
+	raw := []byte("Subject: foo\r\nFrom: \"Bar\"\r\n <bar@example.com>\r\n\r\nTo: body\r\n")
+	assert.Equal(t, []string{"Subject: foo", "From: \"Bar\"\r\n <bar@example.com>"}, RawGetHeaderFields(&raw))
+}
+
+func Test_RawSetHeaderFields(t *testing.T) {
+	raw := []byte("Subject: foo\r\nReceived: from a\r\n by b\r\n\r\nReceived: body\r\n")
+	RawSetHeaderFields(&raw, []string{"X-Foo: bar", "Subject: foo"})
+	assert.Equal(t, "X-Foo: bar\r\nSubject: foo\r\n\r\nReceived: body\r\n", string(raw))
+	raw = []byte("Subject: foo")
+	RawSetHeaderFields(&raw, []string{"Subject: bar"})
+	assert.Equal(t, "Subject: bar\r\n\r\n", string(raw))
+}
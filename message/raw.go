@@ -39,3 +39,74 @@ func RawGetMessageId(raw *[]byte) []byte {
 	}
 	return []byte{}
 }
+
+// RawCountHeaders returns the number of header lines starting with one of the
+// given prefixes (case insensitive)
+func RawCountHeaders(raw *[]byte, headers ...string) int {
+	count := 0
+	for _, line := range bytes.Split(RawGetHeaders(raw), []byte{10}) {
+		lower := bytes.ToLower(line)
+		for _, h := range headers {
+			if bytes.HasPrefix(lower, []byte(strings.ToLower(h))) {
+				count++
+				break
+			}
+		}
+	}
+	return count
+}
+
+// RawGetHeaderValue returns the (unfolded) value of the first header
+// header found in raw mail or an empty string
+func RawGetHeaderValue(raw *[]byte, header string) string {
+	bHeader := []byte(strings.ToLower(header) + ":")
+	lines := bytes.Split(RawGetHeaders(raw), []byte{13, 10})
+	for i, line := range lines {
+		if !bytes.HasPrefix(bytes.ToLower(line), bHeader) {
+			continue
+		}
+		value := string(line[len(bHeader):])
+		// folded ?
+		for _, next := range lines[i+1:] {
+			if len(next) == 0 || (next[0] != 32 && next[0] != 9) {
+				break
+			}
+			value += string(next)
+		}
+		return strings.TrimSpace(value)
+	}
+	return ""
+}
+
+// RawGetHeaderFields returns raw header fields (folded lines included,
+// without the trailing CRLF), in the order they appear
+func RawGetHeaderFields(raw *[]byte) []string {
+	fields := []string{}
+	for _, line := range bytes.Split(RawGetHeaders(raw), []byte{13, 10}) {
+		if len(line) == 0 {
+			continue
+		}
+		if (line[0] == 32 || line[0] == 9) && len(fields) != 0 {
+			fields[len(fields)-1] += "\r\n" + string(line)
+			continue
+		}
+		fields = append(fields, string(line))
+	}
+	return fields
+}
+
+// RawSetHeaderFields replaces header fields of raw mail by fields (as
+// returned by RawGetHeaderFields), the body is kept
+func RawSetHeaderFields(raw *[]byte, fields []string) {
+	body := []byte{13, 10}
+	if p := bytes.Index(*raw, []byte{13, 10, 13, 10}); p != -1 {
+		body = (*raw)[p+2:]
+	}
+	b := new(bytes.Buffer)
+	for _, field := range fields {
+		b.WriteString(field)
+		b.WriteString("\r\n")
+	}
+	b.Write(body)
+	*raw = b.Bytes()
+}
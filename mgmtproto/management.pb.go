@@ -0,0 +1,1298 @@
+// Code generated by protoc-gen-go.
+// source: management.proto
+// DO NOT EDIT!
+
+/*
+Package mgmtproto is a generated protocol buffer package.
+
+It is generated from these files:
+	management.proto
+
+It has these top-level messages:
+	Empty
+	Id
+	Name
+	Target
+	Count
+	QueuedMessage
+	QueuedMessages
+	InjectChunk
+	Injected
+	User
+	Users
+	Alias
+	Aliases
+	Route
+	Routes
+	CountersRequest
+	SubsystemCounters
+	NodeCounters
+*/
+package mgmtproto
+
+import proto "github.com/golang/protobuf/proto"
+import math "math"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = math.Inf
+
+type Empty struct {
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *Empty) Reset()         { *m = Empty{} }
+func (m *Empty) String() string { return proto.CompactTextString(m) }
+func (*Empty) ProtoMessage()    {}
+
+type Id struct {
+	Id               *int64 `protobuf:"varint,1,req,name=id" json:"id,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *Id) Reset()         { *m = Id{} }
+func (m *Id) String() string { return proto.CompactTextString(m) }
+func (*Id) ProtoMessage()    {}
+
+func (m *Id) GetId() int64 {
+	if m != nil && m.Id != nil {
+		return *m.Id
+	}
+	return 0
+}
+
+type Name struct {
+	Name             *string `protobuf:"bytes,1,req,name=name" json:"name,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Name) Reset()         { *m = Name{} }
+func (m *Name) String() string { return proto.CompactTextString(m) }
+func (*Name) ProtoMessage()    {}
+
+func (m *Name) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+// message ID or destination domain
+type Target struct {
+	Target           *string `protobuf:"bytes,1,req,name=target" json:"target,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Target) Reset()         { *m = Target{} }
+func (m *Target) String() string { return proto.CompactTextString(m) }
+func (*Target) ProtoMessage()    {}
+
+func (m *Target) GetTarget() string {
+	if m != nil && m.Target != nil {
+		return *m.Target
+	}
+	return ""
+}
+
+type Count struct {
+	Count            *int32 `protobuf:"varint,1,req,name=count" json:"count,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *Count) Reset()         { *m = Count{} }
+func (m *Count) String() string { return proto.CompactTextString(m) }
+func (*Count) ProtoMessage()    {}
+
+func (m *Count) GetCount() int32 {
+	if m != nil && m.Count != nil {
+		return *m.Count
+	}
+	return 0
+}
+
+type QueuedMessage struct {
+	Id                  *int64  `protobuf:"varint,1,req,name=id" json:"id,omitempty"`
+	Uuid                *string `protobuf:"bytes,2,req,name=uuid" json:"uuid,omitempty"`
+	MailFrom            *string `protobuf:"bytes,3,opt,name=mail_from" json:"mail_from,omitempty"`
+	AuthUser            *string `protobuf:"bytes,4,opt,name=auth_user" json:"auth_user,omitempty"`
+	RcptTo              *string `protobuf:"bytes,5,opt,name=rcpt_to" json:"rcpt_to,omitempty"`
+	MessageId           *string `protobuf:"bytes,6,opt,name=message_id" json:"message_id,omitempty"`
+	Host                *string `protobuf:"bytes,7,opt,name=host" json:"host,omitempty"`
+	AddedAt             *int64  `protobuf:"varint,8,opt,name=added_at" json:"added_at,omitempty"`
+	NextDeliveryAt      *int64  `protobuf:"varint,9,opt,name=next_delivery_at" json:"next_delivery_at,omitempty"`
+	Status              *uint32 `protobuf:"varint,10,opt,name=status" json:"status,omitempty"`
+	DeliveryFailedCount *uint32 `protobuf:"varint,11,opt,name=delivery_failed_count" json:"delivery_failed_count,omitempty"`
+	LastError           *string `protobuf:"bytes,12,opt,name=last_error" json:"last_error,omitempty"`
+	XXX_unrecognized    []byte  `json:"-"`
+}
+
+func (m *QueuedMessage) Reset()         { *m = QueuedMessage{} }
+func (m *QueuedMessage) String() string { return proto.CompactTextString(m) }
+func (*QueuedMessage) ProtoMessage()    {}
+
+func (m *QueuedMessage) GetId() int64 {
+	if m != nil && m.Id != nil {
+		return *m.Id
+	}
+	return 0
+}
+
+func (m *QueuedMessage) GetUuid() string {
+	if m != nil && m.Uuid != nil {
+		return *m.Uuid
+	}
+	return ""
+}
+
+func (m *QueuedMessage) GetMailFrom() string {
+	if m != nil && m.MailFrom != nil {
+		return *m.MailFrom
+	}
+	return ""
+}
+
+func (m *QueuedMessage) GetAuthUser() string {
+	if m != nil && m.AuthUser != nil {
+		return *m.AuthUser
+	}
+	return ""
+}
+
+func (m *QueuedMessage) GetRcptTo() string {
+	if m != nil && m.RcptTo != nil {
+		return *m.RcptTo
+	}
+	return ""
+}
+
+func (m *QueuedMessage) GetMessageId() string {
+	if m != nil && m.MessageId != nil {
+		return *m.MessageId
+	}
+	return ""
+}
+
+func (m *QueuedMessage) GetHost() string {
+	if m != nil && m.Host != nil {
+		return *m.Host
+	}
+	return ""
+}
+
+func (m *QueuedMessage) GetAddedAt() int64 {
+	if m != nil && m.AddedAt != nil {
+		return *m.AddedAt
+	}
+	return 0
+}
+
+func (m *QueuedMessage) GetNextDeliveryAt() int64 {
+	if m != nil && m.NextDeliveryAt != nil {
+		return *m.NextDeliveryAt
+	}
+	return 0
+}
+
+func (m *QueuedMessage) GetStatus() uint32 {
+	if m != nil && m.Status != nil {
+		return *m.Status
+	}
+	return 0
+}
+
+func (m *QueuedMessage) GetDeliveryFailedCount() uint32 {
+	if m != nil && m.DeliveryFailedCount != nil {
+		return *m.DeliveryFailedCount
+	}
+	return 0
+}
+
+func (m *QueuedMessage) GetLastError() string {
+	if m != nil && m.LastError != nil {
+		return *m.LastError
+	}
+	return ""
+}
+
+type QueuedMessages struct {
+	Messages         []*QueuedMessage `protobuf:"bytes,1,rep,name=messages" json:"messages,omitempty"`
+	XXX_unrecognized []byte           `json:"-"`
+}
+
+func (m *QueuedMessages) Reset()         { *m = QueuedMessages{} }
+func (m *QueuedMessages) String() string { return proto.CompactTextString(m) }
+func (*QueuedMessages) ProtoMessage()    {}
+
+func (m *QueuedMessages) GetMessages() []*QueuedMessage {
+	if m != nil {
+		return m.Messages
+	}
+	return nil
+}
+
+type InjectChunk struct {
+	MailFrom         *string  `protobuf:"bytes,1,opt,name=mail_from" json:"mail_from,omitempty"`
+	RcptTo           []string `protobuf:"bytes,2,rep,name=rcpt_to" json:"rcpt_to,omitempty"`
+	SendAt           *int64   `protobuf:"varint,3,opt,name=send_at" json:"send_at,omitempty"`
+	Data             []byte   `protobuf:"bytes,4,opt,name=data" json:"data,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *InjectChunk) Reset()         { *m = InjectChunk{} }
+func (m *InjectChunk) String() string { return proto.CompactTextString(m) }
+func (*InjectChunk) ProtoMessage()    {}
+
+func (m *InjectChunk) GetMailFrom() string {
+	if m != nil && m.MailFrom != nil {
+		return *m.MailFrom
+	}
+	return ""
+}
+
+func (m *InjectChunk) GetRcptTo() []string {
+	if m != nil {
+		return m.RcptTo
+	}
+	return nil
+}
+
+func (m *InjectChunk) GetSendAt() int64 {
+	if m != nil && m.SendAt != nil {
+		return *m.SendAt
+	}
+	return 0
+}
+
+func (m *InjectChunk) GetData() []byte {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
+type Injected struct {
+	Id               *string `protobuf:"bytes,1,req,name=id" json:"id,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Injected) Reset()         { *m = Injected{} }
+func (m *Injected) String() string { return proto.CompactTextString(m) }
+func (*Injected) ProtoMessage()    {}
+
+func (m *Injected) GetId() string {
+	if m != nil && m.Id != nil {
+		return *m.Id
+	}
+	return ""
+}
+
+type User struct {
+	Login            *string `protobuf:"bytes,1,req,name=login" json:"login,omitempty"`
+	Passwd           *string `protobuf:"bytes,2,opt,name=passwd" json:"passwd,omitempty"`
+	MailboxQuota     *string `protobuf:"bytes,3,opt,name=mailbox_quota" json:"mailbox_quota,omitempty"`
+	MailboxDriver    *string `protobuf:"bytes,4,opt,name=mailbox_driver" json:"mailbox_driver,omitempty"`
+	HaveMailbox      *bool   `protobuf:"varint,5,opt,name=have_mailbox" json:"have_mailbox,omitempty"`
+	AuthRelay        *bool   `protobuf:"varint,6,opt,name=auth_relay" json:"auth_relay,omitempty"`
+	IsCatchall       *bool   `protobuf:"varint,7,opt,name=is_catchall" json:"is_catchall,omitempty"`
+	Active           *bool   `protobuf:"varint,8,opt,name=active" json:"active,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *User) Reset()         { *m = User{} }
+func (m *User) String() string { return proto.CompactTextString(m) }
+func (*User) ProtoMessage()    {}
+
+func (m *User) GetLogin() string {
+	if m != nil && m.Login != nil {
+		return *m.Login
+	}
+	return ""
+}
+
+func (m *User) GetPasswd() string {
+	if m != nil && m.Passwd != nil {
+		return *m.Passwd
+	}
+	return ""
+}
+
+func (m *User) GetMailboxQuota() string {
+	if m != nil && m.MailboxQuota != nil {
+		return *m.MailboxQuota
+	}
+	return ""
+}
+
+func (m *User) GetMailboxDriver() string {
+	if m != nil && m.MailboxDriver != nil {
+		return *m.MailboxDriver
+	}
+	return ""
+}
+
+func (m *User) GetHaveMailbox() bool {
+	if m != nil && m.HaveMailbox != nil {
+		return *m.HaveMailbox
+	}
+	return false
+}
+
+func (m *User) GetAuthRelay() bool {
+	if m != nil && m.AuthRelay != nil {
+		return *m.AuthRelay
+	}
+	return false
+}
+
+func (m *User) GetIsCatchall() bool {
+	if m != nil && m.IsCatchall != nil {
+		return *m.IsCatchall
+	}
+	return false
+}
+
+func (m *User) GetActive() bool {
+	if m != nil && m.Active != nil {
+		return *m.Active
+	}
+	return false
+}
+
+type Users struct {
+	Users            []*User `protobuf:"bytes,1,rep,name=users" json:"users,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Users) Reset()         { *m = Users{} }
+func (m *Users) String() string { return proto.CompactTextString(m) }
+func (*Users) ProtoMessage()    {}
+
+func (m *Users) GetUsers() []*User {
+	if m != nil {
+		return m.Users
+	}
+	return nil
+}
+
+type Alias struct {
+	Alias            *string `protobuf:"bytes,1,req,name=alias" json:"alias,omitempty"`
+	DeliverTo        *string `protobuf:"bytes,2,opt,name=deliver_to" json:"deliver_to,omitempty"`
+	Pipe             *string `protobuf:"bytes,3,opt,name=pipe" json:"pipe,omitempty"`
+	IsMinilist       *bool   `protobuf:"varint,4,opt,name=is_minilist" json:"is_minilist,omitempty"`
+	IsDomainAlias    *bool   `protobuf:"varint,5,opt,name=is_domain_alias" json:"is_domain_alias,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Alias) Reset()         { *m = Alias{} }
+func (m *Alias) String() string { return proto.CompactTextString(m) }
+func (*Alias) ProtoMessage()    {}
+
+func (m *Alias) GetAlias() string {
+	if m != nil && m.Alias != nil {
+		return *m.Alias
+	}
+	return ""
+}
+
+func (m *Alias) GetDeliverTo() string {
+	if m != nil && m.DeliverTo != nil {
+		return *m.DeliverTo
+	}
+	return ""
+}
+
+func (m *Alias) GetPipe() string {
+	if m != nil && m.Pipe != nil {
+		return *m.Pipe
+	}
+	return ""
+}
+
+func (m *Alias) GetIsMinilist() bool {
+	if m != nil && m.IsMinilist != nil {
+		return *m.IsMinilist
+	}
+	return false
+}
+
+func (m *Alias) GetIsDomainAlias() bool {
+	if m != nil && m.IsDomainAlias != nil {
+		return *m.IsDomainAlias
+	}
+	return false
+}
+
+type Aliases struct {
+	Aliases          []*Alias `protobuf:"bytes,1,rep,name=aliases" json:"aliases,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *Aliases) Reset()         { *m = Aliases{} }
+func (m *Aliases) String() string { return proto.CompactTextString(m) }
+func (*Aliases) ProtoMessage()    {}
+
+func (m *Aliases) GetAliases() []*Alias {
+	if m != nil {
+		return m.Aliases
+	}
+	return nil
+}
+
+type Route struct {
+	Id               *int64  `protobuf:"varint,1,opt,name=id" json:"id,omitempty"`
+	Host             *string `protobuf:"bytes,2,req,name=host" json:"host,omitempty"`
+	LocalIp          *string `protobuf:"bytes,3,opt,name=local_ip" json:"local_ip,omitempty"`
+	RemoteHost       *string `protobuf:"bytes,4,req,name=remote_host" json:"remote_host,omitempty"`
+	RemotePort       *int32  `protobuf:"varint,5,opt,name=remote_port" json:"remote_port,omitempty"`
+	Priority         *int32  `protobuf:"varint,6,opt,name=priority" json:"priority,omitempty"`
+	User             *string `protobuf:"bytes,7,opt,name=user" json:"user,omitempty"`
+	MailFrom         *string `protobuf:"bytes,8,opt,name=mail_from" json:"mail_from,omitempty"`
+	SmtpAuthLogin    *string `protobuf:"bytes,9,opt,name=smtp_auth_login" json:"smtp_auth_login,omitempty"`
+	SmtpAuthPasswd   *string `protobuf:"bytes,10,opt,name=smtp_auth_passwd" json:"smtp_auth_passwd,omitempty"`
+	SmtpAuthMech     *string `protobuf:"bytes,11,opt,name=smtp_auth_mech" json:"smtp_auth_mech,omitempty"`
+	ForwardClient    *string `protobuf:"bytes,12,opt,name=forward_client" json:"forward_client,omitempty"`
+	RetrySchedule    *string `protobuf:"bytes,13,opt,name=retry_schedule" json:"retry_schedule,omitempty"`
+	Proxy            *string `protobuf:"bytes,14,opt,name=proxy" json:"proxy,omitempty"`
+	Weight           *int32  `protobuf:"varint,15,opt,name=weight" json:"weight,omitempty"`
+	MxFallback       *bool   `protobuf:"varint,16,opt,name=mx_fallback" json:"mx_fallback,omitempty"`
+	IpFamily         *string `protobuf:"bytes,17,opt,name=ip_family" json:"ip_family,omitempty"`
+	Timeouts         *string `protobuf:"bytes,18,opt,name=timeouts" json:"timeouts,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Route) Reset()         { *m = Route{} }
+func (m *Route) String() string { return proto.CompactTextString(m) }
+func (*Route) ProtoMessage()    {}
+
+func (m *Route) GetId() int64 {
+	if m != nil && m.Id != nil {
+		return *m.Id
+	}
+	return 0
+}
+
+func (m *Route) GetHost() string {
+	if m != nil && m.Host != nil {
+		return *m.Host
+	}
+	return ""
+}
+
+func (m *Route) GetLocalIp() string {
+	if m != nil && m.LocalIp != nil {
+		return *m.LocalIp
+	}
+	return ""
+}
+
+func (m *Route) GetRemoteHost() string {
+	if m != nil && m.RemoteHost != nil {
+		return *m.RemoteHost
+	}
+	return ""
+}
+
+func (m *Route) GetRemotePort() int32 {
+	if m != nil && m.RemotePort != nil {
+		return *m.RemotePort
+	}
+	return 0
+}
+
+func (m *Route) GetPriority() int32 {
+	if m != nil && m.Priority != nil {
+		return *m.Priority
+	}
+	return 0
+}
+
+func (m *Route) GetUser() string {
+	if m != nil && m.User != nil {
+		return *m.User
+	}
+	return ""
+}
+
+func (m *Route) GetMailFrom() string {
+	if m != nil && m.MailFrom != nil {
+		return *m.MailFrom
+	}
+	return ""
+}
+
+func (m *Route) GetSmtpAuthLogin() string {
+	if m != nil && m.SmtpAuthLogin != nil {
+		return *m.SmtpAuthLogin
+	}
+	return ""
+}
+
+func (m *Route) GetSmtpAuthPasswd() string {
+	if m != nil && m.SmtpAuthPasswd != nil {
+		return *m.SmtpAuthPasswd
+	}
+	return ""
+}
+
+func (m *Route) GetSmtpAuthMech() string {
+	if m != nil && m.SmtpAuthMech != nil {
+		return *m.SmtpAuthMech
+	}
+	return ""
+}
+
+func (m *Route) GetForwardClient() string {
+	if m != nil && m.ForwardClient != nil {
+		return *m.ForwardClient
+	}
+	return ""
+}
+
+func (m *Route) GetRetrySchedule() string {
+	if m != nil && m.RetrySchedule != nil {
+		return *m.RetrySchedule
+	}
+	return ""
+}
+
+func (m *Route) GetProxy() string {
+	if m != nil && m.Proxy != nil {
+		return *m.Proxy
+	}
+	return ""
+}
+
+func (m *Route) GetWeight() int32 {
+	if m != nil && m.Weight != nil {
+		return *m.Weight
+	}
+	return 0
+}
+
+func (m *Route) GetMxFallback() bool {
+	if m != nil && m.MxFallback != nil {
+		return *m.MxFallback
+	}
+	return false
+}
+
+func (m *Route) GetIpFamily() string {
+	if m != nil && m.IpFamily != nil {
+		return *m.IpFamily
+	}
+	return ""
+}
+
+func (m *Route) GetTimeouts() string {
+	if m != nil && m.Timeouts != nil {
+		return *m.Timeouts
+	}
+	return ""
+}
+
+type Routes struct {
+	Routes           []*Route `protobuf:"bytes,1,rep,name=routes" json:"routes,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *Routes) Reset()         { *m = Routes{} }
+func (m *Routes) String() string { return proto.CompactTextString(m) }
+func (*Routes) ProtoMessage()    {}
+
+func (m *Routes) GetRoutes() []*Route {
+	if m != nil {
+		return m.Routes
+	}
+	return nil
+}
+
+type CountersRequest struct {
+	Interval         *int32 `protobuf:"varint,1,opt,name=interval" json:"interval,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *CountersRequest) Reset()         { *m = CountersRequest{} }
+func (m *CountersRequest) String() string { return proto.CompactTextString(m) }
+func (*CountersRequest) ProtoMessage()    {}
+
+func (m *CountersRequest) GetInterval() int32 {
+	if m != nil && m.Interval != nil {
+		return *m.Interval
+	}
+	return 0
+}
+
+type SubsystemCounters struct {
+	Name             *string `protobuf:"bytes,1,req,name=name" json:"name,omitempty"`
+	Goroutines       *int64  `protobuf:"varint,2,opt,name=goroutines" json:"goroutines,omitempty"`
+	OpenConns        *int32  `protobuf:"varint,3,opt,name=open_conns" json:"open_conns,omitempty"`
+	OldestConnAge    *int64  `protobuf:"varint,4,opt,name=oldest_conn_age" json:"oldest_conn_age,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *SubsystemCounters) Reset()         { *m = SubsystemCounters{} }
+func (m *SubsystemCounters) String() string { return proto.CompactTextString(m) }
+func (*SubsystemCounters) ProtoMessage()    {}
+
+func (m *SubsystemCounters) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *SubsystemCounters) GetGoroutines() int64 {
+	if m != nil && m.Goroutines != nil {
+		return *m.Goroutines
+	}
+	return 0
+}
+
+func (m *SubsystemCounters) GetOpenConns() int32 {
+	if m != nil && m.OpenConns != nil {
+		return *m.OpenConns
+	}
+	return 0
+}
+
+func (m *SubsystemCounters) GetOldestConnAge() int64 {
+	if m != nil && m.OldestConnAge != nil {
+		return *m.OldestConnAge
+	}
+	return 0
+}
+
+type NodeCounters struct {
+	Node             *string              `protobuf:"bytes,1,req,name=node" json:"node,omitempty"`
+	Time             *int64               `protobuf:"varint,2,opt,name=time" json:"time,omitempty"`
+	Goroutines       *int32               `protobuf:"varint,3,opt,name=goroutines" json:"goroutines,omitempty"`
+	OpenFds          *int32               `protobuf:"varint,4,opt,name=open_fds" json:"open_fds,omitempty"`
+	SmtpdSessions    *int32               `protobuf:"varint,5,opt,name=smtpd_sessions" json:"smtpd_sessions,omitempty"`
+	SmtpdMaxSessions *int32               `protobuf:"varint,6,opt,name=smtpd_max_sessions" json:"smtpd_max_sessions,omitempty"`
+	Subsystems       []*SubsystemCounters `protobuf:"bytes,7,rep,name=subsystems" json:"subsystems,omitempty"`
+	XXX_unrecognized []byte               `json:"-"`
+}
+
+func (m *NodeCounters) Reset()         { *m = NodeCounters{} }
+func (m *NodeCounters) String() string { return proto.CompactTextString(m) }
+func (*NodeCounters) ProtoMessage()    {}
+
+func (m *NodeCounters) GetNode() string {
+	if m != nil && m.Node != nil {
+		return *m.Node
+	}
+	return ""
+}
+
+func (m *NodeCounters) GetTime() int64 {
+	if m != nil && m.Time != nil {
+		return *m.Time
+	}
+	return 0
+}
+
+func (m *NodeCounters) GetGoroutines() int32 {
+	if m != nil && m.Goroutines != nil {
+		return *m.Goroutines
+	}
+	return 0
+}
+
+func (m *NodeCounters) GetOpenFds() int32 {
+	if m != nil && m.OpenFds != nil {
+		return *m.OpenFds
+	}
+	return 0
+}
+
+func (m *NodeCounters) GetSmtpdSessions() int32 {
+	if m != nil && m.SmtpdSessions != nil {
+		return *m.SmtpdSessions
+	}
+	return 0
+}
+
+func (m *NodeCounters) GetSmtpdMaxSessions() int32 {
+	if m != nil && m.SmtpdMaxSessions != nil {
+		return *m.SmtpdMaxSessions
+	}
+	return 0
+}
+
+func (m *NodeCounters) GetSubsystems() []*SubsystemCounters {
+	if m != nil {
+		return m.Subsystems
+	}
+	return nil
+}
+
+func init() {
+}
+
+// Client API for Management service
+
+type ManagementClient interface {
+	QueueList(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*QueuedMessages, error)
+	QueueDiscard(ctx context.Context, in *Id, opts ...grpc.CallOption) (*Empty, error)
+	QueueBounce(ctx context.Context, in *Id, opts ...grpc.CallOption) (*Empty, error)
+	QueueHold(ctx context.Context, in *Target, opts ...grpc.CallOption) (*Count, error)
+	QueueRelease(ctx context.Context, in *Target, opts ...grpc.CallOption) (*Count, error)
+	QueueFlush(ctx context.Context, in *Target, opts ...grpc.CallOption) (*Count, error)
+	QueueInject(ctx context.Context, opts ...grpc.CallOption) (Management_QueueInjectClient, error)
+	UserList(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Users, error)
+	UserAdd(ctx context.Context, in *User, opts ...grpc.CallOption) (*Empty, error)
+	UserDel(ctx context.Context, in *Name, opts ...grpc.CallOption) (*Empty, error)
+	AliasList(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Aliases, error)
+	AliasAdd(ctx context.Context, in *Alias, opts ...grpc.CallOption) (*Empty, error)
+	AliasDel(ctx context.Context, in *Name, opts ...grpc.CallOption) (*Empty, error)
+	RouteList(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Routes, error)
+	RouteAdd(ctx context.Context, in *Route, opts ...grpc.CallOption) (*Empty, error)
+	RouteDel(ctx context.Context, in *Id, opts ...grpc.CallOption) (*Empty, error)
+	Counters(ctx context.Context, in *CountersRequest, opts ...grpc.CallOption) (Management_CountersClient, error)
+}
+
+type managementClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewManagementClient(cc *grpc.ClientConn) ManagementClient {
+	return &managementClient{cc}
+}
+
+func (c *managementClient) QueueList(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*QueuedMessages, error) {
+	out := new(QueuedMessages)
+	err := grpc.Invoke(ctx, "/mgmtproto.Management/QueueList", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managementClient) QueueDiscard(ctx context.Context, in *Id, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := grpc.Invoke(ctx, "/mgmtproto.Management/QueueDiscard", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managementClient) QueueBounce(ctx context.Context, in *Id, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := grpc.Invoke(ctx, "/mgmtproto.Management/QueueBounce", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managementClient) QueueHold(ctx context.Context, in *Target, opts ...grpc.CallOption) (*Count, error) {
+	out := new(Count)
+	err := grpc.Invoke(ctx, "/mgmtproto.Management/QueueHold", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managementClient) QueueRelease(ctx context.Context, in *Target, opts ...grpc.CallOption) (*Count, error) {
+	out := new(Count)
+	err := grpc.Invoke(ctx, "/mgmtproto.Management/QueueRelease", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managementClient) QueueFlush(ctx context.Context, in *Target, opts ...grpc.CallOption) (*Count, error) {
+	out := new(Count)
+	err := grpc.Invoke(ctx, "/mgmtproto.Management/QueueFlush", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managementClient) QueueInject(ctx context.Context, opts ...grpc.CallOption) (Management_QueueInjectClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Management_serviceDesc.Streams[0], c.cc, "/mgmtproto.Management/QueueInject", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &managementQueueInjectClient{stream}
+	return x, nil
+}
+
+type Management_QueueInjectClient interface {
+	Send(*InjectChunk) error
+	CloseAndRecv() (*Injected, error)
+	grpc.ClientStream
+}
+
+type managementQueueInjectClient struct {
+	grpc.ClientStream
+}
+
+func (x *managementQueueInjectClient) Send(m *InjectChunk) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *managementQueueInjectClient) CloseAndRecv() (*Injected, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(Injected)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *managementClient) UserList(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Users, error) {
+	out := new(Users)
+	err := grpc.Invoke(ctx, "/mgmtproto.Management/UserList", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managementClient) UserAdd(ctx context.Context, in *User, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := grpc.Invoke(ctx, "/mgmtproto.Management/UserAdd", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managementClient) UserDel(ctx context.Context, in *Name, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := grpc.Invoke(ctx, "/mgmtproto.Management/UserDel", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managementClient) AliasList(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Aliases, error) {
+	out := new(Aliases)
+	err := grpc.Invoke(ctx, "/mgmtproto.Management/AliasList", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managementClient) AliasAdd(ctx context.Context, in *Alias, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := grpc.Invoke(ctx, "/mgmtproto.Management/AliasAdd", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managementClient) AliasDel(ctx context.Context, in *Name, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := grpc.Invoke(ctx, "/mgmtproto.Management/AliasDel", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managementClient) RouteList(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Routes, error) {
+	out := new(Routes)
+	err := grpc.Invoke(ctx, "/mgmtproto.Management/RouteList", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managementClient) RouteAdd(ctx context.Context, in *Route, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := grpc.Invoke(ctx, "/mgmtproto.Management/RouteAdd", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managementClient) RouteDel(ctx context.Context, in *Id, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := grpc.Invoke(ctx, "/mgmtproto.Management/RouteDel", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managementClient) Counters(ctx context.Context, in *CountersRequest, opts ...grpc.CallOption) (Management_CountersClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Management_serviceDesc.Streams[1], c.cc, "/mgmtproto.Management/Counters", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &managementCountersClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Management_CountersClient interface {
+	Recv() (*NodeCounters, error)
+	grpc.ClientStream
+}
+
+type managementCountersClient struct {
+	grpc.ClientStream
+}
+
+func (x *managementCountersClient) Recv() (*NodeCounters, error) {
+	m := new(NodeCounters)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Server API for Management service
+
+type ManagementServer interface {
+	QueueList(context.Context, *Empty) (*QueuedMessages, error)
+	QueueDiscard(context.Context, *Id) (*Empty, error)
+	QueueBounce(context.Context, *Id) (*Empty, error)
+	QueueHold(context.Context, *Target) (*Count, error)
+	QueueRelease(context.Context, *Target) (*Count, error)
+	QueueFlush(context.Context, *Target) (*Count, error)
+	QueueInject(Management_QueueInjectServer) error
+	UserList(context.Context, *Empty) (*Users, error)
+	UserAdd(context.Context, *User) (*Empty, error)
+	UserDel(context.Context, *Name) (*Empty, error)
+	AliasList(context.Context, *Empty) (*Aliases, error)
+	AliasAdd(context.Context, *Alias) (*Empty, error)
+	AliasDel(context.Context, *Name) (*Empty, error)
+	RouteList(context.Context, *Empty) (*Routes, error)
+	RouteAdd(context.Context, *Route) (*Empty, error)
+	RouteDel(context.Context, *Id) (*Empty, error)
+	Counters(*CountersRequest, Management_CountersServer) error
+}
+
+func RegisterManagementServer(s *grpc.Server, srv ManagementServer) {
+	s.RegisterService(&_Management_serviceDesc, srv)
+}
+
+func _Management_QueueList_Handler(srv interface{}, ctx context.Context, codec grpc.Codec, buf []byte) (interface{}, error) {
+	in := new(Empty)
+	if err := codec.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(ManagementServer).QueueList(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Management_QueueDiscard_Handler(srv interface{}, ctx context.Context, codec grpc.Codec, buf []byte) (interface{}, error) {
+	in := new(Id)
+	if err := codec.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(ManagementServer).QueueDiscard(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Management_QueueBounce_Handler(srv interface{}, ctx context.Context, codec grpc.Codec, buf []byte) (interface{}, error) {
+	in := new(Id)
+	if err := codec.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(ManagementServer).QueueBounce(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Management_QueueHold_Handler(srv interface{}, ctx context.Context, codec grpc.Codec, buf []byte) (interface{}, error) {
+	in := new(Target)
+	if err := codec.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(ManagementServer).QueueHold(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Management_QueueRelease_Handler(srv interface{}, ctx context.Context, codec grpc.Codec, buf []byte) (interface{}, error) {
+	in := new(Target)
+	if err := codec.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(ManagementServer).QueueRelease(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Management_QueueFlush_Handler(srv interface{}, ctx context.Context, codec grpc.Codec, buf []byte) (interface{}, error) {
+	in := new(Target)
+	if err := codec.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(ManagementServer).QueueFlush(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Management_QueueInject_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ManagementServer).QueueInject(&managementQueueInjectServer{stream})
+}
+
+type Management_QueueInjectServer interface {
+	SendAndClose(*Injected) error
+	Recv() (*InjectChunk, error)
+	grpc.ServerStream
+}
+
+type managementQueueInjectServer struct {
+	grpc.ServerStream
+}
+
+func (x *managementQueueInjectServer) SendAndClose(m *Injected) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *managementQueueInjectServer) Recv() (*InjectChunk, error) {
+	m := new(InjectChunk)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Management_UserList_Handler(srv interface{}, ctx context.Context, codec grpc.Codec, buf []byte) (interface{}, error) {
+	in := new(Empty)
+	if err := codec.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(ManagementServer).UserList(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Management_UserAdd_Handler(srv interface{}, ctx context.Context, codec grpc.Codec, buf []byte) (interface{}, error) {
+	in := new(User)
+	if err := codec.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(ManagementServer).UserAdd(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Management_UserDel_Handler(srv interface{}, ctx context.Context, codec grpc.Codec, buf []byte) (interface{}, error) {
+	in := new(Name)
+	if err := codec.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(ManagementServer).UserDel(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Management_AliasList_Handler(srv interface{}, ctx context.Context, codec grpc.Codec, buf []byte) (interface{}, error) {
+	in := new(Empty)
+	if err := codec.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(ManagementServer).AliasList(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Management_AliasAdd_Handler(srv interface{}, ctx context.Context, codec grpc.Codec, buf []byte) (interface{}, error) {
+	in := new(Alias)
+	if err := codec.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(ManagementServer).AliasAdd(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Management_AliasDel_Handler(srv interface{}, ctx context.Context, codec grpc.Codec, buf []byte) (interface{}, error) {
+	in := new(Name)
+	if err := codec.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(ManagementServer).AliasDel(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Management_RouteList_Handler(srv interface{}, ctx context.Context, codec grpc.Codec, buf []byte) (interface{}, error) {
+	in := new(Empty)
+	if err := codec.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(ManagementServer).RouteList(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Management_RouteAdd_Handler(srv interface{}, ctx context.Context, codec grpc.Codec, buf []byte) (interface{}, error) {
+	in := new(Route)
+	if err := codec.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(ManagementServer).RouteAdd(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Management_RouteDel_Handler(srv interface{}, ctx context.Context, codec grpc.Codec, buf []byte) (interface{}, error) {
+	in := new(Id)
+	if err := codec.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(ManagementServer).RouteDel(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Management_Counters_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(CountersRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ManagementServer).Counters(m, &managementCountersServer{stream})
+}
+
+type Management_CountersServer interface {
+	Send(*NodeCounters) error
+	grpc.ServerStream
+}
+
+type managementCountersServer struct {
+	grpc.ServerStream
+}
+
+func (x *managementCountersServer) Send(m *NodeCounters) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _Management_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "mgmtproto.Management",
+	HandlerType: (*ManagementServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "QueueList",
+			Handler:    _Management_QueueList_Handler,
+		},
+		{
+			MethodName: "QueueDiscard",
+			Handler:    _Management_QueueDiscard_Handler,
+		},
+		{
+			MethodName: "QueueBounce",
+			Handler:    _Management_QueueBounce_Handler,
+		},
+		{
+			MethodName: "QueueHold",
+			Handler:    _Management_QueueHold_Handler,
+		},
+		{
+			MethodName: "QueueRelease",
+			Handler:    _Management_QueueRelease_Handler,
+		},
+		{
+			MethodName: "QueueFlush",
+			Handler:    _Management_QueueFlush_Handler,
+		},
+		{
+			MethodName: "UserList",
+			Handler:    _Management_UserList_Handler,
+		},
+		{
+			MethodName: "UserAdd",
+			Handler:    _Management_UserAdd_Handler,
+		},
+		{
+			MethodName: "UserDel",
+			Handler:    _Management_UserDel_Handler,
+		},
+		{
+			MethodName: "AliasList",
+			Handler:    _Management_AliasList_Handler,
+		},
+		{
+			MethodName: "AliasAdd",
+			Handler:    _Management_AliasAdd_Handler,
+		},
+		{
+			MethodName: "AliasDel",
+			Handler:    _Management_AliasDel_Handler,
+		},
+		{
+			MethodName: "RouteList",
+			Handler:    _Management_RouteList_Handler,
+		},
+		{
+			MethodName: "RouteAdd",
+			Handler:    _Management_RouteAdd_Handler,
+		},
+		{
+			MethodName: "RouteDel",
+			Handler:    _Management_RouteDel_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "QueueInject",
+			Handler:       _Management_QueueInject_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Counters",
+			Handler:       _Management_Counters_Handler,
+			ServerStreams: true,
+		},
+	},
+}
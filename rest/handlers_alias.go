@@ -0,0 +1,184 @@
+package rest
+
+import (
+	"encoding/json"
+	"github.com/jinzhu/gorm"
+	"github.com/julienschmidt/httprouter"
+	"github.com/nbio/httpcontext"
+	"github.com/toorop/tmail/api"
+	"net/http"
+	"strconv"
+)
+
+// aliasesGetAll returns aliases
+func aliasesGetAll(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	aliases, err := api.AliasList()
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get aliases", err.Error())
+		return
+	}
+	js, err := json.Marshal(aliases)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// virtualAliasesAdd adds a virtual alias
+// JSON body: Address (address or @domain for a catch-all), Destinations
+// (list of addresses)
+func virtualAliasesAdd(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	p := struct {
+		Address      string
+		Destinations []string
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		httpWriteErrorJson(w, 500, "unable to get JSON body", err.Error())
+		return
+	}
+	alias, err := api.AliasAddVirtual(p.Address, p.Destinations)
+	if err != nil {
+		httpWriteErrorJson(w, 422, "unable to add virtual alias", err.Error())
+		return
+	}
+	logInfo(r, "virtual alias added "+alias.Alias)
+	js, err := json.Marshal(alias)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(201)
+	w.Write(js)
+}
+
+// aliasesDel removes an alias
+func aliasesDel(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	address := httpcontext.Get(r, "params").(httprouter.Params).ByName("alias")
+	if err := api.AliasDel(address); err != nil {
+		httpWriteErrorJson(w, 422, "unable to remove alias "+address, err.Error())
+		return
+	}
+	logInfo(r, "alias removed "+address)
+}
+
+// virtualAliasesExpand returns final recipients of an address
+func virtualAliasesExpand(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	address := httpcontext.Get(r, "params").(httprouter.Params).ByName("address")
+	rcpts, err := api.AliasExpand(address)
+	if err != nil {
+		httpWriteErrorJson(w, 422, "unable to expand "+address, err.Error())
+		return
+	}
+	js, err := json.Marshal(rcpts)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// rewritesGetAll returns rewrite rules
+func rewritesGetAll(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	rules, err := api.AddressRewriteList()
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get rewrite rules", err.Error())
+		return
+	}
+	js, err := json.Marshal(rules)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// rewritesAdd adds a rewrite rule
+// JSON body: Scope (sender or recipient), Pattern (regexp), Replacement,
+// Priority (lowest first)
+func rewritesAdd(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	p := struct {
+		Scope       string
+		Pattern     string
+		Replacement string
+		Priority    int
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		httpWriteErrorJson(w, 500, "unable to get JSON body", err.Error())
+		return
+	}
+	rule, err := api.AddressRewriteAdd(p.Scope, p.Pattern, p.Replacement, p.Priority)
+	if err != nil {
+		httpWriteErrorJson(w, 422, "unable to add rewrite rule", err.Error())
+		return
+	}
+	logInfo(r, "rewrite rule added "+rule.Pattern)
+	js, err := json.Marshal(rule)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(201)
+	w.Write(js)
+}
+
+// rewritesDel removes a rewrite rule
+func rewritesDel(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	idStr := httpcontext.Get(r, "params").(httprouter.Params).ByName("id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		httpWriteErrorJson(w, 422, "bad rewrite rule id "+idStr, err.Error())
+		return
+	}
+	err = api.AddressRewriteDel(id)
+	if err == gorm.RecordNotFound {
+		httpWriteErrorJson(w, 404, "no such rewrite rule "+idStr, "")
+		return
+	}
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to remove rewrite rule "+idStr, err.Error())
+		return
+	}
+	logInfo(r, "rewrite rule removed "+idStr)
+}
+
+// addAliasHandlers add aliases handlers to router
+func addAliasHandlers(router *httprouter.Router) {
+	// list aliases
+	router.GET("/aliases", wrapHandler(aliasesGetAll))
+	// add a virtual alias
+	router.POST("/aliases/virtual", wrapHandler(virtualAliasesAdd))
+	// remove an alias
+	router.DELETE("/aliases/alias/:alias", wrapHandler(aliasesDel))
+	// final recipients of an address
+	router.GET("/aliases/expand/:address", wrapHandler(virtualAliasesExpand))
+	// list rewrite rules
+	router.GET("/aliases/rewrites", wrapHandler(rewritesGetAll))
+	// add a rewrite rule
+	router.POST("/aliases/rewrites", wrapHandler(rewritesAdd))
+	// remove a rewrite rule
+	router.DELETE("/aliases/rewrites/:id", wrapHandler(rewritesDel))
+}
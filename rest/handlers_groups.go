@@ -0,0 +1,209 @@
+package rest
+
+import (
+	"encoding/json"
+	"github.com/jinzhu/gorm"
+	"github.com/julienschmidt/httprouter"
+	"github.com/nbio/httpcontext"
+	"github.com/toorop/tmail/api"
+	"github.com/toorop/tmail/core"
+	"net/http"
+)
+
+// groupsGetAll returns groups
+func groupsGetAll(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	groups, err := api.MailGroupList()
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get groups", err.Error())
+		return
+	}
+	js, err := json.Marshal(groups)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// groupsGetOne returns a group and its members
+func groupsGetOne(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	address := httpcontext.Get(r, "params").(httprouter.Params).ByName("address")
+	group, err := api.MailGroupGet(address)
+	if err == gorm.RecordNotFound {
+		httpWriteErrorJson(w, 404, "no such group "+address, "")
+		return
+	}
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get group "+address, err.Error())
+		return
+	}
+	members, err := api.MailGroupMembers(address)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get members of group "+address, err.Error())
+		return
+	}
+	js, err := json.Marshal(struct {
+		core.MailGroup
+		Members []core.MailGroupMember
+	}{group, members})
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// groupsAdd adds a group
+// JSON body: Address, Description, Policy (anyone, members or owners),
+// SubjectPrefix, ReplyToGroup, Unsubscribe (List-Unsubscribe URL)
+func groupsAdd(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	p := core.MailGroup{}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		httpWriteErrorJson(w, 500, "unable to get JSON body", err.Error())
+		return
+	}
+	group, err := api.MailGroupAdd(p)
+	if err != nil {
+		httpWriteErrorJson(w, 422, "unable to add group", err.Error())
+		return
+	}
+	logInfo(r, "group added "+group.Address)
+	js, err := json.Marshal(group)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	w.Header().Set("Location", httpGetScheme()+"://"+r.Host+"/groups/"+group.Address)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(201)
+	w.Write(js)
+}
+
+// groupsUpdate updates options of a group
+// JSON body: as groupsAdd (Address is ignored)
+func groupsUpdate(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	address := httpcontext.Get(r, "params").(httprouter.Params).ByName("address")
+	p := core.MailGroup{}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		httpWriteErrorJson(w, 500, "unable to get JSON body", err.Error())
+		return
+	}
+	group, err := api.MailGroupUpdate(address, p)
+	if err == gorm.RecordNotFound {
+		httpWriteErrorJson(w, 404, "no such group "+address, "")
+		return
+	}
+	if err != nil {
+		httpWriteErrorJson(w, 422, "unable to update group "+address, err.Error())
+		return
+	}
+	logInfo(r, "group updated "+address)
+	js, err := json.Marshal(group)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// groupsDel removes a group
+func groupsDel(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	address := httpcontext.Get(r, "params").(httprouter.Params).ByName("address")
+	err := api.MailGroupDel(address)
+	if err == gorm.RecordNotFound {
+		httpWriteErrorJson(w, 404, "no such group "+address, "")
+		return
+	}
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to remove group "+address, err.Error())
+		return
+	}
+	logInfo(r, "group removed "+address)
+}
+
+// groupsMemberAdd adds a member to a group
+// JSON body: Address, IsOwner
+func groupsMemberAdd(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	address := httpcontext.Get(r, "params").(httprouter.Params).ByName("address")
+	p := struct {
+		Address string
+		IsOwner bool
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		httpWriteErrorJson(w, 500, "unable to get JSON body", err.Error())
+		return
+	}
+	member, err := api.MailGroupMemberAdd(address, p.Address, p.IsOwner)
+	if err == gorm.RecordNotFound {
+		httpWriteErrorJson(w, 404, "no such group "+address, "")
+		return
+	}
+	if err != nil {
+		httpWriteErrorJson(w, 422, "unable to add member to group "+address, err.Error())
+		return
+	}
+	logInfo(r, "member "+member.Address+" added to group "+address)
+	js, err := json.Marshal(member)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(201)
+	w.Write(js)
+}
+
+// groupsMemberDel removes a member of a group
+func groupsMemberDel(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	address := httpcontext.Get(r, "params").(httprouter.Params).ByName("address")
+	member := httpcontext.Get(r, "params").(httprouter.Params).ByName("member")
+	err := api.MailGroupMemberDel(address, member)
+	if err == gorm.RecordNotFound {
+		httpWriteErrorJson(w, 404, "no such member "+member+" in group "+address, "")
+		return
+	}
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to remove member "+member+" of group "+address, err.Error())
+		return
+	}
+	logInfo(r, "member "+member+" removed from group "+address)
+}
+
+// addGroupsHandlers add groups handlers to router
+func addGroupsHandlers(router *httprouter.Router) {
+	// list groups
+	router.GET("/groups", wrapHandler(groupsGetAll))
+	// add a group
+	router.POST("/groups", wrapHandler(groupsAdd))
+	// get a group and its members
+	router.GET("/groups/:address", wrapHandler(groupsGetOne))
+	// update options of a group
+	router.PUT("/groups/:address", wrapHandler(groupsUpdate))
+	// remove a group
+	router.DELETE("/groups/:address", wrapHandler(groupsDel))
+	// add a member
+	router.POST("/groups/:address/members", wrapHandler(groupsMemberAdd))
+	// remove a member
+	router.DELETE("/groups/:address/members/:member", wrapHandler(groupsMemberDel))
+}
@@ -0,0 +1,91 @@
+package rest
+
+import (
+	"encoding/json"
+	"github.com/jinzhu/gorm"
+	"github.com/julienschmidt/httprouter"
+	"github.com/nbio/httpcontext"
+	"github.com/toorop/tmail/api"
+	"github.com/toorop/tmail/core"
+	"net/http"
+	"strconv"
+)
+
+// journalGetAll returns journal rules
+func journalGetAll(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	rules, err := api.JournalRuleList()
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get journal rules", err.Error())
+		return
+	}
+	js, err := json.Marshal(rules)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// journalAdd adds a journal rule
+// JSON body: Domain ("" for all domains), Direction (inbound, outbound or
+// both), Address (archive address), Archive (copy to journal store)
+func journalAdd(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	p := core.JournalRule{}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		httpWriteErrorJson(w, 500, "unable to get JSON body", err.Error())
+		return
+	}
+	rule, err := api.JournalRuleAdd(p)
+	if err != nil {
+		httpWriteErrorJson(w, 422, "unable to add journal rule", err.Error())
+		return
+	}
+	logInfo(r, "journal rule added "+strconv.FormatInt(rule.Id, 10))
+	js, err := json.Marshal(rule)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(201)
+	w.Write(js)
+}
+
+// journalDel removes a journal rule
+func journalDel(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	idStr := httpcontext.Get(r, "params").(httprouter.Params).ByName("id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		httpWriteErrorJson(w, 422, "bad journal rule id "+idStr, err.Error())
+		return
+	}
+	err = api.JournalRuleDel(id)
+	if err == gorm.RecordNotFound {
+		httpWriteErrorJson(w, 404, "no such journal rule "+idStr, "")
+		return
+	}
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to remove journal rule "+idStr, err.Error())
+		return
+	}
+	logInfo(r, "journal rule removed "+idStr)
+}
+
+// addJournalHandlers add journal handlers to router
+func addJournalHandlers(router *httprouter.Router) {
+	// list journal rules
+	router.GET("/journal", wrapHandler(journalGetAll))
+	// add a journal rule
+	router.POST("/journal", wrapHandler(journalAdd))
+	// remove a journal rule
+	router.DELETE("/journal/:id", wrapHandler(journalDel))
+}
@@ -0,0 +1,87 @@
+package rest
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"github.com/nbio/httpcontext"
+	"github.com/toorop/tmail/api"
+	"github.com/toorop/tmail/core"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// messagesGetEvents returns events of a message (queue id or Message-ID)
+func messagesGetEvents(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	id := httpcontext.Get(r, "params").(httprouter.Params).ByName("uuid")
+	timelines, err := api.MessageTrace(id)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get events of message "+id, err.Error())
+		return
+	}
+	if len(timelines) == 0 {
+		httpWriteErrorJson(w, 404, "no event for message "+id, "")
+		return
+	}
+	js, err := json.Marshal(timelines)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// messagesSearch returns events of messages
+// query: message_id, sender, rcpt, from & to (RFC 3339), limit
+func messagesSearch(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	search := core.MessageTraceQuery{
+		MessageId: query.Get("message_id"),
+		MailFrom:  query.Get("sender"),
+		RcptTo:    query.Get("rcpt"),
+	}
+	var err error
+	if query.Get("from") != "" {
+		if search.Since, err = time.Parse(time.RFC3339, query.Get("from")); err != nil {
+			httpWriteErrorJson(w, 422, "bad date for from, RFC 3339 expected", err.Error())
+			return
+		}
+	}
+	if query.Get("to") != "" {
+		if search.Until, err = time.Parse(time.RFC3339, query.Get("to")); err != nil {
+			httpWriteErrorJson(w, 422, "bad date for to, RFC 3339 expected", err.Error())
+			return
+		}
+	}
+	if query.Get("limit") != "" {
+		if search.Limit, err = strconv.Atoi(query.Get("limit")); err != nil {
+			httpWriteErrorJson(w, 422, "bad limit", err.Error())
+			return
+		}
+	}
+	timelines, err := api.MessageTraceSearch(search)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to search messages", err.Error())
+		return
+	}
+	js, err := json.Marshal(timelines)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// addMessagesHandlers add message trace handlers to router
+func addMessagesHandlers(router *httprouter.Router) {
+	// search messages
+	router.GET("/messages", wrapHandler(messagesSearch))
+	// get events of a message
+	router.GET("/messages/:uuid/events", wrapHandler(messagesGetEvents))
+}
@@ -0,0 +1,53 @@
+package rest
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"github.com/toorop/tmail/api"
+	"net/http"
+	"time"
+)
+
+// metricsGetHistory returns rollups of metrics
+// query: kind (smtpd or delivery), tier (raw, hourly or daily), from & to
+// (RFC 3339, default last 24 hours)
+func metricsGetHistory(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	to, from := time.Now(), time.Now().Add(-24*time.Hour)
+	var err error
+	if query.Get("to") != "" {
+		if to, err = time.Parse(time.RFC3339, query.Get("to")); err != nil {
+			httpWriteErrorJson(w, 422, "bad date for to, RFC 3339 expected", err.Error())
+			return
+		}
+		if query.Get("from") == "" {
+			from = to.Add(-24 * time.Hour)
+		}
+	}
+	if query.Get("from") != "" {
+		if from, err = time.Parse(time.RFC3339, query.Get("from")); err != nil {
+			httpWriteErrorJson(w, 422, "bad date for from, RFC 3339 expected", err.Error())
+			return
+		}
+	}
+	rollups, err := api.MetricsHistory(query.Get("kind"), query.Get("tier"), from, to)
+	if err != nil {
+		httpWriteErrorJson(w, 422, "unable to get metrics history", err.Error())
+		return
+	}
+	js, err := json.Marshal(rollups)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// addMetricsHandlers add metrics handlers to router
+func addMetricsHandlers(router *httprouter.Router) {
+	// get rollups
+	router.GET("/metrics/history", wrapHandler(metricsGetHistory))
+}
@@ -0,0 +1,27 @@
+package rest
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"github.com/toorop/tmail/api"
+	"net/http"
+)
+
+// monitorGetStats returns self monitoring counters
+func monitorGetStats(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	js, err := json.Marshal(api.MonitorGetStats())
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// addMonitorHandlers add Monitor handlers to router
+func addMonitorHandlers(router *httprouter.Router) {
+	// get monitoring counters
+	router.GET("/monitor", wrapHandler(monitorGetStats))
+}
@@ -0,0 +1,130 @@
+package rest
+
+import (
+	"encoding/json"
+	"github.com/jinzhu/gorm"
+	"github.com/julienschmidt/httprouter"
+	"github.com/nbio/httpcontext"
+	"github.com/toorop/tmail/api"
+	"github.com/toorop/tmail/core"
+	"net/http"
+	"strconv"
+)
+
+// quarantineGetAll returns quarantined messages
+func quarantineGetAll(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	messages, err := api.QuarantineList()
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get quarantined messages", err.Error())
+		return
+	}
+	js, err := json.Marshal(messages)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// quarantineGetOne returns a quarantined message and its headers
+func quarantineGetOne(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	idStr := httpcontext.Get(r, "params").(httprouter.Params).ByName("id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get message id", err.Error())
+		return
+	}
+	m, err := api.QuarantineGet(id)
+	if err == gorm.RecordNotFound {
+		httpWriteErrorJson(w, 404, "no such message "+idStr, "")
+		return
+	}
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get message "+idStr, err.Error())
+		return
+	}
+	headers, err := api.QuarantineHeaders(id)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get headers of message "+idStr, err.Error())
+		return
+	}
+	js, err := json.Marshal(struct {
+		core.QuarantinedMessage
+		Headers string
+	}{m, headers})
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// quarantineRelease queues a quarantined message for delivery
+func quarantineRelease(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	idStr := httpcontext.Get(r, "params").(httprouter.Params).ByName("id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get message id", err.Error())
+		return
+	}
+	queueId, err := api.QuarantineRelease(id)
+	if err == gorm.RecordNotFound {
+		httpWriteErrorJson(w, 404, "no such message "+idStr, "")
+		return
+	}
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to release message "+idStr, err.Error())
+		return
+	}
+	logInfo(r, "quarantined message "+idStr+" released, queued as "+queueId)
+	js, err := json.Marshal(struct{ QueueId string }{queueId})
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// quarantineDel removes a quarantined message
+func quarantineDel(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	idStr := httpcontext.Get(r, "params").(httprouter.Params).ByName("id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get message id", err.Error())
+		return
+	}
+	err = api.QuarantineDel(id)
+	if err == gorm.RecordNotFound {
+		httpWriteErrorJson(w, 404, "no such message "+idStr, "")
+		return
+	}
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to remove message "+idStr, err.Error())
+		return
+	}
+	logInfo(r, "quarantined message "+idStr+" removed")
+}
+
+// addQuarantineHandlers add quarantine handlers to router
+func addQuarantineHandlers(router *httprouter.Router) {
+	// list quarantined messages
+	router.GET("/quarantine", wrapHandler(quarantineGetAll))
+	// get a quarantined message and its headers
+	router.GET("/quarantine/:id", wrapHandler(quarantineGetOne))
+	// release a quarantined message
+	router.POST("/quarantine/:id/release", wrapHandler(quarantineRelease))
+	// remove a quarantined message
+	router.DELETE("/quarantine/:id", wrapHandler(quarantineDel))
+}
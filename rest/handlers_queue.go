@@ -8,6 +8,7 @@ import (
 	"github.com/toorop/tmail/api"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 // usersGetAll return all users
@@ -28,6 +29,49 @@ func queueGetMessages(w http.ResponseWriter, r *http.Request) {
 	httpWriteJson(w, js)
 }
 
+// queueInjectMessage puts a message in queue
+// JSON body: MailFrom, RcptTo (list), Message (raw), SendAt (optional RFC 3339
+// date of future release)
+func queueInjectMessage(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	p := struct {
+		MailFrom string
+		RcptTo   []string
+		Message  string
+		SendAt   string
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		httpWriteErrorJson(w, 500, "unable to get JSON body", err.Error())
+		return
+	}
+	sendAt := time.Time{}
+	if p.SendAt != "" {
+		var err error
+		if sendAt, err = time.Parse(time.RFC3339, p.SendAt); err != nil {
+			httpWriteErrorJson(w, 422, "bad SendAt date "+p.SendAt, err.Error())
+			return
+		}
+	}
+	id, err := api.QueueInject([]byte(p.Message), p.MailFrom, p.RcptTo, sendAt)
+	if err != nil {
+		httpWriteErrorJson(w, 422, "unable to queue message", err.Error())
+		return
+	}
+	logInfo(r, "message queued as "+id)
+	js, err := json.Marshal(struct {
+		Id string
+	}{id})
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(201)
+	w.Write(js)
+}
+
 // queueGetMessage get a message by ID
 func queueGetMessage(w http.ResponseWriter, r *http.Request) {
 	if !authorized(w, r) {
@@ -101,14 +145,141 @@ func queueBounceMessage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// redirect redirects queued (or bounced if bounced is true) message to
+// RcptTo of JSON body
+func redirect(bounced bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		msgIdStr := httpcontext.Get(r, "params").(httprouter.Params).ByName("id")
+		msgIdInt, err := strconv.ParseInt(msgIdStr, 10, 64)
+		if err != nil {
+			httpWriteErrorJson(w, 500, "unable to get message id", err.Error())
+			return
+		}
+		p := struct {
+			RcptTo string
+		}{}
+		if err = json.NewDecoder(r.Body).Decode(&p); err != nil {
+			httpWriteErrorJson(w, 500, "unable to get JSON body", err.Error())
+			return
+		}
+		action := api.QueueRedirect
+		if bounced {
+			action = api.BouncedRedirect
+		}
+		// authenticated caller is recorded
+		login, _, _ := r.BasicAuth()
+		audit, err := action(msgIdInt, p.RcptTo, "rest:"+login+"@"+r.RemoteAddr)
+		if err == gorm.RecordNotFound {
+			httpWriteErrorJson(w, 404, "no such message "+msgIdStr, "")
+			return
+		}
+		if err != nil {
+			httpWriteErrorJson(w, 422, "unable to redirect message "+msgIdStr, err.Error())
+			return
+		}
+		logInfo(r, "message "+msgIdStr+" redirected to "+audit.NewRcpt+", queued as "+audit.QueueId)
+		js, err := json.Marshal(audit)
+		if err != nil {
+			httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+			return
+		}
+		httpWriteJson(w, js)
+	}
+}
+
+// bouncedGetMessages returns bounced messages kept for redirection
+func bouncedGetMessages(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	messages, err := api.BouncedList()
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get bounced messages", err.Error())
+		return
+	}
+	js, err := json.Marshal(messages)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// redirectsGetAll returns redirections
+func redirectsGetAll(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	audits, err := api.RedirectAuditList()
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get redirections", err.Error())
+		return
+	}
+	js, err := json.Marshal(audits)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// queueAction returns handler applying action (api.QueueHold, ...) to
+// messages of target (message ID or destination domain)
+func queueAction(name string, action func(target string) (int, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		target := httpcontext.Get(r, "params").(httprouter.Params).ByName("target")
+		count, err := action(target)
+		if err == gorm.RecordNotFound {
+			httpWriteErrorJson(w, 404, "no such message "+target, "")
+			return
+		}
+		if err != nil {
+			httpWriteErrorJson(w, 500, "unable to "+name+" "+target, err.Error())
+			return
+		}
+		js, err := json.Marshal(struct {
+			Messages int
+		}{count})
+		if err != nil {
+			httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+			return
+		}
+		httpWriteJson(w, js)
+	}
+}
+
 // addQueueHandlers add Queue handlers to router
 func addQueueHandlers(router *httprouter.Router) {
 	// get all message in queue
 	router.GET("/queue", wrapHandler(queueGetMessages))
+	// put a message in queue
+	router.POST("/queue", wrapHandler(queueInjectMessage))
 	// get a message by id
 	router.GET("/queue/:id", wrapHandler(queueGetMessage))
 	// discard a message
 	router.DELETE("/queue/discard/:id", wrapHandler(queueDiscardMessage))
 	// bounce a message
 	router.DELETE("/queue/bounce/:id", wrapHandler(queueBounceMessage))
+	// put messages (ID or destination domain) on hold
+	router.POST("/queue/hold/:target", wrapHandler(queueAction("hold", api.QueueHold)))
+	// release messages on hold
+	router.POST("/queue/release/:target", wrapHandler(queueAction("release", api.QueueRelease)))
+	// force an immediate delivery attempt
+	router.POST("/queue/flush/:target", wrapHandler(queueAction("flush", api.QueueFlush)))
+	// bounce messages now
+	router.POST("/queue/bounce/:target", wrapHandler(queueAction("bounce", api.QueueBounce)))
+	// redirect a message to another recipient
+	router.POST("/queue/redirect/:id", wrapHandler(redirect(false)))
+	// get bounced messages kept for redirection
+	router.GET("/bounced", wrapHandler(bouncedGetMessages))
+	// redirect a bounced message to another recipient
+	router.POST("/bounced/redirect/:id", wrapHandler(redirect(true)))
+	// get redirections
+	router.GET("/redirects", wrapHandler(redirectsGetAll))
 }
@@ -0,0 +1,180 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/julienschmidt/httprouter"
+	"github.com/nbio/httpcontext"
+	"github.com/toorop/tmail/api"
+)
+
+// relayIpsGetAll returns IPs and networks allowed to relay
+func relayIpsGetAll(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	ips, err := api.RelayIpGetAll()
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get relay IPs", err.Error())
+		return
+	}
+	js, err := json.Marshal(ips)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// relayIpsAdd allows an IP or a network to relay
+// JSON body: Ip (IP or network, eg 192.168.0.0/16)
+func relayIpsAdd(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	p := struct{ Ip string }{}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		httpWriteErrorJson(w, 500, "unable to get JSON body", err.Error())
+		return
+	}
+	if err := api.RelayIpAdd(p.Ip); err != nil {
+		httpWriteErrorJson(w, 422, "unable to add relay IP "+p.Ip, err.Error())
+		return
+	}
+	logInfo(r, "relay IP added "+p.Ip)
+	w.WriteHeader(201)
+}
+
+// relayIpsDel removes an IP or a network allowed to relay
+func relayIpsDel(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	ip := strings.TrimPrefix(httpcontext.Get(r, "params").(httprouter.Params).ByName("ip"), "/")
+	if err := api.RelayIpDel(ip); err != nil {
+		httpWriteErrorJson(w, 422, "unable to remove relay IP "+ip, err.Error())
+		return
+	}
+	logInfo(r, "relay IP removed "+ip)
+}
+
+// relayPoliciesGetAll returns relay policies of listeners
+func relayPoliciesGetAll(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	policies, err := api.RelayPolicyList()
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get relay policies", err.Error())
+		return
+	}
+	js, err := json.Marshal(policies)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// relayPoliciesPut sets relay policy of a listener
+// JSON body: Listener (ip:port, :port or submission), Policy (default,
+// auth, networks or none)
+func relayPoliciesPut(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	p := struct{ Listener, Policy string }{}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		httpWriteErrorJson(w, 500, "unable to get JSON body", err.Error())
+		return
+	}
+	policy, err := api.RelayPolicySet(p.Listener, p.Policy)
+	if err != nil {
+		httpWriteErrorJson(w, 422, "unable to set relay policy of "+p.Listener, err.Error())
+		return
+	}
+	logInfo(r, "relay policy of "+policy.Listener+" set to "+policy.Policy)
+	js, err := json.Marshal(policy)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// relayPoliciesDel removes relay policy of a listener
+func relayPoliciesDel(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	listener := httpcontext.Get(r, "params").(httprouter.Params).ByName("listener")
+	err := api.RelayPolicyDel(listener)
+	if err == gorm.RecordNotFound {
+		httpWriteErrorJson(w, 404, "no relay policy for "+listener, "")
+		return
+	}
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to remove relay policy of "+listener, err.Error())
+		return
+	}
+	logInfo(r, "relay policy of "+listener+" removed")
+}
+
+// relayLoginsGetAll returns POP/IMAP logins whose IP can relay
+func relayLoginsGetAll(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	logins, err := api.RelayLoginList()
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get POP/IMAP logins", err.Error())
+		return
+	}
+	js, err := json.Marshal(logins)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// relayLoginsAdd records a POP/IMAP login (POP/IMAP-before-SMTP)
+// JSON body: Ip, Login
+func relayLoginsAdd(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	p := struct{ Ip, Login string }{}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		httpWriteErrorJson(w, 500, "unable to get JSON body", err.Error())
+		return
+	}
+	if err := api.RelayLoginAdd(p.Ip, p.Login); err != nil {
+		httpWriteErrorJson(w, 422, "unable to record login from "+p.Ip, err.Error())
+		return
+	}
+	w.WriteHeader(201)
+}
+
+// addRelayHandlers add relay handlers to router
+func addRelayHandlers(router *httprouter.Router) {
+	// list IPs and networks allowed to relay
+	router.GET("/relay/ips", wrapHandler(relayIpsGetAll))
+	// allow an IP or a network to relay
+	router.POST("/relay/ips", wrapHandler(relayIpsAdd))
+	// remove an IP or a network (eg DELETE /relay/ips/192.168.0.0/16)
+	router.DELETE("/relay/ips/*ip", wrapHandler(relayIpsDel))
+	// list relay policies of listeners
+	router.GET("/relay/policies", wrapHandler(relayPoliciesGetAll))
+	// set relay policy of a listener
+	router.PUT("/relay/policies", wrapHandler(relayPoliciesPut))
+	// remove relay policy of a listener
+	router.DELETE("/relay/policies/:listener", wrapHandler(relayPoliciesDel))
+	// list POP/IMAP logins whose IP can relay
+	router.GET("/relay/logins", wrapHandler(relayLoginsGetAll))
+	// record a POP/IMAP login
+	router.POST("/relay/logins", wrapHandler(relayLoginsAdd))
+}
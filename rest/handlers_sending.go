@@ -0,0 +1,70 @@
+package rest
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"github.com/nbio/httpcontext"
+	"github.com/toorop/tmail/api"
+	"net/http"
+)
+
+// sendingGetAll returns sending status (quotas, counters of the day,
+// reputation) of authenticated users
+func sendingGetAll(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	statuses, err := api.SendingStatusList()
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get sending status", err.Error())
+		return
+	}
+	js, err := json.Marshal(statuses)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// sendingGetOne returns sending status of an user
+func sendingGetOne(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	user := httpcontext.Get(r, "params").(httprouter.Params).ByName("user")
+	status, err := api.SendingStatusOf(user)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get sending status of "+user, err.Error())
+		return
+	}
+	js, err := json.Marshal(status)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// sendingReset resets sending counters of an user and lifts their suspension
+func sendingReset(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	user := httpcontext.Get(r, "params").(httprouter.Params).ByName("user")
+	if err := api.SendingReset(user); err != nil {
+		httpWriteErrorJson(w, 500, "unable to reset sending counters of "+user, err.Error())
+		return
+	}
+	logInfo(r, "sending counters of "+user+" reset")
+}
+
+// addSendingHandlers add sending quotas handlers to router
+func addSendingHandlers(router *httprouter.Router) {
+	// get status of all users
+	router.GET("/sending", wrapHandler(sendingGetAll))
+	// get status of an user
+	router.GET("/sending/:user", wrapHandler(sendingGetOne))
+	// reset counters of an user
+	router.DELETE("/sending/:user", wrapHandler(sendingReset))
+}
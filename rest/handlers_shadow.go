@@ -0,0 +1,37 @@
+package rest
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"github.com/toorop/tmail/api"
+	"net/http"
+)
+
+// shadowGetStats returns comparison reports of checks in shadow mode
+func shadowGetStats(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	js, err := json.Marshal(api.ShadowGetStats())
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// shadowResetStats resets comparison reports
+func shadowResetStats(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	api.ShadowResetStats()
+}
+
+// addShadowHandlers add shadow mode handlers to router
+func addShadowHandlers(router *httprouter.Router) {
+	// get comparison reports
+	router.GET("/shadow", wrapHandler(shadowGetStats))
+	// reset comparison reports
+	router.DELETE("/shadow", wrapHandler(shadowResetStats))
+}
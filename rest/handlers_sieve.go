@@ -0,0 +1,125 @@
+package rest
+
+import (
+	"encoding/json"
+	"github.com/jinzhu/gorm"
+	"github.com/julienschmidt/httprouter"
+	"github.com/nbio/httpcontext"
+	"github.com/toorop/tmail/api"
+	"net/http"
+)
+
+// sieveGetAll returns sieve scripts of a user
+func sieveGetAll(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	user := httpcontext.Get(r, "params").(httprouter.Params).ByName("user")
+	scripts, err := api.SieveScriptList(user)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get sieve scripts of "+user, err.Error())
+		return
+	}
+	js, err := json.Marshal(scripts)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// sieveGetOne returns a sieve script
+func sieveGetOne(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	user := httpcontext.Get(r, "params").(httprouter.Params).ByName("user")
+	name := httpcontext.Get(r, "params").(httprouter.Params).ByName("name")
+	script, err := api.SieveScriptGet(user, name)
+	if err == gorm.RecordNotFound {
+		httpWriteErrorJson(w, 404, "no such script "+name+" for "+user, "")
+		return
+	}
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get script "+name+" of "+user, err.Error())
+		return
+	}
+	js, err := json.Marshal(script)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// sievePut adds or replaces a sieve script
+// JSON body: Content, Active
+func sievePut(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	user := httpcontext.Get(r, "params").(httprouter.Params).ByName("user")
+	name := httpcontext.Get(r, "params").(httprouter.Params).ByName("name")
+	p := struct {
+		Content string
+		Active  bool
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		httpWriteErrorJson(w, 500, "unable to get JSON body", err.Error())
+		return
+	}
+	script, err := api.SieveScriptPut(user, name, p.Content)
+	if err != nil {
+		httpWriteErrorJson(w, 422, "unable to put script "+name+" of "+user, err.Error())
+		return
+	}
+	if p.Active != script.Active {
+		activate := name
+		if !p.Active {
+			activate = ""
+		}
+		if err = api.SieveScriptActivate(user, activate); err != nil {
+			httpWriteErrorJson(w, 500, "unable to activate script "+name+" of "+user, err.Error())
+			return
+		}
+		script.Active = p.Active
+	}
+	logInfo(r, "sieve script "+name+" of "+user+" updated")
+	js, err := json.Marshal(script)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// sieveDel removes a sieve script
+func sieveDel(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	user := httpcontext.Get(r, "params").(httprouter.Params).ByName("user")
+	name := httpcontext.Get(r, "params").(httprouter.Params).ByName("name")
+	err := api.SieveScriptDel(user, name)
+	if err == gorm.RecordNotFound {
+		httpWriteErrorJson(w, 404, "no such script "+name+" for "+user, "")
+		return
+	}
+	if err != nil {
+		httpWriteErrorJson(w, 422, "unable to remove script "+name+" of "+user, err.Error())
+		return
+	}
+	logInfo(r, "sieve script "+name+" of "+user+" removed")
+}
+
+// addSieveHandlers add sieve handlers to router
+func addSieveHandlers(router *httprouter.Router) {
+	// list scripts of a user
+	router.GET("/sieve/:user", wrapHandler(sieveGetAll))
+	// get a script
+	router.GET("/sieve/:user/:name", wrapHandler(sieveGetOne))
+	// add or replace a script
+	router.PUT("/sieve/:user/:name", wrapHandler(sievePut))
+	// remove a script
+	router.DELETE("/sieve/:user/:name", wrapHandler(sieveDel))
+}
@@ -0,0 +1,51 @@
+package rest
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"github.com/nbio/httpcontext"
+	"github.com/toorop/tmail/api"
+	"github.com/toorop/tmail/core"
+	"net/http"
+)
+
+// throttleGetStats returns throttling counters (connections & sessions of
+// this process, messages of current hour)
+func throttleGetStats(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	counters, err := api.ThrottleCounters()
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get throttling counters", err.Error())
+		return
+	}
+	js, err := json.Marshal(struct {
+		core.ThrottleStats
+		Messages []core.ThrottleCounter
+	}{api.ThrottleGetStats(), counters})
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// throttleResetCounter resets messages counters of a sender
+func throttleResetCounter(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	sender := httpcontext.Get(r, "params").(httprouter.Params).ByName("sender")
+	if err := api.ThrottleCounterReset(sender); err != nil {
+		httpWriteErrorJson(w, 500, "unable to reset counters of "+sender, err.Error())
+	}
+}
+
+// addThrottleHandlers add throttling handlers to router
+func addThrottleHandlers(router *httprouter.Router) {
+	// get counters
+	router.GET("/throttle", wrapHandler(throttleGetStats))
+	// reset messages counters of a sender
+	router.DELETE("/throttle/:sender", wrapHandler(throttleResetCounter))
+}
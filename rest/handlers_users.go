@@ -16,11 +16,12 @@ func usersAdd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	p := struct {
-		Passwd       string `json: "passwd"`
-		AuthRelay    bool   `json: "authRelay"`
-		HaveMailbox  bool   `json: "haveMailbox"`
-		IsCathall    bool   `json: "isCatchall"`
-		MailboxQuota string `json: "mailboxQuota"`
+		Passwd        string `json: "passwd"`
+		AuthRelay     bool   `json: "authRelay"`
+		HaveMailbox   bool   `json: "haveMailbox"`
+		IsCathall     bool   `json: "isCatchall"`
+		MailboxQuota  string `json: "mailboxQuota"`
+		MailboxDriver string `json: "mailboxDriver"`
 	}{}
 
 	// nil body
@@ -34,7 +35,7 @@ func usersAdd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := api.UserAdd(httpcontext.Get(r, "params").(httprouter.Params).ByName("user"), p.Passwd, p.MailboxQuota, p.HaveMailbox, p.AuthRelay, p.IsCathall); err != nil {
+	if err := api.UserAdd(httpcontext.Get(r, "params").(httprouter.Params).ByName("user"), p.Passwd, p.MailboxQuota, p.MailboxDriver, p.HaveMailbox, p.AuthRelay, p.IsCathall); err != nil {
 		httpWriteErrorJson(w, 422, "unable to create new user", err.Error())
 		return
 	}
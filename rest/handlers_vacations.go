@@ -0,0 +1,110 @@
+package rest
+
+import (
+	"encoding/json"
+	"github.com/jinzhu/gorm"
+	"github.com/julienschmidt/httprouter"
+	"github.com/nbio/httpcontext"
+	"github.com/toorop/tmail/api"
+	"github.com/toorop/tmail/core"
+	"net/http"
+)
+
+// vacationsGetAll returns vacation responses
+func vacationsGetAll(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	vacations, err := api.VacationList()
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get vacations", err.Error())
+		return
+	}
+	js, err := json.Marshal(vacations)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// vacationsGetOne returns vacation response of a mailbox
+func vacationsGetOne(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	user := httpcontext.Get(r, "params").(httprouter.Params).ByName("user")
+	v, err := api.VacationGet(user)
+	if err == gorm.RecordNotFound {
+		httpWriteErrorJson(w, 404, "no vacation for "+user, "")
+		return
+	}
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get vacation of "+user, err.Error())
+		return
+	}
+	js, err := json.Marshal(v)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// vacationsPut sets vacation response of a mailbox
+// JSON body: Enabled, Subject, Body, StartAt, EndAt (RFC 3339), Interval
+// (days)
+func vacationsPut(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	user := httpcontext.Get(r, "params").(httprouter.Params).ByName("user")
+	p := core.Vacation{}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		httpWriteErrorJson(w, 500, "unable to get JSON body", err.Error())
+		return
+	}
+	p.Login = user
+	v, err := api.VacationSet(p)
+	if err != nil {
+		httpWriteErrorJson(w, 422, "unable to set vacation of "+user, err.Error())
+		return
+	}
+	logInfo(r, "vacation of "+v.Login+" set")
+	js, err := json.Marshal(v)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// vacationsDel removes vacation response of a mailbox
+func vacationsDel(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	user := httpcontext.Get(r, "params").(httprouter.Params).ByName("user")
+	err := api.VacationDel(user)
+	if err == gorm.RecordNotFound {
+		httpWriteErrorJson(w, 404, "no vacation for "+user, "")
+		return
+	}
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to remove vacation of "+user, err.Error())
+		return
+	}
+	logInfo(r, "vacation of "+user+" removed")
+}
+
+// addVacationsHandlers add vacations handlers to router
+func addVacationsHandlers(router *httprouter.Router) {
+	// list vacations
+	router.GET("/vacations", wrapHandler(vacationsGetAll))
+	// get vacation of a mailbox
+	router.GET("/vacations/:user", wrapHandler(vacationsGetOne))
+	// set vacation of a mailbox
+	router.PUT("/vacations/:user", wrapHandler(vacationsPut))
+	// remove vacation of a mailbox
+	router.DELETE("/vacations/:user", wrapHandler(vacationsDel))
+}
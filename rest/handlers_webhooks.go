@@ -0,0 +1,96 @@
+package rest
+
+import (
+	"encoding/json"
+	"github.com/jinzhu/gorm"
+	"github.com/julienschmidt/httprouter"
+	"github.com/nbio/httpcontext"
+	"github.com/toorop/tmail/api"
+	"net/http"
+	"strconv"
+)
+
+// webhooksGetAll returns registered webhooks
+func webhooksGetAll(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	hooks, err := api.WebhookList()
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to get webhooks", err.Error())
+		return
+	}
+	js, err := json.Marshal(hooks)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	httpWriteJson(w, js)
+}
+
+// webhooksAdd registers a webhook
+// JSON body: Scope (global, domain or user), Target (domain or user), Url,
+// Secret (optional HMAC secret), Events (list, empty for all)
+func webhooksAdd(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	p := struct {
+		Scope  string
+		Target string
+		Url    string
+		Secret string
+		Events []string
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		httpWriteErrorJson(w, 500, "unable to get JSON body", err.Error())
+		return
+	}
+	hook, err := api.WebhookAdd(p.Scope, p.Target, p.Url, p.Secret, p.Events)
+	if err != nil {
+		httpWriteErrorJson(w, 422, "unable to add webhook", err.Error())
+		return
+	}
+	logInfo(r, "webhook added "+hook.Url)
+	js, err := json.Marshal(hook)
+	if err != nil {
+		httpWriteErrorJson(w, 500, "JSON encondig failed", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(201)
+	w.Write(js)
+}
+
+// webhooksDel removes a webhook
+func webhooksDel(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	idStr := httpcontext.Get(r, "params").(httprouter.Params).ByName("id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		httpWriteErrorJson(w, 422, "bad webhook id "+idStr, err.Error())
+		return
+	}
+	err = api.WebhookDel(id)
+	if err == gorm.RecordNotFound {
+		httpWriteErrorJson(w, 404, "no such webhook "+idStr, "")
+		return
+	}
+	if err != nil {
+		httpWriteErrorJson(w, 500, "unable to remove webhook "+idStr, err.Error())
+		return
+	}
+	logInfo(r, "webhook removed "+idStr)
+}
+
+// addWebhooksHandlers add webhooks handlers to router
+func addWebhooksHandlers(router *httprouter.Router) {
+	// list webhooks
+	router.GET("/webhooks", wrapHandler(webhooksGetAll))
+	// register a webhook
+	router.POST("/webhooks", wrapHandler(webhooksAdd))
+	// remove a webhook
+	router.DELETE("/webhooks/:id", wrapHandler(webhooksDel))
+}
@@ -31,6 +31,30 @@ func LaunchServer() {
 	addUsersHandlers(router)
 	// Queue
 	addQueueHandlers(router)
+	// Monitor
+	addMonitorHandlers(router)
+	// Metrics history
+	addMetricsHandlers(router)
+	// Shadow mode
+	addShadowHandlers(router)
+	// Throttling
+	addThrottleHandlers(router)
+	// Sending quotas
+	addSendingHandlers(router)
+	// Webhooks
+	addWebhooksHandlers(router)
+	// Aliases
+	addAliasHandlers(router)
+	// Groups
+	addGroupsHandlers(router)
+	addSieveHandlers(router)
+	addVacationsHandlers(router)
+	addQuarantineHandlers(router)
+	addJournalHandlers(router)
+	// Relay control
+	addRelayHandlers(router)
+	// Message trace
+	addMessagesHandlers(router)
 
 	// Microservice data handler
 	router.Handler("GET", "/msdata/:id", http.StripPrefix("/msdata/", http.FileServer(http.Dir(core.Cfg.GetTempDir()))))
@@ -43,6 +67,11 @@ func LaunchServer() {
 	// TLS
 	if core.Cfg.GetRestServerIsTls() {
 		core.Log.Info("httpd " + addr + " TLS launched")
+		// ACME
+		if tlsConfig := core.RestTLSConfig(); tlsConfig != nil {
+			server := &http.Server{Addr: addr, Handler: n, TLSConfig: tlsConfig}
+			log.Fatalln(server.ListenAndServeTLS("", ""))
+		}
 		log.Fatalln(http.ListenAndServeTLS(addr, path.Join(getBasePath(), "ssl/web_server.crt"), path.Join(getBasePath(), "ssl/web_server.key"), n))
 	} else {
 		core.Log.Info("httpd " + addr + " launched")
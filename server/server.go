@@ -0,0 +1,411 @@
+// Package server runs tmail (smtpd, deliverd, REST and gRPC servers...)
+// inside another Go program.
+//
+// Config, DB and logger of tmail are global: a program can run only one
+// Server. Config is given as values of parameters, named as in tmail.cfg
+// without the TMAIL_ prefix:
+//
+//	srv, err := server.New(server.Options{
+//		BasePath: "/var/lib/appliance/tmail",
+//		Config: map[string]string{
+//			"me":           "mx.example.com",
+//			"db_driver":    "sqlite3",
+//			"db_source":    "/var/lib/appliance/tmail/db/tmail.db",
+//			"smtpd_launch": "true",
+//			"smtpd_dsns":   "0.0.0.0:25:false",
+//			...
+//		},
+//		InitDB: true,
+//	})
+//	srv.OnData(func(sessionId string, envelope message.Envelope, raw []byte) (core.HookReply, []string) {
+//		...
+//	})
+//	srv.OnPhase(core.HookRcpt, func(s *core.SMTPSession) core.HookReply {
+//		if !allowed(s.AuthUser, s.Rcpt) {
+//			return core.HookReply{Code: 550, Msg: "5.7.1 recipient not allowed"}
+//		}
+//		s.Metadata["policy"] = "checked"
+//		return core.HookReply{}
+//	})
+//	err = srv.Start()
+//	...
+//	srv.Stop()
+//
+// Users, routes, queue... are managed with package api once the server is
+// created.
+package server
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/bitly/nsq/nsqd"
+
+	"github.com/toorop/tmail/core"
+	"github.com/toorop/tmail/grpcapi"
+	"github.com/toorop/tmail/rest"
+)
+
+// Options are options of New
+type Options struct {
+	// BasePath is the directory of db, nsq, ssl & tpl (directory of
+	// executable if empty)
+	BasePath string
+	// Config values, environment is not read
+	Config map[string]string
+	// LogOutput, if not nil, receives log (logpath is ignored)
+	LogOutput io.Writer
+	// InitDB creates missing tables, New fails if tables are missing and
+	// InitDB is false
+	InitDB bool
+}
+
+// Server is a tmail server
+type Server struct {
+	sync.Mutex
+	nsqd     *nsqd.NSQD
+	started  bool
+	handover *core.Handover // handover to the new executable of a restart
+}
+
+// New bootstraps tmail with opts and returns a server
+func New(opts Options) (*Server, error) {
+	if opts.BasePath != "" {
+		core.SetBasePath(opts.BasePath)
+	}
+	if err := core.ScopeBootstrapFromMap(opts.Config, opts.LogOutput); err != nil {
+		return nil, err
+	}
+	for _, p := range []string{"db", "nsq", "ssl"} {
+		if err := os.MkdirAll(path.Join(core.GetBasePath(), p), 0700); err != nil {
+			return nil, errors.New("unable to create path " + path.Join(core.GetBasePath(), p) + " - " + err.Error())
+		}
+	}
+	if !core.IsOkDB(core.DB) {
+		if !opts.InitDB {
+			return nil, errors.New("database misses some tables")
+		}
+		if err := core.InitDB(core.DB); err != nil {
+			return nil, err
+		}
+	}
+	if err := core.AutoMigrateDB(core.DB); err != nil {
+		return nil, err
+	}
+	if core.Cfg.GetDovecotSupportEnabled() {
+		if _, err := exec.LookPath(core.Cfg.GetDovecotLda()); err != nil {
+			return nil, errors.New("unable to find Dovecot LDA binary - " + err.Error())
+		}
+	}
+	rand.Seed(time.Now().UTC().UnixNano())
+	return &Server{}, nil
+}
+
+// FromScope returns a server using config, DB & logger already
+// bootstrapped by core.ScopeBootstrap
+func FromScope() *Server {
+	return &Server{}
+}
+
+// OnConnect registers hook h called when a client connects to smtpd (a
+// hook of core.HookConnect)
+func (srv *Server) OnConnect(h core.SmtpdConnectHook) {
+	core.RegisterSmtpdConnectHook(h)
+}
+
+// OnData registers hook h called with messages received by smtpd (a hook
+// of core.HookData)
+func (srv *Server) OnData(h core.SmtpdDataHook) {
+	core.RegisterSmtpdDataHook(h)
+}
+
+// OnPhase registers hook h called at phase of SMTP sessions (or deliveries)
+func (srv *Server) OnPhase(phase core.HookPhase, h core.Hook) {
+	core.RegisterHook(phase, h)
+}
+
+// OnEvent registers hook h called with delivery events
+func (srv *Server) OnEvent(h core.EventHook) {
+	core.RegisterEventHook(h)
+}
+
+// SetIdentityProvider sets provider of hostnames presented by smtpd and
+// deliverd
+func (srv *Server) SetIdentityProvider(p core.IdentityProvider) {
+	core.SetIdentityProvider(p)
+}
+
+// SetOAuth2TokenProvider sets provider of access tokens of routes using
+// XOAUTH2
+func (srv *Server) SetOAuth2TokenProvider(p core.OAuth2TokenProvider) {
+	core.SetOAuth2TokenProvider(p)
+}
+
+// Start launches nsqd and services enabled in config
+func (srv *Server) Start() error {
+	srv.Lock()
+	defer srv.Unlock()
+	if srv.started {
+		return errors.New("server is already started")
+	}
+	if err := core.RoleCheck(); err != nil {
+		return err
+	}
+	// if there is nothing to do then... do nothing
+	if !core.RoleDeliverdEnabled() && !core.RoleSmtpdEnabled() {
+		return errors.New("I have nothing to do, so i do nothing")
+	}
+	if err := core.InitMailQueueProducer(); err != nil {
+		return errors.New("unable to init queue producer - " + err.Error())
+	}
+
+	// new executable of a restart: smtpd serves first on listeners handed
+	// over, nsqd and other services start once the previous executable
+	// (which still runs them) exited
+	handover := core.HandoverChild()
+	if handover {
+		listeners, err := srv.startSmtpd()
+		if err != nil {
+			return err
+		}
+		if err = core.HandoverReady(listeners); err != nil {
+			return errors.New("unable to take over smtpd listeners - " + err.Error())
+		}
+		core.Log.Info("smtpd serves, waiting for the exit of previous executable")
+		core.HandoverWaitPrevious()
+	}
+
+	// init and launch nsqd
+	opts := nsqd.NewNSQDOptions()
+	opts.Logger = log.New(ioutil.Discard, "", 0)
+	if core.Cfg.GetDebugEnabled() {
+		opts.Logger = core.Log
+	}
+	opts.Verbose = core.Cfg.GetDebugEnabled()
+	opts.DataPath = core.GetBasePath() + "/nsq"
+	// if cluster get lookupd addresses
+	if core.Cfg.GetClusterModeEnabled() {
+		opts.NSQLookupdTCPAddresses = core.Cfg.GetNSQLookupdTcpAddresses()
+	}
+
+	// deflate (compression)
+	opts.DeflateEnabled = true
+
+	// if a message timeout it returns to the queue: https://groups.google.com/d/msg/nsq-users/xBQF1q4srUM/kX22TIoIs-QJ
+	// msg timeout : base time to wait from consummer before requeuing a message
+	// note: deliverd consumer return immediatly (message is handled in a go routine)
+	// Ce qui est au dessus est faux malgres la go routine il attends toujours a la réponse
+	// et c'est normal car le message est toujours "in flight"
+	// En fait ce timeout c'est le temps durant lequel le message peut rester dans le state "in flight"
+	// autrement dit c'est le temps maxi que peu prendre deliverd.processMsg
+	opts.MsgTimeout = 10 * time.Minute
+
+	// maximum duration before a message will timeout
+	opts.MaxMsgTimeout = 15 * time.Hour
+
+	// maximum requeuing timeout for a message
+	// si le client ne demande pas de requeue dans ce delais alors
+	// le message et considéré comme traité
+	opts.MaxReqTimeout = 1 * time.Hour
+
+	// Number of message in RAM before synching to disk
+	opts.MemQueueSize = 0
+
+	srv.nsqd = nsqd.NewNSQD(opts)
+	srv.nsqd.LoadMetadata()
+	if err := srv.nsqd.PersistMetadata(); err != nil {
+		return errors.New("failed to persist metadata - " + err.Error())
+	}
+	srv.nsqd.Main()
+
+	if !handover {
+		if _, err := srv.startSmtpd(); err != nil {
+			return err
+		}
+	}
+
+	// ManageSieve
+	if core.Cfg.GetManageSieveListen() != "" {
+		go core.LaunchManageSieve()
+	}
+
+	// cluster heartbeats (leases of queued messages)
+	if core.Cfg.GetClusterModeEnabled() {
+		if err := core.ClusterInit(); err != nil {
+			return errors.New("unable to init cluster mode - " + err.Error())
+		}
+		go core.LaunchClusterHeartbeat()
+	}
+
+	// deliverd
+	if core.RoleDeliverdEnabled() {
+		go core.LaunchDeliverd()
+	}
+
+	// signed configuration bundles
+	if core.Cfg.GetBundleUrl() != "" {
+		go core.LaunchConfigBundleFetcher()
+	}
+
+	// HTTP REST server
+	if core.Cfg.GetRestServerLaunch() {
+		go rest.LaunchServer()
+	}
+
+	// gRPC management server
+	if core.Cfg.GetGrpcServerLaunch() {
+		go grpcapi.LaunchServer()
+	}
+
+	// ACME certificates
+	if core.Cfg.GetAcmeEnabled() {
+		go core.LaunchAcme()
+	}
+
+	// self monitoring
+	if core.Cfg.GetMonitorInterval() != 0 {
+		go core.LaunchMonitor()
+	}
+
+	// Prometheus metrics
+	if core.Cfg.GetMetricsListen() != "" {
+		go core.LaunchMetricsServer()
+	}
+
+	// metrics rollups
+	if core.Cfg.GetMetricsRollupsEnabled() {
+		go core.LaunchMetricsRollups()
+	}
+
+	// delivery webhooks
+	if core.Cfg.GetWebhookEnabled() {
+		go core.LaunchWebhooks()
+	}
+
+	// DMARC aggregate reports
+	if core.Cfg.GetSmtpdDmarcReportsEnabled() {
+		go core.LaunchDmarcReporter()
+	}
+
+	// digests for domain administrators
+	if core.Cfg.GetDigestEnabled() {
+		go core.LaunchDigestReporter()
+	}
+
+	// quarantine expiration & digests
+	if core.QuarantineEnabled() {
+		go core.LaunchQuarantineHousekeeper()
+	}
+
+	// purge of message events
+	if core.Cfg.GetMessageTraceRetention() != 0 {
+		go core.LaunchMessageTracePurge()
+	}
+	srv.started = true
+	return nil
+}
+
+// startSmtpd launches smtpd (if role enables it), it returns the number of
+// listeners launched
+func (srv *Server) startSmtpd() (int, error) {
+	if !core.RoleSmtpdEnabled() {
+		return 0, nil
+	}
+	// clamav ?
+	if core.Cfg.GetSmtpdClamavEnabled() {
+		if err := core.NewClamav().Ping(); err != nil {
+			return 0, errors.New("unable to connect to clamd - " + err.Error())
+		}
+	}
+
+	smtpdDsns, err := core.GetDsnsFromString(core.Cfg.GetSmtpdDsns())
+	if err != nil {
+		return 0, errors.New("unable to parse smtpd dsn - " + err.Error())
+	}
+	core.SmtpdInheritedListenersClose(smtpdDsns)
+	for _, dsn := range smtpdDsns {
+		go core.NewSmtpd(dsn).ListenAndServe()
+		core.Log.Info("smtpd " + dsn.String() + " launched.")
+	}
+
+	// role addresses (postmaster, abuse)
+	if err = core.RoleAddressesCheck(); err != nil {
+		core.Log.Error("unable to check role addresses -", err)
+	}
+
+	// CRAM-MD5 states of users (password equivalent)
+	if err = core.SaslPurgeDisabledCredentials(); err != nil {
+		core.Log.Error("unable to purge SASL credentials -", err)
+	}
+
+	// accept-then-scan
+	go core.LaunchScanAsync()
+
+	return len(smtpdDsns), nil
+}
+
+// Stop stops gracefully smtpd (see smtpd_shutdown_grace) and deliverd
+// (see deliverd_shutdown_grace), stops queue producer and flushes nsqd to
+// disk. Other listeners are not closed: Stop must be called before exiting
+func (srv *Server) Stop() {
+	srv.Lock()
+	defer srv.Unlock()
+	if !srv.started {
+		return
+	}
+	core.Log.Info("Exiting...")
+
+	// no more connections, active sessions end
+	core.SmtpdStop()
+
+	// current deliveries end
+	core.DeliverdStop()
+
+	// close NsqQueueProducer if exists
+	if core.NsqQueueProducer != nil {
+		core.NsqQueueProducer.Stop()
+	}
+
+	// flush nsqd memory to disk
+	srv.nsqd.Exit()
+	srv.started = false
+}
+
+// Restart starts executable bin (with args) which takes over smtpd
+// listeners while server keeps serving. Once smtpd of bin serves, server
+// must be stopped (Stop) and the process must exit: bin starts its other
+// services then. If bin fails to start or to serve, an error is returned
+// and server keeps running.
+func (srv *Server) Restart(bin string, args []string) error {
+	h, err := core.SmtpdHandover()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(bin)
+	cmd.Args, cmd.Env, cmd.ExtraFiles = args, h.Env, h.Files
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err = cmd.Start(); err != nil {
+		h.Abort()
+		return err
+	}
+	h.Started()
+	// reaped if it exits before this process
+	go cmd.Wait()
+	if err = h.WaitReady(); err != nil {
+		cmd.Process.Kill()
+		h.Abort()
+		return err
+	}
+	srv.Lock()
+	srv.handover = h
+	srv.Unlock()
+	return nil
+}
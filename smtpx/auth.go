@@ -0,0 +1,259 @@
+// Modified version of the standard auth.go librarie
+
+// Copyright 2010 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpx
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Auth is implemented by an SMTP authentication mechanism.
+type Auth interface {
+	// Start begins an authentication with a server.
+	// It returns the name of the authentication protocol
+	// and optionally data to include in the initial AUTH message
+	// sent to the server. It can return proto == "" to indicate
+	// that the authentication should be skipped.
+	// If it returns a non-nil error, the SMTP client aborts
+	// the authentication attempt and closes the connection.
+	Start(server *ServerInfo) (proto string, toServer []byte, err error)
+
+	// Next continues the authentication. The server has just sent
+	// the fromServer data. If more is true, the server expects a
+	// response, which Next should return as toServer; otherwise
+	// Next should return toServer == nil.
+	// If Next returns a non-nil error, the SMTP client aborts
+	// the authentication attempt and closes the connection.
+	Next(fromServer []byte, more bool) (toServer []byte, err error)
+}
+
+// ServerInfo records information about an SMTP server.
+type ServerInfo struct {
+	//Address net.TCPAddr // SMTP adrress
+	Name string   // SMTP server name
+	TLS  bool     // using TLS, with valid certificate for Name
+	Auth []string // advertised authentication mechanisms
+}
+
+type plainAuth struct {
+	identity, username, password string
+	host                         string
+}
+
+// PlainAuth returns an Auth that implements the PLAIN authentication
+// mechanism as defined in RFC 4616.
+// The returned Auth uses the given username and password to authenticate
+// on TLS connections to host and act as identity. Usually identity will be
+// left blank to act as username.
+func PlainAuth(identity, username, password, host string) Auth {
+	return &plainAuth{identity, username, password, host}
+}
+
+func (a *plainAuth) Start(server *ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		advertised := false
+		for _, mechanism := range server.Auth {
+			if mechanism == "PLAIN" {
+				advertised = true
+				break
+			}
+		}
+		if !advertised {
+			return "", nil, errors.New("unencrypted connection")
+		}
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	resp := []byte(a.identity + "\x00" + a.username + "\x00" + a.password)
+	return "PLAIN", resp, nil
+}
+
+func (a *plainAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// We've already sent everything.
+		return nil, errors.New("unexpected server challenge")
+	}
+	return nil, nil
+}
+
+type cramMD5Auth struct {
+	username, secret string
+}
+
+// CRAMMD5Auth returns an Auth that implements the CRAM-MD5 authentication
+// mechanism as defined in RFC 2195.
+// The returned Auth uses the given username and secret to authenticate
+// to the server using the challenge-response mechanism.
+func CRAMMD5Auth(username, secret string) Auth {
+	return &cramMD5Auth{username, secret}
+}
+
+func (a *cramMD5Auth) Start(server *ServerInfo) (string, []byte, error) {
+	return "CRAM-MD5", nil, nil
+}
+
+func (a *cramMD5Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		d := hmac.New(md5.New, []byte(a.secret))
+		d.Write(fromServer)
+		s := make([]byte, 0, d.Size())
+		return []byte(fmt.Sprintf("%s %x", a.username, d.Sum(s))), nil
+	}
+	return nil, nil
+}
+
+type xoauth2Auth struct {
+	username, token string
+}
+
+// XOAuth2Auth returns an Auth that implements the XOAUTH2 authentication
+// mechanism (Gmail, Office 365) with OAuth 2.0 access token token.
+func XOAuth2Auth(username, token string) Auth {
+	return &xoauth2Auth{username, token}
+}
+
+func (a *xoauth2Auth) Start(server *ServerInfo) (string, []byte, error) {
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// error (JSON) is sent as a challenge, an empty response ends the
+		// exchange and server replies with the error code
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// scramMaxIterations is the max iteration count accepted from servers
+// (PBKDF2 cost)
+const scramMaxIterations = 1000000
+
+type scramSha256Auth struct {
+	username, password string
+	nonce              string
+	clientFirstBare    string
+	serverSignature    []byte
+	verified           bool // server signature has been verified
+}
+
+// ScramSha256Auth returns an Auth that implements the SCRAM-SHA-256
+// authentication mechanism as defined in RFC 7677 (without channel binding).
+func ScramSha256Auth(username, password string) Auth {
+	return &scramSha256Auth{username: username, password: password}
+}
+
+func (a *scramSha256Auth) Start(server *ServerInfo) (string, []byte, error) {
+	if a.nonce == "" {
+		b := make([]byte, 18)
+		if _, err := rand.Read(b); err != nil {
+			return "", nil, err
+		}
+		a.nonce = base64.StdEncoding.EncodeToString(b)
+	}
+	username := strings.Replace(strings.Replace(a.username, "=", "=3D", -1), ",", "=2C", -1)
+	a.clientFirstBare = "n=" + username + ",r=" + a.nonce
+	a.serverSignature, a.verified = nil, false
+	return "SCRAM-SHA-256", []byte("n,," + a.clientFirstBare), nil
+}
+
+func (a *scramSha256Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	// authentication succeeded, server must have proved it knows the
+	// password (server-final-message as challenge or as success data)
+	if !more {
+		if a.verified {
+			return nil, nil
+		}
+		if a.serverSignature == nil {
+			return nil, errors.New("SCRAM: authentication ended before server final message")
+		}
+		if decoded, err := base64.StdEncoding.DecodeString(string(fromServer)); err == nil && bytes.HasPrefix(decoded, []byte("v=")) {
+			fromServer = decoded
+		}
+		if err := a.verify(fromServer); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	// server-final-message
+	if a.serverSignature != nil {
+		if err := a.verify(fromServer); err != nil {
+			return nil, err
+		}
+		return []byte{}, nil
+	}
+	// server-first-message
+	var nonce, salt64 string
+	iterations := 0
+	for _, attr := range strings.Split(string(fromServer), ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			continue
+		}
+		switch attr[0] {
+		case 'r':
+			nonce = attr[2:]
+		case 's':
+			salt64 = attr[2:]
+		case 'i':
+			iterations, _ = strconv.Atoi(attr[2:])
+		case 'e':
+			return nil, errors.New("SCRAM: server error " + attr[2:])
+		}
+	}
+	if !strings.HasPrefix(nonce, a.nonce) || len(nonce) == len(a.nonce) {
+		return nil, errors.New("SCRAM: bad server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil || len(salt) == 0 || iterations <= 0 {
+		return nil, errors.New("SCRAM: bad server first message " + string(fromServer))
+	}
+	if iterations > scramMaxIterations {
+		return nil, fmt.Errorf("SCRAM: iteration count %d is over %d", iterations, scramMaxIterations)
+	}
+	clientFinal := "c=biws,r=" + nonce
+	authMessage := a.clientFirstBare + "," + string(fromServer) + "," + clientFinal
+	saltedPassword := pbkdf2.Key([]byte(a.password), salt, iterations, sha256.Size, sha256.New)
+	clientKey := scramHmac(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	proof := scramHmac(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	a.serverSignature = scramHmac(scramHmac(saltedPassword, "Server Key"), authMessage)
+	return []byte(clientFinal + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verify verifies server-final-message
+func (a *scramSha256Auth) verify(final []byte) error {
+	if !bytes.HasPrefix(final, []byte("v=")) {
+		return errors.New("SCRAM: bad server final message " + string(final))
+	}
+	signature, err := base64.StdEncoding.DecodeString(string(final[2:]))
+	if err != nil || !hmac.Equal(signature, a.serverSignature) {
+		return errors.New("SCRAM: bad server signature")
+	}
+	a.verified = true
+	return nil
+}
+
+// scramHmac returns HMAC-SHA-256 of message with key
+func scramHmac(key []byte, message string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(message))
+	return h.Sum(nil)
+}
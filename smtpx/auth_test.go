@@ -0,0 +1,65 @@
+package smtpx
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestXOAuth2Auth(t *testing.T) {
+	a := XOAuth2Auth("someuser@example.com", "ya29.vF9dft4qmTc2Nvb3RlckBhdHRhdmlzdGEuY29tCg")
+	proto, resp, err := a.Start(&ServerInfo{TLS: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "XOAUTH2", proto)
+	assert.Equal(t, "user=someuser@example.com\x01auth=Bearer ya29.vF9dft4qmTc2Nvb3RlckBhdHRhdmlzdGEuY29tCg\x01\x01", string(resp))
+	resp, err = a.Next([]byte(`{"status":"401","schemes":"bearer"}`), true)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{}, resp)
+}
+
+// test vector of RFC 7677
+func TestScramSha256Auth(t *testing.T) {
+	a := &scramSha256Auth{username: "user", password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	proto, resp, err := a.Start(&ServerInfo{TLS: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "SCRAM-SHA-256", proto)
+	assert.Equal(t, "n,,n=user,r=rOprNGfwEbeRWgbNEkqO", string(resp))
+	resp, err = a.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", string(resp))
+	_, err = a.Next([]byte("v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="), true)
+	assert.Error(t, err)
+	resp, err = a.Next([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="), true)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{}, resp)
+	resp, err = a.Next([]byte("2.7.0 Authentication successful"), false)
+	assert.NoError(t, err)
+	assert.Nil(t, resp)
+
+	// server signature as success data
+	a = &scramSha256Auth{username: "user", password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	a.Start(&ServerInfo{})
+	_, err = a.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"), true)
+	assert.NoError(t, err)
+	_, err = a.Next([]byte("dj02cnJpVFJCaTIzV3BSUi93dHVwK21NaFVaVW4vZEI1bkxUSlJzamw5NUc0PQ=="), false)
+	assert.NoError(t, err)
+
+	// success without server signature
+	a = &scramSha256Auth{username: "user", password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	a.Start(&ServerInfo{})
+	_, err = a.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"), true)
+	assert.NoError(t, err)
+	_, err = a.Next([]byte("2.7.0 Authentication successful"), false)
+	assert.Error(t, err)
+
+	a = &scramSha256Auth{username: "user", password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	a.Start(&ServerInfo{})
+	_, err = a.Next([]byte("r=another,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"), true)
+	assert.Error(t, err)
+
+	// iteration count over cap
+	a = &scramSha256Auth{username: "user", password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	a.Start(&ServerInfo{})
+	_, err = a.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=1000000000"), true)
+	assert.Error(t, err)
+}
@@ -0,0 +1,618 @@
+// strongly inspired by http://golang.org/src/net/smtp/smtp.go
+
+// Package smtpx is the SMTP and LMTP client of the tmail delivery engine.
+//
+// A Client is connected to a server through routes (Dial) or to an LMTP
+// server (DialLMTP), or wraps an existing connection (NewClient). Every
+// command takes a context: its deadline and cancellation abort the command
+// and close the connection. Host names are resolved and connections dialed
+// through the Resolver and Dialer of Options, so DNS and network can be
+// replaced. Idle connections can be kept for next deliveries in a Pool.
+package smtpx
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrTimeout is returned when the server doesn't reply in time
+var ErrTimeout = errors.New("server do not reply in time -> timeout")
+
+// default timeouts (see also DefaultTimeouts)
+const (
+	DefaultCommandTimeout = 30 * time.Second
+	// QUIT & canceled AUTH
+	shortCommandTimeout = 10 * time.Second
+)
+
+// Client represents an SMTP (or LMTP) client
+type Client struct {
+	// Text is the textproto connection to the server, replies of commands
+	// written to it directly can be read with it
+	Text *textproto.Conn
+	// LocalName is the name sent with EHLO, HELO and LHLO
+	LocalName string
+	// ServerName is the name of the server, authentications are bound to it
+	ServerName string
+	// Route is the route of the connection (nil if Client has not been
+	// connected by Dial)
+	Route *Route
+	// Timeouts of commands and data transfers (DefaultTimeouts for zero
+	// values)
+	Timeouts Timeouts
+	// OnClose, if not nil, is called when connection is closed
+	OnClose func()
+
+	conn      net.Conn
+	connTLS   *tls.Conn
+	closeOnce sync.Once
+	// supported extensions
+	ext map[string]string
+	// whether the Client is using TLS
+	tls bool
+	// supported auth mechanisms
+	auth []string
+	// LMTP (RFC 2033) client
+	lmtp bool
+}
+
+// Reply represents a reply of the server
+type Reply struct {
+	Code int
+	Msg  string
+	Err  error
+}
+
+// NewClient returns a client using conn, the greeting of the server must be
+// read with Greeting
+func NewClient(conn net.Conn, localName string) *Client {
+	return &Client{
+		Text:      textproto.NewConn(conn),
+		LocalName: localName,
+		conn:      conn,
+	}
+}
+
+// NewLMTPClient returns an LMTP client using conn (LHLO instead of EHLO, a
+// reply per recipient after DATA)
+func NewLMTPClient(conn net.Conn, localName string) *Client {
+	c := NewClient(conn, localName)
+	c.lmtp = true
+	return c
+}
+
+// Greeting reads the greeting of the server
+func (c *Client) Greeting(ctx context.Context) (code int, msg string, err error) {
+	defer c.watch(ctx, c.timeouts().Greeting)()
+	code, msg, err = c.Text.ReadCodeLine(220)
+	return code, msg, c.ioError(ctx, err)
+}
+
+// Close closes connection
+func (c *Client) Close() error {
+	err := c.Text.Close()
+	c.closeOnce.Do(func() {
+		if c.OnClose != nil {
+			c.OnClose()
+		}
+	})
+	return err
+}
+
+// timeouts returns timeouts of client
+func (c *Client) timeouts() Timeouts {
+	return DefaultTimeouts.Merge(c.Timeouts)
+}
+
+// watch sets the deadline of connection (in timeout or deadline of ctx if
+// it's sooner) and aborts I/O if ctx is canceled
+// the returned func must be called when I/O are done
+func (c *Client) watch(ctx context.Context, timeout time.Duration) func() {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.conn.SetDeadline(deadline)
+	if ctx.Done() == nil {
+		return func() { c.conn.SetDeadline(time.Time{}) }
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			// unblocks pending I/O
+			c.conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+		c.conn.SetDeadline(time.Time{})
+	}
+}
+
+// ioError returns err, connection is closed on timeout or cancellation
+// (its state is unknown)
+func (c *Client) ioError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		c.Close()
+		return ctx.Err()
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		c.Close()
+		return ErrTimeout
+	}
+	return err
+}
+
+// cmd sends a command and returns reply
+func (c *Client) cmd(ctx context.Context, timeout time.Duration, expectedCode int, format string, args ...interface{}) (int, string, error) {
+	defer c.watch(ctx, timeout)()
+	id, err := c.Text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", c.ioError(ctx, err)
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	code, msg, err := c.Text.ReadResponse(expectedCode)
+	return code, msg, c.ioError(ctx, err)
+}
+
+// Extension reports whether an extension is support by the server.
+func (c *Client) Extension(ext string) (bool, string) {
+	if c.ext == nil {
+		return false, ""
+	}
+	ext = strings.ToUpper(ext)
+	param, ok := c.ext[ext]
+	return ok, param
+}
+
+// Limits are limits announced by a server with the LIMITS extension
+// (RFC 9422), 0 if not announced
+type Limits struct {
+	RcptMax       int // recipients per transaction
+	MailMax       int // transactions per session
+	RcptDomainMax int // recipient domains per transaction
+}
+
+// Limits returns limits announced by the server
+func (c *Client) Limits() (limits Limits) {
+	ok, params := c.Extension("LIMITS")
+	if !ok {
+		return
+	}
+	for _, param := range strings.Fields(params) {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value, err := strconv.Atoi(kv[1])
+		if err != nil || value < 0 {
+			continue
+		}
+		switch strings.ToUpper(kv[0]) {
+		case "RCPTMAX":
+			limits.RcptMax = value
+		case "MAILMAX":
+			limits.MailMax = value
+		case "RCPTDOMAINMAX":
+			limits.RcptDomainMax = value
+		}
+	}
+	return
+}
+
+// IsLMTP returns true if c is an LMTP client
+func (c *Client) IsLMTP() bool {
+	return c.lmtp
+}
+
+// TLSConnectionState returns state of TLS connection, ok is false if
+// connection is not encrypted
+func (c *Client) TLSConnectionState() (state tls.ConnectionState, ok bool) {
+	if !c.tls {
+		return
+	}
+	return c.connTLS.ConnectionState(), true
+}
+
+// RemoteAddr return remote address (IP:PORT)
+func (c *Client) RemoteAddr() string {
+	return c.conn.RemoteAddr().String()
+}
+
+// LocalAddr return local address (IP:PORT)
+func (c *Client) LocalAddr() string {
+	return c.conn.LocalAddr().String()
+}
+
+// SMTP commands
+
+// Noop sends NOOP
+func (c *Client) Noop(ctx context.Context) (code int, msg string, err error) {
+	return c.cmd(ctx, c.timeouts().Command, 250, "NOOP")
+}
+
+// Rset sends RSET
+func (c *Client) Rset(ctx context.Context) (code int, msg string, err error) {
+	return c.cmd(ctx, c.timeouts().Command, 250, "RSET")
+}
+
+// Hello tries EHLO, then HELO if it failed (LHLO for LMTP client)
+func (c *Client) Hello(ctx context.Context) (code int, msg string, err error) {
+	code, msg, err = c.Ehlo(ctx)
+	if err == nil || c.lmtp {
+		return
+	}
+	return c.Helo(ctx)
+}
+
+// Ehlo sends EHLO (LHLO for LMTP client) and records extensions announced
+// by the server
+func (c *Client) Ehlo(ctx context.Context) (code int, msg string, err error) {
+	verb := "EHLO"
+	if c.lmtp {
+		verb = "LHLO"
+	}
+	code, msg, err = c.cmd(ctx, c.timeouts().Ehlo, 250, "%s %s", verb, c.LocalName)
+	if err != nil {
+		return code, msg, err
+	}
+	ext := make(map[string]string)
+	extList := strings.Split(msg, "\n")
+	if len(extList) > 1 {
+		extList = extList[1:]
+		for _, line := range extList {
+			args := strings.SplitN(line, " ", 2)
+			if len(args) > 1 {
+				ext[strings.ToUpper(args[0])] = args[1]
+			} else {
+				ext[strings.ToUpper(args[0])] = ""
+			}
+		}
+	}
+	if mechs, ok := ext["AUTH"]; ok {
+		c.auth = strings.Split(mechs, " ")
+	}
+	c.ext = ext
+	return
+}
+
+// Helo sends HELO
+func (c *Client) Helo(ctx context.Context) (code int, msg string, err error) {
+	c.ext = nil
+	return c.cmd(ctx, c.timeouts().Ehlo, 250, "HELO %s", c.LocalName)
+}
+
+// StartTLS sends the STARTTLS command, encrypts all further communication
+// and sends EHLO again
+func (c *Client) StartTLS(ctx context.Context, config *tls.Config) (code int, msg string, err error) {
+	c.tls = false
+	code, msg, err = c.cmd(ctx, c.timeouts().StartTLS, 220, "STARTTLS")
+	if err != nil {
+		return
+	}
+	c.connTLS = tls.Client(c.conn, config)
+	stop := c.watch(ctx, c.timeouts().StartTLS)
+	err = c.connTLS.Handshake()
+	stop()
+	if err != nil {
+		return 0, "", c.ioError(ctx, err)
+	}
+	c.Text = textproto.NewConn(c.connTLS)
+	code, msg, err = c.Ehlo(ctx)
+	if err != nil {
+		return
+	}
+	c.tls = true
+	return
+}
+
+// Auth authenticates with mechanism a, connection is closed on failure
+func (c *Client) Auth(ctx context.Context, a Auth) (code int, msg string, err error) {
+	encoding := base64.StdEncoding
+	mech, resp, err := a.Start(&ServerInfo{c.ServerName, c.tls, c.auth})
+	if err != nil {
+		c.Quit(ctx)
+		return
+	}
+	resp64 := make([]byte, encoding.EncodedLen(len(resp)))
+	encoding.Encode(resp64, resp)
+	code, msg64, err := c.cmd(ctx, c.timeouts().Command, 0, "AUTH %s %s", mech, resp64)
+	for err == nil {
+		var msg []byte
+		switch code {
+		case 334:
+			msg, err = encoding.DecodeString(msg64)
+		case 235:
+			// the last message isn't base64 because it isn't a challenge
+			msg = []byte(msg64)
+		default:
+			err = &textproto.Error{Code: code, Msg: msg64}
+		}
+		if err == nil {
+			resp, err = a.Next(msg, code == 334)
+		}
+		if err != nil {
+			// abort the AUTH
+			c.cmd(ctx, shortCommandTimeout, 501, "*")
+			c.Quit(ctx)
+			break
+		}
+		if resp == nil {
+			break
+		}
+		resp64 = make([]byte, encoding.EncodedLen(len(resp)))
+		encoding.Encode(resp64, resp)
+		code, msg64, err = c.cmd(ctx, c.timeouts().Command, 0, "%s", resp64)
+	}
+	return code, msg64, err
+}
+
+// ForwardClient sends original client attributes (name, value pairs) with
+// verb XCLIENT or XFORWARD. Only attributes announced by the server in its
+// EHLO reply are sent.
+// After XCLIENT the server sends a new greeting and EHLO is sent again.
+func (c *Client) ForwardClient(ctx context.Context, verb string, attrs [][2]string) (code int, msg string, err error) {
+	ok, announced := c.Extension(verb)
+	if !ok {
+		return 0, "", errors.New(verb + " is not supported by remote server")
+	}
+	announced = " " + strings.ToUpper(announced) + " "
+	cmd := verb
+	for _, attr := range attrs {
+		if !strings.Contains(announced, " "+attr[0]+" ") {
+			continue
+		}
+		cmd += " " + attr[0] + "=" + xtextEncode(attr[1])
+	}
+	if cmd == verb {
+		return 0, "", errors.New("no attribute to send with " + verb)
+	}
+	if verb == "XFORWARD" {
+		return c.cmd(ctx, c.timeouts().Command, 250, "%s", cmd)
+	}
+	if code, msg, err = c.cmd(ctx, c.timeouts().Command, 220, "%s", cmd); err != nil {
+		return
+	}
+	return c.Ehlo(ctx)
+}
+
+// xtextEncode encodes s as xtext (RFC 3461)
+func xtextEncode(s string) string {
+	encoded := ""
+	for _, c := range []byte(s) {
+		if c < 33 || c > 126 || c == '+' || c == '=' {
+			encoded += fmt.Sprintf("+%02X", c)
+			continue
+		}
+		encoded += string(c)
+	}
+	return encoded
+}
+
+// cmdParams returns ESMTP parameters of a command (" P1 P2", "" if none)
+func cmdParams(params []string) string {
+	if len(params) == 0 {
+		return ""
+	}
+	return " " + strings.Join(params, " ")
+}
+
+// Mail sends MAIL FROM with ESMTP parameters params (KEYWORD[=value])
+func (c *Client) Mail(ctx context.Context, from string, params ...string) (code int, msg string, err error) {
+	return c.cmd(ctx, c.timeouts().Mail, 250, "MAIL FROM:<%s>%s", from, cmdParams(params))
+}
+
+// Rcpt sends RCPT TO with ESMTP parameters params, err is not nil if
+// recipient is not accepted
+func (c *Client) Rcpt(ctx context.Context, to string, params ...string) (code int, msg string, err error) {
+	code, msg, err = c.cmd(ctx, c.timeouts().Rcpt, -1, "RCPT TO:<%s>%s", to, cmdParams(params))
+	if err == nil && code != 250 && code != 251 {
+		err = &textproto.Error{Code: code, Msg: msg}
+	}
+	return
+}
+
+// MailRcpt sends MAIL FROM and RCPT TO for each recipient, commands are
+// pipelined (RFC 2920) if the server announced PIPELINING
+// err is not nil if MAIL FROM failed or on network error, replies to RCPT
+// are returned in order
+func (c *Client) MailRcpt(ctx context.Context, from string, to []string) (mail Reply, rcpts []Reply, err error) {
+	if ok, _ := c.Extension("PIPELINING"); !ok {
+		if mail.Code, mail.Msg, mail.Err = c.Mail(ctx, from); mail.Err != nil {
+			return mail, nil, mail.Err
+		}
+		for _, rcpt := range to {
+			r := Reply{}
+			r.Code, r.Msg, r.Err = c.Rcpt(ctx, rcpt)
+			if r.Code == 0 && r.Err != nil {
+				return mail, rcpts, r.Err
+			}
+			rcpts = append(rcpts, r)
+		}
+		return mail, rcpts, nil
+	}
+
+	// pipelined commands: MAIL and RCPT timeouts
+	defer c.watch(ctx, c.timeouts().Mail+c.timeouts().Rcpt)()
+	ids := []uint{}
+	id, err := c.Text.Cmd("MAIL FROM:<%s>", from)
+	if err != nil {
+		return mail, nil, c.ioError(ctx, err)
+	}
+	ids = append(ids, id)
+	for _, rcpt := range to {
+		if id, err = c.Text.Cmd("RCPT TO:<%s>", rcpt); err != nil {
+			return mail, nil, c.ioError(ctx, err)
+		}
+		ids = append(ids, id)
+	}
+	for i, id := range ids {
+		r := Reply{}
+		c.Text.StartResponse(id)
+		r.Code, r.Msg, r.Err = c.Text.ReadResponse(-1)
+		c.Text.EndResponse(id)
+		if r.Code == 0 && r.Err != nil {
+			return mail, rcpts, c.ioError(ctx, r.Err)
+		}
+		if r.Err == nil && ((i == 0 && r.Code != 250) || (i > 0 && r.Code != 250 && r.Code != 251)) {
+			r.Err = &textproto.Error{Code: r.Code, Msg: r.Msg}
+		}
+		if i == 0 {
+			mail = r
+		} else {
+			rcpts = append(rcpts, r)
+		}
+	}
+	// replies to RCPT are meaningless if MAIL has failed
+	if mail.Err != nil {
+		return mail, nil, mail.Err
+	}
+	return mail, rcpts, nil
+}
+
+// DataWriter writes message data after DATA
+type DataWriter struct {
+	c *Client
+	io.WriteCloser
+}
+
+// Write writes a block of data (limited by Timeouts.DataBlock)
+func (w *DataWriter) Write(p []byte) (int, error) {
+	w.c.conn.SetWriteDeadline(time.Now().Add(w.c.timeouts().DataBlock))
+	n, err := w.WriteCloser.Write(p)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		w.c.Close()
+		return n, ErrTimeout
+	}
+	return n, err
+}
+
+// Finish ends data and returns reply of the server (the code is not
+// checked)
+func (w *DataWriter) Finish(ctx context.Context) (code int, msg string, err error) {
+	defer w.c.watch(ctx, w.c.timeouts().DataTerm)()
+	if err = w.WriteCloser.Close(); err != nil {
+		return 0, "", w.c.ioError(ctx, err)
+	}
+	code, msg, err = w.c.Text.ReadResponse(-1)
+	return code, msg, w.c.ioError(ctx, err)
+}
+
+// Data issues a DATA command to the server and returns a writer that
+// can be used to write the data. The caller must call Finish before calling
+// any more methods on c.
+func (c *Client) Data(ctx context.Context) (*DataWriter, int, string, error) {
+	code, msg, err := c.cmd(ctx, c.timeouts().DataInit, 354, "DATA")
+	if err != nil {
+		return nil, code, msg, err
+	}
+	return &DataWriter{c, c.Text.DotWriter()}, code, msg, nil
+}
+
+// Bdat sends data to the server in chunks of chunkSize bytes (RFC 3030
+// CHUNKING), the last one with the LAST keyword. It returns the reply to the
+// last chunk sent.
+// If chunkSize is 0 data is sent in one chunk.
+func (c *Client) Bdat(ctx context.Context, data []byte, chunkSize int) (code int, msg string, err error) {
+	if chunkSize <= 0 {
+		chunkSize = len(data)
+	}
+	offset := 0
+	for {
+		end := offset + chunkSize
+		last := end >= len(data)
+		if last {
+			end = len(data)
+		}
+		code, msg, err = c.bdatChunk(ctx, data[offset:end], last)
+		if err != nil || last {
+			return
+		}
+		offset = end
+	}
+}
+
+// bdatChunk sends one BDAT command followed by its chunk and reads reply
+func (c *Client) bdatChunk(ctx context.Context, chunk []byte, last bool) (int, string, error) {
+	cmd := fmt.Sprintf("BDAT %d", len(chunk))
+	if last {
+		cmd += " LAST"
+	}
+	// chunk can be huge, data timeouts are used rather than command timeout
+	timeout := c.timeouts().DataBlock
+	if last {
+		timeout += c.timeouts().DataTerm
+	}
+	defer c.watch(ctx, timeout)()
+
+	id := c.Text.Next()
+	c.Text.StartRequest(id)
+	_, err := c.Text.W.WriteString(cmd + "\r\n")
+	if err == nil {
+		_, err = c.Text.W.Write(chunk)
+	}
+	if err == nil {
+		err = c.Text.W.Flush()
+	}
+	c.Text.EndRequest(id)
+	if err != nil {
+		return 0, "", c.ioError(ctx, err)
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	code, msg, err := c.Text.ReadResponse(250)
+	return code, msg, c.ioError(ctx, err)
+}
+
+// LMTPData sends DATA and data, then reads a reply per accepted recipient
+// (rcptCount). Replies are returned in RCPT order.
+func (c *Client) LMTPData(ctx context.Context, data []byte, rcptCount int) (replies []Reply, code int, msg string, err error) {
+	w, code, msg, err := c.Data(ctx)
+	if err != nil {
+		return nil, code, msg, err
+	}
+	if _, err = io.Copy(w, bytes.NewReader(data)); err != nil {
+		return nil, 0, "", c.ioError(ctx, err)
+	}
+	defer c.watch(ctx, c.timeouts().DataTerm)()
+	if err = w.WriteCloser.Close(); err != nil {
+		return nil, 0, "", c.ioError(ctx, err)
+	}
+	for i := 0; i < rcptCount; i++ {
+		var r Reply
+		r.Code, r.Msg, r.Err = c.Text.ReadResponse(250)
+		// network error, next replies will never come
+		if r.Code == 0 && r.Err != nil {
+			return replies, 0, "", c.ioError(ctx, r.Err)
+		}
+		replies = append(replies, r)
+	}
+	return replies, 250, "", nil
+}
+
+// Quit sends QUIT and closes connection
+func (c *Client) Quit(ctx context.Context) (code int, msg string, err error) {
+	code, msg, err = c.cmd(ctx, shortCommandTimeout, 221, "QUIT")
+	c.Close()
+	return
+}
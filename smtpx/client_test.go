@@ -0,0 +1,284 @@
+package smtpx
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeServer serves one connection, replies are given per command verb
+func fakeServer(t *testing.T, replies map[string]string) (addr string, commands chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands = make(chan string, 100)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("220 fake ESMTP\r\n"))
+		data := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(commands)
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			if data {
+				if line == "." {
+					data = false
+					conn.Write([]byte("250 queued\r\n"))
+				}
+				continue
+			}
+			commands <- line
+			verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			if strings.HasPrefix(line, "RCPT TO:<bad") {
+				verb = "RCPT-BAD"
+			}
+			reply, ok := replies[verb]
+			if !ok {
+				// no reply
+				continue
+			}
+			conn.Write([]byte(reply + "\r\n"))
+			if verb == "DATA" {
+				data = true
+			}
+			if verb == "QUIT" {
+				close(commands)
+				return
+			}
+		}
+	}()
+	return l.Addr().String(), commands
+}
+
+var fakeReplies = map[string]string{
+	"EHLO":     "250-fake\r\n250-PIPELINING\r\n250 8BITMIME",
+	"MAIL":     "250 ok",
+	"RCPT":     "250 ok",
+	"RCPT-BAD": "550 no such user",
+	"DATA":     "354 go",
+	"RSET":     "250 ok",
+	"QUIT":     "221 bye",
+}
+
+func dialFake(t *testing.T, addr string) *Client {
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+	c, err := Dial(context.Background(), []Route{{ID: 7, RemoteHost: host, RemotePort: p}}, Options{LocalName: "client.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestSession(t *testing.T) {
+	addr, commands := fakeServer(t, fakeReplies)
+	c := dialFake(t, addr)
+	assert.Equal(t, int64(7), c.Route.ID)
+	ctx := context.Background()
+
+	_, _, err := c.Hello(ctx)
+	assert.NoError(t, err)
+	ok, _ := c.Extension("pipelining")
+	assert.True(t, ok)
+
+	mail, rcpts, err := c.MailRcpt(ctx, "from@example.com", []string{"good@example.com", "bad@example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, 250, mail.Code)
+	assert.Len(t, rcpts, 2)
+	assert.NoError(t, rcpts[0].Err)
+	assert.Equal(t, 550, rcpts[1].Code)
+	_, ok = rcpts[1].Err.(*textproto.Error)
+	assert.True(t, ok)
+
+	w, _, _, err := c.Data(ctx)
+	assert.NoError(t, err)
+	w.Write([]byte("Subject: test\r\n\r\nbody\r\n"))
+	code, _, err := w.Finish(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 250, code)
+
+	_, _, err = c.Quit(ctx)
+	assert.NoError(t, err)
+
+	sent := []string{}
+	for cmd := range commands {
+		sent = append(sent, cmd)
+	}
+	assert.Equal(t, []string{"EHLO client.test", "MAIL FROM:<from@example.com>", "RCPT TO:<good@example.com>", "RCPT TO:<bad@example.com>", "DATA", "QUIT"}, sent)
+}
+
+func TestParams(t *testing.T) {
+	addr, commands := fakeServer(t, fakeReplies)
+	c := dialFake(t, addr)
+	ctx := context.Background()
+	_, _, err := c.Mail(ctx, "from@example.com", "MT-PRIORITY=3")
+	assert.NoError(t, err)
+	_, _, err = c.Rcpt(ctx, "to@example.com", "X-A=1", "X-B")
+	assert.NoError(t, err)
+	_, _, err = c.Rcpt(ctx, "other@example.com")
+	assert.NoError(t, err)
+	c.Quit(ctx)
+	sent := []string{}
+	for cmd := range commands {
+		sent = append(sent, cmd)
+	}
+	assert.Equal(t, []string{"MAIL FROM:<from@example.com> MT-PRIORITY=3", "RCPT TO:<to@example.com> X-A=1 X-B", "RCPT TO:<other@example.com>", "QUIT"}, sent)
+}
+
+func TestLimits(t *testing.T) {
+	replies := map[string]string{
+		"EHLO": "250-fake\r\n250-LIMITS RCPTMAX=20 MAILMAX=bad RCPTDOMAINMAX=3 FOO=1\r\n250 8BITMIME",
+		"QUIT": "221 bye",
+	}
+	addr, _ := fakeServer(t, replies)
+	c := dialFake(t, addr)
+	ctx := context.Background()
+	_, _, err := c.Hello(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, Limits{RcptMax: 20, RcptDomainMax: 3}, c.Limits())
+	c.Quit(ctx)
+
+	addr, _ = fakeServer(t, fakeReplies)
+	c = dialFake(t, addr)
+	c.Hello(ctx)
+	assert.Equal(t, Limits{}, c.Limits())
+	c.Quit(ctx)
+}
+
+func TestContextCancel(t *testing.T) {
+	addr, _ := fakeServer(t, fakeReplies)
+	c := dialFake(t, addr)
+	closed := false
+	c.OnClose = func() { closed = true }
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	// NOOP is never replied
+	_, _, err := c.Noop(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, closed)
+}
+
+func TestParseLMTPURI(t *testing.T) {
+	network, address, err := ParseLMTPURI("lmtp:///var/run/lmtp.sock")
+	assert.NoError(t, err)
+	assert.Equal(t, "unix", network)
+	assert.Equal(t, "/var/run/lmtp.sock", address)
+
+	network, address, err = ParseLMTPURI("LMTP://mailstore")
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp", network)
+	assert.Equal(t, "mailstore:24", address)
+
+	_, _, err = ParseLMTPURI("smtp://mailstore")
+	assert.Error(t, err)
+}
+
+// fakeResolver resolves all host names to ips
+type fakeResolver []net.IP
+
+func (r fakeResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return r, nil
+}
+
+func TestAttempts(t *testing.T) {
+	opts := Options{Resolver: fakeResolver{net.ParseIP("192.0.2.25"), net.ParseIP("2001:db8::25")}}
+	route := Route{
+		RemoteHost: "mx.example.com",
+		RemotePort: 25,
+		LocalIPs:   []net.IP{net.ParseIP("198.51.100.1"), net.ParseIP("2001:db8::1")},
+	}
+	attempts, err := Attempts(context.Background(), &route, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []Attempt{
+		{net.ParseIP("198.51.100.1"), "192.0.2.25:25"},
+		{net.ParseIP("2001:db8::1"), "[2001:db8::25]:25"},
+	}, attempts)
+
+	// any local IP
+	route.LocalIPs = nil
+	route.RemoteHost = "192.0.2.26"
+	attempts, err = Attempts(context.Background(), &route, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []Attempt{{nil, "192.0.2.26:25"}}, attempts)
+
+	_, err = Attempts(context.Background(), &Route{RemoteHost: "lmtp://mailstore"}, opts)
+	assert.Error(t, err)
+}
+
+func TestAttemptsFamily(t *testing.T) {
+	opts := Options{Resolver: fakeResolver{net.ParseIP("192.0.2.25"), net.ParseIP("192.0.2.26"), net.ParseIP("2001:db8::25")}}
+	route := Route{RemoteHost: "mx.example.com", RemotePort: 25, Family: FamilyIPv6First}
+	attempts, err := Attempts(context.Background(), &route, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []Attempt{{nil, "[2001:db8::25]:25"}, {nil, "192.0.2.25:25"}, {nil, "192.0.2.26:25"}}, attempts)
+
+	route.Family = FamilyIPv4Only
+	attempts, err = Attempts(context.Background(), &route, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []Attempt{{nil, "192.0.2.25:25"}, {nil, "192.0.2.26:25"}}, attempts)
+
+	route.Family = FamilyIPv6Only
+	route.LocalIPs = []net.IP{net.ParseIP("198.51.100.1")}
+	_, err = Attempts(context.Background(), &route, opts)
+	assert.Error(t, err)
+
+	_, err = ParseFamily("IPv4-First")
+	assert.NoError(t, err)
+	_, err = ParseFamily("ipv5")
+	assert.Error(t, err)
+}
+
+// blackholeDialer never connects to blackhole, connects to others
+type blackholeDialer struct {
+	blackhole string
+	dialed    chan string
+}
+
+func (d blackholeDialer) Dial(ctx context.Context, network, localAddr, remoteAddr string) (net.Conn, error) {
+	d.dialed <- remoteAddr
+	if remoteAddr == d.blackhole {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	client, server := net.Pipe()
+	server.Close()
+	return client, nil
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	dialer := blackholeDialer{"[2001:db8::25]:25", make(chan string, 10)}
+	opts := Options{Dialer: dialer, FallbackDelay: 50 * time.Millisecond}
+	route := Route{RemoteHost: "mx.example.com", RemotePort: 25}
+	attempts := []Attempt{{nil, "[2001:db8::25]:25"}, {nil, "192.0.2.25:25"}}
+	started := time.Now()
+	conn, err := dialAttempts(context.Background(), &route, attempts, opts)
+	assert.NoError(t, err)
+	conn.Close()
+	assert.True(t, time.Since(started) < time.Second)
+	assert.Equal(t, "[2001:db8::25]:25", <-dialer.dialed)
+	assert.Equal(t, "192.0.2.25:25", <-dialer.dialed)
+
+	// no address answers
+	dialer.blackhole = "192.0.2.25:25"
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = dialAttempts(ctx, &route, attempts[1:], Options{Dialer: dialer})
+	assert.Error(t, err)
+}
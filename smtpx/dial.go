@@ -0,0 +1,406 @@
+package smtpx
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resolver resolves host names of routes
+type Resolver interface {
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// Dialer dials connections to servers, localAddr is the local address
+// (IP:0) to bind ("" for any)
+type Dialer interface {
+	Dial(ctx context.Context, network, localAddr, remoteAddr string) (net.Conn, error)
+}
+
+// NetResolver resolves host names with package net
+type NetResolver struct{}
+
+// LookupIP implements Resolver
+func (NetResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, nil
+}
+
+// NetDialer dials connections with package net
+type NetDialer struct {
+	// Timeout of connections (none if zero)
+	Timeout time.Duration
+}
+
+// Dial implements Dialer
+func (d NetDialer) Dial(ctx context.Context, network, localAddr, remoteAddr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: d.Timeout}
+	if localAddr != "" {
+		addr, err := net.ResolveTCPAddr("tcp", localAddr)
+		if err != nil {
+			return nil, errors.New("bad local address: " + localAddr + ". " + err.Error())
+		}
+		dialer.LocalAddr = addr
+	}
+	return dialer.DialContext(ctx, network, remoteAddr)
+}
+
+// Family is the IP family preference of a route
+type Family string
+
+// Families
+const (
+	// FamilyAny: addresses are tried in resolver order
+	FamilyAny       Family = ""
+	FamilyIPv6First Family = "ipv6-first"
+	FamilyIPv4First Family = "ipv4-first"
+	FamilyIPv6Only  Family = "ipv6-only"
+	FamilyIPv4Only  Family = "ipv4-only"
+)
+
+// ParseFamily returns family f
+func ParseFamily(f string) (Family, error) {
+	switch family := Family(strings.ToLower(f)); family {
+	case FamilyAny, FamilyIPv6First, FamilyIPv4First, FamilyIPv6Only, FamilyIPv4Only:
+		return family, nil
+	}
+	return FamilyAny, errors.New("bad IP family " + f + " (ipv6-first, ipv4-first, ipv6-only or ipv4-only expected)")
+}
+
+// Route is a way to reach a server
+type Route struct {
+	// ID identifies route for the caller
+	ID int64
+	// RemoteHost is the host name or IP of server, or an LMTP URI
+	// (lmtp://host:port or lmtp:///path/to/socket)
+	RemoteHost string
+	RemotePort int
+	// LocalIPs are local IPs to connect from (any if empty), they are tried
+	// in order (failover) or in random order if RoundRobin is true
+	LocalIPs   []net.IP
+	RoundRobin bool
+	// Proxy, if not nil, is the proxy connections go through. Local IPs are
+	// the source addresses of PROXY headers, they are ignored with SOCKS5.
+	Proxy *Proxy
+	// Family is the IP family preference of connections
+	Family Family
+	// Timeouts of connections through route, they override those of
+	// Options which are not zero
+	Timeouts Timeouts
+}
+
+// Options are options of Dial
+type Options struct {
+	// LocalName is sent with EHLO, HELO and LHLO
+	LocalName string
+	// Resolver resolves host names (NetResolver if nil)
+	Resolver Resolver
+	// Dialer dials connections (NetDialer with Timeouts.Connect if nil)
+	Dialer Dialer
+	// FallbackDelay is the head start of an attempt before the next one is
+	// started in parallel (Happy Eyeballs, RFC 8305), attempts are
+	// sequential if zero
+	FallbackDelay time.Duration
+	// Timeouts of connections and clients (see Client)
+	Timeouts Timeouts
+	// Debug, if not nil, is called with failed attempts
+	Debug func(v ...interface{})
+}
+
+func (o *Options) resolver() Resolver {
+	if o.Resolver == nil {
+		return NetResolver{}
+	}
+	return o.Resolver
+}
+
+func (o *Options) dialer() Dialer {
+	if o.Dialer == nil {
+		return NetDialer{Timeout: DefaultTimeouts.Merge(o.Timeouts).Connect}
+	}
+	return o.Dialer
+}
+
+func (o *Options) debug(v ...interface{}) {
+	if o.Debug != nil {
+		o.Debug(v...)
+	}
+}
+
+// client returns a client of conn
+func (o *Options) client(conn net.Conn, lmtp bool) *Client {
+	c := NewClient(conn, o.LocalName)
+	c.lmtp = lmtp
+	c.Timeouts = o.Timeouts
+	return c
+}
+
+// IsLMTPURI returns true if uri is an LMTP destination (lmtp://...)
+func IsLMTPURI(uri string) bool {
+	return strings.HasPrefix(strings.ToLower(uri), "lmtp://")
+}
+
+// ParseLMTPURI returns network and address of an LMTP URI
+// lmtp://host:port -> tcp (default port 24)
+// lmtp:///path/to/socket -> unix
+func ParseLMTPURI(uri string) (network, address string, err error) {
+	if !IsLMTPURI(uri) {
+		return "", "", errors.New("not an LMTP URI: " + uri)
+	}
+	address = uri[len("lmtp://"):]
+	if address == "" {
+		return "", "", errors.New("empty LMTP destination: " + uri)
+	}
+	if address[0] == '/' {
+		return "unix", address, nil
+	}
+	if _, _, err = net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "24")
+	}
+	return "tcp", address, nil
+}
+
+// DialLMTP returns a client connected to LMTP server uri (greeting has been
+// read)
+func DialLMTP(ctx context.Context, uri string, opts Options) (*Client, error) {
+	network, address, err := ParseLMTPURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := opts.dialer().Dial(ctx, network, "", address)
+	if err != nil {
+		return nil, err
+	}
+	c := opts.client(conn, true)
+	c.ServerName = address
+	if _, _, err = c.Greeting(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Attempt is a connection Dial tries through a route
+type Attempt struct {
+	// LocalIP is the local IP to connect from (nil for any)
+	LocalIP net.IP
+	// RemoteAddr is the server address (IP:port)
+	RemoteAddr string
+}
+
+// Attempts returns connections Dial tries through route (not LMTP), in
+// order: each local IP with each address of remote host of the same family
+// (IPv4 <-> IPv4 or IPv6 <-> IPv6). Order of local IPs is random for round
+// robin routes. With an "only" family preference addresses of the other
+// family are removed, with a "first" preference families are interleaved
+// starting with the preferred one (RFC 8305).
+func Attempts(ctx context.Context, route *Route, opts Options) ([]Attempt, error) {
+	if IsLMTPURI(route.RemoteHost) {
+		return nil, errors.New("no attempts for LMTP route " + route.RemoteHost)
+	}
+	localIPs := route.LocalIPs
+	if len(localIPs) == 0 || (route.Proxy != nil && route.Proxy.Scheme == "socks5") {
+		localIPs = []net.IP{nil}
+	} else if route.RoundRobin {
+		localIPs = make([]net.IP, len(route.LocalIPs))
+		for i, p := range rand.Perm(len(route.LocalIPs)) {
+			localIPs[p] = route.LocalIPs[i]
+		}
+	}
+
+	// remote addresses
+	remoteIPs := []net.IP{}
+	if ip := net.ParseIP(route.RemoteHost); ip != nil {
+		remoteIPs = append(remoteIPs, ip)
+	} else {
+		ips, err := opts.resolver().LookupIP(ctx, route.RemoteHost)
+		if err != nil {
+			return nil, err
+		}
+		remoteIPs = ips
+	}
+
+	attempts := []Attempt{}
+	for _, localIP := range localIPs {
+		for _, remoteIP := range remoteIPs {
+			// IPv4 <-> IPv4 or IPv6 <-> IPv6
+			if localIP != nil && (localIP.To4() != nil) != (remoteIP.To4() != nil) {
+				continue
+			}
+			attempts = append(attempts, Attempt{localIP, net.JoinHostPort(remoteIP.String(), strconv.Itoa(route.RemotePort))})
+		}
+	}
+
+	// family preference
+	if route.Family == FamilyAny {
+		return attempts, nil
+	}
+	preferred, others := []Attempt{}, []Attempt{}
+	for _, a := range attempts {
+		host, _, _ := net.SplitHostPort(a.RemoteAddr)
+		isIPv6 := net.ParseIP(host).To4() == nil
+		if isIPv6 == (route.Family == FamilyIPv6First || route.Family == FamilyIPv6Only) {
+			preferred = append(preferred, a)
+		} else {
+			others = append(others, a)
+		}
+	}
+	if route.Family == FamilyIPv6Only || route.Family == FamilyIPv4Only {
+		if len(preferred) == 0 {
+			return nil, errors.New("no address of family " + string(route.Family) + " for " + route.RemoteHost)
+		}
+		return preferred, nil
+	}
+	attempts = attempts[:0]
+	for i := 0; i < len(preferred) || i < len(others); i++ {
+		if i < len(preferred) {
+			attempts = append(attempts, preferred[i])
+		}
+		if i < len(others) {
+			attempts = append(attempts, others[i])
+		}
+	}
+	return attempts, nil
+}
+
+// dialAttempt dials connection a through route
+func (o *Options) dialAttempt(ctx context.Context, route *Route, a Attempt) (net.Conn, error) {
+	if route.Proxy != nil {
+		return route.Proxy.Dial(ctx, o.dialer(), a.LocalIP, a.RemoteAddr)
+	}
+	localAddr := ""
+	if a.LocalIP != nil {
+		localAddr = net.JoinHostPort(a.LocalIP.String(), "0")
+	}
+	return o.dialer().Dial(ctx, "tcp", localAddr, a.RemoteAddr)
+}
+
+// dialAttempts returns the first connection established through route
+// (Happy Eyeballs): an attempt is started when the previous one fails or
+// after opts.FallbackDelay, connections established after the first one are
+// closed.
+func dialAttempts(ctx context.Context, route *Route, attempts []Attempt, opts Options) (net.Conn, error) {
+	if len(attempts) == 0 {
+		return nil, errors.New("no address to connect to " + route.RemoteHost)
+	}
+	dialCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn    net.Conn
+		err     error
+		attempt Attempt
+	}
+	results := make(chan result, len(attempts))
+	next, pending := 0, 0
+	start := func() {
+		a := attempts[next]
+		next++
+		pending++
+		go func() {
+			conn, err := opts.dialAttempt(dialCtx, route, a)
+			results <- result{conn, err, a}
+		}()
+	}
+
+	start()
+	var err error
+	for pending != 0 {
+		var fallback <-chan time.Time
+		var timer *time.Timer
+		if next < len(attempts) && opts.FallbackDelay > 0 {
+			timer = time.NewTimer(opts.FallbackDelay)
+			fallback = timer.C
+		}
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if timer != nil {
+					timer.Stop()
+				}
+				// canceled attempts
+				go func(n int) {
+					for ; n != 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			opts.debug("unable to get a SMTP client", r.attempt.LocalIP, "->", r.attempt.RemoteAddr, "-", r.err.Error())
+			err = r.err
+			if next < len(attempts) {
+				start()
+			}
+		case <-fallback:
+			start()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	return nil, err
+}
+
+// Dial returns a client connected through the first route which works
+// (greeting has been read). Local IPs of a route are tried with each
+// address of its remote host (see Attempts), attempts overlap after
+// opts.FallbackDelay (Happy Eyeballs).
+// If a server replies with an error greeting, the error (a
+// *textproto.Error) is returned at once.
+func Dial(ctx context.Context, routes []Route, opts Options) (*Client, error) {
+	global := opts.Timeouts
+	for i := range routes {
+		route := &routes[i]
+		opts.Timeouts = global.Merge(route.Timeouts)
+		// LMTP
+		if IsLMTPURI(route.RemoteHost) {
+			c, err := DialLMTP(ctx, route.RemoteHost, opts)
+			if err == nil {
+				c.Route = route
+				return c, nil
+			}
+			opts.debug("unable to get a LMTP client", route.RemoteHost, "-", err.Error())
+			continue
+		}
+
+		attempts, err := Attempts(ctx, route, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := dialAttempts(ctx, route, attempts, opts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		c := opts.client(conn, false)
+		c.ServerName = route.RemoteHost
+		c.Route = route
+		if _, _, err = c.Greeting(ctx); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+	// All routes have been tested -> Fail !
+	return nil, errors.New("unable to get a client, all routes have been tested")
+}
@@ -0,0 +1,122 @@
+package smtpx
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Pool keeps idle connections for next deliveries to the same destination.
+// Connections are identified by a key chosen by the caller (eg destination
+// and routes), they are reset (RSET) before being reused.
+type Pool struct {
+	// IdleTimeout is the time connections are kept idle
+	IdleTimeout time.Duration
+
+	mu    sync.Mutex
+	conns map[string][]*poolConn
+}
+
+// poolConn represents an idle connection
+type poolConn struct {
+	c         *Client
+	uses      int // messages delivered through this connection
+	idleSince time.Time
+}
+
+// NewPool returns a pool keeping connections idle for idleTimeout
+func NewPool(idleTimeout time.Duration) *Pool {
+	return &Pool{
+		IdleTimeout: idleTimeout,
+		conns:       make(map[string][]*poolConn),
+	}
+}
+
+// Get returns an idle connection of key and the number of messages it has
+// delivered (nil if there is none)
+func (p *Pool) Get(ctx context.Context, key string) (*Client, int) {
+	for {
+		p.mu.Lock()
+		conns := p.conns[key]
+		if len(conns) == 0 {
+			p.mu.Unlock()
+			return nil, 0
+		}
+		pc := conns[len(conns)-1]
+		p.conns[key] = conns[:len(conns)-1]
+		p.mu.Unlock()
+		if time.Since(pc.idleSince) < p.IdleTimeout {
+			if _, _, err := pc.c.Rset(ctx); err == nil {
+				return pc.c, pc.uses
+			}
+		}
+		pc.c.Close()
+	}
+}
+
+// Put keeps c open for next deliveries of key, uses is the number of messages
+// it has delivered, at most max connections are kept per key
+// it returns false if c has not been kept
+func (p *Pool) Put(key string, c *Client, uses, max int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if max < 1 {
+		max = 1
+	}
+	if len(p.conns[key]) >= max {
+		return false
+	}
+	p.conns[key] = append(p.conns[key], &poolConn{c, uses, time.Now()})
+	return true
+}
+
+// Idle returns the number of idle connections whose key matches
+func (p *Pool) Idle(match func(key string) bool) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for key, conns := range p.conns {
+		if match(key) {
+			n += len(conns)
+		}
+	}
+	return n
+}
+
+// CloseAll closes (QUIT) all connections
+func (p *Pool) CloseAll(ctx context.Context) {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = make(map[string][]*poolConn)
+	p.mu.Unlock()
+	for _, kept := range conns {
+		for _, pc := range kept {
+			pc.c.Quit(ctx)
+		}
+	}
+}
+
+// CloseIdle closes (QUIT) connections idle for more than IdleTimeout
+func (p *Pool) CloseIdle(ctx context.Context) {
+	expired := []*Client{}
+	p.mu.Lock()
+	for key, conns := range p.conns {
+		kept := []*poolConn{}
+		for _, pc := range conns {
+			if time.Since(pc.idleSince) < p.IdleTimeout {
+				kept = append(kept, pc)
+			} else {
+				expired = append(expired, pc.c)
+			}
+		}
+		if len(kept) == 0 {
+			delete(p.conns, key)
+		} else {
+			p.conns[key] = kept
+		}
+	}
+	p.mu.Unlock()
+	for _, c := range expired {
+		c.Quit(ctx)
+	}
+}
@@ -0,0 +1,226 @@
+package smtpx
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Proxy is a proxy connections of a route go through
+type Proxy struct {
+	// Scheme is socks5, proxy (PROXY protocol v1) or proxy2 (v2)
+	Scheme string
+	// Addr is the address (host:port) of the proxy
+	Addr string
+	// User & Password of SOCKS5 authentication (none if User is empty)
+	User     string
+	Password string
+}
+
+// ParseProxy parses a proxy URI
+// socks5://[user:password@]host:port, proxy://host:port or
+// proxy2://host:port
+func ParseProxy(uri string) (*Proxy, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, errors.New("bad proxy " + uri + " - " + err.Error())
+	}
+	p := &Proxy{Scheme: u.Scheme, Addr: u.Host}
+	switch p.Scheme {
+	case "socks5":
+		if u.User != nil {
+			p.User = u.User.Username()
+			p.Password, _ = u.User.Password()
+		}
+	case "proxy", "proxy2":
+		if u.User != nil {
+			return nil, errors.New("bad proxy " + uri + " - no credentials with PROXY protocol")
+		}
+	default:
+		return nil, errors.New("bad proxy " + uri + " - scheme must be socks5, proxy or proxy2")
+	}
+	if _, _, err = net.SplitHostPort(p.Addr); err != nil {
+		return nil, errors.New("bad proxy " + uri + " - " + err.Error())
+	}
+	return p, nil
+}
+
+// String returns URI of proxy (without password)
+func (p *Proxy) String() string {
+	if p.User != "" {
+		return p.Scheme + "://" + p.User + "@" + p.Addr
+	}
+	return p.Scheme + "://" + p.Addr
+}
+
+// Dial returns a connection to remoteAddr (IP:port) through proxy p.
+// localIP is the source address sent in PROXY headers (address of the
+// connection to the proxy if nil), it's not used with SOCKS5.
+func (p *Proxy) Dial(ctx context.Context, dialer Dialer, localIP net.IP, remoteAddr string) (net.Conn, error) {
+	conn, err := dialer.Dial(ctx, "tcp", "", p.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(DefaultCommandTimeout))
+	}
+	switch p.Scheme {
+	case "socks5":
+		err = p.socks5Connect(conn, remoteAddr)
+	default:
+		err = p.writeProxyHeader(conn, localIP, remoteAddr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, errors.New("proxy " + p.String() + " - " + err.Error())
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// socks5Connect asks SOCKS5 server on conn to connect to remoteAddr
+// (RFC 1928, authentication RFC 1929)
+func (p *Proxy) socks5Connect(conn net.Conn, remoteAddr string) error {
+	host, portStr, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+	method := byte(0x00)
+	if p.User != "" {
+		method = 0x02
+	}
+	if _, err = conn.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 || reply[1] != method {
+		return errors.New("SOCKS5 authentication method refused")
+	}
+	if method == 0x02 {
+		if len(p.User) > 255 || len(p.Password) > 255 {
+			return errors.New("SOCKS5 credentials too long")
+		}
+		auth := []byte{1, byte(len(p.User))}
+		auth = append(auth, p.User...)
+		auth = append(auth, byte(len(p.Password)))
+		auth = append(auth, p.Password...)
+		if _, err = conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("SOCKS5 authentication failed")
+		}
+	}
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("SOCKS5 host name too long")
+		}
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 1)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 4)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		return fmt.Errorf("SOCKS5 connect to %s failed, code %d", remoteAddr, header[1])
+	}
+	// bound address
+	skip := 0
+	switch header[3] {
+	case 1:
+		skip = 4 + 2
+	case 4:
+		skip = 16 + 2
+	case 3:
+		l := make([]byte, 1)
+		if _, err = io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		skip = int(l[0]) + 2
+	default:
+		return errors.New("SOCKS5 bad address type in reply")
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip))
+	return err
+}
+
+// proxyHeaderV2Sig is the signature of PROXY v2 headers
+var proxyHeaderV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// writeProxyHeader sends PROXY header (source localIP, destination
+// remoteAddr) on conn
+func (p *Proxy) writeProxyHeader(conn net.Conn, localIP net.IP, remoteAddr string) error {
+	dstHost, dstPortStr, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return err
+	}
+	dstIP := net.ParseIP(dstHost)
+	dstPort, err := strconv.Atoi(dstPortStr)
+	if dstIP == nil || err != nil {
+		return errors.New("bad remote address " + remoteAddr)
+	}
+	srcIP, srcPort := localIP, 0
+	if srcIP == nil {
+		if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			srcIP, srcPort = addr.IP, addr.Port
+		}
+	}
+	if srcIP == nil || (srcIP.To4() != nil) != (dstIP.To4() != nil) {
+		return errors.New("source & destination of PROXY header must be both IPv4 or IPv6")
+	}
+	if p.Scheme == "proxy" {
+		family := "TCP6"
+		if dstIP.To4() != nil {
+			family = "TCP4"
+		}
+		_, err = fmt.Fprintf(conn, "PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, srcPort, dstPort)
+		return err
+	}
+	buf := bytes.NewBuffer(nil)
+	buf.Write(proxyHeaderV2Sig)
+	buf.WriteByte(0x21) // v2, PROXY
+	if src4, dst4 := srcIP.To4(), dstIP.To4(); src4 != nil {
+		buf.Write([]byte{0x11, 0, 12})
+		buf.Write(src4)
+		buf.Write(dst4)
+	} else {
+		buf.Write([]byte{0x21, 0, 36})
+		buf.Write(srcIP.To16())
+		buf.Write(dstIP.To16())
+	}
+	binary.Write(buf, binary.BigEndian, uint16(srcPort))
+	binary.Write(buf, binary.BigEndian, uint16(dstPort))
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,118 @@
+package smtpx
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Timeouts are timeouts of a client session, for each step of the session
+// (RFC 5321 4.5.3.2 recommends 5 minutes for greeting, MAIL and RCPT, 2
+// minutes for DATA initiation, 3 minutes for each data block and 10 minutes
+// for DATA termination). Zero values are replaced by DefaultTimeouts.
+type Timeouts struct {
+	// Connect limits TCP connection (and proxy handshake)
+	Connect time.Duration
+	// Greeting limits wait of the greeting of the server
+	Greeting time.Duration
+	// Ehlo limits EHLO, HELO and LHLO
+	Ehlo time.Duration
+	// StartTLS limits STARTTLS command and TLS handshake
+	StartTLS time.Duration
+	Mail     time.Duration
+	Rcpt     time.Duration
+	// DataInit limits DATA command (354 reply)
+	DataInit time.Duration
+	// DataBlock limits sending of each block of data (a BDAT chunk and its
+	// reply)
+	DataBlock time.Duration
+	// DataTerm limits wait of the reply to the end of data (final dot, BDAT
+	// LAST, LMTP replies)
+	DataTerm time.Duration
+	// Command limits other commands (NOOP, RSET, AUTH, XCLIENT, QUIT...)
+	Command time.Duration
+}
+
+// DefaultTimeouts are timeouts used when a timeout is zero
+var DefaultTimeouts = Timeouts{
+	Connect:   30 * time.Second,
+	Greeting:  30 * time.Second,
+	Ehlo:      10 * time.Second,
+	StartTLS:  30 * time.Second,
+	Mail:      30 * time.Second,
+	Rcpt:      30 * time.Second,
+	DataInit:  30 * time.Second,
+	DataBlock: 3 * time.Minute,
+	DataTerm:  5 * time.Minute,
+	Command:   30 * time.Second,
+}
+
+// timeouts by name (ParseTimeouts)
+func (t *Timeouts) byName() map[string]*time.Duration {
+	return map[string]*time.Duration{
+		"connect":    &t.Connect,
+		"greeting":   &t.Greeting,
+		"ehlo":       &t.Ehlo,
+		"starttls":   &t.StartTLS,
+		"mail":       &t.Mail,
+		"rcpt":       &t.Rcpt,
+		"data-init":  &t.DataInit,
+		"data-block": &t.DataBlock,
+		"data-term":  &t.DataTerm,
+		"command":    &t.Command,
+	}
+}
+
+// ParseTimeouts parses timeouts spec: name=duration separated by commas,
+// names are connect, greeting, ehlo, starttls, mail, rcpt, data-init,
+// data-block, data-term and command. Durations are Go durations (30s, 5m)
+// eg: connect=10s,greeting=5m,data-term=10m
+func ParseTimeouts(spec string) (t Timeouts, err error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return
+	}
+	byName := t.byName()
+	for _, part := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return t, errors.New("bad timeout " + part + " (name=duration expected)")
+		}
+		d, ok := byName[strings.ToLower(strings.TrimSpace(kv[0]))]
+		if !ok {
+			return t, errors.New("unknown timeout " + kv[0])
+		}
+		if *d, err = time.ParseDuration(strings.TrimSpace(kv[1])); err != nil {
+			return t, errors.New("bad duration of timeout " + kv[0] + " - " + err.Error())
+		}
+		if *d <= 0 {
+			return t, errors.New("timeout " + kv[0] + " must be positive")
+		}
+	}
+	return
+}
+
+// Merge returns t with its timeouts replaced by those of o which are not
+// zero
+func (t Timeouts) Merge(o Timeouts) Timeouts {
+	byName := t.byName()
+	for name, d := range o.byName() {
+		if *d != 0 {
+			*byName[name] = *d
+		}
+	}
+	return t
+}
+
+// String returns spec of timeouts which are not zero (see ParseTimeouts)
+func (t Timeouts) String() string {
+	parts := []string{}
+	for name, d := range t.byName() {
+		if *d != 0 {
+			parts = append(parts, name+"="+d.String())
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
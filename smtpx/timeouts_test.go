@@ -0,0 +1,31 @@
+package smtpx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTimeouts(t *testing.T) {
+	timeouts, err := ParseTimeouts("connect=10s, Greeting=5m,data-term=10m")
+	assert.NoError(t, err)
+	assert.Equal(t, Timeouts{Connect: 10 * time.Second, Greeting: 5 * time.Minute, DataTerm: 10 * time.Minute}, timeouts)
+	assert.Equal(t, "connect=10s,data-term=10m0s,greeting=5m0s", timeouts.String())
+
+	timeouts, err = ParseTimeouts("")
+	assert.NoError(t, err)
+	assert.Equal(t, Timeouts{}, timeouts)
+
+	for _, spec := range []string{"connect", "hello=10s", "mail=10", "rcpt=-1s"} {
+		_, err = ParseTimeouts(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestMergeTimeouts(t *testing.T) {
+	merged := DefaultTimeouts.Merge(Timeouts{Rcpt: time.Minute})
+	assert.Equal(t, time.Minute, merged.Rcpt)
+	assert.Equal(t, DefaultTimeouts.Mail, merged.Mail)
+	assert.Equal(t, 30*time.Second, DefaultTimeouts.Rcpt)
+}
@@ -11,15 +11,16 @@ import (
 	"os/signal"
 	"path"
 	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/bitly/nsq/nsqd"
 	"github.com/codegangsta/cli"
 
 	tcli "github.com/toorop/tmail/cli"
 	"github.com/toorop/tmail/core"
-	"github.com/toorop/tmail/rest"
+	"github.com/toorop/tmail/server"
 )
 
 const (
@@ -28,11 +29,19 @@ const (
 
 func init() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
+	core.Version = TmailVersion
+
+	// tmail config check reads the config file and opens the DB it points
+	// to itself: config of the environment (the running one, maybe broken)
+	// is neither validated nor used to open the DB
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "check" {
+		return
+	}
+
 	var err error
 	if err = core.ScopeBootstrap(); err != nil {
 		log.Fatalln(err)
 	}
-	core.Version = TmailVersion
 
 	// Check base path structure
 	requiredPaths := []string{"db", "nsq", "ssl"}
@@ -90,104 +99,84 @@ func main() {
 	app.Email = "toorop@tmail.io"
 	app.Version = TmailVersion
 	app.Commands = tcli.CliCommands
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "role",
+			Usage: "role of process: all, smtpd (acceptance only) or deliverd (delivery only), overrides TMAIL_ROLE",
+		},
+	}
 	// no know command ? Launch server
 	app.Action = func(c *cli.Context) {
 		if len(c.Args()) != 0 {
 			cli.ShowAppHelp(c)
 		} else {
-			// if there is nothing to do then... do nothing
-			if !core.Cfg.GetLaunchDeliverd() && !core.Cfg.GetLaunchSmtpd() {
-				log.Fatalln("I have nothing to do, so i do nothing. Bye.")
-			}
-
 			// Loop
 			sigChan := make(chan os.Signal, 1)
-			signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+			signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
 
-			// TODO
-			// Chanel to comunicate between all elements
-			//daChan := make(chan string)
-
-			// init and launch nsqd
-			opts := nsqd.NewNSQDOptions()
-			opts.Logger = log.New(ioutil.Discard, "", 0)
-			if core.Cfg.GetDebugEnabled() {
-				opts.Logger = core.Log
+			if role := c.String("role"); role != "" {
+				core.Cfg.SetRole(role)
 			}
-			opts.Verbose = core.Cfg.GetDebugEnabled()
-			opts.DataPath = core.GetBasePath() + "/nsq"
-			// if cluster get lookupd addresses
-			if core.Cfg.GetClusterModeEnabled() {
-				opts.NSQLookupdTCPAddresses = core.Cfg.GetNSQLookupdTcpAddresses()
+			srv := server.FromScope()
+			if err := srv.Start(); err != nil {
+				log.Fatalln(err)
 			}
 
-			// deflate (compression)
-			opts.DeflateEnabled = true
-
-			// if a message timeout it returns to the queue: https://groups.google.com/d/msg/nsq-users/xBQF1q4srUM/kX22TIoIs-QJ
-			// msg timeout : base time to wait from consummer before requeuing a message
-			// note: deliverd consumer return immediatly (message is handled in a go routine)
-			// Ce qui est au dessus est faux malgres la go routine il attends toujours a la réponse
-			// et c'est normal car le message est toujours "in flight"
-			// En fait ce timeout c'est le temps durant lequel le message peut rester dans le state "in flight"
-			// autrement dit c'est le temps maxi que peu prendre deliverd.processMsg
-			opts.MsgTimeout = 10 * time.Minute
-
-			// maximum duration before a message will timeout
-			opts.MaxMsgTimeout = 15 * time.Hour
-
-			// maximum requeuing timeout for a message
-			// si le client ne demande pas de requeue dans ce delais alors
-			// le message et considéré comme traité
-			opts.MaxReqTimeout = 1 * time.Hour
-
-			// Number of message in RAM before synching to disk
-			opts.MemQueueSize = 0
-
-			nsqd := nsqd.NewNSQD(opts)
-			nsqd.LoadMetadata()
-			err := nsqd.PersistMetadata()
-			if err != nil {
-				log.Fatalf("ERROR: failed to persist metadata - %s", err.Error())
+			// pid file (signals sent by CLI)
+			if err := ioutil.WriteFile(core.PidFile(), []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+				core.Log.Error("unable to write pid file - " + err.Error())
 			}
-			nsqd.Main()
-
-			// smtpd
-			if core.Cfg.GetLaunchSmtpd() {
-				// clamav ?
-				if core.Cfg.GetSmtpdClamavEnabled() {
-					if err = core.NewClamav().Ping(); err != nil {
-						log.Fatalln("Unable to connect to clamd -", err)
+
+			// SIGHUP: reload config, TLS certificates and header rules
+			hupChan := make(chan os.Signal, 1)
+			signal.Notify(hupChan, syscall.SIGHUP)
+			go func() {
+				for range hupChan {
+					changed, restart, err := core.ConfigReload()
+					if err != nil {
+						core.Log.Error("config - unable to reload " + core.ConfigFile() + ", running config is kept - " + err.Error())
+					} else {
+						if len(changed) != 0 {
+							core.Log.Info("config - reloaded, changed: " + strings.Join(changed, ", "))
+						}
+						if len(restart) != 0 {
+							core.Log.Info("config - restart needed to apply (tmail restart): " + strings.Join(restart, ", "))
+						}
+					}
+					if _, err := core.TLSCertsReload(); err != nil {
+						core.Log.Error("TLS - unable to reload certificates - " + err.Error())
 					}
+					core.HeaderRulesReload()
 				}
-
-				smtpdDsns, err := core.GetDsnsFromString(core.Cfg.GetSmtpdDsns())
+			}()
+
+			// SIGUSR2: restart, executable (new binary) is started with smtpd
+			// listeners, this process stops once it serves (it writes the
+			// pid file)
+			restarted := false
+			for sig := range sigChan {
+				if sig != syscall.SIGUSR2 {
+					break
+				}
+				bin, err := exec.LookPath(os.Args[0])
 				if err != nil {
-					log.Fatalln("unable to parse smtpd dsn -", err)
+					core.Log.Error("unable to restart - " + err.Error())
+					continue
 				}
-				for _, dsn := range smtpdDsns {
-					go core.NewSmtpd(dsn).ListenAndServe()
-					core.Log.Info("smtpd " + dsn.String() + " launched.")
+				core.Log.Info("restarting " + bin)
+				if err = srv.Restart(bin, os.Args); err != nil {
+					core.Log.Error("unable to restart, still running - " + err.Error())
+					continue
 				}
+				core.Log.Info("restart - new executable serves, stopping")
+				restarted = true
+				break
 			}
-
-			// deliverd
-			go core.LaunchDeliverd()
-
-			// HTTP REST server
-			if core.Cfg.GetRestServerLaunch() {
-				go rest.LaunchServer()
+			srv.Stop()
+			if !restarted {
+				os.Remove(core.PidFile())
 			}
 
-			<-sigChan
-			core.Log.Info("Exiting...")
-
-			// close NsqQueueProducer if exists
-			core.NsqQueueProducer.Stop()
-
-			// flush nsqd memory to disk
-			nsqd.Exit()
-
 			// exit
 			os.Exit(0)
 		}